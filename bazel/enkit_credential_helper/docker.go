@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// errDockerNotFound is the error docker expects on stdout when a helper has no credentials.
+var errDockerNotFound = errors.New("credentials not found in native keychain")
+
+// DockerCredentials is the format docker expects from a get request.
+type DockerCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func dockerGet(in io.Reader, out io.Writer) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	server := strings.TrimSpace(string(data))
+	if server == "" {
+		return fmt.Errorf("no server url supplied on stdin")
+	}
+
+	token, err := readToken(hostFromURI(server))
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return errDockerNotFound
+	}
+
+	return json.NewEncoder(out).Encode(&DockerCredentials{
+		ServerURL: server,
+		Username:  token.Username(),
+		Secret:    token.Token,
+	})
+}
+
+func newDockerCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "docker <get|store|erase|list>",
+		Short: "Act as a docker credential helper, also available as docker-credential-enkit",
+		Long: `Act as a docker credential helper, also available as docker-credential-enkit.
+
+To use it, make docker-credential-enkit a symlink to this binary in your PATH, and
+add to ~/.docker/config.json:
+
+	{"credHelpers": {"registry.example.com": "enkit"}}
+
+The token from 'enkit login' is returned as the secret. store and erase are
+accepted and ignored, as the token is managed by 'enkit login'.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case "get":
+				err := dockerGet(os.Stdin, os.Stdout)
+				if errors.Is(err, errDockerNotFound) {
+					fmt.Println(err)
+				}
+				return err
+			case "store", "erase":
+				_, err := io.Copy(io.Discard, os.Stdin)
+				return err
+			case "list":
+				// Hosts are selected by patterns, there is no list of servers to return.
+				fmt.Println("{}")
+				return nil
+			}
+			return fmt.Errorf("unknown docker credential helper operation %q", args[0])
+		},
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerGet(t *testing.T) {
+	setupConfig(t, &Rules{Rule: []Rule{
+		{Host: "registry.example.com"},
+	}}, "user@example.com", map[string]string{"user@example.com": "user-token"})
+
+	for _, server := range []string{"registry.example.com:5000\n", "https://registry.example.com/v2/"} {
+		out := &bytes.Buffer{}
+		require.NoError(t, dockerGet(strings.NewReader(server), out), server)
+
+		var creds DockerCredentials
+		require.NoError(t, json.Unmarshal(out.Bytes(), &creds), server)
+		assert.Equal(t, DockerCredentials{
+			ServerURL: strings.TrimSpace(server),
+			Username:  "user@example.com",
+			Secret:    "user-token",
+		}, creds, server)
+	}
+
+	out := &bytes.Buffer{}
+	assert.ErrorIs(t, dockerGet(strings.NewReader("other.example.com"), out), errDockerNotFound)
+	assert.Error(t, dockerGet(strings.NewReader(" \n"), out))
+	assert.Empty(t, out.String())
+}
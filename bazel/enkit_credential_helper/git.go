@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// readGitAttributes parses the key=value lines git writes on stdin, up to an empty line.
+func readGitAttributes(r io.Reader) (map[string]string, error) {
+	attrs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid line from git: %q", line)
+		}
+		attrs[key] = value
+	}
+	return attrs, scanner.Err()
+}
+
+func gitGet(in io.Reader, out io.Writer) error {
+	attrs, err := readGitAttributes(in)
+	if err != nil {
+		return err
+	}
+
+	host := attrs["host"]
+	if host == "" && attrs["url"] != "" {
+		host = hostFromURI(attrs["url"])
+	}
+	if host == "" {
+		return nil
+	}
+
+	token, err := readToken(host)
+	if err != nil {
+		return err
+	}
+	// Printing nothing lets git try the next helper, or prompt the user.
+	if token == nil {
+		return nil
+	}
+
+	username := attrs["username"]
+	if username == "" {
+		username = token.Username()
+	}
+	_, err = fmt.Fprintf(out, "username=%s\npassword=%s\n", username, token.Token)
+	return err
+}
+
+func newGitCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "git <get|store|erase>",
+		Short: "Act as a git credential helper, also available as git-credential-enkit",
+		Long: `Act as a git credential helper, also available as git-credential-enkit.
+
+To use it, make git-credential-enkit a symlink to this binary in your PATH, and run:
+
+	git config --global credential.https://git.example.com.helper enkit
+	git config --global http.https://git.example.com.proactiveAuth basic
+
+The token from 'enkit login' is returned as the password. store and erase are
+accepted and ignored, as the token is managed by 'enkit login'.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case "get":
+				return gitGet(os.Stdin, os.Stdout)
+			case "store", "erase":
+				_, err := io.Copy(io.Discard, os.Stdin)
+				return err
+			}
+			// Git requires unknown operations to be ignored.
+			return nil
+		},
+	}
+}
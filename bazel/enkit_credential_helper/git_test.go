@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitGet(t *testing.T) {
+	setupConfig(t, &Rules{Rule: []Rule{
+		{Host: "git.example.com", Identity: "ci@example.com"},
+	}}, "", map[string]string{"ci@example.com": "ci-token"})
+
+	for _, tc := range []struct {
+		in, expected string
+	}{
+		{"protocol=https\nhost=git.example.com\n\n", "username=ci@example.com\npassword=ci-token\n"},
+		{"protocol=https\r\nhost=git.example.com\r\nusername=me\r\n\r\n", "username=me\npassword=ci-token\n"},
+		{"url=https://git.example.com/repo.git\n", "username=ci@example.com\npassword=ci-token\n"},
+		// Attributes after the empty line are not part of the request.
+		{"protocol=https\n\nhost=git.example.com\n", ""},
+		{"protocol=https\nhost=other.example.com\n\n", ""},
+		{"", ""},
+	} {
+		out := &bytes.Buffer{}
+		assert.NoError(t, gitGet(strings.NewReader(tc.in), out), "%q", tc.in)
+		assert.Equal(t, tc.expected, out.String(), "%q", tc.in)
+	}
+
+	out := &bytes.Buffer{}
+	assert.Error(t, gitGet(strings.NewReader("invalid line\n"), out))
+	assert.Empty(t, out.String())
+}
@@ -4,15 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 
-	"github.com/ccontavalli/enkit/lib/config/defcon"
-	"github.com/ccontavalli/enkit/lib/config/identity"
 	"github.com/ccontavalli/enkit/lib/khttp/kcookie"
 	"github.com/ccontavalli/enkit/lib/stamp"
 )
@@ -71,39 +71,47 @@ func credsCheck(ctx context.Context, creds *Credentials, testURL string) error {
 	return nil
 }
 
-func readToken() (string, error) {
-	if token, ok := os.LookupEnv("ENKIT_OVERRIDE_TOKEN"); ok {
-		return token, nil
-	}
+// Request is the request sent by bazel on stdin.
+type Request struct {
+	Uri string `json:"uri"`
+}
 
-	store, err := identity.NewStore("enkit", defcon.Open)
-	if err != nil {
-		return "", fmt.Errorf("failed to open identity store %q: %w", "enkit", err)
+// readRequest reads the request from stdin, unless stdin is a terminal.
+func readRequest() (*Request, error) {
+	req := &Request{}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return req, nil
 	}
 
-	_, token, err := store.Load("")
-	return token, err
+	if err := json.NewDecoder(os.Stdin).Decode(req); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse request: %w", err)
+	}
+	return req, nil
 }
 
-func fetchCreds() (*Credentials, error) {
-	token, err := readToken()
+func fetchCreds(uri string) (*Credentials, error) {
+	token, err := readToken(hostFromURI(uri))
 	if err != nil {
 		return nil, err
 	}
 
-	cookie := kcookie.New("Creds", token)
-
-	creds := &Credentials{
-		Headers: map[string][]string{
-			"cookie": {cookie.String()},
-		},
+	creds := &Credentials{Headers: map[string][]string{}}
+	if token == nil {
+		return creds, nil
 	}
 
+	cookie := kcookie.New(token.CookieName(), token.Token)
+	creds.Headers["cookie"] = []string{cookie.String()}
 	return creds, nil
 }
 
 func getCommand(cmd *cobra.Command, args []string) error {
-	creds, err := fetchCreds()
+	req, err := readRequest()
+	if err != nil {
+		return err
+	}
+
+	creds, err := fetchCreds(req.Uri)
 	if err != nil {
 		return err
 	}
@@ -118,7 +126,7 @@ func getCommand(cmd *cobra.Command, args []string) error {
 }
 
 func checkCommand(cmd *cobra.Command, args []string) error {
-	creds, err := fetchCreds()
+	creds, err := fetchCreds(args[0])
 	if err != nil {
 		return fmt.Errorf(friendlyCredsError, err)
 	}
@@ -154,7 +162,7 @@ func main() {
 
 	getCmd := &cobra.Command{
 		Use:          "get",
-		Short:        "Print JSON-formatted credentials to stdout",
+		Short:        "Print JSON-formatted credentials for the uri requested on stdin",
 		RunE:         getCommand,
 		SilenceUsage: true,
 	}
@@ -179,6 +187,17 @@ func main() {
 	rootCmd.AddCommand(getCmd)
 	rootCmd.AddCommand(checkCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(newGitCommand())
+	rootCmd.AddCommand(newDockerCommand())
+
+	// git and docker run helpers by name: git-credential-enkit and
+	// docker-credential-enkit can be symlinks to this binary.
+	switch filepath.Base(os.Args[0]) {
+	case "git-credential-enkit":
+		rootCmd.SetArgs(append([]string{"git"}, os.Args[1:]...))
+	case "docker-credential-enkit":
+		rootCmd.SetArgs(append([]string{"docker"}, os.Args[1:]...))
+	}
 
 	exitIf(rootCmd.ExecuteContext(ctx))
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/defcon"
+	"github.com/ccontavalli/enkit/lib/config/identity"
+)
+
+// Rule selects the credentials to return for the hosts matching Host.
+type Rule struct {
+	// Host is a pattern as understood by path.Match, like "*.example.com".
+	// The port, if any, is not part of the match.
+	Host string
+	// Identity to load from the enkit identity store, like "user@example.com".
+	// If empty, the default identity is used.
+	Identity string
+	// Cookie is the name of the cookie carrying the token in bazel mode. Defaults to "Creds".
+	Cookie string
+	// Skip causes no credentials to be returned for the matching hosts.
+	Skip bool
+}
+
+// Rules are stored in the enkit_credential_helper config, under the "rules" key.
+//
+// For example, in ~/.config/enkit_credential_helper/rules.toml:
+//
+//	[[Rule]]
+//	Host = "*.internal.example.com"
+//
+//	[[Rule]]
+//	Host = "git.example.com"
+//	Identity = "ci@example.com"
+//
+// Rules are evaluated in order, the first matching one wins. If no rules
+// are configured, the default identity is returned for any host. If rules
+// are configured, hosts not matching any rule get no credentials.
+type Rules struct {
+	Rule []Rule
+}
+
+// Token is a token from the identity store, selected for a host.
+type Token struct {
+	Rule     Rule
+	Identity string
+	Token    string
+}
+
+// CookieName returns the name of the cookie to send the token in.
+func (t *Token) CookieName() string {
+	if t.Rule.Cookie != "" {
+		return t.Rule.Cookie
+	}
+	return "Creds"
+}
+
+// Username returns the username to use with protocols requiring one.
+//
+// Servers behind enproxy only look at the password, any non-empty username works.
+func (t *Token) Username() string {
+	if t.Identity != "" {
+		return t.Identity
+	}
+	return "enkit"
+}
+
+func loadRules() (*Rules, error) {
+	store, err := defcon.Open("enkit_credential_helper")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config store %q: %w", "enkit_credential_helper", err)
+	}
+	defer store.Close()
+
+	var rules Rules
+	if _, err := store.Unmarshal(config.Key("rules"), &rules); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
+	return &rules, nil
+}
+
+// Match returns the first rule matching the host, or nil.
+func (r *Rules) Match(host string) (*Rule, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for i := range r.Rule {
+		matched, err := path.Match(strings.ToLower(r.Rule[i].Host), host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", r.Rule[i].Host, err)
+		}
+		if matched {
+			return &r.Rule[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// hostFromURI returns the host of an uri, or the uri itself if it has no scheme.
+//
+// Docker passes registries as plain host names, like "registry.example.com:5000".
+func hostFromURI(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return strings.SplitN(uri, "/", 2)[0]
+}
+
+// readToken returns the token to use for the host, or nil if the host gets no credentials.
+//
+// ENKIT_OVERRIDE_TOKEN replaces the token from the identity store, but is only
+// returned for the hosts the rules would return credentials for.
+func readToken(host string) (*Token, error) {
+	rules, err := loadRules()
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &Rule{}
+	if rules != nil {
+		rule, err = rules.Match(host)
+		if err != nil {
+			return nil, err
+		}
+		if rule == nil || rule.Skip {
+			return nil, nil
+		}
+	}
+
+	if token, ok := os.LookupEnv("ENKIT_OVERRIDE_TOKEN"); ok {
+		return &Token{Rule: *rule, Token: token}, nil
+	}
+
+	store, err := identity.NewStore("enkit", defcon.Open)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity store %q: %w", "enkit", err)
+	}
+
+	id, token, err := store.Load(rule.Identity)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{Rule: *rule, Identity: id, Token: token}, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/defcon"
+	"github.com/ccontavalli/enkit/lib/config/directory"
+	"github.com/ccontavalli/enkit/lib/config/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupConfig points the config stores to a temporary directory, with the
+// identities and, if not nil, rules supplied.
+func setupConfig(t *testing.T, rules *Rules, def string, tokens map[string]string) {
+	t.Setenv("ENKIT_OVERRIDE_TOKEN", "")
+	os.Unsetenv("ENKIT_OVERRIDE_TOKEN")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	directory.Refresh()
+	t.Cleanup(directory.Refresh)
+
+	if rules != nil {
+		store, err := defcon.Open("enkit_credential_helper")
+		require.NoError(t, err)
+		require.NoError(t, store.Marshal(config.Key("rules"), rules))
+		require.NoError(t, store.Close())
+	}
+
+	ids, err := identity.NewStore("enkit", defcon.Open)
+	require.NoError(t, err)
+	for id, token := range tokens {
+		require.NoError(t, ids.Save(id, token))
+	}
+	if def != "" {
+		require.NoError(t, ids.SetDefault(def))
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+	rules := &Rules{Rule: []Rule{
+		{Host: "skip.internal.example.com", Skip: true},
+		{Host: "*.internal.example.com"},
+		{Host: "Git.Example.com", Identity: "ci@example.com"},
+	}}
+
+	for host, expected := range map[string]*Rule{
+		"skip.internal.example.com":      &rules.Rule[0],
+		"build.internal.example.com":     &rules.Rule[1],
+		"build.internal.example.com:443": &rules.Rule[1],
+		"BUILD.Internal.Example.com":     &rules.Rule[1],
+		"git.example.com":                &rules.Rule[2],
+		"git.example.com:8443":           &rules.Rule[2],
+		"internal.example.com":           nil,
+		// As with path.Match, * also matches dots.
+		"a.b.internal.example.com": &rules.Rule[1],
+		"example.com":              nil,
+		"":                         nil,
+	} {
+		rule, err := rules.Match(host)
+		assert.NoError(t, err, host)
+		assert.Equal(t, expected, rule, host)
+	}
+
+	invalid := &Rules{Rule: []Rule{{Host: "[invalid"}}}
+	_, err := invalid.Match("example.com")
+	assert.Error(t, err)
+
+	rule, err := (&Rules{}).Match("example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, rule)
+}
+
+func TestHostFromURI(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"https://git.example.com/repo.git":      "git.example.com",
+		"https://git.example.com:8443/repo.git": "git.example.com:8443",
+		"https://user@git.example.com/repo":     "git.example.com",
+		"registry.example.com":                  "registry.example.com",
+		"registry.example.com:5000":             "registry.example.com:5000",
+		"registry.example.com/image":            "registry.example.com",
+		"":                                      "",
+	} {
+		assert.Equal(t, expected, hostFromURI(uri), uri)
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	tokens := map[string]string{"user@example.com": "user-token", "ci@example.com": "ci-token"}
+
+	// Without rules, the default identity is returned for any host.
+	setupConfig(t, nil, "user@example.com", tokens)
+	token, err := readToken("anything.example.org")
+	require.NoError(t, err)
+	assert.Equal(t, &Token{Identity: "user@example.com", Token: "user-token"}, token)
+
+	// With rules, the identity of the matching rule, or nothing.
+	rules := &Rules{Rule: []Rule{
+		{Host: "skip.example.com", Skip: true},
+		{Host: "git.example.com", Identity: "ci@example.com"},
+		{Host: "*.example.com", Cookie: "Other"},
+	}}
+	setupConfig(t, rules, "user@example.com", tokens)
+
+	token, err = readToken("git.example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, &Token{Rule: rules.Rule[1], Identity: "ci@example.com", Token: "ci-token"}, token)
+
+	token, err = readToken("www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "user-token", token.Token)
+	assert.Equal(t, "Other", token.CookieName())
+
+	for _, host := range []string{"skip.example.com", "example.org"} {
+		token, err = readToken(host)
+		assert.NoError(t, err, host)
+		assert.Nil(t, token, host)
+	}
+
+	// The override replaces the token, but the rules still apply.
+	t.Setenv("ENKIT_OVERRIDE_TOKEN", "override")
+	for _, host := range []string{"skip.example.com", "example.org"} {
+		token, err = readToken(host)
+		assert.NoError(t, err, host)
+		assert.Nil(t, token, host)
+	}
+	token, err = readToken("www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &Token{Rule: rules.Rule[2], Token: "override"}, token)
+	assert.Equal(t, "Other", token.CookieName())
+	assert.Equal(t, "enkit", token.Username())
+
+	// Without rules, it is returned for any host.
+	setupConfig(t, nil, "user@example.com", tokens)
+	t.Setenv("ENKIT_OVERRIDE_TOKEN", "override")
+	token, err = readToken("skip.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &Token{Token: "override"}, token)
+	assert.Equal(t, "Creds", token.CookieName())
+}
@@ -8,11 +8,15 @@ import (
 	ocommands "github.com/ccontavalli/enkit/enkit/outputs"
 	vcommands "github.com/ccontavalli/enkit/enkit/version"
 	bazelcmds "github.com/ccontavalli/enkit/lib/bazel/commands"
+	cachecmds "github.com/ccontavalli/enkit/lib/cache/commands"
 	"github.com/ccontavalli/enkit/lib/client"
 	bcommands "github.com/ccontavalli/enkit/lib/client/commands"
+	emailcmds "github.com/ccontavalli/enkit/lib/kemail/commands"
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
+	kconfigcmds "github.com/ccontavalli/enkit/lib/kflags/kconfig/commands"
 	"github.com/ccontavalli/enkit/lib/srand"
+	mcommands "github.com/ccontavalli/enkit/machinist/client"
 	tcommands "github.com/ccontavalli/enkit/proxy/ptunnel/commands"
 
 	"github.com/spf13/cobra"
@@ -60,6 +64,15 @@ func New() (*EnkitCommand, error) {
 	bazel := bazelcmds.New(base)
 	root.AddCommand(bazel.Command)
 
+	cache := cachecmds.New(base)
+	root.AddCommand(cache.Command)
+
+	email := emailcmds.New(base)
+	root.AddCommand(email.Command)
+
+	config := kconfigcmds.New(base)
+	root.AddCommand(config.Command)
+
 	versionCmd := vcommands.New(base)
 	root.AddCommand(versionCmd.Command)
 
@@ -75,6 +88,8 @@ func New() (*EnkitCommand, error) {
 	}
 	root.AddCommand(machineCert.Command)
 
+	root.AddCommand(mcommands.NewCommand(base))
+
 	return &EnkitCommand{
 		cmd:       root,
 		baseFlags: base,
@@ -13,6 +13,7 @@ import (
 	"github.com/ccontavalli/enkit/lib/client"
 	"github.com/ccontavalli/enkit/lib/karchive"
 	"github.com/ccontavalli/enkit/lib/kbuildbarn"
+	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
 	"github.com/ccontavalli/enkit/lib/multierror"
 
 	"github.com/spf13/cobra"
@@ -177,6 +178,7 @@ type Run struct {
 	InvocationID string
 	DirPath      string
 	ZipPath      string
+	Sandbox      *faketreeexec.Sandbox
 }
 
 func NewRun(root *Root) *Run {
@@ -197,7 +199,11 @@ func NewRun(root *Root) *Run {
 	paths are correct within the outputs themselves.
 
   $ enkit outputs run --zip-path=/tmp/some-zip -- find .
-	Runs "find ." in the unpacked zip after it is rerooted.`,
+	Runs "find ." in the unpacked zip after it is rerooted.
+
+  $ enkit outputs run --dir-path=/tmp/some_dir --net=none --memory=4G --seccomp=default -- ./run_tests.sh
+	Runs the tests with no network access, at most 4G of memory, and a seccomp
+	profile denying system calls not expected from tests.`,
 		},
 		root: root,
 	}
@@ -207,6 +213,7 @@ func NewRun(root *Root) *Run {
 	command.Flags().StringVar(&command.InvocationID, "invocation-id", "", "If set, the build's invocation ID from which to mount artifacts")
 	command.Flags().StringVar(&command.DirPath, "dir-path", "", "If set, the path to already-unpacked artifacts to reroot")
 	command.Flags().StringVar(&command.ZipPath, "zip-path", "", "If set, the path to a zipped outputs file to unpack and re-root")
+	command.Sandbox = faketreeexec.DefaultSandbox().Register(&kcobra.FlagSet{FlagSet: command.Flags()}, "")
 	return command
 }
 
@@ -223,7 +230,7 @@ func (c *Run) Run(cmd *cobra.Command, args []string) error {
 		}
 		defer unzipDir.Close()
 		promptStr := fmt.Sprintf("\n[Artifacts shell: %s]\n\\w > ", c.ZipPath)
-		if err := faketreeexec.Run(
+		if err := c.Sandbox.Run(
 			ctx,
 			promptStr,
 			map[string]string{
@@ -237,7 +244,7 @@ func (c *Run) Run(cmd *cobra.Command, args []string) error {
 
 	case c.DirPath != "":
 		promptStr := fmt.Sprintf("\n[Artifacts shell: %s]\n\\w > ", c.DirPath)
-		if err := faketreeexec.Run(
+		if err := c.Sandbox.Run(
 			ctx,
 			promptStr,
 			map[string]string{
@@ -4,34 +4,40 @@ package asset_service
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/hex"
 	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	grpc_status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"log"
-	"net/http"
-	"strconv"
-	"strings"
+	"time"
 )
 
 type assetServer struct {
 	cache           CacheProxy
 	assetDownloader AssetDownloader
+	index           Index
+	limits          ExtractLimits
+	pushEnabled     bool
 	accessLogger    *log.Logger
 	errorLogger     *log.Logger
 }
 
-func RegisterAssetServer(config Config, server *grpc.Server, cache CacheProxy, assetDownloader AssetDownloader) {
-	asset.RegisterFetchServer(server, &assetServer{
+func RegisterAssetServer(config Config, server *grpc.Server, cache CacheProxy, assetDownloader AssetDownloader, index Index) {
+	s := &assetServer{
 		cache:           cache,
 		assetDownloader: assetDownloader,
+		index:           index,
+		limits:          config.ExtractLimits(),
+		pushEnabled:     config.PushEnabled(),
 		accessLogger:    config.AccessLogger(),
 		errorLogger:     config.ErrorLogger(),
-	})
+	}
+	asset.RegisterFetchServer(server, s)
+	asset.RegisterPushServer(server, s)
 }
 
 var errNilFetchBlobRequest = grpc_status.Error(codes.InvalidArgument, "expected a non-nil *FetchBlobRequest")
@@ -42,82 +48,41 @@ func (s *assetServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest
 		return nil, errNilFetchBlobRequest
 	}
 
-	var sha256Str string
-
-	globalHeader := http.Header{}
-
-	uriSpecificHeaders := make(map[int]http.Header)
+	q, st := parseQualifiers(s.errorLogger, req.GetUris(), req.GetQualifiers())
+	if st != nil {
+		return &asset.FetchBlobResponse{Status: st}, nil
+	}
 
-	for _, q := range req.GetQualifiers() {
-		if q == nil {
+	for _, uri := range req.GetUris() {
+		entry := s.lookup(ctx, IndexKindBlob, uri, req.GetQualifiers(), req.GetOldestContentAccepted())
+		// The qualifiers are part of the key, but never trust the index to return
+		// content not matching the checksum requested.
+		if entry != nil && !q.matchesSha256(entry.Hash) {
+			s.errorLogger.Printf("index entry for \"%s\" has hash %s, not matching %s", uri, entry.Hash, q.sri)
+			entry = nil
+		}
+		if entry != nil {
+			s.accessLogger.Printf("INDEX HIT %s %s/%d", uri, entry.Hash, entry.Size)
 			return &asset.FetchBlobResponse{
-				Status: &status.Status{
-					Code:    int32(codes.InvalidArgument),
-					Message: "unexpected nil qualifier in FetchBlobRequest",
-				},
+				Status:     &status.Status{Code: int32(codes.OK)},
+				BlobDigest: entry.Digest(),
+				Uri:        uri,
+				ExpiresAt:  timestamppb.New(entry.Expires),
 			}, nil
 		}
+	}
 
-		const QualifierHTTPHeaderPrefix = "http_header:"
-		const QualifierHTTPHeaderUrlPrefix = "http_header_url:"
-
-		if strings.HasPrefix(q.Name, QualifierHTTPHeaderPrefix) {
-			key := q.Name[len(QualifierHTTPHeaderPrefix):]
-
-			globalHeader[key] = strings.Split(q.Value, ",")
-			continue
-		} else if strings.HasPrefix(q.Name, QualifierHTTPHeaderUrlPrefix) {
-			idxAndKey := q.Name[len(QualifierHTTPHeaderUrlPrefix):]
-			parts := strings.Split(idxAndKey, ":")
-			if len(parts) != 2 {
-				s.errorLogger.Printf("invalid http_header_url qualifier: \"%s\"", idxAndKey)
-				continue
-			}
-
-			uriIndex, err := strconv.Atoi(parts[0])
-			if err != nil {
-				s.errorLogger.Printf("failed to parse URI index as int: %s", err)
-				continue
-			}
-
-			if uriIndex < 0 || uriIndex >= len(req.GetUris()) {
-				s.errorLogger.Printf("URI index for header is out of range [0 - %d]: %d", len(req.GetUris())-1, uriIndex)
-				continue
-			}
-
-			if _, found := uriSpecificHeaders[uriIndex]; !found {
-				uriSpecificHeaders[uriIndex] = make(http.Header)
-			}
-			uriSpecificHeaders[uriIndex].Add(parts[1], q.Value)
-
-			continue
-		}
-
-		if q.Name == "checksum.sri" && strings.HasPrefix(q.Value, "sha256-") {
-			// Ref: https://developer.mozilla.org/en-US/docs/Web/Security/Subresource_Integrity
-
-			b64hash := strings.TrimPrefix(q.Value, "sha256-")
-
-			decoded, err := base64.StdEncoding.DecodeString(b64hash)
-			if err != nil {
-				s.errorLogger.Printf("failed to base64 decode \"%s\": %v",
-					b64hash, err)
-				continue
-			}
-
-			sha256Str = hex.EncodeToString(decoded)
-
-			found, err := s.cache.Contains(ctx, sha256Str)
+	if q.sha256 != "" {
+		found, err := s.cache.Contains(ctx, q.sha256)
 
-			if err != nil {
-				s.errorLogger.Printf("failed to query  cache.Contains: %s", err)
-			} else if found != nil {
-				s.accessLogger.Printf("CACHE HIT %s/%d", found.Hash, found.SizeBytes)
-				return &asset.FetchBlobResponse{
-					Status:     &status.Status{Code: int32(codes.OK)},
-					BlobDigest: found,
-				}, nil
-			}
+		if err != nil {
+			s.errorLogger.Printf("failed to query  cache.Contains: %s", err)
+		} else if found != nil {
+			s.accessLogger.Printf("CACHE HIT %s/%d", found.Hash, found.SizeBytes)
+			return &asset.FetchBlobResponse{
+				Status:     &status.Status{Code: int32(codes.OK)},
+				BlobDigest: found,
+			}, nil
 		}
 	}
 
@@ -125,24 +90,28 @@ func (s *assetServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest
 	md, _ := metadata.FromIncomingContext(ctx)
 
 	for uriIndex, uri := range req.GetUris() {
-		uriSpecificHeader := globalHeader.Clone()
-		if header, found := uriSpecificHeaders[uriIndex]; found {
-			for key, value := range header {
-				uriSpecificHeader[key] = value
-			}
-		}
-
-		digest, err := s.assetDownloader.FetchItem(uri, uriSpecificHeader, md, sha256Str)
+		digest, err := s.assetDownloader.FetchItem(uri, q.headers(uriIndex), md, q.sha256)
 		if err != nil {
 			s.errorLogger.Printf("failed to fetch item \"%s\": %v", uri, err)
 		}
 
 		if digest != nil {
-			return &asset.FetchBlobResponse{
+			response := &asset.FetchBlobResponse{
 				Status:     &status.Status{Code: int32(codes.OK)},
 				BlobDigest: digest,
 				Uri:        uri,
-			}, nil
+			}
+
+			if q.hasHeaders(uriIndex) {
+				return response, nil
+			}
+			entry, err := s.index.Put(IndexKindBlob, uri, req.GetQualifiers(), digest, time.Time{})
+			if err != nil {
+				s.errorLogger.Printf("failed to index \"%s\": %v", uri, err)
+			} else {
+				response.ExpiresAt = timestamppb.New(entry.Expires)
+			}
+			return response, nil
 		}
 
 		// Not a simple file. Not yet handled...
@@ -153,6 +122,69 @@ func (s *assetServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest
 	}, nil
 }
 
-func (s *assetServer) FetchDirectory(context.Context, *asset.FetchDirectoryRequest) (*asset.FetchDirectoryResponse, error) {
-	return nil, grpc_status.Errorf(codes.Unimplemented, "GetZstd not implemented")
+// lookup returns the entry in the index for the uri, if its content is still in the CAS.
+//
+// Errors are logged, and treated as if the uri was not in the index.
+func (s *assetServer) lookup(ctx context.Context, kind, uri string, qualifiers []*asset.Qualifier, oldest *timestamppb.Timestamp) *IndexEntry {
+	var oldestTime time.Time
+	if oldest != nil {
+		oldestTime = oldest.AsTime()
+	}
+
+	entry, err := s.index.Get(kind, uri, qualifiers, oldestTime)
+	if err != nil {
+		s.errorLogger.Printf("failed to query index for \"%s\": %v", uri, err)
+		return nil
+	}
+	if entry == nil {
+		return nil
+	}
+
+	isMissing, err := s.cache.IsMissing(ctx, entry.Digest())
+	if err != nil {
+		s.errorLogger.Printf("failed to query cache.IsMissing: %s", err)
+		return nil
+	}
+	if isMissing {
+		return nil
+	}
+
+	// The root Directory is not enough: the rest of the tree may have been evicted.
+	if kind == IndexKindDirectory {
+		complete, err := s.treeComplete(ctx, entry.Digest())
+		if err != nil {
+			s.errorLogger.Printf("failed to check the tree of \"%s\": %s", uri, err)
+			return nil
+		}
+		if !complete {
+			s.errorLogger.Printf("tree of \"%s\" is not fully in the cache, fetching it again", uri)
+			return nil
+		}
+	}
+	return entry
+}
+
+// treeComplete returns true if the Directory at root, and all the files and
+// Directories below it, are in the CAS.
+func (s *assetServer) treeComplete(ctx context.Context, root *pb.Digest) (bool, error) {
+	directories, err := s.cache.GetTree(ctx, root)
+	if err != nil || len(directories) == 0 {
+		return false, err
+	}
+
+	// GetTree omits the missing Directories, look for all the ones referenced.
+	digests := []*pb.Digest{root}
+	for _, directory := range directories {
+		for _, file := range directory.Files {
+			digests = append(digests, file.Digest)
+		}
+		for _, child := range directory.Directories {
+			digests = append(digests, child.Digest)
+		}
+	}
+	missing, err := s.cache.FindMissing(ctx, digests)
+	if err != nil {
+		return false, err
+	}
+	return len(missing) == 0, nil
 }
@@ -31,6 +31,9 @@ const (
 	// The maximum chunk size to write back to the client in Send calls.
 	// Inspired by Goma's FileBlob.FILE_CHUNK maxium size.
 	maxChunkSize = 2 * 1024 * 1024 // 2M
+
+	// The maximum number of digests to check in a single FindMissingBlobs call.
+	maxFindMissingDigests = 1000
 )
 
 type CacheProxy interface {
@@ -38,7 +41,10 @@ type CacheProxy interface {
 	IsMissing(ctx context.Context, digest *pb.Digest) (bool, error)
 	Contains(ctx context.Context, hash string) (*pb.Digest, error)
 	Put(ctx context.Context, uuid string, digest *pb.Digest, rc io.ReadCloser) error
+	PutBlob(ctx context.Context, uuid string, digest *pb.Digest, rc io.ReadCloser) error
 	GetToFile(ctx context.Context, uuid string, hash string) (*os.File, error)
+	FindMissing(ctx context.Context, digests []*pb.Digest) ([]*pb.Digest, error)
+	GetTree(ctx context.Context, root *pb.Digest) ([]*pb.Directory, error)
 }
 
 type cacheProxy struct {
@@ -200,6 +206,48 @@ func (cp *cacheProxy) IsMissing(ctx context.Context, digest *pb.Digest) (bool, e
 	}
 }
 
+// FindMissing returns the digests that are not in the CAS.
+func (cp *cacheProxy) FindMissing(ctx context.Context, digests []*pb.Digest) ([]*pb.Digest, error) {
+	var missing []*pb.Digest
+	for start := 0; start < len(digests); start += maxFindMissingDigests {
+		end := min(start+maxFindMissingDigests, len(digests))
+		resp, err := cp.cas.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+			BlobDigests: digests[start:end],
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error on query FindMissingBlobs: %s", err)
+		}
+		missing = append(missing, resp.MissingBlobDigests...)
+	}
+	return missing, nil
+}
+
+// GetTree returns the Directory at root, and the Directories below it.
+//
+// Directories missing from the CAS are omitted, as per GetTree semantics. Returns
+// nil if the root Directory itself is missing.
+func (cp *cacheProxy) GetTree(ctx context.Context, root *pb.Digest) ([]*pb.Directory, error) {
+	stream, err := cp.cas.GetTree(ctx, &pb.GetTreeRequest{RootDigest: root})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error on query GetTree: %s", err)
+	}
+
+	var directories []*pb.Directory
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return directories, nil
+		}
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, nil
+			}
+			return nil, status.Errorf(codes.Internal, "error on query GetTree: %s", err)
+		}
+		directories = append(directories, resp.Directories...)
+	}
+}
+
 func (cp *cacheProxy) Contains(ctx context.Context, hash string) (*pb.Digest, error) {
 	actionResult, err := cp.ac.GetActionResult(ctx, &pb.GetActionResultRequest{
 		ActionDigest: actionDigest(hash),
@@ -381,6 +429,25 @@ func (cp *cacheProxy) Put(ctx context.Context, uuid string, digest *pb.Digest, r
 	return nil
 }
 
+// PutBlob uploads the blob into the CAS, without indexing it in the action cache.
+func (cp *cacheProxy) PutBlob(ctx context.Context, uuid string, digest *pb.Digest, rc io.ReadCloser) error {
+	defer rc.Close()
+
+	isMissing, err := cp.IsMissing(ctx, digest)
+	if err != nil || !isMissing {
+		return err
+	}
+
+	err = cp.bsWrite(ctx, uuid, digest, rc)
+	if err != nil && err != io.EOF {
+		se := status.Convert(err)
+		if se == nil || se.Message() != "EOF" {
+			return err
+		}
+	}
+	return nil
+}
+
 func (cp *cacheProxy) GetToFile(ctx context.Context, uuid string, hash string) (*os.File, error) {
 	digest, err := cp.Contains(ctx, hash)
 	if err != nil {
@@ -436,14 +503,14 @@ func (cp *cacheProxy) GetToFile(ctx context.Context, uuid string, hash string) (
 	}
 
 	if write != digest.SizeBytes {
-		return nil, status.Errorf(codes.DataLoss, "downloaded size: %d, differ from requested: %d")
+		return nil, status.Errorf(codes.DataLoss, "downloaded size: %d, differ from requested: %d", write, digest.SizeBytes)
 	}
 
 	hashBytes := h.Sum(nil)
 	hashStr := hex.EncodeToString(hashBytes[:])
 
 	if hashStr != hash {
-		return nil, status.Errorf(codes.DataLoss, ": %s", err)
+		return nil, status.Errorf(codes.DataLoss, "downloaded hash: %s, differ from requested: %s", hashStr, hash)
 	}
 
 	isOk = true
@@ -20,6 +20,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type CacheConfig interface {
@@ -34,6 +35,9 @@ type Config interface {
 	MetadataExtractor() bbgrpc.MetadataExtractor
 
 	ParallelDownloads() int32
+	IndexTTL() time.Duration
+	ExtractLimits() ExtractLimits
+	PushEnabled() bool
 	SkipSchemes() map[string]bool
 	SkipHosts() map[string]bool
 	AccessLogger() *log.Logger
@@ -87,6 +91,19 @@ type config struct {
 	AssetDownloader struct {
 		QueueSize int32 `json:"queue_size"`
 	} `json:"asset_downloader"`
+	Index struct {
+		Ttl string `json:"ttl"`
+	} `json:"index"`
+	// Limits on the archives unpacked by FetchDirectory. 0 uses the default, negative values disable the limit.
+	Extract struct {
+		MaxSize     int64 `json:"max_size"`
+		MaxFileSize int64 `json:"max_file_size"`
+		MaxEntries  int   `json:"max_entries"`
+	} `json:"extract"`
+	// Push lets any client bind uris to content in the CAS, so it is disabled unless explicitly enabled.
+	Push struct {
+		Enabled bool `json:"enabled"`
+	} `json:"push"`
 	UrlFilter struct {
 		SkipHosts []string `json:"skip_hosts"`
 	} `json:"url_filter"`
@@ -95,6 +112,7 @@ type config struct {
 		AddMetadataJmespathExpression *jmespathconfig.Expression                   `json:"add_metadata_jmespath_expression,omitempty"`
 	} `json:"metadata"`
 	metadataExtractor bbgrpc.MetadataExtractor
+	indexTTL          time.Duration
 }
 
 type metadataExtractor struct {
@@ -117,6 +135,15 @@ func (m *metadataExtractor) extractMetadata(ctx context.Context) (bbgrpc.Metadat
 }
 
 func (cfg *config) Init(group program.Group) error {
+	cfg.indexTTL = 30 * 24 * time.Hour
+	if cfg.Index.Ttl != "" {
+		ttl, err := time.ParseDuration(cfg.Index.Ttl)
+		if err != nil {
+			return util.StatusWrap(err, "Failed to parse index ttl")
+		}
+		cfg.indexTTL = ttl
+	}
+
 	var metadataHeaderValues bbgrpc.MetadataHeaderValues
 	for _, entry := range cfg.Metadata.AddMetadata {
 		metadataHeaderValues.Add(entry.Header, entry.Values)
@@ -161,6 +188,32 @@ func (cfg *config) ParallelDownloads() int32 {
 	return cfg.AssetDownloader.QueueSize
 }
 
+func (cfg *config) IndexTTL() time.Duration {
+	return cfg.indexTTL
+}
+
+func (cfg *config) ExtractLimits() ExtractLimits {
+	limits := ExtractLimits{
+		MaxSize:     cfg.Extract.MaxSize,
+		MaxFileSize: cfg.Extract.MaxFileSize,
+		MaxEntries:  cfg.Extract.MaxEntries,
+	}
+	if limits.MaxSize == 0 {
+		limits.MaxSize = DefaultExtractMaxSize
+	}
+	if limits.MaxFileSize == 0 {
+		limits.MaxFileSize = DefaultExtractMaxFileSize
+	}
+	if limits.MaxEntries == 0 {
+		limits.MaxEntries = DefaultExtractMaxEntries
+	}
+	return limits
+}
+
+func (cfg *config) PushEnabled() bool {
+	return cfg.Push.Enabled
+}
+
 func (cfg *config) SkipSchemes() map[string]bool {
 	return map[string]bool{"file": true}
 }
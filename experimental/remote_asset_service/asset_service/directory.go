@@ -0,0 +1,454 @@
+package asset_service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/ccontavalli/enkit/lib/karchive"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpc_status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNilFetchDirectoryRequest = grpc_status.Error(codes.InvalidArgument, "expected a non-nil *FetchDirectoryRequest")
+
+// Default limits on the archives unpacked by FetchDirectory.
+const (
+	DefaultExtractMaxSize     = 16 << 30
+	DefaultExtractMaxFileSize = 4 << 30
+	DefaultExtractMaxEntries  = 1 << 20
+)
+
+// ExtractLimits bounds the content of the archives unpacked by FetchDirectory.
+//
+// Archives compress well, so a small download can otherwise fill the disk of
+// the server. Zero or negative values mean no limit.
+type ExtractLimits struct {
+	// Total uncompressed size of the files, in bytes.
+	MaxSize int64
+	// Uncompressed size of each file, in bytes.
+	MaxFileSize int64
+	// Number of files, directories and symlinks.
+	MaxEntries int
+}
+
+// modifiers returns the karchive options enforcing the limits.
+func (l ExtractLimits) modifiers() []karchive.Modifier {
+	return []karchive.Modifier{
+		karchive.WithMaxSize(l.MaxSize),
+		karchive.WithMaxFileSize(l.MaxFileSize),
+		karchive.WithMaxEntries(l.MaxEntries),
+	}
+}
+
+// archiveExtensions maps the resource_type qualifier to the extension used to unpack the archive.
+var archiveExtensions = map[string]string{
+	"application/zip":     ".zip",
+	"application/x-tar":   ".tar",
+	"application/gzip":    ".tar.gz",
+	"application/x-gzip":  ".tar.gz",
+	"application/x-xz":    ".tar.xz",
+	"application/zstd":    ".tar.zst",
+	"application/x-bzip2": ".tar.bz2",
+}
+
+// sriHashes are the Subresource Integrity algorithms that can be verified.
+var sriHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// FetchDirectory downloads an archive, unpacks it, and uploads the resulting tree in the CAS.
+//
+// The root digest of the tree is remembered in the index, so following requests for
+// the same uri and qualifiers don't need to download and unpack the archive again.
+func (s *assetServer) FetchDirectory(ctx context.Context, req *asset.FetchDirectoryRequest) (*asset.FetchDirectoryResponse, error) {
+	if req == nil {
+		return nil, errNilFetchDirectoryRequest
+	}
+
+	if len(req.GetUris()) == 0 {
+		return nil, grpc_status.Error(codes.InvalidArgument, "expected at least one uri in FetchDirectoryRequest")
+	}
+
+	if df := req.GetDigestFunction(); df != pb.DigestFunction_UNKNOWN && df != pb.DigestFunction_SHA256 {
+		return &asset.FetchDirectoryResponse{
+			Status: &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: fmt.Sprintf("unsupported digest function %s", df),
+			},
+		}, nil
+	}
+
+	q, st := parseQualifiers(s.errorLogger, req.GetUris(), req.GetQualifiers())
+	if st != nil {
+		return &asset.FetchDirectoryResponse{Status: st}, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// Any uri already in the index is preferred to downloading any of them.
+	for _, uri := range req.GetUris() {
+		entry := s.lookup(ctx, IndexKindDirectory, uri, req.GetQualifiers(), req.GetOldestContentAccepted())
+		if entry != nil {
+			s.accessLogger.Printf("INDEX HIT %s %s/%d", uri, entry.Hash, entry.Size)
+			return &asset.FetchDirectoryResponse{
+				Status:              &status.Status{Code: int32(codes.OK)},
+				Uri:                 uri,
+				ExpiresAt:           timestamppb.New(entry.Expires),
+				RootDirectoryDigest: entry.Digest(),
+			}, nil
+		}
+	}
+
+	var lastErr error
+	for uriIndex, uri := range req.GetUris() {
+		root, err := s.fetchDirectory(ctx, uri, q.headers(uriIndex), md, q)
+		if err != nil {
+			s.errorLogger.Printf("failed to fetch directory \"%s\": %v", uri, err)
+			lastErr = err
+			continue
+		}
+
+		s.accessLogger.Printf("GRPC ASSET DIRECTORY %s %s/%d", uri, root.Hash, root.SizeBytes)
+		response := &asset.FetchDirectoryResponse{
+			Status:              &status.Status{Code: int32(codes.OK)},
+			Uri:                 uri,
+			RootDirectoryDigest: root,
+		}
+
+		if q.hasHeaders(uriIndex) {
+			return response, nil
+		}
+		entry, err := s.index.Put(IndexKindDirectory, uri, req.GetQualifiers(), root, time.Time{})
+		if err != nil {
+			s.errorLogger.Printf("failed to index \"%s\": %v", uri, err)
+		} else {
+			response.ExpiresAt = timestamppb.New(entry.Expires)
+		}
+		return response, nil
+	}
+
+	if lastErr != nil {
+		return &asset.FetchDirectoryResponse{Status: grpc_status.Convert(lastErr).Proto()}, nil
+	}
+	return &asset.FetchDirectoryResponse{
+		Status: &status.Status{Code: int32(codes.NotFound)},
+	}, nil
+}
+
+// fetchDirectory downloads the archive at uri, and uploads its content in the CAS.
+//
+// Returns the digest of the root Directory.
+func (s *assetServer) fetchDirectory(ctx context.Context, uri string, headers http.Header, md metadata.MD, q *fetchQualifiers) (*pb.Digest, error) {
+	digest, err := s.assetDownloader.FetchItem(uri, headers, md, q.sha256)
+	if err != nil {
+		return nil, err
+	}
+	if digest == nil {
+		return nil, grpc_status.Errorf(codes.NotFound, "could not download %s", uri)
+	}
+
+	id := uuid.New().String()
+	archive, err := s.cache.GetToFile(ctx, id, digest.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if archive == nil {
+		return nil, grpc_status.Errorf(codes.NotFound, "archive %s/%d is not in the cache", digest.Hash, digest.SizeBytes)
+	}
+	defer os.Remove(archive.Name())
+	archive.Close()
+
+	if err := verifySRI(archive.Name(), q.sri); err != nil {
+		return nil, err
+	}
+
+	name, err := archiveName(uri, q.resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", fmt.Sprintf("%s-", id))
+	if err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extract(name, archive.Name(), dir, s.limits); err != nil {
+		if errors.Is(err, karchive.ErrLimitExceeded) {
+			return nil, grpc_status.Errorf(codes.ResourceExhausted, "failed to unpack %s: %s", uri, err)
+		}
+		return nil, grpc_status.Errorf(codes.InvalidArgument, "failed to unpack %s: %s", uri, err)
+	}
+
+	// Symlinks are checked against the resolved paths, as created by karchive.
+	top, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to resolve temp dir: %s", err)
+	}
+	root := top
+	if q.directory != "" {
+		root, err = filepath.EvalSymlinks(filepath.Join(top, filepath.Clean("/"+q.directory)))
+		if err != nil || !within(top, root) {
+			return nil, grpc_status.Errorf(codes.NotFound, "directory %s not found in %s", q.directory, uri)
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return nil, grpc_status.Errorf(codes.NotFound, "directory %s not found in %s", q.directory, uri)
+		}
+	}
+
+	return s.putDirectory(ctx, id, root, root)
+}
+
+// within returns true if path is dir, or is under it.
+func within(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// linkTarget returns the target of the symlink, relative to the directory containing it.
+//
+// Returns an error if the target, or any symlink it goes through, points outside of root:
+// clients materializing the tree would otherwise create links to arbitrary files.
+func linkTarget(root, link string) (string, error) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(link)
+	rel := target
+	if filepath.IsAbs(target) {
+		clean := filepath.Clean(target)
+		if !within(root, clean) {
+			return "", fmt.Errorf("points to %s, outside of the directory", target)
+		}
+		rel, _ = filepath.Rel(dir, clean)
+	}
+
+	// Follow the target one component at a time, as the kernel does: components
+	// can be symlinks themselves, after which a .. is not a lexical operation.
+	current := dir
+	for _, component := range strings.Split(rel, string(os.PathSeparator)) {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+		default:
+			current = filepath.Join(current, component)
+			if info, err := os.Lstat(current); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				resolved, err := filepath.EvalSymlinks(current)
+				if err != nil {
+					return "", fmt.Errorf("points to %s, through unresolvable link %s", target, current)
+				}
+				current = resolved
+			}
+		}
+		if !within(root, current) {
+			return "", fmt.Errorf("points to %s, outside of the directory", target)
+		}
+	}
+	return rel, nil
+}
+
+// verifySRI checks that the file matches the checksums in Subresource Integrity format.
+//
+// As per the specification, the file is valid if any of the checksums with a
+// supported algorithm matches.
+func verifySRI(name string, sri string) error {
+	var errs []string
+	for _, checksum := range strings.Fields(sri) {
+		algo, expected, found := strings.Cut(checksum, "-")
+		newHash := sriHashes[algo]
+		if !found || newHash == nil {
+			continue
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return grpc_status.Errorf(codes.Internal, "failed to open archive: %s", err)
+		}
+		h := newHash()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return grpc_status.Errorf(codes.Internal, "failed to read archive: %s", err)
+		}
+
+		got := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if got == expected {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: expected %s, got %s", algo, expected, got))
+	}
+
+	if len(errs) > 0 {
+		return grpc_status.Errorf(codes.InvalidArgument, "checksum mismatch - %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// archiveName returns a name for the archive, with an extension indicating how to unpack it.
+func archiveName(uri string, resourceType string) (string, error) {
+	if resourceType != "" {
+		ext, found := archiveExtensions[resourceType]
+		if !found {
+			return "", grpc_status.Errorf(codes.InvalidArgument, "unsupported resource_type %s", resourceType)
+		}
+		return "archive" + ext, nil
+	}
+
+	name := uri
+	if u, err := url.Parse(uri); err == nil {
+		name = u.Path
+	}
+	return path.Base(name), nil
+}
+
+// extract unpacks the archive stored in the file into dir.
+//
+// The format of the archive is determined by the extension of name. karchive refuses
+// to create or write files outside of dir, even through symlinks in the archive,
+// and stops with an error wrapping karchive.ErrLimitExceeded once a limit is crossed.
+func extract(name, file, dir string, limits ExtractLimits) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(name, ".zip") {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return karchive.UnzipTo(f, info.Size(), dir, limits.modifiers()...)
+	}
+
+	if strings.HasSuffix(name, ".tar") {
+		return karchive.Untar(f, dir, limits.modifiers()...)
+	}
+
+	decoded, r, err := karchive.Decoder(name, f)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(decoded, ".tar") {
+		return fmt.Errorf("%s is not a tar archive", name)
+	}
+	return karchive.Untar(r, dir, limits.modifiers()...)
+}
+
+// putDirectory uploads the files and directories under dir in the CAS.
+//
+// root is the top of the tree returned, dir itself or one of its parents: symlinks
+// must point inside it, and are made relative. Returns the digest of the Directory.
+func (s *assetServer) putDirectory(ctx context.Context, id, root, dir string) (*pb.Digest, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to read directory: %s", err)
+	}
+
+	// os.ReadDir returns entries sorted by name, as required for Directory protos.
+	directory := &pb.Directory{}
+	for _, entry := range entries {
+		name := entry.Name()
+		full := filepath.Join(dir, name)
+
+		switch mode := entry.Type(); {
+		case mode&os.ModeSymlink != 0:
+			target, err := linkTarget(root, full)
+			if err != nil {
+				return nil, grpc_status.Errorf(codes.InvalidArgument, "link %s %s", name, err)
+			}
+			directory.Symlinks = append(directory.Symlinks, &pb.SymlinkNode{Name: name, Target: filepath.ToSlash(target)})
+
+		case mode.IsDir():
+			digest, err := s.putDirectory(ctx, id, root, full)
+			if err != nil {
+				return nil, err
+			}
+			directory.Directories = append(directory.Directories, &pb.DirectoryNode{Name: name, Digest: digest})
+
+		case mode.IsRegular():
+			info, err := entry.Info()
+			if err != nil {
+				return nil, grpc_status.Errorf(codes.Internal, "failed to stat %s: %s", name, err)
+			}
+			digest, err := s.putFile(ctx, id, full)
+			if err != nil {
+				return nil, err
+			}
+			directory.Files = append(directory.Files, &pb.FileNode{Name: name, Digest: digest, IsExecutable: info.Mode()&0111 != 0})
+		}
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(directory)
+	if err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to marshal directory: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	digest := &pb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+
+	if err := s.putBlob(ctx, id, digest, io.NopCloser(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// putFile uploads the file in the CAS, returning its digest.
+func (s *assetServer) putFile(ctx context.Context, id, name string) (*pb.Digest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to open %s: %s", name, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to read %s: %s", name, err)
+	}
+	digest := &pb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: size}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, grpc_status.Errorf(codes.Internal, "failed to rewind %s: %s", name, err)
+	}
+	if err := s.putBlob(ctx, id, digest, io.NopCloser(f)); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// putBlob uploads the blob in the CAS, unless it is empty.
+//
+// The empty blob is implicitly present in any CAS.
+func (s *assetServer) putBlob(ctx context.Context, id string, digest *pb.Digest, rc io.ReadCloser) error {
+	if digest.SizeBytes == 0 {
+		rc.Close()
+		return nil
+	}
+	return s.cache.PutBlob(ctx, id, digest, rc)
+}
@@ -0,0 +1,520 @@
+package asset_service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCache is a CacheProxy keeping blobs in memory.
+type fakeCache struct {
+	mutex sync.Mutex
+	blobs map[string][]byte
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{blobs: map[string][]byte{}}
+}
+
+func digestOf(data []byte) *pb.Digest {
+	sum := sha256.Sum256(data)
+	return &pb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+func (c *fakeCache) add(data []byte) *pb.Digest {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	digest := digestOf(data)
+	c.blobs[digest.Hash] = data
+	return digest
+}
+
+func (c *fakeCache) get(hash string) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.blobs[hash]
+}
+
+func (c *fakeCache) CheckUpdateCapabilities(ctx context.Context) error {
+	return nil
+}
+
+func (c *fakeCache) IsMissing(ctx context.Context, digest *pb.Digest) (bool, error) {
+	return c.get(digest.Hash) == nil && digest.SizeBytes != 0, nil
+}
+
+func (c *fakeCache) Contains(ctx context.Context, hash string) (*pb.Digest, error) {
+	data := c.get(hash)
+	if data == nil {
+		return nil, nil
+	}
+	return digestOf(data), nil
+}
+
+func (c *fakeCache) Put(ctx context.Context, uuid string, digest *pb.Digest, rc io.ReadCloser) error {
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if got := digestOf(data); got.Hash != digest.Hash || got.SizeBytes != digest.SizeBytes {
+		return fmt.Errorf("digest mismatch - expected %s/%d, got %s/%d", digest.Hash, digest.SizeBytes, got.Hash, got.SizeBytes)
+	}
+	c.add(data)
+	return nil
+}
+
+func (c *fakeCache) PutBlob(ctx context.Context, uuid string, digest *pb.Digest, rc io.ReadCloser) error {
+	return c.Put(ctx, uuid, digest, rc)
+}
+
+func (c *fakeCache) GetToFile(ctx context.Context, uuid string, hash string) (*os.File, error) {
+	data := c.get(hash)
+	if data == nil {
+		return nil, nil
+	}
+	f, err := os.CreateTemp("", uuid+"-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return f, err
+}
+
+func (c *fakeCache) FindMissing(ctx context.Context, digests []*pb.Digest) ([]*pb.Digest, error) {
+	var missing []*pb.Digest
+	for _, digest := range digests {
+		if isMissing, _ := c.IsMissing(ctx, digest); isMissing {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
+
+// GetTree returns the Directories in the tree, omitting the missing ones like a CAS does.
+func (c *fakeCache) GetTree(ctx context.Context, root *pb.Digest) ([]*pb.Directory, error) {
+	var directories []*pb.Directory
+	pending := []*pb.Digest{root}
+	for len(pending) > 0 {
+		data := c.get(pending[0].Hash)
+		pending = pending[1:]
+		if data == nil {
+			continue
+		}
+		directory := &pb.Directory{}
+		if err := proto.Unmarshal(data, directory); err != nil {
+			return nil, err
+		}
+		directories = append(directories, directory)
+		for _, child := range directory.Directories {
+			pending = append(pending, child.Digest)
+		}
+	}
+	return directories, nil
+}
+
+// remove evicts a blob from the cache.
+func (c *fakeCache) remove(hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.blobs, hash)
+}
+
+// fakeDownloader is an AssetDownloader serving content from memory, storing it in the cache.
+type fakeDownloader struct {
+	cache   *fakeCache
+	content map[string][]byte
+
+	fetched []string
+	headers []http.Header
+}
+
+func (d *fakeDownloader) FetchItem(uri string, headers http.Header, grpcHeaders metadata.MD, expectedHash string) (*pb.Digest, error) {
+	d.fetched = append(d.fetched, uri)
+	d.headers = append(d.headers, headers)
+	data, found := d.content[uri]
+	if !found {
+		return nil, fmt.Errorf("%s not found", uri)
+	}
+	digest := digestOf(data)
+	if expectedHash != "" && expectedHash != digest.Hash {
+		return nil, fmt.Errorf("%s has hash %s, expected %s", uri, digest.Hash, expectedHash)
+	}
+	return d.cache.add(data), nil
+}
+
+// fakeIndex is an Index keeping entries in memory, forever.
+type fakeIndex map[string]*IndexEntry
+
+func (i fakeIndex) Get(kind, uri string, qualifiers []*asset.Qualifier, oldest time.Time) (*IndexEntry, error) {
+	entry := i[indexKey(kind, uri, qualifiers)]
+	if entry == nil || entry.Created.Before(oldest) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (i fakeIndex) Put(kind, uri string, qualifiers []*asset.Qualifier, digest *pb.Digest, expires time.Time) (*IndexEntry, error) {
+	if expires.IsZero() {
+		expires = time.Now().Add(time.Hour)
+	}
+	entry := &IndexEntry{Hash: digest.Hash, Size: digest.SizeBytes, Created: time.Now(), Expires: expires}
+	i[indexKey(kind, uri, qualifiers)] = entry
+	return entry, nil
+}
+
+func newTestServer(content map[string][]byte) (*assetServer, *fakeCache, *fakeDownloader) {
+	cache := newFakeCache()
+	downloader := &fakeDownloader{cache: cache, content: content}
+	logger := log.New(io.Discard, "", 0)
+	return &assetServer{
+		cache:           cache,
+		assetDownloader: downloader,
+		index:           fakeIndex{},
+		accessLogger:    logger,
+		errorLogger:     logger,
+	}, cache, downloader
+}
+
+type archiveEntry struct {
+	name   string
+	mode   os.FileMode
+	target string
+}
+
+func tarGzOf(t *testing.T, entries ...archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: int64(entry.mode.Perm()), Typeflag: tar.TypeReg}
+		body := ""
+		switch {
+		case entry.mode&os.ModeSymlink != 0:
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, entry.target
+		case entry.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		default:
+			body = "content of " + entry.name
+			hdr.Size = int64(len(body))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func zipOf(t *testing.T, entries ...archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		hdr.SetMode(entry.mode)
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		body := "content of " + entry.name
+		if entry.mode&os.ModeSymlink != 0 {
+			body = entry.target
+		}
+		if !entry.mode.IsDir() {
+			_, err = w.Write([]byte(body))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func readDirectory(t *testing.T, cache *fakeCache, digest *pb.Digest) *pb.Directory {
+	data := cache.get(digest.Hash)
+	require.NotNil(t, data, "directory %s not in the cache", digest.Hash)
+	dir := &pb.Directory{}
+	require.NoError(t, proto.Unmarshal(data, dir))
+	return dir
+}
+
+func TestFetchDirectory(t *testing.T) {
+	archive := tarGzOf(t,
+		archiveEntry{name: "pkg-1.0/", mode: os.ModeDir | 0755},
+		archiveEntry{name: "pkg-1.0/README", mode: 0644},
+		archiveEntry{name: "pkg-1.0/bin/tool", mode: 0755},
+		archiveEntry{name: "pkg-1.0/bin/readme", mode: os.ModeSymlink | 0777, target: "../README"},
+		archiveEntry{name: "pkg-1.0/docs", mode: os.ModeSymlink | 0777, target: "/pkg-1.0/README"},
+	)
+	uri := "https://example.com/pkg-1.0.tar.gz"
+	server, cache, downloader := newTestServer(map[string][]byte{uri: archive})
+
+	req := &asset.FetchDirectoryRequest{
+		Uris:       []string{"https://example.com/missing.tar.gz", uri},
+		Qualifiers: []*asset.Qualifier{{Name: QualifierDirectory, Value: "pkg-1.0"}},
+	}
+	resp, err := server.FetchDirectory(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.OK), resp.Status.Code, "%v", resp.Status)
+	assert.Equal(t, uri, resp.Uri)
+	assert.NotNil(t, resp.ExpiresAt)
+
+	root := readDirectory(t, cache, resp.RootDirectoryDigest)
+	require.Len(t, root.Files, 1)
+	assert.Equal(t, "README", root.Files[0].Name)
+	assert.False(t, root.Files[0].IsExecutable)
+	assert.Equal(t, []byte("content of pkg-1.0/README"), cache.get(root.Files[0].Digest.Hash))
+	require.Len(t, root.Symlinks, 1)
+	assert.Equal(t, &pb.SymlinkNode{Name: "docs", Target: "README"}, root.Symlinks[0])
+	require.Len(t, root.Directories, 1)
+	assert.Equal(t, "bin", root.Directories[0].Name)
+
+	bin := readDirectory(t, cache, root.Directories[0].Digest)
+	require.Len(t, bin.Files, 1)
+	assert.Equal(t, "tool", bin.Files[0].Name)
+	assert.True(t, bin.Files[0].IsExecutable)
+	assert.Equal(t, []*pb.SymlinkNode{{Name: "readme", Target: "../README"}}, bin.Symlinks)
+
+	// The second request is served from the index, without downloading the archive again.
+	fetched := len(downloader.fetched)
+	again, err := server.FetchDirectory(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), again.Status.Code)
+	assert.True(t, proto.Equal(resp.RootDirectoryDigest, again.RootDirectoryDigest))
+	assert.Equal(t, fetched, len(downloader.fetched))
+
+	// Index entries for trees partially evicted from the cache are ignored, and
+	// the archive is downloaded again, restoring the tree.
+	for _, evicted := range []*pb.Digest{bin.Files[0].Digest, root.Directories[0].Digest} {
+		cache.remove(evicted.Hash)
+		again, err = server.FetchDirectory(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, int32(codes.OK), again.Status.Code)
+		assert.True(t, proto.Equal(resp.RootDirectoryDigest, again.RootDirectoryDigest))
+		assert.Equal(t, req.Uris, downloader.fetched[fetched:])
+		assert.NotNil(t, cache.get(evicted.Hash))
+		fetched = len(downloader.fetched)
+	}
+}
+
+func TestFetchDirectoryZip(t *testing.T) {
+	archive := zipOf(t,
+		archiveEntry{name: "src/", mode: os.ModeDir | 0755},
+		archiveEntry{name: "src/main.c", mode: 0644},
+		archiveEntry{name: "configure", mode: 0755},
+	)
+	uri := "https://example.com/download?id=42"
+	server, cache, _ := newTestServer(map[string][]byte{uri: archive})
+
+	sum := sha256.Sum256(archive)
+	resp, err := server.FetchDirectory(context.Background(), &asset.FetchDirectoryRequest{
+		Uris: []string{uri},
+		Qualifiers: []*asset.Qualifier{
+			{Name: QualifierResourceType, Value: "application/zip"},
+			{Name: QualifierChecksumSri, Value: "sha256-" + base64.StdEncoding.EncodeToString(sum[:])},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.OK), resp.Status.Code, "%v", resp.Status)
+
+	root := readDirectory(t, cache, resp.RootDirectoryDigest)
+	require.Len(t, root.Files, 1)
+	assert.Equal(t, "configure", root.Files[0].Name)
+	assert.True(t, root.Files[0].IsExecutable)
+	require.Len(t, root.Directories, 1)
+	src := readDirectory(t, cache, root.Directories[0].Digest)
+	require.Len(t, src.Files, 1)
+	assert.Equal(t, "main.c", src.Files[0].Name)
+}
+
+func TestFetchDirectoryLimits(t *testing.T) {
+	// Each file is 21 bytes long, "content of pkg/file-N".
+	entries := []archiveEntry{
+		{name: "pkg/", mode: os.ModeDir | 0755},
+		{name: "pkg/file-1", mode: 0644},
+		{name: "pkg/file-2", mode: 0644},
+	}
+	content := map[string][]byte{
+		"https://example.com/pkg.tar.gz": tarGzOf(t, entries...),
+		"https://example.com/pkg.zip":    zipOf(t, entries...),
+	}
+
+	for _, test := range []struct {
+		limits  ExtractLimits
+		message string
+	}{
+		{limits: ExtractLimits{MaxSize: 42, MaxFileSize: 21, MaxEntries: 3}},
+		{limits: ExtractLimits{MaxSize: 41}, message: "more than 41 bytes uncompressed, at pkg/file-2"},
+		{limits: ExtractLimits{MaxFileSize: 20}, message: "pkg/file-1 is 21 bytes uncompressed, more than 20"},
+		{limits: ExtractLimits{MaxEntries: 2}, message: "more than 2 entries, at pkg/file-2"},
+	} {
+		for uri := range content {
+			server, _, _ := newTestServer(content)
+			server.limits = test.limits
+
+			resp, err := server.FetchDirectory(context.Background(), &asset.FetchDirectoryRequest{Uris: []string{uri}})
+			require.NoError(t, err)
+			if test.message == "" {
+				assert.Equal(t, int32(codes.OK), resp.Status.Code, "%s - %v", uri, resp.Status)
+				continue
+			}
+			assert.Equal(t, int32(codes.ResourceExhausted), resp.Status.Code, "%s - %v", uri, resp.Status)
+			assert.Contains(t, resp.Status.Message, test.message, "%s", uri)
+		}
+	}
+}
+
+func TestFetchDirectoryErrors(t *testing.T) {
+	escaping := tarGzOf(t, archiveEntry{name: "link", mode: os.ModeSymlink | 0777, target: "../../etc/passwd"})
+	through := tarGzOf(t,
+		archiveEntry{name: "link", mode: os.ModeSymlink | 0777, target: "dir"},
+		archiveEntry{name: "link/file", mode: 0644},
+	)
+	valid := tarGzOf(t, archiveEntry{name: "file", mode: 0644})
+	server, _, _ := newTestServer(map[string][]byte{
+		"https://example.com/escaping.tar.gz": escaping,
+		"https://example.com/through.tar.gz":  through,
+		"https://example.com/valid.tar.gz":    valid,
+		"https://example.com/valid.rar":       valid,
+	})
+
+	wrong := sha256.Sum256([]byte("something else"))
+	for _, test := range []struct {
+		uri        string
+		qualifiers []*asset.Qualifier
+		function   pb.DigestFunction_Value
+		code       codes.Code
+		message    string
+	}{
+		{uri: "https://example.com/escaping.tar.gz", code: codes.InvalidArgument, message: "outside of"},
+		{uri: "https://example.com/through.tar.gz", code: codes.InvalidArgument, message: "symlink"},
+		{uri: "https://example.com/valid.rar", code: codes.InvalidArgument, message: "format of file not known"},
+		{uri: "https://example.com/valid.tar.gz", code: codes.InvalidArgument, message: "unsupported resource_type",
+			qualifiers: []*asset.Qualifier{{Name: QualifierResourceType, Value: "application/x-rar"}}},
+		{uri: "https://example.com/valid.tar.gz", code: codes.NotFound, message: "directory missing not found",
+			qualifiers: []*asset.Qualifier{{Name: QualifierDirectory, Value: "missing"}}},
+		{uri: "https://example.com/valid.tar.gz", code: codes.InvalidArgument, message: "checksum mismatch",
+			qualifiers: []*asset.Qualifier{{Name: QualifierChecksumSri, Value: "sha384-" + base64.StdEncoding.EncodeToString(wrong[:])}}},
+		{uri: "https://example.com/valid.tar.gz", code: codes.InvalidArgument, message: "unsupported digest function",
+			function: pb.DigestFunction_SHA512},
+	} {
+		resp, err := server.FetchDirectory(context.Background(), &asset.FetchDirectoryRequest{
+			Uris:           []string{test.uri},
+			Qualifiers:     test.qualifiers,
+			DigestFunction: test.function,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int32(test.code), resp.Status.Code, "%s - %v", test.uri, resp.Status)
+		assert.Contains(t, resp.Status.Message, test.message, "%s", test.uri)
+	}
+
+	_, err := server.FetchDirectory(context.Background(), nil)
+	assert.Error(t, err)
+	_, err = server.FetchDirectory(context.Background(), &asset.FetchDirectoryRequest{})
+	assert.Error(t, err)
+}
+
+func TestFetchDirectorySubtreeLinks(t *testing.T) {
+	tree := func(links ...archiveEntry) []byte {
+		entries := []archiveEntry{
+			{name: "pkg/a/b/file", mode: 0644},
+			{name: "pkg/README", mode: 0644},
+			{name: "other/secret", mode: 0644},
+			{name: "current", mode: os.ModeSymlink | 0777, target: "pkg"},
+		}
+		return tarGzOf(t, append(entries, links...)...)
+	}
+	link := func(name, target string) archiveEntry {
+		return archiveEntry{name: name, mode: os.ModeSymlink | 0777, target: target}
+	}
+
+	for _, test := range []struct {
+		name    string
+		archive []byte
+		// Symlinks expected in pkg/a/b, empty if the links must be refused.
+		expected []*pb.SymlinkNode
+	}{
+		{name: "inside", archive: tree(
+			link("pkg/a/b/abs", "/pkg/README"),
+			link("pkg/a/b/rel", "../../README"),
+			link("pkg/a/b/up", "../.."),
+			link("pkg/a/b/via", "up/a/b/file"),
+			link("pkg/a/b/dangling", "missing"),
+		), expected: []*pb.SymlinkNode{
+			{Name: "abs", Target: "../../README"},
+			{Name: "dangling", Target: "missing"},
+			{Name: "rel", Target: "../../README"},
+			{Name: "up", Target: "../.."},
+			{Name: "via", Target: "up/a/b/file"},
+		}},
+		// Inside the archive, but outside of the directory returned.
+		{name: "absolute", archive: tree(link("pkg/a/b/abs", "/other/secret"))},
+		{name: "relative", archive: tree(link("pkg/a/b/rel", "../../../other/secret"))},
+		{name: "top", archive: tree(link("pkg/a/b/rel", "../../.."))},
+		{name: "back in", archive: tree(link("pkg/a/b/rel", "../../../pkg/README"))},
+		// Lexically pkg/a/b/secret, but up resolves to pkg, and pkg/.. to the top.
+		{name: "through link", archive: tree(link("pkg/a/b/up", "../.."), link("pkg/a/b/rel", "up/../other/secret"))},
+	} {
+		uri := "https://example.com/" + test.name + ".tar.gz"
+		server, cache, _ := newTestServer(map[string][]byte{uri: test.archive})
+
+		// The directory qualifier can itself go through a symlink.
+		for _, directory := range []string{"pkg", "current"} {
+			resp, err := server.FetchDirectory(context.Background(), &asset.FetchDirectoryRequest{
+				Uris:       []string{uri},
+				Qualifiers: []*asset.Qualifier{{Name: QualifierDirectory, Value: directory}},
+			})
+			require.NoError(t, err)
+			if len(test.expected) == 0 {
+				assert.Equal(t, int32(codes.InvalidArgument), resp.Status.Code, "%s - %v", test.name, resp.Status)
+				assert.Contains(t, resp.Status.Message, "outside of the directory", test.name)
+				continue
+			}
+			require.Equal(t, int32(codes.OK), resp.Status.Code, "%s - %v", test.name, resp.Status)
+
+			root := readDirectory(t, cache, resp.RootDirectoryDigest)
+			require.Len(t, root.Directories, 1, test.name)
+			a := readDirectory(t, cache, root.Directories[0].Digest)
+			require.Len(t, a.Directories, 1, test.name)
+			b := readDirectory(t, cache, a.Directories[0].Digest)
+			assert.Equal(t, test.expected, b.Symlinks, test.name)
+		}
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	for _, test := range []struct {
+		uri, resourceType, expected string
+	}{
+		{"https://example.com/pkg-1.0.tar.gz?download=1", "", "pkg-1.0.tar.gz"},
+		{"https://example.com/download", "application/x-xz", "archive.tar.xz"},
+		{"https://example.com/pkg.zip", "application/gzip", "archive.tar.gz"},
+	} {
+		name, err := archiveName(test.uri, test.resourceType)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, name)
+	}
+}
@@ -0,0 +1,198 @@
+package asset_service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	enconfig "github.com/ccontavalli/enkit/lib/config"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IndexKindBlob      = "blob"
+	IndexKindDirectory = "directory"
+)
+
+// IndexPruneInterval is how often Put removes the expired entries from the store.
+//
+// Get deletes the expired entries it finds, but entries that are never looked
+// up again would otherwise stay in the store forever.
+const IndexPruneInterval = 10 * time.Minute
+
+// IndexEntry is the content known for an uri and set of qualifiers.
+type IndexEntry struct {
+	Hash string
+	Size int64
+
+	// When the entry was fetched or pushed, and when it stops being valid.
+	Created time.Time
+	Expires time.Time
+}
+
+func (e *IndexEntry) Digest() *pb.Digest {
+	return &pb.Digest{Hash: e.Hash, SizeBytes: e.Size}
+}
+
+// Index maps an uri and its qualifiers to the digest of its content.
+//
+// kind is one of the IndexKind constants, so blobs and directories fetched
+// or pushed for the same uri are remembered separately.
+type Index interface {
+	// Get returns the entry for the uri, or nil if unknown, expired, or created before oldest.
+	Get(kind, uri string, qualifiers []*asset.Qualifier, oldest time.Time) (*IndexEntry, error)
+	// Put records the digest of the uri. A zero expires uses the default ttl of the index.
+	Put(kind, uri string, qualifiers []*asset.Qualifier, digest *pb.Digest, expires time.Time) (*IndexEntry, error)
+}
+
+type index struct {
+	store  enconfig.Store
+	ttl    time.Duration
+	now    func() time.Time
+	logger *log.Logger
+
+	// Serializes Get and Put, as not all stores are safe for concurrent use.
+	mutex sync.Mutex
+	// When the expired entries were last removed from the store.
+	pruned time.Time
+}
+
+// NewIndex returns an Index persisted in the config store.
+func NewIndex(cfg Config, store enconfig.Store) Index {
+	return &index{
+		store:  store,
+		ttl:    cfg.IndexTTL(),
+		now:    time.Now,
+		logger: cfg.ErrorLogger(),
+	}
+}
+
+// indexKey returns the key under which the content of the uri is stored.
+//
+// Headers are not part of the key, as they are expected to carry credentials rather
+// than to change the content returned. For the same reason, content fetched with
+// headers is never indexed: the credentials would not be checked on lookup.
+func indexKey(kind, uri string, qualifiers []*asset.Qualifier) string {
+	var parts []string
+	for _, q := range qualifiers {
+		if strings.HasPrefix(q.Name, QualifierHTTPHeaderPrefix) || strings.HasPrefix(q.Name, QualifierHTTPHeaderUrlPrefix) {
+			continue
+		}
+		parts = append(parts, q.Name+"="+q.Value)
+	}
+	sort.Strings(parts)
+
+	h := sha256.New()
+	h.Write([]byte(kind + "\x00" + uri))
+	for _, part := range parts {
+		h.Write([]byte("\x00" + part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (i *index) Get(kind, uri string, qualifiers []*asset.Qualifier, oldest time.Time) (*IndexEntry, error) {
+	key := enconfig.Key(indexKey(kind, uri, qualifiers))
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var entry IndexEntry
+	if _, err := i.store.Unmarshal(key, &entry); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !entry.Expires.After(i.now()) {
+		if err := i.store.Delete(key); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if entry.Created.Before(oldest) {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (i *index) Put(kind, uri string, qualifiers []*asset.Qualifier, digest *pb.Digest, expires time.Time) (*IndexEntry, error) {
+	now := i.now()
+	if expires.IsZero() {
+		expires = now.Add(i.ttl)
+	}
+
+	entry := &IndexEntry{
+		Hash:    digest.Hash,
+		Size:    digest.SizeBytes,
+		Created: now,
+		Expires: expires,
+	}
+
+	i.mutex.Lock()
+	err := i.store.Marshal(enconfig.Key(indexKey(kind, uri, qualifiers)), entry)
+	prune := err == nil && now.Sub(i.pruned) >= IndexPruneInterval
+	if prune {
+		i.pruned = now
+	}
+	i.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if prune {
+		if err := i.prune(now); err != nil && i.logger != nil {
+			i.logger.Printf("Could not prune expired index entries: %v", err)
+		}
+	}
+	return entry, nil
+}
+
+// prune deletes all the entries expired by now.
+//
+// The mutex is only held for one entry at a time, so Get and Put are not
+// stalled for the whole time it takes to go through a large index.
+func (i *index) prune(now time.Time) error {
+	i.mutex.Lock()
+	descs, err := i.store.List()
+	i.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range descs {
+		if err := i.pruneEntry(desc, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneEntry deletes the entry if expired by now.
+//
+// The entry is read again with the mutex held, as a Put may have refreshed it
+// since the store was listed.
+func (i *index) pruneEntry(desc enconfig.Descriptor, now time.Time) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var entry IndexEntry
+	if _, err := i.store.Unmarshal(desc, &entry); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if entry.Expires.After(now) {
+		return nil
+	}
+	if err := i.store.Delete(desc); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package asset_service
+
+import (
+	"encoding/json"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	enconfig "github.com/ccontavalli/enkit/lib/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeStore is an enconfig.Store keeping json encoded objects in memory.
+type fakeStore struct {
+	objects map[string][]byte
+	deleted []string
+	// If set, invoked by List once the keys are listed.
+	listed func()
+}
+
+func (s *fakeStore) List(mods ...enconfig.ListModifier) ([]enconfig.Descriptor, error) {
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	if s.listed != nil {
+		s.listed()
+	}
+	return enconfig.SortedDescriptorsFromKeys(keys), nil
+}
+
+func (s *fakeStore) Marshal(desc enconfig.Descriptor, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.objects[desc.Key()] = data
+	return nil
+}
+
+func (s *fakeStore) Unmarshal(desc enconfig.Descriptor, value interface{}) (enconfig.Descriptor, error) {
+	data, found := s.objects[desc.Key()]
+	if !found {
+		return desc, os.ErrNotExist
+	}
+	return desc, json.Unmarshal(data, value)
+}
+
+func (s *fakeStore) Delete(desc enconfig.Descriptor) error {
+	if _, found := s.objects[desc.Key()]; !found {
+		return os.ErrNotExist
+	}
+	delete(s.objects, desc.Key())
+	s.deleted = append(s.deleted, desc.Key())
+	return nil
+}
+
+func (s *fakeStore) Close() error {
+	return nil
+}
+
+func TestIndex(t *testing.T) {
+	store := &fakeStore{objects: map[string][]byte{}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	idx := &index{store: store, ttl: time.Hour, now: func() time.Time { return now }}
+
+	uri := "https://example.com/file.tar.gz"
+	digest := &pb.Digest{Hash: "0123abcd", SizeBytes: 42}
+	qualifiers := []*asset.Qualifier{
+		{Name: QualifierChecksumSri, Value: "sha256-ASNFZ4mrze8="},
+		{Name: QualifierHTTPHeaderPrefix + "Authorization", Value: "Bearer token"},
+	}
+
+	entry, err := idx.Put(IndexKindBlob, uri, qualifiers, digest, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, &IndexEntry{Hash: "0123abcd", Size: 42, Created: now, Expires: now.Add(time.Hour)}, entry)
+	assert.Len(t, store.objects, 1)
+
+	// Headers are not part of the key: they carry credentials, which change over time.
+	other := []*asset.Qualifier{
+		{Name: QualifierHTTPHeaderUrlPrefix + "0:Authorization", Value: "Bearer other"},
+		{Name: QualifierChecksumSri, Value: "sha256-ASNFZ4mrze8="},
+	}
+	got, err := idx.Get(IndexKindBlob, uri, other, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, entry, got)
+	assert.Equal(t, indexKey(IndexKindBlob, uri, qualifiers), indexKey(IndexKindBlob, uri, other))
+
+	// Other qualifiers, kinds and uris are.
+	got, err = idx.Get(IndexKindBlob, uri, nil, time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = idx.Get(IndexKindDirectory, uri, qualifiers, time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = idx.Get(IndexKindBlob, uri+"?mirror", qualifiers, time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Entries created before oldest are ignored, but kept.
+	got, err = idx.Get(IndexKindBlob, uri, qualifiers, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = idx.Get(IndexKindBlob, uri, qualifiers, now)
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+
+	// Expired entries are deleted.
+	now = now.Add(time.Hour)
+	got, err = idx.Get(IndexKindBlob, uri, qualifiers, time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	assert.Len(t, store.objects, 0)
+	assert.Equal(t, []string{indexKey(IndexKindBlob, uri, qualifiers)}, store.deleted)
+
+	// An explicit expiration overrides the ttl.
+	expires := now.Add(time.Minute)
+	entry, err = idx.Put(IndexKindDirectory, uri, nil, digest, expires)
+	require.NoError(t, err)
+	assert.Equal(t, expires, entry.Expires)
+	now = now.Add(2 * time.Minute)
+	got, err = idx.Get(IndexKindDirectory, uri, nil, time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestIndexPrune(t *testing.T) {
+	store := &fakeStore{objects: map[string][]byte{}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	idx := &index{store: store, ttl: time.Hour, now: func() time.Time { return now }}
+
+	digest := &pb.Digest{Hash: "0123abcd", SizeBytes: 42}
+	_, err := idx.Put(IndexKindBlob, "https://example.com/short", nil, digest, now.Add(time.Minute))
+	require.NoError(t, err)
+	_, err = idx.Put(IndexKindBlob, "https://example.com/long", nil, digest, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, store.objects, 2)
+
+	// Expired entries are kept until the next prune, even if never looked up.
+	now = now.Add(2 * time.Minute)
+	_, err = idx.Put(IndexKindBlob, "https://example.com/other", nil, digest, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, store.objects, 3)
+
+	now = now.Add(IndexPruneInterval)
+	_, err = idx.Put(IndexKindDirectory, "https://example.com/other", nil, digest, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, store.objects, 3)
+	assert.Equal(t, []string{indexKey(IndexKindBlob, "https://example.com/short", nil)}, store.deleted)
+
+	// Once the ttl passes, all the entries not refreshed are gone.
+	now = now.Add(55 * time.Minute)
+	_, err = idx.Put(IndexKindBlob, "https://example.com/long", nil, digest, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, store.objects, 2)
+	assert.NotContains(t, store.objects, indexKey(IndexKindBlob, "https://example.com/other", nil))
+
+	// Entries refreshed by a Put once the store is listed are kept.
+	now = now.Add(2 * time.Hour)
+	key := indexKey(IndexKindBlob, "https://example.com/long", nil)
+	store.listed = func() {
+		require.NoError(t, store.Marshal(enconfig.Key(key), &IndexEntry{Hash: "0123abcd", Size: 42, Created: now, Expires: now.Add(time.Hour)}))
+	}
+	_, err = idx.Put(IndexKindBlob, "https://example.com/new", nil, digest, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, store.objects, 2)
+	assert.Contains(t, store.objects, key)
+}
@@ -0,0 +1,116 @@
+package asset_service
+
+import (
+	"context"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"os"
+	"time"
+)
+
+var errNilPushBlobRequest = grpc_status.Error(codes.InvalidArgument, "expected a non-nil *PushBlobRequest")
+var errNilPushDirectoryRequest = grpc_status.Error(codes.InvalidArgument, "expected a non-nil *PushDirectoryRequest")
+
+// PushBlob records in the index that the uris refer to a blob already in the CAS.
+func (s *assetServer) PushBlob(ctx context.Context, req *asset.PushBlobRequest) (*asset.PushBlobResponse, error) {
+	if req == nil {
+		return nil, errNilPushBlobRequest
+	}
+
+	if err := s.push(ctx, IndexKindBlob, req.GetUris(), req.GetQualifiers(), req.GetBlobDigest(), req.GetExpireAt()); err != nil {
+		return nil, err
+	}
+	return &asset.PushBlobResponse{}, nil
+}
+
+// PushDirectory records in the index that the uris refer to a Directory already in the CAS.
+func (s *assetServer) PushDirectory(ctx context.Context, req *asset.PushDirectoryRequest) (*asset.PushDirectoryResponse, error) {
+	if req == nil {
+		return nil, errNilPushDirectoryRequest
+	}
+
+	if err := s.push(ctx, IndexKindDirectory, req.GetUris(), req.GetQualifiers(), req.GetRootDirectoryDigest(), req.GetExpireAt()); err != nil {
+		return nil, err
+	}
+	return &asset.PushDirectoryResponse{}, nil
+}
+
+// push records in the index that the uris refer to the digest.
+//
+// Pushed entries are returned to any client fetching the same uris and qualifiers,
+// so pushes are refused unless enabled in the config, and must carry a checksum.sri
+// qualifier: fetches without one never see pushed content.
+func (s *assetServer) push(ctx context.Context, kind string, uris []string, qualifiers []*asset.Qualifier, digest *pb.Digest, expireAt *timestamppb.Timestamp) error {
+	if !s.pushEnabled {
+		return grpc_status.Error(codes.PermissionDenied, "push is disabled on this server")
+	}
+	if len(uris) == 0 {
+		return grpc_status.Error(codes.InvalidArgument, "expected at least one uri in Push request")
+	}
+	if digest == nil || digest.Hash == "" {
+		return grpc_status.Error(codes.InvalidArgument, "expected a digest in Push request")
+	}
+	for _, q := range qualifiers {
+		if q == nil {
+			return grpc_status.Error(codes.InvalidArgument, "unexpected nil qualifier in Push request")
+		}
+	}
+	// Fetch requests with a checksum.sri qualifier would return the blob pushed:
+	// it must match. The checksum of a directory is the one of the archive, unknown here.
+	q, _ := parseQualifiers(s.errorLogger, uris, qualifiers)
+	if q.sri == "" {
+		return grpc_status.Errorf(codes.InvalidArgument, "expected a %s qualifier in Push request", QualifierChecksumSri)
+	}
+	if kind == IndexKindBlob && !q.matchesSha256(digest.Hash) {
+		return grpc_status.Errorf(codes.InvalidArgument, "digest %s does not match the %s qualifier %q", digest.Hash, QualifierChecksumSri, q.sri)
+	}
+
+	var expires time.Time
+	if expireAt != nil {
+		expires = expireAt.AsTime()
+	}
+
+	// The content must have been uploaded before being pushed, or the
+	// index would return digests that cannot be retrieved.
+	isMissing, err := s.cache.IsMissing(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if isMissing {
+		return grpc_status.Errorf(codes.FailedPrecondition, "%s/%d is not in the CAS", digest.Hash, digest.SizeBytes)
+	}
+
+	// Without a sha256 checksum, the blob must be read to verify the other algorithms.
+	if kind == IndexKindBlob && q.sri != "" && len(q.sha256s) == 0 && digest.SizeBytes > 0 {
+		if err := s.verifyBlob(ctx, digest, q.sri); err != nil {
+			return err
+		}
+	}
+
+	for _, uri := range uris {
+		if _, err := s.index.Put(kind, uri, qualifiers, digest, expires); err != nil {
+			return grpc_status.Errorf(codes.Internal, "failed to index \"%s\": %s", uri, err)
+		}
+		s.accessLogger.Printf("GRPC ASSET PUSH %s %s %s/%d", kind, uri, digest.Hash, digest.SizeBytes)
+	}
+	return nil
+}
+
+// verifyBlob checks that the blob in the CAS matches the checksums in Subresource Integrity format.
+func (s *assetServer) verifyBlob(ctx context.Context, digest *pb.Digest, sri string) error {
+	f, err := s.cache.GetToFile(ctx, uuid.New().String(), digest.Hash)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return grpc_status.Errorf(codes.FailedPrecondition, "%s/%d is not in the CAS", digest.Hash, digest.SizeBytes)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	return verifySRI(f.Name(), sri)
+}
@@ -0,0 +1,129 @@
+package asset_service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func sriOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestPushBlob(t *testing.T) {
+	server, cache, downloader := newTestServer(nil)
+	content := []byte("pushed content")
+	digest := cache.add(content)
+	uri := "https://example.com/pushed"
+	qualifiers := []*asset.Qualifier{{Name: QualifierChecksumSri, Value: sriOf(content)}}
+
+	// Pushes are refused unless enabled.
+	_, err := server.PushBlob(context.Background(), &asset.PushBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers, BlobDigest: digest})
+	assert.Equal(t, codes.PermissionDenied, grpc_status.Code(err))
+	_, err = server.PushDirectory(context.Background(), &asset.PushDirectoryRequest{Uris: []string{uri}, Qualifiers: qualifiers, RootDirectoryDigest: digest})
+	assert.Equal(t, codes.PermissionDenied, grpc_status.Code(err))
+
+	server.pushEnabled = true
+	_, err = server.PushBlob(context.Background(), &asset.PushBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers, BlobDigest: digest})
+	require.NoError(t, err)
+
+	resp, err := server.FetchBlob(context.Background(), &asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), resp.Status.Code)
+	assert.Equal(t, digest.Hash, resp.BlobDigest.Hash)
+	assert.Empty(t, downloader.fetched)
+
+	// Digests not matching the checksum are rejected.
+	other := cache.add([]byte("other content"))
+	_, err = server.PushBlob(context.Background(), &asset.PushBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers, BlobDigest: other})
+	assert.Equal(t, codes.InvalidArgument, grpc_status.Code(err))
+
+	// Checksums in other algorithms are verified against the content in the CAS.
+	sum := sha512.Sum384(content)
+	sha384 := []*asset.Qualifier{{Name: QualifierChecksumSri, Value: "sha384-" + base64.StdEncoding.EncodeToString(sum[:])}}
+	_, err = server.PushBlob(context.Background(), &asset.PushBlobRequest{Uris: []string{uri}, Qualifiers: sha384, BlobDigest: digest})
+	assert.NoError(t, err)
+	_, err = server.PushBlob(context.Background(), &asset.PushBlobRequest{Uris: []string{uri}, Qualifiers: sha384, BlobDigest: other})
+	assert.Equal(t, codes.InvalidArgument, grpc_status.Code(err))
+
+	// Directories are not checked, the checksum is the one of the archive they were unpacked from.
+	_, err = server.PushDirectory(context.Background(), &asset.PushDirectoryRequest{Uris: []string{uri}, Qualifiers: qualifiers, RootDirectoryDigest: other})
+	assert.NoError(t, err)
+
+	// Without a checksum, pushes would be returned to fetches not asking for one.
+	_, err = server.PushDirectory(context.Background(), &asset.PushDirectoryRequest{Uris: []string{uri}, RootDirectoryDigest: other})
+	assert.Equal(t, codes.InvalidArgument, grpc_status.Code(err))
+
+	for _, req := range []*asset.PushBlobRequest{
+		{Qualifiers: qualifiers, BlobDigest: digest},
+		{Uris: []string{uri}, Qualifiers: qualifiers},
+		{Uris: []string{uri}, BlobDigest: digest},
+		{Uris: []string{uri}, Qualifiers: []*asset.Qualifier{nil}, BlobDigest: digest},
+	} {
+		_, err = server.PushBlob(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, grpc_status.Code(err), "%v", req)
+	}
+	resp, err = server.FetchBlob(context.Background(), &asset.FetchBlobRequest{Uris: []string{uri}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.NotFound), resp.Status.Code)
+
+	missing := []byte("not uploaded")
+	_, err = server.PushBlob(context.Background(), &asset.PushBlobRequest{Uris: []string{uri}, Qualifiers: []*asset.Qualifier{{Name: QualifierChecksumSri, Value: sriOf(missing)}}, BlobDigest: digestOf(missing)})
+	assert.Equal(t, codes.FailedPrecondition, grpc_status.Code(err))
+}
+
+func TestFetchBlobChecksIndexHash(t *testing.T) {
+	content := []byte("downloaded content")
+	uri := "https://example.com/file"
+	server, cache, downloader := newTestServer(map[string][]byte{uri: content})
+	qualifiers := []*asset.Qualifier{{Name: QualifierChecksumSri, Value: sriOf(content)}}
+
+	// An index entry not matching the checksum, as created before pushes were checked.
+	wrong := cache.add([]byte("wrong content"))
+	_, err := server.index.Put(IndexKindBlob, uri, qualifiers, wrong, time.Time{})
+	require.NoError(t, err)
+
+	resp, err := server.FetchBlob(context.Background(), &asset.FetchBlobRequest{Uris: []string{uri}, Qualifiers: qualifiers})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), resp.Status.Code)
+	assert.Equal(t, digestOf(content).Hash, resp.BlobDigest.Hash)
+	assert.Equal(t, []string{uri}, downloader.fetched)
+}
+
+func TestFetchWithHeadersNotIndexed(t *testing.T) {
+	blob := []byte("private content")
+	archive := tarGzOf(t, archiveEntry{name: "file", mode: 0644})
+	content := map[string][]byte{
+		"https://example.com/private":        blob,
+		"https://example.com/private.tar.gz": archive,
+	}
+	server, _, downloader := newTestServer(content)
+	headers := []*asset.Qualifier{{Name: QualifierHTTPHeaderUrlPrefix + "0:Authorization", Value: "Bearer secret"}}
+
+	blobResp, err := server.FetchBlob(context.Background(), &asset.FetchBlobRequest{Uris: []string{"https://example.com/private"}, Qualifiers: headers})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), blobResp.Status.Code)
+	assert.Nil(t, blobResp.ExpiresAt)
+	dirResp, err := server.FetchDirectory(context.Background(), &asset.FetchDirectoryRequest{Uris: []string{"https://example.com/private.tar.gz"}, Qualifiers: headers})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), dirResp.Status.Code)
+	assert.Nil(t, dirResp.ExpiresAt)
+	assert.Empty(t, server.index)
+
+	// Callers without the credentials go through the download again.
+	fetched := len(downloader.fetched)
+	delete(content, "https://example.com/private")
+	blobResp, err = server.FetchBlob(context.Background(), &asset.FetchBlobRequest{Uris: []string{"https://example.com/private"}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.NotFound), blobResp.Status.Code)
+	assert.Equal(t, fetched+1, len(downloader.fetched))
+}
@@ -0,0 +1,152 @@
+package asset_service
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	QualifierHTTPHeaderPrefix    = "http_header:"
+	QualifierHTTPHeaderUrlPrefix = "http_header_url:"
+	QualifierChecksumSri         = "checksum.sri"
+	QualifierDirectory           = "directory"
+	QualifierResourceType        = "resource_type"
+)
+
+// fetchQualifiers are the qualifiers of a Fetch request understood by the server.
+//
+// See https://github.com/bazelbuild/remote-apis/blob/main/build/bazel/remote/asset/v1/qualifiers.md
+type fetchQualifiers struct {
+	// Headers to send with the request of all the URIs.
+	globalHeader http.Header
+	// Headers to send with the request of a single URI, by index of the URI.
+	uriSpecificHeaders map[int]http.Header
+
+	// Checksums the content must match, in Subresource Integrity format, and
+	// the hex encoded sha256 among them, if any: the last one, and all of them.
+	sri     string
+	sha256  string
+	sha256s []string
+
+	// Subdirectory of the unpacked archive to return, for FetchDirectory.
+	directory string
+	// Media type of the content, for FetchDirectory.
+	resourceType string
+}
+
+// parseQualifiers parses the qualifiers of a Fetch request for the uris.
+//
+// Invalid qualifiers are logged and ignored, a nil qualifier fails the request with the status returned.
+func parseQualifiers(errorLogger *log.Logger, uris []string, qualifiers []*asset.Qualifier) (*fetchQualifiers, *status.Status) {
+	parsed := &fetchQualifiers{
+		globalHeader:       http.Header{},
+		uriSpecificHeaders: make(map[int]http.Header),
+	}
+
+	for _, q := range qualifiers {
+		if q == nil {
+			return nil, &status.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: "unexpected nil qualifier in Fetch request",
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(q.Name, QualifierHTTPHeaderPrefix):
+			key := q.Name[len(QualifierHTTPHeaderPrefix):]
+
+			parsed.globalHeader[key] = strings.Split(q.Value, ",")
+
+		case strings.HasPrefix(q.Name, QualifierHTTPHeaderUrlPrefix):
+			idxAndKey := q.Name[len(QualifierHTTPHeaderUrlPrefix):]
+			parts := strings.Split(idxAndKey, ":")
+			if len(parts) != 2 {
+				errorLogger.Printf("invalid http_header_url qualifier: \"%s\"", idxAndKey)
+				continue
+			}
+
+			uriIndex, err := strconv.Atoi(parts[0])
+			if err != nil {
+				errorLogger.Printf("failed to parse URI index as int: %s", err)
+				continue
+			}
+
+			if uriIndex < 0 || uriIndex >= len(uris) {
+				errorLogger.Printf("URI index for header is out of range [0 - %d]: %d", len(uris)-1, uriIndex)
+				continue
+			}
+
+			if _, found := parsed.uriSpecificHeaders[uriIndex]; !found {
+				parsed.uriSpecificHeaders[uriIndex] = make(http.Header)
+			}
+			parsed.uriSpecificHeaders[uriIndex].Add(parts[1], q.Value)
+
+		case q.Name == QualifierChecksumSri:
+			// Ref: https://developer.mozilla.org/en-US/docs/Web/Security/Subresource_Integrity
+			parsed.sri = q.Value
+			for _, checksum := range strings.Fields(q.Value) {
+				if !strings.HasPrefix(checksum, "sha256-") {
+					continue
+				}
+				b64hash := strings.TrimPrefix(checksum, "sha256-")
+
+				decoded, err := base64.StdEncoding.DecodeString(b64hash)
+				if err != nil {
+					errorLogger.Printf("failed to base64 decode \"%s\": %v",
+						b64hash, err)
+					continue
+				}
+
+				parsed.sha256 = hex.EncodeToString(decoded)
+				parsed.sha256s = append(parsed.sha256s, parsed.sha256)
+			}
+
+		case q.Name == QualifierDirectory:
+			parsed.directory = q.Value
+
+		case q.Name == QualifierResourceType:
+			parsed.resourceType = q.Value
+		}
+	}
+	return parsed, nil
+}
+
+// headers returns the headers to send with the request of the URI with the index.
+func (q *fetchQualifiers) headers(uriIndex int) http.Header {
+	uriSpecificHeader := q.globalHeader.Clone()
+	if header, found := q.uriSpecificHeaders[uriIndex]; found {
+		for key, value := range header {
+			uriSpecificHeader[key] = value
+		}
+	}
+	return uriSpecificHeader
+}
+
+// hasHeaders returns true if headers are sent with the request of the URI with the index.
+//
+// Headers are not part of the index key, so content fetched with them, likely with
+// the credentials of the caller, must not be indexed: it would be returned to anyone.
+func (q *fetchQualifiers) hasHeaders(uriIndex int) bool {
+	return len(q.globalHeader) > 0 || len(q.uriSpecificHeaders[uriIndex]) > 0
+}
+
+// matchesSha256 returns true if the hex encoded sha256 hash matches any of the
+// sha256 checksums of the sri qualifier, or if there are none.
+func (q *fetchQualifiers) matchesSha256(hash string) bool {
+	if len(q.sha256s) == 0 {
+		return true
+	}
+	for _, sha256 := range q.sha256s {
+		if strings.EqualFold(sha256, hash) {
+			return true
+		}
+	}
+	return false
+}
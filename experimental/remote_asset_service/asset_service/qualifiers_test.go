@@ -0,0 +1,73 @@
+package asset_service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	asset "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"log"
+	"net/http"
+	"testing"
+)
+
+func TestParseQualifiers(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	sri := "sha384-AAAA sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	logs := &bytes.Buffer{}
+	uris := []string{"https://example.com/a", "https://mirror.example.com/a"}
+	q, st := parseQualifiers(log.New(logs, "", 0), uris, []*asset.Qualifier{
+		{Name: QualifierHTTPHeaderPrefix + "Accept", Value: "text/plain,text/html"},
+		{Name: QualifierHTTPHeaderPrefix + "Authorization", Value: "Bearer global"},
+		{Name: QualifierHTTPHeaderUrlPrefix + "1:Authorization", Value: "Bearer mirror"},
+		{Name: QualifierHTTPHeaderUrlPrefix + "2:Authorization", Value: "Bearer out of range"},
+		{Name: QualifierHTTPHeaderUrlPrefix + "one:Authorization", Value: "Bearer invalid index"},
+		{Name: QualifierHTTPHeaderUrlPrefix + "Authorization", Value: "Bearer no index"},
+		{Name: QualifierChecksumSri, Value: sri},
+		{Name: QualifierDirectory, Value: "pkg-1.0"},
+		{Name: QualifierResourceType, Value: "application/zip"},
+		{Name: "vcs.branch", Value: "main"},
+	})
+	require.Nil(t, st)
+
+	assert.Equal(t, sri, q.sri)
+	assert.Equal(t, hex.EncodeToString(sum[:]), q.sha256)
+	assert.Equal(t, "pkg-1.0", q.directory)
+	assert.Equal(t, "application/zip", q.resourceType)
+
+	assert.Equal(t, http.Header{
+		"Accept":        {"text/plain", "text/html"},
+		"Authorization": {"Bearer global"},
+	}, q.headers(0))
+	assert.Equal(t, http.Header{
+		"Accept":        {"text/plain", "text/html"},
+		"Authorization": {"Bearer mirror"},
+	}, q.headers(1))
+	// The uri specific headers don't change the global ones.
+	assert.Equal(t, []string{"Bearer global"}, q.headers(0)["Authorization"])
+	assert.True(t, q.hasHeaders(0))
+	assert.True(t, q.hasHeaders(1))
+
+	assert.Contains(t, logs.String(), "out of range")
+	assert.Contains(t, logs.String(), "failed to parse URI index")
+	assert.Contains(t, logs.String(), "invalid http_header_url qualifier")
+}
+
+func TestParseQualifiersInvalid(t *testing.T) {
+	logs := &bytes.Buffer{}
+	q, st := parseQualifiers(log.New(logs, "", 0), nil, []*asset.Qualifier{
+		{Name: QualifierChecksumSri, Value: "sha256-not*base64 sha512-ignored"},
+	})
+	require.Nil(t, st)
+	assert.Equal(t, "", q.sha256)
+	assert.Contains(t, logs.String(), "failed to base64 decode")
+	assert.False(t, q.hasHeaders(0))
+
+	_, st = parseQualifiers(log.New(logs, "", 0), nil, []*asset.Qualifier{{Name: QualifierDirectory, Value: "a"}, nil})
+	require.NotNil(t, st)
+	assert.Equal(t, int32(codes.InvalidArgument), st.Code)
+}
@@ -9,11 +9,15 @@ import (
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 
 	"github.com/buildbarn/bb-storage/pkg/program"
 	"github.com/ccontavalli/enkit/experimental/remote_asset_service/asset_service"
+	"github.com/ccontavalli/enkit/lib/config/factory"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/srand"
 )
 
 func usage() {
@@ -24,6 +28,7 @@ func usage() {
 
 type prog struct {
 	configPath string
+	indexFlags *factory.Flags
 }
 
 func (p *prog) run(ctx context.Context, siblingsGroup, dependenciesGroup program.Group) error {
@@ -41,6 +46,16 @@ func (p *prog) run(ctx context.Context, siblingsGroup, dependenciesGroup program
 	metrics := asset_service.NewMetrics()
 	assetDownloader := asset_service.NewAssetDownloader(config, proxyCache, urlFilter, metrics)
 
+	workspace, err := factory.NewStore(rand.New(srand.Source), factory.FromFlags(p.indexFlags))
+	if err != nil {
+		return err
+	}
+	store, err := workspace.Open("asset_service", "index")
+	if err != nil {
+		return err
+	}
+	index := asset_service.NewIndex(config, store)
+
 	grpcAddress := config.GrpcAddress()
 
 	var opts []grpc.ServerOption
@@ -54,7 +69,7 @@ func (p *prog) run(ctx context.Context, siblingsGroup, dependenciesGroup program
 
 	log.Println("Starting gRPC server on address", grpcAddress)
 
-	asset_service.RegisterAssetServer(config, grpcServer, proxyCache, assetDownloader)
+	asset_service.RegisterAssetServer(config, grpcServer, proxyCache, assetDownloader, index)
 
 	h := health.NewServer()
 	grpc_health_v1.RegisterHealthServer(grpcServer, h)
@@ -85,6 +100,7 @@ func main() {
 	flag.Usage = usage
 
 	local := flag.Bool("local", false, "Run in non daemon mode")
+	indexFlags := factory.DefaultFlags().Register(&kflags.GoFlagSet{FlagSet: flag.CommandLine}, "index-")
 
 	optind := permutateArgs(os.Args)
 	flag.Parse()
@@ -95,7 +111,7 @@ func main() {
 		return
 	}
 
-	p := &prog{configPath: args[0]}
+	p := &prog{configPath: args[0], indexFlags: indexFlags}
 
 	if *local {
 		err := program.RunLocal(context.Background(), p.run)
@@ -3,34 +3,73 @@ package exec
 import (
 	"context"
 	"fmt"
-	"os"
-	"os/exec"
+	"strconv"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
 )
 
 var (
 	faketreeBin = "faketree" // Allows for tests to set an explicit path
 )
 
-func Run(ctx context.Context, promptStr string, dirMap map[string]string, chdir string, innerCmd []string) error {
-	args := []string{}
-	for src, dest := range dirMap {
-		args = append(args, "--mount", fmt.Sprintf("%s:%s", src, dest))
-	}
-	if chdir != "" {
-		args = append(args, "--chdir", chdir)
-	}
-	if len(innerCmd) > 0 {
-		args = append(args, "--")
-		args = append(args, innerCmd...)
+// Sandbox configures the isolation of the commands run with faketree.
+//
+// The zero value runs commands with the network and resources of the host.
+type Sandbox struct {
+	// Network of the command, one of host, none, loopback. Empty means host.
+	Net string
+	// Resource limits, empty or zero means no limit. Require cgroup v2.
+	Memory string
+	CPUs   string
+	Pids   int
+	// Seccomp profile, "default" or the path of a json profile.
+	Seccomp string
+}
+
+func DefaultSandbox() *Sandbox {
+	return &Sandbox{}
+}
+
+func (s *Sandbox) Register(set kflags.FlagSet, prefix string) *Sandbox {
+	set.StringVar(&s.Net, prefix+"net", s.Net, "Network available to the command: host, none, or loopback")
+	set.StringVar(&s.Memory, prefix+"memory", s.Memory, "If set, limit the memory available to the command, as in 512M or 2GiB")
+	set.StringVar(&s.CPUs, prefix+"cpus", s.CPUs, "If set, limit the CPU time available to the command, in number of CPUs, as in 1.5")
+	set.IntVar(&s.Pids, prefix+"pids", s.Pids, "If set, limit the number of processes and threads the command can create")
+	set.StringVar(&s.Seccomp, prefix+"seccomp", s.Seccomp, "If set, seccomp profile to apply to the command: 'default', or the path of a json profile")
+	return s
+}
+
+// Spec returns a Spec configuring the sandbox.
+func (s *Sandbox) Spec() (*Spec, error) {
+	spec := &Spec{Version: SpecVersion, Net: s.Net, Memory: s.Memory, Pids: s.Pids, Seccomp: s.Seccomp}
+	if s.CPUs != "" {
+		cpus, err := strconv.ParseFloat(s.CPUs, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpus %q - %w", s.CPUs, err)
+		}
+		spec.CPUs = cpus
 	}
+	return spec, nil
+}
 
-	cmd := exec.CommandContext(ctx, faketreeBin, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("PS1=%s", promptStr),
-	)
+// Run runs innerCmd in faketree, with the directories in dirMap mounted, and no sandboxing.
+func Run(ctx context.Context, promptStr string, dirMap map[string]string, chdir string, innerCmd []string) error {
+	return DefaultSandbox().Run(ctx, promptStr, dirMap, chdir, innerCmd)
+}
 
-	return cmd.Run()
+// Run runs innerCmd in faketree, with the directories in dirMap mounted, isolated as per sandbox.
+//
+// Returns an ExitStatus if innerCmd fails.
+func (s *Sandbox) Run(ctx context.Context, promptStr string, dirMap map[string]string, chdir string, innerCmd []string) error {
+	spec, err := s.Spec()
+	if err != nil {
+		return err
+	}
+	for src, dest := range dirMap {
+		spec.Mounts = append(spec.Mounts, Mount{Source: src, Target: dest})
+	}
+	spec.Workdir = chdir
+	spec.Env = map[string]string{"PS1": promptStr}
+	spec.Command = innerCmd
+	return spec.Run(ctx)
 }
@@ -42,3 +42,21 @@ func TestRun(t *testing.T) {
 	)
 	assert.ErrorContains(t, gotErr, "exit status 1")
 }
+
+func TestSandboxSpec(t *testing.T) {
+	spec, err := DefaultSandbox().Spec()
+	assert.NoError(t, err)
+	flags, err := spec.Flags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, flags)
+
+	sandbox := &Sandbox{Net: "none", Memory: "1G", CPUs: "0.5", Pids: 64, Seccomp: "default"}
+	spec, err = sandbox.Spec()
+	assert.NoError(t, err)
+	flags, err = spec.Flags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--net", "none", "--memory", "1G", "--cpus", "0.5", "--pids", "64", "--seccomp", "default"}, flags)
+
+	_, err = (&Sandbox{CPUs: "many"}).Spec()
+	assert.Error(t, err)
+}
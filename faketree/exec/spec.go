@@ -0,0 +1,321 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/config/marshal"
+	"github.com/ccontavalli/enkit/lib/multierror"
+)
+
+// SpecVersion is the version of the spec format supported.
+const SpecVersion = 1
+
+// ExitSetupFailed is the status faketree exits with when the sandbox cannot be set up.
+const ExitSetupFailed = 125
+
+// ExitTimeout is the status faketree exits with when the command was killed due to timeout.
+const ExitTimeout = 124
+
+// ExitStatus is the error returned when the command run in the sandbox exits with a non zero status.
+//
+// Mimicking the shell, a command killed by a signal has status 128 + signal number.
+type ExitStatus int
+
+func (es ExitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(es))
+}
+
+func (es ExitStatus) ExitCode() int {
+	return int(es)
+}
+
+// Mount is a file or directory to mount in the sandbox.
+type Mount struct {
+	// Empty for file systems with no source, like proc.
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	Target string `json:"target" yaml:"target"`
+	// Same as the options of --mount, as in "recursive,bind,ro" or "type=tmpfs".
+	Options string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// Overlay is a copy-on-write view of one or more directories, see --overlay.
+type Overlay struct {
+	Lower  []string `json:"lower" yaml:"lower"`
+	Target string   `json:"target" yaml:"target"`
+	// Directory capturing the writes, a scratch directory is used if empty.
+	Upper string `json:"upper,omitempty" yaml:"upper,omitempty"`
+	Work  string `json:"work,omitempty" yaml:"work,omitempty"`
+}
+
+// Tmpfs is an ephemeral, memory backed, directory.
+type Tmpfs struct {
+	Target string `json:"target" yaml:"target"`
+	// As in 64m or 1g, no limit other than the tmpfs default if empty.
+	Size string `json:"size,omitempty" yaml:"size,omitempty"`
+	// Octal permissions, as in 1777.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// Spec describes a faketree sandbox, and the command to run in it.
+//
+// Specs can be loaded from yaml or json files with LoadSpec, passed to the
+// faketree binary with --spec, or run directly with Run.
+type Spec struct {
+	// Must be SpecVersion.
+	Version int `json:"version" yaml:"version"`
+
+	Mounts   []Mount   `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	Overlays []Overlay `json:"overlays,omitempty" yaml:"overlays,omitempty"`
+	Tmpfs    []Tmpfs   `json:"tmpfs,omitempty" yaml:"tmpfs,omitempty"`
+
+	// User and group names or ids the command runs as. Same as the caller if empty.
+	Uid string `json:"uid,omitempty" yaml:"uid,omitempty"`
+	Gid string `json:"gid,omitempty" yaml:"gid,omitempty"`
+	// Run as uid 0 and gid 0, overrides Uid and Gid.
+	Root bool `json:"root,omitempty" yaml:"root,omitempty"`
+
+	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	// Environment variables to set for the command, in addition to the ones inherited.
+	Env map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	// Working directory of the command, created if it does not exist.
+	Workdir string `json:"workdir,omitempty" yaml:"workdir,omitempty"`
+
+	// Process handling, as per the --wait, --propagate, --wait-term flags. Default true.
+	Wait      *bool `json:"wait,omitempty" yaml:"wait,omitempty"`
+	Propagate *bool `json:"propagate,omitempty" yaml:"propagate,omitempty"`
+	WaitTerm  *bool `json:"wait_term,omitempty" yaml:"wait_term,omitempty"`
+	// How long to wait for leftover processes once the command terminates, as in 30s.
+	WaitTimeout string `json:"wait_timeout,omitempty" yaml:"wait_timeout,omitempty"`
+	// Maximum run time of the command, as in 10m. No limit if empty.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Isolation, as per the --net, --memory, --cpus, --pids and --seccomp flags.
+	Net     string  `json:"net,omitempty" yaml:"net,omitempty"`
+	Memory  string  `json:"memory,omitempty" yaml:"memory,omitempty"`
+	CPUs    float64 `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	Pids    int     `json:"pids,omitempty" yaml:"pids,omitempty"`
+	Seccomp string  `json:"seccomp,omitempty" yaml:"seccomp,omitempty"`
+
+	// Command to run, the default shell if empty.
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+}
+
+// LoadSpec reads a spec from a yaml or json file.
+//
+// The format is determined by the extension, yaml is assumed if unknown.
+func LoadSpec(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spec - %w", err)
+	}
+
+	spec := &Spec{}
+	if err := marshal.FileMarshallers(marshal.Known).UnmarshalDefault(path, data, marshal.Yaml, spec); err != nil {
+		return nil, fmt.Errorf("could not parse spec %s - %w", path, err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid spec %s - %w", path, err)
+	}
+	return spec, nil
+}
+
+// Validate returns an error if the spec is incomplete or invalid.
+func (s *Spec) Validate() error {
+	if s.Version != SpecVersion {
+		return fmt.Errorf("unsupported version %d - only version %d is supported", s.Version, SpecVersion)
+	}
+
+	var errs []error
+	for ix, mount := range s.Mounts {
+		if mount.Target == "" {
+			errs = append(errs, fmt.Errorf("mount #%d has no target", ix))
+		}
+	}
+	for ix, overlay := range s.Overlays {
+		if overlay.Target == "" || len(overlay.Lower) == 0 {
+			errs = append(errs, fmt.Errorf("overlay #%d must have a target and at least one lower directory", ix))
+		}
+	}
+	for ix, tmpfs := range s.Tmpfs {
+		if tmpfs.Target == "" {
+			errs = append(errs, fmt.Errorf("tmpfs #%d has no target", ix))
+		}
+	}
+	for key := range s.Env {
+		if key == "" || strings.Contains(key, "=") {
+			errs = append(errs, fmt.Errorf("invalid environment variable name %q", key))
+		}
+	}
+	for _, duration := range [][2]string{{"wait_timeout", s.WaitTimeout}, {"timeout", s.Timeout}} {
+		if duration[1] == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(duration[1]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s - %w", duration[0], err))
+		}
+	}
+	return multierror.New(errs)
+}
+
+// Flags returns the faketree command line flags to create the sandbox.
+func (s *Spec) Flags() ([]string, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	for _, mount := range s.Mounts {
+		value := mount.Source + ":" + mount.Target
+		if mount.Options != "" {
+			value += ":" + mount.Options
+		}
+		args = append(args, "--mount", value)
+	}
+	for _, overlay := range s.Overlays {
+		value := strings.Join(overlay.Lower, ",") + ":" + overlay.Target
+		options := []string{}
+		if overlay.Upper != "" {
+			options = append(options, "upper="+overlay.Upper)
+		}
+		if overlay.Work != "" {
+			options = append(options, "work="+overlay.Work)
+		}
+		if len(options) > 0 {
+			value += ":" + strings.Join(options, ",")
+		}
+		args = append(args, "--overlay", value)
+	}
+	for _, tmpfs := range s.Tmpfs {
+		options := []string{}
+		if tmpfs.Size != "" {
+			options = append(options, "size="+tmpfs.Size)
+		}
+		if tmpfs.Mode != "" {
+			options = append(options, "mode="+tmpfs.Mode)
+		}
+		value := tmpfs.Target
+		if len(options) > 0 {
+			value += ":" + strings.Join(options, ",")
+		}
+		args = append(args, "--tmpfs", value)
+	}
+
+	if s.Root {
+		args = append(args, "--root")
+	}
+	if s.Uid != "" {
+		args = append(args, "--uid", s.Uid)
+	}
+	if s.Gid != "" {
+		args = append(args, "--gid", s.Gid)
+	}
+	if s.Hostname != "" {
+		args = append(args, "--hostname", s.Hostname)
+	}
+	keys := []string{}
+	for key := range s.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--env", key+"="+s.Env[key])
+	}
+	if s.Workdir != "" {
+		args = append(args, "--chdir", s.Workdir)
+	}
+
+	for _, flag := range []struct {
+		name  string
+		value *bool
+	}{{"wait", s.Wait}, {"propagate", s.Propagate}, {"wait-term", s.WaitTerm}} {
+		if flag.value != nil {
+			args = append(args, fmt.Sprintf("--%s=%t", flag.name, *flag.value))
+		}
+	}
+	if s.WaitTimeout != "" {
+		args = append(args, "--wait-timeout", s.WaitTimeout)
+	}
+	if s.Timeout != "" {
+		args = append(args, "--timeout", s.Timeout)
+	}
+
+	if s.Net != "" {
+		args = append(args, "--net", s.Net)
+	}
+	if s.Memory != "" {
+		args = append(args, "--memory", s.Memory)
+	}
+	if s.CPUs != 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(s.CPUs, 'f', -1, 64))
+	}
+	if s.Pids != 0 {
+		args = append(args, "--pids", strconv.Itoa(s.Pids))
+	}
+	if s.Seccomp != "" {
+		args = append(args, "--seccomp", s.Seccomp)
+	}
+	return args, nil
+}
+
+// Args returns the faketree command line to run the command in the sandbox.
+func (s *Spec) Args() ([]string, error) {
+	args, err := s.Flags()
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Command) > 0 {
+		args = append(args, "--")
+		args = append(args, s.Command...)
+	}
+	return args, nil
+}
+
+// Cmd returns an exec.Cmd running the command in the sandbox.
+//
+// The command inherits stdin, stdout and stderr, which can be changed before it is started.
+// Use ExitError to convert the error returned by Run or Wait in an ExitStatus.
+func (s *Spec) Cmd(ctx context.Context) (*exec.Cmd, error) {
+	args, err := s.Args()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, faketreeBin, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// Run runs the command in the sandbox, and waits for it to terminate.
+//
+// Returns an ExitStatus if the command or faketree exited with a non zero status,
+// ExitSetupFailed indicating that faketree could not set up the sandbox.
+func (s *Spec) Run(ctx context.Context) error {
+	cmd, err := s.Cmd(ctx)
+	if err != nil {
+		return err
+	}
+	return ExitError(cmd.Run())
+}
+
+// ExitError converts an *exec.ExitError into an ExitStatus, returns any other error unchanged.
+func ExitError(err error) error {
+	var eerr *exec.ExitError
+	if !errors.As(err, &eerr) {
+		return err
+	}
+	if status, ok := eerr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return ExitStatus(128 + int(status.Signal()))
+	}
+	return ExitStatus(eerr.ExitCode())
+}
@@ -0,0 +1,130 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/runfiles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSpec(t *testing.T) {
+	dir := t.TempDir()
+	yaml := filepath.Join(dir, "spec.yaml")
+	require.NoError(t, os.WriteFile(yaml, []byte(`
+version: 1
+mounts:
+  - {source: /opt/data, target: /data, options: "recursive,bind,ro"}
+  - {target: /tmp/scratch, options: "type=tmpfs"}
+overlays:
+  - {lower: [/opt/toolchain, /opt/base], target: /toolchain, upper: /tmp/upper}
+tmpfs:
+  - {target: /tmp, size: 1g, mode: "1777"}
+root: true
+hostname: builder
+env: {LANG: C, A: "b=c"}
+workdir: /data
+wait: false
+wait_timeout: 30s
+timeout: 1h
+net: loopback
+cpus: 1.5
+pids: 64
+seccomp: default
+command: [make, test]
+`), 0o644))
+
+	spec, err := LoadSpec(yaml)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"make", "test"}, spec.Command)
+	args, err := spec.Args()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"--mount", "/opt/data:/data:recursive,bind,ro",
+		"--mount", ":/tmp/scratch:type=tmpfs",
+		"--overlay", "/opt/toolchain,/opt/base:/toolchain:upper=/tmp/upper",
+		"--tmpfs", "/tmp:size=1g,mode=1777",
+		"--root",
+		"--hostname", "builder",
+		"--env", "A=b=c",
+		"--env", "LANG=C",
+		"--chdir", "/data",
+		"--wait=false",
+		"--wait-timeout", "30s",
+		"--timeout", "1h",
+		"--net", "loopback",
+		"--cpus", "1.5",
+		"--pids", "64",
+		"--seccomp", "default",
+		"--", "make", "test",
+	}, args)
+
+	json := filepath.Join(dir, "spec.json")
+	require.NoError(t, os.WriteFile(json, []byte(`{"version": 1, "uid": "nobody", "memory": "1G", "propagate": true}`), 0o644))
+	spec, err = LoadSpec(json)
+	require.NoError(t, err)
+	args, err = spec.Args()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--uid", "nobody", "--propagate=true", "--memory", "1G"}, args)
+
+	for _, invalid := range []string{
+		`{}`,
+		`{"version": 2}`,
+		`{"version": 1, "mounts": [{"source": "/tmp"}]}`,
+		`{"version": 1, "overlays": [{"target": "/tmp"}]}`,
+		`{"version": 1, "env": {"A=B": "C"}}`,
+		`{"version": 1, "timeout": "forever"}`,
+		`{"version": 1, "command": "make"}`,
+	} {
+		require.NoError(t, os.WriteFile(json, []byte(invalid), 0o644))
+		_, err := LoadSpec(json)
+		assert.Error(t, err, "%s", invalid)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	assert.Equal(t, ExitStatus(3), ExitError(err))
+
+	err = exec.Command("/bin/sh", "-c", "kill -9 $$").Run()
+	assert.Equal(t, ExitStatus(137), ExitError(err))
+
+	other := errors.New("other")
+	assert.Equal(t, other, ExitError(other))
+	assert.Nil(t, ExitError(nil))
+	assert.Equal(t, "exit status 3", ExitStatus(3).Error())
+}
+
+func TestSpecRun(t *testing.T) {
+	path, err := runfiles.Rlocation("enkit/faketree/faketree_/faketree")
+	if err != nil {
+		t.Skipf("faketree binary not available - %v", err)
+	}
+	defer func(oldPath string) {
+		faketreeBin = oldPath
+	}(faketreeBin)
+	faketreeBin = path
+
+	out := filepath.Join(os.Getenv("TEST_TMPDIR"), "out")
+	spec := &Spec{
+		Version: SpecVersion,
+		Mounts:  []Mount{{Source: os.Getenv("TEST_TMPDIR"), Target: "/tmp/sandbox"}},
+		Env:     map[string]string{"GREETING": "hello"},
+		Workdir: "/tmp/sandbox",
+		Command: []string{"/bin/sh", "-c", "echo $GREETING > out; exit 7"},
+	}
+	err = spec.Run(context.Background())
+	assert.Equal(t, ExitStatus(7), err)
+
+	data, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(data))
+
+	spec = &Spec{Version: SpecVersion, Timeout: "100ms", Command: []string{"/bin/sleep", "10"}}
+	assert.Equal(t, ExitStatus(ExitTimeout), spec.Run(context.Background()))
+}
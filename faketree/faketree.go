@@ -13,9 +13,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/pkg/reexec"
+	ftexec "github.com/ccontavalli/enkit/faketree/exec"
 	"github.com/ccontavalli/enkit/lib/multierror"
 	"github.com/spf13/pflag"
 )
@@ -52,15 +54,8 @@ func (mf *MountFlags) Normalize() (*MountFlags, error) {
 // ExitStatus wraps an exit code into an error.
 //
 // Workaround as there is no accessible constructor to create an ExitError.
-type ExitStatus int
-
-func (es ExitStatus) Error() string {
-	return fmt.Sprintf("process exited with status %d", int(es))
-}
-
-func (es ExitStatus) ExitCode() int {
-	return int(es)
-}
+// Shared with the library, so callers get the same errors.
+type ExitStatus = ftexec.ExitStatus
 
 // WaitChildren waits for all children of this process to die.
 //
@@ -351,6 +346,25 @@ type Flags struct {
 
 	Uid, Gid int
 	Mount    []MountFlags
+	Overlay  []OverlayFlags
+	Tmpfs    []TmpfsFlags
+
+	// Where to write the list of changes captured by overlays, "-" for stderr.
+	OverlayDiff string
+	// Where to write a tar archive of the changes captured by overlays.
+	OverlayExport string
+
+	// One of NetHost, NetNone, NetLoopback.
+	Net string
+	// Resource limits, applied via cgroup v2.
+	Limits Limits
+	// Path of a seccomp profile, or SeccompDefault for the built in one.
+	Seccomp string
+
+	// Environment variables to set for the command, as KEY=VALUE.
+	Env []string
+	// Maximum run time of the command, 0 for no limit.
+	CommandTimeout time.Duration
 }
 
 // Args turns the content of the Flags object into a set of command line flags.
@@ -402,6 +416,21 @@ func (opts *Flags) Args() []string {
 	for _, mount := range opts.Mount {
 		args = append(args, "--mount", mount.String())
 	}
+	for _, overlay := range opts.Overlay {
+		args = append(args, "--overlay", overlay.String())
+	}
+	for _, tmpfs := range opts.Tmpfs {
+		args = append(args, "--tmpfs", tmpfs.String())
+	}
+	if opts.Net != NetHost {
+		args = append(args, "--net", opts.Net)
+	}
+	if opts.Seccomp != "" {
+		args = append(args, "--seccomp", opts.Seccomp)
+	}
+	for _, env := range opts.Env {
+		args = append(args, "--env", env)
+	}
 	return args
 }
 
@@ -476,7 +505,7 @@ func RealPath(path string) (string, error) {
 const kDefaultPerms = 0o755
 
 // Default exit code used to indicate an error in faketree itself.
-const kDefaultExit = 125
+const kDefaultExit = ftexec.ExitSetupFailed
 
 // Default timeout when wait is enabled before sending SIGKILL.
 //
@@ -494,6 +523,7 @@ func NewFlags() *Flags {
 		TermOnWait: true,
 		Propagate:  true,
 		Timeout:    kDefaultTimeout,
+		Net:        NetHost,
 	}
 
 	// Realpath may fail due to how procfs is mounted.
@@ -514,8 +544,36 @@ func (opts *Flags) LogOrFail(msg string, args ...interface{}) {
 
 // Parses the specified command line arguments into a Flags object.
 //
+// If --spec is supplied, the spec is loaded first, and the flags on the
+// command line override the values in the spec.
+//
 // Returns the arguments that were not parsed, or an error.
 func (opts *Flags) Parse(argv []string) ([]string, error) {
+	left, spec, err := opts.parse(argv)
+	if err != nil || spec == "" {
+		return left, err
+	}
+
+	loaded, err := ftexec.LoadSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := loaded.Flags()
+	if err != nil {
+		return nil, err
+	}
+
+	*opts = *NewFlags()
+	if left, _, err = opts.parse(append(flags, argv...)); err != nil {
+		return nil, err
+	}
+	if len(left) == 0 {
+		left = loaded.Command
+	}
+	return left, nil
+}
+
+func (opts *Flags) parse(argv []string) ([]string, string, error) {
 	fs := pflag.NewFlagSet("faketree", pflag.ContinueOnError)
 
 	fs.BoolVar(&opts.Root, "root", opts.Root, "Make the command believe it has root (will force uid=0 and gid=0 regardless of --uid and --gid options)")
@@ -549,39 +607,94 @@ func (opts *Flags) Parse(argv []string) ([]string, error) {
 	var mounts []string
 	fs.StringArrayVar(&mounts, "mount", nil, "Override the layout of the filesystem to have the specified directories mounted. "+
 		"Syntax is: --mount path:destination:[options[,type=type]?[,data=...]?]?.")
+	var overlays []string
+	fs.StringArrayVar(&overlays, "overlay", nil, "Mount the lower directories read only at destination, capturing all writes in an upper directory. "+
+		"Syntax is: --overlay lower[,lower...]:destination[:upper=dir[,work=dir]]. Without upper=, a scratch directory "+
+		"is used, and removed once the command terminates.")
+	var tmpfs []string
+	fs.StringArrayVar(&tmpfs, "tmpfs", nil, "Mount an empty, ephemeral, tmpfs at destination. "+
+		"Syntax is: --tmpfs destination[:size=64m[,mode=1777]].")
+	fs.StringVar(&opts.OverlayDiff, "overlay-diff", opts.OverlayDiff, "Once the command terminates, write the list of files added (A), "+
+		"changed (C) or deleted (D) in the overlays to the specified file, or stderr if no file is specified.")
+	fs.Lookup("overlay-diff").NoOptDefVal = "-"
+	fs.StringVar(&opts.OverlayExport, "overlay-export", opts.OverlayExport, "Once the command terminates, write the files changed in the "+
+		"overlays to the specified tar file, in the format of an OCI image layer.")
+
+	fs.StringVar(&opts.Net, "net", opts.Net, "Network to provide to the command, one of: "+strings.Join(kNetModes, ", ")+". "+
+		"none and loopback create a new network namespace, with no interface up, or only the loopback interface up.")
+	fs.StringVar(&opts.Limits.Memory, "memory", opts.Limits.Memory, "Limit the memory available to the command, as in 512M or 2GiB. "+
+		"Resource limits require cgroup v2, and a cgroup delegated to the user - see help screen for more details.")
+	fs.Float64Var(&opts.Limits.CPUs, "cpus", opts.Limits.CPUs, "Limit the CPU time available to the command, in number of CPUs, as in 1.5")
+	fs.IntVar(&opts.Limits.Pids, "pids", opts.Limits.Pids, "Limit the number of processes and threads the command can create")
+	fs.StringVar(&opts.Seccomp, "seccomp", opts.Seccomp, "Apply a seccomp profile to the command. Either '"+SeccompDefault+"', "+
+		"to deny system calls not expected in builds and tests, or the path of a json profile - see help screen for more details.")
+
+	fs.StringArrayVar(&opts.Env, "env", opts.Env, "Set an environment variable for the command, as in --env KEY=VALUE. Can be repeated.")
+	fs.DurationVar(&opts.CommandTimeout, "timeout", opts.CommandTimeout, "Kill the command and all its children if still running after "+
+		"the specified time, exiting with status 124. 0 means no timeout.")
+	var spec string
+	fs.StringVar(&spec, "spec", "", "Load the configuration of the sandbox from a yaml or json spec file - see help screen for more details.")
 
 	if err := fs.Parse(argv); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if err := ValidNet(opts.Net); err != nil {
+		return nil, "", err
+	}
+	if _, err := opts.Limits.Files(); err != nil {
+		return nil, "", err
+	}
+	for _, env := range opts.Env {
+		if key, _, found := strings.Cut(env, "="); !found || key == "" {
+			return nil, "", fmt.Errorf("invalid --env %q - must be in the form KEY=VALUE", env)
+		}
 	}
 
 	for _, mount := range mounts {
 		m, err := NewMountFlags(mount)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		opts.Mount = append(opts.Mount, *m)
 	}
+	for _, overlay := range overlays {
+		o, err := NewOverlayFlags(overlay)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.Overlay = append(opts.Overlay, *o)
+	}
+	for _, t := range tmpfs {
+		tf, err := NewTmpfsFlags(t)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.Tmpfs = append(opts.Tmpfs, *tf)
+	}
+	if (opts.OverlayDiff != "" || opts.OverlayExport != "") && len(opts.Overlay) == 0 {
+		return nil, "", errNoOverlays
+	}
 
 	var err error
 	if !opts.Root {
 		if uid != "" {
 			opts.Uid, opts.Gid, err = ParseOrLookupUser(uid)
 			if err != nil {
-				return nil, err
+				return nil, "", err
 			}
 		}
 
 		if gid != "" {
 			opts.Gid, err = ParseOrLookupGroup(gid)
 			if err != nil {
-				return nil, err
+				return nil, "", err
 			}
 		}
 	} else {
 		opts.Uid, opts.Gid = 0, 0
 	}
 
-	return fs.Args(), nil
+	return fs.Args(), spec, nil
 }
 
 func initializeSystem() {
@@ -591,6 +704,12 @@ func initializeSystem() {
 		exit(err)
 	}
 
+	if flags.Net == NetLoopback {
+		if err := LoopbackUp(); err != nil {
+			flags.LogOrFail("Could not configure network - %v", err)
+		}
+	}
+
 	if flags.Hostname != "" {
 		if err := syscall.Sethostname([]byte(flags.Hostname)); err != nil {
 			flags.LogOrFail("Error setting hostname - %s\n", err)
@@ -610,13 +729,20 @@ func initializeSystem() {
 			continue
 		}
 
-		mkerr := mount.MakeTarget(os.FileMode(flags.Perms))
-		if err := mount.Mount(); err != nil {
-			if mkerr != nil {
-				flags.LogOrFail("Could not create mount target %s - %v", mount.Target, mkerr)
-			}
-			flags.LogOrFail("Could not mount %s - %v", mount, err)
+		flags.MountOrLog(mount)
+	}
+
+	// Overlays and tmpfs are mounted after --mount, so they can be placed on top.
+	for _, overlay := range flags.Overlay {
+		mount, err := overlay.MountFlags()
+		if err != nil {
+			flags.LogOrFail("Skipping overlay %s - %v", overlay, err)
+			continue
 		}
+		flags.MountOrLog(mount)
+	}
+	for _, tmpfs := range flags.Tmpfs {
+		flags.MountOrLog(tmpfs.MountFlags())
 	}
 
 	// Why is this necessary? Mostly to unconfuse golang libraries.
@@ -654,6 +780,17 @@ func initializeSystem() {
 	enterPrivileges(flags, left)
 }
 
+// MountOrLog creates the target directory and mounts the file system, logging any error.
+func (opts *Flags) MountOrLog(mount *MountFlags) {
+	mkerr := mount.MakeTarget(os.FileMode(opts.Perms))
+	if err := mount.Mount(); err != nil {
+		if mkerr != nil {
+			opts.LogOrFail("Could not create mount target %s - %v", mount.Target, mkerr)
+		}
+		opts.LogOrFail("Could not mount %s - %v", mount, err)
+	}
+}
+
 func initializePrivileges() {
 	flags := NewFlags()
 	left, err := flags.Parse(os.Args[1:])
@@ -678,6 +815,22 @@ func initializePrivileges() {
 		os.Setenv("PWD", flags.Chdir)
 	}
 
+	for _, env := range flags.Env {
+		key, value, _ := strings.Cut(env, "=")
+		os.Setenv(key, value)
+	}
+
+	// Last, as the profile may deny the system calls above.
+	if flags.Seccomp != "" {
+		profile, err := LoadSeccompProfile(flags.Seccomp)
+		if err == nil {
+			err = profile.Install()
+		}
+		if err != nil {
+			exit(fmt.Errorf("Could not apply --seccomp %s - %w", flags.Seccomp, err))
+		}
+	}
+
 	Exec(left...)
 }
 
@@ -729,6 +882,36 @@ func enterSystem() {
 		exit(err)
 	}
 
+	// The profile is read again after mounts are set up, validate it now and make
+	// sure the path is absolute, so it is not affected by --chdir.
+	if flags.Seccomp != "" && flags.Seccomp != SeccompDefault {
+		if flags.Seccomp, err = filepath.Abs(flags.Seccomp); err != nil {
+			exit(err)
+		}
+		if _, err := LoadSeccompProfile(flags.Seccomp); err != nil {
+			exit(err)
+		}
+	}
+
+	var cgroup *Cgroup
+	if !flags.Limits.Empty() {
+		if cgroup, err = NewCgroup(&flags.Limits); err != nil {
+			exit(fmt.Errorf("Could not apply resource limits - %w", err))
+		}
+	}
+
+	// The upper directories must be created outside of the namespaces,
+	// so they are still accessible once the command terminates.
+	for i := range flags.Overlay {
+		if err := flags.Overlay[i].Prepare(os.FileMode(flags.Perms)); err != nil {
+			flags.ReportOverlays()
+			if cgroup != nil {
+				cgroup.Close()
+			}
+			exit(err)
+		}
+	}
+
 	cmd := NextCommand("initialize-system", flags, left)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -736,7 +919,8 @@ func enterSystem() {
 			syscall.CLONE_NEWNS | // independent set of mounts.
 			syscall.CLONE_NEWUTS | // host and domain names.
 			syscall.CLONE_NEWIPC | // sysv ipc
-			syscall.CLONE_NEWUSER, // new user namespace
+			syscall.CLONE_NEWUSER | // new user namespace
+			NetCloneflags(flags.Net), // network, if requested.
 
 		UidMappings: []syscall.SysProcIDMap{
 			{
@@ -754,11 +938,30 @@ func enterSystem() {
 		},
 	}
 
-	RunAndWait(
+	if cgroup != nil {
+		// Only the first process is placed in the cgroup, all others inherit it.
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = cgroup.FD()
+	}
+
+	err = RunAndWait(
 		false,           // Wait for ALL children.
 		flags.Propagate, // Make sure signals are propagated.
 		false,           // Do not send SIGTERM to children if the main command dies (would duplicate).
-		flags.Timeout, cmd, 0)
+		flags.Timeout, flags.CommandTimeout, cmd, 0)
+
+	if rerr := flags.ReportOverlays(); rerr != nil {
+		log.Printf("%v", rerr)
+		if err == nil {
+			err = rerr
+		}
+	}
+	if cgroup != nil {
+		if cerr := cgroup.Close(); cerr != nil {
+			log.Printf("Could not remove cgroup %s - %v", cgroup.Path, cerr)
+		}
+	}
+	exit(err)
 }
 
 var kHelpScreen = `
@@ -818,6 +1021,101 @@ Mount syntax:
     - Most mount(8) options are supported, with the similar semantics:
       ` + strings.Join(KnownOptions.List(), ",") + `
 
+Overlays and tmpfs:
+
+  The --overlay option mounts one or more read only lower directories
+  at the destination, with all the writes captured in an upper directory:
+     '--overlay lower[,lower...]:dest[:upper=dir[,work=dir]]'
+
+  For example:
+
+     faketree --overlay /opt/toolchain:/opt/toolchain \
+              --tmpfs /tmp:size=1g --overlay-diff -- make
+         Runs make with /opt/toolchain writable, but leaving the original
+	 untouched, and /tmp on a tmpfs limited to 1g of memory. Once make
+	 terminates, the files added (A), changed (C) or deleted (D) in
+	 /opt/toolchain are printed on stderr.
+
+  With this syntax:
+    - The first lower directory is the top most. The upper directory
+      and the work directory must be on the same file system, the
+      work directory defaults to the upper directory name + ".work".
+    - Without upper=, a scratch directory is created and deleted once
+      the command terminates. Use --overlay-diff or --overlay-export to
+      retrieve the changes, the latter writes a tar file in the format
+      of an OCI image layer, with .wh. files marking deletions.
+    - Overlays are mounted after any --mount, and tmpfs after overlays.
+    - Mounting overlays from a user namespace requires linux >= 5.11.
+
+  The --tmpfs option accepts the size=, nr_blocks=, nr_inodes=, mode=,
+  uid=, gid= and huge= options of tmpfs(5), comma separated.
+
+Isolation:
+
+  By default, the command shares the network of the host, and has the
+  same resources available as faketree.
+
+  --net=none creates a new network namespace, with no interfaces up.
+  --net=loopback is the same, but brings up the loopback interface, so
+  the command can still use 127.0.0.1 or ::1 to talk to itself.
+
+  --memory, --cpus and --pids limit the resources available to the
+  command and all its children. They require a cgroup v2 hierarchy, and
+  the cgroup of faketree to be delegated to the user, for example with:
+
+     systemd-run --user --scope -p Delegate=yes -- \
+         faketree --memory 2G --cpus 1.5 --pids 512 -- make
+
+  faketree creates a child cgroup named faketree-<pid> with the limits,
+  and removes it once the command terminates. If faketree is the only
+  process in its cgroup, it moves itself in a faketree-<pid>-supervisor
+  child, so controllers can be enabled.
+
+  --seccomp=default denies system calls that allow to tamper with the
+  sandbox, or are not expected in builds and tests, like mount, ptrace,
+  bpf, reboot, or clone creating namespaces, returning EPERM. clone3
+  fails with ENOSYS, so callers fall back to clone. --seccomp=/path/to/profile.json
+  applies a custom profile instead, in the format:
+
+     {"default": "allow", "rules": [
+        {"syscalls": ["ptrace", "bpf"], "action": "errno", "errno": 1},
+        {"syscalls": ["reboot"], "action": "kill"},
+        {"syscalls": ["clone"], "action": "errno",
+         "args": [{"index": 0, "op": "any_set", "value": 268435456}]}]}
+
+  Valid actions are allow, errno, kill, and log. Arguments can be matched
+  with the eq, ne, and any_set ops. Only a limited set of
+  system calls can be used in rules, an invalid profile shows the list.
+
+Spec files:
+
+  Instead of flags, a sandbox can be described in a yaml or json file,
+  loaded with --spec. Flags supplied on the command line override the
+  values in the spec, a command after -- replaces the one in the spec.
+
+  For example:
+
+     version: 1
+     mounts:
+       - {source: /opt/data/build-0014, target: /opt/build}
+       - {target: /tmp/scratch, options: "type=tmpfs"}
+     overlays:
+       - {lower: [/opt/toolchain], target: /opt/toolchain}
+     tmpfs:
+       - {target: /tmp, size: 1g}
+     hostname: builder
+     env: {LANG: C}
+     workdir: /opt/build
+     wait_timeout: 30s
+     timeout: 1h
+     net: loopback
+     seccomp: default
+     command: [make, install]
+
+  Other keys are uid, gid, root, wait, propagate, wait_term, memory,
+  cpus, and pids, with the same meaning as the corresponding flags. The
+  same spec can be run from go with the faketree/exec library.
+
 Signals handling:
 
   When --signals=false, faketree does nothing for signal handling:
@@ -906,7 +1204,7 @@ func exit(err error) {
 	}
 
 	if errors.Is(err, pflag.ErrHelp) {
-		fmt.Fprintf(os.Stderr, kHelpScreen)
+		fmt.Fprint(os.Stderr, kHelpScreen)
 		os.Exit(kDefaultExit)
 	}
 
@@ -967,24 +1265,27 @@ func enterPrivileges(flags *Flags, left []string) {
 		},
 	}
 
-	RunAndWait(flags.Wait, flags.Propagate, flags.TermOnWait, flags.Timeout, cmd, -1)
+	exit(RunAndWait(flags.Wait, flags.Propagate, flags.TermOnWait, flags.Timeout, 0, cmd, -1))
 }
 
 // RunAndWait runs the specified command and waits for it.
 //
-// RunAndWait never returns, as it invokes exit() at the end.
+// Returns the error of the command, suitable to be passed to exit().
 //
 // It impelemnts the wait and propagate flag, configures the kill policy based
 // on the tow flag (term on wait) as well as waiting for the entire set of
 // children, or just one.
-func RunAndWait(wait, propagate, tow bool, timeout time.Duration, cmd *exec.Cmd, pid int) {
+//
+// If deadline is not 0, the command is killed with SIGKILL if still running
+// after deadline, and ExitStatus(ExitTimeout) returned.
+func RunAndWait(wait, propagate, tow bool, timeout, deadline time.Duration, cmd *exec.Cmd, pid int) error {
 	// Avoid race condition by setting signal handlers before any chance of SIGCHLD.
 	var c chan os.Signal
 	if propagate {
 		c = ReceiveSignals()
 	}
 	if err := cmd.Start(); err != nil {
-		exit(err)
+		return err
 	}
 	if propagate {
 		if pid == 0 {
@@ -993,14 +1294,27 @@ func RunAndWait(wait, propagate, tow bool, timeout time.Duration, cmd *exec.Cmd,
 		go PropagateSignals(c, pid)
 	}
 
+	var expired atomic.Bool
+	if deadline != 0 {
+		process := cmd.Process
+		timer := time.AfterFunc(deadline, func() {
+			expired.Store(true)
+			process.Kill()
+		})
+		defer timer.Stop()
+	}
+
 	var err error
 	if wait {
 		err = WaitChildren(timeout, cmd.Process, tow)
 	} else {
 		err = cmd.Wait()
 	}
-
-	exit(err)
+	if expired.Load() {
+		log.Printf("Command killed as still running after %s", deadline)
+		return ExitStatus(ftexec.ExitTimeout)
+	}
+	return err
 }
 
 func main() {
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestDefaultShell(t *testing.T) {
@@ -114,3 +115,39 @@ func TestParseFlags(t *testing.T) {
 	args = fl.Args()
 	assert.Equal(t, []string{"--uid", u.Uid, "--gid", u.Gid, "--faketree", fl.Faketree, "--wait-term=false"}, args)
 }
+
+func TestParseSpec(t *testing.T) {
+	u, err := user.Current()
+	assert.NoError(t, err)
+
+	spec := filepath.Join(t.TempDir(), "spec.yaml")
+	assert.NoError(t, os.WriteFile(spec, []byte(`
+version: 1
+mounts:
+  - {source: /etc/hosts, target: /tmp/hosts}
+hostname: builder
+env: {LANG: C}
+timeout: 10m
+command: [make, test]
+`), 0o644))
+
+	fl := NewFlags()
+	left, err := fl.Parse([]string{"--spec", spec, "--hostname", "override"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make", "test"}, left)
+	assert.Equal(t, 10*time.Minute, fl.CommandTimeout)
+
+	args := fl.Args()
+	assert.Equal(t, []string{"--uid", u.Uid, "--gid", u.Gid, "--hostname", "override", "--faketree", fl.Faketree,
+		"--mount", "/etc/hosts:/tmp/hosts", "--env", "LANG=C"}, args)
+
+	fl = NewFlags()
+	left, err = fl.Parse([]string{"--spec", spec, "--", "ls"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ls"}, left)
+
+	_, err = NewFlags().Parse([]string{"--spec", filepath.Join(t.TempDir(), "missing.yaml")})
+	assert.Error(t, err)
+	_, err = NewFlags().Parse([]string{"--env", "NOVALUE"})
+	assert.Error(t, err)
+}
@@ -179,3 +179,95 @@ $ft --fail --wait-timeout=1s -- bash -c "(sleep 3600) &>/dev/null & exit 12"
 test "$?" == "12" || {
   fail "faketree did not return the status of the main command"
 }
+
+# Overlay on a read only tree: writes are captured in the upper directory,
+# the lower directory is left untouched.
+lower=$(mktemp -d $tmpdir/lower.XXXXXX)
+upper=$tmpdir/upper
+mkdir -p $lower/bin
+echo original > $lower/bin/tool
+echo stale > $lower/stale
+$ft --fail --overlay $lower:/opt/toolchain:upper=$upper --overlay-diff=$tmpdir/diff -- \
+  sh -c "echo patched > /opt/toolchain/bin/tool; echo new > /opt/toolchain/added; rm /opt/toolchain/stale"
+test "$?" == 0 || {
+  fail "unexpected failure with overlay mount"
+}
+grep -q original $lower/bin/tool && test -f $lower/stale || {
+  fail "overlay modified the lower directory"
+}
+grep -q patched $upper/bin/tool || {
+  fail "overlay did not capture writes in $upper"
+}
+test "$(cat $tmpdir/diff)" == "$(printf 'A /opt/toolchain/added\nC /opt/toolchain/bin\nC /opt/toolchain/bin/tool\nD /opt/toolchain/stale')" || {
+  fail "unexpected overlay diff - $(cat $tmpdir/diff)"
+}
+
+# Without upper=, a scratch directory is used, and changes can be exported.
+$ft --fail --overlay $lower:/opt/toolchain --overlay-export=$tmpdir/layer.tar -- \
+  sh -c "echo new > /opt/toolchain/added; rm /opt/toolchain/stale"
+test "$?" == 0 || {
+  fail "unexpected failure with scratch overlay mount"
+}
+test "$(tar -tf $tmpdir/layer.tar | sort | tr '\n' ' ')" == "opt/toolchain/.wh.stale opt/toolchain/added " || {
+  fail "unexpected overlay export - $(tar -tf $tmpdir/layer.tar)"
+}
+
+# Size of tmpfs mounts is limited.
+size=$($ft --fail --tmpfs /tmp/scratch:size=1m -- sh -c "df -k /tmp/scratch | tail -n 1 | awk '{print \$2}'")
+test "$size" == "1024" || {
+  fail "tmpfs size was not applied - $size"
+}
+$ft --fail --tmpfs /tmp/scratch:size=1m -- sh -c "dd if=/dev/zero of=/tmp/scratch/fill bs=1M count=2" &>/dev/null
+test "$?" != 0 || {
+  fail "tmpfs size limit was not enforced"
+}
+
+# With --net=none only a down loopback interface is present, --net=loopback brings it up.
+ifaces=$($ft --fail --net=none -- sh -c "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '")
+test "$ifaces" == "lo" || {
+  fail "unexpected interfaces with --net=none - $ifaces"
+}
+unreachable=$($ft --fail --net=none -- bash -c "exec 3<>/dev/tcp/127.0.0.1/1" 2>&1)
+echo "$unreachable" | grep -q "Network is unreachable" || {
+  fail "loopback should be down with --net=none - $unreachable"
+}
+refused=$($ft --fail --net=loopback -- bash -c "exec 3<>/dev/tcp/127.0.0.1/1" 2>&1)
+echo "$refused" | grep -q "Connection refused" || {
+  fail "loopback was not brought up with --net=loopback - $refused"
+}
+
+# The default seccomp profile denies creating namespaces.
+$ft --fail --seccomp=default -- unshare --user true &>/dev/null
+test "$?" != 0 || {
+  fail "seccomp profile did not deny unshare"
+}
+echo '{"default": "allow", "rules": [{"syscalls": ["socket"], "action": "errno", "errno": 13}]}' > $tmpdir/profile.json
+denied=$($ft --fail --seccomp=$tmpdir/profile.json -- bash -c "exec 3<>/dev/tcp/127.0.0.1/1" 2>&1)
+echo "$denied" | grep -q "Permission denied" || {
+  fail "seccomp profile did not deny socket - $denied"
+}
+
+# A spec can describe the sandbox, flags on the command line override it.
+cat > $tmpdir/spec.yaml <<SPEC
+version: 1
+mounts:
+  - {source: $tmpdir, target: /opt/spec}
+hostname: from-spec
+env: {GREETING: hello}
+workdir: /opt/spec
+command: [sh, -c, 'echo \$GREETING \$(hostname) \$(pwd)']
+SPEC
+out=$($ft --fail --spec $tmpdir/spec.yaml)
+test "$out" == "hello from-spec /opt/spec" || {
+  fail "unexpected output running spec - $out"
+}
+out=$($ft --fail --spec $tmpdir/spec.yaml --hostname from-flags)
+test "$out" == "hello from-flags /opt/spec" || {
+  fail "flags did not override the spec - $out"
+}
+
+# Commands still running after --timeout are killed.
+$ft --fail --timeout=1s -- sleep 3600 &>/dev/null
+test "$?" == 124 || {
+  fail "faketree did not return 124 on timeout"
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ccontavalli/enkit/lib/multierror"
+)
+
+// OverlayFlags describes a copy-on-write overlay mount.
+//
+// The lower directories are presented read only at the target, merged,
+// with all the changes captured in the upper directory.
+type OverlayFlags struct {
+	Lower  []string
+	Target string
+
+	Upper string
+	Work  string
+
+	// Set if Upper and Work were created by faketree, and must be
+	// removed once the command completes. Not propagated via Args().
+	Scratch string
+}
+
+// NewOverlayFlags parses an overlay specification.
+//
+// The format is lower[,lower...]:target[:upper=dir[,work=dir]], where
+// the first lower directory is the top most one.
+func NewOverlayFlags(overlay string) (*OverlayFlags, error) {
+	splits := strings.SplitN(overlay, ":", 3)
+	if len(splits) < 2 || splits[0] == "" || splits[1] == "" {
+		return nil, fmt.Errorf("invalid overlay: %s - format is '/lower/path[,/lower/path...]:/dest/path[:upper=/path[,work=/path]]'", overlay)
+	}
+
+	of := &OverlayFlags{Target: splits[1]}
+	for _, lower := range strings.Split(splits[0], ",") {
+		lower = strings.TrimSpace(lower)
+		if lower == "" {
+			return nil, fmt.Errorf("invalid overlay: %s - empty lower directory", overlay)
+		}
+		of.Lower = append(of.Lower, lower)
+	}
+
+	if len(splits) < 3 {
+		return of, nil
+	}
+	var errs []error
+	for ix, field := range strings.Split(splits[2], ",") {
+		field = strings.TrimSpace(field)
+		if u := strings.TrimPrefix(field, "upper="); len(u) < len(field) {
+			of.Upper = u
+			continue
+		}
+		if w := strings.TrimPrefix(field, "work="); len(w) < len(field) {
+			of.Work = w
+			continue
+		}
+		errs = append(errs, fmt.Errorf("overlay option #%d is unknown: %s - only upper= and work= are supported", ix, field))
+	}
+	if of.Work != "" && of.Upper == "" {
+		errs = append(errs, fmt.Errorf("overlay %s - work= requires upper= to be specified", overlay))
+	}
+	return of, multierror.New(errs)
+}
+
+func (of OverlayFlags) String() string {
+	options := []string{}
+	if of.Upper != "" {
+		options = append(options, "upper="+of.Upper)
+	}
+	if of.Work != "" {
+		options = append(options, "work="+of.Work)
+	}
+
+	result := strings.Join(of.Lower, ",") + ":" + of.Target
+	if len(options) > 0 {
+		result += ":" + strings.Join(options, ",")
+	}
+	return result
+}
+
+// Prepare creates the upper and work directories, if necessary.
+//
+// When no upper directory was specified, a scratch directory is created, to be
+// deleted with Cleanup(). Must be invoked before entering the namespaces, so
+// the upper layer is accessible once the command terminates.
+func (of *OverlayFlags) Prepare(perms os.FileMode) error {
+	if of.Upper == "" {
+		scratch, err := os.MkdirTemp("", "faketree-overlay-")
+		if err != nil {
+			return fmt.Errorf("could not create scratch directory for overlay on %s: %w", of.Target, err)
+		}
+		of.Scratch = scratch
+		of.Upper = filepath.Join(scratch, "upper")
+		of.Work = filepath.Join(scratch, "work")
+	}
+	if of.Work == "" {
+		// The work directory must be on the same file system as the upper directory.
+		of.Work = strings.TrimSuffix(of.Upper, "/") + ".work"
+	}
+
+	var errs []error
+	for _, dir := range []string{of.Upper, of.Work} {
+		if err := os.MkdirAll(dir, perms); err != nil {
+			errs = append(errs, fmt.Errorf("could not create overlay directory %s: %w", dir, err))
+		}
+	}
+	return multierror.New(errs)
+}
+
+// MountFlags returns the MountFlags to mount the overlay.
+//
+// userxattr is required to mount overlays from within a user namespace,
+// supported since linux 5.11.
+func (of *OverlayFlags) MountFlags() (*MountFlags, error) {
+	var lowers []string
+	for _, lower := range of.Lower {
+		real, err := RealPath(lower)
+		if err != nil {
+			return nil, fmt.Errorf("could not compute realpath of lower directory %s: %w", lower, err)
+		}
+		lowers = append(lowers, real)
+	}
+	upper, err := filepath.Abs(of.Upper)
+	if err != nil {
+		return nil, err
+	}
+	work, err := filepath.Abs(of.Work)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MountFlags{
+		Target: of.Target,
+		Fstype: "overlay",
+		Data:   fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", strings.Join(lowers, ":"), upper, work),
+	}, nil
+}
+
+// Cleanup removes the scratch directories created by Prepare, if any.
+func (of *OverlayFlags) Cleanup() error {
+	if of.Scratch == "" {
+		return nil
+	}
+	return RemoveAll(of.Scratch)
+}
+
+// RemoveAll is like os.RemoveAll, but removes directories that are not readable or writable.
+//
+// The kernel creates the overlay work directories with mode 000.
+func RemoveAll(path string) error {
+	filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if d != nil && d.IsDir() {
+			os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// TmpfsFlags describes an ephemeral, memory backed, tmpfs mount.
+type TmpfsFlags struct {
+	Target string
+	// Options passed to tmpfs, like size=64m or mode=1777.
+	Options []string
+}
+
+var kTmpfsOptions = []string{"size", "nr_blocks", "nr_inodes", "mode", "uid", "gid", "huge"}
+
+// NewTmpfsFlags parses a tmpfs specification, in the format target[:size=...[,mode=...]].
+func NewTmpfsFlags(tmpfs string) (*TmpfsFlags, error) {
+	splits := strings.SplitN(tmpfs, ":", 2)
+	if splits[0] == "" {
+		return nil, fmt.Errorf("invalid tmpfs: %s - format is '/dest/path[:size=64m[,mode=1777]]'", tmpfs)
+	}
+
+	tf := &TmpfsFlags{Target: splits[0]}
+	if len(splits) < 2 {
+		return tf, nil
+	}
+
+	var errs []error
+	for ix, field := range strings.Split(splits[1], ",") {
+		field = strings.TrimSpace(field)
+		name, value, _ := strings.Cut(field, "=")
+		known := false
+		for _, option := range kTmpfsOptions {
+			if name == option {
+				known = true
+				break
+			}
+		}
+		if !known || value == "" {
+			errs = append(errs, fmt.Errorf("tmpfs option #%d is invalid: %s - supported: %s, as in size=64m", ix, field, strings.Join(kTmpfsOptions, ",")))
+			continue
+		}
+		tf.Options = append(tf.Options, field)
+	}
+	return tf, multierror.New(errs)
+}
+
+func (tf TmpfsFlags) String() string {
+	if len(tf.Options) == 0 {
+		return tf.Target
+	}
+	return tf.Target + ":" + strings.Join(tf.Options, ",")
+}
+
+func (tf *TmpfsFlags) MountFlags() *MountFlags {
+	return &MountFlags{
+		Target: tf.Target,
+		Fstype: "tmpfs",
+		Flags:  syscall.MS_NOSUID | syscall.MS_NODEV,
+		Data:   strings.Join(tf.Options, ","),
+	}
+}
+
+// ChangeKind describes how a path was changed in an overlay, same letters as 'docker diff'.
+type ChangeKind byte
+
+const (
+	ChangeAdded    ChangeKind = 'A'
+	ChangeModified ChangeKind = 'C'
+	ChangeDeleted  ChangeKind = 'D'
+)
+
+// Change is a path added, modified or deleted in an overlay.
+type Change struct {
+	Kind ChangeKind
+	// Absolute path, as seen from within faketree.
+	Path string
+
+	// Path of the file in the upper directory, empty for deletions.
+	upper string
+	// Set for directories whose lower content was hidden.
+	opaque bool
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%c %s", c.Kind, c.Path)
+}
+
+// isWhiteout returns true if the file marks a deletion in an overlay upper layer.
+func isWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// isOpaque returns true if the directory hides the content of the lower layers.
+func isOpaque(path string) bool {
+	buffer := make([]byte, 1)
+	for _, attr := range []string{"user.overlay.opaque", "trusted.overlay.opaque"} {
+		size, err := syscall.Getxattr(path, attr, buffer)
+		if err == nil && size == 1 && buffer[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes returns the list of changes captured in the upper directory, sorted by path.
+func (of *OverlayFlags) Changes() ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(of.Upper, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(of.Upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		change := Change{Path: filepath.Join(of.Target, rel), upper: path}
+		if isWhiteout(info) {
+			change.Kind = ChangeDeleted
+			change.upper = ""
+			changes = append(changes, change)
+			return nil
+		}
+
+		change.Kind = ChangeAdded
+		for _, lower := range of.Lower {
+			if _, err := os.Lstat(filepath.Join(lower, rel)); err == nil {
+				change.Kind = ChangeModified
+				break
+			}
+		}
+		if info.IsDir() && isOpaque(path) {
+			change.opaque = true
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read the upper layer of the overlay on %s: %w", of.Target, err)
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// WriteChanges writes the list of changes in human readable form.
+func WriteChanges(w io.Writer, changes []Change) error {
+	for _, change := range changes {
+		if _, err := fmt.Fprintln(w, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportChanges writes the changes as a tar archive, in the format of an OCI image layer.
+//
+// Deleted files are represented by .wh.<name> whiteout files, directories replacing
+// the lower content by a .wh..wh..opq file, so the archive can be applied on top of
+// the lower directories with any tool supporting OCI layers.
+func ExportChanges(w io.Writer, changes []Change) error {
+	tw := tar.NewWriter(w)
+	for _, change := range changes {
+		name := strings.TrimPrefix(change.Path, "/")
+		if change.Kind == ChangeDeleted {
+			whiteout := filepath.Join(filepath.Dir(name), ".wh."+filepath.Base(name))
+			if err := tw.WriteHeader(&tar.Header{Name: whiteout, Typeflag: tar.TypeReg, Mode: 0o600}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := os.Lstat(change.upper)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(change.upper); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("could not export %s: %w", change.Path, err)
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Uname, header.Gname = "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if change.opaque {
+			if err := tw.WriteHeader(&tar.Header{Name: filepath.Join(name, ".wh..wh..opq"), Typeflag: tar.TypeReg, Mode: 0o600}); err != nil {
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(tw, change.upper); err != nil {
+			return fmt.Errorf("could not export %s: %w", change.Path, err)
+		}
+	}
+	return tw.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ReportOverlays writes the diff and export of the overlays, as requested via flags,
+// and removes the scratch directories.
+func (opts *Flags) ReportOverlays() error {
+	var changes []Change
+	var errs []error
+	if opts.OverlayDiff != "" || opts.OverlayExport != "" {
+		for _, overlay := range opts.Overlay {
+			c, err := overlay.Changes()
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			changes = append(changes, c...)
+		}
+	}
+
+	if opts.OverlayDiff != "" {
+		if err := writeTo(opts.OverlayDiff, func(w io.Writer) error { return WriteChanges(w, changes) }); err != nil {
+			errs = append(errs, fmt.Errorf("could not write overlay diff: %w", err))
+		}
+	}
+	if opts.OverlayExport != "" {
+		if err := writeTo(opts.OverlayExport, func(w io.Writer) error { return ExportChanges(w, changes) }); err != nil {
+			errs = append(errs, fmt.Errorf("could not export overlay changes: %w", err))
+		}
+	}
+
+	for _, overlay := range opts.Overlay {
+		if err := overlay.Cleanup(); err != nil {
+			errs = append(errs, fmt.Errorf("could not remove scratch directory %s: %w", overlay.Scratch, err))
+		}
+	}
+	return multierror.New(errs)
+}
+
+// writeTo invokes the writer on the file at path, or stderr if path is "-".
+func writeTo(path string, writer func(io.Writer) error) error {
+	if path == "-" {
+		return writer(os.Stderr)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writer(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// errNoOverlays is returned when reporting on overlays is requested, but no overlay is configured.
+var errNoOverlays = errors.New("--overlay-diff and --overlay-export require at least one --overlay")
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayFlags(t *testing.T) {
+	of, err := NewOverlayFlags("/opt/toolchain,/opt/base:/toolchain")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/opt/toolchain", "/opt/base"}, of.Lower)
+	assert.Equal(t, "/toolchain", of.Target)
+	assert.Equal(t, "/opt/toolchain,/opt/base:/toolchain", of.String())
+
+	of, err = NewOverlayFlags("/opt/toolchain:/toolchain:upper=/tmp/up, work=/tmp/work")
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/up", of.Upper)
+	assert.Equal(t, "/tmp/work", of.Work)
+	assert.Equal(t, "/opt/toolchain:/toolchain:upper=/tmp/up,work=/tmp/work", of.String())
+
+	for _, invalid := range []string{"", "/opt", ":/toolchain", "/opt:", "/opt,,/base:/toolchain", "/opt:/toolchain:ro", "/opt:/toolchain:work=/tmp/work"} {
+		_, err := NewOverlayFlags(invalid)
+		assert.Error(t, err, "%s", invalid)
+	}
+
+	tf, err := NewTmpfsFlags("/tmp")
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp", tf.String())
+	assert.Equal(t, "", tf.MountFlags().Data)
+
+	tf, err = NewTmpfsFlags("/tmp:size=64m, mode=1777")
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp:size=64m,mode=1777", tf.String())
+	assert.Equal(t, "size=64m,mode=1777", tf.MountFlags().Data)
+	assert.Equal(t, "tmpfs", tf.MountFlags().Fstype)
+
+	for _, invalid := range []string{"", ":size=1m", "/tmp:size", "/tmp:ro"} {
+		_, err := NewTmpfsFlags(invalid)
+		assert.Error(t, err, "%s", invalid)
+	}
+}
+
+func TestOverlayPrepare(t *testing.T) {
+	lower := t.TempDir()
+	of := &OverlayFlags{Lower: []string{lower}, Target: "/toolchain"}
+	assert.NoError(t, of.Prepare(0o755))
+	assert.NotEmpty(t, of.Scratch)
+	assert.DirExists(t, of.Upper)
+	assert.DirExists(t, of.Work)
+
+	// The kernel creates directories with no permissions in the work directory.
+	assert.NoError(t, os.Mkdir(filepath.Join(of.Work, "work"), 0))
+	mf, err := of.MountFlags()
+	assert.NoError(t, err)
+	assert.Equal(t, "overlay", mf.Fstype)
+	assert.Contains(t, mf.Data, "lowerdir="+lower+",upperdir="+of.Upper+",workdir="+of.Work+",userxattr")
+
+	assert.NoError(t, of.Cleanup())
+	assert.NoDirExists(t, of.Scratch)
+
+	upper := filepath.Join(t.TempDir(), "upper")
+	of = &OverlayFlags{Lower: []string{lower}, Target: "/toolchain", Upper: upper}
+	assert.NoError(t, of.Prepare(0o755))
+	assert.Empty(t, of.Scratch)
+	assert.Equal(t, upper+".work", of.Work)
+	assert.NoError(t, of.Cleanup())
+	assert.DirExists(t, upper)
+}
+
+func TestOverlayChanges(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	for _, dir := range []string{"bin", "lib/old"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(lower, dir), 0o755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(lower, "bin", "tool"), []byte("original"), 0o755))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(upper, "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(upper, "bin", "tool"), []byte("patched"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(upper, "added"), []byte("new"), 0o644))
+	require.NoError(t, os.Symlink("bin/tool", filepath.Join(upper, "link")))
+
+	// Whiteouts are character devices 0/0, creating one may not be allowed.
+	whiteout := true
+	if err := syscall.Mknod(filepath.Join(upper, "lib"), syscall.S_IFCHR, 0); err != nil {
+		t.Logf("cannot create whiteout, skipping deletion checks - %v", err)
+		whiteout = false
+	}
+
+	of := &OverlayFlags{Lower: []string{lower}, Target: "/toolchain", Upper: upper}
+	changes, err := of.Changes()
+	require.NoError(t, err)
+
+	var listed bytes.Buffer
+	assert.NoError(t, WriteChanges(&listed, changes))
+	expected := "A /toolchain/added\nC /toolchain/bin\nC /toolchain/bin/tool\n"
+	if whiteout {
+		expected += "D /toolchain/lib\n"
+	}
+	expected += "A /toolchain/link\n"
+	assert.Equal(t, expected, listed.String())
+
+	var exported bytes.Buffer
+	require.NoError(t, ExportChanges(&exported, changes))
+	files := map[string]string{}
+	tr := tar.NewReader(&exported)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(data) + header.Linkname
+	}
+
+	expectedFiles := map[string]string{
+		"toolchain/added":    "new",
+		"toolchain/bin/":     "",
+		"toolchain/bin/tool": "patched",
+		"toolchain/link":     "bin/tool",
+	}
+	if whiteout {
+		expectedFiles["toolchain/.wh.lib"] = ""
+	}
+	assert.Equal(t, expectedFiles, files)
+}
+
+func TestParseOverlayFlags(t *testing.T) {
+	fl := NewFlags()
+	left, err := fl.Parse([]string{"--overlay", "/opt/toolchain:/toolchain:upper=/tmp/up", "--tmpfs", "/tmp:size=1g", "--overlay-diff", "--", "make"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make"}, left)
+	assert.Equal(t, "-", fl.OverlayDiff)
+
+	args := fl.Args()
+	assert.Equal(t, []string{"--overlay", "/opt/toolchain:/toolchain:upper=/tmp/up", "--tmpfs", "/tmp:size=1g"}, args[len(args)-4:])
+
+	_, err = NewFlags().Parse([]string{"--overlay-export", "/tmp/layer.tar"})
+	assert.ErrorIs(t, err, errNoOverlays)
+	_, err = NewFlags().Parse([]string{"--tmpfs", "/tmp:ro"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Use the network of the host, the default.
+	NetHost = "host"
+	// Create a new network namespace, with no interface up.
+	NetNone = "none"
+	// Create a new network namespace, with only the loopback interface up.
+	NetLoopback = "loopback"
+)
+
+var kNetModes = []string{NetHost, NetNone, NetLoopback}
+
+// ValidNet returns an error if the network mode is unknown.
+func ValidNet(net string) error {
+	for _, mode := range kNetModes {
+		if net == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid --net %q - valid modes are: %s", net, strings.Join(kNetModes, ", "))
+}
+
+// NetCloneflags returns the clone flags necessary to configure the network.
+func NetCloneflags(net string) uintptr {
+	if net == NetHost || net == "" {
+		return 0
+	}
+	return syscall.CLONE_NEWNET
+}
+
+// LoopbackUp brings up the loopback interface of the current network namespace.
+func LoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("could not open socket to configure loopback - %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("could not retrieve flags of loopback - %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("could not bring loopback up - %w", err)
+	}
+	return nil
+}
+
+// Limits are resource limits, enforced via cgroup v2.
+type Limits struct {
+	// Maximum memory, as in 512M or 2GiB.
+	Memory string
+	// Maximum CPU time, in number of CPUs. 1.5 means one and a half CPUs.
+	CPUs float64
+	// Maximum number of processes or threads.
+	Pids int
+}
+
+// Empty returns true if no limit was configured.
+func (l *Limits) Empty() bool {
+	return l.Memory == "" && l.CPUs == 0 && l.Pids == 0
+}
+
+// kCpuPeriod is the period used for cpu.max, in microseconds. Same as the kernel default.
+const kCpuPeriod = 100000
+
+// Files returns the name and content of the cgroup files necessary to enforce the limits.
+func (l *Limits) Files() (map[string]string, error) {
+	files := map[string]string{}
+	if l.Memory != "" {
+		bytes, err := humanize.ParseBytes(l.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --memory %q - %w", l.Memory, err)
+		}
+		files["memory.max"] = strconv.FormatUint(bytes, 10)
+	}
+	if l.CPUs < 0 {
+		return nil, fmt.Errorf("invalid --cpus %v - must be positive", l.CPUs)
+	}
+	if l.CPUs > 0 {
+		quota := int64(l.CPUs * kCpuPeriod)
+		if quota < 1000 {
+			return nil, fmt.Errorf("invalid --cpus %v - must be at least 0.01", l.CPUs)
+		}
+		files["cpu.max"] = fmt.Sprintf("%d %d", quota, kCpuPeriod)
+	}
+	if l.Pids < 0 {
+		return nil, fmt.Errorf("invalid --pids %d - must be positive", l.Pids)
+	}
+	if l.Pids > 0 {
+		files["pids.max"] = strconv.Itoa(l.Pids)
+	}
+	return files, nil
+}
+
+// Controllers returns the cgroup controllers required to enforce the files.
+func Controllers(files map[string]string) []string {
+	var controllers []string
+	for _, controller := range []string{"cpu", "memory", "pids"} {
+		if _, found := files[controller+".max"]; found {
+			controllers = append(controllers, controller)
+		}
+	}
+	return controllers
+}
+
+// kCgroupRoot is where the cgroup v2 hierarchy is expected to be mounted.
+const kCgroupRoot = "/sys/fs/cgroup"
+
+// CurrentCgroup returns the path of the cgroup v2 of the current process.
+func CurrentCgroup() (string, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(kCgroupRoot, &fs); err != nil || fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return "", fmt.Errorf("%s is not a cgroup v2 file system - resource limits require cgroup v2", kCgroupRoot)
+	}
+
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, found := strings.CutPrefix(scanner.Text(), "0::"); found {
+			return filepath.Join(kCgroupRoot, path), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("could not find the cgroup v2 of the process in /proc/self/cgroup")
+}
+
+// Cgroup is a cgroup created to enforce resource limits.
+type Cgroup struct {
+	Path string
+	dir  *os.File
+
+	// Set if NewCgroup had to move the current process in a supervisor leaf,
+	// to enable the controllers in its parent.
+	supervisor *Supervisor
+}
+
+// FD returns the file descriptor to pass to clone3() to start a process in the cgroup.
+func (cg *Cgroup) FD() int {
+	return int(cg.dir.Fd())
+}
+
+// Close removes the cgroup, and the supervisor leaf if one was created.
+//
+// Must be invoked after all the processes in the cgroup terminated. Given that the
+// kernel removes processes from the cgroup asynchronously, retries for a few seconds.
+func (cg *Cgroup) Close() error {
+	cg.dir.Close()
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(cg.Path); err == nil || !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || cg.supervisor == nil {
+		return err
+	}
+	return cg.supervisor.Close()
+}
+
+// Supervisor is the leaf the current process was moved into to enable controllers
+// in its cgroup, as the kernel does not allow processes in cgroups with controllers.
+type Supervisor struct {
+	Path string
+	// Controllers enabled in the parent of the leaf.
+	Controllers []string
+}
+
+// Close moves the current process back into the parent cgroup and removes the leaf.
+//
+// The controllers enabled are disabled first, as the process could not be moved back otherwise.
+func (s *Supervisor) Close() error {
+	parent := filepath.Dir(s.Path)
+	disable := []string{}
+	for _, controller := range s.Controllers {
+		disable = append(disable, "-"+controller)
+	}
+	if len(disable) > 0 {
+		if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(disable, " ")), 0o644); err != nil {
+			return fmt.Errorf("could not disable controllers in %s - %w", parent, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		return fmt.Errorf("could not move faketree back into cgroup %s - %w", parent, err)
+	}
+	return os.Remove(s.Path)
+}
+
+// NewCgroup creates a child of the cgroup of the current process enforcing the limits.
+//
+// The cgroup of the current process must have been delegated to the user, for example
+// by running faketree with 'systemd-run --user --scope -p Delegate=yes'.
+//
+// Controllers can only be enabled in a cgroup with no processes. If the current process
+// is the only one in its cgroup, it is moved into a 'faketree-<pid>-supervisor' leaf.
+func NewCgroup(limits *Limits) (*Cgroup, error) {
+	files, err := limits.Files()
+	if err != nil {
+		return nil, err
+	}
+	parent, err := CurrentCgroup()
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Access(filepath.Join(parent, "cgroup.subtree_control"), unix.W_OK); err != nil {
+		return nil, fmt.Errorf("cgroup %s has not been delegated to the user - try running faketree with "+
+			"'systemd-run --user --scope -p Delegate=yes faketree ...' - %w", parent, err)
+	}
+	supervisor, err := EnableControllers(parent, Controllers(files))
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func(path string) {
+		os.Remove(path)
+		if supervisor != nil {
+			supervisor.Close()
+		}
+	}
+
+	path := filepath.Join(parent, fmt.Sprintf("faketree-%d", os.Getpid()))
+	if err := os.Mkdir(path, 0o755); err != nil {
+		cleanup(path)
+		return nil, fmt.Errorf("could not create cgroup - %w", err)
+	}
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(value), 0o644); err != nil {
+			cleanup(path)
+			return nil, fmt.Errorf("could not set %s to %s in cgroup %s - %w", name, value, path, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		cleanup(path)
+		return nil, err
+	}
+	return &Cgroup{Path: path, dir: dir, supervisor: supervisor}, nil
+}
+
+// EnableControllers enables the controllers for the children of the cgroup at path.
+//
+// Returns the supervisor leaf the current process was moved into, if any, which must
+// be closed once the children of the cgroup are removed.
+func EnableControllers(path string, controllers []string) (*Supervisor, error) {
+	available, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := os.ReadFile(filepath.Join(path, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, err
+	}
+
+	var missing, enable, errs []string
+	for _, controller := range controllers {
+		if !hasWord(string(available), controller) {
+			errs = append(errs, controller)
+		}
+		if !hasWord(string(enabled), controller) {
+			missing = append(missing, controller)
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("cgroup controllers %s are not available in %s - they must be delegated to the user", strings.Join(errs, ", "), path)
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	control := filepath.Join(path, "cgroup.subtree_control")
+	err = os.WriteFile(control, []byte(strings.Join(enable, " ")), 0o644)
+	if err == nil || !errors.Is(err, syscall.EBUSY) {
+		return nil, err
+	}
+
+	// EBUSY: the cgroup has processes. Move the current process out of the way, and retry.
+	leaf := filepath.Join(path, fmt.Sprintf("faketree-%d-supervisor", os.Getpid()))
+	if err := os.Mkdir(leaf, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		os.Remove(leaf)
+		return nil, fmt.Errorf("could not move faketree into cgroup %s - %w", leaf, err)
+	}
+	supervisor := &Supervisor{Path: leaf, Controllers: missing}
+	if err := os.WriteFile(control, []byte(strings.Join(enable, " ")), 0o644); err != nil {
+		supervisor.Controllers = nil
+		supervisor.Close()
+		return nil, fmt.Errorf("could not enable controllers in %s, are other processes running in this cgroup? "+
+			"try running faketree with 'systemd-run --user --scope -p Delegate=yes faketree ...' - %w", path, err)
+	}
+	return supervisor, nil
+}
+
+func hasWord(list, word string) bool {
+	for _, field := range strings.Fields(list) {
+		if field == word {
+			return true
+		}
+	}
+	return false
+}
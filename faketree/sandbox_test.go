@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestNet(t *testing.T) {
+	for _, mode := range []string{NetHost, NetNone, NetLoopback} {
+		assert.NoError(t, ValidNet(mode))
+	}
+	assert.Error(t, ValidNet("bridge"))
+	assert.Equal(t, uintptr(0), NetCloneflags(NetHost))
+	assert.Equal(t, uintptr(syscall.CLONE_NEWNET), NetCloneflags(NetLoopback))
+
+	fl := NewFlags()
+	_, err := fl.Parse([]string{"--net=loopback", "--seccomp=default", "--memory=1G"})
+	assert.NoError(t, err)
+	args := fl.Args()
+	assert.Equal(t, []string{"--net", "loopback", "--seccomp", "default"}, args[len(args)-4:])
+
+	_, err = NewFlags().Parse([]string{"--net=bridge"})
+	assert.Error(t, err)
+	_, err = NewFlags().Parse([]string{"--memory=lots"})
+	assert.Error(t, err)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{}
+	assert.True(t, limits.Empty())
+	files, err := limits.Files()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	limits = Limits{Memory: "512MiB", CPUs: 1.5, Pids: 100}
+	assert.False(t, limits.Empty())
+	files, err = limits.Files()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"memory.max": "536870912",
+		"cpu.max":    "150000 100000",
+		"pids.max":   "100",
+	}, files)
+	assert.Equal(t, []string{"cpu", "memory", "pids"}, Controllers(files))
+
+	for _, invalid := range []Limits{{Memory: "lots"}, {CPUs: -1}, {CPUs: 0.001}, {Pids: -3}} {
+		_, err := invalid.Files()
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestEnableControllers(t *testing.T) {
+	cgroup := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(cgroup, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(cgroup, "cgroup.subtree_control"), []byte("memory\n"), 0o644))
+
+	supervisor, err := EnableControllers(cgroup, []string{"memory", "pids"})
+	assert.NoError(t, err)
+	assert.Nil(t, supervisor)
+	control, err := os.ReadFile(filepath.Join(cgroup, "cgroup.subtree_control"))
+	assert.NoError(t, err)
+	assert.Equal(t, "+pids", string(control))
+
+	_, err = EnableControllers(cgroup, []string{"hugetlb"})
+	assert.ErrorContains(t, err, "hugetlb are not available")
+}
+
+func TestSupervisorClose(t *testing.T) {
+	cgroup := t.TempDir()
+	leaf := filepath.Join(cgroup, "faketree-1-supervisor")
+	require.NoError(t, os.Mkdir(leaf, 0o755))
+
+	supervisor := &Supervisor{Path: leaf, Controllers: []string{"memory", "pids"}}
+	assert.NoError(t, supervisor.Close())
+	assert.NoDirExists(t, leaf)
+
+	control, err := os.ReadFile(filepath.Join(cgroup, "cgroup.subtree_control"))
+	assert.NoError(t, err)
+	assert.Equal(t, "-memory -pids", string(control))
+	procs, err := os.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), string(procs))
+}
+
+func TestSeccompCompile(t *testing.T) {
+	program, err := kSeccompDefaultProfile.Compile()
+	require.NoError(t, err)
+
+	// Check the architecture, load the syscall number, 2 instructions per syscall, default action.
+	// clone needs 7 instructions: compare nr, check the low and high word of flags, return, reload nr.
+	header := 4
+	if kSeccompSyscallBit != 0 {
+		header += 2
+	}
+	assert.Equal(t, header+2*len(kSeccompDefaultProfile.Rules[0].Syscalls)+7+2+1, len(program))
+	assert.Equal(t, uint32(unix.SECCOMP_RET_ALLOW), program[len(program)-1].K)
+	assert.Equal(t, uint32(unix.SYS_PTRACE), program[header+2*indexOf(kSeccompDefaultProfile.Rules[0].Syscalls, "ptrace")].K)
+	assert.Equal(t, uint32(unix.SECCOMP_RET_ERRNO|uint32(syscall.EPERM)), program[header+1].K)
+
+	profile := SeccompProfile{Default: "errno", Rules: []SeccompRule{{Syscalls: []string{"socket"}, Action: "allow"}, {Syscalls: []string{"reboot"}, Action: "errno", Errno: 13}}}
+	program, err = profile.Compile()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(unix.SECCOMP_RET_ERRNO|uint32(syscall.EPERM)), program[len(program)-1].K)
+	assert.Equal(t, uint32(unix.SECCOMP_RET_ERRNO|13), program[len(program)-2].K)
+
+	_, err = (&SeccompProfile{Default: "allow", Rules: []SeccompRule{{Syscalls: []string{"clone"}, Action: "kill", Args: []SeccompArg{{Index: 6, Op: "eq"}}}}}).Compile()
+	assert.ErrorContains(t, err, "invalid argument index 6")
+	_, err = (&SeccompProfile{Default: "allow", Rules: []SeccompRule{{Syscalls: []string{"clone"}, Action: "kill", Args: []SeccompArg{{Op: "gt"}}}}}).Compile()
+	assert.ErrorContains(t, err, "invalid argument op")
+	_, err = (&SeccompProfile{Default: "maybe"}).Compile()
+	assert.ErrorContains(t, err, "invalid action")
+	_, err = (&SeccompProfile{Default: "allow", Rules: []SeccompRule{{Syscalls: []string{"fork"}, Action: "kill"}}}).Compile()
+	assert.ErrorContains(t, err, "unsupported system calls fork")
+
+	path := filepath.Join(t.TempDir(), "profile.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"default": "allow", "rules": [{"syscalls": ["ptrace"], "action": "kill"}]}`), 0o644))
+	loaded, err := LoadSeccompProfile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "kill", loaded.Rules[0].Action)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"default": "allow", "rules": [{"syscalls": ["ptrace"], "action": "maim"}]}`), 0o644))
+	_, err = LoadSeccompProfile(path)
+	assert.True(t, strings.Contains(err.Error(), "rule #0"), "%v", err)
+}
+
+// runSeccomp interprets the subset of BPF used by Compile on a struct seccomp_data.
+func runSeccomp(t *testing.T, program []unix.SockFilter, nr uint32, args ...uint64) uint32 {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data[0:], nr)
+	binary.LittleEndian.PutUint32(data[4:], kSeccompArch)
+	for ix, arg := range args {
+		binary.LittleEndian.PutUint64(data[16+8*ix:], arg)
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(program); pc++ {
+		ins := program[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = binary.LittleEndian.Uint32(data[ins.K:])
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K:
+			taken := (ins.Code&0xf0 == unix.BPF_JEQ && acc == ins.K) ||
+				(ins.Code&0xf0 == unix.BPF_JGE && acc >= ins.K) ||
+				(ins.Code&0xf0 == unix.BPF_JSET && acc&ins.K != 0)
+			if taken {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		default:
+			t.Fatalf("unexpected instruction %#v at %d", ins, pc)
+		}
+	}
+	t.Fatalf("program terminated without returning")
+	return 0
+}
+
+func TestSeccompArgs(t *testing.T) {
+	if kSeccompArch == 0 {
+		t.Skip("seccomp not supported on this architecture")
+	}
+	program, err := kSeccompDefaultProfile.Compile()
+	require.NoError(t, err)
+
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(syscall.EPERM))
+	allow := uint32(unix.SECCOMP_RET_ALLOW)
+	assert.Equal(t, allow, runSeccomp(t, program, unix.SYS_CLONE, unix.CLONE_VM|unix.CLONE_THREAD|unix.CLONE_SIGHAND))
+	assert.Equal(t, eperm, runSeccomp(t, program, unix.SYS_CLONE, unix.CLONE_NEWUSER))
+	assert.Equal(t, eperm, runSeccomp(t, program, unix.SYS_CLONE, unix.CLONE_NEWNS|uint64(syscall.SIGCHLD)))
+	assert.Equal(t, uint32(unix.SECCOMP_RET_ERRNO|uint32(syscall.ENOSYS)), runSeccomp(t, program, unix.SYS_CLONE3))
+	assert.Equal(t, eperm, runSeccomp(t, program, unix.SYS_PTRACE))
+	// After a clone not matching the flags, the number is reloaded for the following rules.
+	assert.Equal(t, allow, runSeccomp(t, program, unix.SYS_GETPID))
+
+	profile := SeccompProfile{Default: "allow", Rules: []SeccompRule{
+		{Syscalls: []string{"socket"}, Action: "kill", Args: []SeccompArg{{Index: 0, Op: "eq", Value: unix.AF_INET}, {Index: 1, Op: "ne", Value: 1 << 40}}},
+		{Syscalls: []string{"socket"}, Action: "errno", Args: []SeccompArg{{Index: 2, Op: "any_set", Value: 1 << 33}}},
+	}}
+	program, err = profile.Compile()
+	require.NoError(t, err)
+	kill := uint32(unix.SECCOMP_RET_KILL_PROCESS)
+	assert.Equal(t, kill, runSeccomp(t, program, unix.SYS_SOCKET, unix.AF_INET, unix.SOCK_STREAM))
+	assert.Equal(t, allow, runSeccomp(t, program, unix.SYS_SOCKET, unix.AF_INET, 1<<40))
+	assert.Equal(t, allow, runSeccomp(t, program, unix.SYS_SOCKET, unix.AF_INET6, unix.SOCK_STREAM))
+	assert.Equal(t, allow, runSeccomp(t, program, unix.SYS_SOCKET, unix.AF_INET|1<<32, unix.SOCK_STREAM))
+	assert.Equal(t, eperm, runSeccomp(t, program, unix.SYS_SOCKET, unix.AF_INET6, 0, 1<<33))
+	assert.Equal(t, allow, runSeccomp(t, program, unix.SYS_SOCKET, unix.AF_INET6, 0, 1<<32))
+}
+
+func indexOf(list []string, value string) int {
+	for ix, entry := range list {
+		if entry == value {
+			return ix
+		}
+	}
+	return -1
+}
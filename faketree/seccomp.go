@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SeccompRule applies an action to a set of system calls.
+type SeccompRule struct {
+	Syscalls []string `json:"syscalls"`
+	// One of allow, errno, kill or log.
+	Action string `json:"action"`
+	// Errno returned with the errno action, EPERM if not specified.
+	Errno uint16 `json:"errno,omitempty"`
+	// If specified, the rule only applies if all the arguments match.
+	Args []SeccompArg `json:"args,omitempty"`
+}
+
+// SeccompArg matches an argument of a system call.
+type SeccompArg struct {
+	// Index of the argument, from 0.
+	Index uint `json:"index"`
+	// One of eq, ne, or any_set - true if any of the bits in value is set in the argument.
+	Op    string `json:"op"`
+	Value uint64 `json:"value"`
+}
+
+// SeccompProfile is a seccomp policy, loaded from a json file like:
+//
+//	{
+//	  "default": "allow",
+//	  "rules": [
+//	    {"syscalls": ["ptrace", "bpf"], "action": "errno"},
+//	    {"syscalls": ["reboot"], "action": "kill"},
+//	    {"syscalls": ["clone"], "action": "errno", "args": [{"index": 0, "op": "any_set", "value": 268435456}]}
+//	  ]
+//	}
+//
+// Only the system calls in kSeccompSyscalls can be used in rules.
+type SeccompProfile struct {
+	// Action applied to system calls not matching any rule, one of allow, errno, kill or log.
+	Default string        `json:"default"`
+	Rules   []SeccompRule `json:"rules"`
+}
+
+// SeccompDefault is the name of the built in profile.
+const SeccompDefault = "default"
+
+// kSeccompCloneNamespaces are the clone flags creating new namespaces.
+const kSeccompCloneNamespaces = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC | unix.CLONE_NEWUSER |
+	unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+// kSeccompDefaultProfile denies the system calls that allow to escape or
+// tamper with the sandbox, or are not expected to be used by builds and tests.
+//
+// Like the default docker profile, clone is denied if it creates namespaces. The
+// flags of clone3 are in memory, and cannot be checked by seccomp: clone3 fails with
+// ENOSYS instead, so the C library falls back to clone.
+var kSeccompDefaultProfile = SeccompProfile{
+	Default: "allow",
+	Rules: []SeccompRule{{
+		Action: "errno",
+		Syscalls: []string{
+			"acct", "add_key", "adjtimex", "bpf", "clock_adjtime", "clock_settime", "delete_module",
+			"finit_module", "init_module", "kexec_file_load", "kexec_load", "keyctl", "mount", "move_mount",
+			"open_by_handle_at", "perf_event_open", "pivot_root", "process_vm_readv", "process_vm_writev",
+			"ptrace", "quotactl", "reboot", "request_key", "setns", "settimeofday", "swapoff", "swapon",
+			"syslog", "umount2", "unshare", "userfaultfd",
+		},
+	}, {
+		Action:   "errno",
+		Syscalls: []string{"clone"},
+		Args:     []SeccompArg{{Index: 0, Op: "any_set", Value: kSeccompCloneNamespaces}},
+	}, {
+		Action:   "errno",
+		Errno:    uint16(syscall.ENOSYS),
+		Syscalls: []string{"clone3"},
+	}},
+}
+
+// kSeccompSyscalls maps the names usable in seccomp profiles to their number.
+var kSeccompSyscalls = map[string]uintptr{
+	"acct":              unix.SYS_ACCT,
+	"add_key":           unix.SYS_ADD_KEY,
+	"adjtimex":          unix.SYS_ADJTIMEX,
+	"bpf":               unix.SYS_BPF,
+	"chroot":            unix.SYS_CHROOT,
+	"clock_adjtime":     unix.SYS_CLOCK_ADJTIME,
+	"clock_settime":     unix.SYS_CLOCK_SETTIME,
+	"clone":             unix.SYS_CLONE,
+	"clone3":            unix.SYS_CLONE3,
+	"connect":           unix.SYS_CONNECT,
+	"delete_module":     unix.SYS_DELETE_MODULE,
+	"fanotify_init":     unix.SYS_FANOTIFY_INIT,
+	"finit_module":      unix.SYS_FINIT_MODULE,
+	"fsconfig":          unix.SYS_FSCONFIG,
+	"fsmount":           unix.SYS_FSMOUNT,
+	"fsopen":            unix.SYS_FSOPEN,
+	"init_module":       unix.SYS_INIT_MODULE,
+	"io_uring_enter":    unix.SYS_IO_URING_ENTER,
+	"io_uring_register": unix.SYS_IO_URING_REGISTER,
+	"io_uring_setup":    unix.SYS_IO_URING_SETUP,
+	"kcmp":              unix.SYS_KCMP,
+	"kexec_load":        unix.SYS_KEXEC_LOAD,
+	"keyctl":            unix.SYS_KEYCTL,
+	"mbind":             unix.SYS_MBIND,
+	"mount":             unix.SYS_MOUNT,
+	"move_mount":        unix.SYS_MOVE_MOUNT,
+	"move_pages":        unix.SYS_MOVE_PAGES,
+	"name_to_handle_at": unix.SYS_NAME_TO_HANDLE_AT,
+	"open_by_handle_at": unix.SYS_OPEN_BY_HANDLE_AT,
+	"open_tree":         unix.SYS_OPEN_TREE,
+	"perf_event_open":   unix.SYS_PERF_EVENT_OPEN,
+	"personality":       unix.SYS_PERSONALITY,
+	"pivot_root":        unix.SYS_PIVOT_ROOT,
+	"process_vm_readv":  unix.SYS_PROCESS_VM_READV,
+	"process_vm_writev": unix.SYS_PROCESS_VM_WRITEV,
+	"ptrace":            unix.SYS_PTRACE,
+	"quotactl":          unix.SYS_QUOTACTL,
+	"reboot":            unix.SYS_REBOOT,
+	"request_key":       unix.SYS_REQUEST_KEY,
+	"sethostname":       unix.SYS_SETHOSTNAME,
+	"setdomainname":     unix.SYS_SETDOMAINNAME,
+	"setns":             unix.SYS_SETNS,
+	"settimeofday":      unix.SYS_SETTIMEOFDAY,
+	"socket":            unix.SYS_SOCKET,
+	"swapoff":           unix.SYS_SWAPOFF,
+	"swapon":            unix.SYS_SWAPON,
+	"syslog":            unix.SYS_SYSLOG,
+	"umount2":           unix.SYS_UMOUNT2,
+	"unshare":           unix.SYS_UNSHARE,
+	"userfaultfd":       unix.SYS_USERFAULTFD,
+	"vhangup":           unix.SYS_VHANGUP,
+}
+
+// LoadSeccompProfile returns the built in profile if name is "default", or reads the profile from file.
+func LoadSeccompProfile(name string) (*SeccompProfile, error) {
+	if name == SeccompDefault {
+		return &kSeccompDefaultProfile, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read seccomp profile - %w", err)
+	}
+	profile := &SeccompProfile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("could not parse seccomp profile %s - %w", name, err)
+	}
+	if _, err := profile.Compile(); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s - %w", name, err)
+	}
+	return profile, nil
+}
+
+func seccompAction(action string, errno uint16) (uint32, error) {
+	switch action {
+	case "allow":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "errno":
+		if errno == 0 {
+			errno = uint16(syscall.EPERM)
+		}
+		return unix.SECCOMP_RET_ERRNO | uint32(errno), nil
+	case "kill":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "log":
+		return unix.SECCOMP_RET_LOG, nil
+	}
+	return 0, fmt.Errorf("invalid action %q - must be one of allow, errno, kill, log", action)
+}
+
+func bpfStatement(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+const (
+	kOffsetNr   = 0  // Offset of nr in struct seccomp_data.
+	kOffsetArch = 4  // Offset of arch in struct seccomp_data.
+	kOffsetArgs = 16 // Offset of args in struct seccomp_data, 6 64 bit values.
+)
+
+// bpfArgs returns the instructions checking the arguments of a system call.
+//
+// All the jumps with a jt or jf of kNoMatch are meant to skip to the end of the
+// instructions returned, and must be resolved by the caller.
+func bpfArgs(args []SeccompArg) ([]unix.SockFilter, error) {
+	const next = 2 // Skips to the first instruction of the next argument from the low word check.
+
+	var program []unix.SockFilter
+	for _, arg := range args {
+		if arg.Index >= 6 {
+			return nil, fmt.Errorf("invalid argument index %d - system calls have 6 arguments", arg.Index)
+		}
+		// The architectures supported are little endian: the low word comes first.
+		low := bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, uint32(kOffsetArgs+8*arg.Index))
+		high := bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, uint32(kOffsetArgs+8*arg.Index+4))
+		vlow, vhigh := uint32(arg.Value), uint32(arg.Value>>32)
+
+		switch arg.Op {
+		case "eq":
+			program = append(program,
+				low, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, vlow, 0, kNoMatch),
+				high, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, vhigh, 0, kNoMatch))
+		case "ne":
+			program = append(program,
+				low, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, vlow, 0, next),
+				high, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, vhigh, kNoMatch, 0))
+		case "any_set":
+			program = append(program,
+				low, bpfJump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, vlow, next, 0),
+				high, bpfJump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, vhigh, 0, kNoMatch))
+		default:
+			return nil, fmt.Errorf("invalid argument op %q - must be one of eq, ne, any_set", arg.Op)
+		}
+	}
+	return program, nil
+}
+
+// kNoMatch marks the jumps to resolve in the instructions returned by bpfArgs.
+const kNoMatch = 0xff
+
+// Compile turns the profile into a BPF program for the current architecture.
+func (sp *SeccompProfile) Compile() ([]unix.SockFilter, error) {
+	if kSeccompArch == 0 {
+		return nil, fmt.Errorf("seccomp profiles are not supported on this architecture")
+	}
+	def, err := seccompAction(sp.Default, 0)
+	if err != nil {
+		return nil, fmt.Errorf("default - %w", err)
+	}
+
+	program := []unix.SockFilter{
+		// Kill processes using a different ABI, which would bypass the rules.
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, kOffsetArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, kSeccompArch, 1, 0),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, kOffsetNr),
+	}
+	if kSeccompSyscallBit != 0 {
+		program = append(program,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, kSeccompSyscallBit, 0, 1),
+			bpfStatement(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	var unknown []string
+	for ix, rule := range sp.Rules {
+		action, err := seccompAction(rule.Action, rule.Errno)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d - %w", ix, err)
+		}
+		args, err := bpfArgs(rule.Args)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d - %w", ix, err)
+		}
+		for _, name := range rule.Syscalls {
+			nr, found := kSeccompSyscalls[name]
+			if !found {
+				unknown = append(unknown, name)
+				continue
+			}
+			if len(args) == 0 {
+				program = append(program,
+					bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1),
+					bpfStatement(unix.BPF_RET|unix.BPF_K, action),
+				)
+				continue
+			}
+
+			// Checking the arguments overwrites the syscall number: if they don't
+			// match, jump to an instruction loading it again.
+			block := append(append([]unix.SockFilter{}, args...), bpfStatement(unix.BPF_RET|unix.BPF_K, action))
+			for i := range block {
+				if block[i].Jt == kNoMatch {
+					block[i].Jt = uint8(len(block) - i - 1)
+				}
+				if block[i].Jf == kNoMatch {
+					block[i].Jf = uint8(len(block) - i - 1)
+				}
+			}
+			program = append(program, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, uint8(len(block)+1)))
+			program = append(program, block...)
+			program = append(program, bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, kOffsetNr))
+		}
+	}
+	if len(unknown) > 0 {
+		known := []string{}
+		for name := range kSeccompSyscalls {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unsupported system calls %s - supported: %s", strings.Join(unknown, ", "), strings.Join(known, ", "))
+	}
+	return append(program, bpfStatement(unix.BPF_RET|unix.BPF_K, def)), nil
+}
+
+// Install applies the profile to all the threads of the current process.
+//
+// The profile is inherited by any process exec()d or spawned afterward, and cannot
+// be removed. Sets no_new_privs, required to use seccomp without CAP_SYS_ADMIN.
+func (sp *SeccompProfile) Install() error {
+	program, err := sp.Compile()
+	if err != nil {
+		return err
+	}
+
+	// no_new_privs is per thread, and seccomp checks it on the calling thread:
+	// both must run on the same one, or seccomp fails with EACCES.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("could not set no_new_privs - %w", err)
+	}
+
+	fprog := unix.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("could not install seccomp filter - %w", errno)
+	}
+	// With TSYNC, a positive value is the id of a thread the filter could not be applied to.
+	if tid != 0 {
+		return fmt.Errorf("could not install seccomp filter on thread %d", tid)
+	}
+	return nil
+}
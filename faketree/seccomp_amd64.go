@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const kSeccompArch = unix.AUDIT_ARCH_X86_64
+
+// x32 system calls are reported with the x86_64 architecture, but have this bit set.
+const kSeccompSyscallBit = 0x40000000
+
+func init() {
+	// Not available on all architectures.
+	kSeccompSyscalls["kexec_file_load"] = unix.SYS_KEXEC_FILE_LOAD
+}
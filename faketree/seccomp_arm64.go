@@ -0,0 +1,12 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const kSeccompArch = unix.AUDIT_ARCH_AARCH64
+
+const kSeccompSyscallBit = 0
+
+func init() {
+	// Not available on all architectures.
+	kSeccompSyscalls["kexec_file_load"] = unix.SYS_KEXEC_FILE_LOAD
+}
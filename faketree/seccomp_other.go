@@ -0,0 +1,8 @@
+//go:build !amd64 && !arm64
+
+package main
+
+// Seccomp profiles are only supported on amd64 and arm64.
+const kSeccompArch = 0
+
+const kSeccompSyscallBit = 0
@@ -68,40 +68,11 @@ func GetAffectedTargets(config *ppb.PresubmitConfig, mode GetMode, opts GetModeO
 	excludeTags := config.GetExcludeTags()
 	includeTags := config.GetIncludeTags()
 
-	// Open the bazel workspaces, using a temporary output_base. Since the
-	// temporary worktrees created above will have a different path on every
-	// invocation, by default bazel will create a new cache directory for them,
-	// re-download all dependencies, etc. which is both slow and will eventually
-	// fill up the disk. Using a temporary output_base which gets deleted each
-	// time avoids this problem, at the cost of the startup/redownload on
-	// repeated invocations with the same source points.
-	//
-	// This temporary directory needs to be in the user's $HOME directory to
-	// avoid filling up /tmp in the dev container.
-	cacheDir, err := os.UserCacheDir()
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get user's cache dir: %w", err)
-	}
-	cacheDir = filepath.Join(cacheDir, "enkit", "bazel")
-	err = os.MkdirAll(cacheDir, 0755)
+	cleanup, err := prepareOutputBases(&opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to make root cache dir: %w", err)
-	}
-	if opts.Start.OutputBase == "" {
-		opts.Start.OutputBase, err = ioutil.TempDir(cacheDir, "output_base_*")
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create temporary output_base: %w", err)
-		}
-		defer os.RemoveAll(opts.Start.OutputBase)
-	}
-
-	if opts.End.OutputBase == "" {
-		opts.End.OutputBase, err = ioutil.TempDir(cacheDir, "output_base_*")
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create temporary output_base: %w", err)
-		}
-		defer os.RemoveAll(opts.End.OutputBase)
+		return nil, nil, err
 	}
+	defer cleanup()
 
 	result, errs := mode(opts, log)
 
@@ -168,6 +139,71 @@ skipTarget:
 	return changedRules, changedTests, nil
 }
 
+// prepareOutputBases creates temporary output bases for the start and end
+// points that don't have one configured. The returned function deletes them.
+func prepareOutputBases(opts *GetModeOptions) (func(), error) {
+	// Open the bazel workspaces, using a temporary output_base. Since the
+	// temporary worktrees created above will have a different path on every
+	// invocation, by default bazel will create a new cache directory for them,
+	// re-download all dependencies, etc. which is both slow and will eventually
+	// fill up the disk. Using a temporary output_base which gets deleted each
+	// time avoids this problem, at the cost of the startup/redownload on
+	// repeated invocations with the same source points.
+	//
+	// This temporary directory needs to be in the user's $HOME directory to
+	// avoid filling up /tmp in the dev container.
+	var created []string
+	cleanup := func() {
+		for _, dir := range created {
+			os.RemoveAll(dir)
+		}
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return cleanup, fmt.Errorf("failed to get user's cache dir: %w", err)
+	}
+	cacheDir = filepath.Join(cacheDir, "enkit", "bazel")
+	err = os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return cleanup, fmt.Errorf("failed to make root cache dir: %w", err)
+	}
+	if opts.Start.OutputBase == "" {
+		opts.Start.OutputBase, err = ioutil.TempDir(cacheDir, "output_base_*")
+		if err != nil {
+			return cleanup, fmt.Errorf("failed to create temporary output_base: %w", err)
+		}
+		created = append(created, opts.Start.OutputBase)
+	}
+
+	if opts.End.OutputBase == "" {
+		opts.End.OutputBase, err = ioutil.TempDir(cacheDir, "output_base_*")
+		if err != nil {
+			return cleanup, fmt.Errorf("failed to create temporary output_base: %w", err)
+		}
+		created = append(created, opts.End.OutputBase)
+	}
+	return cleanup, nil
+}
+
+// ExplainAffectedTarget queries the start and end points, and reports why
+// the target with the supplied name is, or is not, affected.
+func ExplainAffectedTarget(mode GetMode, opts GetModeOptions, name string, log logger.Logger) (*Explanation, error) {
+	cleanup, err := prepareOutputBases(&opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	result, err := mode(opts, log)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Explaining %s...", name)
+	return Explain(result.StartQueryResult, result.EndQueryResult, name)
+}
+
 func SerialQuery(opt GetModeOptions, log logger.Logger) (*GetResult, error) {
 	startWorkspace, err := OpenWorkspace(
 		opt.Start.RepoPath,
@@ -72,7 +72,10 @@ type Invocations struct {
 	*cobra.Command
 	root *Root
 
-	InvID string
+	InvID      string
+	BinaryFile string
+	JSONFile   string
+	BESListen  string
 }
 
 func NewInvocations(root *Root) *Invocations {
@@ -85,10 +88,15 @@ func NewInvocations(root *Root) *Invocations {
 		root: root,
 	}
 
-	command.PersistentFlags().StringVarP(&command.InvID, "invocation-id", "i", "", "Invocation ID of build to use")
-	command.MarkFlagRequired("invocation-id")
+	command.PersistentFlags().StringVarP(&command.InvID, "invocation-id", "i", "", "Invocation ID of build to use, fetched from BuildBuddy")
+	command.PersistentFlags().StringVar(&command.BinaryFile, "build_event_binary_file", "", "Read the build events from a file generated by bazel with --build_event_binary_file")
+	command.PersistentFlags().StringVar(&command.JSONFile, "build_event_json_file", "", "Read the build events from a file generated by bazel with --build_event_json_file")
+	command.PersistentFlags().StringVar(&command.BESListen, "bes_listen", "", "Receive the build events from bazel, by listening on this address (for example, localhost:1985) and waiting for a build run with --bes_backend=grpc://<address>")
 
 	command.AddCommand(NewInvTargetsList(command).Command)
+	command.AddCommand(NewInvFailures(command).Command)
+	command.AddCommand(NewInvTimings(command).Command)
+	command.AddCommand(NewInvDiff(command).Command)
 
 	return command
 }
@@ -121,9 +129,8 @@ func NewInvTargetsList(parent *Invocations) *InvTargetsList {
 }
 
 func (c *InvTargetsList) Check(cmd *cobra.Command, args []string) error {
-	// Ensure invocation ID is set
-	if c.parent.InvID == "" {
-		return fmt.Errorf("--invocation-id must be set")
+	if err := c.parent.checkSource(); err != nil {
+		return err
 	}
 	if c.StatusFilter != nil {
 		for _, s := range c.StatusFilter {
@@ -136,14 +143,9 @@ func (c *InvTargetsList) Check(cmd *cobra.Command, args []string) error {
 }
 
 func (c *InvTargetsList) Run(cmd *cobra.Command, args []string) error {
-	// Fetch invocation data
-	bb, err := c.root.BuildBuddyClient()
-	if err != nil {
-		return fmt.Errorf("failed to connect to BuildBuddy: %w", err)
-	}
-	events, err := bb.GetBuildEvents(cmd.Context(), c.parent.InvID)
+	events, err := c.parent.Events(cmd.Context())
 	if err != nil {
-		return fmt.Errorf("failed to get invocation with ID %q: %w", c.parent.InvID, err)
+		return err
 	}
 	statuses, err := invocationStatusFromBuildEvents(events)
 	if err != nil {
@@ -163,6 +165,139 @@ func (c *InvTargetsList) Run(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+type InvFailures struct {
+	*cobra.Command
+	root   *Root
+	parent *Invocations
+}
+
+func NewInvFailures(parent *Invocations) *InvFailures {
+	command := &InvFailures{
+		Command: &cobra.Command{
+			Use:   "failures",
+			Short: "List failed actions and tests in invocation, with the location of their logs",
+			Example: `  $ enkit bazel invocations failures --build_event_json_file=/tmp/bep.json
+        List the failures of a build run with --build_event_json_file=/tmp/bep.json.`,
+		},
+		root:   parent.root,
+		parent: parent,
+	}
+	command.Command.PreRunE = command.Check
+	command.Command.RunE = command.Run
+
+	return command
+}
+
+func (c *InvFailures) Check(cmd *cobra.Command, args []string) error {
+	return c.parent.checkSource()
+}
+
+func (c *InvFailures) Run(cmd *cobra.Command, args []string) error {
+	events, err := c.parent.Events(cmd.Context())
+	if err != nil {
+		return err
+	}
+	printFailures(os.Stdout, failuresFromBuildEvents(events))
+	return nil
+}
+
+type InvTimings struct {
+	*cobra.Command
+	root   *Root
+	parent *Invocations
+
+	Top     int
+	Profile string
+}
+
+func NewInvTimings(parent *Invocations) *InvTimings {
+	command := &InvTimings{
+		Command: &cobra.Command{
+			Use:   "timings",
+			Short: "Show the critical path and the slowest targets in invocation",
+		},
+		root:   parent.root,
+		parent: parent,
+	}
+	command.Command.PreRunE = command.Check
+	command.Command.RunE = command.Run
+	command.Flags().IntVar(&command.Top, "top", 10, "Number of slowest targets, tests and action types to show, 0 to show all")
+	command.Flags().StringVar(&command.Profile, "profile", "", "JSON trace profile of the invocation, used to time targets; defaults to the one referenced by the build events, if local")
+
+	return command
+}
+
+func (c *InvTimings) Check(cmd *cobra.Command, args []string) error {
+	return c.parent.checkSource()
+}
+
+func (c *InvTimings) Run(cmd *cobra.Command, args []string) error {
+	events, err := c.parent.Events(cmd.Context())
+	if err != nil {
+		return err
+	}
+	timings := timingsFromBuildEvents(events)
+	profile := c.Profile
+	if profile == "" {
+		profile = timings.profile
+	}
+	if profile != "" {
+		if err := timings.LoadProfile(profile); err != nil {
+			if c.Profile != "" {
+				return err
+			}
+			c.root.Log.Warnf("Targets will not be timed: %v", err)
+		}
+	}
+	timings.Print(os.Stdout, c.Top)
+	return nil
+}
+
+type InvDiff struct {
+	*cobra.Command
+	root   *Root
+	parent *Invocations
+}
+
+func NewInvDiff(parent *Invocations) *InvDiff {
+	command := &InvDiff{
+		Command: &cobra.Command{
+			Use:   "diff <before> <after>",
+			Short: "Show the targets whose status changed between two invocations",
+			Long: `Show the targets whose status changed between two invocations.
+
+Each invocation is either the path of a binary or .json BEP file, or the
+ID of an invocation to fetch from BuildBuddy.`,
+			Example: `  $ enkit bazel invocations diff /tmp/before.bep /tmp/after.bep
+        Compare two builds run with --build_event_binary_file.`,
+			Args: cobra.ExactArgs(2),
+		},
+		root:   parent.root,
+		parent: parent,
+	}
+	command.Command.RunE = command.Run
+
+	return command
+}
+
+func (c *InvDiff) Run(cmd *cobra.Command, args []string) error {
+	var invocations []*invocation
+	for _, source := range args {
+		events, err := c.root.loadEvents(cmd.Context(), source)
+		if err != nil {
+			return err
+		}
+		inv, err := invocationStatusFromBuildEvents(events)
+		if err != nil {
+			return fmt.Errorf("failed to parse status of all targets in %s: %w", source, err)
+		}
+		invocations = append(invocations, inv)
+	}
+
+	printStatusChanges(os.Stdout, diffInvocations(invocations[0], invocations[1]))
+	return nil
+}
+
 type AffectedTargets struct {
 	*cobra.Command
 	root *Root
@@ -171,6 +306,9 @@ type AffectedTargets struct {
 	End             string
 	RepoRoot        string
 	PresubmitConfig string
+	Parallel        bool
+
+	bazel.GetModeOptions
 }
 
 func NewAffectedTargets(root *Root) *AffectedTargets {
@@ -188,11 +326,85 @@ func NewAffectedTargets(root *Root) *AffectedTargets {
 	command.PersistentFlags().StringVarP(&command.RepoRoot, "repo_root", "r", "", "Path to the git repository root; autodetected from $PWD if unset")
 	command.PersistentFlags().StringVar(&command.PresubmitConfig, "presubmit_config", "", "Path to presubmit configuration to read target filtering options")
 
+	command.PersistentFlags().BoolVar(&command.Parallel, "parallel", true, "If set, the bazel query is run in parallel")
+	command.PersistentFlags().StringVar(&command.GetModeOptions.Start.OutputBase, "start_output_base", "", "If set, the directory to use as start output base")
+	command.PersistentFlags().StringVar(&command.GetModeOptions.Start.WorkspaceLog, "start_workspace_log", "", "If set, previously generated workspace log file will be used")
+	command.PersistentFlags().StringVar(&command.GetModeOptions.End.OutputBase, "end_output_base", "", "If set, the directory to use as end output base")
+	command.PersistentFlags().StringVar(&command.GetModeOptions.End.WorkspaceLog, "end_workspace_log", "", "If set, previously generated workspace log file will be used")
+	command.PersistentFlags().StringVar(&command.Query, "query", "deps(//...)",
+		"The query to use to find the targets. Only the default query has been tested, "+
+			"not all queries will work correctly, make sure to test your changes carefully")
+	command.PersistentFlags().StringArrayVar(&command.ExtraStartup, "extra_startup", nil, "Extra startup flags appended to the bazel command line")
+
 	command.AddCommand(NewAffectedTargetsList(command).Command)
+	command.AddCommand(NewAffectedTargetsExplain(command).Command)
 
 	return command
 }
 
+// checkout creates worktrees for the start and end revisions, and returns
+// the options and mode to query them with. The returned function deletes the
+// worktrees.
+func (c *AffectedTargets) checkout() (bazel.GetModeOptions, bazel.GetMode, func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	options := c.GetModeOptions
+
+	startDir := c.RepoRoot
+	var err error
+	if startDir == "" {
+		startDir, err = os.Getwd()
+		if err != nil {
+			return options, nil, cleanup, fmt.Errorf("failed to detect working dir: %w", err)
+		}
+	}
+	gitRoot, gitToBazelPath, err := bazelGitRoot(startDir)
+	if err != nil {
+		return options, nil, cleanup, fmt.Errorf("can't find git repo root: %w", err)
+	}
+
+	// Create temporary worktrees in which to execute bazel commands.
+	// If the end commit is not provided, use the current git directory as the end
+	// worktree, which will include uncommitted local changes.
+	c.root.BaseFlags.Log.Infof("Checking out %q to tempdir...", c.Start)
+	startTree, err := git.NewTempWorktree(gitRoot, c.Start)
+	if err != nil {
+		return options, nil, cleanup, fmt.Errorf("can't generate worktree for committish %q: %w", c.Start, err)
+	}
+	cleanups = append(cleanups, func() { startTree.Close() })
+	options.Start.RepoPath = filepath.Clean(filepath.Join(startTree.Root(), gitToBazelPath))
+	c.root.BaseFlags.Log.Infof("Checked out %q to %q", c.Start, startTree.Root())
+
+	endTreePath := gitRoot
+	if c.End != "" {
+		c.root.BaseFlags.Log.Infof("Checking out %q to tempdir...", c.End)
+		endTree, err := git.NewTempWorktree(gitRoot, c.End)
+		if err != nil {
+			return options, nil, cleanup, fmt.Errorf("can't generate worktree for committish %q: %w", c.End, err)
+		}
+		cleanups = append(cleanups, func() { endTree.Close() })
+		endTreePath = endTree.Root()
+	} else {
+		c.root.BaseFlags.Log.Infof("Using %d as ending working directory", endTreePath)
+	}
+	c.root.BaseFlags.Log.Infof("Checked out %q to %q", c.End, endTreePath)
+	options.End.RepoPath = filepath.Clean(filepath.Join(endTreePath, gitToBazelPath))
+
+	mode := bazel.ParallelQuery
+	if !c.Parallel {
+		if err := setCurrentOutputBaseAsDefault(gitRoot, &options, c.root.Log); err != nil {
+			c.root.Log.Warnf("Could not compute output_base of workspace %s: %s", gitRoot, err)
+		}
+
+		mode = bazel.SerialQuery
+	}
+	return options, mode, cleanup, nil
+}
+
 type AffectedTargetsList struct {
 	*cobra.Command
 	root   *Root
@@ -200,9 +412,6 @@ type AffectedTargetsList struct {
 
 	AffectedTargetsFile string
 	AffectedTestsFile   string
-	Parallel            bool
-
-	bazel.GetModeOptions
 }
 
 func NewAffectedTargetsList(parent *AffectedTargets) *AffectedTargetsList {
@@ -222,17 +431,8 @@ func NewAffectedTargetsList(parent *AffectedTargets) *AffectedTargetsList {
 	}
 	command.Command.RunE = command.Run
 
-	command.Flags().BoolVar(&command.Parallel, "parallel", true, "If set, the bazel query is run in parallel")
 	command.Flags().StringVar(&command.AffectedTargetsFile, "affected_targets_file", "", "If set, the list of affected targets will be dumped to this file path")
 	command.Flags().StringVar(&command.AffectedTestsFile, "affected_tests_file", "", "If set, the list of affected tests will be dumped to this file path")
-	command.Flags().StringVar(&command.Start.OutputBase, "start_output_base", "", "If set, the directory to use as start output base")
-	command.Flags().StringVar(&command.Start.WorkspaceLog, "start_workspace_log", "", "If set, previously generated workspace log file will be used")
-	command.Flags().StringVar(&command.End.OutputBase, "end_output_base", "", "If set, the directory to use as end output base")
-	command.Flags().StringVar(&command.End.WorkspaceLog, "end_workspace_log", "", "If set, previously generated workspace log file will be used")
-	command.Flags().StringVar(&command.Query, "query", "deps(//...)",
-		"The query to use to find the targets. Only the default query has been tested, "+
-			"not all queries will work correctly, make sure to test your changes carefully")
-	command.Flags().StringArrayVar(&command.ExtraStartup, "extra_startup", nil, "Extra startup flags appended to the bazel command line")
 
 	return command
 }
@@ -276,56 +476,13 @@ func (c *AffectedTargetsList) Run(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	startDir := c.parent.RepoRoot
-	var err error
-	if startDir == "" {
-		startDir, err = os.Getwd()
-		if err != nil {
-			return fmt.Errorf("failed to detect working dir: %w", err)
-		}
-	}
-	gitRoot, gitToBazelPath, err := bazelGitRoot(startDir)
-	if err != nil {
-		return fmt.Errorf("can't find git repo root: %w", err)
-	}
-
-	// Create temporary worktrees in which to execute bazel commands.
-	// If the end commit is not provided, use the current git directory as the end
-	// worktree, which will include uncommitted local changes.
-	c.root.BaseFlags.Log.Infof("Checking out %q to tempdir...", c.parent.Start)
-	startTree, err := git.NewTempWorktree(gitRoot, c.parent.Start)
+	options, mode, cleanup, err := c.parent.checkout()
+	defer cleanup()
 	if err != nil {
-		return fmt.Errorf("can't generate worktree for committish %q: %w", c.parent.Start, err)
-	}
-	defer startTree.Close()
-	c.Start.RepoPath = filepath.Clean(filepath.Join(startTree.Root(), gitToBazelPath))
-	c.root.BaseFlags.Log.Infof("Checked out %q to %q", c.parent.Start, startTree.Root())
-
-	endTreePath := gitRoot
-	if c.parent.End != "" {
-		c.root.BaseFlags.Log.Infof("Checking out %q to tempdir...", c.parent.End)
-		endTree, err := git.NewTempWorktree(gitRoot, c.parent.End)
-		if err != nil {
-			return fmt.Errorf("can't generate worktree for committish %q: %w", c.parent.End, err)
-		}
-		defer endTree.Close()
-		endTreePath = endTree.Root()
-	} else {
-		c.root.BaseFlags.Log.Infof("Using %d as ending working directory", endTreePath)
-	}
-	c.root.BaseFlags.Log.Infof("Checked out %q to %q", c.parent.End, endTreePath)
-	c.End.RepoPath = filepath.Clean(filepath.Join(endTreePath, gitToBazelPath))
-
-	mode := bazel.ParallelQuery
-	if !c.Parallel {
-		if err := setCurrentOutputBaseAsDefault(gitRoot, &c.GetModeOptions, c.root.Log); err != nil {
-			c.root.Log.Warnf("Could not compute output_base of workspace %s: %s", gitRoot, err)
-		}
-
-		mode = bazel.SerialQuery
+		return err
 	}
 
-	rules, tests, err := bazel.GetAffectedTargets(config, mode, c.GetModeOptions, c.root.BaseFlags.Log)
+	rules, tests, err := bazel.GetAffectedTargets(config, mode, options, c.root.BaseFlags.Log)
 	if err != nil {
 		return fmt.Errorf("failed to calculate affected targets: %w", err)
 	}
@@ -357,6 +514,49 @@ func (c *AffectedTargetsList) Run(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+type AffectedTargetsExplain struct {
+	*cobra.Command
+	root   *Root
+	parent *AffectedTargets
+}
+
+func NewAffectedTargetsExplain(parent *AffectedTargets) *AffectedTargetsExplain {
+	command := &AffectedTargetsExplain{
+		Command: &cobra.Command{
+			Use:   "explain <label>",
+			Short: "Explain why a target is affected between two source revision points",
+			Long: `Explain why a target is affected between two source revision points.
+
+For each changed input, shows the dependency path from the target to the
+input, and the reason the input changed: a source file, a BUILD attribute,
+the list of dependencies, an external repository, or a toolchain.`,
+			Example: `  $ enkit bazel affected-targets explain //lib/bazel:bazel_test --start=HEAD~1 --end=HEAD
+        Explain why //lib/bazel:bazel_test is affected by the most recent commit.`,
+			Args: cobra.ExactArgs(1),
+		},
+		root:   parent.root,
+		parent: parent,
+	}
+	command.Command.RunE = command.Run
+
+	return command
+}
+
+func (c *AffectedTargetsExplain) Run(cmd *cobra.Command, args []string) error {
+	options, mode, cleanup, err := c.parent.checkout()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	explanation, err := bazel.ExplainAffectedTarget(mode, options, args[0], c.root.BaseFlags.Log)
+	if err != nil {
+		return fmt.Errorf("failed to explain %s: %w", args[0], err)
+	}
+	printExplanation(os.Stdout, explanation)
+	return nil
+}
+
 func writeTargets(targets []*bazel.Target, path string) error {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
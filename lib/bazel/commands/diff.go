@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+)
+
+// statusChange is a target whose status differs between two invocations.
+//
+// before or after is nil if the target was not part of that invocation.
+type statusChange struct {
+	name   string
+	before *target
+	after  *target
+}
+
+// diffInvocations returns the targets whose status changed between the
+// before and after invocations, sorted by name.
+func diffInvocations(before, after *invocation) []statusChange {
+	var changes []statusChange
+	for name, b := range before.targets {
+		a := after.targets[name]
+		if a != nil && a.status == b.status {
+			continue
+		}
+		changes = append(changes, statusChange{name: name, before: b, after: a})
+	}
+	for name, a := range after.targets {
+		if _, found := before.targets[name]; !found {
+			changes = append(changes, statusChange{name: name, after: a})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+	return changes
+}
+
+func statusName(t *target) string {
+	if t == nil {
+		return "absent"
+	}
+	return strings.ToLower(bespb.TestStatus_name[int32(t.status)])
+}
+
+func printStatusChanges(w io.Writer, changes []statusChange) {
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s: %s -> %s\n", change.name, statusName(change.before), statusName(change.after))
+	}
+}
@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+)
+
+func TestDiffInvocations(t *testing.T) {
+	before := &invocation{
+		finished: true,
+		targets: map[string]*target{
+			"//a:same":    {name: "//a:same", status: bespb.TestStatus_PASSED},
+			"//a:broken":  {name: "//a:broken", status: bespb.TestStatus_PASSED},
+			"//a:fixed":   {name: "//a:fixed", status: bespb.TestStatus_FAILED},
+			"//a:removed": {name: "//a:removed", status: bespb.TestStatus_PASSED},
+		},
+	}
+	after := &invocation{
+		finished: true,
+		targets: map[string]*target{
+			"//a:same":   {name: "//a:same", status: bespb.TestStatus_PASSED},
+			"//a:broken": {name: "//a:broken", status: bespb.TestStatus_TIMEOUT},
+			"//a:fixed":  {name: "//a:fixed", status: bespb.TestStatus_PASSED},
+			"//a:added":  {name: "//a:added", status: bespb.TestStatus_FLAKY},
+		},
+	}
+
+	var out bytes.Buffer
+	printStatusChanges(&out, diffInvocations(before, after))
+	assert.Equal(t, `//a:added: absent -> flaky
+//a:broken: passed -> timeout
+//a:fixed: failed -> passed
+//a:removed: passed -> absent
+`, out.String())
+
+	assert.Len(t, diffInvocations(after, after), 0)
+}
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ccontavalli/enkit/lib/bes"
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+
+	"google.golang.org/grpc"
+)
+
+// checkSource ensures that exactly one source of build events was specified.
+func (c *Invocations) checkSource() error {
+	set := 0
+	for _, source := range []string{c.InvID, c.BinaryFile, c.JSONFile, c.BESListen} {
+		if source != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of --invocation-id, --build_event_binary_file, --build_event_json_file or --bes_listen must be set")
+	}
+	return nil
+}
+
+// Events returns the build events from the source selected on the command line.
+func (c *Invocations) Events(ctx context.Context) ([]*bespb.BuildEvent, error) {
+	switch {
+	case c.BinaryFile != "":
+		return bes.ReadEventFileAs(c.BinaryFile, bes.ReadBinaryEvents)
+	case c.JSONFile != "":
+		return bes.ReadEventFileAs(c.JSONFile, bes.ReadJSONEvents)
+	case c.BESListen != "":
+		return c.receiveEvents(ctx)
+	}
+	return c.root.buildBuddyEvents(ctx, c.InvID)
+}
+
+// receiveEvents starts a local Build Event Service, and waits for a bazel
+// invocation to stream its events to it.
+func (c *Invocations) receiveEvents(ctx context.Context) ([]*bespb.BuildEvent, error) {
+	listener, err := net.Listen("tcp", c.BESListen)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %q: %w", c.BESListen, err)
+	}
+
+	server := grpc.NewServer()
+	defer server.Stop()
+	receiver := bes.NewReceiver()
+	receiver.Register(server)
+	go server.Serve(listener)
+
+	c.root.Log.Infof("Waiting for build events; run bazel with --bes_backend=grpc://%s", listener.Addr())
+	inv, err := receiver.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.root.Log.Infof("Received %d events from invocation %s", len(inv.Events), inv.ID)
+	return inv.Events, nil
+}
+
+// loadEvents returns the build events from source, either the path of a
+// binary or .json BEP file, or the ID of an invocation on BuildBuddy.
+func (r *Root) loadEvents(ctx context.Context, source string) ([]*bespb.BuildEvent, error) {
+	if _, err := os.Stat(source); err == nil {
+		return bes.ReadEventFile(source)
+	}
+	return r.buildBuddyEvents(ctx, source)
+}
+
+func (r *Root) buildBuddyEvents(ctx context.Context, id string) ([]*bespb.BuildEvent, error) {
+	bb, err := r.BuildBuddyClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to BuildBuddy: %w", err)
+	}
+	events, err := bb.GetBuildEvents(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invocation with ID %q: %w", id, err)
+	}
+	return events, nil
+}
@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ccontavalli/enkit/lib/bazel"
+)
+
+func printExplanation(w io.Writer, e *bazel.Explanation) {
+	if !e.Affected {
+		fmt.Fprintf(w, "%s is not affected\n", e.Target)
+		return
+	}
+
+	fmt.Fprintf(w, "%s is affected by %d changed inputs:\n", e.Target, len(e.Causes))
+	for _, cause := range e.Causes {
+		fmt.Fprintf(w, "\n%s: %s\n", cause.Target, cause.Reason)
+		for _, detail := range cause.Details {
+			fmt.Fprintf(w, "    %s\n", detail)
+		}
+		fmt.Fprintf(w, "  path:\n")
+		for i, step := range cause.Path {
+			if i == 0 {
+				fmt.Fprintf(w, "    %s\n", step)
+				continue
+			}
+			fmt.Fprintf(w, "    -> %s\n", step)
+		}
+	}
+}
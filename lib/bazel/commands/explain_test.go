@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ccontavalli/enkit/lib/bazel"
+)
+
+func TestPrintExplanation(t *testing.T) {
+	var out bytes.Buffer
+	printExplanation(&out, &bazel.Explanation{Target: "//app:app"})
+	assert.Equal(t, "//app:app is not affected\n", out.String())
+
+	out.Reset()
+	printExplanation(&out, &bazel.Explanation{
+		Target:   "//app:app_test",
+		Affected: true,
+		Causes: []*bazel.ChangeCause{
+			{
+				Target:  "//lib:lib",
+				Reason:  bazel.ReasonAttribute,
+				Details: []string{"modified attribute importpath"},
+				Path:    []string{"//app:app_test", "//app:app", "//lib:lib"},
+			},
+			{
+				Target: "//lib:lib.go",
+				Reason: bazel.ReasonSourceFile,
+				Path:   []string{"//app:app_test", "//app:app", "//lib:lib", "//lib:lib.go"},
+			},
+		},
+	})
+	assert.Equal(t, `//app:app_test is affected by 2 changed inputs:
+
+//lib:lib: BUILD attributes changed
+    modified attribute importpath
+  path:
+    //app:app_test
+    -> //app:app
+    -> //lib:lib
+
+//lib:lib.go: source file changed
+  path:
+    //app:app_test
+    -> //app:app
+    -> //lib:lib
+    -> //lib:lib.go
+`, out.String())
+}
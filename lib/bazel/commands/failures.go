@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+)
+
+// failure is an action or a test attempt that failed during an invocation.
+type failure struct {
+	label    string
+	kind     string
+	exitCode int32
+	message  string
+	// logs maps the name of a log, like "stderr" or "test.log", to its location.
+	logs map[string]string
+}
+
+// failuresFromBuildEvents returns the failed actions and tests in events,
+// sorted by label.
+//
+// Note that bazel only reports in the event stream actions that failed, or
+// all actions when run with --build_event_publish_all_actions.
+func failuresFromBuildEvents(events []*bespb.BuildEvent) []*failure {
+	var failures []*failure
+	for _, event := range events {
+		switch payload := event.Payload.(type) {
+		case *bespb.BuildEvent_Action:
+			action := payload.Action
+			if action.GetSuccess() {
+				continue
+			}
+			label := action.GetLabel()
+			if label == "" {
+				label = event.GetId().GetActionCompleted().GetLabel()
+			}
+			f := &failure{
+				label:    label,
+				kind:     action.GetType(),
+				exitCode: action.GetExitCode(),
+				message:  action.GetFailureDetail().GetMessage(),
+				logs:     map[string]string{},
+			}
+			if loc := fileLocation(action.GetStdout()); loc != "" {
+				f.logs["stdout"] = loc
+			}
+			if loc := fileLocation(action.GetStderr()); loc != "" {
+				f.logs["stderr"] = loc
+			}
+			failures = append(failures, f)
+
+		case *bespb.BuildEvent_TestResult:
+			result := payload.TestResult
+			switch result.GetStatus() {
+			case bespb.TestStatus_PASSED, bespb.TestStatus_FLAKY, bespb.TestStatus_NO_STATUS:
+				continue
+			}
+			id := event.GetId().GetTestResult()
+			f := &failure{
+				label:   id.GetLabel(),
+				kind:    fmt.Sprintf("test %s (run %d, shard %d, attempt %d)", result.GetStatus(), id.GetRun(), id.GetShard(), id.GetAttempt()),
+				message: result.GetStatusDetails(),
+				logs:    map[string]string{},
+			}
+			for _, output := range result.GetTestActionOutput() {
+				if output.GetName() != "test.log" {
+					continue
+				}
+				if loc := fileLocation(output); loc != "" {
+					f.logs[output.GetName()] = loc
+				}
+			}
+			failures = append(failures, f)
+		}
+	}
+
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].label < failures[j].label
+	})
+	return failures
+}
+
+// fileLocation returns the path of a file referenced by the event stream, or
+// its URI if the file is not local.
+func fileLocation(f *bespb.File) string {
+	uri := f.GetUri()
+	if uri == "" {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return u.Path
+}
+
+func printFailures(w io.Writer, failures []*failure) {
+	for _, f := range failures {
+		fmt.Fprintf(w, "%s %s", f.label, f.kind)
+		if f.exitCode != 0 {
+			fmt.Fprintf(w, " (exit code %d)", f.exitCode)
+		}
+		fmt.Fprintln(w)
+		if f.message != "" {
+			fmt.Fprintf(w, "    %s\n", f.message)
+		}
+		names := make([]string, 0, len(f.logs))
+		for name := range f.logs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "    %s: %s\n", name, f.logs[name])
+		}
+	}
+}
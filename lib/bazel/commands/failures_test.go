@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+	fpb "github.com/ccontavalli/enkit/third_party/bazel/proto"
+)
+
+func TestFailuresFromBuildEvents(t *testing.T) {
+	events := []*bespb.BuildEvent{
+		{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_ActionCompleted{ActionCompleted: &bespb.BuildEventId_ActionCompletedId{
+				Label: "//lib/foo:foo",
+			}}},
+			Payload: &bespb.BuildEvent_Action{Action: &bespb.ActionExecuted{
+				Success:       false,
+				Type:          "GoCompilePkg",
+				ExitCode:      1,
+				Stderr:        &bespb.File{Name: "stderr", File: &bespb.File_Uri{Uri: "file:///tmp/output/stderr-12"}},
+				FailureDetail: &fpb.FailureDetail{Message: "compilation failed"},
+			}},
+		},
+		{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_ActionCompleted{ActionCompleted: &bespb.BuildEventId_ActionCompletedId{
+				Label: "//lib/bar:bar",
+			}}},
+			Payload: &bespb.BuildEvent_Action{Action: &bespb.ActionExecuted{
+				Success: true,
+				Type:    "GoLink",
+			}},
+		},
+		{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_TestResult{TestResult: &bespb.BuildEventId_TestResultId{
+				Label: "//lib/bar:bar_test", Run: 1, Shard: 0, Attempt: 2,
+			}}},
+			Payload: &bespb.BuildEvent_TestResult{TestResult: &bespb.TestResult{
+				Status: bespb.TestStatus_FAILED,
+				TestActionOutput: []*bespb.File{
+					{Name: "test.log", File: &bespb.File_Uri{Uri: "bytestream://cache.example.com/blobs/1234/56"}},
+					{Name: "test.xml", File: &bespb.File_Uri{Uri: "bytestream://cache.example.com/blobs/5678/12"}},
+				},
+			}},
+		},
+		{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_TestResult{TestResult: &bespb.BuildEventId_TestResultId{
+				Label: "//lib/baz:baz_test", Run: 1, Attempt: 1,
+			}}},
+			Payload: &bespb.BuildEvent_TestResult{TestResult: &bespb.TestResult{
+				Status: bespb.TestStatus_PASSED,
+			}},
+		},
+	}
+
+	var out bytes.Buffer
+	printFailures(&out, failuresFromBuildEvents(events))
+	assert.Equal(t, `//lib/bar:bar_test test FAILED (run 1, shard 0, attempt 2)
+    test.log: bytestream://cache.example.com/blobs/1234/56
+//lib/foo:foo GoCompilePkg (exit code 1)
+    compilation failed
+    stderr: /tmp/output/stderr-12
+`, out.String())
+
+	assert.Len(t, failuresFromBuildEvents(loadTestEvents(t, "enkit/lib/bazel/commands/testdata/success.json")), 0)
+}
@@ -0,0 +1,199 @@
+package commands
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+)
+
+// duration is the time spent on a target or by a kind of action.
+type duration struct {
+	name     string
+	duration time.Duration
+}
+
+// timings summarizes where the time of an invocation was spent.
+type timings struct {
+	wall     time.Duration
+	cpu      time.Duration
+	analysis time.Duration
+
+	// criticalPath is the critical path summary computed by bazel, if available.
+	criticalPath string
+	// profile is the path of the JSON trace profile written by bazel, if available.
+	profile string
+
+	// tests is the total run time of each test, slowest first.
+	tests []duration
+	// mnemonics is the time between the first and the last action of each
+	// type executed, slowest first.
+	mnemonics []duration
+	// targets is the sum of the time spent running the actions of each
+	// target, slowest first. Only available from the trace profile.
+	targets []duration
+}
+
+func timingsFromBuildEvents(events []*bespb.BuildEvent) *timings {
+	t := &timings{}
+	for _, event := range events {
+		switch payload := event.Payload.(type) {
+		case *bespb.BuildEvent_BuildMetrics:
+			metrics := payload.BuildMetrics.GetTimingMetrics()
+			t.wall = time.Duration(metrics.GetWallTimeInMs()) * time.Millisecond
+			t.cpu = time.Duration(metrics.GetCpuTimeInMs()) * time.Millisecond
+			t.analysis = time.Duration(metrics.GetAnalysisPhaseTimeInMs()) * time.Millisecond
+
+			for _, action := range payload.BuildMetrics.GetActionSummary().GetActionData() {
+				t.mnemonics = append(t.mnemonics, duration{
+					name:     action.GetMnemonic(),
+					duration: time.Duration(action.GetLastEndedMs()-action.GetFirstStartedMs()) * time.Millisecond,
+				})
+			}
+
+		case *bespb.BuildEvent_BuildToolLogs:
+			for _, log := range payload.BuildToolLogs.GetLog() {
+				switch log.GetName() {
+				case "critical path":
+					if contents := log.GetContents(); len(contents) > 0 {
+						t.criticalPath = strings.TrimSpace(string(contents))
+					} else {
+						t.criticalPath = fileLocation(log)
+					}
+				case "command.profile.gz":
+					if strings.HasPrefix(log.GetUri(), "file:") {
+						t.profile = fileLocation(log)
+					}
+				}
+			}
+
+		case *bespb.BuildEvent_TestSummary:
+			summary := payload.TestSummary
+			d := summary.GetTotalRunDuration().AsDuration()
+			if summary.GetTotalRunDuration() == nil {
+				d = time.Duration(summary.GetTotalRunDurationMillis()) * time.Millisecond
+			}
+			t.tests = append(t.tests, duration{
+				name:     event.GetId().GetTestSummary().GetLabel(),
+				duration: d,
+			})
+		}
+	}
+
+	sortDurations(t.tests)
+	sortDurations(t.mnemonics)
+	return t
+}
+
+// traceProfile is the subset of the chrome trace format written by bazel
+// with --generate_json_trace_profile that is needed to time targets.
+type traceProfile struct {
+	TraceEvents []struct {
+		Cat string `json:"cat"`
+		// Dur is in microseconds.
+		Dur  float64 `json:"dur"`
+		Args struct {
+			Target string `json:"target"`
+		} `json:"args"`
+	} `json:"traceEvents"`
+}
+
+// targetsFromProfile returns the time spent running the actions of each
+// target, slowest first, from a trace profile, optionally gzip compressed.
+func targetsFromProfile(r io.Reader) ([]duration, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	var profile traceProfile
+	if err := json.NewDecoder(r).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("invalid trace profile: %w", err)
+	}
+
+	byTarget := map[string]time.Duration{}
+	for _, event := range profile.TraceEvents {
+		// Remote and local execution events are nested within the action
+		// processing event, counting them would count the time twice.
+		if event.Cat != "action processing" || event.Args.Target == "" {
+			continue
+		}
+		byTarget[event.Args.Target] += time.Duration(event.Dur * float64(time.Microsecond))
+	}
+
+	targets := make([]duration, 0, len(byTarget))
+	for name, d := range byTarget {
+		targets = append(targets, duration{name: name, duration: d})
+	}
+	sortDurations(targets)
+	return targets, nil
+}
+
+// LoadProfile computes the time spent on each target from the trace profile
+// at path.
+func (t *timings) LoadProfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	targets, err := targetsFromProfile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	t.targets = targets
+	return nil
+}
+
+func sortDurations(durations []duration) {
+	sort.SliceStable(durations, func(i, j int) bool {
+		if durations[i].duration != durations[j].duration {
+			return durations[i].duration > durations[j].duration
+		}
+		return durations[i].name < durations[j].name
+	})
+}
+
+// Print writes the timings to w, showing at most top targets, tests and action types.
+func (t *timings) Print(w io.Writer, top int) {
+	fmt.Fprintf(w, "Wall time: %s, CPU time: %s, analysis phase: %s\n", t.wall, t.cpu, t.analysis)
+	fmt.Fprintln(w, "")
+
+	if t.criticalPath != "" {
+		fmt.Fprintln(w, t.criticalPath)
+		fmt.Fprintln(w, "")
+	}
+
+	printDurations(w, "Slowest targets (sum of action time)", t.targets, top)
+	printDurations(w, "Slowest tests", t.tests, top)
+	printDurations(w, "Slowest action types (first start to last end)", t.mnemonics, top)
+}
+
+func printDurations(w io.Writer, header string, durations []duration, top int) {
+	if len(durations) == 0 {
+		return
+	}
+	if top > 0 && len(durations) > top {
+		durations = durations[:top]
+	}
+	fmt.Fprintf(w, "%s:\n", header)
+	for _, d := range durations {
+		fmt.Fprintf(w, "%10s %s\n", d.duration.Round(time.Millisecond), d.name)
+	}
+	fmt.Fprintln(w, "")
+}
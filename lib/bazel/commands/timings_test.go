@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/rules_go/go/runfiles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+)
+
+func loadTestEvents(t *testing.T, path string) []*bespb.BuildEvent {
+	t.Helper()
+	r, err := runfiles.New()
+	require.NoError(t, err)
+	f, err := r.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	events, err := unmarshalEventsList(f)
+	require.NoError(t, err)
+	return events
+}
+
+func TestTimingsFromBuildEvents(t *testing.T) {
+	events := loadTestEvents(t, "enkit/lib/bazel/commands/testdata/success.json")
+	events = append(events, &bespb.BuildEvent{
+		Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_BuildToolLogs{BuildToolLogs: &bespb.BuildEventId_BuildToolLogsId{}}},
+		Payload: &bespb.BuildEvent_BuildToolLogs{BuildToolLogs: &bespb.BuildToolLogs{
+			Log: []*bespb.File{
+				{Name: "elapsed time", File: &bespb.File_Contents{Contents: []byte("194.070000")}},
+				{Name: "critical path", File: &bespb.File_Contents{Contents: []byte("Critical Path: 190.12s\n")}},
+			},
+		}},
+	}, &bespb.BuildEvent{
+		Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_TestSummary{TestSummary: &bespb.BuildEventId_TestSummaryId{Label: "//slow:test"}}},
+		Payload: &bespb.BuildEvent_TestSummary{TestSummary: &bespb.TestSummary{
+			TotalRunDuration: durationpb.New(3 * time.Second),
+		}},
+	})
+
+	got := timingsFromBuildEvents(events)
+	assert.Equal(t, 194070*time.Millisecond, got.wall)
+	assert.Equal(t, 3870*time.Millisecond, got.cpu)
+	assert.Equal(t, 46*time.Millisecond, got.analysis)
+	assert.Equal(t, "Critical Path: 190.12s", got.criticalPath)
+	assert.Equal(t, []duration{
+		{name: "//slow:test", duration: 3 * time.Second},
+		{name: "//lib/config/marshal:marshal_test", duration: 140 * time.Millisecond},
+		{name: "//lib/config/remote:remote_test", duration: 114 * time.Millisecond},
+		{name: "//lib/config:config_test", duration: 109 * time.Millisecond},
+		{name: "//lib/config/directory:directory_test", duration: 20 * time.Millisecond},
+	}, got.tests)
+	require.Len(t, got.mnemonics, 5)
+	assert.Equal(t, duration{name: "GoCompilePkg", duration: 189744 * time.Millisecond}, got.mnemonics[0])
+
+	var out bytes.Buffer
+	got.Print(&out, 2)
+	assert.Equal(t, `Wall time: 3m14.07s, CPU time: 3.87s, analysis phase: 46ms
+
+Critical Path: 190.12s
+
+Slowest tests:
+        3s //slow:test
+     140ms //lib/config/marshal:marshal_test
+
+Slowest action types (first start to last end):
+  3m9.744s GoCompilePkg
+   3m7.93s GoLink
+
+`, out.String())
+}
+
+func TestTargetsFromProfile(t *testing.T) {
+	profile := `{"otherData":{},"traceEvents":[
+{"cat":"action processing","name":"Compiling a.go","ph":"X","dur":1500000,"args":{"target":"//a:a","mnemonic":"GoCompilePkg"}},
+{"cat":"remote action execution","name":"Compiling a.go","ph":"X","dur":1400000,"args":{"target":"//a:a"}},
+{"cat":"action processing","name":"Linking a","ph":"X","dur":500000,"args":{"target":"//a:a","mnemonic":"GoLink"}},
+{"cat":"action processing","name":"Compiling b.go","ph":"X","dur":3000000,"args":{"target":"//b:b"}},
+{"cat":"general information","name":"Build","ph":"X","dur":9000000}
+]}`
+	want := []duration{
+		{name: "//b:b", duration: 3 * time.Second},
+		{name: "//a:a", duration: 2 * time.Second},
+	}
+
+	got, err := targetsFromProfile(strings.NewReader(profile))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write([]byte(profile))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	got, err = targetsFromProfile(&compressed)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = targetsFromProfile(strings.NewReader("not json"))
+	assert.Error(t, err)
+
+	var out bytes.Buffer
+	(&timings{targets: got}).Print(&out, 1)
+	assert.Equal(t, `Wall time: 0s, CPU time: 0s, analysis phase: 0s
+
+Slowest targets (sum of action time):
+        3s //b:b
+
+`, out.String())
+}
+
+func TestTimingsFindsProfile(t *testing.T) {
+	got := timingsFromBuildEvents([]*bespb.BuildEvent{{
+		Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_BuildToolLogs{BuildToolLogs: &bespb.BuildEventId_BuildToolLogsId{}}},
+		Payload: &bespb.BuildEvent_BuildToolLogs{BuildToolLogs: &bespb.BuildToolLogs{
+			Log: []*bespb.File{
+				{Name: "command.profile.gz", File: &bespb.File_Uri{Uri: "file:///tmp/output_base/command.profile.gz"}},
+			},
+		}},
+	}})
+	assert.Equal(t, "/tmp/output_base/command.profile.gz", got.profile)
+
+	// Profiles uploaded to a remote cache are not downloaded.
+	got = timingsFromBuildEvents([]*bespb.BuildEvent{{
+		Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_BuildToolLogs{BuildToolLogs: &bespb.BuildEventId_BuildToolLogsId{}}},
+		Payload: &bespb.BuildEvent_BuildToolLogs{BuildToolLogs: &bespb.BuildToolLogs{
+			Log: []*bespb.File{
+				{Name: "command.profile.gz", File: &bespb.File_Uri{Uri: "bytestream://cache.example.com/blobs/abc/12"}},
+			},
+		}},
+	}})
+	assert.Empty(t, got.profile)
+}
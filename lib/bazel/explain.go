@@ -0,0 +1,269 @@
+package bazel
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ChangeReason describes why the hash of a target changed between two
+// points in time.
+type ChangeReason int
+
+const (
+	// The contents of a source file changed.
+	ReasonSourceFile ChangeReason = iota
+	// One or more attributes of a rule, as written in a BUILD file or
+	// generated by a macro, changed.
+	ReasonAttribute
+	// The direct dependencies of a rule were added, removed or reordered.
+	ReasonDependencies
+	// The target did not exist at the start point.
+	ReasonNewTarget
+	// An external repository changed, for example because its version or
+	// checksum changed.
+	ReasonExternalRepository
+	// A toolchain, or a file or repository it depends on, changed.
+	ReasonToolchain
+)
+
+func (r ChangeReason) String() string {
+	switch r {
+	case ReasonSourceFile:
+		return "source file changed"
+	case ReasonAttribute:
+		return "BUILD attributes changed"
+	case ReasonDependencies:
+		return "dependencies changed"
+	case ReasonNewTarget:
+		return "new target"
+	case ReasonExternalRepository:
+		return "external repository changed"
+	case ReasonToolchain:
+		return "toolchain changed"
+	}
+	return fmt.Sprintf("ChangeReason(%d)", int(r))
+}
+
+// ChangeCause is a target whose own hash changed, causing the hash of the
+// explained target to change.
+type ChangeCause struct {
+	// Name of the target that changed.
+	Target string
+	Reason ChangeReason
+	// Human readable details about the change, like the name of the
+	// attributes or of the dependencies that changed.
+	Details []string
+	// Dependency path from the explained target to Target, both included.
+	Path []string
+}
+
+// Explanation describes why a target is considered affected.
+type Explanation struct {
+	// Name of the target explained.
+	Target string
+	// True if the hash of the target changed between start and end.
+	Affected bool
+	// Changed inputs causing the target to be affected, sorted by name.
+	Causes []*ChangeCause
+}
+
+// Explain reports why the target with the supplied name is, or is not,
+// affected between the start and end query results.
+//
+// It walks the dependency graph of the end point, following only the
+// dependencies whose hash changed, down to the targets whose own
+// attributes, contents or dependency list changed.
+func Explain(startResults, endResults *QueryResult, name string) (*Explanation, error) {
+	startHashes, err := startResults.TargetHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate target hashes for start point: %w", err)
+	}
+	endHashes, err := endResults.TargetHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate target hashes for end point: %w", err)
+	}
+
+	root, found := endResults.Targets[name]
+	if !found {
+		return nil, fmt.Errorf("target %q does not exist at the end point", name)
+	}
+
+	explanation := &Explanation{Target: name}
+	if hash, found := startHashes[name]; found && hash == endHashes[name] {
+		return explanation, nil
+	}
+	explanation.Affected = true
+
+	// Breadth first, so that the path reported for each cause is the shortest.
+	parent := map[string]string{name: ""}
+	queue := []*Target{root}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if cause := changeCause(startResults.Targets[current.Name()], current); cause != nil {
+			cause.Path = pathTo(parent, current.Name())
+			classifyToolchain(cause, endResults.Targets)
+			explanation.Causes = append(explanation.Causes, cause)
+		}
+
+		for _, dep := range current.deps {
+			if _, seen := parent[dep.Name()]; seen {
+				continue
+			}
+			if hash, found := startHashes[dep.Name()]; found && hash == endHashes[dep.Name()] {
+				continue
+			}
+			parent[dep.Name()] = current.Name()
+			queue = append(queue, dep)
+		}
+	}
+
+	sort.Slice(explanation.Causes, func(i, j int) bool {
+		return explanation.Causes[i].Target < explanation.Causes[j].Target
+	})
+	return explanation, nil
+}
+
+// changeCause returns why the end target changed compared to the start
+// target, ignoring changes to its dependencies' hashes, or nil if it did not.
+func changeCause(start, end *Target) *ChangeCause {
+	cause := &ChangeCause{Target: end.Name()}
+	external := isExternalName(end.Name())
+
+	switch {
+	case start == nil:
+		cause.Reason = ReasonNewTarget
+		if external {
+			cause.Reason = ReasonExternalRepository
+			cause.Details = []string{"repository @" + repositoryName(end.Name())}
+		}
+		return cause
+
+	case start.shallowHash != end.shallowHash:
+		switch {
+		case external:
+			cause.Reason = ReasonExternalRepository
+			cause.Details = []string{"repository @" + repositoryName(end.Name())}
+		case end.ruleType == "":
+			cause.Reason = ReasonSourceFile
+		default:
+			cause.Reason = ReasonAttribute
+			cause.Details = diffAttrs(start.attrHashes, end.attrHashes)
+		}
+		return cause
+
+	case !slices.Equal(start.depNames, end.depNames):
+		cause.Reason = ReasonDependencies
+		cause.Details = diffDeps(start.depNames, end.depNames)
+		return cause
+	}
+	return nil
+}
+
+// classifyToolchain marks a cause as a toolchain change if the dependency
+// path from the explained target goes through a toolchain.
+func classifyToolchain(cause *ChangeCause, targets map[string]*Target) {
+	// Skip the explained target itself: explaining a toolchain should still
+	// report which of its inputs changed.
+	for _, name := range cause.Path[1:] {
+		if !isToolchain(targets[name]) {
+			continue
+		}
+		cause.Details = append(cause.Details, fmt.Sprintf("%s (via toolchain %s)", cause.Reason, name))
+		cause.Reason = ReasonToolchain
+		return
+	}
+}
+
+// isToolchain returns true if the target defines or configures a toolchain.
+func isToolchain(t *Target) bool {
+	if t == nil {
+		return false
+	}
+	if strings.Contains(t.ruleType, "toolchain") {
+		return true
+	}
+	return strings.HasPrefix(repositoryName(t.Name()), "local_config_")
+}
+
+func pathTo(parent map[string]string, name string) []string {
+	var path []string
+	for ; name != ""; name = parent[name] {
+		path = append(path, name)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+func isExternalName(name string) bool {
+	lbl, err := labelFromString(name)
+	return err == nil && lbl.isExternal()
+}
+
+func repositoryName(name string) string {
+	lbl, err := labelFromString(name)
+	if err != nil {
+		return ""
+	}
+	if lbl.Workspace == "" && lbl.Package == "external" {
+		return lbl.Rule
+	}
+	return lbl.WorkspaceName()
+}
+
+// diffAttrs returns a description of the attributes that were added, removed
+// or modified.
+func diffAttrs(start, end []attrHash) []string {
+	before := map[string]uint32{}
+	for _, attr := range start {
+		before[attr.name] = attr.hash
+	}
+
+	var changes []string
+	for _, attr := range end {
+		hash, found := before[attr.name]
+		delete(before, attr.name)
+		switch {
+		case !found:
+			changes = append(changes, "added attribute "+attr.name)
+		case hash != attr.hash:
+			changes = append(changes, "modified attribute "+attr.name)
+		}
+	}
+	for name := range before {
+		changes = append(changes, "removed attribute "+name)
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// diffDeps returns a description of the dependencies that were added or
+// removed.
+func diffDeps(start, end []string) []string {
+	before := map[string]struct{}{}
+	for _, dep := range start {
+		before[dep] = struct{}{}
+	}
+
+	var changes []string
+	for _, dep := range end {
+		if _, found := before[dep]; found {
+			delete(before, dep)
+			continue
+		}
+		changes = append(changes, "added dependency "+dep)
+	}
+	for dep := range before {
+		changes = append(changes, "removed dependency "+dep)
+	}
+	if len(changes) == 0 {
+		return []string{"dependencies reordered"}
+	}
+	sort.Strings(changes)
+	return changes
+}
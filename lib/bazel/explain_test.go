@@ -0,0 +1,222 @@
+package bazel
+
+import (
+	"testing"
+
+	bpb "github.com/ccontavalli/enkit/lib/bazel/proto"
+	"github.com/ccontavalli/enkit/lib/errdiff"
+	"github.com/ccontavalli/enkit/lib/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func ruleTarget(name, class string, deps []string, attrs ...*bpb.Attribute) *bpb.Target {
+	return &bpb.Target{
+		Type: bpb.Target_RULE.Enum(),
+		Rule: &bpb.Rule{
+			Name:      proto.String(name),
+			RuleClass: proto.String(class),
+			RuleInput: deps,
+			Attribute: attrs,
+		},
+	}
+}
+
+func sourceTarget(name string) *bpb.Target {
+	return &bpb.Target{
+		Type:       bpb.Target_SOURCE_FILE.Enum(),
+		SourceFile: &bpb.SourceFile{Name: proto.String(name)},
+	}
+}
+
+func stringAttr(name, value string) *bpb.Attribute {
+	return &bpb.Attribute{
+		Name:        proto.String(name),
+		Type:        bpb.Attribute_STRING.Enum(),
+		StringValue: proto.String(value),
+	}
+}
+
+// queryResult builds a QueryResult from the supplied targets, reading source
+// files from files.
+func queryResult(t *testing.T, files map[string]string, targets ...*bpb.Target) *QueryResult {
+	t.Helper()
+	contents := map[string][]byte{}
+	for name, content := range files {
+		contents[name] = []byte(content)
+	}
+	w := &Workspace{sourceFS: testutil.NewFS(t, contents)}
+	events := &WorkspaceEvents{WorkspaceHashes: map[string]uint32{"com_example": 1, "local_config_cc": 1}}
+
+	result := &QueryResult{Targets: map[string]*Target{}, workspace: w}
+	for _, target := range targets {
+		newTarget, err := NewTarget(w, target, events)
+		if err != nil {
+			t.Fatalf("failed to create target: %v", err)
+		}
+		result.Targets[newTarget.Name()] = newTarget
+	}
+	return result
+}
+
+func TestExplain(t *testing.T) {
+	files := map[string]string{
+		"app/main.go": "package main",
+		"lib/lib.go":  "package lib",
+	}
+	modified := map[string]string{
+		"app/main.go": "package main",
+		"lib/lib.go":  "package lib // modified",
+	}
+	start := queryResult(t, files,
+		ruleTarget("//app:app", "go_binary", []string{"//app:main.go", "//lib:lib"}),
+		sourceTarget("//app:main.go"),
+		ruleTarget("//lib:lib", "go_library", []string{"//lib:lib.go"}, stringAttr("importpath", "example.com/lib")),
+		sourceTarget("//lib:lib.go"),
+		ruleTarget("//app:app_test", "go_test", []string{"//app:app", "@local_config_cc//:toolchain"}),
+		ruleTarget("@local_config_cc//:toolchain", "cc_toolchain", nil),
+		ruleTarget("//app:tool", "go_binary", []string{"@com_example//:dep"}),
+		ruleTarget("@com_example//:dep", "go_library", nil),
+	)
+
+	testCases := []struct {
+		desc    string
+		end     *QueryResult
+		target  string
+		want    *Explanation
+		wantErr string
+	}{
+		{
+			desc:   "unchanged",
+			end:    start,
+			target: "//app:app",
+			want:   &Explanation{Target: "//app:app"},
+		},
+		{
+			desc: "source file",
+			end: queryResult(t, modified,
+				ruleTarget("//app:app", "go_binary", []string{"//app:main.go", "//lib:lib"}),
+				sourceTarget("//app:main.go"),
+				ruleTarget("//lib:lib", "go_library", []string{"//lib:lib.go"}, stringAttr("importpath", "example.com/lib")),
+				sourceTarget("//lib:lib.go"),
+			),
+			target: "//app:app",
+			want: &Explanation{
+				Target:   "//app:app",
+				Affected: true,
+				Causes: []*ChangeCause{{
+					Target: "//lib:lib.go",
+					Reason: ReasonSourceFile,
+					Path:   []string{"//app:app", "//lib:lib", "//lib:lib.go"},
+				}},
+			},
+		},
+		{
+			desc: "attribute and dependencies",
+			end: queryResult(t, files,
+				ruleTarget("//app:app", "go_binary", []string{"//app:main.go"}),
+				sourceTarget("//app:main.go"),
+				ruleTarget("//lib:lib", "go_library", []string{"//lib:lib.go"}, stringAttr("importpath", "example.com/lib/v2")),
+				sourceTarget("//lib:lib.go"),
+				ruleTarget("//app:app_test", "go_test", []string{"//app:app", "//lib:lib", "@local_config_cc//:toolchain"}),
+				ruleTarget("@local_config_cc//:toolchain", "cc_toolchain", nil),
+			),
+			target: "//app:app_test",
+			want: &Explanation{
+				Target:   "//app:app_test",
+				Affected: true,
+				Causes: []*ChangeCause{
+					{
+						Target:  "//app:app",
+						Reason:  ReasonDependencies,
+						Details: []string{"removed dependency //lib:lib"},
+						Path:    []string{"//app:app_test", "//app:app"},
+					},
+					{
+						Target:  "//app:app_test",
+						Reason:  ReasonDependencies,
+						Details: []string{"added dependency //lib:lib"},
+						Path:    []string{"//app:app_test"},
+					},
+					{
+						Target:  "//lib:lib",
+						Reason:  ReasonAttribute,
+						Details: []string{"modified attribute importpath"},
+						Path:    []string{"//app:app_test", "//lib:lib"},
+					},
+				},
+			},
+		},
+		{
+			desc: "toolchain",
+			end: queryResult(t, files,
+				ruleTarget("//app:app", "go_binary", []string{"//app:main.go", "//lib:lib"}),
+				sourceTarget("//app:main.go"),
+				ruleTarget("//lib:lib", "go_library", []string{"//lib:lib.go"}, stringAttr("importpath", "example.com/lib")),
+				sourceTarget("//lib:lib.go"),
+				ruleTarget("//app:app_test", "go_test", []string{"//app:app", "@local_config_cc//:toolchain"}),
+				ruleTarget("@local_config_cc//:toolchain", "cc_toolchain", []string{"@local_config_cc//:gcc"}),
+				ruleTarget("@local_config_cc//:gcc", "filegroup", nil),
+			),
+			target: "//app:app_test",
+			want: &Explanation{
+				Target:   "//app:app_test",
+				Affected: true,
+				Causes: []*ChangeCause{
+					{
+						Target:  "@local_config_cc//:gcc",
+						Reason:  ReasonToolchain,
+						Details: []string{"repository @local_config_cc", "external repository changed (via toolchain @local_config_cc//:toolchain)"},
+						Path:    []string{"//app:app_test", "@local_config_cc//:toolchain", "@local_config_cc//:gcc"},
+					},
+					{
+						Target:  "@local_config_cc//:toolchain",
+						Reason:  ReasonToolchain,
+						Details: []string{"added dependency @local_config_cc//:gcc", "dependencies changed (via toolchain @local_config_cc//:toolchain)"},
+						Path:    []string{"//app:app_test", "@local_config_cc//:toolchain"},
+					},
+				},
+			},
+		},
+		{
+			desc: "external repository",
+			end: func() *QueryResult {
+				end := queryResult(t, files,
+					ruleTarget("//app:tool", "go_binary", []string{"@com_example//:dep"}),
+					ruleTarget("@com_example//:dep", "go_library", nil),
+				)
+				end.Targets["@com_example//:dep"].shallowHash++
+				return end
+			}(),
+			target: "//app:tool",
+			want: &Explanation{
+				Target:   "//app:tool",
+				Affected: true,
+				Causes: []*ChangeCause{{
+					Target:  "@com_example//:dep",
+					Reason:  ReasonExternalRepository,
+					Details: []string{"repository @com_example"},
+					Path:    []string{"//app:tool", "@com_example//:dep"},
+				}},
+			},
+		},
+		{
+			desc:    "missing target",
+			end:     start,
+			target:  "//app:missing",
+			wantErr: "does not exist",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := Explain(start, tc.end, tc.target)
+			errdiff.Check(t, err, tc.wantErr)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package bazel
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ModuleLockFile is the name of the lockfile bazel generates next to
+// MODULE.bazel when Bzlmod is enabled.
+const ModuleLockFile = "MODULE.bazel.lock"
+
+// Separator between the components of a canonical repository name: `~` up
+// to bazel 7, `+` starting with bazel 8.
+var reRepoNameSeparator = regexp.MustCompile(`[~+]`)
+
+// moduleLock contains the subset of MODULE.bazel.lock used to detect
+// changes to external repositories.
+//
+// The format of the lockfile changed significantly across bazel releases:
+// up to lockFileVersion 10, the resolved module graph is stored, including
+// the repo spec of each module; later versions only store the hashes of the
+// registry files consulted during resolution.
+type moduleLock struct {
+	LockFileVersion    int                        `json:"lockFileVersion"`
+	RegistryFileHashes map[string]json.RawMessage `json:"registryFileHashes"`
+	ModuleDepGraph     map[string]struct {
+		Name     string          `json:"name"`
+		RepoSpec json.RawMessage `json:"repoSpec"`
+	} `json:"moduleDepGraph"`
+	// Extension ID -> evaluation factors (like "general", or "os:linux") -> results.
+	ModuleExtensions map[string]map[string]struct {
+		BzlTransitiveDigest string                     `json:"bzlTransitiveDigest"`
+		GeneratedRepoSpecs  map[string]json.RawMessage `json:"generatedRepoSpecs"`
+	} `json:"moduleExtensions"`
+}
+
+// ParseModuleLock computes the hashes of the external repositories declared
+// with Bzlmod from the content of a MODULE.bazel.lock file.
+//
+// Hashes are keyed by moduleRepoKey, so that they can be looked up by
+// canonical repository name independently of the bazel version in use.
+//
+// Repositories of modules are hashed based on the registry files or repo
+// specs recorded for them, so that bumping a bazel_dep changes only the hash
+// of the bumped module. Repositories generated by module extensions are
+// hashed based on their repo spec and on the digest of the extension code,
+// so that changing an entry in a go.mod file changes only the hash of the
+// corresponding go_repository.
+//
+// Module extensions marked as reproducible are not recorded in the lockfile,
+// their repositories must be hashed by other means.
+func ParseModuleLock(r io.Reader) (map[string]uint32, error) {
+	var lock moduleLock
+	if err := json.NewDecoder(r).Decode(&lock); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ModuleLockFile, err)
+	}
+
+	// Sorted "key=value" entries to hash for each repository.
+	entries := map[string][]string{}
+
+	for _, module := range lock.ModuleDepGraph {
+		if module.Name == "" || len(module.RepoSpec) == 0 || string(module.RepoSpec) == "null" {
+			continue
+		}
+		spec, err := canonicalJSON(module.RepoSpec)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", module.Name, err)
+		}
+		key := moduleRepoKey(module.Name)
+		entries[key] = append(entries[key], spec)
+	}
+
+	// Only the source.json files of the selected module versions matter,
+	// but some registries have no source.json. Fall back to the MODULE.bazel
+	// files, which also include versions considered but not selected.
+	sources := map[string][]string{}
+	modules := map[string][]string{}
+	for url, hash := range lock.RegistryFileHashes {
+		parts := strings.Split(url, "/")
+		if len(parts) < 4 || parts[len(parts)-4] != "modules" {
+			continue
+		}
+		key := moduleRepoKey(parts[len(parts)-3])
+		entry := url + "=" + string(hash)
+		switch parts[len(parts)-1] {
+		case "source.json":
+			sources[key] = append(sources[key], entry)
+		case "MODULE.bazel":
+			modules[key] = append(modules[key], entry)
+		}
+	}
+	for key, files := range modules {
+		if _, found := sources[key]; !found {
+			entries[key] = append(entries[key], files...)
+		}
+	}
+	for key, files := range sources {
+		entries[key] = append(entries[key], files...)
+	}
+
+	for id, factors := range lock.ModuleExtensions {
+		module, extension := parseExtensionID(id)
+		for factor, result := range factors {
+			for repo, spec := range result.GeneratedRepoSpecs {
+				canonical, err := canonicalJSON(spec)
+				if err != nil {
+					return nil, fmt.Errorf("extension %s, repository %s: %w", id, repo, err)
+				}
+				key := module + "/" + extension + "/" + repo
+				entries[key] = append(entries[key], factor+"="+result.BzlTransitiveDigest+"="+canonical)
+			}
+		}
+	}
+
+	hashes := map[string]uint32{}
+	for key, values := range entries {
+		sort.Strings(values)
+		h := fnv.New32()
+		for _, value := range values {
+			fmt.Fprint(h, value)
+		}
+		hashes[key] = h.Sum32()
+	}
+	return hashes, nil
+}
+
+// ParseModuleLock computes the hashes of the Bzlmod repositories from the
+// MODULE.bazel.lock file in the workspace.
+//
+// Returns nil, nil if the workspace has no lockfile.
+func (w *Workspace) ParseModuleLock() (map[string]uint32, error) {
+	f, err := w.OpenSource(ModuleLockFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return ParseModuleLock(f)
+}
+
+// moduleRepoKey returns a key identifying a repository declared with Bzlmod
+// from its canonical name, independently of the bazel version that
+// generated it.
+//
+// For example, rules_go~0.41.0 (bazel 7.0), rules_go~ (bazel 7.1) and
+// rules_go+ (bazel 8) all return "rules_go", while
+// gazelle~~go_deps~com_github_pkg_errors and
+// gazelle++go_deps+com_github_pkg_errors both return
+// "gazelle/go_deps/com_github_pkg_errors".
+//
+// Returns the empty string if name is not a valid canonical name.
+func moduleRepoKey(name string) string {
+	parts := reRepoNameSeparator.Split(strings.TrimLeft(name, "@"), -1)
+	switch len(parts) {
+	case 1, 2:
+		// A module, or a repository defined in WORKSPACE.
+		return parts[0]
+	case 3:
+		// A repository generated by an extension used by the root module.
+		return rootModuleName(parts[0]) + "/" + parts[1] + "/" + parts[2]
+	case 4:
+		// A repository generated by an extension used by another module.
+		return parts[0] + "/" + parts[2] + "/" + parts[3]
+	}
+	return ""
+}
+
+// parseExtensionID returns the name of the module defining the extension,
+// and the name of the extension, from an extension ID in the lockfile, like
+// "@@gazelle~//:extensions.bzl%go_deps".
+func parseExtensionID(id string) (string, string) {
+	repo, rest, _ := strings.Cut(id, "//")
+	_, extension, _ := strings.Cut(rest, "%")
+	extension, _, _ = strings.Cut(extension, "%")
+
+	module := reRepoNameSeparator.Split(strings.TrimLeft(repo, "@"), -1)[0]
+	return rootModuleName(module), extension
+}
+
+// rootModuleName returns a consistent name for the root module, which has
+// an empty canonical name starting with bazel 8, and _main before.
+func rootModuleName(name string) string {
+	if name == "" {
+		return "_main"
+	}
+	return name
+}
+
+// canonicalJSON re-encodes a JSON value with sorted object keys, so it can be
+// hashed consistently.
+func canonicalJSON(raw json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,174 @@
+package bazel
+
+import (
+	"strings"
+	"testing"
+
+	bpb "github.com/ccontavalli/enkit/lib/bazel/proto"
+	"github.com/ccontavalli/enkit/lib/errdiff"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Lockfile as generated by bazel 8, with versions and sums supplied by the
+// test.
+func modernLock(rulesGoVersion, errorsSum string) string {
+	return `{
+  "lockFileVersion": 13,
+  "registryFileHashes": {
+    "https://bcr.bazel.build/bazel_registry.json": "8a28e4af",
+    "https://bcr.bazel.build/modules/gazelle/0.35.0/MODULE.bazel": "5346c8ef",
+    "https://bcr.bazel.build/modules/gazelle/0.35.0/source.json": "baf2a039",
+    "https://bcr.bazel.build/modules/rules_go/0.41.0/MODULE.bazel": "3478bb1c",
+    "https://bcr.bazel.build/modules/rules_go/` + rulesGoVersion + `/MODULE.bazel": "fc9e1a3b",
+    "https://bcr.bazel.build/modules/rules_go/` + rulesGoVersion + `/source.json": "` + rulesGoVersion + `"
+  },
+  "selectedYankedVersions": {},
+  "moduleExtensions": {
+    "@@gazelle+//:extensions.bzl%go_deps": {
+      "general": {
+        "bzlTransitiveDigest": "J3nqZ1",
+        "usagesDigest": "` + errorsSum + `",
+        "recordedFileInputs": {"@@//:go.mod": "` + errorsSum + `"},
+        "generatedRepoSpecs": {
+          "com_github_pkg_errors": {
+            "repoRuleId": "@@gazelle+//internal:go_repository.bzl%go_repository",
+            "attributes": {"importpath": "github.com/pkg/errors", "sum": "` + errorsSum + `", "version": "v0.9.1"}
+          },
+          "org_golang_x_sync": {
+            "repoRuleId": "@@gazelle+//internal:go_repository.bzl%go_repository",
+            "attributes": {"version": "v0.6.0", "importpath": "golang.org/x/sync", "sum": "h1:5BMeUDZ"}
+          }
+        }
+      }
+    },
+    "//:extensions.bzl%tools": {
+      "os:linux,arch:amd64": {
+        "bzlTransitiveDigest": "aGVsbG8",
+        "generatedRepoSpecs": {
+          "toolchain": {"bzlFile": "@@//:tools.bzl", "ruleClassName": "tool", "attributes": {"version": "1.0"}}
+        }
+      }
+    }
+  }
+}`
+}
+
+// Lockfile as generated by bazel 7.0, recording the module dependency graph.
+const legacyLock = `{
+  "lockFileVersion": 3,
+  "moduleFileHash": "0e3e315145ac7ee7a4e0ac825e1c5e03c068ec1254dd42c3caaecb27e921dc4d",
+  "moduleDepGraph": {
+    "<root>": {"name": "", "version": "", "key": "<root>", "repoName": ""},
+    "rules_go@0.41.0": {
+      "name": "rules_go",
+      "version": "0.41.0",
+      "repoSpec": {
+        "bzlFile": "@bazel_tools//tools/build_defs/repo:http.bzl",
+        "ruleClassName": "http_archive",
+        "attributes": {"name": "rules_go~0.41.0", "urls": ["https://github.com/bazelbuild/rules_go/releases/download/v0.41.0/rules_go-v0.41.0.zip"], "integrity": "sha256-MY="}
+      }
+    }
+  },
+  "moduleExtensions": {
+    "@@gazelle~0.35.0//:extensions.bzl%go_deps": {
+      "general": {
+        "bzlTransitiveDigest": "J3nqZ1",
+        "generatedRepoSpecs": {
+          "com_github_pkg_errors": {"bzlFile": "@@gazelle~0.35.0//internal:go_repository.bzl", "ruleClassName": "go_repository", "attributes": {"name": "gazelle~0.35.0~go_deps~com_github_pkg_errors", "sum": "h1:FEBLx1z"}}
+        }
+      }
+    }
+  }
+}`
+
+func TestModuleRepoKey(t *testing.T) {
+	for name, want := range map[string]string{
+		"rules_go~0.41.0":     "rules_go",
+		"rules_go~":           "rules_go",
+		"@@rules_go+":         "rules_go",
+		"com_google_protobuf": "com_google_protobuf",
+		"gazelle~0.35.0~go_deps~org_golang_x_net": "gazelle/go_deps/org_golang_x_net",
+		"gazelle~~go_deps~org_golang_x_net":       "gazelle/go_deps/org_golang_x_net",
+		"gazelle++go_deps+org_golang_x_net":       "gazelle/go_deps/org_golang_x_net",
+		"_main~tools~toolchain":                   "_main/tools/toolchain",
+		"+tools+toolchain":                        "_main/tools/toolchain",
+		"a+b+c+d+e":                               "",
+	} {
+		assert.Equal(t, want, moduleRepoKey(name), name)
+	}
+}
+
+func TestParseModuleLock(t *testing.T) {
+	base, err := ParseModuleLock(strings.NewReader(modernLock("0.50.1", "h1:FEBLx1z")))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"gazelle",
+		"rules_go",
+		"gazelle/go_deps/com_github_pkg_errors",
+		"gazelle/go_deps/org_golang_x_sync",
+		"_main/tools/toolchain",
+	}, keys(base))
+
+	// Bumping a bazel_dep changes only the hash of the module.
+	bumped, err := ParseModuleLock(strings.NewReader(modernLock("0.51.0", "h1:FEBLx1z")))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"rules_go"}, changedKeys(base, bumped))
+
+	// Changing a go.mod entry changes only the hash of its repository.
+	gomod, err := ParseModuleLock(strings.NewReader(modernLock("0.50.1", "h1:Z8mEnnx")))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"gazelle/go_deps/com_github_pkg_errors"}, changedKeys(base, gomod))
+
+	legacy, err := ParseModuleLock(strings.NewReader(legacyLock))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"rules_go", "gazelle/go_deps/com_github_pkg_errors"}, keys(legacy))
+
+	_, err = ParseModuleLock(strings.NewReader("{"))
+	errdiff.Check(t, err, "failed to parse MODULE.bazel.lock")
+}
+
+func TestModuleLockAffectedTargets(t *testing.T) {
+	query := func(lock string) *QueryResult {
+		hashes, err := ParseModuleLock(strings.NewReader(lock))
+		require.NoError(t, err)
+		events := &WorkspaceEvents{ModuleHashes: hashes}
+
+		w := testWorkspace(t)
+		result := &QueryResult{Targets: map[string]*Target{}, workspace: w}
+		for _, target := range []*bpb.Target{
+			ruleTarget("//app:errors", "go_library", []string{"@@gazelle++go_deps+com_github_pkg_errors//:errors"}),
+			ruleTarget("//app:sync", "go_library", []string{"@@gazelle++go_deps+org_golang_x_sync//errgroup:errgroup"}),
+			ruleTarget("@@gazelle++go_deps+com_github_pkg_errors//:errors", "go_library", nil),
+			ruleTarget("@@gazelle++go_deps+org_golang_x_sync//errgroup:errgroup", "go_library", nil),
+		} {
+			newTarget, err := NewTarget(w, target, events)
+			require.NoError(t, err)
+			result.Targets[newTarget.Name()] = newTarget
+		}
+		return result
+	}
+
+	got, err := calculateAffected(query(modernLock("0.50.1", "h1:FEBLx1z")), query(modernLock("0.50.1", "h1:Z8mEnnx")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"//app:errors", "@@gazelle++go_deps+com_github_pkg_errors//:errors"}, got)
+}
+
+func keys(m map[string]uint32) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func changedKeys(before, after map[string]uint32) []string {
+	var changed []string
+	for k, v := range after {
+		if before[k] != v {
+			changed = append(changed, k)
+		}
+	}
+	return changed
+}
@@ -71,6 +71,18 @@ func (w *Workspace) Query(query string, options ...QueryOption) (*QueryResult, e
 		}
 	}
 
+	// Read the lockfile after running the query, as bazel updates it.
+	moduleHashes, err := w.ParseModuleLock()
+	if err != nil {
+		return nil, err
+	}
+	if moduleHashes != nil {
+		if workspaceEvents == nil {
+			workspaceEvents = &WorkspaceEvents{}
+		}
+		workspaceEvents.ModuleHashes = moduleHashes
+	}
+
 	stdout, err := cmd.Stdout()
 	if err != nil {
 		return nil, fmt.Errorf("failed to open query stdout: %w", err)
@@ -35,6 +35,9 @@ type Target struct {
 	// Memoized hash of this target, including transitive target hashes. If nil,
 	// the hash is not computed yet; use getHash() to fetch a computed hash.
 	hash *uint32
+	// Hash of each attribute of a rule, sorted by name; used to explain why
+	// shallowHash changed.
+	attrHashes []attrHash
 	// Target names of the direct dependencies for this target
 	depNames []string
 	// If this target is a rule with dependencies, direct dependency node pointers
@@ -42,6 +45,12 @@ type Target struct {
 	deps []*Target
 }
 
+// attrHash is the hash of the value of a single rule attribute.
+type attrHash struct {
+	name string
+	hash uint32
+}
+
 type TargetHashes map[string]uint32
 
 func ConstructTarget(w *Workspace, t *bpb.Target) (*Target, error) {
@@ -55,6 +64,7 @@ func ConstructTarget(w *Workspace, t *bpb.Target) (*Target, error) {
 		ruleType:    extractRuleType(t),
 		tags:        extractTags(t),
 		shallowHash: shallow,
+		attrHashes:  extractAttrHashes(t),
 		depNames:    extractDepNames(t),
 	}, nil
 }
@@ -83,7 +93,7 @@ func NewTarget(w *Workspace, t *bpb.Target, workspaceEvents *WorkspaceEvents) (*
 // external target. This target only has attributes based on the hashes used
 // during download of the external repository, to save time on hashing
 // third-party files that are unlikely to change often. These hashes are fetched
-// from the supplied set of workspace events.
+// from the supplied set of workspace events, and from MODULE.bazel.lock.
 func NewExternalPseudoTarget(w *Workspace, t *bpb.Target, workspaceEvents *WorkspaceEvents) (*Target, error) {
 	nameCopy := extractName(t)
 	lbl, err := labelFromString(nameCopy)
@@ -94,8 +104,7 @@ func NewExternalPseudoTarget(w *Workspace, t *bpb.Target, workspaceEvents *Works
 		return nil, fmt.Errorf("target %q is not external", nameCopy)
 	}
 
-	workspaceName := lbl.WorkspaceName()
-	hash, hashExist := workspaceEvents.WorkspaceHashes[workspaceName]
+	hash, hashExist := workspaceEvents.RepositoryHash(lbl.WorkspaceName())
 	if !hashExist {
 		return nil, nil
 	}
@@ -209,6 +218,7 @@ func (t *Target) RuleType() string {
 // ResolveDeps resolves each target name to the actual target object using the
 // supplied mapping.
 func (t *Target) ResolveDeps(others map[string]*Target) error {
+	t.deps = nil
 	for _, dep := range t.depNames {
 		other, ok := others[dep]
 		if !ok {
@@ -266,6 +276,23 @@ func extractTags(t *bpb.Target) map[string]struct{} {
 	return tags
 }
 
+// extractAttrHashes returns the hash of each attribute of the supplied Target
+// proto message, sorted by attribute name. It must be invoked after
+// shallowHash, which sorts the attributes.
+func extractAttrHashes(t *bpb.Target) []attrHash {
+	var hashes []attrHash
+	for _, attr := range t.GetRule().GetAttribute() {
+		h := fnv.New32()
+		if attr.GetName() != "generator_location" {
+			fmt.Fprint(h, attrValue(attr))
+		} else {
+			fmt.Fprint(h, reIgnoreFilePath.ReplaceAllString(attrValue(attr), ""))
+		}
+		hashes = append(hashes, attrHash{name: attr.GetName(), hash: h.Sum32()})
+	}
+	return hashes
+}
+
 // extractTags returns the set of dependencies present on supplied Target proto
 // message, by stringified label.
 func extractDepNames(t *bpb.Target) []string {
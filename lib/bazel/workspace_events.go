@@ -17,6 +17,27 @@ import (
 
 type WorkspaceEvents struct {
 	WorkspaceHashes map[string]uint32
+	// Hashes of the repositories declared with Bzlmod, keyed by
+	// moduleRepoKey. See ParseModuleLock.
+	ModuleHashes map[string]uint32
+}
+
+// RepositoryHash returns the hash of the external repository with the
+// supplied name, as it appears in labels.
+//
+// Hashes computed from MODULE.bazel.lock take precedence over those computed
+// from the workspace rules log, as the log only contains the repositories
+// fetched by the query.
+func (e *WorkspaceEvents) RepositoryHash(name string) (uint32, bool) {
+	if e == nil {
+		return 0, false
+	}
+	name = strings.TrimLeft(name, "@")
+	if hash, found := e.ModuleHashes[moduleRepoKey(name)]; found {
+		return hash, true
+	}
+	hash, found := e.WorkspaceHashes[name]
+	return hash, found
 }
 
 // extractChecksums returns a sorted list of download hashes from a set of
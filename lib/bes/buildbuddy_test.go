@@ -27,7 +27,7 @@ func newTestHttpClient(t *testing.T, code int, res proto.Message) *testHttpClien
 	}
 	msg, err := proto.Marshal(res)
 	if err != nil {
-		t.Fatalf("failed to marshal proto: %w", err)
+		t.Fatalf("failed to marshal proto: %v", err)
 	}
 	b := bytes.NewBuffer(msg)
 	return &testHttpClient{
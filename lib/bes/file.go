@@ -0,0 +1,93 @@
+package bes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/proto/delimited"
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ReadBinaryEvents reads the build events from a stream in the format
+// generated by bazel with --build_event_binary_file: a sequence of
+// BuildEvent protos, each prefixed by its size as a varint.
+func ReadBinaryEvents(r io.Reader) ([]*bespb.BuildEvent, error) {
+	var events []*bespb.BuildEvent
+
+	rdr := delimited.NewReader(r)
+	for {
+		buf, err := rdr.Next()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event #%d: %w", len(events), err)
+		}
+
+		event := &bespb.BuildEvent{}
+		if err := proto.Unmarshal(buf, event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event #%d: %w", len(events), err)
+		}
+		events = append(events, event)
+	}
+}
+
+// ReadJSONEvents reads the build events from a stream in the format
+// generated by bazel with --build_event_json_file: a sequence of BuildEvent
+// protos, each encoded as a JSON object.
+func ReadJSONEvents(r io.Reader) ([]*bespb.BuildEvent, error) {
+	var events []*bespb.BuildEvent
+
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event #%d: %w", len(events), err)
+		}
+
+		event := &bespb.BuildEvent{}
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(raw, event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event #%d: %w", len(events), err)
+		}
+		events = append(events, event)
+	}
+}
+
+// ReadEventFile reads the build events stored in the file at path.
+//
+// Files with a .json extension are parsed with ReadJSONEvents, any other
+// file with ReadBinaryEvents.
+func ReadEventFile(path string) ([]*bespb.BuildEvent, error) {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return ReadEventFileAs(path, ReadJSONEvents)
+	}
+	return ReadEventFileAs(path, ReadBinaryEvents)
+}
+
+// ReadEventFileAs reads the build events stored in the file at path with
+// read, either ReadJSONEvents or ReadBinaryEvents.
+func ReadEventFileAs(path string, read func(io.Reader) ([]*bespb.BuildEvent, error)) ([]*bespb.BuildEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events, err := read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return events, nil
+}
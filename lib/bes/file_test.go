@@ -0,0 +1,138 @@
+package bes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/errdiff"
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func testEvents() []*bespb.BuildEvent {
+	return []*bespb.BuildEvent{
+		{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_Started{Started: &bespb.BuildEventId_BuildStartedId{}}},
+			Payload: &bespb.BuildEvent_Started{Started: &bespb.BuildStarted{
+				Uuid:    "0f5e6a2c-1d4b-4c4e-9a3f-2b6d7e8f9a0b",
+				Command: "test",
+			}},
+		},
+		{
+			Id: &bespb.BuildEventId{Id: &bespb.BuildEventId_BuildFinished{BuildFinished: &bespb.BuildEventId_BuildFinishedId{}}},
+			Payload: &bespb.BuildEvent_Finished{Finished: &bespb.BuildFinished{
+				OverallSuccess: true,
+			}},
+			LastMessage: true,
+		},
+	}
+}
+
+func encodeBinary(t *testing.T, events []*bespb.BuildEvent) []byte {
+	t.Helper()
+	var out []byte
+	for _, event := range events {
+		msg, err := proto.Marshal(event)
+		require.NoError(t, err)
+		out = binary.AppendUvarint(out, uint64(len(msg)))
+		out = append(out, msg...)
+	}
+	return out
+}
+
+func encodeJSON(t *testing.T, events []*bespb.BuildEvent) []byte {
+	t.Helper()
+	var out []byte
+	for _, event := range events {
+		msg, err := protojson.Marshal(event)
+		require.NoError(t, err)
+		out = append(out, msg...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+func TestReadEvents(t *testing.T) {
+	want := testEvents()
+	binaryData := encodeBinary(t, want)
+
+	testCases := []struct {
+		desc    string
+		read    func([]byte) ([]*bespb.BuildEvent, error)
+		input   []byte
+		want    []*bespb.BuildEvent
+		wantErr string
+	}{
+		{
+			desc:  "binary",
+			read:  func(b []byte) ([]*bespb.BuildEvent, error) { return ReadBinaryEvents(bytes.NewReader(b)) },
+			input: binaryData,
+			want:  want,
+		},
+		{
+			desc:    "truncated binary",
+			read:    func(b []byte) ([]*bespb.BuildEvent, error) { return ReadBinaryEvents(bytes.NewReader(b)) },
+			input:   binaryData[:len(binaryData)-2],
+			wantErr: "failed to read event #1",
+		},
+		{
+			desc:  "json",
+			read:  func(b []byte) ([]*bespb.BuildEvent, error) { return ReadJSONEvents(bytes.NewReader(b)) },
+			input: encodeJSON(t, want),
+			want:  want,
+		},
+		{
+			desc:    "invalid json",
+			read:    func(b []byte) ([]*bespb.BuildEvent, error) { return ReadJSONEvents(bytes.NewReader(b)) },
+			input:   []byte(`{"id": {"started": {}}}` + "\n" + `{"id": 12}`),
+			wantErr: "failed to unmarshal event #1",
+		},
+		{
+			desc: "empty",
+			read: func(b []byte) ([]*bespb.BuildEvent, error) { return ReadBinaryEvents(bytes.NewReader(b)) },
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := tc.read(tc.input)
+			errdiff.Check(t, err, tc.wantErr)
+			if err != nil {
+				return
+			}
+			assert.Empty(t, cmpDiff(tc.want, got))
+		})
+	}
+}
+
+func TestReadEventFile(t *testing.T) {
+	dir := t.TempDir()
+	want := testEvents()
+
+	binaryPath := filepath.Join(dir, "bep.bin")
+	require.NoError(t, os.WriteFile(binaryPath, encodeBinary(t, want), 0644))
+	jsonPath := filepath.Join(dir, "bep.json")
+	require.NoError(t, os.WriteFile(jsonPath, encodeJSON(t, want), 0644))
+
+	for _, path := range []string{binaryPath, jsonPath} {
+		got, err := ReadEventFile(path)
+		require.NoError(t, err)
+		assert.Empty(t, cmpDiff(want, got), path)
+	}
+
+	// The format is explicit, regardless of the extension.
+	textPath := filepath.Join(dir, "bep.txt")
+	require.NoError(t, os.WriteFile(textPath, encodeJSON(t, want), 0644))
+	got, err := ReadEventFileAs(textPath, ReadJSONEvents)
+	require.NoError(t, err)
+	assert.Empty(t, cmpDiff(want, got))
+
+	_, err = ReadEventFile(filepath.Join(dir, "missing.bin"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+}
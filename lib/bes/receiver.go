@@ -0,0 +1,133 @@
+package bes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Invocation is the sequence of build events received for a single bazel
+// invocation.
+type Invocation struct {
+	ID     string
+	Events []*bespb.BuildEvent
+}
+
+// Receiver is a minimal Build Event Service backend, collecting in memory
+// the events streamed by bazel.
+//
+// Register it on a grpc server, point bazel to it with
+// --bes_backend=grpc://<address>, and use Next to wait for the build to
+// complete.
+type Receiver struct {
+	bpb.UnimplementedPublishBuildEventServer
+
+	mu       sync.Mutex
+	pending  map[string]*receiving
+	finished chan *Invocation
+}
+
+type receiving struct {
+	invocation Invocation
+	last       int64
+}
+
+// NewReceiver returns a Receiver ready to be registered.
+func NewReceiver() *Receiver {
+	return &Receiver{
+		pending:  map[string]*receiving{},
+		finished: make(chan *Invocation, 16),
+	}
+}
+
+// Register registers the Receiver as the PublishBuildEvent service of server.
+func (r *Receiver) Register(server *grpc.Server) {
+	bpb.RegisterPublishBuildEventServer(server, r)
+}
+
+// Next blocks until the event stream of an invocation is complete, and
+// returns it.
+func (r *Receiver) Next(ctx context.Context) (*Invocation, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case inv := <-r.finished:
+		return inv, nil
+	}
+}
+
+// PublishLifecycleEvent ignores lifecycle events, only sent by bazel with
+// --bes_lifecycle_events.
+func (r *Receiver) PublishLifecycleEvent(ctx context.Context, req *bpb.PublishLifecycleEventRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+// PublishBuildToolEventStream acknowledges and records all the build events
+// sent by bazel.
+//
+// Retries are handled by ignoring the events that were already received.
+func (r *Receiver) PublishBuildToolEventStream(stream bpb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ordered := req.GetOrderedBuildEvent()
+		if err := r.record(ordered); err != nil {
+			return err
+		}
+		if err := stream.Send(&bpb.PublishBuildToolEventStreamResponse{
+			StreamId:       ordered.GetStreamId(),
+			SequenceNumber: ordered.GetSequenceNumber(),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Receiver) record(ordered *bpb.OrderedBuildEvent) error {
+	id := ordered.GetStreamId().GetInvocationId()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state := r.pending[id]
+	if state == nil {
+		state = &receiving{invocation: Invocation{ID: id}}
+		r.pending[id] = state
+	}
+	if ordered.GetSequenceNumber() <= state.last {
+		return nil
+	}
+	state.last = ordered.GetSequenceNumber()
+
+	switch event := ordered.GetEvent().GetEvent().(type) {
+	case *bpb.BuildEvent_BazelEvent:
+		be := &bespb.BuildEvent{}
+		if err := event.BazelEvent.UnmarshalTo(be); err != nil {
+			return fmt.Errorf("invocation %s: failed to unmarshal event #%d: %w", id, ordered.GetSequenceNumber(), err)
+		}
+		state.invocation.Events = append(state.invocation.Events, be)
+
+	case *bpb.BuildEvent_ComponentStreamFinished:
+		delete(r.pending, id)
+		select {
+		case r.finished <- &state.invocation:
+		default:
+			// Nobody is waiting for more invocations, drop it.
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package bes
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	bespb "github.com/ccontavalli/enkit/third_party/bazel/buildeventstream"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func cmpDiff(want, got []*bespb.BuildEvent) string {
+	return cmp.Diff(want, got, protocmp.Transform())
+}
+
+func TestReceiver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	receiver := NewReceiver()
+	receiver.Register(server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := bpb.NewPublishBuildEventClient(conn).PublishBuildToolEventStream(ctx)
+	require.NoError(t, err)
+
+	streamID := &bpb.StreamId{BuildId: "build", InvocationId: "invocation", Component: bpb.StreamId_TOOL}
+	send := func(seq int64, event *bpb.BuildEvent) {
+		require.NoError(t, stream.Send(&bpb.PublishBuildToolEventStreamRequest{
+			OrderedBuildEvent: &bpb.OrderedBuildEvent{
+				StreamId:       streamID,
+				SequenceNumber: seq,
+				Event:          event,
+			},
+		}))
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, seq, res.GetSequenceNumber())
+	}
+
+	want := testEvents()
+	for i, event := range want {
+		payload, err := anypb.New(event)
+		require.NoError(t, err)
+		bazelEvent := &bpb.BuildEvent{Event: &bpb.BuildEvent_BazelEvent{BazelEvent: payload}}
+		send(int64(i+1), bazelEvent)
+		// Retransmissions are acknowledged, but not recorded twice.
+		send(int64(i+1), bazelEvent)
+	}
+	send(int64(len(want)+1), &bpb.BuildEvent{
+		Event: &bpb.BuildEvent_ComponentStreamFinished{ComponentStreamFinished: &bpb.BuildEvent_BuildComponentStreamFinished{}},
+	})
+	require.NoError(t, stream.CloseSend())
+
+	inv, err := receiver.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "invocation", inv.ID)
+	assert.Empty(t, cmpDiff(want, inv.Events))
+
+	expired, cancelExpired := context.WithCancel(ctx)
+	cancelExpired()
+	_, err = receiver.Next(expired)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/cache"
+	"github.com/ccontavalli/enkit/lib/client"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+type Root struct {
+	*cobra.Command
+	*client.BaseFlags
+}
+
+func New(base *client.BaseFlags) *Root {
+	root := NewRoot(base)
+
+	root.AddCommand(NewGC(root).Command)
+	root.AddCommand(NewList(root).Command)
+	root.AddCommand(NewUsage(root).Command)
+
+	return root
+}
+
+func NewRoot(base *client.BaseFlags) *Root {
+	return &Root{
+		Command: &cobra.Command{
+			Use:           "cache",
+			Short:         "Inspect and clean up the local cache",
+			SilenceUsage:  true,
+			SilenceErrors: true,
+			Long: `cache - inspects and cleans up the local cache
+
+The cache stores downloaded files and configs, and the state of the ssh agent.
+Its location and size limits are controlled by the --cache-* flags.`,
+		},
+		BaseFlags: base,
+	}
+}
+
+type GC struct {
+	*cobra.Command
+	root *Root
+
+	DryRun bool
+}
+
+func NewGC(root *Root) *GC {
+	command := &GC{
+		Command: &cobra.Command{
+			Use:   "gc",
+			Short: "Remove expired, least recently used and abandoned cache entries",
+			Example: `  $ enkit cache gc --cache-max-size=5GB --cache-max-age=720h
+        Remove entries not used in the last 30 days, and the least recently
+        used ones until the cache is smaller than 5GB.`,
+			Args: cobra.NoArgs,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().BoolVarP(&command.DryRun, "dry-run", "n", false, "Only show the entries that would be removed")
+
+	return command
+}
+
+func (c *GC) Run(cmd *cobra.Command, args []string) error {
+	result, err := c.root.Local.GC(c.DryRun)
+	if err != nil {
+		return err
+	}
+	for _, entry := range result.Removed {
+		c.root.Log.Infof("removing %s entry %s (%s, last used %s)", entry.State, entry.Path,
+			humanize.Bytes(uint64(entry.Size)), humanize.Time(entry.LastUsed))
+	}
+	verb := "Removed"
+	if c.DryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d entries, %s freed, %s left\n", verb, len(result.Removed),
+		humanize.Bytes(uint64(result.Freed)), humanize.Bytes(uint64(result.Size)))
+	return nil
+}
+
+type List struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewList(root *Root) *List {
+	command := &List{
+		Command: &cobra.Command{
+			Use:     "ls",
+			Short:   "List cache entries, least recently used first",
+			Aliases: []string{"list"},
+			Args:    cobra.NoArgs,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (c *List) Run(cmd *cobra.Command, args []string) error {
+	entries, err := c.root.Local.List()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	return printEntries(os.Stdout, entries)
+}
+
+func printEntries(w io.Writer, entries []cache.Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAST USED\tSIZE\tSTATE\tPATH")
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", entry.LastUsed.Format(time.DateTime),
+			humanize.Bytes(uint64(entry.Size)), entry.State, entry.Path)
+	}
+	return tw.Flush()
+}
+
+type Usage struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewUsage(root *Root) *Usage {
+	command := &Usage{
+		Command: &cobra.Command{
+			Use:   "du",
+			Short: "Show the disk space used by the cache",
+			Args:  cobra.NoArgs,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (c *Usage) Run(cmd *cobra.Command, args []string) error {
+	entries, err := c.root.Local.List()
+	if err != nil {
+		return err
+	}
+	maxSize, err := c.root.Local.ParseMaxSize()
+	if err != nil {
+		return err
+	}
+	return printUsage(os.Stdout, c.root.Local.Root, entries, maxSize)
+}
+
+func printUsage(w io.Writer, root string, entries []cache.Entry, maxSize uint64) error {
+	counts := map[cache.EntryState]int{}
+	sizes := map[cache.EntryState]int64{}
+	var total int64
+	for _, entry := range entries {
+		counts[entry.State]++
+		sizes[entry.State] += entry.Size
+		total += entry.Size
+	}
+
+	limit := "unbounded"
+	if maxSize > 0 {
+		limit = humanize.Bytes(maxSize)
+	}
+	fmt.Fprintf(w, "%s: %s in %d entries (max size %s)\n", root, humanize.Bytes(uint64(total)), len(entries), limit)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, state := range []cache.EntryState{cache.EntryCommitted, cache.EntryUncommitted, cache.EntryPurging} {
+		fmt.Fprintf(tw, "  %s\t%d entries\t%s\n", state, counts[state], humanize.Bytes(uint64(sizes[state])))
+	}
+	return tw.Flush()
+}
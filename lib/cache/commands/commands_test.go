@@ -0,0 +1,30 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/cache"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintUsage(t *testing.T) {
+	entries := []cache.Entry{
+		{Path: "/cache/aa/1", State: cache.EntryCommitted, Size: 2000},
+		{Path: "/cache/aa/2", State: cache.EntryCommitted, Size: 3000},
+		{Path: "/cache/bb/3.tmp1", State: cache.EntryUncommitted, Size: 1000},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, printUsage(&out, "/cache", entries, 10000))
+	assert.Equal(t, `/cache: 6.0 kB in 3 entries (max size 10 kB)
+  committed    2 entries  5.0 kB
+  uncommitted  1 entries  1.0 kB
+  purging      0 entries  0 B
+`, out.String())
+
+	out.Reset()
+	assert.NoError(t, printUsage(&out, "/cache", nil, 0))
+	assert.Contains(t, out.String(), "/cache: 0 B in 0 entries (max size unbounded)")
+}
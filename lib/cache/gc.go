@@ -0,0 +1,363 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// DefaultStaleAge is the default for Local.StaleAge.
+	DefaultStaleAge = 24 * time.Hour
+	// DefaultGCInterval is the default for Local.GCInterval.
+	DefaultGCInterval = time.Hour
+
+	// DefaultMinEvictionAge is the default for Local.MinEvictionAge.
+	//
+	// Entries used more recently are likely still in use by some build or
+	// process, so the cache is allowed to temporarily exceed its maximum
+	// size instead.
+	DefaultMinEvictionAge = 12 * time.Hour
+
+	// Left overs of interrupted Purge calls not modified for this long are
+	// removed by GC.
+	purgingAge = 5 * time.Minute
+)
+
+const (
+	// Lock held while garbage collecting, so that processes sharing the same
+	// cache directory don't try to evict the same entries.
+	gcLockFile = ".gc.lock"
+	// Touched at the end of every garbage collection, to rate limit the
+	// automatic garbage collection performed by Commit.
+	gcStampFile = ".gc.stamp"
+)
+
+// ErrGCRunning is returned by GC if another process is already garbage
+// collecting the same cache directory.
+var ErrGCRunning = errors.New("cache garbage collection already in progress")
+
+var (
+	// Name of the directories containing the entries, first byte of the hash.
+	reEntryPrefix = regexp.MustCompile(`^[0-9a-f]{2}$`)
+	// Suffix added by Purge to the entries being removed.
+	rePurgeSuffix = regexp.MustCompile(`-[0-9a-f]{16}$`)
+	// Suffix added by Get to the entries not yet committed.
+	reTempSuffix = regexp.MustCompile(`\.tmp[0-9]+$`)
+)
+
+// EntryState describes the lifecycle of a cache entry on disk.
+type EntryState int
+
+const (
+	// The entry was committed, and can be returned by Get.
+	EntryCommitted EntryState = iota
+	// The entry was returned by Get, but not committed yet. It is either
+	// still being filled, or was abandoned by a process that terminated
+	// before calling Commit or Purge.
+	EntryUncommitted
+	// The entry was being purged, but was not removed completely.
+	EntryPurging
+)
+
+func (s EntryState) String() string {
+	switch s {
+	case EntryCommitted:
+		return "committed"
+	case EntryUncommitted:
+		return "uncommitted"
+	case EntryPurging:
+		return "purging"
+	}
+	return fmt.Sprintf("EntryState(%d)", int(s))
+}
+
+// Entry describes a cache entry on disk.
+type Entry struct {
+	// Full path of the entry directory.
+	Path  string
+	State EntryState
+	// Total size of the files in the entry, in bytes.
+	Size int64
+	// For committed entries, the last time the entry was committed or looked
+	// up. For the other entries, the last time any file in the entry was
+	// modified.
+	LastUsed time.Time
+}
+
+// GCResult summarizes the outcome of a garbage collection.
+type GCResult struct {
+	// Entries removed, or that would have been removed in dry run mode.
+	Removed []Entry
+	// Bytes freed by removing the entries.
+	Freed int64
+	// Size in bytes of the entries left in the cache.
+	Size int64
+}
+
+// ParseMaxSize returns the MaxSize of the cache in bytes, 0 if unbounded.
+func (c *Local) ParseMaxSize() (uint64, error) {
+	if c.MaxSize == "" {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(c.MaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache max size %q: %w", c.MaxSize, err)
+	}
+	return size, nil
+}
+
+// List returns all the entries in the cache, including the ones not yet
+// committed, sorted by path.
+func (c *Local) List() ([]Entry, error) {
+	prefixes, err := os.ReadDir(c.Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || !reEntryPrefix.MatchString(prefix.Name()) {
+			continue
+		}
+		dir := filepath.Join(c.Root, prefix.Name())
+		children, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, child := range children {
+			if !child.IsDir() {
+				continue
+			}
+			entry, err := readEntry(filepath.Join(dir, child.Name()))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Removed by a concurrent Purge or Commit.
+					continue
+				}
+				return nil, err
+			}
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+func readEntry(path string) (*Entry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{Path: path, LastUsed: info.ModTime()}
+	switch name := filepath.Base(path); {
+	case rePurgeSuffix.MatchString(name):
+		entry.State = EntryPurging
+	case reTempSuffix.MatchString(name):
+		entry.State = EntryUncommitted
+	}
+
+	err = filepath.WalkDir(path, func(current string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			entry.Size += info.Size()
+		}
+		// Files are written while an entry is being filled or removed, so the
+		// last modification of any of them tells if the entry was abandoned.
+		if entry.State != EntryCommitted && info.ModTime().After(entry.LastUsed) {
+			entry.LastUsed = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GC removes entries from the cache according to the configured policy:
+//   - uncommitted entries not modified for longer than StaleAge, and left
+//     overs of interrupted Purge calls.
+//   - committed entries not used for longer than MaxAge.
+//   - the least recently used committed entries, until the cache is
+//     smaller than MaxSize. Entries used in the last MinEvictionAge are
+//     never removed.
+//
+// Committed entries are removed with Purge, so other processes using the
+// cache never see partially removed entries. Only one process at a time can
+// garbage collect a cache directory, ErrGCRunning is returned if another
+// one is already doing it.
+//
+// In dry run mode, no entry is removed, but the result reports the entries
+// that would have been removed.
+func (c *Local) GC(dryRun bool) (*GCResult, error) {
+	maxSize, err := c.ParseMaxSize()
+	if err != nil {
+		return nil, err
+	}
+	if !PathIsDir(c.Root) {
+		return &GCResult{}, nil
+	}
+
+	unlock, err := lockFile(filepath.Join(c.Root, gcLockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if !dryRun {
+		// Touch the stamp first, so failures are not retried at every Commit.
+		touchFile(filepath.Join(c.Root, gcStampFile))
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := &GCResult{}
+	remove := func(entry Entry) error {
+		if !dryRun {
+			if err := c.Purge(entry.Path); err != nil {
+				return fmt.Errorf("could not remove %s: %w", entry.Path, err)
+			}
+		}
+		result.Removed = append(result.Removed, entry)
+		result.Freed += entry.Size
+		return nil
+	}
+
+	var committed []Entry
+	for _, entry := range entries {
+		age := now.Sub(entry.LastUsed)
+		switch entry.State {
+		case EntryPurging:
+			if age < purgingAge {
+				continue
+			}
+		case EntryUncommitted:
+			if c.StaleAge <= 0 || age < c.StaleAge {
+				continue
+			}
+		case EntryCommitted:
+			if c.MaxAge <= 0 || age < c.MaxAge || recentlyUsed(entry.Path, now, c.MaxAge) {
+				committed = append(committed, entry)
+				continue
+			}
+		}
+		if err := remove(entry); err != nil {
+			return result, err
+		}
+	}
+
+	for _, entry := range committed {
+		result.Size += entry.Size
+	}
+	if maxSize <= 0 || uint64(result.Size) <= maxSize {
+		return result, nil
+	}
+
+	minEvictionAge := c.MinEvictionAge
+	if minEvictionAge <= 0 {
+		minEvictionAge = DefaultMinEvictionAge
+	}
+	sort.SliceStable(committed, func(i, j int) bool {
+		return committed[i].LastUsed.Before(committed[j].LastUsed)
+	})
+	for _, entry := range committed {
+		if uint64(result.Size) <= maxSize {
+			break
+		}
+		if now.Sub(entry.LastUsed) < minEvictionAge || recentlyUsed(entry.Path, now, minEvictionAge) {
+			// Entries are sorted by access time, all the following ones
+			// are in use as well.
+			break
+		}
+		if err := remove(entry); err != nil {
+			return result, err
+		}
+		result.Size -= entry.Size
+	}
+	return result, nil
+}
+
+// collecting contains the roots of the caches being garbage collected by
+// Commit in this process, see maybeGC.
+var collecting sync.Map
+
+// maybeGC runs GC if a maximum size or age is configured, and no garbage
+// collection was performed in the last GCInterval.
+//
+// GC runs synchronously, delaying the Commit that crossed the GCInterval:
+// run in background, it would be killed mid-eviction by short lived commands
+// exiting right after Commit returns, and never complete.
+//
+// Errors are ignored: garbage collection is best effort, and will be retried
+// later. The lock file taken by GC prevents other processes from collecting
+// the same cache at the same time.
+func (c *Local) maybeGC() {
+	if c.GCInterval <= 0 || (c.MaxSize == "" && c.MaxAge <= 0) {
+		return
+	}
+	if info, err := os.Stat(filepath.Join(c.Root, gcStampFile)); err == nil && time.Since(info.ModTime()) < c.GCInterval {
+		return
+	}
+	if _, running := collecting.LoadOrStore(c.Root, true); running {
+		return
+	}
+	defer collecting.Delete(c.Root)
+	c.GC(false)
+}
+
+// recentlyUsed checks again the access time of an entry right before removing
+// it, as it could have been looked up while the cache was being scanned.
+func recentlyUsed(path string, now time.Time, window time.Duration) bool {
+	info, err := os.Stat(path)
+	return err == nil && now.Sub(info.ModTime()) < window
+}
+
+// touch marks a committed entry as used, by updating its modification time.
+//
+// Errors are ignored, as the cache may be on a read only file system, in
+// which case the entry will just appear older than it is.
+func touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+func touchFile(path string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return
+	}
+	f.Close()
+	touch(path)
+}
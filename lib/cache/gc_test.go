@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addEntry stores size bytes under key, and makes the entry appear last used
+// age ago. If commit is false, the entry is left uncommitted.
+func addEntry(t *testing.T, c *Local, key string, size int, age time.Duration, commit bool) string {
+	t.Helper()
+	location, found, err := c.Get(key)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	file := filepath.Join(location, "data")
+	require.NoError(t, os.WriteFile(file, make([]byte, size), 0600))
+	if commit {
+		location, err = c.Commit(location)
+		require.NoError(t, err)
+		file = filepath.Join(location, "data")
+	}
+
+	when := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(file, when, when))
+	require.NoError(t, os.Chtimes(location, when, when))
+	return location
+}
+
+func paths(entries []Entry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Path)
+	}
+	return result
+}
+
+func TestList(t *testing.T) {
+	c := &Local{Root: t.TempDir()}
+	committed := addEntry(t, c, "committed", 100, time.Hour, true)
+	uncommitted := addEntry(t, c, "uncommitted", 10, time.Hour, false)
+
+	// The lookup refreshes the access time of the entry.
+	location, err := c.Exists("committed")
+	require.NoError(t, err)
+	assert.Equal(t, committed, location)
+
+	entries, err := c.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		switch entry.Path {
+		case committed:
+			assert.Equal(t, EntryCommitted, entry.State)
+			assert.Equal(t, int64(100), entry.Size)
+			assert.WithinDuration(t, time.Now(), entry.LastUsed, time.Minute)
+		case uncommitted:
+			assert.Equal(t, EntryUncommitted, entry.State)
+			assert.Equal(t, int64(10), entry.Size)
+			assert.WithinDuration(t, time.Now().Add(-time.Hour), entry.LastUsed, time.Minute)
+		default:
+			t.Errorf("unexpected entry %s", entry.Path)
+		}
+	}
+
+	entries, err = (&Local{Root: filepath.Join(c.Root, "missing")}).List()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestGC(t *testing.T) {
+	c := &Local{Root: t.TempDir(), MaxSize: "250B", MaxAge: 48 * time.Hour, StaleAge: DefaultStaleAge, MinEvictionAge: time.Hour}
+
+	old := addEntry(t, c, "old", 10, 72*time.Hour, true)
+	lru := addEntry(t, c, "lru", 100, 3*time.Hour, true)
+	mru := addEntry(t, c, "mru", 100, 2*time.Hour, true)
+	inuse := addEntry(t, c, "in-use", 100, time.Minute, true)
+	stale := addEntry(t, c, "stale", 10, 25*time.Hour, false)
+	filling := addEntry(t, c, "filling", 10, time.Hour, false)
+
+	result, err := c.GC(true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{old, stale, lru}, paths(result.Removed))
+	assert.Equal(t, int64(120), result.Freed)
+	assert.Equal(t, int64(200), result.Size)
+
+	// Nothing was removed in dry run mode.
+	entries, err := c.List()
+	require.NoError(t, err)
+	assert.Len(t, entries, 6)
+
+	result, err = c.GC(false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{old, stale, lru}, paths(result.Removed))
+
+	entries, err = c.List()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{mru, inuse, filling}, paths(entries))
+
+	// Entries in use are never evicted, even if the cache is too large.
+	c.MaxSize = "50B"
+	result, err = c.GC(false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{mru}, paths(result.Removed))
+	assert.Equal(t, int64(100), result.Size)
+
+	// By default, entries used in the last DefaultMinEvictionAge are kept.
+	c.MinEvictionAge = 0
+	addEntry(t, c, "recent", 100, 3*time.Hour, true)
+	result, err = c.GC(false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Removed)
+	assert.Equal(t, int64(200), result.Size)
+
+	c.MaxSize = "lots"
+	_, err = c.GC(false)
+	assert.ErrorContains(t, err, "invalid cache max size")
+}
+
+func TestGCLocked(t *testing.T) {
+	c := &Local{Root: t.TempDir()}
+	unlock, err := lockFile(filepath.Join(c.Root, gcLockFile))
+	require.NoError(t, err)
+
+	_, err = c.GC(false)
+	assert.ErrorIs(t, err, ErrGCRunning)
+
+	unlock()
+	_, err = c.GC(false)
+	assert.NoError(t, err)
+}
+
+func TestCommitGC(t *testing.T) {
+	c := &Local{Root: t.TempDir(), MaxAge: time.Hour}
+	old := addEntry(t, c, "old", 10, 2*time.Hour, true)
+	c.GCInterval = time.Hour
+
+	// The first commit garbage collects before returning, removing old entries.
+	addEntry(t, c, "new", 10, 0, true)
+	location, err := c.Exists("old")
+	require.NoError(t, err)
+	assert.Equal(t, "", location)
+	assert.NoDirExists(t, old)
+
+	// The following ones don't, until GCInterval expires.
+	addEntry(t, c, "old", 10, 2*time.Hour, true)
+	addEntry(t, c, "another", 10, 0, true)
+	location, err = c.Exists("old")
+	require.NoError(t, err)
+	assert.Equal(t, old, location)
+}
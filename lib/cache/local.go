@@ -8,14 +8,36 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/kirsle/configdir"
 )
 
 // Local implements a local file system based cache.
+//
+// Entries are stored in sub directories of Root. The modification time of
+// each committed entry directory is updated every time the entry is looked
+// up, and used as its last access time by GC.
 type Local struct {
 	Root string
+
+	// MaxSize is the maximum size of the cache, in human readable format,
+	// like "10GB" or "512MiB". Empty means unbounded.
+	MaxSize string
+	// MaxAge is the maximum time an entry can stay unused before being
+	// removed. 0 means forever.
+	MaxAge time.Duration
+	// StaleAge is the time after which an uncommitted entry that is no
+	// longer being written is considered abandoned, and removed.
+	StaleAge time.Duration
+	// MinEvictionAge is the minimum time since the last access before an
+	// entry can be removed to bring the cache below MaxSize. 0 means
+	// DefaultMinEvictionAge.
+	MinEvictionAge time.Duration
+	// GCInterval is how often Commit will run GC, if MaxSize or MaxAge are
+	// set. 0 disables automatic garbage collection.
+	GCInterval time.Duration
 }
 
 // NewLocal will return a Local cache pointing to the OS specific directory where files are cached.
@@ -27,11 +49,21 @@ type Local struct {
 //
 // Will return /home/username/.cache/gnome as the location for the cache.
 func NewLocal(label string) *Local {
-	return &Local{Root: configdir.LocalCache(label)}
+	return &Local{
+		Root:           configdir.LocalCache(label),
+		StaleAge:       DefaultStaleAge,
+		MinEvictionAge: DefaultMinEvictionAge,
+		GCInterval:     DefaultGCInterval,
+	}
 }
 
 func (l *Local) Register(flags kflags.FlagSet, prefix string) *Local {
 	flags.StringVar(&l.Root, prefix+"cache-dir", l.Root, "Directory where to cache files")
+	flags.StringVar(&l.MaxSize, prefix+"cache-max-size", l.MaxSize, "Maximum size of the cache, like 10GB. Least recently used entries are removed first. Empty for unbounded")
+	flags.DurationVar(&l.MaxAge, prefix+"cache-max-age", l.MaxAge, "Remove cache entries not used for longer than this. 0 to keep them forever")
+	flags.DurationVar(&l.StaleAge, prefix+"cache-stale-age", l.StaleAge, "Remove uncommitted cache entries not modified for longer than this")
+	flags.DurationVar(&l.MinEvictionAge, prefix+"cache-min-eviction-age", l.MinEvictionAge, "Never remove cache entries used more recently than this to honor the max size, as they may still be in use")
+	flags.DurationVar(&l.GCInterval, prefix+"cache-gc-interval", l.GCInterval, "How often to garbage collect the cache when a max size or max age is set. 0 to only collect on explicit request")
 	return l
 }
 
@@ -80,6 +112,7 @@ func (c *Local) Get(key string) (string, bool, error) {
 	dirEnd := fmt.Sprintf("%x", sum[1:len(sum)-1])
 	dirFull := filepath.Join(dirPrefix, dirEnd)
 	if PathIsDir(dirFull) {
+		touch(dirFull)
 		return dirFull, true, nil
 	}
 	err := os.MkdirAll(dirPrefix, 0750)
@@ -104,6 +137,7 @@ func (c *Local) Exists(key string) (string, error) {
 	dirEnd := fmt.Sprintf("%x", sum[1:len(sum)-1])
 	dirFull := filepath.Join(dirPrefix, dirEnd)
 	if PathIsDir(dirFull) {
+		touch(dirFull)
 		return dirFull, nil
 	}
 	return "", nil
@@ -124,10 +158,12 @@ func (c *Local) Exists(key string) (string, error) {
 // call Commit() immediately after Get().
 //
 // The `location` string must be a value returned by Get().
+//
+// Once every GCInterval, Commit also runs GC before returning.
 func (c *Local) Commit(location string) (string, error) {
 	idx := strings.LastIndex(location, ".tmp")
 	// Defense in depth - ensure that the supplied path to commit is valid.
-	if c.Root != "." && !strings.HasPrefix(location, c.Root) {
+	if !c.contains(location) {
 		panic(fmt.Sprintf("Tried to commit '%s' - which is not a temporary cache path", location))
 	}
 	// Tolerate Committing an already committed directory. This simplifies user's code.
@@ -142,6 +178,8 @@ func (c *Local) Commit(location string) (string, error) {
 	if err := os.Rename(location, location[:idx]); err != nil && !os.IsExist(err) {
 		return location[:idx], err
 	}
+	touch(location[:idx])
+	c.maybeGC()
 	return location[:idx], nil
 }
 
@@ -173,7 +211,7 @@ func (c *Local) Commit(location string) (string, error) {
 func (c *Local) Purge(location string) error {
 	// Defense in depth - ensure that the supplied path to remove is valid.
 	location = filepath.Clean(location)
-	if c.Root != "." && !strings.HasPrefix(location, c.Root) {
+	if !c.contains(location) {
 		panic(fmt.Sprintf("Tried to purge '%s' - outside the root of the cache", location))
 	}
 	// Ensure no partial file is read from the cache while deletion is in progress.
@@ -182,6 +220,26 @@ func (c *Local) Purge(location string) error {
 	return os.RemoveAll(tempname)
 }
 
+// contains returns true if location is a path below the root of the cache.
+//
+// Both paths are cleaned and made absolute before being compared, so a
+// relative Root, or a location like root/../elsewhere, is handled correctly.
+func (c *Local) contains(location string) bool {
+	root, err := filepath.Abs(c.Root)
+	if err != nil {
+		return false
+	}
+	location, err = filepath.Abs(location)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, location)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // Rollback purges the directory if it has not been committed.
 func (c *Local) Rollback(location string) error {
 	idx := strings.LastIndex(location, ".tmp")
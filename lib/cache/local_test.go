@@ -6,6 +6,9 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCache(t *testing.T) {
@@ -115,6 +118,30 @@ func TestCachePurgePanic(t *testing.T) {
 	cache.Purge(toRemove)
 }
 
+// Tries to Purge a directory next to the cache, sharing the prefix of its root.
+func TestCachePurgeSibling(t *testing.T) {
+	dir := t.TempDir()
+	sibling := filepath.Join(dir, "cache-other")
+	require.NoError(t, os.Mkdir(sibling, 0750))
+
+	cache := &Local{Root: filepath.Join(dir, "cache")}
+	for _, location := range []string{sibling, filepath.Join(dir, "cache", "..", "cache-other"), cache.Root} {
+		assert.Panics(t, func() { cache.Purge(location) }, location)
+	}
+	assert.DirExists(t, sibling)
+
+	// A relative root is compared with the absolute locations returned by Get.
+	t.Chdir(dir)
+	cache = &Local{Root: "./cache/"}
+	location, found, err := cache.Get("key")
+	require.NoError(t, err)
+	assert.False(t, found)
+	location, err = cache.Commit(filepath.Join(dir, location))
+	require.NoError(t, err)
+	assert.NoError(t, cache.Purge(location))
+	assert.NoDirExists(t, location)
+}
+
 // Tries to commit a directory that was not created with Cache.Get()
 func TestCacheCommitPanic(t *testing.T) {
 	cacheRoot, err := ioutil.TempDir("", "cache")
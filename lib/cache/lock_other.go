@@ -0,0 +1,32 @@
+//go:build !unix
+
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile acquires an exclusive lock on path, without blocking.
+//
+// The lock is a file created exclusively, and removed when unlocking. A lock
+// left behind by a process that terminated is ignored after DefaultStaleAge.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if os.IsExist(err) {
+		if info, serr := os.Stat(path); serr == nil && time.Since(info.ModTime()) > DefaultStaleAge {
+			os.Remove(path)
+			f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		}
+	}
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrGCRunning
+		}
+		return nil, err
+	}
+	f.Close()
+	return func() {
+		os.Remove(path)
+	}, nil
+}
@@ -4,6 +4,10 @@ import (
 	"github.com/ccontavalli/enkit/lib/config/commands"
 	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
 	"github.com/spf13/cobra"
+
+	// Packages registering schemas for `enconfig migrate`.
+	_ "github.com/ccontavalli/enkit/lib/kemail"
+	_ "github.com/ccontavalli/enkit/proxy/enproxy"
 )
 
 func main() {
@@ -8,6 +8,7 @@ import (
 
 	"github.com/ccontavalli/enkit/lib/config"
 	"github.com/ccontavalli/enkit/lib/config/factory"
+	"github.com/ccontavalli/enkit/lib/config/identity"
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
 	"github.com/ccontavalli/enkit/lib/srand"
@@ -43,6 +44,7 @@ type Root struct {
 	*cobra.Command
 	Source     *StoreFlags
 	Dest       *StoreFlags
+	Identity   *identity.IdentityFlags
 	recursive  bool
 	workspaces map[*factory.Flags]config.StoreWorkspace
 }
@@ -58,11 +60,13 @@ func NewRoot() *Root {
 		},
 		Source:     DefaultStoreFlags(),
 		Dest:       DefaultStoreFlags(),
+		Identity:   identity.DefaultIdentityFlags(),
 		workspaces: map[*factory.Flags]config.StoreWorkspace{},
 	}
 
 	root.Source.Register(&kcobra.FlagSet{FlagSet: root.PersistentFlags()}, "src-")
 	root.Dest.Register(&kcobra.FlagSet{FlagSet: root.PersistentFlags()}, "dst-")
+	root.Identity.Register(&kcobra.FlagSet{FlagSet: root.PersistentFlags()}, "")
 	root.PersistentFlags().BoolVar(&root.recursive, "recursive", false, "Recurse into child namespaces")
 
 	root.AddCommand(NewListCommand(root))
@@ -73,6 +77,7 @@ func NewRoot() *Root {
 	root.AddCommand(NewGrepCommand(root))
 	root.AddCommand(NewGetCommand(root))
 	root.AddCommand(NewPutCommand(root))
+	root.AddCommand(NewMigrateCommand(root))
 
 	return root
 }
@@ -101,7 +106,7 @@ func (r *Root) workspace(sf *StoreFlags) (config.StoreWorkspace, error) {
 	if sf.App == "" {
 		return nil, kflags.NewUsageErrorf("must specify --%sapp", sf.Prefix)
 	}
-	workspace, err := factory.NewStore(rand.New(srand.Source), factory.FromFlags(sf.Flags))
+	workspace, err := factory.NewStore(rand.New(srand.Source), factory.FromFlags(sf.Flags), factory.WithIdentity(r.Identity))
 	if err != nil {
 		return nil, err
 	}
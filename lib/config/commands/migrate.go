@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/config/typed"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+)
+
+// NewMigrateCommand returns a command upgrading every key of a namespace to
+// the latest version of a schema.
+//
+// Schemas are registered with typed.Register by the packages defining the
+// config types, so only the schemas linked in the binary are available.
+func NewMigrateCommand(root *Root) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade keys in place to the latest version of a registered schema",
+		Args:  cobra.NoArgs,
+		Example: strings.TrimSpace(`
+enconfig migrate --schema=myapp.Config --src-app=myapp
+enconfig migrate --schema=myapp.Config --src-app=myapp --recursive --dry-run
+`),
+	}
+
+	options := struct {
+		Schema string
+		DryRun bool
+	}{}
+
+	cmd.Flags().StringVar(&options.Schema, "schema", options.Schema, "Name of the registered schema the keys are stored with")
+	cmd.Flags().BoolVarP(&options.DryRun, "dry-run", "n", options.DryRun, "Upgrade and validate the keys, but do not write them back")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		defer root.closeWorkspaces()
+
+		if options.Schema == "" {
+			return kflags.NewUsageErrorf("must specify --schema; known schemas: %s", knownSchemas())
+		}
+		migrator := typed.Lookup(options.Schema)
+		if migrator == nil {
+			return kflags.NewUsageErrorf("unknown schema %q; known schemas: %s", options.Schema, knownSchemas())
+		}
+
+		namespaces, err := root.namespaces(root.Source, root.recursive)
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, ns := range namespaces {
+			store, err := root.openStoreNamespace(root.Source, ns)
+			if err != nil {
+				return err
+			}
+			migrated, err := migrator.Migrate(store, options.DryRun)
+			for _, migration := range migrated {
+				printKeyLine(ns, migration.Descriptor.Key(), fmt.Sprintf("version %d -> %d", migration.From, migration.To))
+			}
+			if err != nil {
+				failed++
+				fmt.Fprintf(cmd.ErrOrStderr(), "namespace %s: %v\n", namespaceName(ns), err)
+			}
+			if err := store.Close(); err != nil {
+				return err
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("migration failed in %d namespaces", failed)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+func knownSchemas() string {
+	names := typed.Registered()
+	if len(names) == 0 {
+		return "(none linked in this binary)"
+	}
+	return strings.Join(names, ", ")
+}
+
+func namespaceName(namespace []string) string {
+	if len(namespace) == 0 {
+		return "/"
+	}
+	return strings.Join(namespace, "/")
+}
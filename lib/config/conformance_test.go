@@ -10,6 +10,7 @@ import (
 	"github.com/ccontavalli/enkit/lib/config"
 	"github.com/ccontavalli/enkit/lib/config/bbolt"
 	"github.com/ccontavalli/enkit/lib/config/directory"
+	"github.com/ccontavalli/enkit/lib/config/gitstore"
 	"github.com/ccontavalli/enkit/lib/config/marshal"
 	"github.com/ccontavalli/enkit/lib/config/memory"
 	"github.com/ccontavalli/enkit/lib/config/sqlite"
@@ -113,6 +114,26 @@ func TestStoreConformance(t *testing.T) {
 				return store, cleanup
 			},
 		},
+		{
+			name: "git",
+			open: func(t *testing.T) (config.Store, func()) {
+				t.Helper()
+				ws, err := gitstore.New(gitstore.WithPath(t.TempDir()), gitstore.WithInit(true))
+				if err != nil {
+					t.Fatalf("open git: %v", err)
+				}
+				loader, err := ws.Open("app", "ns")
+				if err != nil {
+					_ = ws.Close()
+					t.Fatalf("open store: %v", err)
+				}
+				store := config.OpenSimple(loader, marshal.Json)
+				cleanup := func() {
+					_ = ws.Close()
+				}
+				return store, cleanup
+			},
+		},
 		{
 			name: "memory",
 			open: func(t *testing.T) (config.Store, func()) {
@@ -6,6 +6,8 @@
 //   - bbolt: embedded KV store optimized for local, programmatic access.
 //   - sqlite: embedded storage optimized for programmatic access and local queries.
 //   - datastore: Google Cloud Datastore backend for remote config storage.
+//   - git: files committed to a ref of a git repository. Best when config changes
+//     should be code-reviewed and tracked in history.
 //
 // Benchmark notes:
 //   - The benchmark suite exercises list/get/store/lookup across backends with varying record counts
@@ -18,6 +18,8 @@ import (
 	"github.com/ccontavalli/enkit/lib/config/cryptstore"
 	"github.com/ccontavalli/enkit/lib/config/datastore"
 	"github.com/ccontavalli/enkit/lib/config/directory"
+	"github.com/ccontavalli/enkit/lib/config/gitstore"
+	"github.com/ccontavalli/enkit/lib/config/identity"
 	"github.com/ccontavalli/enkit/lib/config/marshal"
 	"github.com/ccontavalli/enkit/lib/config/sqlite"
 	"github.com/ccontavalli/enkit/lib/kflags"
@@ -32,7 +34,7 @@ const (
 type Flags struct {
 	// StoreType determines the backend and optional format to use.
 	// Examples: "directory:toml", "directory:multi", "memory:json",
-	// "bbolt:json", "crypto:directory:toml".
+	// "bbolt:json", "git:yaml", "crypto:directory:toml".
 	StoreType string
 	// Datastore holds Datastore-specific configuration.
 	Datastore *datastore.Flags
@@ -42,6 +44,8 @@ type Flags struct {
 	SQLite *sqlite.Flags
 	// Bbolt holds bbolt-specific configuration.
 	Bbolt *bbolt.Flags
+	// Git holds git-specific configuration.
+	Git *gitstore.Flags
 	// Crypt holds cryptstore-specific configuration used when StoreType has a
 	// "crypto:" prefix.
 	Crypt *cryptstore.Flags
@@ -55,6 +59,7 @@ func DefaultFlags() *Flags {
 		StoreType: "directory:toml",
 		SQLite:    sqlite.DefaultFlags(),
 		Bbolt:     bbolt.DefaultFlags(),
+		Git:       gitstore.DefaultFlags(),
 		Datastore: datastore.DefaultFlags(),
 		Directory: directory.DefaultFlags(),
 		Crypt:     cryptstore.DefaultFlags(),
@@ -114,6 +119,10 @@ func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	set.StringVar(&f.StoreType, prefix+"config-store", f.StoreType, "Type of config store to use (backend[:format] or crypto:backend[:format])")
 	f.SQLite.Register(set, prefix)
 	f.Bbolt.Register(set, prefix)
+	if f.Git == nil {
+		f.Git = gitstore.DefaultFlags()
+	}
+	f.Git.Register(set, prefix)
 	f.Datastore.Register(set, prefix)
 	f.Directory.Register(set, prefix)
 	if f.Crypt == nil {
@@ -127,6 +136,9 @@ func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 type Options struct {
 	Flags *Flags
 	Rng   *rand.Rand
+	// Identity of the user, used by backends that record who performed
+	// a change, like the author of commits in git stores.
+	Identity *identity.IdentityFlags
 }
 
 // Modifier is a function that modifies the factory Options.
@@ -139,6 +151,14 @@ func FromFlags(flags *Flags) Modifier {
 	}
 }
 
+// WithIdentity returns a Modifier that sets the identity of the user
+// performing changes through the store.
+func WithIdentity(ifl *identity.IdentityFlags) Modifier {
+	return func(o *Options) {
+		o.Identity = ifl
+	}
+}
+
 func marshallerByFormat(format string) (marshal.FileMarshaller, error) {
 	if format == "" {
 		return nil, fmt.Errorf("format is required")
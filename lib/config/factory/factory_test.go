@@ -10,6 +10,8 @@ import (
 	"github.com/ccontavalli/enkit/lib/config"
 	"github.com/ccontavalli/enkit/lib/config/cryptstore"
 	"github.com/ccontavalli/enkit/lib/config/directory"
+	"github.com/ccontavalli/enkit/lib/config/gitstore"
+	"github.com/ccontavalli/enkit/lib/config/identity"
 	"github.com/ccontavalli/enkit/lib/config/sqlite"
 	"github.com/stretchr/testify/assert"
 )
@@ -122,6 +124,35 @@ func TestNewSQLiteStore(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "bar", loaded.Value)
 }
+
+func TestNewGitStore(t *testing.T) {
+	flags := &Flags{
+		StoreType: "git:yaml",
+		Git: &gitstore.Flags{
+			Path: t.TempDir(),
+			Init: true,
+		},
+	}
+
+	ifl := &identity.IdentityFlags{UserDomain: "bob", DefaultDomain: "example.com"}
+	workspace, err := NewStore(testRng(), FromFlags(flags), WithIdentity(ifl))
+	assert.NoError(t, err)
+	defer workspace.Close()
+
+	store, err := workspace.Open("myapp", "testns")
+	assert.NoError(t, err)
+
+	type TestConfig struct {
+		Value string
+	}
+	assert.NoError(t, store.Marshal(config.Key("test-key"), &TestConfig{Value: "baz"}))
+
+	var loaded TestConfig
+	_, err = store.Unmarshal(config.Key("test-key"), &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", loaded.Value)
+}
+
 func TestDirectorySimpleWithFormat(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "config-factory-test")
 	assert.Nil(t, err)
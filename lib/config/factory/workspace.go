@@ -10,6 +10,7 @@ import (
 	"github.com/ccontavalli/enkit/lib/config/cryptstore"
 	"github.com/ccontavalli/enkit/lib/config/datastore"
 	"github.com/ccontavalli/enkit/lib/config/directory"
+	"github.com/ccontavalli/enkit/lib/config/gitstore"
 	"github.com/ccontavalli/enkit/lib/config/marshal"
 	"github.com/ccontavalli/enkit/lib/config/memory"
 	"github.com/ccontavalli/enkit/lib/config/sqlite"
@@ -51,7 +52,7 @@ func NewStore(rng *rand.Rand, mods ...Modifier) (config.StoreWorkspace, error) {
 		}
 		// fallthrough
 		fallthrough
-	case "directory", "bbolt", "sqlite":
+	case "directory", "bbolt", "sqlite", "git":
 		loaderWorkspace, err := newLoaderWorkspace(opts, backend)
 		if err != nil {
 			return nil, err
@@ -113,6 +114,8 @@ func newLoaderWorkspace(opts *Options, backend string) (config.LoaderWorkspace,
 		return bbolt.New(bbolt.FromFlags(opts.Flags.Bbolt))
 	case "sqlite":
 		return sqlite.New(sqlite.FromFlags(opts.Flags.SQLite))
+	case "git":
+		return gitstore.New(gitstore.FromFlags(opts.Flags.Git), gitstore.WithIdentity(opts.Identity))
 	default:
 		return nil, fmt.Errorf("unknown loader backend: %s", backend)
 	}
@@ -0,0 +1,683 @@
+// Config store backed by a git repository.
+//
+// Each namespace maps to a directory in the tree of a configured ref, and
+// each key to a file in that directory. Reads always come from the commit
+// the ref points to, while every Write or Delete creates a new commit on
+// top of it, authored by the configured identity.
+//
+// Using a bare repository is recommended: the working tree of a non-bare
+// repository is never touched, so if the ref is checked out, it will appear
+// modified after each write.
+//
+// Optionally, the workspace can periodically fetch the ref from a remote
+// and fast-forward to it, and push local commits back, so that configs can
+// be reviewed and edited with the normal git workflow.
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/identity"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// Number of times a commit is retried when the ref is concurrently updated
+// by another writer.
+const maxCommitAttempts = 10
+
+// Workspace opens loaders and explorers over a git repository.
+type Workspace struct {
+	repo *git.Repository
+	opts options
+
+	// Serializes read-modify-write cycles of the ref within this process.
+	// Updates from other processes are detected via compare and swap.
+	mu sync.Mutex
+
+	// Cancelled by Close, to stop periodic synchronization and interrupt
+	// any fetch or push in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type options struct {
+	path          string
+	ref           plumbing.ReferenceName
+	remote        string
+	init          bool
+	authorName    string
+	authorEmail   string
+	message       string
+	fetchInterval time.Duration
+	pushInterval  time.Duration
+	log           logger.Logger
+}
+
+// Modifier configures the git workspace.
+type Modifier func(*options) error
+
+// Flags holds configuration options for git stores.
+type Flags struct {
+	// Path to the git repository, bare or not.
+	Path string
+	// Ref to read from and commit to. Names not starting with refs/ are
+	// interpreted as branch names.
+	Ref string
+	// Remote used by Fetch and Push.
+	Remote string
+	// Init creates an empty bare repository if none exists at Path.
+	Init bool
+	// AuthorName and AuthorEmail override the author of the commits.
+	AuthorName  string
+	AuthorEmail string
+	// Message is used as the subject of the commits created.
+	Message string
+	// FetchInterval and PushInterval enable periodic synchronization with
+	// the remote when non-zero.
+	FetchInterval time.Duration
+	PushInterval  time.Duration
+}
+
+// DefaultFlags returns a new Flags struct with default values.
+func DefaultFlags() *Flags {
+	return &Flags{
+		Ref:    "main",
+		Remote: "origin",
+	}
+}
+
+// Register registers the git flags with the provided FlagSet.
+func (f *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
+	set.StringVar(&f.Path, prefix+"config-store-git-path", f.Path, "Path to the git repository (required when using git)")
+	set.StringVar(&f.Ref, prefix+"config-store-git-ref", f.Ref, "Branch or full ref configs are read from and committed to")
+	set.StringVar(&f.Remote, prefix+"config-store-git-remote", f.Remote, "Name of the git remote to fetch from and push to")
+	set.BoolVar(&f.Init, prefix+"config-store-git-init", f.Init, "Create an empty bare repository if the path does not contain one")
+	set.StringVar(&f.AuthorName, prefix+"config-store-git-author-name", f.AuthorName, "Author name for commits (defaults to the user from the identity flags)")
+	set.StringVar(&f.AuthorEmail, prefix+"config-store-git-author-email", f.AuthorEmail, "Author email for commits (defaults to the identity flags)")
+	set.StringVar(&f.Message, prefix+"config-store-git-message", f.Message, "Subject of the commits created on each change (optional)")
+	set.DurationVar(&f.FetchInterval, prefix+"config-store-git-fetch-interval", f.FetchInterval, "If non-zero, how often to fetch and fast-forward from the remote")
+	set.DurationVar(&f.PushInterval, prefix+"config-store-git-push-interval", f.PushInterval, "If non-zero, how often to push local commits to the remote")
+	return f
+}
+
+// FromFlags returns a Modifier that applies git flags.
+func FromFlags(flags *Flags) Modifier {
+	return func(o *options) error {
+		if flags == nil {
+			return nil
+		}
+		if flags.Path != "" {
+			o.path = flags.Path
+		}
+		if flags.Ref != "" {
+			o.ref = refName(flags.Ref)
+		}
+		if flags.Remote != "" {
+			o.remote = flags.Remote
+		}
+		if flags.Init {
+			o.init = true
+		}
+		if flags.AuthorName != "" {
+			o.authorName = flags.AuthorName
+		}
+		if flags.AuthorEmail != "" {
+			o.authorEmail = flags.AuthorEmail
+		}
+		if flags.Message != "" {
+			o.message = flags.Message
+		}
+		if flags.FetchInterval != 0 {
+			o.fetchInterval = flags.FetchInterval
+		}
+		if flags.PushInterval != 0 {
+			o.pushInterval = flags.PushInterval
+		}
+		return nil
+	}
+}
+
+// WithPath specifies the path of the git repository.
+func WithPath(path string) Modifier {
+	return func(o *options) error {
+		o.path = path
+		return nil
+	}
+}
+
+// WithRef specifies the branch or full ref to read from and commit to.
+func WithRef(ref string) Modifier {
+	return func(o *options) error {
+		o.ref = refName(ref)
+		return nil
+	}
+}
+
+// WithInit creates an empty bare repository if none exists.
+func WithInit(init bool) Modifier {
+	return func(o *options) error {
+		o.init = init
+		return nil
+	}
+}
+
+// WithAuthor sets the name and email of the author of the commits.
+func WithAuthor(name, email string) Modifier {
+	return func(o *options) error {
+		o.authorName = name
+		o.authorEmail = email
+		return nil
+	}
+}
+
+// WithIdentity uses the identity specified on the command line as author
+// of the commits, unless an author was already configured.
+func WithIdentity(ifl *identity.IdentityFlags) Modifier {
+	return func(o *options) error {
+		if ifl == nil || ifl.Identity() == "" {
+			return nil
+		}
+		if o.authorEmail == "" {
+			o.authorEmail = ifl.Identity()
+		}
+		if o.authorName == "" {
+			o.authorName = ifl.User()
+		}
+		return nil
+	}
+}
+
+// WithMessage sets the subject of the commits created.
+func WithMessage(message string) Modifier {
+	return func(o *options) error {
+		o.message = message
+		return nil
+	}
+}
+
+// WithSync enables periodic fetch and push with the named remote.
+//
+// An interval of 0 disables the corresponding operation.
+func WithSync(remote string, fetch, push time.Duration) Modifier {
+	return func(o *options) error {
+		o.remote = remote
+		o.fetchInterval = fetch
+		o.pushInterval = push
+		return nil
+	}
+}
+
+// WithLogger sets the logger used to report errors of periodic operations.
+func WithLogger(log logger.Logger) Modifier {
+	return func(o *options) error {
+		o.log = log
+		return nil
+	}
+}
+
+// New opens the git repository and returns a loader workspace backed by it.
+//
+// If periodic synchronization is configured, a background goroutine is
+// started, and stopped by Close.
+func New(mods ...Modifier) (*Workspace, error) {
+	opts := options{
+		ref:    plumbing.NewBranchReferenceName("main"),
+		remote: "origin",
+		log:    logger.Nil,
+	}
+	for _, mod := range mods {
+		if mod == nil {
+			continue
+		}
+		if err := mod(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.path == "" {
+		return nil, fmt.Errorf("git config store requires a repository path")
+	}
+	if opts.authorName == "" || opts.authorEmail == "" {
+		name, email := defaultAuthor()
+		if opts.authorName == "" {
+			opts.authorName = name
+		}
+		if opts.authorEmail == "" {
+			opts.authorEmail = email
+		}
+	}
+
+	repo, err := git.PlainOpen(opts.path)
+	if err == git.ErrRepositoryNotExists && opts.init {
+		repo, err = git.PlainInit(opts.path, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open git repository %s: %w", opts.path, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ws := &Workspace{repo: repo, opts: opts, ctx: ctx, cancel: cancel}
+	ws.startSync()
+	return ws, nil
+}
+
+// Open returns a Loader for the provided namespace.
+func (w *Workspace) Open(app string, namespaces ...string) (config.Loader, error) {
+	dir, err := treePath(app, namespaces...)
+	if err != nil {
+		return nil, err
+	}
+	return &Loader{ws: w, dir: dir}, nil
+}
+
+// Explore returns an explorer that lists child namespaces.
+func (w *Workspace) Explore(app string, namespaces ...string) (config.Explorer, error) {
+	if _, err := treePath(app, namespaces...); err != nil {
+		return nil, err
+	}
+	return &explorator{ws: w, app: app, base: append([]string(nil), namespaces...)}, nil
+}
+
+func (w *Workspace) ParsePath(path string) (config.ParsedPath, error) {
+	return config.DefaultParsePath(path)
+}
+
+// Close stops periodic synchronization, if any.
+//
+// A fetch or push in progress is cancelled, rather than waited for, so
+// Close does not hang on a slow or unreachable remote.
+func (w *Workspace) Close() error {
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+// Ref returns the name of the ref the workspace reads from and commits to.
+func (w *Workspace) Ref() plumbing.ReferenceName {
+	return w.opts.ref
+}
+
+// tree returns the tree of the commit the ref points to, or nil if the
+// ref does not exist yet.
+func (w *Workspace) tree() (*object.Tree, error) {
+	ref, err := w.repo.Storer.Reference(w.opts.ref)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	commit, err := w.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// subtree returns the tree at dir, or nil if it does not exist.
+func (w *Workspace) subtree(dir []string) (*object.Tree, error) {
+	tree, err := w.tree()
+	if err != nil || tree == nil || len(dir) == 0 {
+		return tree, err
+	}
+	sub, err := tree.Tree(strings.Join(dir, "/"))
+	if err == object.ErrDirectoryNotFound {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// commit applies change to the root tree of the ref, and records the result
+// as a new commit.
+//
+// change receives the hash of the current root tree, plumbing.ZeroHash if
+// the ref does not exist yet, and returns the hash of the new root tree.
+// If the tree is unchanged, no commit is created.
+func (w *Workspace) commit(action string, path []string, change func(root plumbing.Hash) (plumbing.Hash, error)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		old, err := w.repo.Storer.Reference(w.opts.ref)
+		if err != nil && err != plumbing.ErrReferenceNotFound {
+			return err
+		}
+
+		var parents []plumbing.Hash
+		root := plumbing.ZeroHash
+		if old != nil {
+			parent, err := w.repo.CommitObject(old.Hash())
+			if err != nil {
+				return err
+			}
+			parents = append(parents, parent.Hash)
+			root = parent.TreeHash
+		}
+
+		updated, err := change(root)
+		if err != nil {
+			return err
+		}
+		if updated == root {
+			return nil
+		}
+		if updated.IsZero() {
+			if updated, err = w.storeTree(nil); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		signature := object.Signature{Name: w.opts.authorName, Email: w.opts.authorEmail, When: now}
+		message := fmt.Sprintf("%s %s\n", action, strings.Join(path, "/"))
+		if w.opts.message != "" {
+			message = w.opts.message + "\n\n" + message
+		}
+		commit := &object.Commit{
+			Author:       signature,
+			Committer:    signature,
+			Message:      message,
+			TreeHash:     updated,
+			ParentHashes: parents,
+		}
+		obj := w.repo.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			return err
+		}
+		hash, err := w.repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return err
+		}
+
+		err = w.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(w.opts.ref, hash), old)
+		if err == nil {
+			return nil
+		}
+		if err != storage.ErrReferenceHasChanged || attempt >= maxCommitAttempts {
+			return fmt.Errorf("could not update %s: %w", w.opts.ref, err)
+		}
+	}
+}
+
+// setPath returns the hash of the tree obtained by replacing the entry at
+// path in the tree identified by root with entry, or by removing it if entry
+// is nil. Trees left empty are removed, and returned as plumbing.ZeroHash.
+func (w *Workspace) setPath(root plumbing.Hash, path []string, entry *object.TreeEntry) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	if !root.IsZero() {
+		tree, err := object.GetTree(w.repo.Storer, root)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, tree.Entries...)
+	}
+
+	name := path[0]
+	index := -1
+	for i, existing := range entries {
+		if existing.Name == name {
+			index = i
+			break
+		}
+	}
+
+	updated := entry
+	if len(path) > 1 {
+		child := plumbing.ZeroHash
+		if index >= 0 && entries[index].Mode == filemode.Dir {
+			child = entries[index].Hash
+		}
+		if child.IsZero() && entry == nil {
+			return plumbing.ZeroHash, notExist(path)
+		}
+		hash, err := w.setPath(child, path[1:], entry)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		updated = nil
+		if !hash.IsZero() {
+			updated = &object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash}
+		}
+	}
+
+	switch {
+	case updated != nil && index >= 0:
+		entries[index] = *updated
+	case updated != nil:
+		entries = append(entries, *updated)
+	case index >= 0:
+		entries = append(entries[:index], entries[index+1:]...)
+	default:
+		return plumbing.ZeroHash, notExist(path)
+	}
+
+	if len(entries) == 0 {
+		return plumbing.ZeroHash, nil
+	}
+	return w.storeTree(entries)
+}
+
+func (w *Workspace) storeTree(entries []object.TreeEntry) (plumbing.Hash, error) {
+	sort.Sort(object.TreeEntrySorter(entries))
+	tree := &object.Tree{Entries: entries}
+	obj := w.repo.Storer.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return w.repo.Storer.SetEncodedObject(obj)
+}
+
+func (w *Workspace) storeBlob(data []byte) (plumbing.Hash, error) {
+	obj := w.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(data)))
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := writer.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return w.repo.Storer.SetEncodedObject(obj)
+}
+
+// Loader reads and writes files in a directory of the git tree.
+type Loader struct {
+	ws  *Workspace
+	dir []string
+}
+
+func (l *Loader) path(name string) ([]string, error) {
+	if err := checkName("key", name); err != nil {
+		return nil, err
+	}
+	return append(append([]string(nil), l.dir...), name), nil
+}
+
+func (l *Loader) List(mods ...config.ListModifier) ([]string, error) {
+	opts := &config.ListOptions{}
+	if err := config.ListModifiers(mods).Apply(opts); err != nil {
+		return nil, err
+	}
+	tree, err := l.ws.subtree(l.dir)
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range tree.Entries {
+		if !entry.Mode.IsFile() {
+			continue
+		}
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	return opts.FinalizeKeys(l, names, 0)
+}
+
+func (l *Loader) Read(name string) ([]byte, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := l.ws.subtree(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return nil, notExist(path)
+	}
+	file, err := tree.File(name)
+	if err == object.ErrFileNotFound {
+		return nil, notExist(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(contents), nil
+}
+
+func (l *Loader) Write(name string, data []byte) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	blob, err := l.ws.storeBlob(data)
+	if err != nil {
+		return err
+	}
+	entry := &object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: blob}
+	return l.ws.commit("Update", path, func(root plumbing.Hash) (plumbing.Hash, error) {
+		return l.ws.setPath(root, path, entry)
+	})
+}
+
+func (l *Loader) Delete(name string) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return l.ws.commit("Delete", path, func(root plumbing.Hash) (plumbing.Hash, error) {
+		return l.ws.setPath(root, path, nil)
+	})
+}
+
+func (l *Loader) Close() error {
+	return nil
+}
+
+type explorator struct {
+	ws   *Workspace
+	app  string
+	base []string
+}
+
+func (e *explorator) List(mods ...config.ListModifier) ([]config.Descriptor, error) {
+	opts := &config.ListOptions{}
+	if err := config.ListModifiers(mods).Apply(opts); err != nil {
+		return nil, err
+	}
+	if opts.Unmarshal != nil {
+		return nil, fmt.Errorf("namespace list does not support unmarshal")
+	}
+	dir, err := treePath(e.app, e.base...)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := e.ws.subtree(dir)
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	children := []string{}
+	for _, entry := range tree.Entries {
+		if entry.Mode == filemode.Dir {
+			children = append(children, entry.Name)
+		}
+	}
+	descs := config.SortedNamespaceDescriptors(e.base, children)
+	return opts.Apply(descs, 0), nil
+}
+
+func (e *explorator) Delete(desc config.Descriptor) error {
+	path, err := treePath(e.app, config.NamespacePathFromDescriptor(e.base, desc)...)
+	if err != nil {
+		return err
+	}
+	return e.ws.commit("Delete", path, func(root plumbing.Hash) (plumbing.Hash, error) {
+		return e.ws.setPath(root, path, nil)
+	})
+}
+
+func (e *explorator) Close() error { return nil }
+
+// treePath converts an app and namespaces into the path of a directory
+// in the git tree.
+//
+// Each of them becomes an entry of the tree, and must be a valid name, see checkName.
+func treePath(app string, namespaces ...string) ([]string, error) {
+	if err := checkName("app", app); err != nil {
+		return nil, err
+	}
+	for _, namespace := range namespaces {
+		if err := checkName("namespace", namespace); err != nil {
+			return nil, err
+		}
+	}
+	return append([]string{app}, namespaces...), nil
+}
+
+// checkName returns an error if name cannot be used as the name of an entry in a git tree.
+//
+// Names like "..", or containing a "/", would produce a corrupt tree, or refer to
+// entries outside of the namespace.
+func checkName(kind, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid %s name %q for a git store", kind, name)
+	}
+	return nil
+}
+
+func refName(ref string) plumbing.ReferenceName {
+	if strings.HasPrefix(ref, "refs/") {
+		return plumbing.ReferenceName(ref)
+	}
+	return plumbing.NewBranchReferenceName(ref)
+}
+
+func notExist(path []string) error {
+	return &fs.PathError{Op: "open", Path: strings.Join(path, "/"), Err: os.ErrNotExist}
+}
+
+func defaultAuthor() (string, string) {
+	name := "enkit"
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		name = current.Username
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return name, name + "@" + host
+}
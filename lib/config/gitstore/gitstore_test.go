@@ -0,0 +1,221 @@
+package gitstore
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/identity"
+	"github.com/ccontavalli/enkit/lib/config/marshal"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConfig struct {
+	Value string `json:"value"`
+}
+
+func TestGitStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	ifl := &identity.IdentityFlags{UserDomain: "alice@example.com"}
+	ws, err := New(WithPath(dir), WithInit(true), WithIdentity(ifl), WithMessage("proxy mappings"))
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	store := config.NewSimple(ws, marshal.Json)
+	users, err := store.Open("myapp", "users")
+	assert.NoError(t, err)
+	hosts, err := store.Open("myapp", "hosts")
+	assert.NoError(t, err)
+
+	assert.NoError(t, users.Marshal(config.Key("alice"), testConfig{Value: "hello"}))
+	assert.NoError(t, hosts.Marshal(config.Key("a/b"), testConfig{Value: "host"}))
+
+	var loaded testConfig
+	_, err = users.Unmarshal(config.Key("alice"), &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", loaded.Value)
+
+	_, err = hosts.Unmarshal(config.Key("a/b"), &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "host", loaded.Value)
+
+	// The commit is authored by the identity, with the configured subject.
+	ref, err := ws.repo.Reference(ws.Ref(), true)
+	assert.NoError(t, err)
+	head, err := ws.repo.CommitObject(ref.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", head.Author.Email)
+	assert.Equal(t, "alice", head.Author.Name)
+	assert.Equal(t, "proxy mappings\n\nUpdate myapp/hosts/a%2Fb.json\n", head.Message)
+	assert.Len(t, head.ParentHashes, 1)
+
+	// Writing the same value does not create an empty commit.
+	assert.NoError(t, hosts.Marshal(config.Key("a/b"), testConfig{Value: "host"}))
+	same, err := ws.repo.Reference(ws.Ref(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, ref.Hash(), same.Hash())
+
+	explorer, err := ws.Explore("myapp")
+	assert.NoError(t, err)
+	namespaces, err := explorer.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hosts", "users"}, descriptorKeys(namespaces))
+
+	assert.NoError(t, users.Delete(config.Key("alice")))
+	_, err = users.Unmarshal(config.Key("alice"), &loaded)
+	assert.True(t, os.IsNotExist(err), "%v", err)
+	err = users.Delete(config.Key("alice"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// Deleting the last key removes the namespace.
+	namespaces, err = explorer.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hosts"}, descriptorKeys(namespaces))
+
+	assert.NoError(t, explorer.Delete(namespaces[0]))
+	namespaces, err = explorer.List()
+	assert.NoError(t, err)
+	assert.Len(t, namespaces, 0)
+	assert.True(t, os.IsNotExist(explorer.Delete(config.Key("hosts"))))
+}
+
+func TestGitStoreInvalidNames(t *testing.T) {
+	ws, err := New(WithPath(t.TempDir()), WithInit(true))
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	for _, name := range []string{"", ".", "..", "a/b", "../users", "a\x00b"} {
+		_, err := ws.Open(name)
+		assert.Error(t, err, "app %q", name)
+		_, err = ws.Open("myapp", "users", name)
+		assert.Error(t, err, "namespace %q", name)
+		_, err = ws.Explore("myapp", name)
+		assert.Error(t, err, "namespace %q", name)
+
+		loader, err := ws.Open("myapp", "users")
+		assert.NoError(t, err)
+		assert.Error(t, loader.Write(name, []byte("data")), "key %q", name)
+		_, err = loader.Read(name)
+		assert.Error(t, err, "key %q", name)
+		assert.False(t, os.IsNotExist(err), "key %q", name)
+		assert.Error(t, loader.Delete(name), "key %q", name)
+	}
+
+	// Nothing was committed.
+	_, err = ws.repo.Reference(ws.Ref(), true)
+	assert.Error(t, err)
+}
+
+func TestGitStoreMissingRepository(t *testing.T) {
+	_, err := New(WithPath(t.TempDir()))
+	assert.Error(t, err)
+
+	_, err = New()
+	assert.Error(t, err)
+}
+
+func TestGitStoreFetchPush(t *testing.T) {
+	ctx := context.Background()
+	upstream := t.TempDir()
+	_, err := git.PlainInit(upstream, true)
+	assert.NoError(t, err)
+
+	open := func() (*Workspace, config.Store) {
+		dir := t.TempDir()
+		repo, err := git.PlainInit(dir, true)
+		assert.NoError(t, err)
+		_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{upstream}})
+		assert.NoError(t, err)
+
+		ws, err := New(WithPath(dir), WithAuthor("test", "test@example.com"))
+		assert.NoError(t, err)
+		loader, err := ws.Open("app")
+		assert.NoError(t, err)
+		return ws, config.OpenSimple(loader, marshal.Json)
+	}
+
+	first, firstStore := open()
+	defer first.Close()
+	second, secondStore := open()
+	defer second.Close()
+
+	assert.NoError(t, firstStore.Marshal(config.Key("key"), testConfig{Value: "first"}))
+	assert.NoError(t, first.Push(ctx))
+	assert.NoError(t, second.Fetch(ctx))
+
+	var loaded testConfig
+	_, err = secondStore.Unmarshal(config.Key("key"), &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", loaded.Value)
+
+	// Fast forward on top of local changes.
+	assert.NoError(t, secondStore.Marshal(config.Key("key"), testConfig{Value: "second"}))
+	assert.NoError(t, second.Push(ctx))
+	assert.NoError(t, first.Fetch(ctx))
+	_, err = firstStore.Unmarshal(config.Key("key"), &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", loaded.Value)
+
+	// Diverged histories are never merged automatically.
+	assert.NoError(t, firstStore.Marshal(config.Key("key"), testConfig{Value: "diverged-first"}))
+	assert.NoError(t, secondStore.Marshal(config.Key("key"), testConfig{Value: "diverged-second"}))
+	assert.NoError(t, second.Push(ctx))
+	assert.Error(t, first.Fetch(ctx))
+	assert.Error(t, first.Push(ctx))
+	_, err = firstStore.Unmarshal(config.Key("key"), &loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "diverged-first", loaded.Value)
+}
+
+func TestGitStoreCloseCancelsSync(t *testing.T) {
+	// A remote accepting connections, and never answering.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, true)
+	assert.NoError(t, err)
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{"http://" + listener.Addr().String() + "/repo"}})
+	assert.NoError(t, err)
+
+	ws, err := New(WithPath(dir), WithAuthor("test", "test@example.com"), WithSync("origin", 10*time.Millisecond, 0))
+	assert.NoError(t, err)
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatal("periodic fetch never reached the remote")
+	}
+
+	closed := make(chan error)
+	go func() { closed <- ws.Close() }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close waited for the fetch in progress")
+	}
+}
+
+func descriptorKeys(descs []config.Descriptor) []string {
+	keys := []string{}
+	for _, desc := range descs {
+		keys = append(keys, desc.Key())
+	}
+	return keys
+}
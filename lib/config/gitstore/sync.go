@@ -0,0 +1,117 @@
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// trackingRef returns the name of the ref used to store the state of the
+// configured ref on the remote.
+func (w *Workspace) trackingRef() plumbing.ReferenceName {
+	return plumbing.NewRemoteReferenceName(w.opts.remote, w.opts.ref.Short())
+}
+
+// Fetch retrieves the configured ref from the remote, and fast-forwards the
+// local ref to it.
+//
+// Local commits not yet pushed are preserved. If the local and remote refs
+// have diverged, an error is returned and the local ref is left untouched.
+func (w *Workspace) Fetch(ctx context.Context) error {
+	tracking := w.trackingRef()
+	spec := gitconfig.RefSpec(fmt.Sprintf("+%s:%s", w.opts.ref, tracking))
+	err := w.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: w.opts.remote,
+		RefSpecs:   []gitconfig.RefSpec{spec},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("could not fetch %s from %s: %w", w.opts.ref, w.opts.remote, err)
+	}
+
+	remote, err := w.repo.Storer.Reference(tracking)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	local, err := w.repo.Storer.Reference(w.opts.ref)
+	if err != nil && err != plumbing.ErrReferenceNotFound {
+		return err
+	}
+	if local != nil {
+		if local.Hash() == remote.Hash() {
+			return nil
+		}
+		localCommit, err := w.repo.CommitObject(local.Hash())
+		if err != nil {
+			return err
+		}
+		remoteCommit, err := w.repo.CommitObject(remote.Hash())
+		if err != nil {
+			return err
+		}
+		// Local commits still to be pushed.
+		if ahead, err := remoteCommit.IsAncestor(localCommit); err != nil || ahead {
+			return err
+		}
+		behind, err := localCommit.IsAncestor(remoteCommit)
+		if err != nil {
+			return err
+		}
+		if !behind {
+			return fmt.Errorf("%s has diverged from %s on %s, manual merge required", w.opts.ref, tracking, w.opts.remote)
+		}
+	}
+	return w.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(w.opts.ref, remote.Hash()), local)
+}
+
+// Push sends the configured ref to the remote.
+//
+// Push fails if the remote ref has commits that were not fetched yet.
+func (w *Workspace) Push(ctx context.Context) error {
+	spec := gitconfig.RefSpec(fmt.Sprintf("%s:%s", w.opts.ref, w.opts.ref))
+	err := w.repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: w.opts.remote,
+		RefSpecs:   []gitconfig.RefSpec{spec},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("could not push %s to %s: %w", w.opts.ref, w.opts.remote, err)
+	}
+	return nil
+}
+
+func (w *Workspace) startSync() {
+	w.every(w.opts.fetchInterval, "fetch", w.Fetch)
+	w.every(w.opts.pushInterval, "push", w.Push)
+}
+
+func (w *Workspace) every(interval time.Duration, name string, op func(context.Context) error) {
+	if interval <= 0 {
+		return
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := op(w.ctx); err != nil && w.ctx.Err() == nil {
+				w.opts.log.Warnf("config store git %s failed: %v", name, err)
+			}
+		}
+	}()
+}
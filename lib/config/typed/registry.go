@@ -0,0 +1,55 @@
+package typed
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ccontavalli/enkit/lib/config"
+)
+
+// Migrator upgrades the documents in a store without knowledge of their type.
+//
+// *Schema[T] implements Migrator.
+type Migrator interface {
+	Version() int
+	Migrate(store config.Store, dryRun bool) ([]Migration, error)
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Migrator{}
+)
+
+// Register makes a schema available by name to generic tools, like
+// `enconfig migrate`, linked in the same binary.
+//
+// It is meant to be called from an init() function, with a name identifying
+// the type, like "myapp.Config". Registering the same name twice panics.
+func Register(name string, migrator Migrator) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, found := registry[name]; found {
+		panic(fmt.Sprintf("schema %q registered twice", name))
+	}
+	registry[name] = migrator
+}
+
+// Lookup returns the schema registered with name, or nil.
+func Lookup(name string) Migrator {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registry[name]
+}
+
+// Registered returns the sorted names of all registered schemas.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,236 @@
+package typed
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/multierror"
+)
+
+// ErrUnsupportedVersion is returned when a document was stored with a schema
+// version that is newer than the current one, or for which no upgrade exists.
+var ErrUnsupportedVersion = errors.New("unsupported schema version")
+
+// ErrInvalid is returned, wrapped, when a validation function rejects a document.
+var ErrInvalid = errors.New("invalid document")
+
+// Versioned is implemented by config structs that record the version of the
+// schema they were stored with.
+//
+// The methods are looked up on *T: SetSchemaVersion is invoked on the value
+// before it is stored, GetSchemaVersion after it is loaded.
+//
+// Example:
+//
+//	type Config struct {
+//	    Version int
+//	    ...
+//	}
+//
+//	func (c *Config) GetSchemaVersion() int        { return c.Version }
+//	func (c *Config) SetSchemaVersion(version int) { c.Version = version }
+type Versioned interface {
+	GetSchemaVersion() int
+	SetSchemaVersion(version int)
+}
+
+// Reader decodes the document being loaded into the value supplied.
+//
+// It can be invoked multiple times, with values of different types, to
+// inspect the document before deciding how to upgrade it.
+type Reader func(value interface{}) error
+
+// Schema describes the current version of documents of type T, how to
+// upgrade documents stored with an older version, and how to validate them.
+//
+// Attach a Schema to a Store[T] with WithSchema:
+//
+//	schema := typed.NewSchema[Config](2).Validate(func(c *Config) error {
+//	    if c.Server == "" {
+//	        return fmt.Errorf("server must be set")
+//	    }
+//	    return nil
+//	})
+//	typed.Upgrade(schema, 1, func(old ConfigV1) (Config, error) {
+//	    return Config{Server: old.Host}, nil
+//	})
+//
+//	store := typed.Wrap[Config](raw).WithSchema(schema)
+type Schema[T any] struct {
+	version    int
+	detect     func(Reader) (int, error)
+	upgrades   map[int]func(Reader) (T, error)
+	validators []func(*T) error
+}
+
+// NewSchema returns a Schema for documents of type T at the specified version.
+func NewSchema[T any](version int) *Schema[T] {
+	return &Schema[T]{
+		version:  version,
+		upgrades: map[int]func(Reader) (T, error){},
+	}
+}
+
+// Version returns the current version of the schema.
+func (s *Schema[T]) Version() int {
+	return s.version
+}
+
+// Detect overrides the function used to determine the version of a stored
+// document.
+//
+// By default, documents are decoded as T, and the version returned by
+// Versioned.GetSchemaVersion is used. If T does not implement Versioned,
+// documents are assumed to be at the current version.
+//
+// Detect is useful to recognize documents stored before versioning was
+// introduced, typically by decoding them into a legacy type.
+func (s *Schema[T]) Detect(detect func(read Reader) (int, error)) *Schema[T] {
+	s.detect = detect
+	return s
+}
+
+// Validate adds a function run on every document before it is stored, and
+// after it is loaded and upgraded.
+func (s *Schema[T]) Validate(validate func(*T) error) *Schema[T] {
+	s.validators = append(s.validators, validate)
+	return s
+}
+
+// Upgrade registers a function converting documents stored with version
+// from, decoded as type Old, into the current version of the schema.
+//
+// Old can be T itself if the type did not change, but the meaning or
+// defaults of its fields did.
+func Upgrade[Old, T any](s *Schema[T], from int, upgrade func(Old) (T, error)) *Schema[T] {
+	s.upgrades[from] = func(read Reader) (T, error) {
+		var old Old
+		if err := read(&old); err != nil {
+			var zero T
+			return zero, err
+		}
+		return upgrade(old)
+	}
+	return s
+}
+
+// Load decodes a document into target, upgrading it to the current version
+// and validating it.
+//
+// It returns the version the document was stored with.
+func (s *Schema[T]) Load(read Reader, target *T) (int, error) {
+	version, err := s.detectVersion(read)
+	if err != nil {
+		return version, err
+	}
+
+	switch {
+	case version == s.version:
+		if err := read(target); err != nil {
+			return version, err
+		}
+	case version > s.version:
+		return version, fmt.Errorf("%w: document has version %d, newest known is %d", ErrUnsupportedVersion, version, s.version)
+	default:
+		upgrade, found := s.upgrades[version]
+		if !found {
+			return version, fmt.Errorf("%w: no upgrade from version %d to %d", ErrUnsupportedVersion, version, s.version)
+		}
+		value, err := upgrade(read)
+		if err != nil {
+			return version, fmt.Errorf("upgrade from version %d failed: %w", version, err)
+		}
+		*target = value
+		s.stamp(target)
+	}
+	return version, s.check(target)
+}
+
+// Prepare stamps the current version on value, and validates it.
+//
+// It is invoked automatically by Store[T].Marshal.
+func (s *Schema[T]) Prepare(value *T) error {
+	s.stamp(value)
+	return s.check(value)
+}
+
+// Migration describes a document upgraded by Migrate.
+type Migration struct {
+	Descriptor config.Descriptor
+	From       int
+	To         int
+}
+
+// Migrate upgrades in place all the documents in store that were stored
+// with an older version of the schema.
+//
+// Documents that cannot be loaded or fail validation are skipped, and
+// reported in the returned error. If dryRun is true, documents are upgraded
+// and validated but not written back.
+func (s *Schema[T]) Migrate(store config.Store, dryRun bool) ([]Migration, error) {
+	descs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []Migration
+	var errs []error
+	for _, desc := range descs {
+		got := desc
+		read := func(value interface{}) error {
+			var err error
+			got, err = store.Unmarshal(desc, value)
+			return err
+		}
+
+		var value T
+		from, err := s.Load(read, &value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", desc.Key(), err))
+			continue
+		}
+		if from == s.version {
+			continue
+		}
+		if !dryRun {
+			if err := store.Marshal(got, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", desc.Key(), err))
+				continue
+			}
+		}
+		migrated = append(migrated, Migration{Descriptor: got, From: from, To: s.version})
+	}
+	return migrated, multierror.New(errs)
+}
+
+func (s *Schema[T]) detectVersion(read Reader) (int, error) {
+	if s.detect != nil {
+		return s.detect(read)
+	}
+
+	var value T
+	versioned, ok := any(&value).(Versioned)
+	if !ok {
+		return s.version, nil
+	}
+	if err := read(&value); err != nil {
+		return 0, err
+	}
+	return versioned.GetSchemaVersion(), nil
+}
+
+func (s *Schema[T]) stamp(value *T) {
+	if versioned, ok := any(value).(Versioned); ok {
+		versioned.SetSchemaVersion(s.version)
+	}
+}
+
+func (s *Schema[T]) check(value *T) error {
+	for _, validate := range s.validators {
+		if err := validate(value); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package typed_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/marshal"
+	"github.com/ccontavalli/enkit/lib/config/memory"
+	"github.com/ccontavalli/enkit/lib/config/typed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type serverV0 struct {
+	Host string
+	Port int
+}
+
+type serverConfig struct {
+	Version int
+	Address string
+}
+
+func (c *serverConfig) GetSchemaVersion() int        { return c.Version }
+func (c *serverConfig) SetSchemaVersion(version int) { c.Version = version }
+
+func serverSchema() *typed.Schema[serverConfig] {
+	schema := typed.NewSchema[serverConfig](1).Validate(func(c *serverConfig) error {
+		if c.Address == "" {
+			return fmt.Errorf("address must be set")
+		}
+		return nil
+	})
+	return typed.Upgrade(schema, 0, func(old serverV0) (serverConfig, error) {
+		return serverConfig{Address: fmt.Sprintf("%s:%d", old.Host, old.Port)}, nil
+	})
+}
+
+func openServerStores(t *testing.T) (config.Store, typed.Store[serverConfig]) {
+	ws := config.NewSimple(memory.NewMarshal(), marshal.Json)
+	raw, err := ws.Open("app", "servers")
+	require.NoError(t, err)
+	return raw, typed.Wrap[serverConfig](raw).WithSchema(serverSchema())
+}
+
+func TestSchemaUpgradeOnLoad(t *testing.T) {
+	raw, store := openServerStores(t)
+	require.NoError(t, raw.Marshal(config.Key("old"), serverV0{Host: "example.com", Port: 53}))
+
+	got, _, err := store.Get(config.Key("old"))
+	require.NoError(t, err)
+	assert.Equal(t, serverConfig{Version: 1, Address: "example.com:53"}, got)
+
+	// Loading does not modify the stored document.
+	var old serverV0
+	_, err = raw.Unmarshal(config.Key("old"), &old)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", old.Host)
+
+	require.NoError(t, store.Marshal(config.Key("new"), serverConfig{Address: "127.0.0.1:53"}))
+	values, err := store.Values()
+	require.NoError(t, err)
+	assert.Equal(t, []serverConfig{
+		{Version: 1, Address: "127.0.0.1:53"},
+		{Version: 1, Address: "example.com:53"},
+	}, values)
+}
+
+func TestSchemaValidation(t *testing.T) {
+	raw, store := openServerStores(t)
+
+	err := store.Marshal(config.Key("empty"), serverConfig{})
+	assert.True(t, errors.Is(err, typed.ErrInvalid), "%v", err)
+	_, err = raw.Unmarshal(config.Key("empty"), &serverConfig{})
+	assert.Error(t, err)
+
+	require.NoError(t, raw.Marshal(config.Key("malformed"), serverConfig{Version: 1}))
+	_, _, err = store.Get(config.Key("malformed"))
+	assert.True(t, errors.Is(err, typed.ErrInvalid), "%v", err)
+
+	require.NoError(t, raw.Marshal(config.Key("future"), serverConfig{Version: 7, Address: "a:1"}))
+	_, _, err = store.Get(config.Key("future"))
+	assert.True(t, errors.Is(err, typed.ErrUnsupportedVersion), "%v", err)
+}
+
+func TestSchemaMigrate(t *testing.T) {
+	raw, store := openServerStores(t)
+	require.NoError(t, raw.Marshal(config.Key("a"), serverV0{Host: "a.example.com", Port: 1}))
+	require.NoError(t, raw.Marshal(config.Key("b"), serverV0{Host: "b.example.com", Port: 2}))
+	require.NoError(t, store.Marshal(config.Key("c"), serverConfig{Address: "c.example.com:3"}))
+
+	migrated, err := store.Migrate(true)
+	require.NoError(t, err)
+	assert.Len(t, migrated, 2)
+	var current serverConfig
+	_, err = raw.Unmarshal(config.Key("a"), &current)
+	require.NoError(t, err)
+	assert.Equal(t, 0, current.Version)
+
+	migrated, err = store.Migrate(false)
+	require.NoError(t, err)
+	require.Len(t, migrated, 2)
+	assert.Equal(t, "a", migrated[0].Descriptor.Key())
+	assert.Equal(t, 0, migrated[0].From)
+	assert.Equal(t, 1, migrated[0].To)
+
+	_, err = raw.Unmarshal(config.Key("b"), &current)
+	require.NoError(t, err)
+	assert.Equal(t, serverConfig{Version: 1, Address: "b.example.com:2"}, current)
+
+	migrated, err = store.Migrate(false)
+	require.NoError(t, err)
+	assert.Len(t, migrated, 0)
+}
+
+func TestRegistry(t *testing.T) {
+	typed.Register("typed_test.serverConfig", serverSchema())
+	assert.Contains(t, typed.Registered(), "typed_test.serverConfig")
+	assert.Equal(t, 1, typed.Lookup("typed_test.serverConfig").Version())
+	assert.Nil(t, typed.Lookup("typed_test.missing"))
+	assert.Panics(t, func() { typed.Register("typed_test.serverConfig", serverSchema()) })
+}
@@ -1,10 +1,18 @@
 package typed
 
-import "github.com/ccontavalli/enkit/lib/config"
+import (
+	"fmt"
+
+	"github.com/ccontavalli/enkit/lib/config"
+)
 
 // Store wraps a config.Store and provides typed helpers for Marshal/Unmarshal and List.
+//
+// If a Schema is attached with WithSchema, documents are validated before
+// being stored, and upgraded and validated when loaded.
 type Store[T any] struct {
 	config.Store
+	schema *Schema[T]
 }
 
 // Wrap wraps a config.Store into a typed store.
@@ -21,6 +29,17 @@ func OpenAs[T any](ws config.StoreWorkspace, app string, namespace ...string) (S
 	return Wrap[T](store), nil
 }
 
+// WithSchema returns a copy of the store using the supplied schema.
+func (s Store[T]) WithSchema(schema *Schema[T]) Store[T] {
+	s.schema = schema
+	return s
+}
+
+// Schema returns the schema attached to the store, or nil.
+func (s Store[T]) Schema() *Schema[T] {
+	return s.schema
+}
+
 // List forwards to the underlying store.
 func (s Store[T]) List(mods ...config.ListModifier) ([]config.Descriptor, error) {
 	return s.Store.List(mods...)
@@ -28,12 +47,27 @@ func (s Store[T]) List(mods ...config.ListModifier) ([]config.Descriptor, error)
 
 // Marshal stores the value into the descriptor.
 func (s Store[T]) Marshal(desc config.Descriptor, value T) error {
+	if s.schema != nil {
+		if err := s.schema.Prepare(&value); err != nil {
+			return err
+		}
+	}
 	return s.Store.Marshal(desc, value)
 }
 
 // Unmarshal reads into target.
 func (s Store[T]) Unmarshal(desc config.Descriptor, target *T) (config.Descriptor, error) {
-	return s.Store.Unmarshal(desc, target)
+	if s.schema == nil {
+		return s.Store.Unmarshal(desc, target)
+	}
+
+	got := desc
+	_, err := s.schema.Load(func(value interface{}) error {
+		var err error
+		got, err = s.Store.Unmarshal(desc, value)
+		return err
+	}, target)
+	return got, err
 }
 
 // Delete removes the descriptor.
@@ -49,12 +83,16 @@ func (s Store[T]) Close() error {
 // Get returns the unmarshaled value by key.
 func (s Store[T]) Get(desc config.Descriptor) (T, config.Descriptor, error) {
 	var out T
-	got, err := s.Store.Unmarshal(desc, &out)
+	got, err := s.Unmarshal(desc, &out)
 	return out, got, err
 }
 
 // Each lists entries and invokes fn for each unmarshaled value.
 func (s Store[T]) Each(fn func(config.Descriptor, *T) error, mods ...config.ListModifier) error {
+	if s.schema != nil {
+		return s.eachWithSchema(fn, mods...)
+	}
+
 	var target T
 	mods = append(mods, config.Unmarshal(&target, fn))
 	_, err := s.Store.List(mods...)
@@ -64,13 +102,41 @@ func (s Store[T]) Each(fn func(config.Descriptor, *T) error, mods ...config.List
 // Values lists entries and returns the unmarshaled values.
 func (s Store[T]) Values(mods ...config.ListModifier) ([]T, error) {
 	var out []T
-	var target T
-	mods = append(mods, config.Unmarshal(&target, func(_ config.Descriptor, value *T) error {
+	err := s.Each(func(_ config.Descriptor, value *T) error {
 		out = append(out, *value)
 		return nil
-	}))
-	if _, err := s.Store.List(mods...); err != nil {
+	}, mods...)
+	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
+
+// Migrate upgrades in place the documents stored with an older version of
+// the attached schema. See Schema.Migrate.
+func (s Store[T]) Migrate(dryRun bool) ([]Migration, error) {
+	if s.schema == nil {
+		return nil, fmt.Errorf("no schema attached to the store")
+	}
+	return s.schema.Migrate(s.Store, dryRun)
+}
+
+// eachWithSchema lists the descriptors first, and unmarshals them one by
+// one, so documents go through the upgrade and validation of the schema.
+func (s Store[T]) eachWithSchema(fn func(config.Descriptor, *T) error, mods ...config.ListModifier) error {
+	descs, err := s.Store.List(mods...)
+	if err != nil {
+		return err
+	}
+	for _, desc := range descs {
+		var value T
+		got, err := s.Unmarshal(desc, &value)
+		if err != nil {
+			return err
+		}
+		if err := fn(got, &value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
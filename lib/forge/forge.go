@@ -0,0 +1,76 @@
+// Package forge abstracts the operations on pull requests needed by bots
+// and CI pipelines across code hosting services (forges) like github,
+// gitlab or gitea.
+//
+// The interface is deliberately minimal: comments can be listed, added
+// and edited, and the metadata of the pull request can be retrieved.
+//
+// This package provides the gitlab and gitea implementations, talking
+// directly to their REST APIs. The github implementation is provided by
+// the RepoClient object in lib/github.
+package forge
+
+import (
+	"context"
+	"time"
+)
+
+// Comment is a free form comment posted on a pull request.
+type Comment struct {
+	ID     int64
+	Author string
+	Body   string
+}
+
+// PullRequest is the metadata of a pull request (merge request, in gitlab).
+type PullRequest struct {
+	Number      int
+	Title       string
+	Description string
+	Author      string
+	State       string
+	URL         string
+
+	// Branch the changes are coming from, and last commit on it.
+	SourceBranch string
+	HeadSHA      string
+	// Branch the changes are going to be merged in.
+	TargetBranch string
+}
+
+// Forge is a code hosting service holding a repository.
+//
+// All methods operate on the repository the Forge was configured with.
+// Pull requests are identified by the number visible to users, the
+// iid in gitlab terminology, the index in gitea.
+type Forge interface {
+	// ListComments returns the free form comments of a pull request, oldest first.
+	//
+	// Comments generated by the forge itself (pushes, label changes, ...)
+	// are not returned.
+	ListComments(pr int) ([]Comment, error)
+
+	// AddComment posts a new comment, returning its id.
+	AddComment(pr int, body string) (int64, error)
+
+	// EditComment replaces the body of a previously posted comment.
+	EditComment(pr int, id int64, body string) error
+
+	// GetPullRequest returns the metadata of a pull request.
+	GetPullRequest(pr int) (*PullRequest, error)
+}
+
+// ContextFactory creates a context for use with the forge operations.
+type ContextFactory func() (context.Context, context.CancelFunc)
+
+// TimeoutContextFactory returns a ContextFactory that will timeout
+// the operations if they don't complete within the specified duration.
+func TimeoutContextFactory(ctx context.Context, timeout time.Duration) ContextFactory {
+	return func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, timeout)
+	}
+}
+
+var DefaultTimeout = time.Second * 30
+
+var DefaultContextFactory = TimeoutContextFactory(context.Background(), DefaultTimeout)
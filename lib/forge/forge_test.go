@@ -0,0 +1,149 @@
+package forge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRetry never sleeps, and tries at most 3 times.
+var testRetry = retry.New(retry.WithAttempts(3), retry.WithSleep(func(d time.Duration) {}))
+
+func TestGitlab(t *testing.T) {
+	var requests []string
+	failures := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("PRIVATE-TOKEN"))
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("X-Next-Page", "2")
+				fmt.Fprint(w, `[{"id":1,"body":"first","author":{"username":"alice"}},{"id":2,"body":"added a commit","system":true}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"id":3,"body":"second","author":{"username":"bob"}}]`)
+		case "POST":
+			var body gitlabBody
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "hello", body.Body)
+			fmt.Fprint(w, `{"id":4,"body":"hello"}`)
+		}
+	})
+	mux.HandleFunc("/gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes/3", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"id":3}`)
+	})
+	mux.HandleFunc("/gitlab/api/v4/projects/group%2Fproject/merge_requests/12", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"iid":12,"title":"Fix","description":"Fixes it","state":"opened","web_url":"https://gitlab/mr/12",`+
+			`"source_branch":"fix","target_branch":"main","sha":"abc123","author":{"username":"alice"}}`)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	gl, err := NewGitlab("group/project", WithBaseURL(server.URL+"/gitlab/"), WithToken("secret"), WithRetry(testRetry))
+	require.NoError(t, err)
+
+	comments, err := gl.ListComments(12)
+	require.NoError(t, err)
+	assert.Equal(t, []Comment{{ID: 1, Author: "alice", Body: "first"}, {ID: 3, Author: "bob", Body: "second"}}, comments)
+
+	id, err := gl.AddComment(12, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), id)
+
+	// First attempt fails with a temporary error, and is retried.
+	assert.NoError(t, gl.EditComment(12, 3, "updated"))
+
+	pr, err := gl.GetPullRequest(12)
+	require.NoError(t, err)
+	assert.Equal(t, &PullRequest{
+		Number: 12, Title: "Fix", Description: "Fixes it", Author: "alice", State: "opened",
+		URL: "https://gitlab/mr/12", SourceBranch: "fix", HeadSHA: "abc123", TargetBranch: "main",
+	}, pr)
+
+	// Not found is not retried.
+	_, err = gl.GetPullRequest(13)
+	var herr *HTTPError
+	require.True(t, errors.As(err, &herr), "%v", err)
+	assert.Equal(t, http.StatusNotFound, herr.StatusCode)
+
+	assert.Equal(t, []string{
+		"GET /gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes",
+		"GET /gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes",
+		"POST /gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes",
+		"PUT /gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes/3",
+		"PUT /gitlab/api/v4/projects/group%2Fproject/merge_requests/12/notes/3",
+		"GET /gitlab/api/v4/projects/group%2Fproject/merge_requests/12",
+		"GET /gitlab/api/v4/projects/group%2Fproject/merge_requests/13",
+	}, requests)
+}
+
+func TestGitea(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		assert.Equal(t, "token secret", r.Header.Get("Authorization"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/repos/octo/repo/issues/7/comments":
+			fmt.Fprint(w, `[{"id":10,"body":"first","user":{"login":"alice"}}]`)
+		case "POST /api/v1/repos/octo/repo/issues/7/comments":
+			fmt.Fprint(w, `{"id":11}`)
+		case "PATCH /api/v1/repos/octo/repo/issues/comments/10":
+			fmt.Fprint(w, `{"id":10}`)
+		case "GET /api/v1/repos/octo/repo/pulls/7":
+			fmt.Fprint(w, `{"number":7,"title":"Fix","body":"Fixes it","state":"open","html_url":"https://gitea/pulls/7",`+
+				`"user":{"login":"alice"},"head":{"ref":"fix","sha":"abc123"},"base":{"ref":"main"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	_, err := NewGitea("octo", "repo", WithToken("secret"))
+	assert.Error(t, err)
+
+	gt, err := NewGitea("octo", "repo", WithBaseURL(server.URL), WithToken("secret"), WithRetry(testRetry))
+	require.NoError(t, err)
+
+	comments, err := gt.ListComments(7)
+	require.NoError(t, err)
+	assert.Equal(t, []Comment{{ID: 10, Author: "alice", Body: "first"}}, comments)
+
+	id, err := gt.AddComment(7, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), id)
+	assert.NoError(t, gt.EditComment(7, 10, "updated"))
+
+	pr, err := gt.GetPullRequest(7)
+	require.NoError(t, err)
+	assert.Equal(t, &PullRequest{
+		Number: 7, Title: "Fix", Description: "Fixes it", Author: "alice", State: "open",
+		URL: "https://gitea/pulls/7", SourceBranch: "fix", HeadSHA: "abc123", TargetBranch: "main",
+	}, pr)
+
+	assert.Error(t, gt.EditComment(7, 12, "missing"))
+	assert.Equal(t, []string{
+		"GET /api/v1/repos/octo/repo/issues/7/comments",
+		"POST /api/v1/repos/octo/repo/issues/7/comments",
+		"PATCH /api/v1/repos/octo/repo/issues/comments/10",
+		"GET /api/v1/repos/octo/repo/pulls/7",
+		"PATCH /api/v1/repos/octo/repo/issues/comments/12",
+	}, requests)
+}
@@ -0,0 +1,175 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/retry"
+)
+
+// Gitea implements the Forge interface on top of the gitea REST API, v1.
+//
+// Forgejo and other forks of gitea expose the same API, and are supported too.
+type Gitea struct {
+	*rest
+	owner string
+	repo  string
+}
+
+type GiteaFlags struct {
+	URL     string
+	Token   string
+	Owner   string
+	Repo    string
+	Retry   *retry.Flags
+	Timeout time.Duration
+}
+
+func DefaultGiteaFlags() *GiteaFlags {
+	return &GiteaFlags{
+		Retry:   retry.DefaultFlags(),
+		Timeout: DefaultTimeout,
+	}
+}
+
+func (fl *GiteaFlags) Register(set kflags.FlagSet, prefix string) *GiteaFlags {
+	set.StringVar(&fl.URL, prefix+"gitea-url", fl.URL, "URL of the gitea instance hosting the repository - as in https://gitea.example.com")
+	set.StringVar(&fl.Token, prefix+"gitea-token", fl.Token, "A gitea API token to access the repository - if unspecified, tries to use GITEA_TOKEN")
+	set.StringVar(&fl.Owner, prefix+"gitea-owner", fl.Owner, "Gitea repository owner - as in https://gitea.example.com/owner/name")
+	set.StringVar(&fl.Repo, prefix+"gitea-repo", fl.Repo, "Gitea repository name - as in https://gitea.example.com/owner/name")
+	set.DurationVar(&fl.Timeout, prefix+"gitea-timeout", fl.Timeout, "How long to wait for gitea operations to complete before retrying")
+	fl.Retry.Register(set, prefix+"gitea-")
+	return fl
+}
+
+// NewGitea creates a client for the specified repository.
+//
+// Unlike gitlab, there is no well known public instance: WithBaseURL is required.
+func NewGitea(owner, repo string, mods ...Modifier) (*Gitea, error) {
+	if owner == "" || repo == "" {
+		return nil, fmt.Errorf("API usage error - both a gitea owner and repository must be specified")
+	}
+	r, err := newRest("/api/v1", func(req *http.Request, token string) {
+		req.Header.Set("Authorization", "token "+token)
+	}, mods...)
+	if err != nil {
+		return nil, err
+	}
+	return &Gitea{rest: r, owner: owner, repo: repo}, nil
+}
+
+// NewGiteaFromFlags creates a gitea client configured from command line flags.
+func NewGiteaFromFlags(ctx context.Context, fl *GiteaFlags, rmods ...retry.Modifier) (*Gitea, error) {
+	token := fl.Token
+	if token == "" {
+		token = os.Getenv("GITEA_TOKEN")
+		if token == "" {
+			return nil, kflags.NewUsageErrorf(
+				"A gitea token must be supplied, either via flags (see --help, --gitea-token) or via GITEA_TOKEN")
+		}
+	}
+	if fl.URL == "" {
+		return nil, kflags.NewUsageErrorf(
+			"The URL of the gitea server must be supplied, see --help, --gitea-url")
+	}
+	if fl.Owner == "" || fl.Repo == "" {
+		return nil, kflags.NewUsageErrorf(
+			"A gitea repository owner and name must be supplied, see --help, --gitea-owner and --gitea-repo")
+	}
+
+	rmods = append([]retry.Modifier{retry.FromFlags(fl.Retry)}, rmods...)
+	return NewGitea(fl.Owner, fl.Repo,
+		WithBaseURL(fl.URL),
+		WithToken(token),
+		WithRetry(retry.New(rmods...)),
+		WithContextFactory(TimeoutContextFactory(ctx, fl.Timeout)),
+	)
+}
+
+type giteaUser struct {
+	Login string `json:"login"`
+}
+
+type giteaComment struct {
+	ID   int64     `json:"id"`
+	Body string    `json:"body"`
+	User giteaUser `json:"user"`
+}
+
+type giteaBranch struct {
+	Ref string `json:"ref"`
+	SHA string `json:"sha"`
+}
+
+type giteaPullRequest struct {
+	Number  int         `json:"number"`
+	Title   string      `json:"title"`
+	Body    string      `json:"body"`
+	State   string      `json:"state"`
+	HTMLURL string      `json:"html_url"`
+	User    giteaUser   `json:"user"`
+	Head    giteaBranch `json:"head"`
+	Base    giteaBranch `json:"base"`
+}
+
+type giteaBody struct {
+	Body string `json:"body"`
+}
+
+func (gt *Gitea) repoPath() string {
+	return "repos/" + url.PathEscape(gt.owner) + "/" + url.PathEscape(gt.repo)
+}
+
+// ListComments returns the comments of the pull request.
+//
+// The gitea API returns all the comments of an issue or pull request at once, no pagination.
+func (gt *Gitea) ListComments(pr int) ([]Comment, error) {
+	var comments []giteaComment
+	if _, err := gt.do("GET", gt.repoPath()+"/issues/"+strconv.Itoa(pr)+"/comments", nil, nil, &comments); err != nil {
+		return nil, err
+	}
+
+	result := make([]Comment, 0, len(comments))
+	for _, comment := range comments {
+		result = append(result, Comment{ID: comment.ID, Author: comment.User.Login, Body: comment.Body})
+	}
+	return result, nil
+}
+
+func (gt *Gitea) AddComment(pr int, body string) (int64, error) {
+	var comment giteaComment
+	if _, err := gt.do("POST", gt.repoPath()+"/issues/"+strconv.Itoa(pr)+"/comments", nil, &giteaBody{Body: body}, &comment); err != nil {
+		return 0, err
+	}
+	return comment.ID, nil
+}
+
+// EditComment edits a comment. In gitea, comment ids are unique in the repository, pr is not used.
+func (gt *Gitea) EditComment(pr int, id int64, body string) error {
+	_, err := gt.do("PATCH", gt.repoPath()+"/issues/comments/"+strconv.FormatInt(id, 10), nil, &giteaBody{Body: body}, nil)
+	return err
+}
+
+func (gt *Gitea) GetPullRequest(pr int) (*PullRequest, error) {
+	var result giteaPullRequest
+	if _, err := gt.do("GET", gt.repoPath()+"/pulls/"+strconv.Itoa(pr), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &PullRequest{
+		Number:       result.Number,
+		Title:        result.Title,
+		Description:  result.Body,
+		Author:       result.User.Login,
+		State:        result.State,
+		URL:          result.HTMLURL,
+		SourceBranch: result.Head.Ref,
+		HeadSHA:      result.Head.SHA,
+		TargetBranch: result.Base.Ref,
+	}, nil
+}
@@ -0,0 +1,192 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/retry"
+)
+
+// Gitlab implements the Forge interface on top of the gitlab REST API, v4.
+//
+// Pull requests are called merge requests in gitlab, and comments are
+// called notes.
+type Gitlab struct {
+	*rest
+	project string
+}
+
+var DefaultGitlabURL = "https://gitlab.com"
+
+type GitlabFlags struct {
+	URL     string
+	Token   string
+	Project string
+	Retry   *retry.Flags
+	Timeout time.Duration
+}
+
+// DefaultGitlabFlags returns the default flags.
+//
+// Defaults are taken from the environment variables set by gitlab CI, if present.
+func DefaultGitlabFlags() *GitlabFlags {
+	fl := &GitlabFlags{
+		URL:     os.Getenv("CI_SERVER_URL"),
+		Project: os.Getenv("CI_PROJECT_PATH"),
+		Retry:   retry.DefaultFlags(),
+		Timeout: DefaultTimeout,
+	}
+	if fl.URL == "" {
+		fl.URL = DefaultGitlabURL
+	}
+	return fl
+}
+
+func (fl *GitlabFlags) Register(set kflags.FlagSet, prefix string) *GitlabFlags {
+	set.StringVar(&fl.URL, prefix+"gitlab-url", fl.URL, "URL of the gitlab instance hosting the project")
+	set.StringVar(&fl.Token, prefix+"gitlab-token", fl.Token, "A gitlab API token with api scope - if unspecified, tries to use GITLAB_TOKEN")
+	set.StringVar(&fl.Project, prefix+"gitlab-project", fl.Project, "Full path of the gitlab project - as in https://gitlab.com/group/subgroup/project, group/subgroup/project")
+	set.DurationVar(&fl.Timeout, prefix+"gitlab-timeout", fl.Timeout, "How long to wait for gitlab operations to complete before retrying")
+	fl.Retry.Register(set, prefix+"gitlab-")
+	return fl
+}
+
+// NewGitlab creates a client for the specified project.
+//
+// project is either the numeric id of the project, or its full path,
+// like "group/subgroup/project".
+func NewGitlab(project string, mods ...Modifier) (*Gitlab, error) {
+	if project == "" {
+		return nil, fmt.Errorf("API usage error - a gitlab project must be specified")
+	}
+	mods = append([]Modifier{WithBaseURL(DefaultGitlabURL)}, mods...)
+	r, err := newRest("/api/v4", func(req *http.Request, token string) {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}, mods...)
+	if err != nil {
+		return nil, err
+	}
+	return &Gitlab{rest: r, project: project}, nil
+}
+
+// NewGitlabFromFlags creates a gitlab client configured from command line flags.
+func NewGitlabFromFlags(ctx context.Context, fl *GitlabFlags, rmods ...retry.Modifier) (*Gitlab, error) {
+	token := fl.Token
+	if token == "" {
+		token = os.Getenv("GITLAB_TOKEN")
+		if token == "" {
+			return nil, kflags.NewUsageErrorf(
+				"A gitlab token must be supplied, either via flags (see --help, --gitlab-token) or via GITLAB_TOKEN")
+		}
+	}
+	if fl.Project == "" {
+		return nil, kflags.NewUsageErrorf(
+			"A gitlab project must be supplied, see --help, --gitlab-project")
+	}
+
+	rmods = append([]retry.Modifier{retry.FromFlags(fl.Retry)}, rmods...)
+	return NewGitlab(fl.Project,
+		WithBaseURL(fl.URL),
+		WithToken(token),
+		WithRetry(retry.New(rmods...)),
+		WithContextFactory(TimeoutContextFactory(ctx, fl.Timeout)),
+	)
+}
+
+type gitlabUser struct {
+	Username string `json:"username"`
+}
+
+type gitlabNote struct {
+	ID     int64      `json:"id"`
+	Body   string     `json:"body"`
+	System bool       `json:"system"`
+	Author gitlabUser `json:"author"`
+}
+
+type gitlabMergeRequest struct {
+	IID          int        `json:"iid"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	State        string     `json:"state"`
+	WebURL       string     `json:"web_url"`
+	SourceBranch string     `json:"source_branch"`
+	TargetBranch string     `json:"target_branch"`
+	SHA          string     `json:"sha"`
+	Author       gitlabUser `json:"author"`
+}
+
+type gitlabBody struct {
+	Body string `json:"body"`
+}
+
+func (gl *Gitlab) mrPath(pr int) string {
+	return "projects/" + url.PathEscape(gl.project) + "/merge_requests/" + strconv.Itoa(pr)
+}
+
+func (gl *Gitlab) ListComments(pr int) ([]Comment, error) {
+	query := url.Values{
+		"sort":     {"asc"},
+		"order_by": {"created_at"},
+		"per_page": {"100"},
+	}
+
+	var comments []Comment
+	for {
+		var notes []gitlabNote
+		header, err := gl.do("GET", gl.mrPath(pr)+"/notes", query, nil, &notes)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			if note.System {
+				continue
+			}
+			comments = append(comments, Comment{ID: note.ID, Author: note.Author.Username, Body: note.Body})
+		}
+
+		next := header.Get("X-Next-Page")
+		if next == "" {
+			break
+		}
+		query.Set("page", next)
+	}
+	return comments, nil
+}
+
+func (gl *Gitlab) AddComment(pr int, body string) (int64, error) {
+	var note gitlabNote
+	if _, err := gl.do("POST", gl.mrPath(pr)+"/notes", nil, &gitlabBody{Body: body}, &note); err != nil {
+		return 0, err
+	}
+	return note.ID, nil
+}
+
+func (gl *Gitlab) EditComment(pr int, id int64, body string) error {
+	_, err := gl.do("PUT", gl.mrPath(pr)+"/notes/"+strconv.FormatInt(id, 10), nil, &gitlabBody{Body: body}, nil)
+	return err
+}
+
+func (gl *Gitlab) GetPullRequest(pr int) (*PullRequest, error) {
+	var mr gitlabMergeRequest
+	if _, err := gl.do("GET", gl.mrPath(pr), nil, nil, &mr); err != nil {
+		return nil, err
+	}
+	return &PullRequest{
+		Number:       mr.IID,
+		Title:        mr.Title,
+		Description:  mr.Description,
+		Author:       mr.Author.Username,
+		State:        mr.State,
+		URL:          mr.WebURL,
+		SourceBranch: mr.SourceBranch,
+		HeadSHA:      mr.SHA,
+		TargetBranch: mr.TargetBranch,
+	}, nil
+}
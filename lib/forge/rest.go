@@ -0,0 +1,201 @@
+package forge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/retry"
+)
+
+// HTTPError is returned when the forge API replies with an error status.
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// First few KB of the body of the reply, normally explaining the error.
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s - %s - %s", e.Method, e.URL, e.Status, strings.TrimSpace(e.Body))
+}
+
+// Temporary returns true if retrying the request may succeed.
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// rest is the REST client shared by the forge implementations.
+type rest struct {
+	base    *url.URL
+	client  *http.Client
+	token   string
+	retry   *retry.Options
+	context ContextFactory
+
+	// Adds the authentication headers, different in each forge.
+	authenticate func(req *http.Request, token string)
+}
+
+type Modifier func(*rest) error
+
+type Modifiers []Modifier
+
+func (mods Modifiers) Apply(r *rest) error {
+	for _, mod := range mods {
+		if err := mod(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithBaseURL configures the URL of the forge, for example https://gitlab.com.
+//
+// The path of the API is appended automatically, unless already present.
+func WithBaseURL(base string) Modifier {
+	return func(r *rest) error {
+		parsed, err := url.Parse(base)
+		if err != nil {
+			return fmt.Errorf("invalid forge URL %s - %w", base, err)
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("invalid forge URL %s - must be in the form https://host[/path]", base)
+		}
+		r.base = parsed
+		return nil
+	}
+}
+
+// WithToken configures the API token used to authenticate.
+func WithToken(token string) Modifier {
+	return func(r *rest) error {
+		r.token = token
+		return nil
+	}
+}
+
+// WithHTTPClient configures the http.Client used to perform the requests.
+func WithHTTPClient(client *http.Client) Modifier {
+	return func(r *rest) error {
+		r.client = client
+		return nil
+	}
+}
+
+// WithRetry configures the library to use the specified retry policy.
+func WithRetry(retry *retry.Options) Modifier {
+	return func(r *rest) error {
+		r.retry = retry
+		return nil
+	}
+}
+
+func WithContextFactory(ctx ContextFactory) Modifier {
+	return func(r *rest) error {
+		r.context = ctx
+		return nil
+	}
+}
+
+func newRest(apipath string, authenticate func(*http.Request, string), mods ...Modifier) (*rest, error) {
+	r := &rest{
+		client:       http.DefaultClient,
+		retry:        retry.New(),
+		context:      DefaultContextFactory,
+		authenticate: authenticate,
+	}
+	if err := Modifiers(mods).Apply(r); err != nil {
+		return nil, err
+	}
+	if r.base == nil {
+		return nil, fmt.Errorf("API usage error - you must supply the URL of the forge with WithBaseURL()")
+	}
+
+	base := *r.base
+	if !strings.HasSuffix(strings.TrimSuffix(base.Path, "/"), apipath) {
+		base.Path = strings.TrimSuffix(base.Path, "/") + apipath
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	base.RawPath = ""
+	r.base = &base
+	return r, nil
+}
+
+// do performs an API request, retrying on temporary errors.
+//
+// path is relative to the API root, and must already be escaped.
+// If in is not nil, it is sent json encoded. If out is not nil, the reply is json decoded in it.
+//
+// Returns the headers of the reply, used for pagination.
+func (r *rest) do(method, path string, query url.Values, in, out interface{}) (http.Header, error) {
+	relative, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	target := r.base.ResolveReference(relative)
+	target.RawQuery = query.Encode()
+
+	var body []byte
+	if in != nil {
+		body, err = json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var header http.Header
+	err = r.retry.Run(func() error {
+		ctx, cancel := r.context()
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return retry.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if r.token != "" && r.authenticate != nil {
+			r.authenticate(req, r.token)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			reply, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			herr := &HTTPError{
+				Method:     method,
+				URL:        target.String(),
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+				Body:       string(reply),
+			}
+			if !herr.Temporary() {
+				return retry.Fatal(herr)
+			}
+			return herr
+		}
+
+		header = resp.Header
+		if out == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%s %s - invalid reply - %w", method, target.String(), err)
+		}
+		return nil
+	})
+	return header, err
+}
@@ -0,0 +1,304 @@
+package github
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
+)
+
+// Annotation levels supported by the github Checks API.
+const (
+	AnnotationNotice  = "notice"
+	AnnotationWarning = "warning"
+	AnnotationFailure = "failure"
+)
+
+// CheckRunAnnotation is a message attached to a line range of a file,
+// shown inline in the diff view of a PR.
+type CheckRunAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	StartColumn     int    `json:"start_column,omitempty"`
+	EndColumn       int    `json:"end_column,omitempty"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+	Title           string `json:"title,omitempty"`
+	RawDetails      string `json:"raw_details,omitempty"`
+}
+
+// AnnotationParserFlags configures how annotations are extracted from build and test output.
+type AnnotationParserFlags struct {
+	StripPrefix []string
+	ModulePath  string
+	MaxLines    int
+}
+
+func DefaultAnnotationParserFlags() *AnnotationParserFlags {
+	return &AnnotationParserFlags{
+		MaxLines: 20,
+	}
+}
+
+func (fl *AnnotationParserFlags) Register(set kflags.FlagSet, prefix string) *AnnotationParserFlags {
+	set.StringArrayVar(&fl.StripPrefix, prefix+"strip-prefix", fl.StripPrefix, "Path prefix to remove from the files referenced in the output, typically the root of the checkout (repeatable)")
+	set.StringVar(&fl.ModulePath, prefix+"go-module", fl.ModulePath, "Go module path of the repository, used to locate the files referenced in go test output")
+	set.IntVar(&fl.MaxLines, prefix+"max-lines", fl.MaxLines, "Maximum number of lines of output to include in a single annotation")
+	return fl
+}
+
+// AnnotationParser extracts file and line annotations from the output of
+// compilers, linters, bazel and go test.
+//
+// It recognizes lines in the common "file:line[:column]: message" format,
+// optionally preceded by a severity as printed by bazel ("ERROR: ...") or
+// followed by one as printed by gcc and clang ("...: warning: ..."). More
+// indented lines that follow are considered part of the same message.
+//
+// go test prints file names relative to the package directory: those
+// annotations are resolved once the "FAIL <package>" or "ok <package>" line
+// is seen, if the module path was configured. Annotations of packages that
+// passed, like the output of t.Log, are reported as notices.
+//
+// Annotations with the same file, line and complete message are reported once.
+type AnnotationParser struct {
+	stripPrefix []string
+	modulePath  string
+	maxLines    int
+
+	annotations []CheckRunAnnotation
+	seen        map[string]bool
+	// Annotations waiting to be resolved to a package directory.
+	pending []CheckRunAnnotation
+	// Annotation being parsed, added once all its continuation lines are seen.
+	current *CheckRunAnnotation
+	// Last annotation parsed, and indentation of its line, to append continuation lines.
+	last   *CheckRunAnnotation
+	indent int
+	lines  int
+	// Indentation of the first continuation line, stripped from all continuation lines.
+	continuationIndent string
+}
+
+type AnnotationParserModifier func(*AnnotationParser)
+
+type AnnotationParserModifiers []AnnotationParserModifier
+
+func (mods AnnotationParserModifiers) Apply(ap *AnnotationParser) {
+	for _, mod := range mods {
+		mod(ap)
+	}
+}
+
+// WithStripPrefix removes the specified prefixes from the file paths.
+//
+// Files with an absolute path not matching any prefix are outside of the
+// repository, and are ignored.
+func WithStripPrefix(prefixes ...string) AnnotationParserModifier {
+	return func(ap *AnnotationParser) {
+		ap.stripPrefix = append(ap.stripPrefix, prefixes...)
+	}
+}
+
+// WithModulePath configures the go module path, to resolve files in go test output.
+func WithModulePath(module string) AnnotationParserModifier {
+	return func(ap *AnnotationParser) {
+		ap.modulePath = module
+	}
+}
+
+func AnnotationParserFromFlags(fl *AnnotationParserFlags) AnnotationParserModifier {
+	return func(ap *AnnotationParser) {
+		ap.stripPrefix = append(ap.stripPrefix, fl.StripPrefix...)
+		ap.modulePath = fl.ModulePath
+		ap.maxLines = fl.MaxLines
+	}
+}
+
+func NewAnnotationParser(mods ...AnnotationParserModifier) *AnnotationParser {
+	ap := &AnnotationParser{
+		maxLines: 20,
+		seen:     map[string]bool{},
+	}
+	AnnotationParserModifiers(mods).Apply(ap)
+	return ap
+}
+
+var (
+	annotationRe = regexp.MustCompile(`^(\s*)(?:(ERROR|WARNING|INFO|DEBUG):\s+)?([^\s:]+):(\d+)(?::(\d+))?:\s*(?:(error|fatal error|warning|note):\s*)?(.*)$`)
+	goPackageRe  = regexp.MustCompile(`^(FAIL|ok)\s+(\S+)\s`)
+)
+
+// Parse reads the output of a build or test, and accumulates the annotations found.
+func (ap *AnnotationParser) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ap.ParseLine(scanner.Text())
+	}
+	ap.finish()
+	return scanner.Err()
+}
+
+// ParseLine parses a single line of output.
+func (ap *AnnotationParser) ParseLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if match := goPackageRe.FindStringSubmatch(line + " "); match != nil {
+		ap.finish()
+		ap.resolve(match[2], match[1] == "ok")
+		return
+	}
+
+	match := annotationRe.FindStringSubmatch(line)
+	if match == nil || !looksLikePath(match[3]) {
+		ap.continuation(line)
+		return
+	}
+
+	start, _ := strconv.Atoi(match[4])
+	column, _ := strconv.Atoi(match[5])
+	annotation := CheckRunAnnotation{
+		Path:            match[3],
+		StartLine:       start,
+		EndLine:         start,
+		AnnotationLevel: annotationLevel(match[2], match[6]),
+		Message:         strings.TrimSpace(match[7]),
+	}
+	if column > 0 {
+		annotation.StartColumn = column
+		annotation.EndColumn = column
+	}
+
+	ap.finish()
+	ap.indent = len(match[1])
+	ap.lines = 1
+	ap.continuationIndent = ""
+	if !strings.Contains(annotation.Path, "/") && ap.modulePath != "" && ap.indent > 0 {
+		// Indented, bare file names are printed by go test, relative to the package.
+		ap.pending = append(ap.pending, annotation)
+		ap.last = &ap.pending[len(ap.pending)-1]
+		return
+	}
+	if !ap.normalize(&annotation) {
+		return
+	}
+	ap.current = &annotation
+	ap.last = ap.current
+}
+
+// finish adds the annotation being parsed, if any, and stops appending continuation lines.
+func (ap *AnnotationParser) finish() {
+	if ap.current != nil {
+		ap.add(*ap.current)
+		ap.current = nil
+	}
+	ap.last = nil
+}
+
+// add adds an annotation, unless the same one was already added.
+func (ap *AnnotationParser) add(annotation CheckRunAnnotation) {
+	key := annotation.Path + ":" + strconv.Itoa(annotation.StartLine) + ":" + annotation.Message
+	if ap.seen[key] {
+		return
+	}
+	ap.seen[key] = true
+	ap.annotations = append(ap.annotations, annotation)
+}
+
+func (ap *AnnotationParser) continuation(line string) {
+	if ap.last == nil {
+		return
+	}
+	trimmed := strings.TrimLeft(line, " \t")
+	if trimmed == "" || len(line)-len(trimmed) <= ap.indent {
+		ap.finish()
+		return
+	}
+	if ap.lines >= ap.maxLines {
+		return
+	}
+	if ap.lines == 1 {
+		ap.continuationIndent = line[:len(line)-len(trimmed)]
+	}
+	ap.lines++
+
+	line = strings.TrimRight(strings.TrimPrefix(line, ap.continuationIndent), " \t")
+	if ap.last.Message == "" {
+		ap.last.Message = line
+		return
+	}
+	ap.last.Message += "\n" + line
+}
+
+// resolve assigns the go package directory to the pending annotations.
+//
+// If the package passed, the annotations are only notices.
+func (ap *AnnotationParser) resolve(pkg string, passed bool) {
+	pending := ap.pending
+	ap.pending = nil
+	if ap.modulePath == "" || (pkg != ap.modulePath && !strings.HasPrefix(pkg, ap.modulePath+"/")) {
+		return
+	}
+	dir := strings.TrimPrefix(strings.TrimPrefix(pkg, ap.modulePath), "/")
+	for _, annotation := range pending {
+		annotation.Path = path.Join(dir, annotation.Path)
+		if passed {
+			annotation.AnnotationLevel = AnnotationNotice
+		}
+		if ap.normalize(&annotation) {
+			ap.add(annotation)
+		}
+	}
+}
+
+// normalize makes the annotation path relative to the repository.
+//
+// Returns false if the annotation should be ignored.
+func (ap *AnnotationParser) normalize(annotation *CheckRunAnnotation) bool {
+	file := annotation.Path
+	for _, prefix := range ap.stripPrefix {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+		if strings.HasPrefix(file, prefix) {
+			file = strings.TrimPrefix(file, prefix)
+			break
+		}
+	}
+	file = path.Clean(file)
+	if path.IsAbs(file) || strings.HasPrefix(file, "../") || strings.HasPrefix(file, "external/") || strings.HasPrefix(file, "bazel-") {
+		return false
+	}
+	annotation.Path = file
+	return true
+}
+
+// Annotations returns the annotations parsed so far.
+//
+// The annotation being parsed is considered complete: continuation lines
+// parsed afterwards are ignored.
+func (ap *AnnotationParser) Annotations() []CheckRunAnnotation {
+	ap.finish()
+	return ap.annotations
+}
+
+func looksLikePath(candidate string) bool {
+	if strings.Contains(candidate, "://") || !strings.ContainsAny(candidate, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		return false
+	}
+	base := path.Base(candidate)
+	return strings.Contains(base, ".") || base == "BUILD" || base == "WORKSPACE"
+}
+
+func annotationLevel(prefix, inline string) string {
+	switch {
+	case prefix == "WARNING" || inline == "warning":
+		return AnnotationWarning
+	case prefix == "INFO" || prefix == "DEBUG" || inline == "note":
+		return AnnotationNotice
+	}
+	return AnnotationFailure
+}
@@ -0,0 +1,114 @@
+package github
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotationParser(t *testing.T) {
+	output := `INFO: Analyzed 12 targets (0 packages loaded, 0 targets configured).
+ERROR: /home/ci/checkout/lib/kemail/BUILD.bazel:3:11: no such package '@foo//': error loading package
+lib/kemail/queue.go:42:5: undefined: sendr
+lib/kemail/queue.go:42:5: undefined: sendr
+WARNING: /home/ci/.cache/bazel/external/foo/BUILD:1:1: ignored, outside of the repository
+/home/ci/checkout/proxy/nasshp/nassh.c:10:3: warning: unused variable 'x' [-Wunused-variable]
+   10 |   int x;
+      |       ^
+2024/01/01 12:30:45 just a log line
+see https://example.com:8080: for details
+--- FAIL: TestQueueProcess (0.00s)
+    queue_test.go:94: 
+        	Error Trace:	/home/ci/checkout/lib/kemail/queue_test.go:94
+        	Error:      	Not equal
+--- FAIL: TestOther (0.00s)
+    other_test.go:12: expected 1, got 2
+FAIL
+FAIL	github.com/ccontavalli/enkit/lib/kemail	0.141s
+`
+	parser := NewAnnotationParser(WithStripPrefix("/home/ci/checkout"), WithModulePath("github.com/ccontavalli/enkit"))
+	assert.NoError(t, parser.Parse(strings.NewReader(output)))
+	assert.Equal(t, []CheckRunAnnotation{
+		{
+			Path: "lib/kemail/BUILD.bazel", StartLine: 3, EndLine: 3, StartColumn: 11, EndColumn: 11,
+			AnnotationLevel: AnnotationFailure, Message: "no such package '@foo//': error loading package",
+		},
+		{
+			Path: "lib/kemail/queue.go", StartLine: 42, EndLine: 42, StartColumn: 5, EndColumn: 5,
+			AnnotationLevel: AnnotationFailure, Message: "undefined: sendr",
+		},
+		{
+			Path: "proxy/nasshp/nassh.c", StartLine: 10, EndLine: 10, StartColumn: 3, EndColumn: 3,
+			AnnotationLevel: AnnotationWarning, Message: "unused variable 'x' [-Wunused-variable]\n10 |   int x;\n   |       ^",
+		},
+		{
+			Path: "lib/kemail/queue_test.go", StartLine: 94, EndLine: 94,
+			AnnotationLevel: AnnotationFailure, Message: "Error Trace:\t/home/ci/checkout/lib/kemail/queue_test.go:94\nError:      \tNot equal",
+		},
+		{
+			Path: "lib/kemail/other_test.go", StartLine: 12, EndLine: 12,
+			AnnotationLevel: AnnotationFailure, Message: "expected 1, got 2",
+		},
+	}, parser.Annotations())
+}
+
+func TestAnnotationParserUnresolved(t *testing.T) {
+	parser := NewAnnotationParser()
+	assert.NoError(t, parser.Parse(strings.NewReader("    foo_test.go:12: failed\nFAIL\texample.com/other/pkg\t0.1s\n/abs/file.go:1: outside\n")))
+	assert.Equal(t, []CheckRunAnnotation{{
+		Path: "foo_test.go", StartLine: 12, EndLine: 12, AnnotationLevel: AnnotationFailure, Message: "failed",
+	}}, parser.Annotations())
+}
+
+func TestAnnotationParserGoTestResult(t *testing.T) {
+	output := `--- FAIL: TestA (0.00s)
+    a_test.go:10: unexpected result
+        got: 1
+--- FAIL: TestB (0.00s)
+    a_test.go:10: unexpected result
+        got: 2
+--- FAIL: TestC (0.00s)
+    a_test.go:10: unexpected result
+        got: 2
+FAIL
+FAIL	example.com/repo/failing	0.1s
+=== RUN   TestD
+    d_test.go:5: connecting to localhost
+--- PASS: TestD (0.00s)
+PASS
+ok  	example.com/repo/passing	0.1s
+`
+	parser := NewAnnotationParser(WithModulePath("example.com/repo"))
+	assert.NoError(t, parser.Parse(strings.NewReader(output)))
+	assert.Equal(t, []CheckRunAnnotation{
+		{
+			Path: "failing/a_test.go", StartLine: 10, EndLine: 10,
+			AnnotationLevel: AnnotationFailure, Message: "unexpected result\ngot: 1",
+		},
+		{
+			Path: "failing/a_test.go", StartLine: 10, EndLine: 10,
+			AnnotationLevel: AnnotationFailure, Message: "unexpected result\ngot: 2",
+		},
+		{
+			Path: "passing/d_test.go", StartLine: 5, EndLine: 5,
+			AnnotationLevel: AnnotationNotice, Message: "connecting to localhost",
+		},
+	}, parser.Annotations())
+}
+
+func TestAnnotationParserDuplicates(t *testing.T) {
+	output := `lib/a.go:1: mismatch
+    expected x
+lib/a.go:1: mismatch
+    expected y
+lib/a.go:1: mismatch
+    expected y
+`
+	parser := NewAnnotationParser()
+	assert.NoError(t, parser.Parse(strings.NewReader(output)))
+	assert.Equal(t, []CheckRunAnnotation{
+		{Path: "lib/a.go", StartLine: 1, EndLine: 1, AnnotationLevel: AnnotationFailure, Message: "mismatch\nexpected x"},
+		{Path: "lib/a.go", StartLine: 1, EndLine: 1, AnnotationLevel: AnnotationFailure, Message: "mismatch\nexpected y"},
+	}, parser.Annotations())
+}
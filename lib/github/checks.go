@@ -0,0 +1,449 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/google/go-github/github"
+)
+
+// Status and conclusion of a check run, as defined by the github Checks API.
+const (
+	CheckQueued     = "queued"
+	CheckInProgress = "in_progress"
+	CheckCompleted  = "completed"
+
+	CheckSuccess        = "success"
+	CheckFailure        = "failure"
+	CheckNeutral        = "neutral"
+	CheckCancelled      = "cancelled"
+	CheckSkipped        = "skipped"
+	CheckTimedOut       = "timed_out"
+	CheckActionRequired = "action_required"
+)
+
+// MaxAnnotationsPerRequest is the maximum number of annotations github accepts
+// in a single create or update request. Further annotations are sent with
+// additional update requests, github appends them to the existing ones.
+const MaxAnnotationsPerRequest = 50
+
+// CheckRunOutput is the summary and details of a check run.
+type CheckRunOutput struct {
+	Title       string               `json:"title"`
+	Summary     string               `json:"summary"`
+	Text        string               `json:"text,omitempty"`
+	Annotations []CheckRunAnnotation `json:"annotations,omitempty"`
+}
+
+// CheckRun describes a check run to create or update.
+//
+// This is not the go-github type: the one in the version of the library in
+// use still has the field names of the Checks API preview, rejected by github.
+type CheckRun struct {
+	Name        string          `json:"name,omitempty"`
+	HeadSHA     string          `json:"head_sha,omitempty"`
+	DetailsURL  string          `json:"details_url,omitempty"`
+	ExternalID  string          `json:"external_id,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Conclusion  string          `json:"conclusion,omitempty"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	Output      *CheckRunOutput `json:"output,omitempty"`
+}
+
+// Validate checks that status and conclusion are consistent, and valid.
+func (cr *CheckRun) Validate() error {
+	switch cr.Status {
+	case "", CheckQueued, CheckInProgress:
+		if cr.Conclusion != "" {
+			return fmt.Errorf("a conclusion can only be specified for a %s check, status is %s", CheckCompleted, cr.Status)
+		}
+	case CheckCompleted:
+		switch cr.Conclusion {
+		case CheckSuccess, CheckFailure, CheckNeutral, CheckCancelled, CheckSkipped, CheckTimedOut, CheckActionRequired:
+		case "":
+			return fmt.Errorf("a %s check requires a conclusion", CheckCompleted)
+		default:
+			return fmt.Errorf("invalid conclusion %q", cr.Conclusion)
+		}
+	default:
+		return fmt.Errorf("invalid status %q - must be one of %s, %s, %s", cr.Status, CheckQueued, CheckInProgress, CheckCompleted)
+	}
+	return nil
+}
+
+// checkRunResult is the subset of the github response used.
+type checkRunResult struct {
+	ID      int64  `json:"id"`
+	HTMLURL string `json:"html_url"`
+}
+
+func (rc *RepoClient) sendCheckRun(method, url string, run *CheckRun) (*checkRunResult, error) {
+	var result checkRunResult
+	var resp *github.Response
+	err := rc.retry.Run(func() error {
+		ctx, cancel := rc.context()
+		defer cancel()
+
+		req, err := rc.client.NewRequest(method, url, run)
+		if err != nil {
+			return err
+		}
+		resp, err = rc.client.Do(ctx, req, &result)
+		return err
+	})
+	if err != nil {
+		return nil, NewGithubError(resp, err)
+	}
+	return &result, nil
+}
+
+// splitAnnotations returns a copy of run with at most MaxAnnotationsPerRequest
+// annotations, and the annotations left.
+func splitAnnotations(run *CheckRun) (*CheckRun, []CheckRunAnnotation) {
+	if run.Output == nil || len(run.Output.Annotations) <= MaxAnnotationsPerRequest {
+		return run, nil
+	}
+	first := *run
+	output := *run.Output
+	output.Annotations = run.Output.Annotations[:MaxAnnotationsPerRequest]
+	first.Output = &output
+	return &first, run.Output.Annotations[MaxAnnotationsPerRequest:]
+}
+
+func (rc *RepoClient) addAnnotations(id int64, output *CheckRunOutput, annotations []CheckRunAnnotation) error {
+	for len(annotations) > 0 {
+		batch := annotations
+		if len(batch) > MaxAnnotationsPerRequest {
+			batch = batch[:MaxAnnotationsPerRequest]
+		}
+		annotations = annotations[len(batch):]
+
+		// Title and summary are mandatory whenever output is supplied.
+		update := &CheckRun{Output: &CheckRunOutput{Title: output.Title, Summary: output.Summary, Text: output.Text, Annotations: batch}}
+		if _, err := rc.sendCheckRun("PATCH", fmt.Sprintf("repos/%s/%s/check-runs/%d", rc.repo.Owner, rc.repo.Name, id), update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateCheckRun creates a check run, and returns its ID.
+//
+// Note that github only allows github apps to create check runs: the token
+// used must be an installation token, like the GITHUB_TOKEN of a github
+// action, rather than a personal access token.
+func (rc *RepoClient) CreateCheckRun(run *CheckRun) (int64, error) {
+	if run.Name == "" || run.HeadSHA == "" {
+		return 0, fmt.Errorf("API usage error - a check run requires both a name and a head sha")
+	}
+	if err := run.Validate(); err != nil {
+		return 0, err
+	}
+
+	first, rest := splitAnnotations(run)
+	result, err := rc.sendCheckRun("POST", fmt.Sprintf("repos/%s/%s/check-runs", rc.repo.Owner, rc.repo.Name), first)
+	if err != nil {
+		return 0, err
+	}
+	return result.ID, rc.addAnnotations(result.ID, run.Output, rest)
+}
+
+// annotationKey identifies annotations reporting the same problem.
+type annotationKey struct {
+	path               string
+	startLine, endLine int
+	message            string
+}
+
+func keyOf(annotation *CheckRunAnnotation) annotationKey {
+	return annotationKey{path: annotation.Path, startLine: annotation.StartLine, endLine: annotation.EndLine, message: annotation.Message}
+}
+
+// listAnnotations returns the annotations of a check run.
+func (rc *RepoClient) listAnnotations(id int64) ([]CheckRunAnnotation, error) {
+	var all []CheckRunAnnotation
+	for page := 1; page != 0; {
+		var annotations []CheckRunAnnotation
+		var resp *github.Response
+		err := rc.retry.Run(func() error {
+			ctx, cancel := rc.context()
+			defer cancel()
+
+			url := fmt.Sprintf("repos/%s/%s/check-runs/%d/annotations?per_page=100&page=%d", rc.repo.Owner, rc.repo.Name, id, page)
+			req, err := rc.client.NewRequest("GET", url, nil)
+			if err != nil {
+				return err
+			}
+			annotations = nil
+			resp, err = rc.client.Do(ctx, req, &annotations)
+			return err
+		})
+		if err != nil {
+			return nil, NewGithubError(resp, err)
+		}
+		all = append(all, annotations...)
+		page = resp.NextPage
+	}
+	return all, nil
+}
+
+// UpdateCheckRun updates an existing check run.
+//
+// Github appends annotations to the ones already present in the check run:
+// annotations with the same path, lines and message as an existing one are
+// not sent again, so a check can be updated multiple times with the same
+// findings.
+func (rc *RepoClient) UpdateCheckRun(id int64, run *CheckRun) error {
+	if err := run.Validate(); err != nil {
+		return err
+	}
+
+	if run.Output != nil && len(run.Output.Annotations) > 0 {
+		existing, err := rc.listAnnotations(id)
+		if err != nil {
+			return err
+		}
+		seen := map[annotationKey]bool{}
+		for i := range existing {
+			seen[keyOf(&existing[i])] = true
+		}
+
+		output := *run.Output
+		output.Annotations = nil
+		for i := range run.Output.Annotations {
+			key := keyOf(&run.Output.Annotations[i])
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			output.Annotations = append(output.Annotations, run.Output.Annotations[i])
+		}
+		deduped := *run
+		deduped.Output = &output
+		run = &deduped
+	}
+
+	first, rest := splitAnnotations(run)
+	if _, err := rc.sendCheckRun("PATCH", fmt.Sprintf("repos/%s/%s/check-runs/%d", rc.repo.Owner, rc.repo.Name, id), first); err != nil {
+		return err
+	}
+	return rc.addAnnotations(id, run.Output, rest)
+}
+
+// GetCheckRuns returns the check runs with the specified name for a commit.
+//
+// The most recent check run is returned first.
+func (rc *RepoClient) GetCheckRuns(sha, name string) ([]*github.CheckRun, error) {
+	opts := github.ListCheckRunsOptions{
+		CheckName: &name,
+		ListOptions: github.ListOptions{
+			PerPage: 100,
+		},
+	}
+
+	var allruns []*github.CheckRun
+	for {
+		var runs *github.ListCheckRunsResults
+		var resp *github.Response
+		err := rc.retry.Run(func() error {
+			ctx, cancel := rc.context()
+			defer cancel()
+
+			var err error
+			runs, resp, err = rc.client.Checks.ListCheckRunsForRef(ctx, rc.repo.Owner, rc.repo.Name, sha, &opts)
+			return err
+		})
+		if err != nil {
+			return nil, NewGithubError(resp, err)
+		}
+		allruns = append(allruns, runs.CheckRuns...)
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return allruns, nil
+}
+
+// StableCheck is a check run whose summary is maintained like a StableComment.
+//
+// The summary is rendered from a template and json, which are stored in
+// the summary itself, so that subsequent, independent invocations can update
+// the json with a diff and re-render it. The status, conclusion and
+// annotations of the check are updated as specified by each invocation.
+type StableCheck struct {
+	*StableComment
+
+	name string
+	sha  string
+	id   int64
+}
+
+func NewStableCheck(name, sha string, mods ...StableCommentModifier) (*StableCheck, error) {
+	if name == "" {
+		return nil, fmt.Errorf("API usage error - a check run requires a name")
+	}
+	sc, err := NewStableComment(mods...)
+	if err != nil {
+		return nil, err
+	}
+	return &StableCheck{StableComment: sc, name: name, sha: sha}, nil
+}
+
+// UpdateFromCheck loads the state of the check run previously posted, if any.
+func (sc *StableCheck) UpdateFromCheck(rc *RepoClient) error {
+	id, payload, template, err := sc.FetchCheckState(rc)
+	if err != nil {
+		return err
+	}
+
+	sc.id = id
+	if payload != "" && !sc.jsonreset {
+		sc.jsoncontent = payload
+	}
+	if sc.template == "" {
+		sc.template = template
+	}
+	return nil
+}
+
+// FetchCheckState returns the ID, json and template of the check run previously posted.
+//
+// Returns a 0 ID if no check run with the configured name exists on the commit.
+func (sc *StableCheck) FetchCheckState(rc *RepoClient) (int64, string, string, error) {
+	if sc.sha == "" {
+		return 0, "", "", fmt.Errorf("API usage error - a check run requires a head sha")
+	}
+	runs, err := rc.GetCheckRuns(sc.sha, sc.name)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	for _, run := range runs {
+		if run.ID == nil {
+			continue
+		}
+		if run.Output == nil || run.Output.Summary == nil {
+			return *run.ID, "", "", nil
+		}
+
+		payload, template, err := sc.ParseComment(*run.Output.Summary)
+		if err != nil && errors.Unwrap(err) != nil {
+			sc.log.Warnf("check %s on %s - Corrupted summary in check run %d? %s", sc.name, sc.sha, *run.ID, err)
+		}
+		return *run.ID, payload, template, nil
+	}
+	return 0, "", "", nil
+}
+
+// PostAction describes the action that needs to be performed for this check.
+func (sc *StableCheck) PostAction() string {
+	if sc.id == 0 {
+		return fmt.Sprintf("create new check run %q", sc.name)
+	}
+	return fmt.Sprintf("update check run %q ID %d", sc.name, sc.id)
+}
+
+// PrepareCheckRun renders the summary of the check, and returns the check run to post.
+//
+// The status, conclusion and annotations of the run are preserved, the summary
+// is replaced. If the run has no title, the name of the check is used.
+func (sc *StableCheck) PrepareCheckRun(tr Transformer, run CheckRun) (*CheckRun, error) {
+	summary, err := sc.PreparePayloadFromDiff(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Name = sc.name
+	run.HeadSHA = sc.sha
+	output := CheckRunOutput{Title: sc.name}
+	if run.Output != nil {
+		output = *run.Output
+	}
+	if output.Title == "" {
+		output.Title = sc.name
+	}
+	output.Summary = summary
+	run.Output = &output
+	return &run, run.Validate()
+}
+
+// PostCheckRun creates or updates the check run.
+func (sc *StableCheck) PostCheckRun(rc *RepoClient, run *CheckRun) error {
+	if sc.id == 0 {
+		id, err := rc.CreateCheckRun(run)
+		if err != nil {
+			return err
+		}
+		sc.id = id
+		return nil
+	}
+	return rc.UpdateCheckRun(sc.id, run)
+}
+
+// PostToCheck renders the summary, and creates or updates the check run.
+func (sc *StableCheck) PostToCheck(rc *RepoClient, tr Transformer, run CheckRun) error {
+	prepared, err := sc.PrepareCheckRun(tr, run)
+	if err != nil {
+		return err
+	}
+	return sc.PostCheckRun(rc, prepared)
+}
+
+type CheckRunFlags struct {
+	Name       string
+	SHA        string
+	Title      string
+	Status     string
+	Conclusion string
+	DetailsURL string
+	Text       string
+}
+
+var DefaultCheckName = "staco"
+
+func DefaultCheckRunFlags() *CheckRunFlags {
+	return &CheckRunFlags{
+		Name: DefaultCheckName,
+	}
+}
+
+func (fl *CheckRunFlags) Register(set kflags.FlagSet, prefix string) *CheckRunFlags {
+	set.StringVar(&fl.Name, prefix+"name", fl.Name, "Name of the check run, identifies the check across subsequent runs of this command")
+	set.StringVar(&fl.SHA, prefix+"sha", fl.SHA, "SHA of the commit the check run refers to")
+	set.StringVar(&fl.Title, prefix+"title", fl.Title, "Title of the check run, shown next to the status - defaults to the name")
+	set.StringVar(&fl.Status, prefix+"status", fl.Status, "Status of the check run: queued, in_progress or completed - defaults to completed if a conclusion is specified, in_progress otherwise")
+	set.StringVar(&fl.Conclusion, prefix+"conclusion", fl.Conclusion, "Conclusion of a completed check: success, failure, neutral, cancelled, skipped, timed_out or action_required")
+	set.StringVar(&fl.DetailsURL, prefix+"details-url", fl.DetailsURL, "URL with the full details of the check, like the CI job logs")
+	set.StringVar(&fl.Text, prefix+"text", fl.Text, "Additional details to show below the summary of the check")
+	return fl
+}
+
+// CheckRunFromFlags returns the CheckRun described by the flags.
+func CheckRunFromFlags(fl *CheckRunFlags, now time.Time) (CheckRun, error) {
+	run := CheckRun{
+		Name:       fl.Name,
+		HeadSHA:    fl.SHA,
+		DetailsURL: fl.DetailsURL,
+		Status:     fl.Status,
+		Conclusion: fl.Conclusion,
+		Output:     &CheckRunOutput{Title: fl.Title, Text: fl.Text},
+	}
+	if run.Status == "" {
+		run.Status = CheckInProgress
+		if run.Conclusion != "" {
+			run.Status = CheckCompleted
+		}
+	}
+	if run.Status == CheckCompleted {
+		run.CompletedAt = &now
+	}
+	if err := run.Validate(); err != nil {
+		return run, kflags.NewUsageErrorf("%s", err)
+	}
+	return run, nil
+}
@@ -0,0 +1,205 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChecks emulates the subset of the github Checks API used.
+type fakeChecks struct {
+	lock     sync.Mutex
+	requests []string
+	runs     map[int64]*CheckRun
+}
+
+func (fc *fakeChecks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.requests = append(fc.requests, r.Method+" "+r.URL.Path)
+
+	var id int64
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/repos/octo/repo/commits/abc123/check-runs":
+		result := github.ListCheckRunsResults{}
+		for id, run := range fc.runs {
+			if run.Name != r.URL.Query().Get("check_name") {
+				continue
+			}
+			summary := run.Output.Summary
+			result.CheckRuns = append(result.CheckRuns, &github.CheckRun{
+				ID:     github.Int64(id),
+				Output: &github.CheckRunOutput{Summary: &summary},
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+		return
+
+	case r.Method == "GET":
+		var page int
+		if _, err := fmt.Sscanf(r.URL.Path, "/repos/octo/repo/check-runs/%d/annotations", &id); err != nil || fc.runs[id] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		annotations := []CheckRunAnnotation{}
+		if output := fc.runs[id].Output; output != nil {
+			annotations = output.Annotations
+		}
+		start := min(max(page-1, 0)*100, len(annotations))
+		end := min(start+100, len(annotations))
+		if end < len(annotations) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, r.URL.Path, page+1))
+		}
+		json.NewEncoder(w).Encode(annotations[start:end])
+		return
+
+	case r.Method == "POST" && r.URL.Path == "/repos/octo/repo/check-runs":
+		id = int64(len(fc.runs) + 1)
+		fc.runs[id] = &CheckRun{}
+
+	case r.Method == "PATCH":
+		if _, err := fmt.Sscanf(r.URL.Path, "/repos/octo/repo/check-runs/%d", &id); err != nil || fc.runs[id] == nil {
+			http.NotFound(w, r)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var update CheckRun
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Output != nil && len(update.Output.Annotations) > MaxAnnotationsPerRequest {
+		http.Error(w, "too many annotations", http.StatusUnprocessableEntity)
+		return
+	}
+
+	run := fc.runs[id]
+	annotations := []CheckRunAnnotation{}
+	if run.Output != nil {
+		annotations = run.Output.Annotations
+	}
+	if update.Name != "" {
+		run.Name = update.Name
+	}
+	if update.Status != "" {
+		run.Status = update.Status
+		run.Conclusion = update.Conclusion
+	}
+	if update.Output != nil {
+		run.Output = update.Output
+		run.Output.Annotations = append(annotations, update.Output.Annotations...)
+	}
+	json.NewEncoder(w).Encode(checkRunResult{ID: id})
+}
+
+func newTestRepoClient(t *testing.T, handler http.Handler) *RepoClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := github.NewClient(nil)
+	base, err := url.Parse(server.URL + "/")
+	require.NoError(t, err)
+	client.BaseURL = base
+
+	rc, err := NewRepoClient(WithClient(client), WithRepo(GithubRepo{Owner: "octo", Name: "repo"}))
+	require.NoError(t, err)
+	return rc
+}
+
+func TestStableCheck(t *testing.T) {
+	fake := &fakeChecks{runs: map[int64]*CheckRun{}}
+	rc := newTestRepoClient(t, fake)
+
+	var annotations []CheckRunAnnotation
+	for i := 0; i < 120; i++ {
+		annotations = append(annotations, CheckRunAnnotation{Path: "main.go", StartLine: i + 1, EndLine: i + 1, AnnotationLevel: AnnotationFailure, Message: "bad"})
+	}
+
+	// First run: creates the check, in progress.
+	sc, err := NewStableCheck("build", "abc123", WithMarker("ci"), WithTemplate("{{range .Steps}}{{.}} {{end}}"), WithJsonContent(`{"Steps":[]}`))
+	require.NoError(t, err)
+	require.NoError(t, sc.UpdateFromCheck(rc))
+	assert.Equal(t, `create new check run "build"`, sc.PostAction())
+
+	diff, err := NewDiffFromFlags(&StableCommentDiffFlags{Patch: `[{"op":"add","path":"/Steps/-","value":"started"}]`})
+	require.NoError(t, err)
+	run, err := CheckRunFromFlags(&CheckRunFlags{Name: "build", SHA: "abc123"}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, sc.PostToCheck(rc, (*DiffTransformer)(&diff), run))
+
+	require.Len(t, fake.runs, 1)
+	assert.Equal(t, CheckInProgress, fake.runs[1].Status)
+	assert.Equal(t, "build", fake.runs[1].Output.Title)
+	assert.Contains(t, fake.runs[1].Output.Summary, "started \n<!-- A wise goat once said: ci\n")
+
+	// Second, independent run: updates the same check, appending to the summary, and annotating files.
+	sc, err = NewStableCheck("build", "abc123", WithMarker("ci"))
+	require.NoError(t, err)
+	require.NoError(t, sc.UpdateFromCheck(rc))
+	assert.Equal(t, `update check run "build" ID 1`, sc.PostAction())
+
+	diff, err = NewDiffFromFlags(&StableCommentDiffFlags{Patch: `[{"op":"add","path":"/Steps/-","value":"failed"}]`})
+	require.NoError(t, err)
+	run, err = CheckRunFromFlags(&CheckRunFlags{Name: "build", SHA: "abc123", Conclusion: CheckFailure, Title: "Build failed"}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, CheckCompleted, run.Status)
+	run.Output.Annotations = annotations
+	require.NoError(t, sc.PostToCheck(rc, (*DiffTransformer)(&diff), run))
+
+	require.Len(t, fake.runs, 1)
+	assert.Equal(t, CheckCompleted, fake.runs[1].Status)
+	assert.Equal(t, CheckFailure, fake.runs[1].Conclusion)
+	assert.Equal(t, "Build failed", fake.runs[1].Output.Title)
+	assert.Contains(t, fake.runs[1].Output.Summary, "started failed \n")
+	assert.Equal(t, annotations, fake.runs[1].Output.Annotations)
+	assert.Equal(t, []string{
+		"GET /repos/octo/repo/commits/abc123/check-runs",
+		"POST /repos/octo/repo/check-runs",
+		"GET /repos/octo/repo/commits/abc123/check-runs",
+		"GET /repos/octo/repo/check-runs/1/annotations",
+		"PATCH /repos/octo/repo/check-runs/1",
+		"PATCH /repos/octo/repo/check-runs/1",
+		"PATCH /repos/octo/repo/check-runs/1",
+	}, fake.requests)
+
+	// Updating the check with the same annotations does not duplicate them.
+	extra := CheckRunAnnotation{Path: "other.go", StartLine: 1, EndLine: 1, AnnotationLevel: AnnotationWarning, Message: "meh"}
+	run.Output.Annotations = append(append([]CheckRunAnnotation{}, annotations...), extra, extra)
+	fake.requests = nil
+	require.NoError(t, rc.UpdateCheckRun(1, &run))
+	assert.Equal(t, append(append([]CheckRunAnnotation{}, annotations...), extra), fake.runs[1].Output.Annotations)
+	assert.Equal(t, []string{
+		"GET /repos/octo/repo/check-runs/1/annotations",
+		"GET /repos/octo/repo/check-runs/1/annotations",
+		"PATCH /repos/octo/repo/check-runs/1",
+	}, fake.requests)
+}
+
+func TestCheckRunFromFlags(t *testing.T) {
+	_, err := CheckRunFromFlags(&CheckRunFlags{Name: "build", Status: CheckInProgress, Conclusion: CheckSuccess}, time.Now())
+	assert.Error(t, err)
+	_, err = CheckRunFromFlags(&CheckRunFlags{Name: "build", Status: CheckCompleted}, time.Now())
+	assert.Error(t, err)
+	_, err = CheckRunFromFlags(&CheckRunFlags{Name: "build", Conclusion: "great"}, time.Now())
+	assert.Error(t, err)
+
+	now := time.Now()
+	run, err := CheckRunFromFlags(&CheckRunFlags{Name: "build", Conclusion: CheckSuccess}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, CheckCompleted, run.Status)
+	assert.Equal(t, &now, run.CompletedAt)
+}
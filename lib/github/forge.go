@@ -0,0 +1,118 @@
+package github
+
+import (
+	"context"
+
+	"github.com/ccontavalli/enkit/lib/forge"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/retry"
+	"github.com/google/go-github/github"
+)
+
+// RepoClient implements the forge.Forge interface, so that stable comments
+// can be posted on github as well as on any other forge.
+var _ forge.Forge = &RepoClient{}
+
+// ListComments returns the free form comments of a PR, see GetPRComments.
+func (rc *RepoClient) ListComments(pr int) ([]forge.Comment, error) {
+	comments, err := rc.GetPRComments(pr)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]forge.Comment, 0, len(comments))
+	for _, comment := range comments {
+		if comment.ID == nil || comment.Body == nil {
+			continue
+		}
+		result = append(result, forge.Comment{ID: *comment.ID, Author: comment.GetUser().GetLogin(), Body: *comment.Body})
+	}
+	return result, nil
+}
+
+// AddComment adds a free form comment to a PR, see AddPRComment.
+func (rc *RepoClient) AddComment(pr int, body string) (int64, error) {
+	return rc.AddPRComment(pr, body)
+}
+
+// EditComment edits a free form comment, see EditPRComment.
+//
+// In github, comment ids are unique in the repository, pr is not used.
+func (rc *RepoClient) EditComment(pr int, id int64, body string) error {
+	return rc.EditPRComment(id, body)
+}
+
+// GetPullRequest returns the metadata of a PR.
+func (rc *RepoClient) GetPullRequest(pr int) (*forge.PullRequest, error) {
+	var result *github.PullRequest
+	var resp *github.Response
+	err := rc.retry.Run(func() error {
+		ctx, cancel := rc.context()
+		defer cancel()
+
+		var err error
+		result, resp, err = rc.client.PullRequests.Get(ctx, rc.repo.Owner, rc.repo.Name, pr)
+		return err
+	})
+	if err != nil {
+		return nil, NewGithubError(resp, err)
+	}
+
+	return &forge.PullRequest{
+		Number:       result.GetNumber(),
+		Title:        result.GetTitle(),
+		Description:  result.GetBody(),
+		Author:       result.GetUser().GetLogin(),
+		State:        result.GetState(),
+		URL:          result.GetHTMLURL(),
+		SourceBranch: result.GetHead().GetRef(),
+		HeadSHA:      result.GetHead().GetSHA(),
+		TargetBranch: result.GetBase().GetRef(),
+	}, nil
+}
+
+// ForgeFlags selects and configures the forge to use.
+type ForgeFlags struct {
+	Forge string
+
+	Github *RepoClientFlags
+	Gitlab *forge.GitlabFlags
+	Gitea  *forge.GiteaFlags
+}
+
+func DefaultForgeFlags() *ForgeFlags {
+	return &ForgeFlags{
+		Forge:  "github",
+		Github: DefaultRepoClientFlags(),
+		Gitlab: forge.DefaultGitlabFlags(),
+		Gitea:  forge.DefaultGiteaFlags(),
+	}
+}
+
+func (fl *ForgeFlags) Register(set kflags.FlagSet, prefix string) *ForgeFlags {
+	set.StringVar(&fl.Forge, prefix+"forge", fl.Forge, "Which forge hosts the repository - one of github, gitlab or gitea. Use the corresponding --github-*, --gitlab-* or --gitea-* flags to configure it")
+	fl.Github.Register(set, prefix)
+	fl.Gitlab.Register(set, prefix)
+	fl.Gitea.Register(set, prefix)
+	return fl
+}
+
+// NewForgeFromFlags returns the forge.Forge selected and configured via flags.
+func NewForgeFromFlags(ctx context.Context, fl *ForgeFlags, rmods ...retry.Modifier) (forge.Forge, error) {
+	var result forge.Forge
+	var err error
+	switch fl.Forge {
+	case "", "github":
+		result, err = NewRepoClient(RepoClientFromFlags(ctx, fl.Github, rmods...))
+	case "gitlab":
+		result, err = forge.NewGitlabFromFlags(ctx, fl.Gitlab, rmods...)
+	case "gitea":
+		result, err = forge.NewGiteaFromFlags(ctx, fl.Gitea, rmods...)
+	default:
+		return nil, kflags.NewUsageErrorf("unknown forge %q - must be one of github, gitlab or gitea", fl.Forge)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
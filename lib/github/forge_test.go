@@ -0,0 +1,87 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/forge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryForge is a forge.Forge keeping comments in memory.
+type memoryForge struct {
+	comments map[int][]forge.Comment
+	next     int64
+}
+
+func (mf *memoryForge) ListComments(pr int) ([]forge.Comment, error) {
+	return mf.comments[pr], nil
+}
+
+func (mf *memoryForge) AddComment(pr int, body string) (int64, error) {
+	mf.next++
+	mf.comments[pr] = append(mf.comments[pr], forge.Comment{ID: mf.next, Body: body})
+	return mf.next, nil
+}
+
+func (mf *memoryForge) EditComment(pr int, id int64, body string) error {
+	for i, comment := range mf.comments[pr] {
+		if comment.ID == id {
+			mf.comments[pr][i].Body = body
+			return nil
+		}
+	}
+	return fmt.Errorf("comment %d not found", id)
+}
+
+func (mf *memoryForge) GetPullRequest(pr int) (*forge.PullRequest, error) {
+	return &forge.PullRequest{Number: pr}, nil
+}
+
+func TestStableCommentOnForge(t *testing.T) {
+	mf := &memoryForge{comments: map[int][]forge.Comment{}}
+	mf.AddComment(3, "LGTM")
+
+	post := func(patch string) {
+		sc, err := NewStableComment(WithMarker("ci"), WithTemplate("{{range .Steps}}{{.}} {{end}}"), WithJsonContent(`{"Steps":[]}`))
+		require.NoError(t, err)
+		require.NoError(t, sc.UpdateFromPR(mf, 3))
+
+		diff, err := NewDiffFromFlags(&StableCommentDiffFlags{Patch: patch})
+		require.NoError(t, err)
+		require.NoError(t, sc.PostToPR(mf, (*DiffTransformer)(&diff), 3))
+	}
+
+	post(`[{"op":"add","path":"/Steps/-","value":"build"}]`)
+	post(`[{"op":"add","path":"/Steps/-","value":"test"}]`)
+
+	require.Len(t, mf.comments[3], 2)
+	assert.Equal(t, "LGTM", mf.comments[3][0].Body)
+	assert.Contains(t, mf.comments[3][1].Body, "build test \n<!-- A wise goat once said: ci\n")
+
+	sc, err := NewStableComment(WithMarker("ci"))
+	require.NoError(t, err)
+	id, payload, _, err := sc.FetchPRState(mf, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), id)
+	assert.Equal(t, `{"Steps":["build","test"]}`, payload)
+}
+
+func TestNewForgeFromFlags(t *testing.T) {
+	fl := DefaultForgeFlags()
+	fl.Forge = "bitbucket"
+	_, err := NewForgeFromFlags(context.Background(), fl)
+	assert.ErrorContains(t, err, "unknown forge")
+
+	fl.Forge = "gitea"
+	fl.Gitea.Token = "secret"
+	_, err = NewForgeFromFlags(context.Background(), fl)
+	assert.ErrorContains(t, err, "--gitea-url")
+
+	fl.Gitea.URL, fl.Gitea.Owner, fl.Gitea.Repo = "https://gitea.example.com", "octo", "repo"
+	f, err := NewForgeFromFlags(context.Background(), fl)
+	require.NoError(t, err)
+	assert.IsType(t, &forge.Gitea{}, f)
+}
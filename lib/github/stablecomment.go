@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Masterminds/sprig/v3"
+	"github.com/ccontavalli/enkit/lib/forge"
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/lib/logger"
 	"github.com/itchyny/gojq"
@@ -354,7 +355,10 @@ func StableCommentFromFlags(fl *StableCommentFlags) StableCommentModifier {
 	}
 }
 
-func (sc *StableComment) UpdateFromPR(rc *RepoClient, pr int) error {
+// UpdateFromPR loads the state of the stable comment already posted on the PR, if any.
+//
+// rc can be any forge: a RepoClient for github, or any of the forges in lib/forge.
+func (sc *StableComment) UpdateFromPR(rc forge.Forge, pr int) error {
 	id, payload, template, err := sc.FetchPRState(rc, pr)
 	if err != nil {
 		return err
@@ -370,18 +374,14 @@ func (sc *StableComment) UpdateFromPR(rc *RepoClient, pr int) error {
 	return nil
 }
 
-func (sc *StableComment) FetchPRState(rc *RepoClient, pr int) (int64, string, string, error) {
-	comments, err := rc.GetPRComments(pr)
+func (sc *StableComment) FetchPRState(rc forge.Forge, pr int) (int64, string, string, error) {
+	comments, err := rc.ListComments(pr)
 	if err != nil {
 		return 0, "", "", err
 	}
 
 	for _, comment := range comments {
-		if comment.Body == nil || comment.ID == nil {
-			continue
-		}
-
-		payload, template, err := sc.ParseComment(*comment.Body)
+		payload, template, err := sc.ParseComment(comment.Body)
 		if err != nil {
 			// If there's a wrapped error, it means parsing json or templates failed.
 			// Log the error, but otherwise re-use this comment. It was corrupted.
@@ -389,9 +389,9 @@ func (sc *StableComment) FetchPRState(rc *RepoClient, pr int) (int64, string, st
 				continue
 			}
 
-			sc.log.Warnf("PR %d - Corrupted comment %d? %s", pr, *comment.ID, err)
+			sc.log.Warnf("PR %d - Corrupted comment %d? %s", pr, comment.ID, err)
 		}
-		return *comment.ID, payload, template, nil
+		return comment.ID, payload, template, nil
 	}
 
 	// NOT FOUND - no defaults.
@@ -436,13 +436,13 @@ func (sc *StableComment) ParseComment(comment string) (string, string, error) {
 }
 
 // PostPayload posts a pre-formatted comment to the specified PR.
-func (sc *StableComment) PostPayload(rc *RepoClient, comment string, prnumber int) error {
+func (sc *StableComment) PostPayload(rc forge.Forge, comment string, prnumber int) error {
 	if sc.id == 0 {
-		_, err := rc.AddPRComment(prnumber, comment)
+		_, err := rc.AddComment(prnumber, comment)
 		return err
 	}
 
-	return rc.EditPRComment(sc.id, comment)
+	return rc.EditComment(prnumber, sc.id, comment)
 }
 
 // PostAction describes the action that needs to be performed for this comment.
@@ -453,7 +453,7 @@ func (sc *StableComment) PostAction() string {
 	return fmt.Sprintf("edit comment ID %d", sc.id)
 }
 
-func (sc *StableComment) PostToPR(rc *RepoClient, tr Transformer, prnumber int) error {
+func (sc *StableComment) PostToPR(rc forge.Forge, tr Transformer, prnumber int) error {
 	payload, err := sc.PreparePayloadFromDiff(tr)
 	if err != nil {
 		return err
@@ -4,27 +4,48 @@ import (
 	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/ulikunitz/xz"
 	"io"
 	"path"
 	"strings"
 )
 
+// Decoder returns a reader decompressing the content of the file with the name, based on its extension.
+//
+// It also returns the name of the file without the compression extension. Shorthands like .tgz
+// are turned into .tar. Files without an extension are returned unchanged.
 func Decoder(name string, current io.Reader) (string, io.Reader, error) {
 	ext := path.Ext(name)
 	name = strings.TrimSuffix(name, ext)
 	switch ext {
 	case "": // Plain text, no extension
 		return name, current, nil
-	case ".bz2":
+	case ".bz2", ".tbz2", ".tbz":
 		r := bzip2.NewReader(current)
-		return name, r, nil
-	case ".xz":
+		return tarName(name, ext, ".bz2"), r, nil
+	case ".xz", ".txz":
 		r, err := xz.NewReader(current)
-		return name, r, err
-	case ".gz":
+		return tarName(name, ext, ".xz"), r, err
+	case ".gz", ".tgz":
 		r, err := gzip.NewReader(current)
-		return name, r, err
+		return tarName(name, ext, ".gz"), r, err
+	case ".zst", ".zstd", ".tzst":
+		r, err := zstd.NewReader(current)
+		if err != nil {
+			return name, nil, err
+		}
+		return tarName(name, ext, ".zst", ".zstd"), r.IOReadCloser(), nil
 	}
 	return "", nil, fmt.Errorf("format of file not known - extension %s does not match any known format", ext)
 }
+
+// tarName appends .tar to the name if ext is a shorthand, not one of the plain extensions.
+func tarName(name, ext string, plain ...string) string {
+	for _, p := range plain {
+		if ext == p {
+			return name
+		}
+	}
+	return name + ".tar"
+}
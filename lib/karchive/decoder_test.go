@@ -0,0 +1,52 @@
+package karchive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoder(t *testing.T) {
+	content := []byte("If you beat your head against the wall, it is your head that breaks and not the wall.")
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	assert.NoError(t, err)
+	_, err = zw.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"wisdom.tar.gz", gz.Bytes(), "wisdom.tar"},
+		{"wisdom.tgz", gz.Bytes(), "wisdom.tar"},
+		{"wisdom.tar.zst", zs.Bytes(), "wisdom.tar"},
+		{"wisdom.tzst", zs.Bytes(), "wisdom.tar"},
+		{"wisdom.txt.zstd", zs.Bytes(), "wisdom.txt"},
+		{"wisdom", content, "wisdom"},
+	}
+	for _, test := range tests {
+		name, r, err := Decoder(test.name, bytes.NewReader(test.data))
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, name)
+		decoded, err := io.ReadAll(r)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, content, decoded, test.name)
+	}
+
+	_, _, err = Decoder("wisdom.rar", bytes.NewReader(content))
+	assert.Error(t, err)
+}
@@ -0,0 +1,251 @@
+package karchive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrLimitExceeded is wrapped by the errors returned when an archive exceeds
+// the limits set with WithMaxSize, WithMaxFileSize or WithMaxEntries.
+var ErrLimitExceeded = errors.New("archive limit exceeded")
+
+// delayed is a directory whose mode and times are set once all its content is unpacked.
+type delayed struct {
+	path        string
+	mode        os.FileMode
+	access, mod time.Time
+}
+
+// extractor creates the files, directories and symlinks of an archive in a directory.
+//
+// Archives can contain entries named like '../../../etc/passwd', symlinks pointing
+// outside of the directory, or files to write through previously created symlinks.
+// The extractor never creates or writes anything outside of the directory: names are
+// forced under it, symlinks resolving outside of it are rejected, and so are writes
+// through existing symlinks.
+type extractor struct {
+	// Absolute path of the directory, with symlinks resolved.
+	dir  string
+	o    options
+	dirs map[string]*delayed
+
+	// Entries and bytes unpacked so far, checked against the limits.
+	entries int
+	size    int64
+}
+
+func newExtractor(dir string, mods ...Modifier) (*extractor, error) {
+	o := options{dirmode: 0755}
+	Modifiers(mods).Apply(&o)
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute absolute path of %s - %w", dir, err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s - %w", abs, err)
+	}
+	return &extractor{dir: resolved, o: o, dirs: map[string]*delayed{}}, nil
+}
+
+// entry accounts for an entry of the archive, of the specified uncompressed size.
+//
+// Returns an error if unpacking it would exceed any of the limits. The size is
+// the one declared by the archive: file refuses to write more than that.
+func (e *extractor) entry(name string, size int64) error {
+	e.entries++
+	if e.o.maxEntries > 0 && e.entries > e.o.maxEntries {
+		return fmt.Errorf("%w: more than %d entries, at %s", ErrLimitExceeded, e.o.maxEntries, name)
+	}
+	if size < 0 {
+		return fmt.Errorf("entry %s has invalid size %d", name, size)
+	}
+	if e.o.maxFileSize > 0 && size > e.o.maxFileSize {
+		return fmt.Errorf("%w: %s is %d bytes uncompressed, more than %d", ErrLimitExceeded, name, size, e.o.maxFileSize)
+	}
+	e.size += size
+	if e.o.maxSize > 0 && e.size > e.o.maxSize {
+		return fmt.Errorf("%w: more than %d bytes uncompressed, at %s", ErrLimitExceeded, e.o.maxSize, name)
+	}
+	return nil
+}
+
+// path returns the path in the directory of an archive entry.
+func (e *extractor) path(name string) string {
+	// Without the extra '/' and filepath.Clean, a name like ../../../etc could
+	// result in overwriting arbitrary files on the system.
+	return filepath.Join(e.dir, filepath.Clean("/"+filepath.FromSlash(name)))
+}
+
+// within returns true if path is the directory, or is under it.
+func (e *extractor) within(path string) bool {
+	return path == e.dir || strings.HasPrefix(path, e.dir+string(os.PathSeparator))
+}
+
+// check returns an error unless path is in the directory once the symlinks in its
+// existing components are resolved, and its last component is not a symlink.
+func (e *extractor) check(path string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write through symlink %s", path)
+	}
+
+	existing, rest := path, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if full := filepath.Join(resolved, rest); !e.within(full) {
+				return fmt.Errorf("%s resolves to %s, outside of %s", path, full, e.dir)
+			}
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// The component does not exist, or is a dangling symlink, which could be
+		// turned into a path outside of the directory once its target is created.
+		if _, lerr := os.Lstat(existing); lerr == nil {
+			return fmt.Errorf("%s resolves through dangling symlink %s", path, existing)
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// mkdirAll creates the directory at path, and its parents, with the default mode.
+func (e *extractor) mkdirAll(path string) error {
+	if err := e.check(path); err != nil {
+		return err
+	}
+	created, err := MkdirAll(path, 0700)
+	if err != nil {
+		return err
+	}
+	for _, dir := range created {
+		e.dirs[dir] = &delayed{path: dir, mode: e.o.dirmode}
+	}
+	return nil
+}
+
+// mkdir creates the directory at path, setting its mode and times once the archive is unpacked.
+func (e *extractor) mkdir(path string, mode os.FileMode, access, mod time.Time) error {
+	if err := e.mkdirAll(path); err != nil {
+		return err
+	}
+	e.dirs[path] = &delayed{path: path, mode: mode.Perm(), access: access, mod: mod}
+	return nil
+}
+
+// file creates the file at path, with size bytes read from r.
+func (e *extractor) file(path string, r io.Reader, size int64, mode os.FileMode, access, mod time.Time) error {
+	// The mkdirAll here is to tolerate archives that don't include directory creation entries.
+	if err := e.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := e.check(path); err != nil {
+		return err
+	}
+
+	wf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Reading one more byte than expected is enough to detect a mismatch.
+	n, err := io.Copy(wf, io.LimitReader(r, size+1))
+	if err != nil {
+		wf.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if n != size {
+		wf.Close()
+		return fmt.Errorf("could not write %s: archive indicates %d bytes, only %d written", path, size, n)
+	}
+	if err := wf.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", path, err)
+	}
+
+	if !mod.IsZero() || !access.IsZero() {
+		if err := os.Chtimes(path, access, mod); err != nil {
+			return fmt.Errorf("could not set time of file %s: %w", path, err)
+		}
+	}
+
+	if err := os.Chmod(path, os.FileMode(uint32(mode.Perm()) & ^e.o.fumask)); err != nil {
+		return fmt.Errorf("could not chmod file %s: %w", path, err)
+	}
+	return nil
+}
+
+// symlink creates a symlink at path pointing to target.
+//
+// Absolute targets are relative to the directory, and turned into absolute paths
+// under it. Relative targets are relative to the directory containing the symlink,
+// as usual. Either way, targets must be in the directory.
+func (e *extractor) symlink(path, target string) error {
+	if err := e.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	dest := filepath.FromSlash(target)
+	if filepath.IsAbs(dest) {
+		dest = filepath.Join(e.dir, dest)
+		target = dest
+	} else {
+		dest = filepath.Join(filepath.Dir(path), dest)
+	}
+	if !e.within(dest) {
+		return fmt.Errorf("link %s points to %s, outside of %s", path, target, e.dir)
+	}
+
+	if err := os.Symlink(target, path); err != nil {
+		return fmt.Errorf("could not create link %s to %s: %w", path, target, err)
+	}
+	return nil
+}
+
+// finish sets the mode and times of the directories created.
+func (e *extractor) finish() error {
+	sorted := []*delayed{}
+	for _, v := range e.dirs {
+		sorted = append(sorted, v)
+	}
+
+	// The requested mask / privileges may cause a dir to become not writable.
+	// To apply the privileges correctly, we need to move from the innermost directory to the
+	// outermost one.
+	//
+	// Doing this "properly" would require building a tree. But we're slackers.
+	// What we do instead is just fix the privileges in reverse alphabetical order.
+	// Guess what? In reverse alphabetical order, a subdirectory is guaranteed to appear
+	// before its parent directory.
+	//
+	// Well, modulo weird internationalization rules, which I believe do not apply to a simple >.
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].path > sorted[j].path
+	})
+
+	for _, dir := range sorted {
+		if !dir.mod.IsZero() || !dir.access.IsZero() {
+			if err := os.Chtimes(dir.path, dir.access, dir.mod); err != nil {
+				return fmt.Errorf("could not set time of file %s: %w", dir.path, err)
+			}
+		}
+		if err := os.Chmod(dir.path, os.FileMode(uint32(dir.mode.Perm()) & ^e.o.dumask)); err != nil {
+			return fmt.Errorf("could not chmod: %w", err)
+		}
+	}
+	return nil
+}
@@ -5,9 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"sort"
-	"time"
 )
 
 type options struct {
@@ -16,6 +13,10 @@ type options struct {
 
 	// Default directory file mode.
 	dirmode os.FileMode
+
+	// Limits on the content of the archive, 0 means no limit.
+	maxSize, maxFileSize int64
+	maxEntries           int
 }
 
 type Modifier func(*options)
@@ -72,6 +73,34 @@ func WithDefaultDirMode(mode os.FileMode) Modifier {
 	}
 }
 
+// WithMaxSize limits the total uncompressed size of the files in the archive.
+//
+// Unpacking fails with an error wrapping ErrLimitExceeded as soon as the
+// limit is crossed. The default, 0, means no limit.
+func WithMaxSize(size int64) Modifier {
+	return func(o *options) {
+		o.maxSize = size
+	}
+}
+
+// WithMaxFileSize limits the uncompressed size of each file in the archive.
+//
+// The default, 0, means no limit.
+func WithMaxFileSize(size int64) Modifier {
+	return func(o *options) {
+		o.maxFileSize = size
+	}
+}
+
+// WithMaxEntries limits the number of files, directories and symlinks in the archive.
+//
+// The default, 0, means no limit.
+func WithMaxEntries(entries int) Modifier {
+	return func(o *options) {
+		o.maxEntries = entries
+	}
+}
+
 // Untarz opens a .tar.{gz,xz,bz2} file, and unpacks it by invoking Untar.
 func Untarz(name string, r io.Reader, dest string, mods ...Modifier) error {
 	_, d, err := Decoder(name, r)
@@ -86,25 +115,16 @@ func Untarz(name string, r io.Reader, dest string, mods ...Modifier) error {
 // Untar can only create regular files, symlinks, and directories.
 // The presence of any other kind of file in the archive will cause the opening to fail.
 //
-// Except for targets of symlinks, if the tar contains files named like '../../../', they
-// won't be allowed to escape the unpack directory: all unpacked files will be placed in
-// a subdirectory of dir, no matter what.
+// If the tar contains files named like '../../../', they won't be allowed to escape the
+// unpack directory: all unpacked files will be placed in a subdirectory of dir, no matter
+// what. Symlinks pointing outside of dir, and files to write through symlinks, cause the
+// unpacking to fail. See extractor for details.
 func Untar(r io.Reader, dir string, mods ...Modifier) error {
-	o := options{dirmode: 0755}
-	Modifiers(mods).Apply(&o)
-
-	dir, err := filepath.Abs(dir)
+	e, err := newExtractor(dir, mods...)
 	if err != nil {
-		return fmt.Errorf("could not compute absolute path of %s - %w", dir, err)
-	}
-
-	type delayed struct {
-		path        string
-		mode        os.FileMode
-		access, mod time.Time
+		return err
 	}
 
-	dirs := map[string]*delayed{}
 	tr := tar.NewReader(r)
 	for {
 		f, err := tr.Next()
@@ -115,97 +135,27 @@ func Untar(r io.Reader, dir string, mods ...Modifier) error {
 			return err
 		}
 
-		// Without the extra '/' and filepath.Clean, a Name like ../../../etc could
-		// result in overwriting arbitrary files on the system.
-		abs := filepath.Join(dir, filepath.Clean("/"+filepath.FromSlash(f.Name)))
+		if err := e.entry(f.Name, f.Size); err != nil {
+			return err
+		}
+
+		abs := e.path(f.Name)
 		mode := f.FileInfo().Mode()
 
 		switch f.Typeflag {
 		case tar.TypeSymlink:
-			dest := filepath.Join(dir, filepath.FromSlash(f.Linkname))
-			if err := os.Symlink(dest, abs); err != nil {
-				return fmt.Errorf("could not create link %s to %s: %w", abs, dest, err)
-			}
+			err = e.symlink(abs, f.Linkname)
 		case tar.TypeReg:
-			// The MkdirAll here is to tolerate .tar.gz files that don't include directory creation entries.
-			created, err := MkdirAll(filepath.Dir(abs), 0700)
-			if err != nil {
-				return err
-			}
-			for _, dir := range created {
-				dirs[dir] = &delayed{path: dir, mode: o.dirmode}
-			}
-
-			wf, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				return err
-			}
-
-			n, err := io.Copy(wf, tr)
-			if err != nil {
-				return fmt.Errorf("could not write %s: %w", abs, err)
-			}
-			if n != f.Size {
-				return fmt.Errorf("could not write %s: tar indicates %d bytes, only %d written", abs, f.Size, n)
-			}
-			if err := wf.Close(); err != nil {
-				return fmt.Errorf("closing %s: %w", abs, err)
-			}
-
-			if !f.ModTime.IsZero() || !f.AccessTime.IsZero() {
-				if err := os.Chtimes(abs, f.AccessTime, f.ModTime); err != nil {
-					return fmt.Errorf("could not set time of file %s: %w", abs, err)
-				}
-			}
-
-			if err := os.Chmod(abs, os.FileMode(uint32(mode.Perm()) & ^o.fumask)); err != nil {
-				return fmt.Errorf("could not chmod directory %s: %w", abs, err)
-			}
-
+			err = e.file(abs, tr, f.Size, mode, f.AccessTime, f.ModTime)
 		case tar.TypeDir:
-			created, err := MkdirAll(abs, 0700)
-			if err != nil {
-				return err
-			}
-			for _, dir := range created {
-				dirs[dir] = &delayed{path: dir, mode: o.dirmode}
-			}
-			dirs[abs] = &delayed{path: abs, mode: mode.Perm(), access: f.AccessTime, mod: f.ModTime}
-
+			err = e.mkdir(abs, mode, f.AccessTime, f.ModTime)
 		default:
 			return fmt.Errorf("tar file entry %s contained unsupported file type %v", f.Name, mode)
 		}
-	}
-
-	sorted := []*delayed{}
-	for _, v := range dirs {
-		sorted = append(sorted, v)
-	}
-
-	// The requested mask / privileges may cause a dir to become not writable.
-	// To apply the privileges correctly, we need to move from the innermost directory to the
-	// outermost one.
-	//
-	// Doing this "properly" would require building a tree. But we're slackers.
-	// What we do instead is just fix the privileges in reverse alphabetical order.
-	// Guess what? In reverse alphabetical order, a subdirectory is guaranteed to appear
-	// before its parent directory.
-	//
-	// Well, modulo weird internationalization rules, which I believe do not apply to a simple >.
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].path > sorted[j].path
-	})
-
-	for _, dir := range dirs {
-		if !dir.mod.IsZero() || !dir.access.IsZero() {
-			if err := os.Chtimes(dir.path, dir.access, dir.mod); err != nil {
-				return fmt.Errorf("could not set time of file %s: %w", dir.path, err)
-			}
-		}
-		if err := os.Chmod(dir.path, os.FileMode(uint32(dir.mode.Perm()) & ^o.dumask)); err != nil {
-			return fmt.Errorf("could not chmod: %w", err)
+		if err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return e.finish()
 }
@@ -81,3 +81,89 @@ func TestCrazyUntar(t *testing.T) {
 	}
 	assert.Equal(t, expected, found)
 }
+
+func tarOf(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		body := ""
+		if hdr.Typeflag == tar.TypeReg {
+			body = "content of " + hdr.Name
+			hdr.Size = int64(len(body))
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return buf
+}
+
+func TestUntarSymlinks(t *testing.T) {
+	td := t.TempDir()
+	err := Untar(tarOf(t,
+		&tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "dir/sub/rel", Typeflag: tar.TypeSymlink, Linkname: "../file"},
+		&tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/dir/file"},
+	), td)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(td, "dir/sub/rel"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content of dir/file", string(data))
+	target, err := os.Readlink(filepath.Join(td, "dir/sub/rel"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../file", target)
+	data, err = os.ReadFile(filepath.Join(td, "abs"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content of dir/file", string(data))
+
+	outside := t.TempDir()
+	for _, headers := range [][]*tar.Header{
+		{{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../../../" + outside}},
+		{{Name: "dir/escape", Typeflag: tar.TypeSymlink, Linkname: "../.."}},
+	} {
+		err := Untar(tarOf(t, headers...), t.TempDir())
+		assert.ErrorContains(t, err, "outside of")
+	}
+
+	// Files cannot be written through symlinks, even pointing inside the directory.
+	for _, headers := range [][]*tar.Header{
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target"}, {Name: "link", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"}, {Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"}, {Name: "link/sub", Typeflag: tar.TypeDir, Mode: 0755}},
+	} {
+		td := t.TempDir()
+		err := Untar(tarOf(t, headers...), td)
+		assert.ErrorContains(t, err, "symlink")
+		assert.NoFileExists(t, filepath.Join(td, "target"))
+		assert.NoDirExists(t, filepath.Join(td, "dir"))
+	}
+}
+
+func TestUntarLimits(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "dir/small", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "dir/larger-file", Typeflag: tar.TypeReg, Mode: 0644},
+		}
+	}
+	// The files are 20 and 26 bytes long.
+	assert.NoError(t, Untar(tarOf(t, headers()...), t.TempDir(), WithMaxEntries(3), WithMaxSize(46), WithMaxFileSize(26)))
+
+	for _, test := range []struct {
+		mod     Modifier
+		message string
+	}{
+		{WithMaxEntries(2), "more than 2 entries, at dir/larger-file"},
+		{WithMaxSize(45), "more than 45 bytes uncompressed, at dir/larger-file"},
+		{WithMaxFileSize(25), "dir/larger-file is 26 bytes uncompressed, more than 25"},
+	} {
+		td := t.TempDir()
+		err := Untar(tarOf(t, headers()...), td, test.mod)
+		assert.ErrorIs(t, err, ErrLimitExceeded)
+		assert.ErrorContains(t, err, test.message)
+		assert.NoFileExists(t, filepath.Join(td, "dir/larger-file"))
+	}
+}
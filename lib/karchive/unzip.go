@@ -1,12 +1,15 @@
 package karchive
 
 import (
+	"archive/zip"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var runCommand = func(cmd *exec.Cmd) error {
@@ -72,3 +75,69 @@ func Unzip(ctx context.Context, zipPath string) (*TempUnzipDir, error) {
 		tempDir: dir,
 	}, nil
 }
+
+// UnzipTo unpacks the zip archive of the specified size read from r in dir.
+//
+// Unlike Unzip, it does not rely on the unzip command. Like Untar, it can only create
+// regular files, symlinks, and directories, and never creates or writes anything
+// outside of dir.
+func UnzipTo(r io.ReaderAt, size int64, dir string, mods ...Modifier) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	e, err := newExtractor(dir, mods...)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if err := e.entry(f.Name, int64(f.UncompressedSize64)); err != nil {
+			return err
+		}
+
+		abs := e.path(f.Name)
+		mode := f.Mode()
+
+		switch {
+		case mode&os.ModeSymlink != 0:
+			err = unzipSymlink(e, abs, f)
+		case mode.IsDir():
+			err = e.mkdir(abs, mode, time.Time{}, f.Modified)
+		case mode.IsRegular():
+			err = unzipFile(e, abs, f)
+		default:
+			return fmt.Errorf("zip file entry %s contained unsupported file type %v", f.Name, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.finish()
+}
+
+// unzipSymlink creates a symlink from a zip entry, which stores the target as content.
+func unzipSymlink(e *extractor, abs string, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return fmt.Errorf("could not read link %s: %w", f.Name, err)
+	}
+	return e.symlink(abs, string(target))
+}
+
+func unzipFile(e *extractor, abs string, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return e.file(abs, rc, int64(f.UncompressedSize64), f.Mode(), time.Time{}, f.Modified)
+}
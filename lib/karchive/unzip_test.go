@@ -1,8 +1,13 @@
 package karchive
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
@@ -96,3 +101,53 @@ func TestUnzipActual(t *testing.T) {
 		})
 	}
 }
+
+func TestUnzipTo(t *testing.T) {
+	zipOf := func(entries map[string]os.FileMode) *bytes.Reader {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		// Sorted, so directories and symlinks are created before what they contain.
+		names := []string{}
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+			hdr.SetMode(entries[name])
+			w, err := zw.CreateHeader(hdr)
+			assert.NoError(t, err)
+			switch mode := entries[name]; {
+			case mode&os.ModeSymlink != 0:
+				_, err = w.Write([]byte("../dir/file"))
+			case mode.IsRegular():
+				_, err = w.Write([]byte("content of " + name))
+			}
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, zw.Close())
+		return bytes.NewReader(buf.Bytes())
+	}
+
+	td := t.TempDir()
+	r := zipOf(map[string]os.FileMode{
+		"dir/":          os.ModeDir | 0750,
+		"dir/file":      0640,
+		"link/to":       os.ModeSymlink | 0777,
+		"../../escaped": 0600,
+	})
+	assert.NoError(t, UnzipTo(r, r.Size(), td))
+
+	data, err := os.ReadFile(filepath.Join(td, "link/to"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content of dir/file", string(data))
+	data, err = os.ReadFile(filepath.Join(td, "escaped"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content of ../../escaped", string(data))
+	info, err := os.Stat(filepath.Join(td, "dir"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	r = zipOf(map[string]os.FileMode{"link": os.ModeSymlink | 0777})
+	assert.ErrorContains(t, UnzipTo(r, r.Size(), t.TempDir()), "outside of")
+}
@@ -0,0 +1,222 @@
+package kemail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ErrNotBounce is returned by ParseBounce for messages that are not delivery status notifications.
+var ErrNotBounce = errors.New("message is not a delivery status notification")
+
+// BounceRecipient is the delivery status of a single recipient, as reported
+// in a delivery status notification.
+type BounceRecipient struct {
+	// Recipient is the address delivery was attempted to (Final-Recipient).
+	Recipient string
+	// OriginalRecipient is the address as originally specified by the sender, if reported.
+	OriginalRecipient string
+	// Action is one of failed, delayed, delivered, relayed or expanded.
+	Action string
+	// Status is the RFC 3463 status code, like 5.1.1.
+	Status string
+	// Diagnostic is the error returned by the remote server, like "550 5.1.1 user unknown".
+	Diagnostic string
+	// RemoteMTA is the server that reported the error, if any.
+	RemoteMTA string
+}
+
+// Permanent returns true if delivery to the recipient failed permanently.
+//
+// Delayed deliveries and transient failures are not permanent: the message
+// may still be delivered.
+func (r BounceRecipient) Permanent() bool {
+	if r.Action != "" {
+		return strings.EqualFold(r.Action, "failed")
+	}
+	return strings.HasPrefix(r.Status, "5.")
+}
+
+// Bounce is a parsed delivery status notification, as per RFC 3464.
+type Bounce struct {
+	// ReportingMTA is the server that generated the notification.
+	ReportingMTA string
+	// EnvelopeID is the ENVID of the original message, if any.
+	EnvelopeID string
+	// MessageID and Subject are from the headers of the original message,
+	// if they were returned in the notification.
+	MessageID string
+	Subject   string
+
+	Recipients []BounceRecipient
+}
+
+// Failed returns the recipients for which delivery failed permanently.
+func (b *Bounce) Failed() []BounceRecipient {
+	var failed []BounceRecipient
+	for _, recipient := range b.Recipients {
+		if recipient.Permanent() {
+			failed = append(failed, recipient)
+		}
+	}
+	return failed
+}
+
+// BounceError is the error reported for a recipient that bounced.
+type BounceError struct {
+	BounceRecipient
+}
+
+func (e *BounceError) Error() string {
+	if e.Diagnostic != "" {
+		return fmt.Sprintf("delivery to %s failed permanently (%s) - %s", e.Recipient, e.Status, e.Diagnostic)
+	}
+	return fmt.Sprintf("delivery to %s failed permanently (%s)", e.Recipient, e.Status)
+}
+
+// ParseBounce parses a delivery status notification.
+//
+// Returns ErrNotBounce if the message is not a multipart/report of type
+// delivery-status, or does not contain one. Bounces in proprietary formats
+// are not recognized.
+func ParseBounce(r io.Reader) (*Bounce, error) {
+	message, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bounce := &Bounce{}
+	found, err := parseBouncePart(bounce, textproto.MIMEHeader(message.Header), message.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotBounce
+	}
+	return bounce, nil
+}
+
+// parseBouncePart looks for a delivery-status report in a MIME part, recursively.
+//
+// Returns true if a report was found.
+func parseBouncePart(bounce *Bounce, header textproto.MIMEHeader, body io.Reader) (bool, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false, nil
+	}
+	if strings.EqualFold(header.Get("Content-Transfer-Encoding"), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	switch mediaType {
+	case "message/delivery-status":
+		return true, parseDeliveryStatus(bounce, body)
+	case "message/rfc822", "text/rfc822-headers":
+		original, err := mail.ReadMessage(body)
+		if err != nil {
+			return false, nil
+		}
+		if bounce.MessageID == "" {
+			bounce.MessageID = original.Header.Get("Message-ID")
+			bounce.Subject = original.Header.Get("Subject")
+		}
+		return false, nil
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return false, nil
+	}
+
+	found := false
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return found, fmt.Errorf("invalid multipart message - %w", err)
+		}
+		ok, err := parseBouncePart(bounce, part.Header, part)
+		if err != nil {
+			return found, err
+		}
+		found = found || ok
+	}
+}
+
+// parseDeliveryStatus parses the per-message and per-recipient fields of a
+// message/delivery-status part, RFC 3464 section 2.
+func parseDeliveryStatus(bounce *Bounce, body io.Reader) error {
+	reader := textproto.NewReader(bufio.NewReader(body))
+	first := true
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if first {
+				bounce.ReportingMTA = fieldValue(fields.Get("Reporting-MTA"))
+				bounce.EnvelopeID = fields.Get("Original-Envelope-Id")
+				first = false
+			} else {
+				bounce.Recipients = append(bounce.Recipients, BounceRecipient{
+					Recipient:         fieldValue(fields.Get("Final-Recipient")),
+					OriginalRecipient: fieldValue(fields.Get("Original-Recipient")),
+					Action:            strings.ToLower(fields.Get("Action")),
+					Status:            statusCode(fields.Get("Status")),
+					Diagnostic:        fieldValue(fields.Get("Diagnostic-Code")),
+					RemoteMTA:         fieldValue(fields.Get("Remote-MTA")),
+				})
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid delivery-status report - %w", err)
+		}
+	}
+}
+
+// statusCode returns the status code of a Status field, dropping any comment
+// following it, or an empty string if the field is missing.
+func statusCode(value string) string {
+	code, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+	return code
+}
+
+// fieldValue strips the type from a typed field, "rfc822; user@example.com" becomes "user@example.com".
+func fieldValue(value string) string {
+	if _, rest, ok := strings.Cut(value, ";"); ok {
+		value = rest
+	}
+	return strings.TrimSpace(value)
+}
+
+// ReportBounce invokes the progress callback for each recipient of the bounce
+// for which delivery failed permanently, with status ProgressBounced and a
+// *BounceError.
+//
+// This allows the same callback used to track sending to record recipients
+// that failed after the message was handed off to the SMTP server.
+func ReportBounce(bounce *Bounce, cb ProgressCallback) {
+	if cb == nil {
+		return
+	}
+	failed := bounce.Failed()
+	for idx, recipient := range failed {
+		cb(Progress{
+			Index:     idx,
+			Total:     len(failed),
+			Label:     recipient.Recipient,
+			Recipient: recipient.Recipient,
+			Status:    ProgressBounced,
+			Err:       &BounceError{BounceRecipient: recipient},
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package kemail
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/config/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBounce = `Return-Path: <>
+From: MAILER-DAEMON@mx.example.com (Mail Delivery System)
+Subject: Undelivered Mail Returned to Sender
+To: noreply@example.com
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="B1F2A3.1700000000/mx.example.com"
+
+--B1F2A3.1700000000/mx.example.com
+Content-Description: Notification
+Content-Type: text/plain; charset=us-ascii
+
+This is the mail system at host mx.example.com.
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+--B1F2A3.1700000000/mx.example.com
+Content-Description: Delivery report
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+X-Postfix-Queue-ID: B1F2A3
+Arrival-Date: Tue, 14 Nov 2023 22:13:20 +0000 (UTC)
+
+Final-Recipient: rfc822; gone@example.org
+Original-Recipient: rfc822;gone@example.org
+Action: failed
+Status: 5.1.1
+Remote-MTA: dns; mail.example.org
+Diagnostic-Code: smtp; 550 5.1.1 <gone@example.org>: Recipient address
+    rejected: User unknown
+
+Final-Recipient: rfc822; slow@example.org
+Action: delayed
+Status: 4.4.1
+Diagnostic-Code: X-Postfix; connect to mail.example.org: Connection timed out
+
+--B1F2A3.1700000000/mx.example.com
+Content-Description: Undelivered Message Headers
+Content-Type: text/rfc822-headers
+
+From: noreply@example.com
+To: gone@example.org
+Subject: Welcome
+Message-ID: <%s@example.com>
+
+--B1F2A3.1700000000/mx.example.com--
+`
+
+func TestParseBounce(t *testing.T) {
+	bounce, err := ParseBounce(strings.NewReader(strings.Replace(testBounce, "%s", "welcome-0011", 1)))
+	require.NoError(t, err)
+	assert.Equal(t, "mx.example.com", bounce.ReportingMTA)
+	assert.Equal(t, "<welcome-0011@example.com>", bounce.MessageID)
+	assert.Equal(t, "Welcome", bounce.Subject)
+	assert.Equal(t, []BounceRecipient{
+		{
+			Recipient:         "gone@example.org",
+			OriginalRecipient: "gone@example.org",
+			Action:            "failed",
+			Status:            "5.1.1",
+			Diagnostic:        "550 5.1.1 <gone@example.org>: Recipient address rejected: User unknown",
+			RemoteMTA:         "mail.example.org",
+		},
+		{
+			Recipient:  "slow@example.org",
+			Action:     "delayed",
+			Status:     "4.4.1",
+			Diagnostic: "connect to mail.example.org: Connection timed out",
+		},
+	}, bounce.Recipients)
+	require.Len(t, bounce.Failed(), 1)
+
+	var reported []Progress
+	ReportBounce(bounce, func(p Progress) ProgressAction {
+		reported = append(reported, p)
+		return ProgressContinue
+	})
+	require.Len(t, reported, 1)
+	assert.Equal(t, ProgressBounced, reported[0].Status)
+	assert.Equal(t, "gone@example.org", reported[0].Recipient)
+	assert.ErrorContains(t, reported[0].Err, "User unknown")
+
+	_, err = ParseBounce(strings.NewReader("From: user@example.com\r\nSubject: hello\r\n\r\nJust a message.\r\n"))
+	assert.ErrorIs(t, err, ErrNotBounce)
+
+	// Status is mandatory, but not all MTAs send it.
+	bounce, err = ParseBounce(strings.NewReader(strings.Replace(strings.Replace(testBounce, "%s", "welcome-0011", 1), "Status: 5.1.1\n", "", 1)))
+	require.NoError(t, err)
+	require.Len(t, bounce.Recipients, 2)
+	assert.Equal(t, "", bounce.Recipients[0].Status)
+	assert.True(t, bounce.Recipients[0].Permanent())
+}
+
+func TestQueueHandleBounce(t *testing.T) {
+	sender := &recordingSender{}
+	clock := &fakeClock{now: time.Now()}
+	queue := newTestQueue(t, memory.NewStore(), clock, sender)
+
+	id, err := queue.Enqueue(NewQueuedMessage("Service <noreply@example.com>", "gone@example.org", "Welcome", "text", ""))
+	require.NoError(t, err)
+	message, err := queue.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"<" + id + "@example.com>"}, message.Headers["Message-ID"])
+	_, err = queue.Process()
+	require.NoError(t, err)
+
+	var progress []QueueState
+	queue.progress = func(message *QueuedMessage) {
+		progress = append(progress, message.State)
+	}
+
+	unknown, err := ParseBounce(strings.NewReader(strings.Replace(testBounce, "%s", "unknown", 1)))
+	require.NoError(t, err)
+	message, err = queue.HandleBounce(unknown)
+	require.NoError(t, err)
+	assert.Nil(t, message)
+
+	bounce, err := ParseBounce(strings.NewReader(strings.Replace(testBounce, "%s", id, 1)))
+	require.NoError(t, err)
+	message, err = queue.HandleBounce(bounce)
+	require.NoError(t, err)
+	require.NotNil(t, message)
+	assert.Equal(t, QueueFailed, message.State)
+	assert.Contains(t, message.LastError, "User unknown")
+	assert.Equal(t, []QueueState{QueueFailed}, progress)
+}
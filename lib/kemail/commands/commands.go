@@ -0,0 +1,467 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/lib/config/factory"
+	"github.com/ccontavalli/enkit/lib/kemail"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
+	"github.com/ccontavalli/enkit/lib/srand"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// DefaultApp and DefaultNamespace identify where the queue is kept in the config store.
+const (
+	DefaultApp       = kemail.DefaultQueueApp
+	DefaultNamespace = kemail.DefaultQueueNamespace
+)
+
+type Root struct {
+	*cobra.Command
+	*client.BaseFlags
+
+	Store     *factory.Flags
+	App       string
+	Namespace string
+}
+
+func New(base *client.BaseFlags) *Root {
+	root := NewRoot(base)
+
+	root.AddCommand(NewList(root).Command)
+	root.AddCommand(NewShow(root).Command)
+	root.AddCommand(NewRetry(root).Command)
+	root.AddCommand(NewPurge(root).Command)
+	root.AddCommand(NewBounce(root).Command)
+	root.AddCommand(NewProcess(root).Command)
+
+	return root
+}
+
+func NewRoot(base *client.BaseFlags) *Root {
+	root := &Root{
+		Command: &cobra.Command{
+			Use:           "email",
+			Short:         "Inspect and manage the outbound email queue",
+			SilenceUsage:  true,
+			SilenceErrors: true,
+			Long: `email - inspects and manages the outbound email queue
+
+Messages are queued in a config store by the servers sending them, and
+delivered by 'enkit email process'. Use the --email-config-store flags to
+point to the same store used by the server.`,
+		},
+		BaseFlags: base,
+		Store:     factory.DefaultFlags(),
+		App:       DefaultApp,
+		Namespace: DefaultNamespace,
+	}
+
+	set := &kcobra.FlagSet{FlagSet: root.PersistentFlags()}
+	root.Store.Register(set, "email-")
+	set.StringVar(&root.App, "email-queue-app", root.App, "App name of the email queue in the config store")
+	set.StringVar(&root.Namespace, "email-queue-namespace", root.Namespace, "Namespace of the email queue in the config store")
+	return root
+}
+
+// Queue opens the email queue configured via flags.
+func (r *Root) Queue(mods ...kemail.QueueModifier) (*kemail.Queue, error) {
+	workspace, err := factory.NewStore(rand.New(srand.Source), factory.FromFlags(r.Store))
+	if err != nil {
+		return nil, err
+	}
+	store, err := workspace.Open(r.App, r.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return kemail.NewQueue(store, append([]kemail.QueueModifier{kemail.WithQueueLogger(r.Log)}, mods...)...)
+}
+
+func parseStates(states []string) ([]kemail.QueueState, error) {
+	var result []kemail.QueueState
+	for _, state := range states {
+		switch s := kemail.QueueState(strings.ToLower(state)); s {
+		case kemail.QueuePending, kemail.QueueSending, kemail.QueueSent, kemail.QueueFailed, kemail.QueueExpired:
+			result = append(result, s)
+		default:
+			return nil, kflags.NewUsageErrorf("invalid state %q - must be one of pending, sending, sent, failed, expired", state)
+		}
+	}
+	return result, nil
+}
+
+type List struct {
+	*cobra.Command
+	root *Root
+
+	States []string
+}
+
+func NewList(root *Root) *List {
+	command := &List{
+		Command: &cobra.Command{
+			Use:     "ls",
+			Short:   "List queued messages, oldest first",
+			Aliases: []string{"list"},
+			Example: `  $ enkit email ls --state=failed --state=expired
+        Show the messages that could not be delivered.`,
+			Args: cobra.NoArgs,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringArrayVarP(&command.States, "state", "s", nil, "Only show messages in this state (repeatable)")
+	return command
+}
+
+func (c *List) Run(cmd *cobra.Command, args []string) error {
+	states, err := parseStates(c.States)
+	if err != nil {
+		return err
+	}
+	queue, err := c.root.Queue()
+	if err != nil {
+		return err
+	}
+	messages, err := queue.List(states...)
+	if err != nil {
+		return err
+	}
+	return printMessages(os.Stdout, messages)
+}
+
+func printMessages(w io.Writer, messages []*kemail.QueuedMessage) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tSTATE\tATTEMPTS\tTO\tLAST ERROR")
+	for _, message := range messages {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", message.ID, message.Created.Format(time.DateTime),
+			message.State, message.Attempts, message.Label, message.LastError)
+	}
+	return tw.Flush()
+}
+
+type Show struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewShow(root *Root) *Show {
+	command := &Show{
+		Command: &cobra.Command{
+			Use:   "show <id>...",
+			Short: "Show the details of queued messages",
+			Args:  cobra.MinimumNArgs(1),
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (c *Show) Run(cmd *cobra.Command, args []string) error {
+	queue, err := c.root.Queue()
+	if err != nil {
+		return err
+	}
+	for _, id := range args {
+		message, err := queue.Get(id)
+		if err != nil {
+			return fmt.Errorf("could not retrieve message %s: %w", id, err)
+		}
+		printMessage(os.Stdout, message)
+	}
+	return nil
+}
+
+func printMessage(w io.Writer, message *kemail.QueuedMessage) {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%s (%s)", t.Format(time.DateTime), humanize.Time(t))
+	}
+
+	fmt.Fprintf(w, "Message %s\n", message.ID)
+	if message.Campaign != "" {
+		fmt.Fprintf(w, "  Campaign:     %s\n", message.Campaign)
+	}
+	fmt.Fprintf(w, "  Recipient:    %s\n", message.Label)
+	fmt.Fprintf(w, "  Subject:      %s\n", strings.Join(message.Headers["Subject"], ", "))
+	fmt.Fprintf(w, "  State:        %s\n", message.State)
+	fmt.Fprintf(w, "  Attempts:     %d\n", message.Attempts)
+	if message.LastError != "" {
+		fmt.Fprintf(w, "  Last error:   %s\n", message.LastError)
+	}
+	fmt.Fprintf(w, "  Created:      %s\n", formatTime(message.Created))
+	fmt.Fprintf(w, "  Last attempt: %s\n", formatTime(message.LastAttempt))
+	if !message.State.Done() {
+		fmt.Fprintf(w, "  Next attempt: %s\n", formatTime(message.NextAttempt))
+	}
+	fmt.Fprintf(w, "  Deadline:     %s\n", formatTime(message.Deadline))
+	if message.State == kemail.QueueSent {
+		fmt.Fprintf(w, "  Sent:         %s\n", formatTime(message.Sent))
+	}
+}
+
+type Retry struct {
+	*cobra.Command
+	root *Root
+
+	States []string
+}
+
+func NewRetry(root *Root) *Retry {
+	command := &Retry{
+		Command: &cobra.Command{
+			Use:   "retry [<id>...]",
+			Short: "Schedule messages for immediate delivery",
+			Example: `  $ enkit email retry --state=failed
+        Try again to deliver all the messages that failed.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringArrayVarP(&command.States, "state", "s", nil, "Retry all the messages in this state (repeatable)")
+	return command
+}
+
+func (c *Retry) Run(cmd *cobra.Command, args []string) error {
+	states, err := parseStates(c.States)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 && len(states) == 0 {
+		return kflags.NewUsageErrorf("must specify the ids of the messages to retry, or --state")
+	}
+
+	queue, err := c.root.Queue()
+	if err != nil {
+		return err
+	}
+	ids := append([]string{}, args...)
+	if len(states) > 0 {
+		messages, err := queue.List(states...)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			ids = append(ids, message.ID)
+		}
+	}
+	for _, id := range ids {
+		if err := queue.Retry(id); err != nil {
+			return fmt.Errorf("could not retry message %s: %w", id, err)
+		}
+	}
+	fmt.Printf("Scheduled %d messages for delivery\n", len(ids))
+	return nil
+}
+
+type Purge struct {
+	*cobra.Command
+	root *Root
+
+	States    []string
+	OlderThan time.Duration
+}
+
+func NewPurge(root *Root) *Purge {
+	command := &Purge{
+		Command: &cobra.Command{
+			Use:   "purge",
+			Short: "Remove messages from the queue",
+			Example: `  $ enkit email purge --older-than=168h
+        Remove the messages sent, failed or expired more than a week ago.
+
+  $ enkit email purge --state=pending
+        Cancel the delivery of all pending messages.`,
+			Args: cobra.NoArgs,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringArrayVarP(&command.States, "state", "s", nil, "Only remove messages in this state (repeatable). By default, messages sent, failed or expired are removed")
+	command.Flags().DurationVar(&command.OlderThan, "older-than", 0, "Only remove messages last changed longer than this ago")
+	return command
+}
+
+func (c *Purge) Run(cmd *cobra.Command, args []string) error {
+	states, err := parseStates(c.States)
+	if err != nil {
+		return err
+	}
+	queue, err := c.root.Queue()
+	if err != nil {
+		return err
+	}
+	purged, err := queue.Purge(time.Now().Add(-c.OlderThan), states...)
+	for _, message := range purged {
+		c.root.Log.Infof("removed %s message %s to %s", message.State, message.ID, message.Label)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d messages\n", len(purged))
+	return nil
+}
+
+type Bounce struct {
+	*cobra.Command
+	root *Root
+}
+
+func NewBounce(root *Root) *Bounce {
+	command := &Bounce{
+		Command: &cobra.Command{
+			Use:   "bounce [<file>...]",
+			Short: "Mark the messages delivery status notifications refer to as failed",
+			Long: `bounce - processes delivery status notifications (bounces)
+
+Reads bounce messages from the files specified, or from stdin, and marks
+the queued messages they refer to as failed, if delivery failed permanently.
+
+Each file, or stdin, must contain a single RFC 5322 message: mbox files
+have to be split first. Can be used to process a maildir receiving the
+bounces for the from address, or configured as a pipe in the MTA.`,
+			Example: `  $ enkit email bounce ~/Maildir/new/*
+        Process the bounces delivered to a maildir, one message per file.
+
+  noreply: "|/usr/local/bin/enkit email bounce"
+        In /etc/aliases, process each bounce as it is delivered to noreply.`,
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	return command
+}
+
+func (c *Bounce) Run(cmd *cobra.Command, args []string) error {
+	queue, err := c.root.Queue()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return c.handle(queue, "stdin", os.Stdin)
+	}
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = c.handle(queue, path, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Bounce) handle(queue *kemail.Queue, name string, r io.Reader) error {
+	bounce, err := kemail.ParseBounce(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	message, err := queue.HandleBounce(bounce)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if message == nil {
+		c.root.Log.Infof("%s: bounce for %s does not refer to a queued message, or is not permanent", name, bounce.MessageID)
+		return nil
+	}
+	fmt.Printf("Message %s to %s marked as failed: %s\n", message.ID, message.Label, message.LastError)
+	return nil
+}
+
+type Process struct {
+	*cobra.Command
+	root *Root
+
+	Dialer *kemail.DialerFlags
+	Sender *kemail.Flags
+	Queue  *kemail.QueueFlags
+	Once   bool
+}
+
+func NewProcess(root *Root) *Process {
+	command := &Process{
+		Command: &cobra.Command{
+			Use:   "process",
+			Short: "Deliver the queued messages",
+			Long: `process - delivers the queued messages
+
+Sends the messages that are due, retrying failed attempts with exponential
+backoff, and keeps polling the queue for new messages until interrupted.
+
+Only one process at a time should deliver the messages of a queue.`,
+			Example: `  $ enkit email process --smtp-host=smtp.example.com --smtp-user=noreply --smtp-password-file=/etc/smtp.password
+        Deliver the queued messages via smtp.example.com, until interrupted.
+
+  $ enkit email process --once --email-sender=fake
+        Log the messages that are due instead of sending them, and exit.`,
+			Args: cobra.NoArgs,
+		},
+		root:   root,
+		Dialer: kemail.DefaultDialerFlags(),
+		Sender: kemail.DefaultFlags(),
+		Queue:  kemail.DefaultQueueFlags(),
+	}
+	command.Command.RunE = command.Run
+
+	set := &kcobra.FlagSet{FlagSet: command.Flags()}
+	command.Dialer.Register(set, "")
+	command.Queue.Register(set, "")
+	// Attempts, backoff and deadlines are handled by the queue, only expose
+	// the flags selecting how messages are sent.
+	command.Flags().StringVar(&command.Sender.Sender, "email-sender", command.Sender.Sender, "Email sender backend (smtp, smtp-shared, or fake).")
+	command.Flags().DurationVar(&command.Sender.FakeDelay, "email-fake-delay", command.Sender.FakeDelay, "Delay between fake email sends.")
+	command.Flags().StringVar(&command.Sender.OverrideRecipient, "email-override-recipient", command.Sender.OverrideRecipient, "Override SMTP recipient address for testing (smtp sender only).")
+	command.Flags().BoolVar(&command.Once, "once", false, "Deliver the messages that are due, and exit")
+	return command
+}
+
+func (c *Process) Run(cmd *cobra.Command, args []string) error {
+	var dialer kemail.Dialer
+	if c.Sender.Sender != "fake" {
+		var err error
+		dialer, err = kemail.NewDialer(kemail.FromDialerFlags(c.Dialer))
+		if err != nil {
+			return kflags.NewUsageErrorf("invalid smtp configuration - %v", err)
+		}
+	}
+	senders, err := kemail.SenderFactoryFromFlags(dialer, c.Sender, c.root.Log, time.Sleep)
+	if err != nil {
+		return err
+	}
+
+	queue, err := c.root.Queue(kemail.FromQueueFlags(c.Queue), kemail.WithQueueSenderFactory(senders))
+	if err != nil {
+		return err
+	}
+	if c.Once {
+		sent, err := queue.Process()
+		fmt.Printf("Sent %d messages\n", sent)
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := queue.Run(ctx); err != nil && !errors.Is(err, kemail.ErrQueueClosed) {
+		return err
+	}
+	return nil
+}
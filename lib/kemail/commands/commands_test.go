@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/lib/kemail"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStates(t *testing.T) {
+	states, err := parseStates([]string{"failed", "Expired"})
+	assert.NoError(t, err)
+	assert.Equal(t, []kemail.QueueState{kemail.QueueFailed, kemail.QueueExpired}, states)
+
+	_, err = parseStates([]string{"lost"})
+	assert.Error(t, err)
+}
+
+func TestPrintMessages(t *testing.T) {
+	created := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	messages := []*kemail.QueuedMessage{
+		{ID: "welcome-0a1b2c3d", Label: "a@example.com", State: kemail.QueueSent, Attempts: 1, Created: created},
+		{ID: "welcome-4e5f6a7b", Label: "b@example.com", State: kemail.QueuePending, Attempts: 2, Created: created, LastError: "timeout"},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, printMessages(&out, messages))
+	assert.Equal(t, `ID                CREATED              STATE    ATTEMPTS  TO             LAST ERROR
+welcome-0a1b2c3d  2024-01-01 10:00:00  sent     1         a@example.com  
+welcome-4e5f6a7b  2024-01-01 10:00:00  pending  2         b@example.com  timeout
+`, out.String())
+}
+
+func TestProcessOnce(t *testing.T) {
+	root := New(client.DefaultBaseFlags("enkit", "enkit"))
+	root.Store.Directory.Path = t.TempDir()
+
+	queue, err := root.Queue()
+	require.NoError(t, err)
+	id, err := queue.Enqueue(kemail.NewQueuedMessage("noreply@example.com", "a@example.com", "hello", "text", ""))
+	require.NoError(t, err)
+
+	root.SetArgs([]string{"process", "--once", "--email-sender", "fake"})
+	require.NoError(t, root.Execute())
+
+	message, err := queue.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, kemail.QueueSent, message.State)
+}
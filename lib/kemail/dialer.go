@@ -42,6 +42,11 @@ type DialerFlags struct {
 	SmtpPassword     string
 	SmtpPasswordFile []byte
 	LocalName        string
+
+	DKIMDomain   string
+	DKIMSelector string
+	DKIMKey      []byte
+	DKIMHeaders  []string
 }
 
 // DefaultDialerFlags returns defaults for SMTP dialer flags.
@@ -59,6 +64,10 @@ func (f *DialerFlags) Register(fs kflags.FlagSet, prefix string) *DialerFlags {
 	fs.StringVar(&f.SmtpPassword, prefix+"smtp-password", f.SmtpPassword, "SMTP password for sending emails.")
 	fs.ByteFileVar(&f.SmtpPasswordFile, prefix+"smtp-password-file", "", "Path to a file containing the SMTP password.", kflags.WithContent(f.SmtpPasswordFile))
 	fs.StringVar(&f.LocalName, prefix+"smtp-local-name", f.LocalName, "Local hostname to present during SMTP handshake.")
+	fs.StringVar(&f.DKIMDomain, prefix+"dkim-domain", f.DKIMDomain, "Domain to DKIM sign emails for, normally the domain of the from address.")
+	fs.StringVar(&f.DKIMSelector, prefix+"dkim-selector", f.DKIMSelector, "DKIM selector: the public key must be published in <selector>._domainkey.<domain>.")
+	fs.ByteFileVar(&f.DKIMKey, prefix+"dkim-key-file", "", "Path to a PEM encoded RSA or ed25519 private key. If set, all emails are DKIM signed.", kflags.WithContent(f.DKIMKey))
+	fs.StringArrayVar(&f.DKIMHeaders, prefix+"dkim-header", f.DKIMHeaders, "Header to include in the DKIM signature (repeatable). Defaults to the standard set of headers.")
 	return f
 }
 
@@ -69,6 +78,7 @@ type DialerOptions struct {
 	SmtpUser     string
 	SmtpPassword string
 	LocalName    string
+	DKIM         *DKIMSigner
 }
 
 // DialerModifier updates dialer options.
@@ -107,6 +117,30 @@ func FromDialerFlags(f *DialerFlags) DialerModifier {
 		o.SmtpUser = f.SmtpUser
 		o.SmtpPassword = f.SmtpPassword
 		o.LocalName = f.LocalName
+
+		if len(f.DKIMKey) == 0 {
+			if f.DKIMDomain != "" || f.DKIMSelector != "" {
+				return kflags.NewUsageErrorf("dkim-key-file must be specified to DKIM sign emails")
+			}
+			return nil
+		}
+		mods := DKIMModifiers{WithDKIMDomain(f.DKIMDomain), WithDKIMSelector(f.DKIMSelector), WithDKIMPEMKey(f.DKIMKey)}
+		if len(f.DKIMHeaders) > 0 {
+			mods = append(mods, WithDKIMHeaders(f.DKIMHeaders...))
+		}
+		signer, err := NewDKIMSigner(mods...)
+		if err != nil {
+			return kflags.NewUsageErrorf("invalid dkim configuration - %w", err)
+		}
+		o.DKIM = signer
+		return nil
+	}
+}
+
+// WithDKIMSigner DKIM signs all the emails sent through the dialer.
+func WithDKIMSigner(signer *DKIMSigner) DialerModifier {
+	return func(o *DialerOptions) error {
+		o.DKIM = signer
 		return nil
 	}
 }
@@ -173,9 +207,9 @@ func NewDialer(mods ...DialerModifier) (Dialer, error) {
 		dialer.LocalName = opts.LocalName
 	}
 
-	return &smtpDialer{
+	return NewSigningDialer(&smtpDialer{
 		dialer:   dialer,
 		identity: identity,
 		logID:    logID,
-	}, nil
+	}, opts.DKIM), nil
 }
@@ -0,0 +1,436 @@
+package kemail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// DefaultDKIMHeaders lists the headers signed by default, when present in the message.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMOptions configures a DKIMSigner.
+type DKIMOptions struct {
+	// Domain is the signing domain, the d= tag.
+	Domain string
+	// Selector is the selector, the s= tag. The public key is published
+	// in the TXT record <Selector>._domainkey.<Domain>.
+	Selector string
+	// Key is the private key used to sign, either an *rsa.PrivateKey or
+	// an ed25519.PrivateKey.
+	Key crypto.Signer
+	// Headers lists the names of the headers to sign. From is always signed.
+	Headers []string
+	// Now returns the time recorded in the signature.
+	Now TimeSource
+}
+
+// DKIMModifier updates DKIM options.
+type DKIMModifier func(*DKIMOptions) error
+
+// DKIMModifiers is a slice of DKIMModifier values.
+type DKIMModifiers []DKIMModifier
+
+// Apply applies all modifiers to the provided options.
+func (mods DKIMModifiers) Apply(o *DKIMOptions) error {
+	for _, m := range mods {
+		if err := m(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithDKIMDomain sets the signing domain.
+func WithDKIMDomain(domain string) DKIMModifier {
+	return func(o *DKIMOptions) error {
+		o.Domain = domain
+		return nil
+	}
+}
+
+// WithDKIMSelector sets the selector of the public key.
+func WithDKIMSelector(selector string) DKIMModifier {
+	return func(o *DKIMOptions) error {
+		o.Selector = selector
+		return nil
+	}
+}
+
+// WithDKIMKey sets the private key used to sign.
+func WithDKIMKey(key crypto.Signer) DKIMModifier {
+	return func(o *DKIMOptions) error {
+		o.Key = key
+		return nil
+	}
+}
+
+// WithDKIMPEMKey parses and sets a PEM encoded private key, see ParseDKIMKey.
+func WithDKIMPEMKey(data []byte) DKIMModifier {
+	return func(o *DKIMOptions) error {
+		key, err := ParseDKIMKey(data)
+		if err != nil {
+			return err
+		}
+		o.Key = key
+		return nil
+	}
+}
+
+// WithDKIMHeaders overrides the list of headers to sign.
+func WithDKIMHeaders(headers ...string) DKIMModifier {
+	return func(o *DKIMOptions) error {
+		o.Headers = headers
+		return nil
+	}
+}
+
+// WithDKIMTimeSource overrides the time source used for the signature timestamp.
+func WithDKIMTimeSource(now TimeSource) DKIMModifier {
+	return func(o *DKIMOptions) error {
+		o.Now = now
+		return nil
+	}
+}
+
+// ParseDKIMKey parses a PEM encoded RSA or ed25519 private key, in either
+// PKCS#1 or PKCS#8 format.
+func ParseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("dkim key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dkim key - %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported dkim key type %T - only rsa and ed25519 keys can be used", key)
+}
+
+// DKIMSigner adds DKIM-Signature headers to messages, as per RFC 6376 and,
+// for ed25519 keys, RFC 8463.
+//
+// Both headers and body are signed with relaxed canonicalization, which
+// tolerates the whitespace changes commonly performed by relays.
+type DKIMSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	headers   []string
+	now       TimeSource
+}
+
+// NewDKIMSigner creates a DKIMSigner. Domain, selector and key are mandatory.
+func NewDKIMSigner(mods ...DKIMModifier) (*DKIMSigner, error) {
+	opts := &DKIMOptions{
+		Headers: DefaultDKIMHeaders,
+		Now:     time.Now,
+	}
+	if err := DKIMModifiers(mods).Apply(opts); err != nil {
+		return nil, err
+	}
+	if opts.Domain == "" {
+		return nil, fmt.Errorf("dkim domain is required")
+	}
+	if opts.Selector == "" {
+		return nil, fmt.Errorf("dkim selector is required")
+	}
+
+	var algorithm string
+	switch opts.Key.(type) {
+	case *rsa.PrivateKey:
+		algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algorithm = "ed25519-sha256"
+	case nil:
+		return nil, fmt.Errorf("dkim key is required")
+	default:
+		return nil, fmt.Errorf("unsupported dkim key type %T - only rsa and ed25519 keys can be used", opts.Key)
+	}
+
+	headers := []string{"from"}
+	for _, header := range opts.Headers {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header == "" || hasHeader(headers, header) {
+			continue
+		}
+		if strings.ContainsAny(header, ": \t") {
+			return nil, fmt.Errorf("invalid header name to sign %q", header)
+		}
+		headers = append(headers, header)
+	}
+
+	return &DKIMSigner{
+		domain:    opts.Domain,
+		selector:  opts.Selector,
+		key:       opts.Key,
+		algorithm: algorithm,
+		headers:   headers,
+		now:       opts.Now,
+	}, nil
+}
+
+func hasHeader(headers []string, name string) bool {
+	for _, header := range headers {
+		if header == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Record returns the TXT record to publish at Name() for receivers to verify signatures.
+func (s *DKIMSigner) Record() (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return "", err
+	}
+	keyType := "rsa"
+	if s.algorithm == "ed25519-sha256" {
+		// RFC 8463 publishes the raw key, rather than the SubjectPublicKeyInfo.
+		keyType = "ed25519"
+		der = s.key.Public().(ed25519.PublicKey)
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", keyType, base64.StdEncoding.EncodeToString(der)), nil
+}
+
+// Name returns the DNS name where the public key has to be published.
+func (s *DKIMSigner) Name() string {
+	return s.selector + "._domainkey." + s.domain
+}
+
+func (s *DKIMSigner) fingerprint() string {
+	der, _ := x509.MarshalPKIXPublicKey(s.key.Public())
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("%s:%s:%x", s.Name(), strings.Join(s.headers, ":"), sum[:8])
+}
+
+// Sign computes the DKIM-Signature header for the raw message supplied.
+//
+// The returned header, terminated by CRLF, has to be prepended to the message.
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	headers, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	// As per RFC 6376 5.4.2, headers appearing multiple times are signed
+	// starting from the last instance.
+	var signed []string
+	var canonical bytes.Buffer
+	used := map[string]int{}
+	for _, name := range s.headers {
+		instances := findHeaders(headers, name)
+		if used[name] >= len(instances) {
+			continue
+		}
+		header := instances[len(instances)-1-used[name]]
+		used[name]++
+		signed = append(signed, name)
+		canonical.WriteString(relaxedHeader(header))
+		canonical.WriteString("\r\n")
+	}
+	if len(signed) == 0 || signed[0] != "from" {
+		return nil, fmt.Errorf("message has no From header, and cannot be signed")
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algorithm, s.domain, s.selector, s.now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	canonical.WriteString(relaxedHeader("DKIM-Signature: " + value))
+
+	digest := sha256.Sum256(canonical.Bytes())
+	var signature []byte
+	var err error
+	if s.algorithm == "ed25519-sha256" {
+		signature, err = s.key.Sign(nil, digest[:], crypto.Hash(0))
+	} else {
+		signature, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not compute dkim signature - %w", err)
+	}
+
+	result := []byte("DKIM-Signature: " + value)
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > 0 {
+		chunk := min(len(encoded), 72)
+		result = append(result, "\r\n\t"...)
+		result = append(result, encoded[:chunk]...)
+		encoded = encoded[chunk:]
+	}
+	return append(result, "\r\n"...), nil
+}
+
+// SignMessage writes the message to w, preceded by its DKIM-Signature header.
+func (s *DKIMSigner) SignMessage(w io.Writer, message *gomail.Message) error {
+	var raw bytes.Buffer
+	if _, err := message.WriteTo(&raw); err != nil {
+		return err
+	}
+	header, err := s.Sign(raw.Bytes())
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(raw.Bytes())
+	return err
+}
+
+// splitMessage returns the headers of a message, unfolded, and its body with CRLF line endings.
+func splitMessage(message []byte) ([]string, []byte) {
+	message = bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	head, body, _ := bytes.Cut(message, []byte("\n\n"))
+
+	var headers []string
+	for _, line := range strings.Split(string(head), "\n") {
+		if len(headers) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			headers[len(headers)-1] += "\r\n" + line
+			continue
+		}
+		headers = append(headers, line)
+	}
+	return headers, bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))
+}
+
+func findHeaders(headers []string, name string) []string {
+	var found []string
+	for _, header := range headers {
+		key, _, ok := strings.Cut(header, ":")
+		if ok && strings.ToLower(strings.TrimSpace(key)) == name {
+			found = append(found, header)
+		}
+	}
+	return found
+}
+
+// collapseSpace unfolds a header value and reduces all runs of whitespace to a single space.
+func collapseSpace(value string) string {
+	return strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}), " ")
+}
+
+// relaxedHeader implements the relaxed header canonicalization of RFC 6376 3.4.2,
+// without the terminating CRLF.
+func relaxedHeader(header string) string {
+	key, value, _ := strings.Cut(header, ":")
+	return strings.ToLower(strings.TrimSpace(key)) + ":" + collapseSpace(value)
+}
+
+// relaxedBody implements the relaxed body canonicalization of RFC 6376 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = relaxedLine(line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// relaxedLine reduces runs of whitespace to a single space, and drops trailing whitespace.
+func relaxedLine(line string) string {
+	var result strings.Builder
+	space := false
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			result.WriteByte(' ')
+			space = false
+		}
+		result.WriteRune(r)
+	}
+	return result.String()
+}
+
+// signingSendCloser signs all messages before handing them to the wrapped SendCloser.
+type signingSendCloser struct {
+	gomail.SendCloser
+	signer *DKIMSigner
+}
+
+type rawMessage []byte
+
+func (m rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m)
+	return int64(n), err
+}
+
+func (s *signingSendCloser) Send(from string, to []string, message io.WriterTo) error {
+	var raw bytes.Buffer
+	if _, err := message.WriteTo(&raw); err != nil {
+		return err
+	}
+	header, err := s.signer.Sign(raw.Bytes())
+	if err != nil {
+		return err
+	}
+	return s.SendCloser.Send(from, to, rawMessage(append(header, raw.Bytes()...)))
+}
+
+type signingDialer struct {
+	dialer Dialer
+	signer *DKIMSigner
+}
+
+// NewSigningDialer returns a Dialer that DKIM signs all the messages sent
+// through the sessions established by dialer.
+//
+// As signing happens when the message is handed to the SMTP session, it
+// applies to all senders: smtp, smtp-shared and one-shot transactional sends.
+func NewSigningDialer(dialer Dialer, signer *DKIMSigner) Dialer {
+	if signer == nil {
+		return dialer
+	}
+	return &signingDialer{dialer: dialer, signer: signer}
+}
+
+func (d *signingDialer) Dial() (gomail.SendCloser, error) {
+	sender, err := d.dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &signingSendCloser{SendCloser: sender, signer: d.signer}, nil
+}
+
+func (d *signingDialer) Identity() string {
+	return d.dialer.Identity() + "|dkim:" + d.signer.fingerprint()
+}
+
+func (d *signingDialer) LogID() string {
+	return d.dialer.LogID() + " dkim=" + d.signer.Name()
+}
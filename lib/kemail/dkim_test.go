@@ -0,0 +1,246 @@
+package kemail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// Example from RFC 6376 section 3.4.5.
+	headers, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	require.Len(t, headers, 2)
+	assert.Equal(t, "a:X", relaxedHeader(headers[0]))
+	assert.Equal(t, "b:Y Z", relaxedHeader(headers[1]))
+	assert.Equal(t, " C\r\nD E\r\n", string(relaxedBody(body)))
+
+	assert.Empty(t, relaxedBody([]byte("\r\n\r\n")))
+}
+
+// verifyDKIM checks the DKIM-Signature header at the top of message against key.
+func verifyDKIM(message []byte, key crypto.PublicKey) error {
+	headers, body := splitMessage(message)
+	if len(headers) == 0 || !strings.HasPrefix(headers[0], "DKIM-Signature:") {
+		return fmt.Errorf("message is not signed")
+	}
+	signature := headers[0]
+	headers = headers[1:]
+
+	tags := map[string]string{}
+	var stripped []string
+	_, value, _ := strings.Cut(signature, ":")
+	for _, tag := range strings.Split(value, ";") {
+		name, content, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[name] = strings.Join(strings.Fields(content), "")
+		if name == "b" {
+			tag = tag[:strings.Index(tag, "=")+1]
+		}
+		stripped = append(stripped, tag)
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return fmt.Errorf("body hash mismatch")
+	}
+
+	var canonical bytes.Buffer
+	used := map[string]int{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		instances := findHeaders(headers, name)
+		if used[name] >= len(instances) {
+			continue
+		}
+		canonical.WriteString(relaxedHeader(instances[len(instances)-1-used[name]]) + "\r\n")
+		used[name]++
+	}
+	canonical.WriteString(relaxedHeader("DKIM-Signature:" + strings.Join(stripped, ";")))
+	digest := sha256.Sum256(canonical.Bytes())
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest[:], sig) {
+			return fmt.Errorf("invalid ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown key type %T", key)
+}
+
+func testMessage() *gomail.Message {
+	message := gomail.NewMessage()
+	message.SetHeader("From", "noreply@example.com")
+	message.SetHeader("To", "user@example.com")
+	message.SetHeader("Subject", "Your login link")
+	message.SetBody("text/plain", "Hello,\nclick the link below.\n")
+	message.AddAlternative("text/html", "<p>Hello</p>")
+	return message
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	now := func() time.Time { return time.Unix(1700000000, 0) }
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		signer, err := NewDKIMSigner(WithDKIMDomain("example.com"), WithDKIMSelector("mail"), WithDKIMKey(key), WithDKIMTimeSource(now))
+		require.NoError(t, err)
+
+		var signed bytes.Buffer
+		require.NoError(t, signer.SignMessage(&signed, testMessage()))
+		assert.NoError(t, verifyDKIM(signed.Bytes(), key.Public()), "%T", key)
+		assert.Contains(t, signed.String(), "d=example.com; s=mail; t=1700000000; h=from:subject:date:to:mime-version:content-type;")
+
+		// Relaxed canonicalization survives whitespace changes by relays...
+		relayed := bytes.Replace(signed.Bytes(), []byte("Subject: Your login link"), []byte("Subject:  Your login\r\n  link"), 1)
+		assert.NoError(t, verifyDKIM(relayed, key.Public()))
+		// ... but not changes to the content.
+		tampered := bytes.Replace(signed.Bytes(), []byte("Your login link"), []byte("Your logout link"), 1)
+		assert.Error(t, verifyDKIM(tampered, key.Public()))
+	}
+
+	record, err := (&DKIMSigner{key: edKey, algorithm: "ed25519-sha256"}).Record()
+	require.NoError(t, err)
+	assert.Equal(t, "v=DKIM1; k=ed25519; p="+base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey)), record)
+
+	signer, err := NewDKIMSigner(WithDKIMDomain("example.com"), WithDKIMSelector("mail"), WithDKIMKey(edKey))
+	require.NoError(t, err)
+	_, err = signer.Sign([]byte("To: user@example.com\r\n\r\nbody"))
+	assert.ErrorContains(t, err, "no From header")
+
+	_, err = NewDKIMSigner(WithDKIMDomain("example.com"), WithDKIMKey(edKey))
+	assert.ErrorContains(t, err, "selector is required")
+	_, err = NewDKIMSigner(WithDKIMDomain("example.com"), WithDKIMSelector("mail"), WithDKIMKey(edKey), WithDKIMHeaders("X-Bad:"))
+	assert.Error(t, err)
+}
+
+// rfc8463Message is the example message from RFC 8463 appendix A.3.
+const rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestDKIMSignRFC8463(t *testing.T) {
+	// Key and record from RFC 8463 appendix A.2.
+	seed, err := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	require.NoError(t, err)
+	key := ed25519.NewKeyFromSeed(seed)
+
+	signer, err := NewDKIMSigner(WithDKIMDomain("football.example.com"), WithDKIMSelector("brisbane"), WithDKIMKey(key),
+		WithDKIMHeaders("to", "subject", "date", "message-id"),
+		WithDKIMTimeSource(func() time.Time { return time.Unix(1528637909, 0) }))
+	require.NoError(t, err)
+
+	record, err := signer.Record()
+	require.NoError(t, err)
+	assert.Equal(t, "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=", record)
+
+	header, err := signer.Sign([]byte(rfc8463Message))
+	require.NoError(t, err)
+
+	// The body hash is the one of the signature in appendix A.3.
+	value := "v=1; a=ed25519-sha256; c=relaxed/relaxed; d=football.example.com; s=brisbane; t=1528637909; " +
+		"h=from:to:subject:date:message-id; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=; b="
+	require.True(t, strings.HasPrefix(string(header), "DKIM-Signature: "+value), "%s", header)
+
+	// The signed data, canonicalized by hand as per RFC 6376 section 3.4.2.
+	canonical := "from:Joe SixPack <joe@football.example.com>\r\n" +
+		"to:Suzie Q <suzie@shopping.example.net>\r\n" +
+		"subject:Is dinner ready?\r\n" +
+		"date:Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"message-id:<20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"dkim-signature:" + value
+	digest := sha256.Sum256([]byte(canonical))
+	want := ed25519.Sign(key, digest[:])
+
+	encoded := strings.NewReplacer("\r\n", "", "\t", "").Replace(strings.TrimPrefix(string(header), "DKIM-Signature: "+value))
+	got, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+type captureSendCloser struct {
+	messages [][]byte
+}
+
+func (c *captureSendCloser) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	c.messages = append(c.messages, buf.Bytes())
+	return nil
+}
+
+func (c *captureSendCloser) Close() error {
+	return nil
+}
+
+type captureDialer struct {
+	sender *captureSendCloser
+}
+
+func (d *captureDialer) Dial() (gomail.SendCloser, error) { return d.sender, nil }
+func (d *captureDialer) Identity() string                 { return "capture" }
+func (d *captureDialer) LogID() string                    { return "capture" }
+
+func TestSigningDialer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	var options DialerOptions
+	flags := &DialerFlags{SmtpHost: "smtp.example.com", SmtpPort: 587, DKIMDomain: "example.com", DKIMSelector: "mail", DKIMKey: keyPEM}
+	require.NoError(t, FromDialerFlags(flags)(&options))
+	require.NotNil(t, options.DKIM)
+	assert.Equal(t, "mail._domainkey.example.com", options.DKIM.Name())
+
+	capture := &captureDialer{sender: &captureSendCloser{}}
+	dialer := NewSigningDialer(capture, options.DKIM)
+	assert.NotEqual(t, capture.Identity(), dialer.Identity())
+	assert.Equal(t, "capture dkim=mail._domainkey.example.com", dialer.LogID())
+
+	sender, err := SenderFactoryFromFlags(dialer, DefaultFlags(), nil, nil)
+	require.NoError(t, err)
+	single, err := sender.Open()
+	require.NoError(t, err)
+	require.NoError(t, single.Send(testMessage()))
+	require.Len(t, capture.sender.messages, 1)
+	assert.NoError(t, verifyDKIM(capture.sender.messages[0], &key.PublicKey))
+
+	assert.Equal(t, capture, NewSigningDialer(capture, nil))
+
+	flags = &DialerFlags{SmtpHost: "smtp.example.com", SmtpPort: 587, DKIMSelector: "mail"}
+	assert.ErrorContains(t, FromDialerFlags(flags)(&options), "dkim-key-file")
+}
@@ -4,6 +4,11 @@
 // recipient list, enforces a minimum wait between connection attempts, and can
 // report progress via a callback for UIs or logging.
 //
+// Messages can be DKIM signed by wrapping the Dialer with NewSigningDialer,
+// or configuring the --dkim-* flags of DialerFlags. Delivery status
+// notifications received after sending can be parsed with ParseBounce, and
+// reported with ReportBounce or Queue.HandleBounce.
+//
 // Typical usage:
 //
 //	flags := kemail.DefaultFlags()
@@ -0,0 +1,644 @@
+package kemail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/typed"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/ccontavalli/enkit/lib/srand"
+	"gopkg.in/gomail.v2"
+)
+
+// QueueState is the delivery state of a queued message.
+type QueueState string
+
+const (
+	// QueuePending messages are waiting to be sent, or to be retried.
+	QueuePending QueueState = "pending"
+	// QueueSending messages are being sent. A message found in this state
+	// when the queue starts was interrupted, and is sent again.
+	QueueSending QueueState = "sending"
+	// QueueSent messages were accepted by the SMTP server.
+	QueueSent QueueState = "sent"
+	// QueueFailed messages exceeded the maximum number of attempts.
+	QueueFailed QueueState = "failed"
+	// QueueExpired messages could not be sent before their deadline.
+	QueueExpired QueueState = "expired"
+)
+
+// Done returns true if no further delivery attempt will be made in this state.
+func (s QueueState) Done() bool {
+	return s == QueueSent || s == QueueFailed || s == QueueExpired
+}
+
+// Valid returns true if s is one of the known states.
+func (s QueueState) Valid() bool {
+	return s == QueuePending || s == QueueSending || s.Done()
+}
+
+// MessagePart is a body of a message, like the text or html version.
+type MessagePart struct {
+	ContentType string
+	Body        string
+}
+
+// QueuedMessage is a message stored in a Queue, with its delivery state.
+//
+// Messages are stored as headers and body parts, rather than as a
+// gomail.Message, so they can be persisted. Attachments are not supported.
+type QueuedMessage struct {
+	ID string
+	// Campaign groups messages sent together, see EnqueueAll.
+	Campaign string `json:",omitempty"`
+	// Label identifies the recipient in logs and in the admin CLI.
+	Label string
+	// Sensitive messages carry credentials, like a login link. They are deleted
+	// from the queue once sent, and their body is removed once failed or expired.
+	Sensitive bool `json:",omitempty"`
+
+	Headers map[string][]string
+	Parts   []MessagePart
+
+	State     QueueState
+	Attempts  int
+	LastError string `json:",omitempty"`
+
+	Created     time.Time
+	LastAttempt time.Time `json:",omitempty"`
+	NextAttempt time.Time `json:",omitempty"`
+	Deadline    time.Time `json:",omitempty"`
+	Sent        time.Time `json:",omitempty"`
+}
+
+// NewQueuedMessage returns a message with a text and an html body, ready to be enqueued.
+func NewQueuedMessage(from, to, subject, text, html string) *QueuedMessage {
+	message := &QueuedMessage{
+		Label: to,
+		Headers: map[string][]string{
+			"From":    {from},
+			"To":      {to},
+			"Subject": {subject},
+		},
+	}
+	if text != "" {
+		message.Parts = append(message.Parts, MessagePart{ContentType: "text/plain", Body: text})
+	}
+	if html != "" {
+		message.Parts = append(message.Parts, MessagePart{ContentType: "text/html", Body: html})
+	}
+	return message
+}
+
+// QueuedMessageSchema is the schema of the messages stored by a Queue.
+var QueuedMessageSchema = typed.NewSchema[QueuedMessage](1).Validate(func(m *QueuedMessage) error {
+	if m.ID == "" {
+		return fmt.Errorf("message has no ID")
+	}
+	if !m.State.Valid() {
+		return fmt.Errorf("message %s has unknown state %q", m.ID, m.State)
+	}
+	return nil
+})
+
+func init() {
+	typed.Register("kemail.QueuedMessage", QueuedMessageSchema)
+}
+
+// Message builds the gomail message to send.
+func (m *QueuedMessage) Message() *gomail.Message {
+	message := gomail.NewMessage()
+	message.SetHeaders(m.Headers)
+	for i, part := range m.Parts {
+		if i == 0 {
+			message.SetBody(part.ContentType, part.Body)
+		} else {
+			message.AddAlternative(part.ContentType, part.Body)
+		}
+	}
+	return message
+}
+
+// ErrQueueClosed is returned by Run when the context is canceled.
+var ErrQueueClosed = errors.New("email queue closed")
+
+// QueueFlags configures the delivery of queued messages.
+type QueueFlags struct {
+	PollInterval time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	MaxAttempts  int
+	Deadline     time.Duration
+}
+
+// DefaultQueueFlags returns default queue flags.
+func DefaultQueueFlags() *QueueFlags {
+	return &QueueFlags{
+		PollInterval: 10 * time.Second,
+		MinBackoff:   30 * time.Second,
+		MaxBackoff:   30 * time.Minute,
+		MaxAttempts:  20,
+		Deadline:     48 * time.Hour,
+	}
+}
+
+// Register registers queue flags.
+func (f *QueueFlags) Register(fs kflags.FlagSet, prefix string) *QueueFlags {
+	fs.DurationVar(&f.PollInterval, prefix+"email-queue-poll-interval", f.PollInterval, "How often to look for queued messages to send.")
+	fs.DurationVar(&f.MinBackoff, prefix+"email-queue-min-backoff", f.MinBackoff, "How long to wait before retrying a message the first time. Doubles at each attempt.")
+	fs.DurationVar(&f.MaxBackoff, prefix+"email-queue-max-backoff", f.MaxBackoff, "Maximum time to wait between attempts of the same message.")
+	fs.IntVar(&f.MaxAttempts, prefix+"email-queue-max-attempts", f.MaxAttempts, "Attempts after which a queued message is marked as failed (0 means unlimited).")
+	fs.DurationVar(&f.Deadline, prefix+"email-queue-deadline", f.Deadline, "Messages not sent within this time from being queued expire (0 means never).")
+	return f
+}
+
+type queueOptions struct {
+	log           logger.Logger
+	now           TimeSource
+	rng           *rand.Rand
+	senderFactory SingleSenderFactory
+	progress      func(*QueuedMessage)
+
+	QueueFlags
+}
+
+// QueueModifier applies configuration to a Queue.
+type QueueModifier func(*queueOptions) error
+
+// QueueModifiers is a slice of QueueModifier values.
+type QueueModifiers []QueueModifier
+
+// Apply applies all modifiers to the options.
+func (mods QueueModifiers) Apply(o *queueOptions) error {
+	for _, m := range mods {
+		if err := m(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FromQueueFlags returns a modifier applying flag values.
+func FromQueueFlags(f *QueueFlags) QueueModifier {
+	return func(o *queueOptions) error {
+		if f == nil {
+			return nil
+		}
+		o.QueueFlags = *f
+		return nil
+	}
+}
+
+// WithQueueSenderFactory sets the factory used to open senders to deliver messages.
+//
+// A queue without a sender factory can be inspected and managed, but not processed.
+func WithQueueSenderFactory(factory SingleSenderFactory) QueueModifier {
+	return func(o *queueOptions) error {
+		o.senderFactory = factory
+		return nil
+	}
+}
+
+// WithQueueLogger sets the logger.
+func WithQueueLogger(log logger.Logger) QueueModifier {
+	return func(o *queueOptions) error {
+		o.log = log
+		return nil
+	}
+}
+
+// WithQueueTimeSource overrides the time source.
+func WithQueueTimeSource(now TimeSource) QueueModifier {
+	return func(o *queueOptions) error {
+		o.now = now
+		return nil
+	}
+}
+
+// WithQueueProgress sets a callback invoked every time the state of a message changes.
+func WithQueueProgress(cb func(*QueuedMessage)) QueueModifier {
+	return func(o *queueOptions) error {
+		o.progress = cb
+		return nil
+	}
+}
+
+// DefaultQueueApp and DefaultQueueNamespace identify where a queue is kept in
+// a config store, unless configured otherwise.
+const (
+	DefaultQueueApp       = "kemail"
+	DefaultQueueNamespace = "queue"
+)
+
+// Queue is a persistent queue of outbound messages.
+//
+// Each message is stored in a config.Store under its ID, together with its
+// delivery state, number of attempts and last error, so delivery resumes
+// where it was interrupted when the process restarts.
+//
+// Delivery is at least once: a message interrupted while being sent is sent
+// again.
+//
+// A Queue is not safe for concurrent processing: only one process at a time
+// should call Process or Run on the same store. Enqueue and the management
+// methods can be used concurrently.
+type Queue struct {
+	store typed.Store[QueuedMessage]
+	queueOptions
+}
+
+// NewQueue returns a queue storing messages in store.
+func NewQueue(store config.Store, mods ...QueueModifier) (*Queue, error) {
+	opts := queueOptions{
+		log:        logger.Go,
+		now:        time.Now,
+		rng:        rand.New(srand.Source),
+		QueueFlags: *DefaultQueueFlags(),
+	}
+	if err := QueueModifiers(mods).Apply(&opts); err != nil {
+		return nil, err
+	}
+	return &Queue{store: typed.Wrap[QueuedMessage](store).WithSchema(QueuedMessageSchema), queueOptions: opts}, nil
+}
+
+// CanDeliver returns true if the queue was configured with a sender, and can
+// be processed with Process or Run.
+func (q *Queue) CanDeliver() bool {
+	return q.senderFactory != nil
+}
+
+// Enqueue stores a message for delivery, and returns its ID.
+//
+// If the message has no ID, a random one is assigned. If a message with the
+// same ID is already queued, the message is not queued again. If the message
+// has no deadline, the one configured in the queue is used.
+//
+// Unless already set, the Message-ID header is derived from the ID, so
+// bounces can be matched to the message, see HandleBounce.
+func (q *Queue) Enqueue(message *QueuedMessage) (string, error) {
+	now := q.now()
+	if message.ID == "" {
+		message.ID = fmt.Sprintf("%s-%016x", now.UTC().Format("20060102T150405"), q.rng.Uint64())
+	} else if _, err := q.Get(message.ID); err == nil {
+		return message.ID, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if len(message.Headers["Message-ID"]) == 0 {
+		if message.Headers == nil {
+			message.Headers = map[string][]string{}
+		}
+		message.Headers["Message-ID"] = []string{messageID(message)}
+	}
+	message.State = QueuePending
+	message.Attempts = 0
+	message.Created = now
+	message.NextAttempt = now
+	if message.Deadline.IsZero() && q.Deadline > 0 {
+		message.Deadline = now.Add(q.Deadline)
+	}
+	if err := q.store.Marshal(config.Key(message.ID), *message); err != nil {
+		return "", fmt.Errorf("could not queue message for %s: %w", message.Label, err)
+	}
+	return message.ID, nil
+}
+
+// messageID returns a Message-ID for the message, using the domain of the sender.
+func messageID(message *QueuedMessage) string {
+	domain := "kemail.invalid"
+	for _, from := range message.Headers["From"] {
+		address, err := mail.ParseAddress(from)
+		if err != nil {
+			continue
+		}
+		if _, host, ok := strings.Cut(address.Address, "@"); ok && host != "" {
+			domain = host
+		}
+	}
+	return "<" + message.ID + "@" + domain + ">"
+}
+
+// EnqueueAll queues a message for each recipient of a campaign.
+//
+// Message IDs are derived from the campaign name and the recipient label, so
+// calling EnqueueAll again after a crash only queues the messages that were
+// not queued before, and recipients already served are not sent the message
+// again.
+func EnqueueAll[T any](q *Queue, campaign string, recipients []T, build func(T) (*QueuedMessage, error), labeler RecipientLabeler[T]) ([]string, error) {
+	if campaign == "" {
+		return nil, fmt.Errorf("a campaign name is required")
+	}
+	var ids []string
+	for idx, recipient := range recipients {
+		message, err := build(recipient)
+		if err != nil {
+			return ids, err
+		}
+		if labeler != nil {
+			message.Label = labeler(recipient)
+		} else if message.Label == "" {
+			message.Label = fmt.Sprintf("recipient %d", idx)
+		}
+		sum := sha256.Sum256([]byte(message.Label))
+		message.ID = campaign + "-" + hex.EncodeToString(sum[:8])
+		message.Campaign = campaign
+
+		id, err := q.Enqueue(message)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Get returns a queued message by ID.
+//
+// If the message does not exist, os.IsNotExist(error) returns true.
+func (q *Queue) Get(id string) (*QueuedMessage, error) {
+	message, _, err := q.store.Get(config.Key(id))
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// List returns the messages in the queue, sorted by creation time.
+//
+// If states are specified, only the messages in one of those states are returned.
+func (q *Queue) List(states ...QueueState) ([]*QueuedMessage, error) {
+	descs, err := q.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*QueuedMessage
+	for _, desc := range descs {
+		message, err := q.Get(desc.Key())
+		if err != nil {
+			// Deleted while listing.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if len(states) > 0 && !hasState(states, message.State) {
+			continue
+		}
+		result = append(result, message)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Created.Equal(result[j].Created) {
+			return result[i].Created.Before(result[j].Created)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func hasState(states []QueueState, state QueueState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue) update(message *QueuedMessage) error {
+	if message.Sensitive && message.State == QueueSent {
+		if err := q.Delete(message.ID); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not delete sent message %s: %w", message.ID, err)
+		}
+		if q.progress != nil {
+			q.progress(message)
+		}
+		return nil
+	}
+	if message.Sensitive && message.State.Done() {
+		message.Parts = nil
+	}
+
+	if err := q.store.Marshal(config.Key(message.ID), *message); err != nil {
+		return fmt.Errorf("could not update state of message %s: %w", message.ID, err)
+	}
+	if q.progress != nil {
+		q.progress(message)
+	}
+	return nil
+}
+
+// Retry schedules a message for immediate delivery, regardless of its state,
+// resetting its attempts. Its deadline is extended if it already passed.
+//
+// Sensitive messages done with cannot be retried, their body was removed.
+func (q *Queue) Retry(id string) error {
+	message, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	if message.Sensitive && message.State.Done() {
+		return fmt.Errorf("message %s is sensitive, and was redacted once %s", message.ID, message.State)
+	}
+	now := q.now()
+	message.State = QueuePending
+	message.Attempts = 0
+	message.NextAttempt = now
+	if !message.Deadline.IsZero() && !message.Deadline.After(now) && q.Deadline > 0 {
+		message.Deadline = now.Add(q.Deadline)
+	}
+	return q.update(message)
+}
+
+// Delete removes a message from the queue.
+func (q *Queue) Delete(id string) error {
+	return q.store.Delete(config.Key(id))
+}
+
+// Purge deletes the messages in one of the specified states that were last
+// changed before the specified time, and returns them.
+//
+// If no state is specified, only messages that are done are purged.
+func (q *Queue) Purge(before time.Time, states ...QueueState) ([]*QueuedMessage, error) {
+	messages, err := q.List(states...)
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []*QueuedMessage
+	for _, message := range messages {
+		if len(states) == 0 && !message.State.Done() {
+			continue
+		}
+		if lastChange(message).After(before) {
+			continue
+		}
+		if err := q.Delete(message.ID); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		purged = append(purged, message)
+	}
+	return purged, nil
+}
+
+// HandleBounce marks the message a bounce refers to as failed, if delivery
+// failed permanently, and returns it.
+//
+// Messages are matched by the Message-ID assigned by Enqueue. Returns nil if
+// the bounce does not refer to a message in this queue, or is not permanent.
+func (q *Queue) HandleBounce(bounce *Bounce) (*QueuedMessage, error) {
+	failed := bounce.Failed()
+	if len(failed) == 0 {
+		return nil, nil
+	}
+	id, _, _ := strings.Cut(strings.Trim(strings.TrimSpace(bounce.MessageID), "<>"), "@")
+	if id == "" {
+		return nil, nil
+	}
+	message, err := q.Get(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var errs []string
+	for _, recipient := range failed {
+		errs = append(errs, (&BounceError{BounceRecipient: recipient}).Error())
+	}
+	message.State = QueueFailed
+	message.LastError = strings.Join(errs, "; ")
+	if err := q.update(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func lastChange(message *QueuedMessage) time.Time {
+	last := message.Created
+	for _, t := range []time.Time{message.LastAttempt, message.Sent} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// backoff returns how long to wait before the next attempt, after attempts failed ones.
+func (q *Queue) backoff(attempts int) time.Duration {
+	wait := q.MinBackoff
+	for i := 1; i < attempts && wait < q.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if q.MaxBackoff > 0 && wait > q.MaxBackoff {
+		wait = q.MaxBackoff
+	}
+	return wait
+}
+
+// Process makes a single pass over the queue, attempting delivery of all the
+// messages that are due, and expiring the ones past their deadline.
+//
+// It returns the number of messages sent.
+func (q *Queue) Process() (int, error) {
+	if q.senderFactory == nil {
+		return 0, fmt.Errorf("the email queue has no sender configured")
+	}
+	messages, err := q.List(QueuePending, QueueSending)
+	if err != nil {
+		return 0, err
+	}
+
+	var sender SingleSender
+	defer func() {
+		if sender != nil {
+			_ = sender.Close()
+		}
+	}()
+
+	sent := 0
+	for _, message := range messages {
+		now := q.now()
+		if !message.Deadline.IsZero() && now.After(message.Deadline) {
+			q.log.Warnf("message %s to %s expired after %d attempts - last error: %s", message.ID, message.Label, message.Attempts, message.LastError)
+			message.State = QueueExpired
+			if err := q.update(message); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if message.State == QueuePending && message.NextAttempt.After(now) {
+			continue
+		}
+
+		message.State = QueueSending
+		message.Attempts++
+		message.LastAttempt = now
+		if err := q.update(message); err != nil {
+			return sent, err
+		}
+
+		var err error
+		if sender == nil {
+			sender, err = q.senderFactory.Open()
+		}
+		if err == nil {
+			q.log.Infof("attempt %d - sending message %s to %s", message.Attempts, message.ID, message.Label)
+			err = sender.Send(message.Message())
+			if err != nil {
+				_ = sender.Close()
+				sender = nil
+			}
+		}
+
+		if err == nil {
+			message.State = QueueSent
+			message.Sent = q.now()
+			message.LastError = ""
+			sent++
+		} else {
+			q.log.Warnf("attempt %d - sending message %s to %s failed - %v", message.Attempts, message.ID, message.Label, err)
+			message.LastError = err.Error()
+			message.State = QueuePending
+			message.NextAttempt = now.Add(q.backoff(message.Attempts))
+			if q.MaxAttempts > 0 && message.Attempts >= q.MaxAttempts {
+				message.State = QueueFailed
+			}
+		}
+		if err := q.update(message); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Run processes the queue every PollInterval, until the context is canceled.
+//
+// Errors accessing the queue are logged, and processing is retried at the
+// next interval.
+func (q *Queue) Run(ctx context.Context) error {
+	for {
+		if _, err := q.Process(); err != nil {
+			q.log.Errorf("processing email queue failed - %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrQueueClosed
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package kemail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/config/memory"
+	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+// recordingSender records the recipients of the messages sent, and fails
+// sending to the recipients in fail.
+type recordingSender struct {
+	sent []string
+	fail map[string]error
+}
+
+func (s *recordingSender) Send(message *gomail.Message) error {
+	to := message.GetHeader("To")[0]
+	if err := s.fail[to]; err != nil {
+		return err
+	}
+	s.sent = append(s.sent, to)
+	return nil
+}
+
+func (s *recordingSender) Close() error {
+	return nil
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestQueue(t *testing.T, store *memory.Store, clock *fakeClock, sender *recordingSender) *Queue {
+	t.Helper()
+	flags := DefaultQueueFlags()
+	flags.MaxAttempts = 3
+	flags.Deadline = time.Hour
+	queue, err := NewQueue(store,
+		FromQueueFlags(flags),
+		WithQueueLogger(logger.Nil),
+		WithQueueTimeSource(clock.Now),
+		WithQueueSenderFactory(singleSenderFactoryFunc(func() (SingleSender, error) {
+			return sender, nil
+		})),
+	)
+	require.NoError(t, err)
+	return queue
+}
+
+func TestQueueMessage(t *testing.T) {
+	message := NewQueuedMessage("noreply@example.com", "user@example.com", "Hello", "text", "<p>html</p>")
+	built := message.Message()
+	assert.Equal(t, []string{"user@example.com"}, built.GetHeader("To"))
+	assert.Equal(t, []string{"Hello"}, built.GetHeader("Subject"))
+}
+
+func TestQueueProcess(t *testing.T) {
+	store := memory.NewStore()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	sender := &recordingSender{fail: map[string]error{"bad@example.com": errors.New("mailbox unavailable")}}
+	queue := newTestQueue(t, store, clock, sender)
+
+	recipients := []string{"a@example.com", "bad@example.com", "b@example.com"}
+	build := func(to string) (*QueuedMessage, error) {
+		return NewQueuedMessage("noreply@example.com", to, "Hello", "text", ""), nil
+	}
+	ids, err := EnqueueAll(queue, "welcome", recipients, build, nil)
+	require.NoError(t, err)
+	assert.Len(t, ids, 3)
+
+	sent, err := queue.Process()
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.ElementsMatch(t, []string{"a@example.com", "b@example.com"}, sender.sent)
+
+	failed, err := queue.List(QueuePending)
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "bad@example.com", failed[0].Label)
+	assert.Equal(t, 1, failed[0].Attempts)
+	assert.Equal(t, "mailbox unavailable", failed[0].LastError)
+	assert.Equal(t, clock.now.Add(30*time.Second), failed[0].NextAttempt)
+
+	// A restarted process re-enqueuing the campaign does not send the messages again.
+	queue = newTestQueue(t, store, clock, sender)
+	_, err = EnqueueAll(queue, "welcome", recipients, build, nil)
+	require.NoError(t, err)
+
+	// Nothing is due before the backoff expires.
+	sent, err = queue.Process()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Len(t, sender.sent, 2)
+
+	// Retries back off exponentially, and give up after MaxAttempts.
+	clock.now = clock.now.Add(30 * time.Second)
+	_, err = queue.Process()
+	require.NoError(t, err)
+	message, err := queue.Get(failed[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, clock.now.Add(time.Minute), message.NextAttempt)
+
+	clock.now = clock.now.Add(time.Minute)
+	_, err = queue.Process()
+	require.NoError(t, err)
+	message, err = queue.Get(failed[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, QueueFailed, message.State)
+	assert.Equal(t, 3, message.Attempts)
+
+	// An administrator can retry it.
+	delete(sender.fail, "bad@example.com")
+	require.NoError(t, queue.Retry(message.ID))
+	sent, err = queue.Process()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Len(t, sender.sent, 3)
+
+	all, err := queue.List()
+	require.NoError(t, err)
+	for _, message := range all {
+		assert.Equal(t, QueueSent, message.State, message.Label)
+	}
+}
+
+func TestQueueResumeAndExpire(t *testing.T) {
+	store := memory.NewStore()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	sender := &recordingSender{fail: map[string]error{"down@example.com": errors.New("connection refused")}}
+	queue := newTestQueue(t, store, clock, sender)
+
+	interrupted, err := queue.Enqueue(NewQueuedMessage("noreply@example.com", "a@example.com", "Hello", "text", ""))
+	require.NoError(t, err)
+	expiring, err := queue.Enqueue(NewQueuedMessage("noreply@example.com", "down@example.com", "Hello", "text", ""))
+	require.NoError(t, err)
+
+	// Simulate a crash while the message was being sent.
+	message, err := queue.Get(interrupted)
+	require.NoError(t, err)
+	message.State = QueueSending
+	require.NoError(t, queue.update(message))
+
+	_, err = queue.Process()
+	require.NoError(t, err)
+	message, err = queue.Get(interrupted)
+	require.NoError(t, err)
+	assert.Equal(t, QueueSent, message.State)
+
+	clock.now = clock.now.Add(2 * time.Hour)
+	_, err = queue.Process()
+	require.NoError(t, err)
+	message, err = queue.Get(expiring)
+	require.NoError(t, err)
+	assert.Equal(t, QueueExpired, message.State)
+
+	// Purge only removes messages done with, last changed before the time specified.
+	purged, err := queue.Purge(clock.now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, purged, 2)
+	_, err = queue.Get(interrupted)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestQueueRun(t *testing.T) {
+	sender := &recordingSender{}
+	queue := newTestQueue(t, memory.NewStore(), &fakeClock{now: time.Now()}, sender)
+	queue.PollInterval = time.Millisecond
+
+	_, err := queue.Enqueue(NewQueuedMessage("noreply@example.com", "a@example.com", "Hello", "text", ""))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue.progress = func(message *QueuedMessage) {
+		if message.State == QueueSent {
+			cancel()
+		}
+	}
+	assert.ErrorIs(t, queue.Run(ctx), ErrQueueClosed)
+	assert.Equal(t, []string{"a@example.com"}, sender.sent)
+
+	_, err = NewQueue(memory.NewStore())
+	require.NoError(t, err)
+}
+
+func TestTransactionalEmailerQueue(t *testing.T) {
+	templates, err := ParseTemplates(
+		[]byte("Welcome {{.name}}"),
+		[]byte("<p>Hello {{.name}}</p>"),
+		[]byte("Hello {{.name}}"),
+	)
+	require.NoError(t, err)
+
+	sender := &recordingSender{}
+	queue := newTestQueue(t, memory.NewStore(), &fakeClock{now: time.Now()}, sender)
+	emailer, err := NewTransactionalEmailer(
+		WithTransactionalQueue(queue),
+		WithFromAddress("noreply@example.com"),
+		WithTemplates(templates),
+	)
+	require.NoError(t, err)
+	require.NoError(t, emailer.Send("user@example.com", map[string]interface{}{"name": "Ada"}))
+	assert.Empty(t, sender.sent)
+
+	messages, err := queue.List(QueuePending)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, []string{"Welcome Ada"}, messages[0].Headers["Subject"])
+	assert.Equal(t, []MessagePart{
+		{ContentType: "text/plain", Body: "Hello Ada"},
+		{ContentType: "text/html", Body: "<p>Hello Ada</p>"},
+	}, messages[0].Parts)
+
+	sent, err := queue.Process()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, []string{"user@example.com"}, sender.sent)
+}
+
+func TestQueueSensitive(t *testing.T) {
+	store := memory.NewStore()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	sender := &recordingSender{fail: map[string]error{"down@example.com": errors.New("connection refused")}}
+	queue := newTestQueue(t, store, clock, sender)
+
+	message := NewQueuedMessage("noreply@example.com", "a@example.com", "Login", "https://example.com/login?token=secret", "")
+	message.Sensitive = true
+	sent, err := queue.Enqueue(message)
+	require.NoError(t, err)
+	message = NewQueuedMessage("noreply@example.com", "down@example.com", "Login", "https://example.com/login?token=secret", "")
+	message.Sensitive = true
+	expiring, err := queue.Enqueue(message)
+	require.NoError(t, err)
+
+	// Sent messages are deleted right away.
+	count, err := queue.Process()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = queue.Get(sent)
+	assert.True(t, os.IsNotExist(err))
+
+	// Expired ones are kept to inspect the failure, without the body.
+	clock.now = clock.now.Add(2 * time.Hour)
+	_, err = queue.Process()
+	require.NoError(t, err)
+	message, err = queue.Get(expiring)
+	require.NoError(t, err)
+	assert.Equal(t, QueueExpired, message.State)
+	assert.Equal(t, "connection refused", message.LastError)
+	assert.Empty(t, message.Parts)
+	assert.Error(t, queue.Retry(expiring))
+}
@@ -41,6 +41,9 @@ const (
 	ProgressError ProgressStatus = "error"
 	// ProgressGiveUp reports when the sender gives up on a recipient.
 	ProgressGiveUp ProgressStatus = "give_up"
+	// ProgressBounced reports a recipient that failed permanently after the
+	// message was sent, as notified by a bounce. See ReportBounce.
+	ProgressBounced ProgressStatus = "bounced"
 )
 
 // ProgressAction controls how the sender continues.
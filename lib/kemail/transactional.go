@@ -110,6 +110,7 @@ type TransactionalEmailer struct {
 	fromAddress   string
 	templates     *Templates
 	sleep         Sleeper
+	queue         *Queue
 }
 
 type transactionalOptions struct {
@@ -121,6 +122,7 @@ type transactionalOptions struct {
 	sleep         Sleeper
 	senderFlags   *Flags
 	senderDialer  Dialer
+	queue         *Queue
 }
 
 // TransactionalModifier applies configuration to a TransactionalEmailer.
@@ -177,6 +179,16 @@ func WithTransactionalSender(sender SingleSender) TransactionalModifier {
 	}
 }
 
+// WithTransactionalQueue queues emails in a persistent Queue instead of sending them directly.
+//
+// Delivery is then performed by whoever processes the queue, see Queue.Run.
+func WithTransactionalQueue(queue *Queue) TransactionalModifier {
+	return func(o *transactionalOptions) error {
+		o.queue = queue
+		return nil
+	}
+}
+
 // WithTransactionalSleep overrides the sleep function for transactional sends.
 func WithTransactionalSleep(sleep Sleeper) TransactionalModifier {
 	return func(o *transactionalOptions) error {
@@ -246,8 +258,8 @@ func NewTransactionalEmailer(mods ...TransactionalModifier) (*TransactionalEmail
 		}
 		opts.senderFactory = factory
 	}
-	if opts.dialAndSend == nil && opts.senderFactory == nil {
-		return nil, fmt.Errorf("dialer or sender factory is required")
+	if opts.dialAndSend == nil && opts.senderFactory == nil && opts.queue == nil {
+		return nil, fmt.Errorf("dialer or sender factory is required, unless sending through a queue")
 	}
 	if opts.fromAddress == "" {
 		return nil, fmt.Errorf("from address is required")
@@ -263,13 +275,14 @@ func NewTransactionalEmailer(mods ...TransactionalModifier) (*TransactionalEmail
 		fromAddress:   opts.fromAddress,
 		templates:     opts.templates,
 		sleep:         opts.sleep,
+		queue:         opts.queue,
 	}, nil
 }
 
-// BuildMessage constructs a gomail message from templates and data.
-func (e *TransactionalEmailer) BuildMessage(to string, data map[string]interface{}) (*gomail.Message, error) {
+// render executes the templates, returning the subject, text and html body.
+func (e *TransactionalEmailer) render(to string, data map[string]interface{}) (string, string, string, error) {
 	if to == "" {
-		return nil, fmt.Errorf("recipient address is required")
+		return "", "", "", fmt.Errorf("recipient address is required")
 	}
 	if data == nil {
 		data = map[string]interface{}{}
@@ -277,30 +290,63 @@ func (e *TransactionalEmailer) BuildMessage(to string, data map[string]interface
 
 	var body bytes.Buffer
 	if err := e.templates.BodyHTML.Execute(&body, data); err != nil {
-		return nil, fmt.Errorf("error executing body html template: %w", err)
+		return "", "", "", fmt.Errorf("error executing body html template: %w", err)
 	}
 
 	var textBody bytes.Buffer
 	if err := e.templates.BodyText.Execute(&textBody, data); err != nil {
-		return nil, fmt.Errorf("error executing body text template: %w", err)
+		return "", "", "", fmt.Errorf("error executing body text template: %w", err)
 	}
 
 	var subject bytes.Buffer
 	if err := e.templates.Subject.Execute(&subject, data); err != nil {
-		return nil, fmt.Errorf("error executing subject template: %w", err)
+		return "", "", "", fmt.Errorf("error executing subject template: %w", err)
+	}
+	return subject.String(), textBody.String(), body.String(), nil
+}
+
+// BuildMessage constructs a gomail message from templates and data.
+func (e *TransactionalEmailer) BuildMessage(to string, data map[string]interface{}) (*gomail.Message, error) {
+	subject, text, html, err := e.render(to, data)
+	if err != nil {
+		return nil, err
 	}
 
 	m := gomail.NewMessage()
 	m.SetHeader("From", e.fromAddress)
 	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject.String())
-	m.SetBody("text/plain", textBody.String())
-	m.AddAlternative("text/html", body.String())
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/plain", text)
+	m.AddAlternative("text/html", html)
 	return m, nil
 }
 
+// BuildQueuedMessage constructs a message suitable for a Queue from templates and data.
+func (e *TransactionalEmailer) BuildQueuedMessage(to string, data map[string]interface{}) (*QueuedMessage, error) {
+	subject, text, html, err := e.render(to, data)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueuedMessage(e.fromAddress, to, subject, text, html), nil
+}
+
 // Send builds and sends a templated email to a single recipient.
+//
+// If a queue was configured with WithTransactionalQueue, the email is queued
+// for delivery instead.
 func (e *TransactionalEmailer) Send(to string, data map[string]interface{}) error {
+	if e.queue != nil {
+		message, err := e.BuildQueuedMessage(to, data)
+		if err != nil {
+			return err
+		}
+		if _, err := e.queue.Enqueue(message); err != nil {
+			e.log.Errorf("Failed to queue email to %s: %v", to, err)
+			return fmt.Errorf("error queuing email: %w", err)
+		}
+		return nil
+	}
+
 	message, err := e.BuildMessage(to, data)
 	if err != nil {
 		return err
@@ -82,7 +82,7 @@ func (ar *AssetAugmenter) VisitFlag(reqns string, fl Flag) (bool, error) {
 	}
 
 	ar.log.Infof("%s flag %s: set from static assets (%d bytes)", ar.forns, fl.Name(), len(asset.data))
-	return true, fl.SetContent(asset.name, asset.data)
+	return true, SetContentFrom(fl, Source{Kind: SourceAsset, Location: asset.name}, asset.name, asset.data)
 }
 
 // Done implements the Done interface of Augmenter.
@@ -165,7 +165,7 @@ func (er *EnvAugmenter) VisitFlag(reqns string, fl Flag) (bool, error) {
 		return false, nil
 	}
 
-	return true, fl.Set(result)
+	return true, SetFrom(fl, Source{Kind: SourceEnv, Location: env}, result)
 }
 
 // Done implements the Done interface of Augmenter. For the EnvAugmenter, it is a noop.
@@ -48,6 +48,7 @@ type options struct {
 	argv      []string
 	runner    []func() error
 	helper    func(*cobra.Command, []string) bool
+	explain   bool
 }
 
 type Modifier func(*cobra.Command, *options) error
@@ -144,6 +145,13 @@ func Run(root *cobra.Command, mods ...Modifier) {
 		})
 	}
 
+	if err == nil && root.PersistentFlags().Lookup("explain-flags") != nil {
+		if cmd := explainRequested(root, o.argv, &o.explain); cmd != nil {
+			ExplainFlags(os.Stdout, cmd)
+			return
+		}
+	}
+
 	if err == nil {
 		err = root.Execute()
 	}
@@ -186,7 +194,7 @@ func Runner(root *cobra.Command, argv []string, eh ...kflags.ErrorHandler) (*Fla
 	}
 
 	runner := func(fs kflags.FlagSet, p kflags.Printer, init kflags.Init) {
-		mods := Modifiers{WithArgs(argv), WithErrorHandler(eh...), WithPrinter(p)}
+		mods := Modifiers{WithArgs(argv), WithErrorHandler(eh...), WithPrinter(p), WithExplainFlags()}
 		if init != nil {
 			mods = append(mods, WithRunner(init))
 		}
@@ -191,6 +191,8 @@ func PopulateFlagDefaults(root *cobra.Command, args []string, resolvers ...kflag
 	// We protect against this by using the seen map.
 	errs := []error{}
 	resolve := func(namespace string, seen map[string]struct{}, r kflags.Augmenter, flag *pflag.Flag) {
+		recordDefault(flag)
+
 		// Prevent setting the same flag multiple times, defense in depth - see comment above.
 		_, found := seen[flag.Name]
 		if found {
@@ -0,0 +1,128 @@
+package kcobra
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// SourceAnnotation is the pflag.Flag annotation used to record the chain of
+// sources that set the value of a flag, JSON encoded.
+const SourceAnnotation = "kflags-source"
+
+// RecordSource implements the kflags.SourceRecorder interface.
+func (pf *PFlag) RecordSource(source kflags.Source) {
+	source.Value = pf.Flag.Value.String()
+	recordSource(pf.Flag, source)
+}
+
+func recordSource(flag *pflag.Flag, source kflags.Source) {
+	encoded, err := json.Marshal(source)
+	if err != nil {
+		return
+	}
+	if flag.Annotations == nil {
+		flag.Annotations = map[string][]string{}
+	}
+	flag.Annotations[SourceAnnotation] = append(flag.Annotations[SourceAnnotation], string(encoded))
+}
+
+// recordDefault records the value defined in the code as the first source
+// of a flag, before any augmenter has the chance to change it.
+func recordDefault(flag *pflag.Flag) {
+	if len(flag.Annotations[SourceAnnotation]) > 0 {
+		return
+	}
+	recordSource(flag, kflags.Source{Kind: kflags.SourceDefault, Value: flag.DefValue})
+}
+
+// FlagSources returns the chain of sources that set the value of a flag,
+// from the first to the last. The last source determines the value of the
+// flag.
+func FlagSources(flag *pflag.Flag) []kflags.Source {
+	var sources []kflags.Source
+	for _, encoded := range flag.Annotations[SourceAnnotation] {
+		var source kflags.Source
+		if err := json.Unmarshal([]byte(encoded), &source); err != nil {
+			continue
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		sources = append(sources, kflags.Source{Kind: kflags.SourceDefault, Value: flag.DefValue})
+	}
+	if flag.Changed {
+		sources = append(sources, kflags.Source{Kind: kflags.SourceCommandLine, Value: flag.Value.String()})
+	}
+	return sources
+}
+
+// ExplainFlags prints all the flags of cmd, including the inherited ones,
+// with their effective value and the sources that set it.
+//
+// Values of flags likely to contain secrets are redacted.
+func ExplainFlags(w io.Writer, cmd *cobra.Command) {
+	fmt.Fprintf(w, "Flags of %s:\n", cmd.CommandPath())
+
+	explain := func(flag *pflag.Flag) {
+		fmt.Fprintf(w, "  --%s = %s\n", flag.Name, quote(flag.Name, flag.Value.String()))
+		for _, source := range FlagSources(flag) {
+			fmt.Fprintf(w, "      %s: %s\n", source.Describe(), quote(flag.Name, source.Value))
+		}
+	}
+	cmd.LocalFlags().VisitAll(explain)
+	cmd.InheritedFlags().VisitAll(explain)
+}
+
+func quote(name, value string) string {
+	redacted := kflags.Redact(name, value)
+	if redacted != value {
+		return redacted
+	}
+	return strconv.Quote(value)
+}
+
+// WithExplainFlags adds an --explain-flags flag to the root command.
+//
+// When set, the command selected on the command line is not run. Instead,
+// its flags are printed with ExplainFlags.
+func WithExplainFlags() Modifier {
+	return func(c *cobra.Command, o *options) error {
+		if c.PersistentFlags().Lookup("explain-flags") != nil {
+			return nil
+		}
+		c.PersistentFlags().BoolVar(&o.explain, "explain-flags", false, "Instead of running the command, show the value of each of its flags, and where it came from")
+		return nil
+	}
+}
+
+// explainRequested parses argv to determine if --explain-flags was passed,
+// and returns the command to explain.
+func explainRequested(root *cobra.Command, argv []string, explain *bool) *cobra.Command {
+	// Fast path, avoids parsing flags if the explain flag could not possibly be set.
+	found := false
+	for _, arg := range argv {
+		if strings.HasPrefix(arg, "--explain-flags") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	cmd, args, err := root.Find(argv)
+	if err != nil {
+		return nil
+	}
+	if err := cmd.ParseFlags(args); err != nil || !*explain {
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,53 @@
+package kcobra
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlagSources(t *testing.T) {
+	os.Setenv("ROOT_ARTIFACT_UPLOAD_UPLOAD_P", "from-env")
+	defer os.Unsetenv("ROOT_ARTIFACT_UPLOAD_UPLOAD_P")
+	os.Setenv("ROOT_API_TOKEN", "secret")
+	defer os.Unsetenv("ROOT_API_TOKEN")
+
+	ff := CreateFakeCommand()
+	ff.Root.PersistentFlags().String("api-token", "", "secret token")
+
+	argv := []string{"root", "artifact", "upload", "--upload-p=from-cli"}
+	require.NoError(t, PopulateDefaults(ff.Root, argv, kflags.NewEnvAugmenter()))
+	require.NoError(t, ff.Upload.ParseFlags(argv[3:]))
+
+	assert.Equal(t, []kflags.Source{
+		{Kind: kflags.SourceDefault, Value: "uploadp0"},
+		{Kind: kflags.SourceEnv, Location: "ROOT_ARTIFACT_UPLOAD_UPLOAD_P", Value: "from-env"},
+		{Kind: kflags.SourceCommandLine, Value: "from-cli"},
+	}, FlagSources(ff.Upload.Flags().Lookup("upload-p")))
+
+	// Flags untouched by augmenters only have a default.
+	assert.Equal(t, []kflags.Source{
+		{Kind: kflags.SourceDefault, Value: "42"},
+	}, FlagSources(ff.Artifact.PersistentFlags().Lookup("artifact-p")))
+
+	var out bytes.Buffer
+	ExplainFlags(&out, ff.Upload)
+	explained := out.String()
+	assert.Contains(t, explained, "Flags of root artifact upload:\n")
+	assert.Contains(t, explained, "  --upload-p = \"from-cli\"\n      default: \"uploadp0\"\n      environment ROOT_ARTIFACT_UPLOAD_UPLOAD_P: \"from-env\"\n      command line: \"from-cli\"\n")
+	assert.Contains(t, explained, "  --api-token = <redacted>\n      default: \"\"\n      environment ROOT_API_TOKEN: <redacted>\n")
+	assert.NotContains(t, explained, "secret\"")
+}
+
+func TestExplainRequested(t *testing.T) {
+	o := &options{}
+	ff := CreateFakeCommand()
+	require.NoError(t, WithExplainFlags()(ff.Root, o))
+
+	assert.Nil(t, explainRequested(ff.Root, []string{"artifact", "upload"}, &o.explain))
+	assert.Equal(t, ff.Upload, explainRequested(ff.Root, []string{"artifact", "upload", "--explain-flags"}, &o.explain))
+}
@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 )
@@ -25,6 +26,9 @@ type CommandRetriever struct {
 	mods    []protocol.Modifier
 	log     logger.Logger
 	retrier *retry.Options
+
+	// If enabled, packages must be signed by a trusted key.
+	verifier *Verifier
 }
 
 func NewCommandRetriever(log logger.Logger, cache cache.Store, retrier *retry.Options, mods ...protocol.Modifier) *CommandRetriever {
@@ -49,27 +53,42 @@ func (cr *CommandRetriever) PrepareHash(url, hash string) (string, error) {
 
 	if err := cr.retrier.Run(func() error {
 		return protocol.Get(url, protocol.Reader(func(httpr io.Reader) error {
-			var found bool
-			var err error
-
-			unpack, found, err = cr.cache.Get(hash)
-			if found {
-				return nil
+			// The package is verified before unpacking, so it needs to be stored first.
+			tmp, err := os.CreateTemp("", "kconfig-package-*.tar.gz")
+			if err != nil {
+				return retry.Fatal(err)
 			}
-			defer cr.cache.Rollback(unpack)
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
 
 			h := sha256.New()
-			r := io.TeeReader(httpr, h)
-			err = karchive.Untarz(url, r, unpack, karchive.WithFileUmask(0222))
-			if err != nil {
-				return fmt.Errorf("error decompressing %s: %w", url, err)
+			if _, err := io.Copy(io.MultiWriter(tmp, h), httpr); err != nil {
+				return fmt.Errorf("error downloading %s: %w", url, err)
 			}
-
 			computed := hex.EncodeToString(h.Sum(nil))
 			if hash != computed {
 				return fmt.Errorf("computed sha256 for %s is %s - required is %s - REJECTED", url, computed, hash)
 			}
+			if err := cr.verify(url, tmp, false); err != nil {
+				return err
+			}
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				return retry.Fatal(err)
+			}
+
+			var found bool
+			unpack, found, err = cr.cache.Get(hash)
+			if err != nil {
+				return retry.Fatal(fmt.Errorf("problem accessing cached entry for hash %s of %s - %w", hash, url, err))
+			}
+			if found {
+				return nil
+			}
+			defer cr.cache.Rollback(unpack)
 
+			if err := karchive.Untarz(url, tmp, unpack, karchive.WithFileUmask(0222)); err != nil {
+				return fmt.Errorf("error decompressing %s: %w", url, err)
+			}
 			unpack, err = cr.cache.Commit(unpack)
 			return err
 		}), cr.mods...)
@@ -92,6 +111,10 @@ func (cr *CommandRetriever) PrepareURL(url string) (string, error) {
 			if !converted {
 				return retry.Fatal(fmt.Errorf("internal error: expected a CachedFile, but conversion failed. Got %#v", r))
 			}
+			// Verified every time, the unpacked package may predate the pinning of keys.
+			if err := cr.verify(url, cf.File, true); err != nil {
+				return err
+			}
 
 			tmp, found, err := cr.cache.Get(cf.Path)
 			if err != nil {
@@ -102,7 +125,7 @@ func (cr *CommandRetriever) PrepareURL(url string) (string, error) {
 				return nil
 			}
 			defer cr.cache.Rollback(tmp)
-			if err := karchive.Untarz(url, cf, unpack, karchive.WithFileUmask(0227)); err != nil {
+			if err := karchive.Untarz(url, cf, tmp, karchive.WithFileUmask(0227)); err != nil {
 				return err
 			}
 			unpack, err = cr.cache.Commit(tmp)
@@ -115,6 +138,42 @@ func (cr *CommandRetriever) PrepareURL(url string) (string, error) {
 	return unpack, nil
 }
 
+// verify checks the signature of the package at url, stored in file.
+//
+// The file is rewound, ready to be unpacked. Signatures are only cached if
+// cached is true, as packages retrieved by hash are never downloaded again
+// once unpacked.
+func (cr *CommandRetriever) verify(url string, file *os.File, cached bool) error {
+	if !cr.verifier.Enabled() {
+		return nil
+	}
+
+	mods := cr.mods
+	if cached {
+		mods = append([]protocol.Modifier{kcache.WithCache(cr.cache, kcache.WithLogger(cr.log))}, mods...)
+	}
+	var signatures []byte
+	if err := protocol.Get(url+SignatureSuffix, protocol.Read(protocol.Buffer(&signatures)), mods...); err != nil {
+		return &SignatureError{URL: url, Err: fmt.Errorf("could not retrieve signature - %w", err)}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return retry.Fatal(err)
+	}
+	digest, err := Digest(file)
+	if err != nil {
+		return retry.Fatal(err)
+	}
+	signer, err := cr.verifier.Verify(digest, signatures)
+	if err != nil {
+		return retry.Fatal(&SignatureError{URL: url, Err: err})
+	}
+	cr.log.Debugf("Package %s signed by trusted key %s", url, signer)
+
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
 func (cr *CommandRetriever) Prepare(url, hash string) (string, error) {
 	if hash != "" {
 		return cr.PrepareHash(url, hash)
@@ -1,6 +1,7 @@
 package kconfig
 
 import (
+	"errors"
 	"github.com/ccontavalli/enkit/lib/cache"
 	"github.com/ccontavalli/enkit/lib/khttp/ktest"
 	"github.com/ccontavalli/enkit/lib/logger"
@@ -93,3 +94,59 @@ func TestCommandRetrieverURLNotCached(t *testing.T) {
 	assert.Equal(t, "200 OK", http.Response[1].Status)
 	assert.Equal(t, "200 OK", http.Response[0].Status)
 }
+
+func TestCommandRetrieverSigned(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/empty.tar.gz")
+	assert.Nil(t, err)
+	trusted, priv := newTestKey(t, "release")
+	_, untrusted := newTestKey(t, "release")
+
+	mux, url, err := ktest.StartServer(ktest.ErrorHandler)
+	assert.Nil(t, err)
+	mux.HandleFunc("/signed.tar.gz", ktest.TestDataHandler("empty.tar.gz"))
+	mux.HandleFunc("/signed.tar.gz.sig", ktest.StringHandler(sign(t, "release", priv, string(data))))
+	mux.HandleFunc("/tampered.tar.gz", ktest.CachableTestDataHandler("empty.tar.gz"))
+	mux.HandleFunc("/tampered.tar.gz.sig", ktest.StringHandler(sign(t, "release", untrusted, string(data))))
+	mux.HandleFunc("/unsigned.tar.gz", ktest.CachableTestDataHandler("empty.tar.gz"))
+
+	const hash = "80b6d25600d8a239571857d944d4c5ff06235c6d6c5604877230c475ee94d0c5"
+	for _, byHash := range []bool{false, true} {
+		tmpdir, err := ioutil.TempDir("", "cache")
+		assert.Nil(t, err)
+		c := &cache.Local{Root: tmpdir}
+
+		cr := NewCommandRetriever(&logger.DefaultLogger{Printer: t.Logf}, c, retry.Nil)
+		cr.verifier, err = NewVerifier(trusted)
+		assert.Nil(t, err)
+
+		prepare := cr.PrepareURL
+		if byHash {
+			prepare = func(url string) (string, error) {
+				return cr.PrepareHash(url, hash)
+			}
+		}
+
+		dir, err := prepare(url + "signed.tar.gz")
+		assert.Nil(t, err, "%v", err)
+		assert.NotEqual(t, "", dir)
+
+		for _, name := range []string{"tampered.tar.gz", "unsigned.tar.gz"} {
+			c := &cache.Local{Root: tmpdir + "/" + name}
+			cr.cache = c
+
+			_, err := prepare(url + name)
+			var serr *SignatureError
+			assert.True(t, errors.As(err, &serr), "%v", err)
+
+			// Nothing was unpacked: the archive is empty, only the downloads
+			// cached by PrepareURL have data.
+			entries, err := c.List()
+			assert.Nil(t, err)
+			for _, entry := range entries {
+				if entry.State == cache.EntryCommitted {
+					assert.NotEqual(t, int64(0), entry.Size, "%s", entry.Path)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/lib/kflags/kconfig"
+	"github.com/ccontavalli/enkit/lib/khttp/protocol"
+
+	"github.com/spf13/cobra"
+)
+
+type Root struct {
+	*cobra.Command
+	*client.BaseFlags
+}
+
+func New(base *client.BaseFlags) *Root {
+	root := NewRoot(base)
+
+	root.AddCommand(NewVerify(root).Command)
+
+	return root
+}
+
+func NewRoot(base *client.BaseFlags) *Root {
+	return &Root{
+		Command: &cobra.Command{
+			Use:           "config",
+			Short:         "Inspect the remote configuration",
+			SilenceUsage:  true,
+			SilenceErrors: true,
+			Long:          `config - inspects the configuration and commands retrieved from the remote config server`,
+		},
+		BaseFlags: base,
+	}
+}
+
+type Verify struct {
+	*cobra.Command
+	root *Root
+
+	BaseConfig string
+	Signature  string
+}
+
+func NewVerify(root *Root) *Verify {
+	command := &Verify{
+		Command: &cobra.Command{
+			Use:   "verify <config-or-package>...",
+			Short: "Verify the signature of config files and command packages",
+			Long: `Verify the signature of config files and command packages.
+
+Each argument is the path or URL of a config file or package. Its signature
+is retrieved by appending ` + kconfig.SignatureSuffix + ` to it, and must be signed by one of
+the keys specified with --kflags-trusted-key, or pinned by --base-config.`,
+			Example: `  $ enkit config verify --base-config=https://config.example.com/enkit.config ./tools.tar.gz
+        Verify that tools.tar.gz is signed with a key trusted by the base config.`,
+			Args: cobra.MinimumNArgs(1),
+		},
+		root: root,
+	}
+	command.Command.RunE = command.Run
+	command.Flags().StringVar(&command.BaseConfig, "base-config", "", "Path or URL of a config file pinning the trusted keys")
+	command.Flags().StringVar(&command.Signature, "signature", "", "Path or URL of the signature file, if it's not the file to verify with "+kconfig.SignatureSuffix+" appended. Only valid with one file")
+
+	return command
+}
+
+func (c *Verify) Run(cmd *cobra.Command, args []string) error {
+	if c.Signature != "" && len(args) != 1 {
+		return fmt.Errorf("--signature can only be used when verifying a single file")
+	}
+
+	var keys []kconfig.TrustedKey
+	for _, value := range c.root.ProviderFlags.TrustedKeys {
+		key, err := kconfig.ParseTrustedKey(value)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if c.BaseConfig != "" {
+		data, err := fetch(c.BaseConfig)
+		if err != nil {
+			return err
+		}
+		config, err := kconfig.Parse(c.BaseConfig, data)
+		if err != nil {
+			return fmt.Errorf("could not parse base config %s - %w", c.BaseConfig, err)
+		}
+		keys = append(keys, config.TrustedKey...)
+	}
+
+	verifier, err := kconfig.NewVerifier(keys...)
+	if err != nil {
+		return err
+	}
+	if !verifier.Enabled() {
+		return fmt.Errorf("no trusted keys - use --kflags-trusted-key, or a --base-config pinning keys")
+	}
+
+	failed := 0
+	for _, target := range args {
+		signature := c.Signature
+		if signature == "" {
+			signature = target + kconfig.SignatureSuffix
+		}
+		signer, err := verifyFile(verifier, target, signature)
+		if err != nil {
+			c.root.Log.Errorf("%s", err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: OK, signed by %s\n", target, signer)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(args))
+	}
+	return nil
+}
+
+func verifyFile(verifier *kconfig.Verifier, target, signature string) (string, error) {
+	data, err := fetch(target)
+	if err != nil {
+		return "", err
+	}
+	signatures, err := fetch(signature)
+	if err != nil {
+		return "", &kconfig.SignatureError{URL: target, Err: fmt.Errorf("could not retrieve signature - %w", err)}
+	}
+	return verifier.VerifyData(target, data, signatures)
+}
+
+// fetch reads a local file, or retrieves an http or https URL.
+func fetch(location string) ([]byte, error) {
+	if u, err := url.Parse(location); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		var data []byte
+		if err := protocol.Get(location, protocol.Read(protocol.Buffer(&data))); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	return os.ReadFile(location)
+}
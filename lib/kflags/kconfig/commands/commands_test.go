@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/errdiff"
+	"github.com/ccontavalli/enkit/lib/kflags/kconfig"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyFile(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	verifier, err := kconfig.NewVerifier(kconfig.TrustedKey{Name: "release", Key: base64.StdEncoding.EncodeToString(pub)})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	config := write("enkit.config", `{"Include": ["other.config"]}`)
+
+	digest, err := kconfig.Digest(strings.NewReader(`{"Include": ["other.config"]}`))
+	require.NoError(t, err)
+	signature, err := kconfig.Sign("release", priv, digest)
+	require.NoError(t, err)
+	write("enkit.config.sig", signature)
+
+	signer, err := verifyFile(verifier, config, config+kconfig.SignatureSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, "release", signer)
+
+	tampered := write("tampered.config", `{"Include": ["evil.config"]}`)
+	_, err = verifyFile(verifier, tampered, config+kconfig.SignatureSuffix)
+	errdiff.Check(t, err, "signature verification of "+tampered+" FAILED")
+
+	_, err = verifyFile(verifier, tampered, tampered+kconfig.SignatureSuffix)
+	errdiff.Check(t, err, "could not retrieve signature")
+}
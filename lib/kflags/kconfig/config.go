@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -131,6 +132,10 @@ type options struct {
 	paramfactory   ParamFactory
 	commandfactory CommandFactory
 
+	// Keys trusted to sign includes and command packages.
+	// If empty, signatures are not verified.
+	trusted []TrustedKey
+
 	base string
 
 	blocklist      *SeenStack
@@ -217,6 +222,18 @@ func WithBaseURL(url string) Modifier {
 	}
 }
 
+// WithTrustedKeys requires all includes and command packages to be signed by one of the keys.
+//
+// Keys pinned this way take precedence over keys pinned by the TrustedKey
+// field of the config files. Unlike those, which are trust-on-first-use,
+// they also verify the first config retrieved.
+func WithTrustedKeys(keys ...TrustedKey) Modifier {
+	return func(o *options) error {
+		o.trusted = append(o.trusted, keys...)
+		return nil
+	}
+}
+
 func WithMangler(mangler kflags.VarMangler) Modifier {
 	return func(o *options) error {
 		o.mangler = mangler
@@ -233,16 +250,20 @@ func WithLogger(l logger.Logger) Modifier {
 
 type Modifiers []Modifier
 
-func (mods Modifiers) Apply(o *options) {
+func (mods Modifiers) Apply(o *options) error {
 	for _, m := range mods {
-		m(o)
+		if err := m(o); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 type Flags struct {
 	Downloader     *downloader.Flags
 	DNS            *remote.DNSFlags
 	RecursionLimit int
+	TrustedKeys    []string
 }
 
 func DefaultFlags() *Flags {
@@ -267,6 +288,9 @@ func (fl *Flags) Register(set kflags.FlagSet, prefix string) *Flags {
 	fl.DNS.Register(set, prefix+"kflags-")
 
 	set.IntVar(&fl.RecursionLimit, prefix+"kflags-recursion-limit", options.recursionLimit, "How many nested includes to process at most")
+	set.StringArrayVar(&fl.TrustedKeys, prefix+"kflags-trusted-key", fl.TrustedKeys, "Public key trusted to sign remote configs and command packages, as name=base64-ed25519-key. "+
+		"If specified, configs and packages not signed by one of these keys are rejected. "+
+		"Unlike the keys pinned by a remote config, trusted on first use, these also verify the first config retrieved")
 	return fl
 }
 
@@ -278,6 +302,13 @@ func FromFlags(fl *Flags) Modifier {
 		o.dlo = append(o.dlo, downloader.FromFlags(fl.Downloader))
 		o.dnso = append(o.dnso, remote.FromDNSFlags(fl.DNS))
 		o.recursionLimit = fl.RecursionLimit
+		for _, value := range fl.TrustedKeys {
+			key, err := ParseTrustedKey(value)
+			if err != nil {
+				return err
+			}
+			o.trusted = append(o.trusted, key)
+		}
 		return nil
 	}
 }
@@ -296,7 +327,9 @@ func FallbackFile(cs cache.Store, domain string) (string, error) {
 
 func NewConfigAugmenterFromDNS(cs cache.Store, domain string, binary string, mods ...Modifier) (*ConfigAugmenter, error) {
 	options := DefaultOptions()
-	Modifiers(mods).Apply(options)
+	if err := Modifiers(mods).Apply(options); err != nil {
+		return nil, err
+	}
 
 	if domain == "" {
 		return nil, fmt.Errorf("cannot look up empty domain name")
@@ -389,12 +422,30 @@ func NewConfigAugmenterFromURL(cs cache.Store, url string, mods ...Modifier) (*C
 
 func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*ConfigAugmenter, error) {
 	options := DefaultOptions()
-	Modifiers(mods).Apply(options)
+	if err := Modifiers(mods).Apply(options); err != nil {
+		return nil, err
+	}
+
+	// The first config pinning keys defines the keys used to verify all the
+	// configs and packages it includes, directly or indirectly.
+	//
+	// That config is not verified itself, unless keys were already pinned:
+	// the pin is trust-on-first-use, see the TrustedKey field of Config.
+	if len(config.TrustedKey) > 0 {
+		if len(options.trusted) == 0 {
+			options.trusted = config.TrustedKey
+		} else if !slices.Equal(options.trusted, config.TrustedKey) {
+			options.log.Warnf("config %s attempts to change the trusted keys - ignored, keys are already pinned", options.base)
+		}
+	}
+	verifier, err := NewVerifier(options.trusted...)
+	if err != nil {
+		return nil, err
+	}
 
 	if options.blocklist == nil {
 		options.blocklist = NewSeenStack()
 	}
-	var err error
 	if options.dl == nil {
 		options.dl, err = downloader.New(options.dlo...)
 		if err != nil {
@@ -413,11 +464,15 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 	if options.paramfactory == nil {
 		options.paramfactory = NewCreator(options.log, cs, options.dl, options.getOptions...).Create
 	}
-	if options.commandfactory == nil {
-		options.commandfactory = NewCommandRetriever(options.log, cs, options.dl.Retrier(), options.dl.ProtocolModifiers()...).Retrieve
+	// Not stored in options: the included configs may pin different keys.
+	commandfactory := options.commandfactory
+	if commandfactory == nil {
+		retriever := NewCommandRetriever(options.log, cs, options.dl.Retrier(), options.dl.ProtocolModifiers()...)
+		retriever.verifier = verifier
+		commandfactory = retriever.Retrieve
 	}
 
-	namespace, err := NewNamespaceAugmenter(baseURL, config.Namespace, options.log, options.mangler, options.commandfactory, options.paramfactory)
+	namespace, err := NewNamespaceAugmenter(baseURL, config.Namespace, options.log, options.mangler, commandfactory, options.paramfactory)
 	if err != nil {
 		return nil, err
 	}
@@ -457,7 +512,16 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 		}
 
 		cr.resolver[offset].cond = sync.NewCond(&cr.lock)
+		getOptions := append([]downloader.Modifier{downloader.WithProtocolOptions(kcache.WithCache(cs))}, options.getOptions...)
 		options.dl.Get(url, protocol.Read(protocol.Callback(func(data []byte) error {
+			if verifier.Enabled() {
+				signer, err := verifyConfig(options.dl, verifier, url, data, getOptions...)
+				if err != nil {
+					return retry.Fatal(err)
+				}
+				options.log.Debugf("Config %s signed by trusted key %s", url, signer)
+			}
+
 			config, err := Parse(url, data)
 
 			// TODO: we could easily implement an error type that causes WithCache (if used) to retry with the stale data.
@@ -493,11 +557,23 @@ func NewConfigAugmenter(cs cache.Store, config *Config, mods ...Modifier) (*Conf
 			}
 			cr.resolver[offset].err = err
 			cr.resolver[offset].cond.Signal()
-		}), append([]downloader.Modifier{downloader.WithProtocolOptions(kcache.WithCache(cs))}, options.getOptions...)...)
+		}), getOptions...)
 	}
 	return cr, multierror.New(errs)
 }
 
+// verifyConfig retrieves the signature of the config file at url, and checks
+// it against the config data.
+//
+// Returns the name of the key that signed the config.
+func verifyConfig(dl *downloader.Downloader, verifier *Verifier, url string, data []byte, mods ...downloader.Modifier) (string, error) {
+	var signatures []byte
+	if err := dl.Fetch(url+SignatureSuffix, protocol.Read(protocol.Buffer(&signatures)), mods...); err != nil {
+		return "", &SignatureError{URL: url, Err: fmt.Errorf("could not retrieve signature - %w", err)}
+	}
+	return verifier.VerifyData(url, data, signatures)
+}
+
 func (cr *ConfigAugmenter) VisitCommand(namespace string, command kflags.Command) (bool, error) {
 	for ix := range cr.resolver {
 		resolver, err := cr.getAugmenter(ix)
@@ -1,12 +1,15 @@
 package kconfig
 
 import (
+	"errors"
 	"flag"
 	"github.com/ccontavalli/enkit/lib/cache"
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/lib/khttp/downloader"
 	"github.com/ccontavalli/enkit/lib/khttp/ktest"
+	"github.com/ccontavalli/enkit/lib/khttp/workpool"
 	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/ccontavalli/enkit/lib/retry"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
@@ -187,3 +190,64 @@ func TestConfigAugmenter(t *testing.T) {
 	err = r.Done()
 	assert.Nil(t, err, "%s", err)
 }
+
+func TestConfigAugmenterSigned(t *testing.T) {
+	trusted, priv := newTestKey(t, "release")
+	_, untrusted := newTestKey(t, "release")
+
+	jconfigSigned := `{"Namespace": [{"Name": "", "Default": [{"Name": "signed-server", "Value": "signed"}]}]}`
+	jconfigTampered := `{"Namespace": [{"Name": "", "Default": [{"Name": "tampered-server", "Value": "tampered"}]}]}`
+	jconfigBase := `{
+  "TrustedKey": [{"Name": "release", "Key": "` + trusted.Key + `"}],
+  "Include": ["/signed.json", "/tampered.json", "/unsigned.json"]
+}`
+
+	mux, url, err := ktest.StartServer(ktest.StringHandler(jconfigBase))
+	assert.Nil(t, err)
+	mux.HandleFunc("/signed.json", ktest.StringHandler(jconfigSigned))
+	mux.HandleFunc("/signed.json.sig", ktest.StringHandler(sign(t, "release", priv, jconfigSigned)))
+	mux.HandleFunc("/tampered.json", ktest.StringHandler(jconfigTampered))
+	mux.HandleFunc("/tampered.json.sig", ktest.StringHandler(sign(t, "release", untrusted, jconfigTampered)))
+	mux.HandleFunc("/unsigned.json", ktest.StringHandler(jconfigTampered))
+	mux.HandleFunc("/unsigned.json.sig", ktest.ErrorHandler)
+
+	visit := func(r *ConfigAugmenter, name string) string {
+		fs := flag.NewFlagSet("", flag.PanicOnError)
+		value := fs.String(name, "default", "usage")
+		_, err := r.VisitFlag("", &kflags.GoFlag{Flag: fs.Lookup(name)})
+		assert.Nil(t, err)
+		return *value
+	}
+
+	// The base config is loaded without verification, and pins the keys for its includes.
+	tempdir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	dl, err := downloader.New(downloader.WithWorkpoolOptions(workpool.WithQueueSize(16)), downloader.WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+	r, err := NewConfigAugmenterFromURL(&cache.Local{Root: tempdir}, url, WithDownloader(dl))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "signed", visit(r, "signed-server"))
+	assert.Equal(t, "default", visit(r, "tampered-server"))
+
+	dl.Wait()
+	err = r.Done()
+	var serr *SignatureError
+	assert.True(t, errors.As(err, &serr), "%v", err)
+
+	// Keys pinned with options apply to the base config as well.
+	tempdir, err = ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	dl, err = downloader.New(downloader.WithWorkpoolOptions(workpool.WithQueueSize(16)), downloader.WithRetryOptions(retry.WithAttempts(1)))
+	assert.Nil(t, err)
+	r, err = NewConfigAugmenterFromURL(&cache.Local{Root: tempdir}, url+"signed.json", WithDownloader(dl), WithTrustedKeys(trusted))
+	assert.Nil(t, err)
+	assert.Equal(t, "signed", visit(r, "signed-server"))
+
+	r, err = NewConfigAugmenterFromURL(&cache.Local{Root: tempdir}, url, WithDownloader(dl), WithTrustedKeys(trusted))
+	assert.Nil(t, err)
+	assert.Equal(t, "default", visit(r, "signed-server"))
+
+	dl.Wait()
+	assert.True(t, errors.As(r.Done(), &serr))
+}
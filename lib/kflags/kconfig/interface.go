@@ -42,6 +42,11 @@ type Namespace struct {
 	Command []Command
 }
 
+// Package is a .tar.gz file containing a Manifest, and the implementation of
+// the commands it defines.
+//
+// If the config defining the package has trusted keys, the package must be
+// signed: the signature is verified before the package is unpacked.
 type Package struct {
 	URL  string
 	Hash string
@@ -84,7 +89,17 @@ type Command struct {
 //
 // 1) First, the list of current Namespace is looked up. If a match is found, the default is set.
 // 2) In order from last to first, all the includes are processed. The default of the first matching include is used.
+//
+// If TrustedKey is set, all the includes and command packages of the config,
+// recursively, must be signed by one of the keys. A signature is retrieved by
+// appending SignatureSuffix to the URL of the signed file.
+//
+// Keys pinned this way are trust-on-first-use: the config pinning them is
+// only verified if keys were already pinned, by WithTrustedKeys or by a
+// config including it. Anyone able to alter the first config pinning keys,
+// or the endpoint serving it, can replace the keys.
 type Config struct {
-	Include   []string
-	Namespace []Namespace
+	Include    []string
+	Namespace  []Namespace
+	TrustedKey []TrustedKey
 }
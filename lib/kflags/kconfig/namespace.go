@@ -361,7 +361,11 @@ func (c *NamespaceAugmenter) VisitFlag(namespace string, flag kflags.Flag) (bool
 			c.errs = append(c.errs, err)
 			return
 		}
-		if err := flag.SetContent(origin, []byte(value)); err != nil {
+		source := kflags.Source{Kind: kflags.SourceConfig, Namespace: namespace}
+		if c.base != nil {
+			source.Location = c.base.String()
+		}
+		if err := kflags.SetContentFrom(flag, source, origin, []byte(value)); err != nil {
 			c.errs = append(c.errs, fmt.Errorf("could not set flag '%s', value '%s' caused %w", flag.Name(), value, err))
 		}
 	}
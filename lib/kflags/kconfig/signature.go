@@ -0,0 +1,186 @@
+package kconfig
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// SignatureSuffix is appended to the URL of a config file or package to
+// retrieve its detached signature.
+const SignatureSuffix = ".sig"
+
+// TrustedKey is an ed25519 public key trusted to sign config files and
+// command packages.
+type TrustedKey struct {
+	// Name identifying the key in signature files.
+	Name string
+	// Key is the public key, base64 encoded.
+	Key string
+}
+
+// ParseTrustedKey parses a key in the name=base64-public-key format used
+// on the command line.
+func ParseTrustedKey(value string) (TrustedKey, error) {
+	name, key, found := strings.Cut(value, "=")
+	if !found || name == "" || key == "" {
+		return TrustedKey{}, fmt.Errorf("invalid trusted key %q - must be in name=base64-public-key format", value)
+	}
+	return TrustedKey{Name: name, Key: key}, nil
+}
+
+// SignatureError is returned when the signature of a config file or
+// command package cannot be verified.
+type SignatureError struct {
+	URL string
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("signature verification of %s FAILED - refusing to use it: %v", e.URL, e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// Verifier checks the signatures of config files and packages.
+//
+// A nil Verifier accepts anything: signatures are only verified if trusted
+// keys are configured.
+type Verifier struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a Verifier trusting the supplied keys, or nil if no
+// key was supplied.
+func NewVerifier(keys ...TrustedKey) (*Verifier, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	v := &Verifier{keys: map[string]ed25519.PublicKey{}}
+	for _, key := range keys {
+		decoded, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key %s - %w", key.Name, err)
+		}
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key %s - ed25519 keys are %d bytes, got %d", key.Name, ed25519.PublicKeySize, len(decoded))
+		}
+		if _, found := v.keys[key.Name]; found {
+			return nil, fmt.Errorf("trusted key %s configured multiple times", key.Name)
+		}
+		v.keys[key.Name] = ed25519.PublicKey(decoded)
+	}
+	return v, nil
+}
+
+// Enabled returns true if signatures must be verified.
+func (v *Verifier) Enabled() bool {
+	return v != nil
+}
+
+// Keys returns the names of the trusted keys, sorted.
+func (v *Verifier) Keys() []string {
+	if v == nil {
+		return nil
+	}
+	var names []string
+	for name := range v.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Digest computes the digest of the data to sign or verify.
+//
+// Signatures are computed on the SHA-512 digest of the data (Ed25519ph), so
+// large packages can be verified without keeping them in memory.
+func Digest(r io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Sign returns a signature line for a signature file, signing digest with key.
+//
+// A signature file can contain multiple lines, signed with different keys.
+func Sign(name string, key ed25519.PrivateKey, digest []byte) (string, error) {
+	signature, err := key.Sign(nil, digest, &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s\n", name, base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// Verify checks that the signature file contains a valid signature of digest
+// by a trusted key, and returns the name of the key.
+//
+// The signature file contains one "key-name base64-signature" pair per line.
+// Empty lines and lines starting with # are ignored.
+func (v *Verifier) Verify(digest []byte, signatures []byte) (string, error) {
+	var untrusted, invalid []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(signatures))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("invalid line in signature file: %q", line)
+		}
+		name := fields[0]
+		key, found := v.keys[name]
+		if !found {
+			untrusted = append(untrusted, name)
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(fields[1])
+		if err == nil {
+			err = ed25519.VerifyWithOptions(key, digest, signature, &ed25519.Options{Hash: crypto.SHA512})
+		}
+		if err != nil {
+			invalid = append(invalid, name)
+			continue
+		}
+		return name, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case len(invalid) > 0:
+		return "", fmt.Errorf("invalid signature by trusted key %s - the data was modified after signing?", strings.Join(invalid, ", "))
+	case len(untrusted) > 0:
+		return "", fmt.Errorf("signed only by untrusted keys %s - trusted keys are %s", strings.Join(untrusted, ", "), strings.Join(v.Keys(), ", "))
+	}
+	return "", fmt.Errorf("no signature found")
+}
+
+// VerifyData is a convenience wrapper around Digest and Verify for data
+// already in memory.
+func (v *Verifier) VerifyData(url string, data []byte, signatures []byte) (string, error) {
+	digest, err := Digest(bytes.NewReader(data))
+	if err != nil {
+		return "", &SignatureError{URL: url, Err: err}
+	}
+	name, err := v.Verify(digest, signatures)
+	if err != nil {
+		return "", &SignatureError{URL: url, Err: err}
+	}
+	return name, nil
+}
@@ -0,0 +1,132 @@
+package kconfig
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/errdiff"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKey generates a new key pair, returning the public key as a TrustedKey.
+func newTestKey(t *testing.T, name string) (TrustedKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	return TrustedKey{Name: name, Key: base64.StdEncoding.EncodeToString(pub)}, priv
+}
+
+// sign returns a signature file for data.
+func sign(t *testing.T, name string, priv ed25519.PrivateKey, data string) string {
+	t.Helper()
+	digest, err := Digest(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("could not compute digest: %v", err)
+	}
+	signature, err := Sign(name, priv, digest)
+	if err != nil {
+		t.Fatalf("could not sign: %v", err)
+	}
+	return signature
+}
+
+func TestVerifier(t *testing.T) {
+	trusted, trustedPriv := newTestKey(t, "release")
+	rotated, rotatedPriv := newTestKey(t, "release-2024")
+	_, untrustedPriv := newTestKey(t, "attacker")
+
+	v, err := NewVerifier(trusted, rotated)
+	assert.NoError(t, err)
+	assert.True(t, v.Enabled())
+	assert.Equal(t, []string{"release", "release-2024"}, v.Keys())
+
+	testCases := []struct {
+		desc       string
+		data       string
+		signatures string
+		wantSigner string
+		wantErr    string
+	}{
+		{
+			desc:       "trusted key",
+			data:       "config",
+			signatures: sign(t, "release", trustedPriv, "config"),
+			wantSigner: "release",
+		},
+		{
+			desc:       "multiple signatures",
+			data:       "config",
+			signatures: "# signed during rotation\n\n" + sign(t, "attacker", untrustedPriv, "config") + sign(t, "release-2024", rotatedPriv, "config"),
+			wantSigner: "release-2024",
+		},
+		{
+			desc:       "modified data",
+			data:       "config, modified",
+			signatures: sign(t, "release", trustedPriv, "config"),
+			wantErr:    "invalid signature by trusted key release",
+		},
+		{
+			desc:       "signed with wrong key",
+			data:       "config",
+			signatures: sign(t, "release", untrustedPriv, "config"),
+			wantErr:    "invalid signature by trusted key release",
+		},
+		{
+			desc:       "untrusted key",
+			data:       "config",
+			signatures: sign(t, "attacker", untrustedPriv, "config"),
+			wantErr:    "signed only by untrusted keys attacker",
+		},
+		{
+			desc:       "malformed",
+			data:       "config",
+			signatures: "release",
+			wantErr:    "invalid line",
+		},
+		{
+			desc:    "empty",
+			data:    "config",
+			wantErr: "no signature found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			signer, err := v.VerifyData("https://example.com/config", []byte(tc.data), []byte(tc.signatures))
+			errdiff.Check(t, err, tc.wantErr)
+			assert.Equal(t, tc.wantSigner, signer)
+			if err != nil {
+				var serr *SignatureError
+				assert.True(t, errors.As(err, &serr))
+				assert.Equal(t, "https://example.com/config", serr.URL)
+			}
+		})
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	v, err := NewVerifier()
+	assert.NoError(t, err)
+	assert.False(t, v.Enabled())
+
+	key, _ := newTestKey(t, "release")
+	_, err = NewVerifier(key, key)
+	errdiff.Check(t, err, "configured multiple times")
+	_, err = NewVerifier(TrustedKey{Name: "short", Key: "c2hvcnQ="})
+	errdiff.Check(t, err, "ed25519 keys are 32 bytes")
+	_, err = NewVerifier(TrustedKey{Name: "garbage", Key: "!!"})
+	errdiff.Check(t, err, "invalid trusted key garbage")
+}
+
+func TestParseTrustedKey(t *testing.T) {
+	key, err := ParseTrustedKey("release=c2hvcnQ=")
+	assert.NoError(t, err)
+	assert.Equal(t, TrustedKey{Name: "release", Key: "c2hvcnQ="}, key)
+
+	_, err = ParseTrustedKey("c2hvcnQ")
+	errdiff.Check(t, err, "name=base64-public-key")
+}
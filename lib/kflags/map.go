@@ -62,7 +62,7 @@ func (ma *MapAugmenter) VisitFlag(reqns string, fl Flag) (bool, error) {
 
 		result, found := ma.args[name]
 		if found {
-			return true, fl.Set(result)
+			return true, SetFrom(fl, Source{Kind: SourceMap, Location: name}, result)
 		}
 	}
 
@@ -0,0 +1,117 @@
+package kflags
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// SourceKind identifies the type of source that set the value of a flag.
+type SourceKind int
+
+const (
+	// The default value defined in the code.
+	SourceDefault SourceKind = iota
+	// An asset embedded in the binary, see AssetAugmenter.
+	SourceAsset
+	// An environment variable, see EnvAugmenter.
+	SourceEnv
+	// A map supplied by the application, see MapAugmenter.
+	SourceMap
+	// A config file, like the ones retrieved by kconfig.
+	SourceConfig
+	// The command line.
+	SourceCommandLine
+)
+
+func (k SourceKind) String() string {
+	switch k {
+	case SourceDefault:
+		return "default"
+	case SourceAsset:
+		return "asset"
+	case SourceEnv:
+		return "environment"
+	case SourceMap:
+		return "map"
+	case SourceConfig:
+		return "config"
+	case SourceCommandLine:
+		return "command line"
+	}
+	return fmt.Sprintf("SourceKind(%d)", int(k))
+}
+
+// Source describes where the value of a flag came from.
+type Source struct {
+	Kind SourceKind
+	// Location of the value within the source: the name of the environment
+	// variable, of the asset, the URL of the config file, ...
+	Location string `json:",omitempty"`
+	// Namespace of the config file defining the value, if any.
+	Namespace string `json:",omitempty"`
+	// Value assigned to the flag, as shown to the user.
+	Value string
+}
+
+// Describe returns a human readable description of the source, without the value.
+func (s Source) Describe() string {
+	result := s.Kind.String()
+	if s.Location != "" {
+		result += " " + s.Location
+	}
+	if s.Namespace != "" {
+		result += " (namespace " + s.Namespace + ")"
+	}
+	return result
+}
+
+// SourceRecorder is implemented by flags capable of recording where their
+// value came from.
+//
+// RecordSource is invoked after the value of the flag has been changed, and
+// is expected to fill in the Value of the Source from the flag.
+type SourceRecorder interface {
+	RecordSource(source Source)
+}
+
+// SetFrom sets the value of a flag, recording the source of the value if the
+// flag implements SourceRecorder.
+//
+// Augmenters should use SetFrom instead of calling Set directly.
+func SetFrom(fl Flag, source Source, value string) error {
+	if err := fl.Set(value); err != nil {
+		return err
+	}
+	if recorder, ok := fl.(SourceRecorder); ok {
+		recorder.RecordSource(source)
+	}
+	return nil
+}
+
+// SetContentFrom is just like SetFrom, but sets the content of the flag.
+//
+// See the ContentValue interface for details.
+func SetContentFrom(fl Flag, source Source, origin string, content []byte) error {
+	if err := fl.SetContent(origin, content); err != nil {
+		return err
+	}
+	if recorder, ok := fl.(SourceRecorder); ok {
+		recorder.RecordSource(source)
+	}
+	return nil
+}
+
+// SecretFlag matches the names of flags likely to hold secrets.
+var SecretFlag = regexp.MustCompile(`(?i)(token|secret|passw|cookie|credential|private|api-?key)`)
+
+// Redacted replaces the value of secret flags when shown to the user.
+const Redacted = "<redacted>"
+
+// Redact returns the value of a flag suitable to be shown to the user,
+// replacing non empty values of flags likely to hold secrets with Redacted.
+func Redact(name, value string) string {
+	if value != "" && SecretFlag.MatchString(name) {
+		return Redacted
+	}
+	return value
+}
@@ -0,0 +1,57 @@
+package kflags
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingFlag struct {
+	GoFlag
+	sources []Source
+}
+
+func (rf *recordingFlag) RecordSource(source Source) {
+	source.Value = rf.Flag.Value.String()
+	rf.sources = append(rf.sources, source)
+}
+
+func TestSetFrom(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("server", "localhost", "usage")
+	fs.Int("port", 0, "usage")
+
+	server := &recordingFlag{GoFlag: GoFlag{fs.Lookup("server")}}
+	assert.NoError(t, SetFrom(server, Source{Kind: SourceEnv, Location: "TEST_SERVER"}, "example.com"))
+	assert.NoError(t, SetContentFrom(server, Source{Kind: SourceConfig, Location: "https://example.com/test.config", Namespace: "test"}, "server", []byte("config.example.com\n")))
+	assert.Equal(t, []Source{
+		{Kind: SourceEnv, Location: "TEST_SERVER", Value: "example.com"},
+		{Kind: SourceConfig, Location: "https://example.com/test.config", Namespace: "test", Value: "config.example.com"},
+	}, server.sources)
+	assert.Equal(t, "config.example.com", fs.Lookup("server").Value.String())
+
+	// Failures are not recorded.
+	port := &recordingFlag{GoFlag: GoFlag{fs.Lookup("port")}}
+	assert.Error(t, SetFrom(port, Source{Kind: SourceEnv, Location: "TEST_PORT"}, "http"))
+	assert.Empty(t, port.sources)
+
+	// Flags not recording sources are just set.
+	assert.NoError(t, SetFrom(&GoFlag{fs.Lookup("port")}, Source{Kind: SourceEnv}, "80"))
+	assert.Equal(t, "80", fs.Lookup("port").Value.String())
+}
+
+func TestSourceDescribe(t *testing.T) {
+	assert.Equal(t, "default", Source{Kind: SourceDefault, Value: "1"}.Describe())
+	assert.Equal(t, "environment ENKIT_PORT", Source{Kind: SourceEnv, Location: "ENKIT_PORT"}.Describe())
+	assert.Equal(t, "config https://example.com/enkit.config (namespace enkit.astore)",
+		Source{Kind: SourceConfig, Location: "https://example.com/enkit.config", Namespace: "enkit.astore"}.Describe())
+}
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, "example.com", Redact("server", "example.com"))
+	assert.Equal(t, Redacted, Redact("override-token", "abc"))
+	assert.Equal(t, Redacted, Redact("buildbuddy-api-key", "abc"))
+	assert.Equal(t, Redacted, Redact("db-password", "abc"))
+	assert.Equal(t, "", Redact("override-token", ""))
+}
@@ -179,6 +179,21 @@ func (d *Downloader) Get(url string, handler protocol.ResponseHandler, eh workpo
 	return nil
 }
 
+// Fetch will fetch the specified url synchronously, with the same options and retries used by Get.
+//
+// Fetch does not use the workpool: it is safe to invoke from a handler run by Get, for example
+// to retrieve a resource related to the one just downloaded, without risking a deadlock.
+func (d *Downloader) Fetch(url string, handler protocol.ResponseHandler, mods ...Modifier) error {
+	options := &options{roptions: d.roptions}
+	if err := Modifiers(mods).Apply(options); err != nil {
+		return err
+	}
+
+	return options.Retrier().Run(func() error {
+		return protocol.Get(url, handler, options.ProtocolModifiers()...)
+	})
+}
+
 type Modifier func(*options) error
 
 type Modifiers []Modifier
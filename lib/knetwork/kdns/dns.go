@@ -7,16 +7,53 @@ import (
 	"github.com/miekg/dns"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultTTL is the TTL of records added without one, and of negative answers.
+const DefaultTTL = 300
+
+// DefaultForwardTimeout is how long to wait for an upstream resolver before trying the next one.
+const DefaultForwardTimeout = 5 * time.Second
+
+// DefaultForwardAllowed are the networks allowed to have their queries forwarded
+// by default: loopback, private and link local addresses.
+var DefaultForwardAllowed = []string{
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::1/128", "fc00::/7", "fe80::/10",
+}
+
 type DnsServer struct {
 	Flags   *Flags
 	Logger  logger.Logger
 	Port    int
 	Domains []string
 
+	// TTL assigned to records added with a TTL of 0. It is also used for the SOA
+	// record of the zones, and determines how long negative answers are cached.
+	TTL uint32
+	// Nameserver advertised in the SOA and NS records of the zones. Defaults to ns.<zone>.
+	Nameserver string
+	// Upstream resolvers queries outside of Domains are forwarded to, in host:port format.
+	// If empty, those queries are not answered.
+	Forwarders     []string
+	ForwardTimeout time.Duration
+	// Networks allowed to have their queries forwarded to Forwarders, see DefaultForwardAllowed.
+	// Queries from other clients are refused, so the server is not an open resolver.
+	ForwardAllowed []*net.IPNet
+	// Networks allowed to request a zone transfer (AXFR) of Domains.
+	TransferAllowed []*net.IPNet
+	// Keys allowed to change records with DNS UPDATE messages, see HandleUpdate.
+	UpdateKeys []UpdateKey
+
 	host       string
 	dnsServers []*dns.Server
+	// Serial of the zones, incremented every time the records change.
+	serial atomic.Uint32
+	// Serializes DNS UPDATE messages.
+	updateLock sync.Mutex
 
 	readOnlyChan chan struct {
 		Return chan *RecordController
@@ -28,6 +65,8 @@ type DnsServer struct {
 		Origin string
 	}
 
+	listChan chan chan map[string]*RecordController
+
 	shutdown        chan bool
 	shutdownSuccess chan bool
 }
@@ -43,10 +82,16 @@ func (s *DnsServer) Run() error {
 	for _, domain := range s.Domains {
 		mux.HandleFunc(dns.Fqdn(domain), s.HandleIncoming)
 	}
+	// Reverse lookups of the A and AAAA records served, see ReverseLookup.
+	mux.HandleFunc(reverseZone4, s.HandleIncoming)
+	mux.HandleFunc(reverseZone6, s.HandleIncoming)
+	if len(s.Forwarders) > 0 {
+		mux.HandleFunc(".", s.Forward)
+	}
 	portAddr := net.JoinHostPort(s.host, strconv.Itoa(s.Port))
 	go s.HandleControllers()
-	tcpServer := &dns.Server{Handler: mux, ReusePort: true, Net: "tcp", Addr: portAddr, Listener: s.Flags.TCPListener}
-	udpServer := &dns.Server{Handler: mux, ReusePort: true, Net: "udp", Addr: portAddr}
+	tcpServer := &dns.Server{Handler: mux, ReusePort: true, Net: "tcp", Addr: portAddr, Listener: s.Flags.TCPListener, TsigSecret: s.tsigSecrets(), MsgAcceptFunc: s.msgAcceptFunc()}
+	udpServer := &dns.Server{Handler: mux, ReusePort: true, Net: "udp", Addr: portAddr, TsigSecret: s.tsigSecrets(), MsgAcceptFunc: s.msgAcceptFunc()}
 	s.dnsServers = append(s.dnsServers, tcpServer, udpServer)
 	return goroutine.WaitFirstError(
 		func() error {
@@ -76,21 +121,56 @@ func (s *DnsServer) Stop() error {
 }
 
 // AddEntry will append a entries to domain.
+//
+// Records with a TTL of 0 are served with the TTL configured in the server.
+// As for all the methods changing entries, the serial of the zones is only
+// incremented if the records served change.
 func (s *DnsServer) AddEntry(name string, rr dns.RR) {
 	c := s.NewControllerForName(dns.CanonicalName(name))
-	c.AddRecords([]dns.RR{rr})
+	if c.AddRecords(s.withTTL([]dns.RR{rr})) {
+		s.serial.Add(1)
+	}
 }
 
 // SetEntry will hard replace an entry. Consider it a force AddEntry.
+//
+// Only records of the types supplied are replaced.
 func (s *DnsServer) SetEntry(name string, records []dns.RR) {
 	c := s.NewControllerForName(dns.CanonicalName(name))
-	c.SetRecords(records)
+	if c.SetRecords(s.withTTL(records)) {
+		s.serial.Add(1)
+	}
+}
+
+// ReplaceEntry replaces all the records of type rType of an entry.
+//
+// Unlike SetEntry, an empty list of records deletes all the records of the type.
+func (s *DnsServer) ReplaceEntry(name string, rType uint16, records []dns.RR) {
+	c := s.NewControllerForName(dns.CanonicalName(name))
+	if c.ReplaceRecords(rType, s.withTTL(records)) {
+		s.serial.Add(1)
+	}
 }
 
 // RemoveFromEntry will delete any entries that container the keywords in the record type.
 func (s *DnsServer) RemoveFromEntry(name string, keywords []string, rType uint16) {
 	c := s.NewControllerForName(dns.CanonicalName(name))
-	c.DeleteRecords(keywords, rType)
+	if c.DeleteRecords(keywords, rType) {
+		s.serial.Add(1)
+	}
+}
+
+// withTTL returns a copy of the records, with the default TTL applied to the records without one.
+func (s *DnsServer) withTTL(records []dns.RR) []dns.RR {
+	result := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		if rr.Header().Ttl == 0 {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = s.TTL
+		}
+		result = append(result, rr)
+	}
+	return result
 }
 
 // ControllerForName will return the controller specified for a specific domain or subdomain. If it does not exist, it
@@ -115,10 +195,18 @@ func (s *DnsServer) NewControllerForName(origin string) *RecordController {
 	return <-returnChan
 }
 
+// Controllers returns a snapshot of all the controllers, indexed by the name they serve.
+func (s *DnsServer) Controllers() map[string]*RecordController {
+	returnChan := make(chan map[string]*RecordController, 1)
+	s.listChan <- returnChan
+	return <-returnChan
+}
+
 func (s *DnsServer) HandleControllers() {
 	controllerMap := map[string]*RecordController{}
 	defer close(s.readOnlyChan)
 	defer close(s.newOrExistingChan)
+	defer close(s.listChan)
 	for {
 		select {
 		case o := <-s.newOrExistingChan:
@@ -128,6 +216,12 @@ func (s *DnsServer) HandleControllers() {
 			o.Return <- controllerMap[o.Origin]
 		case o := <-s.readOnlyChan:
 			o.Return <- controllerMap[o.Origin]
+		case o := <-s.listChan:
+			snapshot := make(map[string]*RecordController, len(controllerMap))
+			for name, c := range controllerMap {
+				snapshot[name] = c
+			}
+			o <- snapshot
 		case <-s.shutdown:
 			for _, c := range controllerMap {
 				c.Close()
@@ -140,6 +234,15 @@ func (s *DnsServer) HandleControllers() {
 
 // HandleIncoming is the entry point to the dns server, no request logic lives here, only dns.Server specific configs.
 func (s *DnsServer) HandleIncoming(writer dns.ResponseWriter, incoming *dns.Msg) {
+	if incoming.Opcode == dns.OpcodeQuery && len(incoming.Question) == 1 && incoming.Question[0].Qtype == dns.TypeAXFR {
+		s.HandleTransfer(writer, incoming)
+		return
+	}
+	if incoming.Opcode == dns.OpcodeUpdate {
+		s.HandleUpdate(writer, incoming)
+		return
+	}
+
 	m := &dns.Msg{}
 	m.SetReply(incoming)
 	m.Compress = true
@@ -148,26 +251,91 @@ func (s *DnsServer) HandleIncoming(writer dns.ResponseWriter, incoming *dns.Msg)
 	case dns.OpcodeQuery:
 		s.ParseDNS(m)
 	}
+
+	// Reverse lookups of addresses not served here are handled by the upstream resolvers.
+	if !m.Authoritative && m.Rcode == dns.RcodeNameError && len(s.Forwarders) > 0 {
+		s.Forward(writer, incoming)
+		return
+	}
+
 	err := writer.WriteMsg(m)
 	if err != nil {
 		s.Logger.Errorf("%s", err)
 	}
 }
 
+// maxCNAMEChain is the maximum number of CNAME records followed to answer a query.
+const maxCNAMEChain = 8
+
 // ParseDNS will only handle dns requests from Domains that it is specified to handle. It will modify the *dns.Msg in place.
+//
+// CNAME records pointing to names within Domains are followed, and PTR queries for addresses
+// not explicitly configured are answered with ReverseLookup.
 func (s *DnsServer) ParseDNS(m *dns.Msg) {
+	exists := false
 	for _, q := range m.Question {
-		c := s.ControllerForName(q.Name)
-		if c != nil {
-			rrs := c.FetchRecords(q.Qtype)
-			for _, txt := range rrs {
-				m.Answer = append(m.Answer, txt)
-			}
+		if zone := s.Zone(q.Name); zone != "" {
+			m.Authoritative = true
 		}
 
+		rrs, found := s.resolve(q.Name, q.Qtype, 0)
+		if len(rrs) == 0 && q.Qtype == dns.TypePTR {
+			rrs = s.ReverseLookup(q.Name)
+			found = len(rrs) > 0
+			if found {
+				m.Authoritative = true
+			}
+		}
+		exists = exists || found
+		m.Answer = append(m.Answer, rrs...)
 	}
 
-	if len(m.Answer) <= 0 {
+	if len(m.Answer) > 0 {
+		return
+	}
+	if !exists {
 		m.Rcode = dns.RcodeNameError
 	}
+	// Negative answers carry the SOA of the zone, so resolvers know how long to cache them.
+	for _, q := range m.Question {
+		if zone := s.Zone(q.Name); zone != "" {
+			m.Ns = append(m.Ns, s.SOA(zone))
+			break
+		}
+	}
+}
+
+// resolve returns the records of type qtype for name, following CNAME records,
+// and true if the name exists at all.
+func (s *DnsServer) resolve(name string, qtype uint16, depth int) ([]dns.RR, bool) {
+	name = dns.CanonicalName(name)
+	if zone := s.Zone(name); zone == name {
+		switch qtype {
+		case dns.TypeSOA:
+			return []dns.RR{s.SOA(zone)}, true
+		case dns.TypeNS:
+			return []dns.RR{s.NS(zone)}, true
+		}
+	}
+
+	c := s.ControllerForName(name)
+	if c == nil {
+		return nil, s.Zone(name) == name
+	}
+	rrs := c.FetchRecords(qtype)
+	if len(rrs) > 0 || qtype == dns.TypeCNAME {
+		return rrs, true
+	}
+
+	cnames := c.FetchRecords(dns.TypeCNAME)
+	if len(cnames) == 0 {
+		return nil, true
+	}
+	result := append([]dns.RR{}, cnames[0])
+	target := cnames[0].(*dns.CNAME).Target
+	if depth < maxCNAMEChain && s.Zone(target) != "" {
+		chained, _ := s.resolve(target, qtype, depth+1)
+		result = append(result, chained...)
+	}
+	return result, true
 }
@@ -91,3 +91,215 @@ func TestDNS(t *testing.T) {
 	assert.NotContains(t, ips, "10.9.9.9")
 
 }
+
+// startDNS starts a dns server on a random port, returning it with its address.
+func startDNS(t *testing.T, mods ...kdns.DNSModifier) (*kdns.DnsServer, string) {
+	l, err := knetwork.AllocatePort()
+	assert.NoError(t, err)
+	dnsAddr, err := l.Address()
+	assert.NoError(t, err)
+
+	dnsServer, err := kdns.NewDNS(append([]kdns.DNSModifier{
+		kdns.WithHost(dnsAddr.IP.String()),
+		kdns.WithPort(dnsAddr.Port),
+		kdns.WithTCPListener(l),
+	}, mods...)...)
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dnsServer.Run()
+	}()
+	t.Cleanup(func() {
+		assert.NoError(t, dnsServer.Stop())
+		<-done
+	})
+	return dnsServer, l.Addr().String()
+}
+
+func mustRR(t *testing.T, record string) dns.RR {
+	rr, err := dns.NewRR(record)
+	assert.NoError(t, err)
+	return rr
+}
+
+// assertRecords compares records in their text format, ignoring the details of the wire format.
+func assertRecords(t *testing.T, expected []string, actual []dns.RR) {
+	t.Helper()
+	var want, got []string
+	for _, record := range expected {
+		want = append(want, mustRR(t, record).String())
+	}
+	for _, rr := range actual {
+		got = append(got, rr.String())
+	}
+	assert.Equal(t, want, got)
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	client := &dns.Client{Net: "tcp"}
+	response, _, err := client.Exchange(m, addr)
+	assert.NoError(t, err)
+	return response
+}
+
+func TestDNSRecords(t *testing.T) {
+	// Cleanups run in reverse order: check for leaks after the servers are stopped.
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+	dnsServer, addr := startDNS(t, kdns.WithDomains([]string{"enkit."}), kdns.WithTTL(60))
+
+	dnsServer.SetEntry("host.enkit", []dns.RR{
+		mustRR(t, "host.enkit. 0 A 10.0.0.1"),
+		mustRR(t, "host.enkit. 0 AAAA fd00::1"),
+	})
+	dnsServer.AddEntry("_all.enkit", mustRR(t, "_all.enkit. 0 A 10.0.0.1"))
+	dnsServer.AddEntry("www.enkit", mustRR(t, "www.enkit. 10 CNAME host.enkit."))
+	dnsServer.AddEntry("_http._tcp.enkit", mustRR(t, "_http._tcp.enkit. SRV 10 5 8080 host.enkit."))
+
+	// Records without a TTL get the default one, others keep theirs.
+	response := query(t, addr, "host.enkit", dns.TypeAAAA)
+	assert.True(t, response.Authoritative)
+	assertRecords(t, []string{"host.enkit. 60 AAAA fd00::1"}, response.Answer)
+
+	response = query(t, addr, "www.enkit", dns.TypeA)
+	assertRecords(t, []string{
+		"www.enkit. 10 CNAME host.enkit.",
+		"host.enkit. 60 A 10.0.0.1",
+	}, response.Answer)
+
+	response = query(t, addr, "_http._tcp.enkit", dns.TypeSRV)
+	assertRecords(t, []string{"_http._tcp.enkit. 3600 SRV 10 5 8080 host.enkit."}, response.Answer)
+
+	// Reverse zones are generated from A and AAAA records, ignoring _ names.
+	response = query(t, addr, "1.0.0.10.in-addr.arpa", dns.TypePTR)
+	assert.True(t, response.Authoritative)
+	assertRecords(t, []string{"1.0.0.10.in-addr.arpa. 60 PTR host.enkit."}, response.Answer)
+
+	reverse, err := dns.ReverseAddr("fd00::1")
+	assert.NoError(t, err)
+	response = query(t, addr, reverse, dns.TypePTR)
+	assertRecords(t, []string{reverse + " 60 PTR host.enkit."}, response.Answer)
+
+	response = query(t, addr, "2.0.0.10.in-addr.arpa", dns.TypePTR)
+	assert.Equal(t, dns.RcodeNameError, response.Rcode)
+
+	// Existing names without records of the type have no answer, but are not NXDOMAIN.
+	response = query(t, addr, "host.enkit", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeSuccess, response.Rcode)
+	assert.Empty(t, response.Answer)
+	assert.Len(t, response.Ns, 1)
+
+	response = query(t, addr, "missing.enkit", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, response.Rcode)
+	assert.IsType(t, &dns.SOA{}, response.Ns[0])
+
+	response = query(t, addr, "enkit", dns.TypeSOA)
+	assertRecords(t, []string{dnsServer.SOA("enkit.").String()}, response.Answer)
+
+	// ReplaceEntry replaces all the records of the type, an empty list deletes them.
+	dnsServer.ReplaceEntry("host.enkit", dns.TypeA, []dns.RR{
+		mustRR(t, "host.enkit. 0 A 10.0.0.2"),
+		mustRR(t, "host.enkit. 0 A 10.0.0.3"),
+	})
+	response = query(t, addr, "host.enkit", dns.TypeA)
+	assertRecords(t, []string{"host.enkit. 60 A 10.0.0.2", "host.enkit. 60 A 10.0.0.3"}, response.Answer)
+	dnsServer.ReplaceEntry("host.enkit", dns.TypeA, nil)
+	response = query(t, addr, "host.enkit", dns.TypeA)
+	assert.Empty(t, response.Answer)
+	response = query(t, addr, "host.enkit", dns.TypeAAAA)
+	assertRecords(t, []string{"host.enkit. 60 AAAA fd00::1"}, response.Answer)
+}
+
+func TestDNSForward(t *testing.T) {
+	// Cleanups run in reverse order: check for leaks after the servers are stopped.
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+	upstream, upstreamAddr := startDNS(t, kdns.WithDomains([]string{"upstream."}))
+	upstream.AddEntry("host.upstream", mustRR(t, "host.upstream. A 10.1.0.1"))
+	upstream.AddEntry("2.0.0.10.in-addr.arpa", mustRR(t, "2.0.0.10.in-addr.arpa. PTR host.upstream."))
+
+	dnsServer, addr := startDNS(t, kdns.WithDomains([]string{"enkit."}), kdns.WithForwarders([]string{upstreamAddr}))
+	dnsServer.AddEntry("host.enkit", mustRR(t, "host.enkit. A 10.0.0.1"))
+
+	response := query(t, addr, "host.upstream", dns.TypeA)
+	assertRecords(t, []string{"host.upstream. 3600 A 10.1.0.1"}, response.Answer)
+
+	response = query(t, addr, "1.0.0.10.in-addr.arpa", dns.TypePTR)
+	assertRecords(t, []string{"1.0.0.10.in-addr.arpa. 3600 PTR host.enkit."}, response.Answer)
+	response = query(t, addr, "2.0.0.10.in-addr.arpa", dns.TypePTR)
+	assertRecords(t, []string{"2.0.0.10.in-addr.arpa. 3600 PTR host.upstream."}, response.Answer)
+
+	// Names in the served domains are never forwarded.
+	response = query(t, addr, "missing.enkit", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, response.Rcode)
+
+	// Queries are only forwarded for the allowed clients.
+	_, deniedAddr := startDNS(t, kdns.WithDomains([]string{"enkit."}), kdns.WithForwarders([]string{upstreamAddr}), kdns.WithForwardAllowed([]string{"10.0.0.0/8"}))
+	response = query(t, deniedAddr, "host.upstream", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, response.Rcode)
+	assert.Empty(t, response.Answer)
+	response = query(t, deniedAddr, "2.0.0.10.in-addr.arpa", dns.TypePTR)
+	assert.Equal(t, dns.RcodeRefused, response.Rcode)
+}
+
+func TestDNSTransfer(t *testing.T) {
+	// Cleanups run in reverse order: check for leaks after the servers are stopped.
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+	dnsServer, addr := startDNS(t, kdns.WithDomains([]string{"enkit.", "other."}), kdns.WithTransferAllowed([]string{"127.0.0.0/8", "::1/128"}))
+	dnsServer.SetEntry("b.enkit", []dns.RR{mustRR(t, "b.enkit. A 10.0.0.2"), mustRR(t, "b.enkit. TXT hello")})
+	dnsServer.AddEntry("a.enkit", mustRR(t, "a.enkit. A 10.0.0.1"))
+	dnsServer.AddEntry("a.other", mustRR(t, "a.other. A 10.0.0.3"))
+
+	m := &dns.Msg{}
+	m.SetAxfr("enkit.")
+	envelopes, err := (&dns.Transfer{}).In(m, addr)
+	assert.NoError(t, err)
+	var records []dns.RR
+	for envelope := range envelopes {
+		assert.NoError(t, envelope.Error)
+		records = append(records, envelope.RR...)
+	}
+	soa := dnsServer.SOA("enkit.").String()
+	assertRecords(t, []string{
+		soa,
+		dnsServer.NS("enkit.").String(),
+		"a.enkit. A 10.0.0.1",
+		"b.enkit. A 10.0.0.2",
+		"b.enkit. TXT hello",
+		soa,
+	}, records)
+
+	denied, deniedAddr := startDNS(t, kdns.WithDomains([]string{"enkit."}))
+	denied.AddEntry("a.enkit", mustRR(t, "a.enkit. A 10.0.0.1"))
+	envelopes, err = (&dns.Transfer{}).In(m, deniedAddr)
+	assert.NoError(t, err)
+	for envelope := range envelopes {
+		assert.Error(t, envelope.Error)
+	}
+}
+
+func TestDNSSerial(t *testing.T) {
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+	dnsServer, _ := startDNS(t, kdns.WithDomains([]string{"enkit."}))
+
+	serial := dnsServer.Serial()
+	records := []dns.RR{mustRR(t, "host.enkit. 60 A 10.0.0.1"), mustRR(t, "host.enkit. 60 A 10.0.0.2")}
+	dnsServer.SetEntry("host.enkit", records)
+	assert.Equal(t, serial+1, dnsServer.Serial())
+
+	// Setting the same records, even in a different order, changes nothing.
+	dnsServer.SetEntry("host.enkit", []dns.RR{records[1], records[0]})
+	dnsServer.ReplaceEntry("host.enkit", dns.TypeA, records)
+	dnsServer.ReplaceEntry("host.enkit", dns.TypeTXT, nil)
+	dnsServer.RemoveFromEntry("host.enkit", []string{"10.0.0.3"}, dns.TypeA)
+	assert.Equal(t, serial+1, dnsServer.Serial())
+
+	dnsServer.RemoveFromEntry("host.enkit", []string{"10.0.0.2"}, dns.TypeA)
+	assert.Equal(t, serial+2, dnsServer.Serial())
+	dnsServer.AddEntry("host.enkit", mustRR(t, "host.enkit. 60 TXT hello"))
+	assert.Equal(t, serial+3, dnsServer.Serial())
+	dnsServer.ReplaceEntry("host.enkit", dns.TypeTXT, nil)
+	assert.Equal(t, serial+4, dnsServer.Serial())
+}
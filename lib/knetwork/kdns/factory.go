@@ -1,9 +1,12 @@
 package kdns
 
 import (
+	"fmt"
 	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/miekg/dns"
 	"log"
 	"net"
+	"time"
 )
 
 func NewDNS(mods ...DNSModifier) (*DnsServer, error) {
@@ -19,7 +22,14 @@ func NewDNS(mods ...DNSModifier) (*DnsServer, error) {
 		Logger:          &logger.DefaultLogger{Printer: log.Printf},
 		shutdown:        make(chan bool, 1),
 		shutdownSuccess: make(chan bool, 1),
+		listChan:        make(chan chan map[string]*RecordController),
 		Flags:           &Flags{},
+		TTL:             DefaultTTL,
+		ForwardTimeout:  DefaultForwardTimeout,
+	}
+	s.serial.Store(uint32(time.Now().Unix()))
+	if err := WithForwardAllowed(DefaultForwardAllowed)(s); err != nil {
+		return nil, err
 	}
 	for _, mod := range mods {
 		if err := mod(s); err != nil {
@@ -71,3 +81,107 @@ func WithHost(ip string) DNSModifier {
 		return nil
 	}
 }
+
+// WithTTL sets the TTL of records added without one, see DnsServer.TTL.
+func WithTTL(ttl uint32) DNSModifier {
+	return func(s *DnsServer) error {
+		s.TTL = ttl
+		return nil
+	}
+}
+
+// WithNameserver sets the name of the nameserver advertised in the SOA and NS records of the zones.
+func WithNameserver(name string) DNSModifier {
+	return func(s *DnsServer) error {
+		s.Nameserver = ""
+		if name != "" {
+			s.Nameserver = dns.Fqdn(name)
+		}
+		return nil
+	}
+}
+
+// WithForwarders configures the upstream resolvers queries outside of the served domains are forwarded to.
+//
+// Resolvers are specified as host or host:port, the port defaults to 53. They are tried in order.
+func WithForwarders(resolvers []string) DNSModifier {
+	return func(s *DnsServer) error {
+		s.Forwarders = nil
+		for _, resolver := range resolvers {
+			if _, _, err := net.SplitHostPort(resolver); err != nil {
+				resolver = net.JoinHostPort(resolver, "53")
+			}
+			s.Forwarders = append(s.Forwarders, resolver)
+		}
+		return nil
+	}
+}
+
+// WithForwardTimeout sets how long to wait for each upstream resolver.
+func WithForwardTimeout(timeout time.Duration) DNSModifier {
+	return func(s *DnsServer) error {
+		s.ForwardTimeout = timeout
+		return nil
+	}
+}
+
+// WithForwardAllowed allows the networks specified in CIDR notation to have their
+// queries forwarded to the resolvers configured with WithForwarders.
+//
+// It replaces the default, DefaultForwardAllowed. Queries that would be forwarded
+// from other networks are refused.
+func WithForwardAllowed(cidrs []string) DNSModifier {
+	return func(s *DnsServer) error {
+		s.ForwardAllowed = nil
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid network allowed to forward queries %q: %w", cidr, err)
+			}
+			s.ForwardAllowed = append(s.ForwardAllowed, network)
+		}
+		return nil
+	}
+}
+
+// WithTransferAllowed allows the networks specified in CIDR notation to request a
+// zone transfer (AXFR) of the served domains, to configure secondary DNS servers.
+//
+// By default, zone transfers are refused.
+func WithTransferAllowed(cidrs []string) DNSModifier {
+	return func(s *DnsServer) error {
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid network allowed to transfer zones %q: %w", cidr, err)
+			}
+			s.TransferAllowed = append(s.TransferAllowed, network)
+		}
+		return nil
+	}
+}
+
+// WithUpdateKeys configures the TSIG keys allowed to change records with DNS UPDATE messages.
+//
+// By default, no key is configured, and all updates are refused.
+func WithUpdateKeys(keys ...UpdateKey) DNSModifier {
+	return func(s *DnsServer) error {
+		for _, key := range keys {
+			key.Name = dns.CanonicalName(key.Name)
+			if key.Algorithm == "" {
+				key.Algorithm = dns.HmacSHA256
+			}
+			key.Algorithm = dns.CanonicalName(key.Algorithm)
+			names := key.Names
+			key.Names = nil
+			for _, name := range names {
+				key.Names = append(key.Names, dns.CanonicalName(name))
+			}
+			if err := key.validate(); err != nil {
+				return err
+			}
+			s.UpdateKeys = append(s.UpdateKeys, key)
+		}
+		return nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/ccontavalli/enkit/lib/logger"
 	"github.com/miekg/dns"
+	"sort"
 	"strings"
 )
 
@@ -24,17 +25,23 @@ var (
 	Shutdown         RecordOp = 5
 )
 
+// SupportedTypes lists the types of records a RecordController can store.
+var SupportedTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypePTR, dns.TypeSRV, dns.TypeTXT}
+
 // RecordController is a controller that specifically controls a single domain. It handles adding, removing and editing
 // dns records in place and should never error out. All methods write errors to the controllers error channel, and operate on
 // a fire and forget methodology. I works like a running server, and to prevent leaks you must call Close.
 type RecordController struct {
 	Log logger.Logger
 
-	aRecords   chan []dns.RR
-	aRecordOps chan recordOperation
+	// One set per supported type, never modified after NewRecordController.
+	sets map[uint16]*recordSet
+}
 
-	txtRecords   chan []dns.RR
-	txtRecordOps chan recordOperation
+// recordSet holds the records of a single type, owned by a watch goroutine.
+type recordSet struct {
+	records chan []dns.RR
+	ops     chan recordOperation
 }
 
 type recordOperation struct {
@@ -42,12 +49,16 @@ type recordOperation struct {
 	Record   dns.RR
 	Records  []dns.RR
 	Keywords []string
+
+	// If not nil, receives true if the operation changed the records.
+	Changed chan bool
 }
 
 // start will spin up the controller and begin handling dns data requests. It is non blocking and is called on NewRecordController
 func (rc *RecordController) start() {
-	go rc.watchARecords()
-	go rc.watchTxtRecords()
+	for _, set := range rc.sets {
+		go set.watch()
+	}
 }
 
 func handleOperation(src []dns.RR, operation recordOperation) []dns.RR {
@@ -64,134 +75,175 @@ func handleOperation(src []dns.RR, operation recordOperation) []dns.RR {
 	return src
 }
 
-func (rc *RecordController) watchARecords() {
-	var aRecords []dns.RR
-	defer rc.Log.Warnf("exiting a records")
-	defer close(rc.aRecords)
-	defer close(rc.aRecordOps)
+func (set *recordSet) watch() {
+	var records []dns.RR
+	defer close(set.records)
+	defer close(set.ops)
 	for {
 		select {
-		case operation := <-rc.aRecordOps:
+		case operation := <-set.ops:
 			if operation.Type == Shutdown {
-				rc.Log.Warnf("shutting down A record server")
 				return
 			}
-			aRecords = handleOperation(aRecords, operation)
-		case rc.aRecords <- aRecords:
+			updated := handleOperation(records, operation)
+			if operation.Changed != nil {
+				operation.Changed <- !sameRecords(records, updated)
+			}
+			records = updated
+		case set.records <- records:
 		}
 	}
 }
 
-func (rc *RecordController) watchTxtRecords() {
-	var txtRecords []dns.RR
-	for {
-		select {
-		case operation := <-rc.txtRecordOps:
-			if operation.Type == Shutdown {
-				return
-			}
-			txtRecords = handleOperation(txtRecords, operation)
-		case rc.txtRecords <- txtRecords:
+// apply sends an operation to the set, and waits for it to be applied.
+//
+// Returns true if the records changed.
+func (set *recordSet) apply(operation recordOperation) bool {
+	operation.Changed = make(chan bool, 1)
+	set.ops <- operation
+	return <-operation.Changed
+}
+
+// sameRecords returns true if a and b contain the same records, in any order.
+func sameRecords(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := make([]string, 0, len(a))
+	bs := make([]string, 0, len(b))
+	for i := range a {
+		as = append(as, a[i].String())
+		bs = append(bs, b[i].String())
+	}
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
 		}
 	}
+	return true
 }
 
 // FetchRecords will return the []dns.RR of whatever records type is inputted. If the controller does not recognize the
 // record type, or if no records of that type exists, it will return an empty list. It takes in a dns.Type.
 func (rc *RecordController) FetchRecords(t uint16) []dns.RR {
-	switch t {
-	case dns.TypeA:
-		return <-rc.aRecords
-	case dns.TypeTXT:
-		return <-rc.txtRecords
-	default:
+	set := rc.sets[t]
+	if set == nil {
 		return []dns.RR{}
 	}
+	return <-set.records
+}
+
+// Records returns all the records stored in the controller, of any type.
+func (rc *RecordController) Records() []dns.RR {
+	var result []dns.RR
+	for _, t := range SupportedTypes {
+		result = append(result, rc.FetchRecords(t)...)
+	}
+	return result
+}
+
+// groupByType splits records by type, logging an error for unsupported types.
+func (rc *RecordController) groupByType(rrs []dns.RR) map[uint16][]dns.RR {
+	grouped := map[uint16][]dns.RR{}
+	for _, r := range rrs {
+		t := r.Header().Rrtype
+		if rc.sets[t] == nil {
+			rc.Log.Errorf("%s", fmt.Errorf("%w: kdns currently does not support record type %s: full record: %v",
+				UnSupportedTypeErr, r.Header().String(), r.String()))
+			continue
+		}
+		grouped[t] = append(grouped[t], r)
+	}
+	return grouped
 }
 
 // AddRecords will arbitrarily add records to the controller if they match the origin of the controller as well as if they
 // are of the currently support record type. If any errors occur, it will write to the general error channel
-func (rc *RecordController) AddRecords(rr []dns.RR) {
+//
+// Returns true if any record was added.
+func (rc *RecordController) AddRecords(rr []dns.RR) bool {
+	changed := false
 	for _, r := range rr {
-		switch r.Header().Rrtype {
-		case dns.TypeA:
-			rc.aRecordOps <- recordOperation{Type: RecordWrite, Record: r}
-		case dns.TypeTXT:
-			rc.txtRecordOps <- recordOperation{Type: RecordWrite, Record: r}
-		default:
+		set := rc.sets[r.Header().Rrtype]
+		if set == nil {
 			rc.Log.Errorf("%s", fmt.Errorf("kdns currently does not support record type %s: full record: %v",
 				r.Header().String(), r.String()))
+			continue
+		}
+		if set.apply(recordOperation{Type: RecordWrite, Record: r}) {
+			changed = true
 		}
 	}
+	return changed
 }
 
 // SetRecords will hard replace records of type recordType in controller.
 // are of the currently support record type. If any errors occur, it will write to the general error channel
-func (rc *RecordController) SetRecords(rr []dns.RR) {
-	var txtRecords []dns.RR
-	var aRecords []dns.RR
-	for _, r := range rr {
-		switch r.Header().Rrtype {
-		case dns.TypeA:
-			aRecords = append(aRecords, r)
-		case dns.TypeTXT:
-			txtRecords = append(txtRecords, r)
-		default:
-			rc.Log.Errorf("%s", fmt.Errorf("kdns currently does not support record type %s: full record: %v", r.Header().String(), r.String()))
+//
+// Only the types of records supplied are replaced, records of other types are left untouched.
+// Returns true if the records changed.
+func (rc *RecordController) SetRecords(rr []dns.RR) bool {
+	changed := false
+	for t, records := range rc.groupByType(rr) {
+		if rc.sets[t].apply(recordOperation{Type: RecordWriteForce, Records: records}) {
+			changed = true
 		}
 	}
-	if len(txtRecords) != 0 {
-		rc.txtRecordOps <- recordOperation{Type: RecordWriteForce, Records: txtRecords}
-	}
-	if len(aRecords) != 0 {
-		rc.aRecordOps <- recordOperation{Type: RecordWriteForce, Records: aRecords}
+	return changed
+}
+
+// ReplaceRecords replaces all the records of type t with the supplied ones.
+//
+// Unlike SetRecords, an empty list deletes all the records of the type.
+// Returns true if the records changed.
+func (rc *RecordController) ReplaceRecords(t uint16, rrs []dns.RR) bool {
+	set := rc.sets[t]
+	if set == nil {
+		rc.Log.Errorf("%s", fmt.Errorf("%w: %v", UnSupportedTypeErr, t))
+		return false
 	}
+	return set.apply(recordOperation{Type: RecordWriteForce, Records: rrs})
 }
 
 // EditRecords will replace records that match the keywords. if the supplied records also match
 // are of the currently support record type. If any errors occur, it will write to the general error channel
-func (rc *RecordController) EditRecords(rrs []dns.RR, keywords []string) {
-	var txtRecords []dns.RR
-	var aRecords []dns.RR
-	for _, r := range rrs {
-		switch r.Header().Rrtype {
-		case dns.TypeA:
-			aRecords = append(aRecords, r)
-		case dns.TypeTXT:
-			txtRecords = append(txtRecords, r)
-		default:
-			rc.Log.Errorf("%s", fmt.Errorf("%w: %v", UnSupportedTypeErr, r.Header().Rrtype))
+//
+// Returns true if the records changed.
+func (rc *RecordController) EditRecords(rrs []dns.RR, keywords []string) bool {
+	changed := false
+	for t, records := range rc.groupByType(rrs) {
+		if rc.sets[t].apply(recordOperation{Type: RecordEdit, Records: records, Keywords: keywords}) {
+			changed = true
 		}
 	}
-	if len(aRecords) != 0 {
-		rc.aRecordOps <- recordOperation{Type: RecordEdit, Records: aRecords, Keywords: keywords}
-	}
-	if len(txtRecords) != 0 {
-		rc.txtRecordOps <- recordOperation{Type: RecordEdit, Records: txtRecords, Keywords: keywords}
-	}
+	return changed
 }
 
 // DeleteRecords will delete records that match the keywords provided. Case sensitive/no processing is done
+// Returns true if any record was deleted.
 // TODO(adam): support regex?
-func (rc *RecordController) DeleteRecords(keywords []string, recordType uint16) {
-	switch recordType {
-	case dns.TypeA:
-		rc.aRecordOps <- recordOperation{Type: RecordDelete, Keywords: keywords}
-	case dns.TypeTXT:
-		rc.txtRecordOps <- recordOperation{Type: RecordDelete, Keywords: keywords}
-	default:
+func (rc *RecordController) DeleteRecords(keywords []string, recordType uint16) bool {
+	set := rc.sets[recordType]
+	if set == nil {
 		rc.Log.Errorf("%s", fmt.Errorf("%w: %v", UnSupportedTypeErr, recordType))
+		return false
 	}
+	return set.apply(recordOperation{Type: RecordDelete, Keywords: keywords})
 }
 
 // NewRecordController create a new controller for a specified origin, or basename;
 func NewRecordController(l logger.Logger) *RecordController {
 	rc := &RecordController{
-		aRecordOps:   make(chan recordOperation),
-		aRecords:     make(chan []dns.RR),
-		txtRecordOps: make(chan recordOperation),
-		txtRecords:   make(chan []dns.RR),
-		Log:          l,
+		sets: map[uint16]*recordSet{},
+		Log:  l,
+	}
+	for _, t := range SupportedTypes {
+		rc.sets[t] = &recordSet{
+			ops:     make(chan recordOperation),
+			records: make(chan []dns.RR),
+		}
 	}
 	rc.start()
 	return rc
@@ -215,6 +267,7 @@ func DeleteIfContains(keywords []string, src []dns.RR) []dns.RR {
 }
 
 func (rc RecordController) Close() {
-	rc.aRecordOps <- recordOperation{Type: Shutdown}
-	rc.txtRecordOps <- recordOperation{Type: Shutdown}
+	for _, set := range rc.sets {
+		set.ops <- recordOperation{Type: Shutdown}
+	}
 }
@@ -72,12 +72,12 @@ func TestController(t *testing.T) {
 	assert.Equal(t, 4, len(aRecords))
 
 	// Test delete multiple
-	controller.DeleteRecords([]string{"aiur", "swarm"}, dns.TypeTXT)
+	assert.True(t, controller.DeleteRecords([]string{"aiur", "swarm"}, dns.TypeTXT))
 	txtRecords = controller.FetchRecords(dns.TypeTXT)
 	assert.Equal(t, 2, len(txtRecords))
 
 	// Test NoOp
-	controller.DeleteRecords([]string{"aiur", "swarm"}, dns.TypeA)
+	assert.False(t, controller.DeleteRecords([]string{"aiur", "swarm"}, dns.TypeA))
 	aRecords = controller.FetchRecords(dns.TypeA)
 	assert.Equal(t, 4, len(aRecords))
 
@@ -107,3 +107,32 @@ func TestController(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	controller = nil
 }
+
+func TestControllerTypes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	controller := kdns.NewRecordController(logger.DefaultLogger{Printer: log.Printf})
+	defer controller.Close()
+
+	var rr []dns.RR
+	for _, record := range []string{
+		"example.com. AAAA fd00::1",
+		"example.com. CNAME other.example.com.",
+		"example.com. SRV 10 5 8080 host.example.com.",
+		"example.com. PTR host.example.com.",
+		"example.com. A 10.0.0.1",
+	} {
+		r, err := dns.NewRR(record)
+		assert.Nil(t, err)
+		rr = append(rr, r)
+	}
+	controller.SetRecords(rr)
+
+	for _, r := range rr {
+		assert.Equal(t, []dns.RR{r}, controller.FetchRecords(r.Header().Rrtype))
+	}
+	assert.Equal(t, []dns.RR{rr[4], rr[0], rr[1], rr[3], rr[2]}, controller.Records())
+
+	controller.DeleteRecords([]string{"8080"}, dns.TypeSRV)
+	assert.Empty(t, controller.FetchRecords(dns.TypeSRV))
+	assert.Len(t, controller.Records(), 4)
+}
@@ -0,0 +1,382 @@
+package kdns
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpdateKey is a TSIG key allowed to change records with DNS UPDATE messages (RFC 2136).
+type UpdateKey struct {
+	// Name of the key, as configured in the client. For example, with nsupdate, the name passed to -y.
+	Name string
+	// Algorithm of the key, one of the dns.Hmac* constants. Defaults to dns.HmacSHA256.
+	Algorithm string
+	// Secret shared with the clients, base64 encoded.
+	Secret string
+
+	// Names the key is allowed to change, including any name below them.
+	// If empty, the key can change any name in the served domains.
+	Names []string
+	// Types of records the key is allowed to change. If empty, any supported type.
+	Types []uint16
+}
+
+// ParseUpdateKey parses an UpdateKey in the format used on the command line:
+//
+//	[algorithm:]name:secret[:name,name,...[:type,type,...]]
+//
+// For example, "dhcp:c2VjcmV0:dhcp.enkit:A,AAAA,PTR" allows the key dhcp to only change
+// A, AAAA and PTR records of dhcp.enkit and the names below it.
+func ParseUpdateKey(value string) (UpdateKey, error) {
+	fields := strings.Split(value, ":")
+	key := UpdateKey{Algorithm: dns.HmacSHA256}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "hmac-") {
+		key.Algorithm = dns.Fqdn(fields[0])
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || len(fields) > 4 || fields[0] == "" || fields[1] == "" {
+		return UpdateKey{}, fmt.Errorf("invalid update key %q - must be in [algorithm:]name:secret[:names[:types]] format", value)
+	}
+	key.Name = dns.CanonicalName(fields[0])
+	key.Secret = fields[1]
+	if len(fields) > 2 && fields[2] != "" {
+		for _, name := range strings.Split(fields[2], ",") {
+			key.Names = append(key.Names, dns.CanonicalName(name))
+		}
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		for _, t := range strings.Split(fields[3], ",") {
+			rtype, found := dns.StringToType[strings.ToUpper(t)]
+			if !found {
+				return UpdateKey{}, fmt.Errorf("invalid update key %q - unknown record type %s", value, t)
+			}
+			key.Types = append(key.Types, rtype)
+		}
+	}
+	return key, key.validate()
+}
+
+func (k UpdateKey) validate() error {
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+		return fmt.Errorf("invalid secret for update key %s - must be base64 encoded: %w", k.Name, err)
+	}
+	switch k.Algorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return fmt.Errorf("invalid algorithm for update key %s - %s is not supported", k.Name, k.Algorithm)
+	}
+	return nil
+}
+
+// Allows returns true if the key is allowed to change records of type rtype for name.
+//
+// A type of dns.TypeANY is only allowed to keys that can change all types.
+func (k UpdateKey) Allows(name string, rtype uint16) bool {
+	name = dns.CanonicalName(name)
+	allowed := len(k.Names) == 0
+	for _, pattern := range k.Names {
+		if dns.IsSubDomain(pattern, name) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	if len(k.Types) == 0 {
+		return true
+	}
+	for _, t := range k.Types {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// tsigSecrets returns the secrets of the update keys, in the format expected by dns.Server.
+func (s *DnsServer) tsigSecrets() map[string]string {
+	if len(s.UpdateKeys) == 0 {
+		return nil
+	}
+	secrets := map[string]string{}
+	for _, key := range s.UpdateKeys {
+		secrets[key.Name] = key.Secret
+	}
+	return secrets
+}
+
+// acceptUpdates is a dns.MsgAcceptFunc also accepting DNS UPDATE messages, which
+// are rejected by dns.DefaultMsgAcceptFunc.
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+	opcode := int(dh.Bits>>11) & 0xF
+	// Bit 15 is the QR bit, set in responses.
+	if opcode == dns.OpcodeUpdate && dh.Bits&(1<<15) == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// msgAcceptFunc returns the dns.MsgAcceptFunc to use, accepting updates only if keys are configured.
+func (s *DnsServer) msgAcceptFunc() dns.MsgAcceptFunc {
+	if len(s.UpdateKeys) == 0 {
+		return dns.DefaultMsgAcceptFunc
+	}
+	return acceptUpdates
+}
+
+func (s *DnsServer) updateKey(name string) *UpdateKey {
+	for i, key := range s.UpdateKeys {
+		if key.Name == dns.CanonicalName(name) {
+			return &s.UpdateKeys[i]
+		}
+	}
+	return nil
+}
+
+// HandleUpdate processes a DNS UPDATE message, as defined in RFC 2136.
+//
+// Updates must be signed with one of the configured UpdateKeys, and can only change
+// names and types of records the key is allowed to. Updates are serialized: the
+// prerequisites are checked and all the changes are applied before the next update
+// is processed.
+func (s *DnsServer) HandleUpdate(writer dns.ResponseWriter, incoming *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetRcode(incoming, s.update(writer, incoming))
+
+	// Sign the response if the request was signed with a valid key.
+	if tsig := incoming.IsTsig(); tsig != nil && writer.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	if err := writer.WriteMsg(m); err != nil {
+		s.Logger.Errorf("%s", err)
+	}
+}
+
+func (s *DnsServer) update(writer dns.ResponseWriter, incoming *dns.Msg) int {
+	tsig := incoming.IsTsig()
+	if tsig == nil {
+		s.Logger.Warnf("refusing unsigned dns update from %s", writer.RemoteAddr())
+		return dns.RcodeRefused
+	}
+	key := s.updateKey(tsig.Hdr.Name)
+	if key == nil || writer.TsigStatus() != nil || dns.CanonicalName(tsig.Algorithm) != key.Algorithm {
+		s.Logger.Warnf("refusing dns update from %s - invalid signature with key %s: %v", writer.RemoteAddr(), tsig.Hdr.Name, writer.TsigStatus())
+		return dns.RcodeNotAuth
+	}
+
+	if len(incoming.Question) != 1 || incoming.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := dns.CanonicalName(incoming.Question[0].Name)
+	if s.Zone(zone) != zone {
+		return dns.RcodeNotAuth
+	}
+
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+
+	if rcode := s.checkPrerequisites(zone, incoming.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := s.checkUpdates(zone, key, incoming.Ns); rcode != dns.RcodeSuccess {
+		s.Logger.Warnf("refusing dns update from %s with key %s - %s", writer.RemoteAddr(), key.Name, dns.RcodeToString[rcode])
+		return rcode
+	}
+	changed := false
+	for _, rr := range incoming.Ns {
+		if s.applyUpdate(rr) {
+			changed = true
+		}
+	}
+	if changed {
+		s.serial.Add(1)
+	}
+	s.Logger.Infof("applied %d dns updates to %s from %s with key %s", len(incoming.Ns), zone, writer.RemoteAddr(), key.Name)
+	return dns.RcodeSuccess
+}
+
+// rrset returns the records of type rtype for name.
+func (s *DnsServer) rrset(name string, rtype uint16) []dns.RR {
+	c := s.ControllerForName(name)
+	if c == nil {
+		return nil
+	}
+	if rtype == dns.TypeANY {
+		return c.Records()
+	}
+	return c.FetchRecords(rtype)
+}
+
+// checkPrerequisites verifies the prerequisites of an update, as per section 3.2 of RFC 2136.
+func (s *DnsServer) checkPrerequisites(zone string, prerequisites []dns.RR) int {
+	// Value dependent prerequisites: the RRset must match exactly, see 3.2.3.
+	expected := map[string][]dns.RR{}
+	for _, rr := range prerequisites {
+		header := rr.Header()
+		if s.Zone(header.Name) != zone {
+			return dns.RcodeNotZone
+		}
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+
+		existing := s.rrset(header.Name, header.Rrtype)
+		switch header.Class {
+		case dns.ClassANY:
+			if len(existing) == 0 {
+				if header.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if len(existing) != 0 {
+				if header.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			id := dns.CanonicalName(header.Name) + "/" + dns.TypeToString[header.Rrtype]
+			expected[id] = append(expected[id], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rrs := range expected {
+		if !sameRRset(rrs, s.rrset(rrs[0].Header().Name, rrs[0].Header().Rrtype)) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// sameRRset returns true if the two sets contain the same records, ignoring TTLs.
+func sameRRset(a, b []dns.RR) bool {
+	contains := func(set []dns.RR, rr dns.RR) bool {
+		for _, candidate := range set {
+			if dns.IsDuplicate(candidate, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUpdates verifies that the updates are well formed, and allowed by the key.
+func (s *DnsServer) checkUpdates(zone string, key *UpdateKey, updates []dns.RR) int {
+	for _, rr := range updates {
+		header := rr.Header()
+		if s.Zone(header.Name) != zone {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			if !isSupported(header.Rrtype) {
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if header.Rrtype != dns.TypeANY && !isSupported(header.Rrtype) {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+
+		if !key.Allows(header.Name, header.Rrtype) {
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func isSupported(rtype uint16) bool {
+	for _, t := range SupportedTypes {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUpdate applies a single update checked with checkUpdates, see section 3.4.2 of RFC 2136.
+//
+// Returns true if the records changed.
+func (s *DnsServer) applyUpdate(rr dns.RR) bool {
+	header := rr.Header()
+	name := dns.CanonicalName(header.Name)
+
+	switch header.Class {
+	case dns.ClassINET:
+		c := s.NewControllerForName(name)
+		existing := c.FetchRecords(header.Rrtype)
+		for _, candidate := range existing {
+			if dns.IsDuplicate(candidate, rr) {
+				return false
+			}
+		}
+		added := s.withTTL([]dns.RR{rr})
+		// A name can only have one CNAME record, a new one replaces the existing one.
+		if header.Rrtype == dns.TypeCNAME {
+			return c.ReplaceRecords(dns.TypeCNAME, added)
+		}
+		return c.AddRecords(added)
+
+	case dns.ClassANY:
+		c := s.ControllerForName(name)
+		if c == nil {
+			return false
+		}
+		types := []uint16{header.Rrtype}
+		if header.Rrtype == dns.TypeANY {
+			types = SupportedTypes
+		}
+		changed := false
+		for _, t := range types {
+			if c.ReplaceRecords(t, nil) {
+				changed = true
+			}
+		}
+		return changed
+
+	case dns.ClassNONE:
+		c := s.ControllerForName(name)
+		if c == nil {
+			return false
+		}
+		// The record to delete carries class NONE, compare it as if it was IN.
+		target := dns.Copy(rr)
+		target.Header().Class = dns.ClassINET
+
+		var kept []dns.RR
+		for _, candidate := range c.FetchRecords(header.Rrtype) {
+			if !dns.IsDuplicate(candidate, target) {
+				kept = append(kept, candidate)
+			}
+		}
+		return c.ReplaceRecords(header.Rrtype, kept)
+	}
+	return false
+}
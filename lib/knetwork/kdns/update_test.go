@@ -0,0 +1,129 @@
+package kdns_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/knetwork/kdns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+const (
+	adminSecret = "YWRtaW4tc2VjcmV0"
+	dhcpSecret  = "ZGhjcC1zZWNyZXQ="
+)
+
+// update sends a dns update for zone signed with key, returning the rcode of the response.
+func update(t *testing.T, addr, key, secret string, fill func(m *dns.Msg)) int {
+	t.Helper()
+	m := &dns.Msg{}
+	m.SetUpdate("enkit.")
+	fill(m)
+	if key != "" {
+		m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{key: secret}}
+	response, _, err := client.Exchange(m, addr)
+	assert.NoError(t, err)
+	if response == nil {
+		return -1
+	}
+	if key != "" && response.Rcode == dns.RcodeSuccess {
+		assert.NotNil(t, response.IsTsig())
+	}
+	return response.Rcode
+}
+
+func TestParseUpdateKey(t *testing.T) {
+	key, err := kdns.ParseUpdateKey("dhcp:" + dhcpSecret + ":dhcp.enkit:A,aaaa")
+	assert.NoError(t, err)
+	assert.Equal(t, kdns.UpdateKey{
+		Name:      "dhcp.",
+		Algorithm: dns.HmacSHA256,
+		Secret:    dhcpSecret,
+		Names:     []string{"dhcp.enkit."},
+		Types:     []uint16{dns.TypeA, dns.TypeAAAA},
+	}, key)
+
+	key, err = kdns.ParseUpdateKey("hmac-sha512:admin:" + adminSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.HmacSHA512, key.Algorithm)
+	assert.True(t, key.Allows("anything.enkit", dns.TypeANY))
+
+	for _, invalid := range []string{"admin", "admin:", "admin:not-base64!", "hmac-md4:admin:" + adminSecret, "admin:" + adminSecret + ":x:BOGUS"} {
+		_, err = kdns.ParseUpdateKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDNSUpdate(t *testing.T) {
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+	dhcp, err := kdns.ParseUpdateKey("dhcp:" + dhcpSecret + ":dhcp.enkit:A")
+	assert.NoError(t, err)
+	dnsServer, addr := startDNS(t, kdns.WithDomains([]string{"enkit."}),
+		kdns.WithUpdateKeys(kdns.UpdateKey{Name: "admin", Secret: adminSecret}, dhcp))
+	serial := dnsServer.Serial()
+
+	// Unsigned, or badly signed updates are refused.
+	insert := func(m *dns.Msg) { m.Insert([]dns.RR{mustRR(t, "host.enkit. 60 A 10.0.0.1")}) }
+	assert.Equal(t, dns.RcodeRefused, update(t, addr, "", "", insert))
+	assert.Equal(t, dns.RcodeNotAuth, update(t, addr, "admin.", dhcpSecret, insert))
+	assert.Equal(t, dns.RcodeNotAuth, update(t, addr, "unknown.", adminSecret, insert))
+	assert.Equal(t, dns.RcodeNameError, query(t, addr, "host.enkit", dns.TypeA).Rcode)
+	assert.Equal(t, serial, dnsServer.Serial())
+
+	assert.Equal(t, dns.RcodeSuccess, update(t, addr, "admin.", adminSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{
+			mustRR(t, "host.enkit. 60 A 10.0.0.1"),
+			mustRR(t, "host.enkit. 0 AAAA fd00::1"),
+			mustRR(t, "host.enkit. 60 TXT one"),
+			mustRR(t, "host.enkit. 60 TXT two"),
+		})
+	}))
+	assert.NotEqual(t, serial, dnsServer.Serial())
+	assertRecords(t, []string{"host.enkit. 60 A 10.0.0.1"}, query(t, addr, "host.enkit", dns.TypeA).Answer)
+	assertRecords(t, []string{"host.enkit. 300 AAAA fd00::1"}, query(t, addr, "host.enkit", dns.TypeAAAA).Answer)
+
+	// Prerequisites are checked before applying any change.
+	assert.Equal(t, dns.RcodeYXDomain, update(t, addr, "admin.", adminSecret, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{mustRR(t, "host.enkit. A 10.0.0.1")})
+		m.RemoveName([]dns.RR{mustRR(t, "host.enkit. A 10.0.0.1")})
+	}))
+	assert.Equal(t, dns.RcodeNXRrset, update(t, addr, "admin.", adminSecret, func(m *dns.Msg) {
+		m.Used([]dns.RR{mustRR(t, "host.enkit. A 10.0.0.2")})
+		m.RemoveName([]dns.RR{mustRR(t, "host.enkit. A 10.0.0.1")})
+	}))
+	assert.Equal(t, dns.RcodeSuccess, update(t, addr, "admin.", adminSecret, func(m *dns.Msg) {
+		m.Used([]dns.RR{mustRR(t, "host.enkit. A 10.0.0.1")})
+		m.RRsetUsed([]dns.RR{mustRR(t, "host.enkit. TXT x")})
+		m.Remove([]dns.RR{mustRR(t, "host.enkit. TXT one")})
+		m.RemoveRRset([]dns.RR{mustRR(t, "host.enkit. AAAA fd00::1")})
+	}))
+	assertRecords(t, []string{"host.enkit. 60 TXT two"}, query(t, addr, "host.enkit", dns.TypeTXT).Answer)
+	assert.Empty(t, query(t, addr, "host.enkit", dns.TypeAAAA).Answer)
+	assertRecords(t, []string{"host.enkit. 60 A 10.0.0.1"}, query(t, addr, "host.enkit", dns.TypeA).Answer)
+
+	// Keys can only change the names and types they are allowed to.
+	assert.Equal(t, dns.RcodeRefused, update(t, addr, "dhcp.", dhcpSecret, insert))
+	assert.Equal(t, dns.RcodeRefused, update(t, addr, "dhcp.", dhcpSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{mustRR(t, "laptop.dhcp.enkit. 60 TXT hello")})
+	}))
+	assert.Equal(t, dns.RcodeSuccess, update(t, addr, "dhcp.", dhcpSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{mustRR(t, "laptop.dhcp.enkit. 60 A 10.0.0.3")})
+	}))
+	assertRecords(t, []string{"3.0.0.10.in-addr.arpa. 60 PTR laptop.dhcp.enkit."}, query(t, addr, "3.0.0.10.in-addr.arpa", dns.TypePTR).Answer)
+
+	// Names outside the zone cannot be changed.
+	assert.Equal(t, dns.RcodeNotZone, update(t, addr, "admin.", adminSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{mustRR(t, "host.example.com. 60 A 10.0.0.1")})
+	}))
+
+	assert.Equal(t, dns.RcodeSuccess, update(t, addr, "admin.", adminSecret, func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{mustRR(t, "host.enkit. A 10.0.0.1")})
+	}))
+	response := query(t, addr, "host.enkit", dns.TypeA)
+	assert.Empty(t, response.Answer)
+}
@@ -0,0 +1,267 @@
+package kdns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	reverseZone4 = "in-addr.arpa."
+	reverseZone6 = "ip6.arpa."
+)
+
+// Zone returns the domain served by the server that name belongs to, or an
+// empty string if the name is outside of all the served domains.
+//
+// If domains are nested, the most specific one is returned.
+func (s *DnsServer) Zone(name string) string {
+	name = dns.CanonicalName(name)
+	zone := ""
+	for _, domain := range s.Domains {
+		domain = dns.CanonicalName(domain)
+		if dns.IsSubDomain(domain, name) && len(domain) > len(zone) {
+			zone = domain
+		}
+	}
+	return zone
+}
+
+// Serial returns the current serial number of the zones.
+func (s *DnsServer) Serial() uint32 {
+	return s.serial.Load()
+}
+
+func (s *DnsServer) nameserver(zone string) string {
+	if s.Nameserver != "" {
+		return s.Nameserver
+	}
+	return "ns." + zone
+}
+
+// SOA returns the start of authority record of a zone.
+func (s *DnsServer) SOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.TTL},
+		Ns:      s.nameserver(zone),
+		Mbox:    "hostmaster." + zone,
+		Serial:  s.Serial(),
+		Refresh: 300,
+		Retry:   60,
+		Expire:  7 * 24 * 3600,
+		Minttl:  s.TTL,
+	}
+}
+
+// NS returns the nameserver record of a zone.
+func (s *DnsServer) NS(zone string) *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: s.TTL},
+		Ns:  s.nameserver(zone),
+	}
+}
+
+// reverseToIP parses a name in the in-addr.arpa or ip6.arpa domains, returning
+// the corresponding address, or nil if the name does not identify an address.
+func reverseToIP(name string) net.IP {
+	name = dns.CanonicalName(name)
+	switch {
+	case strings.HasSuffix(name, "."+reverseZone4):
+		labels := strings.Split(strings.TrimSuffix(name, "."+reverseZone4), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+
+	case strings.HasSuffix(name, "."+reverseZone6):
+		labels := strings.Split(strings.TrimSuffix(name, "."+reverseZone6), ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			b.WriteString(labels[i])
+			if i%4 == 0 && i != 0 {
+				b.WriteString(":")
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// ReverseLookup answers a PTR query for name with the names of all the A and AAAA
+// records pointing to the address, implementing the reverse zones automatically.
+//
+// Names with a label starting with _, like the _all records generated by machinist,
+// are not considered.
+func (s *DnsServer) ReverseLookup(name string) []dns.RR {
+	ip := reverseToIP(name)
+	if ip == nil {
+		return nil
+	}
+
+	var result []dns.RR
+	for target, c := range s.Controllers() {
+		if strings.HasPrefix(target, "_") || strings.Contains(target, "._") {
+			continue
+		}
+		for _, rr := range append(c.FetchRecords(dns.TypeA), c.FetchRecords(dns.TypeAAAA)...) {
+			var addr net.IP
+			switch r := rr.(type) {
+			case *dns.A:
+				addr = r.A
+			case *dns.AAAA:
+				addr = r.AAAA
+			}
+			if !addr.Equal(ip) {
+				continue
+			}
+			result = append(result, &dns.PTR{
+				Hdr: dns.RR_Header{Name: dns.CanonicalName(name), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+				Ptr: target,
+			})
+			break
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].(*dns.PTR).Ptr < result[j].(*dns.PTR).Ptr
+	})
+	return result
+}
+
+// ZoneRecords returns all the records of a zone, sorted by name, starting with its SOA and NS records.
+func (s *DnsServer) ZoneRecords(zone string) []dns.RR {
+	zone = dns.CanonicalName(zone)
+	var names []string
+	controllers := s.Controllers()
+	for name := range controllers {
+		if s.Zone(name) == zone {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := []dns.RR{s.SOA(zone), s.NS(zone)}
+	for _, name := range names {
+		result = append(result, controllers[name].Records()...)
+	}
+	return result
+}
+
+// transferChunk is the maximum number of records sent in a single message of a zone transfer.
+const transferChunk = 100
+
+// transferAllowed returns true if the client is allowed to request zone transfers.
+func (s *DnsServer) transferAllowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range s.TransferAllowed {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleTransfer answers an AXFR request, allowing secondary DNS servers to mirror the served domains.
+//
+// Transfers are only allowed over TCP, from the networks configured with WithTransferAllowed.
+func (s *DnsServer) HandleTransfer(writer dns.ResponseWriter, incoming *dns.Msg) {
+	zone := dns.CanonicalName(incoming.Question[0].Name)
+	if s.Zone(zone) != zone || !s.transferAllowed(writer.RemoteAddr()) {
+		s.Logger.Warnf("refusing zone transfer of %s to %s", zone, writer.RemoteAddr())
+		m := &dns.Msg{}
+		m.SetRcode(incoming, dns.RcodeRefused)
+		if err := writer.WriteMsg(m); err != nil {
+			s.Logger.Errorf("%s", err)
+		}
+		return
+	}
+
+	records := s.ZoneRecords(zone)
+	records = append(records, records[0])
+
+	ch := make(chan *dns.Envelope)
+	tr := &dns.Transfer{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := tr.Out(writer, incoming, ch); err != nil {
+			s.Logger.Errorf("zone transfer of %s to %s failed: %s", zone, writer.RemoteAddr(), err)
+		}
+	}()
+	for len(records) > 0 {
+		chunk := records
+		if len(chunk) > transferChunk {
+			chunk = chunk[:transferChunk]
+		}
+		records = records[len(chunk):]
+		ch <- &dns.Envelope{RR: chunk}
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// forwardAllowed returns true if the client is allowed to have its queries forwarded.
+func (s *DnsServer) forwardAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, network := range s.ForwardAllowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward sends the query to the upstream resolvers configured with WithForwarders,
+// in order, and relays the first answer received.
+//
+// Queries from clients outside the networks configured with WithForwardAllowed are refused.
+func (s *DnsServer) Forward(writer dns.ResponseWriter, incoming *dns.Msg) {
+	if !s.forwardAllowed(writer.RemoteAddr()) {
+		s.Logger.Debugf("refusing to forward query for %v from %s", incoming.Question, writer.RemoteAddr())
+		m := &dns.Msg{}
+		m.SetRcode(incoming, dns.RcodeRefused)
+		if err := writer.WriteMsg(m); err != nil {
+			s.Logger.Errorf("%s", err)
+		}
+		return
+	}
+
+	client := &dns.Client{Net: writer.LocalAddr().Network(), Timeout: s.ForwardTimeout}
+	for _, upstream := range s.Forwarders {
+		response, _, err := client.Exchange(incoming, upstream)
+		if err != nil {
+			s.Logger.Warnf("forwarding query for %v to %s failed: %s", incoming.Question, upstream, err)
+			continue
+		}
+		if err := writer.WriteMsg(response); err != nil {
+			s.Logger.Errorf("%s", err)
+		}
+		return
+	}
+
+	m := &dns.Msg{}
+	m.SetRcode(incoming, dns.RcodeServerFailure)
+	if err := writer.WriteMsg(m); err != nil {
+		s.Logger.Errorf("%s", err)
+	}
+}
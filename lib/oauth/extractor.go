@@ -93,13 +93,17 @@ func (a *Extractor) EncodeCredentials(creds CredentialsCookie) (string, error) {
 
 // GetCredentialsFromRequest will parse and validate the credentials in an http request.
 //
+// Credentials are normally supplied in a cookie. Clients that cannot send cookies,
+// like git or docker configured with enkit_credential_helper, can supply the same
+// token as the password of basic authentication, or as a bearer token.
+//
 // If successful, it will return a CredentialsCookie pointer and the string content of the cookie.
 // If no credentials, or invalid credentials, an error is returned with nil credentials and no cookie.
 func (a *Extractor) GetCredentialsFromRequest(r *http.Request) (*CredentialsCookie, string, error) {
 	cookie, err := r.Cookie(a.CredentialsCookieName())
 	if err != nil {
 		if errors.Is(err, http.ErrNoCookie) {
-			return nil, "", ErrorNotAuthenticated
+			return a.getCredentialsFromHeader(r)
 		}
 
 		return nil, "", err
@@ -115,6 +119,43 @@ func (a *Extractor) GetCredentialsFromRequest(r *http.Request) (*CredentialsCook
 	return credentials, cookie.Value, nil
 }
 
+// getCredentialsFromHeader parses the credentials in the Authorization header.
+//
+// The header may carry credentials for the backend rather than for the proxy,
+// so a value that does not parse is reported as no authentication at all.
+//
+// A header that does authenticate the request is removed from it, so the token
+// is not forwarded by proxies to the backend, which could then impersonate the user.
+func (a *Extractor) getCredentialsFromHeader(r *http.Request) (*CredentialsCookie, string, error) {
+	value, found := AuthorizationToken(r)
+	if !found {
+		return nil, "", ErrorNotAuthenticated
+	}
+
+	_, credentials, err := a.ParseCredentialsCookie(value)
+	if err != nil || credentials == nil {
+		return nil, "", ErrorNotAuthenticated
+	}
+	r.Header.Del("Authorization")
+	return credentials, value, nil
+}
+
+// AuthorizationToken returns the token in the Authorization header of the request.
+//
+// The token is either the password of basic authentication, or a bearer token.
+func AuthorizationToken(r *http.Request) (string, bool) {
+	if _, password, ok := r.BasicAuth(); ok && password != "" {
+		return password, true
+	}
+
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return auth[len(prefix):], true
+	}
+	return "", false
+}
+
 func (a *Extractor) PrepareCredentialsCookie(ad AuthData, co ...kcookie.Modifier) (AuthData, *http.Cookie, error) {
 	ccookie, err := a.EncodeCredentials(*ad.Creds)
 	if err != nil {
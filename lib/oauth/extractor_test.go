@@ -0,0 +1,105 @@
+package oauth
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ccontavalli/enkit/lib/srand"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsFromHeader(t *testing.T) {
+	ex, err := NewExtractor(WithRng(rand.New(srand.Source)), WithSigningExtractorFlags(DefaultSigningExtractorFlags()))
+	assert.NoError(t, err)
+
+	creds := CredentialsCookie{Identity: Identity{Id: "id", Username: "user", Organization: "example.com"}}
+	encoded, err := ex.EncodeCredentials(creds)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, _, err = ex.GetCredentialsFromRequest(req)
+	assert.ErrorIs(t, err, ErrorNotAuthenticated)
+
+	req.SetBasicAuth("git", encoded)
+	got, value, err := ex.GetCredentialsFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, encoded, value)
+	assert.Equal(t, "user", got.Identity.Username)
+	// The token must not be forwarded to backends.
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+encoded)
+	got, _, err = ex.GetCredentialsFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", got.Identity.Username)
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	// Credentials for the backend are not an error, just no credentials, and are kept.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("user", "backend-password")
+	_, _, err = ex.GetCredentialsFromRequest(req)
+	assert.ErrorIs(t, err, ErrorNotAuthenticated)
+	assert.NotEmpty(t, req.Header.Get("Authorization"))
+
+	// When the cookie authenticates the request, the header is left alone.
+	cookieReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	cookieReq.AddCookie(&http.Cookie{Name: ex.CredentialsCookieName(), Value: encoded})
+	cookieReq.SetBasicAuth("user", "backend-password")
+	_, _, err = ex.GetCredentialsFromRequest(cookieReq)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cookieReq.Header.Get("Authorization"))
+}
+
+func TestRedirectorChallenge(t *testing.T) {
+	ex, err := NewExtractor(WithRng(rand.New(srand.Source)), WithSigningExtractorFlags(DefaultSigningExtractorFlags()))
+	assert.NoError(t, err)
+	authURL, err := url.Parse("https://auth.example.com/")
+	assert.NoError(t, err)
+	redirector := &Redirector{Extractor: ex, AuthURL: authURL}
+
+	target, _ := url.Parse("https://git.example.com/repo")
+
+	req := httptest.NewRequest(http.MethodGet, "/repo", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w := httptest.NewRecorder()
+	creds, err := redirector.Authenticate(w, req, target)
+	assert.NoError(t, err)
+	assert.Nil(t, creds)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	// Clients known to supply credentials when challenged get a 401, other
+	// clients the redirect, unless the challenge is enabled for all of them.
+	for _, tc := range []struct {
+		agent, authorization string
+		challenge            bool
+		expected             int
+	}{
+		{agent: "git/2.43.0", expected: http.StatusUnauthorized},
+		{agent: "docker/24.0.7 go/go1.20.10", expected: http.StatusUnauthorized},
+		{agent: "curl/8.5.0", authorization: "Basic dXNlcjpwYXNz", expected: http.StatusUnauthorized},
+		{agent: "curl/8.5.0", expected: http.StatusTemporaryRedirect},
+		{agent: "python-requests/2.31.0", expected: http.StatusTemporaryRedirect},
+		{agent: "curl/8.5.0", challenge: true, expected: http.StatusUnauthorized},
+	} {
+		redirector.BasicChallenge = tc.challenge
+		req = httptest.NewRequest(http.MethodGet, "/repo", nil)
+		req.Header.Set("User-Agent", tc.agent)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		w = httptest.NewRecorder()
+		creds, err = redirector.Authenticate(w, req, target)
+		assert.NoError(t, err)
+		assert.Nil(t, creds)
+		assert.Equal(t, tc.expected, w.Code, "%+v", tc)
+		if tc.expected == http.StatusUnauthorized {
+			assert.Equal(t, `Basic realm="enkit"`, w.Header().Get("WWW-Authenticate"))
+		} else {
+			assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -85,7 +85,8 @@ func DefaultSigningExtractorFlags() *SigningExtractorFlags {
 
 type RedirectorFlags struct {
 	*ExtractorFlags
-	AuthURL string
+	AuthURL        string
+	BasicChallenge bool
 }
 
 func DefaultRedirectorFlags() *RedirectorFlags {
@@ -97,6 +98,9 @@ func DefaultRedirectorFlags() *RedirectorFlags {
 func (rf *RedirectorFlags) Register(set kflags.FlagSet, prefix string) *RedirectorFlags {
 	rf.ExtractorFlags.Register(set, prefix)
 	set.StringVar(&rf.AuthURL, prefix+"auth-url", rf.AuthURL, "Where to redirect users for authentication.")
+	set.BoolVar(&rf.BasicChallenge, prefix+"basic-challenge", rf.BasicChallenge,
+		"Reply with a basic authentication challenge instead of a redirect to any client not asking for html. "+
+			"By default, only git and docker clients, or clients supplying an Authorization header, are challenged.")
 	return rf
 }
 
@@ -186,6 +190,15 @@ func WithAuthURL(url *url.URL) Modifier {
 	}
 }
 
+// WithBasicChallenge challenges any client not asking for html with basic authentication, rather than
+// just git, docker, or clients supplying an Authorization header. Only used by the Redirector.
+func WithBasicChallenge(challenge bool) Modifier {
+	return func(opt *Options) error {
+		opt.basicChallenge = challenge
+		return nil
+	}
+}
+
 func WithTargetURL(url string) Modifier {
 	return func(opt *Options) error {
 		opt.conf.RedirectURL = url
@@ -335,6 +348,7 @@ func WithRedirectorFlags(fl *RedirectorFlags) Modifier {
 		}
 
 		WithAuthURL(u)(o)
+		WithBasicChallenge(fl.BasicChallenge)(o)
 		return WithExtractorFlags(fl.ExtractorFlags)(o)
 	}
 }
@@ -509,6 +523,8 @@ type Options struct {
 	baseCookie string
 	authURL    *url.URL // Only used by the Redirector.
 
+	basicChallenge bool // Only used by the Redirector.
+
 	symmetricSetters []token.SymmetricSetter
 	signingSetters   []token.SigningSetter
 
@@ -626,9 +642,10 @@ func (opt *Options) NewRedirector() (*Redirector, error) {
 	}
 
 	return &Redirector{
-		Extractor:     extractor,
-		AuthURL:       opt.authURL,
-		DefaultTarget: defaultTarget,
+		Extractor:      extractor,
+		AuthURL:        opt.authURL,
+		DefaultTarget:  defaultTarget,
+		BasicChallenge: opt.basicChallenge,
 	}, nil
 }
 
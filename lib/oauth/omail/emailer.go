@@ -6,8 +6,11 @@ import (
 	"math/rand"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ccontavalli/enkit/lib/config"
+	"github.com/ccontavalli/enkit/lib/config/factory"
 	"github.com/ccontavalli/enkit/lib/kemail"
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/lib/logger"
@@ -22,6 +25,11 @@ type Emailer struct {
 	mailer        *kemail.TransactionalEmailer
 	tokenLifetime time.Duration
 	callbackURL   *url.URL
+
+	// If not nil, login emails are queued here rather than sent directly.
+	queue *kemail.Queue
+	// Stops the delivery of the queued emails, if started.
+	stopQueue func()
 }
 
 // EmailTokenPayload is the data encoded in the secure email token.
@@ -36,6 +44,10 @@ type emailerOptions struct {
 	rng             *rand.Rand
 	log             logger.Logger
 	Dialer          kemail.Dialer
+	Queue           *kemail.Queue
+	QueueStore      config.Store
+	QueueFlags      *kemail.QueueFlags
+	ProcessQueue    bool
 	SmtpHost        string
 	SmtpPort        int
 	SmtpUser        string
@@ -70,6 +82,17 @@ type EmailerFlags struct {
 	FromAddress   string
 	TokenLifetime time.Duration
 	SymmetricKey  []byte
+
+	// Queue stores the login emails in a persistent queue before sending them,
+	// so they are retried and not lost if the process restarts.
+	Queue          bool
+	QueueStore     *factory.Flags
+	QueueApp       string
+	QueueNamespace string
+	QueueFlags     *kemail.QueueFlags
+	// QueueProcess delivers the queued emails from this process. If false,
+	// they must be delivered by 'enkit email process'.
+	QueueProcess bool
 }
 
 const kDefaultTemplateSubject = "Your login link"
@@ -108,6 +131,12 @@ func EmailerDefaultFlags() *EmailerFlags {
 		DialerFlags:   *kemail.DefaultDialerFlags(),
 		TemplateFlags: kemail.TemplateFlags{SubjectTemplate: []byte(kDefaultTemplateSubject), BodyHTMLTemplate: []byte(kDefaultTemplateHTMLBody), BodyTextTemplate: []byte(kDefaultTemplateTextBody)},
 		TokenLifetime: 1 * time.Hour,
+
+		QueueStore:     factory.DefaultFlags(),
+		QueueApp:       kemail.DefaultQueueApp,
+		QueueNamespace: kemail.DefaultQueueNamespace,
+		QueueFlags:     kemail.DefaultQueueFlags(),
+		QueueProcess:   true,
 	}
 }
 
@@ -123,6 +152,19 @@ func (f *EmailerFlags) Register(fs kflags.FlagSet, prefix string) {
 		"Path to a Go template file for the login email body (Text). Must contain {{.URL}}. If not set, a default email body is used.",
 	)
 	fs.ByteFileVar(&f.SymmetricKey, prefix+"symmetric-key-file", "", "Path to a file containing the symmetric key for token encryption. If not set, a new key is generated.", kflags.WithContent(f.SymmetricKey))
+
+	fs.BoolVar(&f.Queue, prefix+"queue", f.Queue, "Store the login emails in a persistent queue before sending them, so they are retried and not lost on restart.")
+	fs.BoolVar(&f.QueueProcess, prefix+"queue-process", f.QueueProcess, "Deliver the queued login emails from this process. Disable if they are delivered by 'enkit email process'.")
+	fs.StringVar(&f.QueueApp, prefix+"queue-app", f.QueueApp, "App name of the email queue in the config store")
+	fs.StringVar(&f.QueueNamespace, prefix+"queue-namespace", f.QueueNamespace, "Namespace of the email queue in the config store")
+	if f.QueueStore == nil {
+		f.QueueStore = factory.DefaultFlags()
+	}
+	f.QueueStore.Register(fs, prefix+"queue-")
+	if f.QueueFlags == nil {
+		f.QueueFlags = kemail.DefaultQueueFlags()
+	}
+	f.QueueFlags.Register(fs, prefix)
 }
 
 // FromEmailerFlags returns a Modifier that applies the configuration from the Flags struct.
@@ -170,6 +212,31 @@ func FromEmailerFlags(f *EmailerFlags) EmailerModifier {
 			}
 		}
 
+		if f.Queue {
+			storeFlags := f.QueueStore
+			if storeFlags == nil {
+				storeFlags = factory.DefaultFlags()
+			}
+			workspace, err := factory.NewStore(o.rng, factory.FromFlags(storeFlags))
+			if err != nil {
+				return fmt.Errorf("could not open the email queue store: %w", err)
+			}
+			app, namespace := f.QueueApp, f.QueueNamespace
+			if app == "" {
+				app = kemail.DefaultQueueApp
+			}
+			if namespace == "" {
+				namespace = kemail.DefaultQueueNamespace
+			}
+			store, err := workspace.Open(app, namespace)
+			if err != nil {
+				return fmt.Errorf("could not open the email queue store: %w", err)
+			}
+			o.QueueStore = store
+			o.QueueFlags = f.QueueFlags
+			o.ProcessQueue = f.QueueProcess
+		}
+
 		o.Dialer = dialer
 		o.SmtpHost = f.SmtpHost
 		o.SmtpPort = f.SmtpPort
@@ -215,6 +282,37 @@ func WithEmailerDialer(dialer kemail.Dialer) EmailerModifier {
 	}
 }
 
+// WithEmailerQueue queues the login emails in a persistent queue, rather
+// than sending them directly.
+//
+// Unless WithEmailerQueueProcessing is used, the queue must be processed
+// elsewhere, for example by 'enkit email process'.
+func WithEmailerQueue(queue *kemail.Queue) EmailerModifier {
+	return func(o *emailerOptions) error {
+		o.Queue = queue
+		return nil
+	}
+}
+
+// WithEmailerQueueStore queues the login emails in a persistent queue kept
+// in store, delivered with the dialer of the emailer.
+func WithEmailerQueueStore(store config.Store, flags *kemail.QueueFlags) EmailerModifier {
+	return func(o *emailerOptions) error {
+		o.QueueStore = store
+		o.QueueFlags = flags
+		return nil
+	}
+}
+
+// WithEmailerQueueProcessing sets whether the emailer delivers the queued
+// emails itself, in background, until Close is called.
+func WithEmailerQueueProcessing(process bool) EmailerModifier {
+	return func(o *emailerOptions) error {
+		o.ProcessQueue = process
+		return nil
+	}
+}
+
 func defaultEmailerOptions(rng *rand.Rand) *emailerOptions {
 	return &emailerOptions{
 		rng: rng,
@@ -254,23 +352,77 @@ func NewEmailer(rng *rand.Rand, mods ...EmailerModifier) (*Emailer, error) {
 	opts.log.Infof("NewEmailer configured with: SmtpHost=%s, SmtpPort=%d, SmtpUser=%s, SmtpPassword=%s, FromAddress=%s, TokenLifetime=%s",
 		opts.SmtpHost, opts.SmtpPort, opts.SmtpUser, smtpPasswordStatus, opts.FromAddress, opts.TokenLifetime)
 
+	queue := opts.Queue
+	if queue == nil && opts.QueueStore != nil {
+		var senders kemail.SingleSenderFactory
+		if opts.Dialer != nil {
+			senders, err = kemail.SenderFactoryFromFlags(opts.Dialer, nil, opts.log, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		queue, err = kemail.NewQueue(opts.QueueStore, kemail.FromQueueFlags(opts.QueueFlags), kemail.WithQueueLogger(opts.log), kemail.WithQueueSenderFactory(senders))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure email queue: %w", err)
+		}
+	}
+	if queue != nil && opts.ProcessQueue && !queue.CanDeliver() {
+		return nil, fmt.Errorf("the email queue has no way to send emails - configure an smtp server, or deliver the queue with 'enkit email process'")
+	}
+
 	mailer, err := kemail.NewTransactionalEmailer(
 		kemail.WithTransactionalLogger(opts.log),
 		kemail.WithDialer(opts.Dialer),
 		kemail.WithFromAddress(opts.FromAddress),
 		kemail.WithTemplates(opts.Templates),
+		kemail.WithTransactionalQueue(queue),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure transactional emailer: %w", err)
 	}
 
-	return &Emailer{
+	emailer := &Emailer{
 		log:           opts.log,
 		tokenEncoder:  tokenEncoder,
 		mailer:        mailer,
 		tokenLifetime: opts.TokenLifetime,
 		callbackURL:   opts.CallbackURL,
-	}, nil
+		queue:         queue,
+		stopQueue:     func() {},
+	}
+	if queue != nil && opts.ProcessQueue {
+		emailer.stopQueue = processQueue(queue)
+	} else if queue != nil {
+		opts.log.Infof("Login emails are queued, and must be delivered with 'enkit email process'")
+	}
+	return emailer, nil
+}
+
+// processQueue delivers the messages of the queue in background, and returns a
+// function stopping the delivery.
+func processQueue(queue *kemail.Queue) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		queue.Run(ctx)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
+// Close stops the delivery of the queued emails, if started by the emailer.
+//
+// Emails still queued are delivered the next time the queue is processed.
+func (e *Emailer) Close() error {
+	e.stopQueue()
+	return nil
 }
 
 // CreateEmailToken generates a new encrypted token for the given parameters.
@@ -325,8 +477,9 @@ func (e *Emailer) SendLoginEmailWithCallbackURL(params url.Values, location stri
 
 	templateData := make(map[string]interface{})
 	templateData["URL"] = destinationURL.String()
+	expiration := time.Now().Add(e.tokenLifetime)
 	templateData["TokenLifetime"] = e.tokenLifetime.String()
-	templateData["TokenExpiration"] = time.Now().Add(e.tokenLifetime).Format(time.RFC1123)
+	templateData["TokenExpiration"] = expiration.Format(time.RFC1123)
 	for k, v := range params {
 		if len(v) > 0 {
 			templateData[k] = v[0]
@@ -337,6 +490,9 @@ func (e *Emailer) SendLoginEmailWithCallbackURL(params url.Values, location stri
 		templateData[k] = v
 	}
 
+	if e.queue != nil {
+		return e.queueLoginEmail(email, location, expiration, templateData)
+	}
 	if err := e.mailer.Send(email, templateData); err != nil {
 		return err
 	}
@@ -346,6 +502,26 @@ func (e *Emailer) SendLoginEmailWithCallbackURL(params url.Values, location stri
 	return nil
 }
 
+// queueLoginEmail stores the login email in the queue, for delivery by Queue.Run.
+//
+// The link is useless once the token expires, so the email is not retried
+// past that, and as it carries the token, it is deleted from the queue once
+// sent, or redacted if it could not be.
+func (e *Emailer) queueLoginEmail(email, location string, expiration time.Time, templateData map[string]interface{}) error {
+	message, err := e.mailer.BuildQueuedMessage(email, templateData)
+	if err != nil {
+		return err
+	}
+	message.Deadline = expiration
+	message.Sensitive = true
+	if _, err := e.queue.Enqueue(message); err != nil {
+		return fmt.Errorf("error queuing email: %w", err)
+	}
+
+	e.log.Infof("Login email to %s from %s queued", email, location)
+	return nil
+}
+
 // ValidateEmailToken validates the given token and returns the payload.
 func (e *Emailer) DecodeEmailToken(tokenStr string) (*EmailTokenPayload, error) {
 	var payload EmailTokenPayload
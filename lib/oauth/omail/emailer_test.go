@@ -1,18 +1,23 @@
 package omail
 
 import (
+	"fmt"
 	"io"
 	"math/rand"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ccontavalli/enkit/lib/config/memory"
 	"github.com/ccontavalli/enkit/lib/kemail"
+	"github.com/ccontavalli/enkit/lib/logger"
 	"github.com/ccontavalli/enkit/lib/oauth"
 	"github.com/ccontavalli/enkit/lib/srand"
 	"github.com/ccontavalli/enkit/lib/token"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/gomail.v2"
 )
 
@@ -188,3 +193,127 @@ func TestFlagsValidation(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "CallbackURL must be configured")
 }
+
+func TestEmailerQueueSurvivesRestart(t *testing.T) {
+	rng := rand.New(srand.Source)
+	key, err := token.GenerateSymmetricKey(rng, 256)
+	assert.NoError(t, err)
+	callbackURL, err := url.Parse("https://example.com/my/callback")
+	assert.NoError(t, err)
+
+	flags := EmailerDefaultFlags()
+	flags.SmtpHost = "smtp.example.com"
+	flags.FromAddress = "noreply@example.com"
+	flags.SymmetricKey = key
+	flags.Queue = true
+	flags.QueueStore.Directory.Path = t.TempDir()
+	flags.QueueFlags.PollInterval = 10 * time.Millisecond
+	flags.QueueFlags.MinBackoff = 0
+
+	// The smtp server is down: the email stays in the queue.
+	var failures atomic.Int32
+	failing := &mockDialer{send: func(m *gomail.Message) error {
+		failures.Add(1)
+		return fmt.Errorf("smtp server unavailable")
+	}}
+	emailer, err := NewEmailer(rng, FromEmailerFlags(flags), WithCallbackURL(callbackURL), WithEmailerDialer(failing))
+	assert.NoError(t, err)
+
+	params := url.Values{}
+	params.Set("email", "test@example.com")
+	assert.NoError(t, emailer.SendLoginEmail(params, "test-location"))
+	assert.Eventually(t, func() bool { return failures.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, emailer.Close())
+
+	// After a restart, with the smtp server back, the email is delivered.
+	sent := make(chan *gomail.Message, 1)
+	working := &mockDialer{send: func(m *gomail.Message) error {
+		sent <- m
+		return nil
+	}}
+	emailer, err = NewEmailer(rng, FromEmailerFlags(flags), WithCallbackURL(callbackURL), WithEmailerDialer(working))
+	assert.NoError(t, err)
+	defer emailer.Close()
+
+	select {
+	case message := <-sent:
+		assert.Equal(t, []string{"test@example.com"}, message.GetHeader("To"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued email was not delivered after restart")
+	}
+}
+
+func TestEmailerQueueRequiresSender(t *testing.T) {
+	rng := rand.New(srand.Source)
+	key, err := token.GenerateSymmetricKey(rng, 256)
+	assert.NoError(t, err)
+	callbackURL, err := url.Parse("https://example.com/my/callback")
+	assert.NoError(t, err)
+
+	templates, err := kemail.ParseTemplates([]byte(kDefaultTemplateSubject), []byte(kDefaultTemplateHTMLBody), []byte(kDefaultTemplateTextBody))
+	assert.NoError(t, err)
+	mods := []EmailerModifier{
+		WithCallbackURL(callbackURL), WithSymmetricKey(key), WithEmailerQueueStore(memory.NewStore(), nil),
+		func(o *emailerOptions) error {
+			o.FromAddress = "noreply@example.com"
+			o.Templates = templates
+			return nil
+		},
+	}
+
+	// Without a dialer, the queue can only be delivered by another process.
+	_, err = NewEmailer(rng, append(mods, WithEmailerQueueProcessing(true))...)
+	assert.ErrorContains(t, err, "enkit email process")
+
+	emailer, err := NewEmailer(rng, mods...)
+	assert.NoError(t, err)
+	assert.NoError(t, emailer.Close())
+}
+
+func TestEmailerQueueDeadline(t *testing.T) {
+	rng := rand.New(srand.Source)
+	key, err := token.GenerateSymmetricKey(rng, 256)
+	assert.NoError(t, err)
+	callbackURL, err := url.Parse("https://example.com/my/callback")
+	assert.NoError(t, err)
+
+	flags := EmailerDefaultFlags()
+	flags.SmtpHost = "smtp.example.com"
+	flags.FromAddress = "noreply@example.com"
+	flags.SymmetricKey = key
+	flags.TokenLifetime = 10 * time.Minute
+
+	sent := 0
+	dialer := &mockDialer{send: func(m *gomail.Message) error {
+		sent++
+		return nil
+	}}
+	senders, err := kemail.SenderFactoryFromFlags(dialer, nil, logger.Nil, nil)
+	require.NoError(t, err)
+	queue, err := kemail.NewQueue(memory.NewStore(), kemail.WithQueueSenderFactory(senders))
+	require.NoError(t, err)
+	emailer, err := NewEmailer(rng, FromEmailerFlags(flags), WithCallbackURL(callbackURL), WithEmailerDialer(dialer), WithEmailerQueue(queue))
+	require.NoError(t, err)
+	defer emailer.Close()
+
+	params := url.Values{}
+	params.Set("email", "test@example.com")
+	start := time.Now()
+	require.NoError(t, emailer.SendLoginEmail(params, "test-location"))
+
+	// The email is not retried past the expiration of the token in it.
+	messages, err := queue.List()
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.True(t, messages[0].Sensitive)
+	assert.WithinDuration(t, start.Add(10*time.Minute), messages[0].Deadline, 5*time.Second)
+
+	// Once sent, it is deleted from the queue.
+	count, err := queue.Process()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 1, sent)
+	messages, err = queue.List()
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
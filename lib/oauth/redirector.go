@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/ccontavalli/enkit/lib/khttp"
 	"github.com/ccontavalli/enkit/lib/khttp/kcookie"
@@ -17,6 +18,9 @@ type Redirector struct {
 	AuthURL *url.URL
 	// After successful authentication via redirection, send user back here by default.
 	DefaultTarget string
+	// Challenge any client not asking for html with basic authentication, rather than
+	// just the clients known to supply credentials when challenged.
+	BasicChallenge bool
 }
 
 func (as *Redirector) PerformLogin(w http.ResponseWriter, r *http.Request, lm ...LoginModifier) error {
@@ -69,5 +73,36 @@ func (as *Redirector) Authenticate(w http.ResponseWriter, r *http.Request, rurl
 		return ad.Creds, nil
 	}
 
+	// Tools like git or docker can't follow a login page, but supply credentials
+	// when challenged. Browsers always ask for html when navigating. Other clients,
+	// like scripts, get the redirect to the login page unless configured otherwise.
+	if !acceptsHTML(r) && (as.BasicChallenge || wantsChallenge(r)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="enkit"`)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return nil, nil
+	}
+
 	return nil, as.PerformLogin(w, r, WithTarget(rurl.String()))
 }
+
+// wantsChallenge returns true if the client is known to supply credentials when challenged.
+//
+// That's the case when the request already carries credentials (not valid for the proxy,
+// or they would have been accepted), or when it comes from git or docker.
+func wantsChallenge(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	agent := strings.ToLower(r.UserAgent())
+	return strings.HasPrefix(agent, "git/") || strings.HasPrefix(agent, "docker/")
+}
+
+// acceptsHTML returns true if the client indicated it can display an html page.
+func acceptsHTML(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, "text/html") {
+			return true
+		}
+	}
+	return false
+}
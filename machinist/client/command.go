@@ -0,0 +1,33 @@
+package client
+
+import (
+	"github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/machinist/config"
+
+	"github.com/spf13/cobra"
+)
+
+// AddCommands adds the commands meant to be run by users to interact with the nodes.
+func AddCommands(c *cobra.Command, conf *config.Common) {
+	c.AddCommand(NewRunCommand(conf))
+	c.AddCommand(NewPushCommand(conf))
+	c.AddCommand(NewPullCommand(conf))
+	c.AddCommand(NewNodesCommand(conf))
+	c.AddCommand(NewTokenCommand(conf))
+}
+
+// NewCommand returns a machinist command with only the commands meant to be run by users,
+// to be embedded in other tools, like `enkit machinist`.
+func NewCommand(bf *client.BaseFlags) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "machinist",
+		Short: "Lists, and runs commands or copies files on the machines managed by machinist",
+	}
+	conf := &config.Common{
+		Root: bf,
+	}
+	c.PersistentFlags().StringVar(&conf.ControlPlaneHost, "control-host", "localhost", "machinist controller to connect to")
+	c.PersistentFlags().IntVar(&conf.ControlPlanePort, "control-port", 4545, "port of the machinist controller")
+	AddCommands(c, conf)
+	return c
+}
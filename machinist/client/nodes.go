@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	eclient "github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/machinist/config"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+// NodesFlags are the options of `machinist nodes`.
+type NodesFlags struct {
+	Tags  []string
+	Stale bool
+}
+
+func NewNodesCommand(conf *config.Common) *cobra.Command {
+	nf := &NodesFlags{}
+	c := &cobra.Command{
+		Use:   "nodes [--tag=TAG...] [--stale]",
+		Short: "Lists the nodes known to the controller",
+		Long: `Lists the nodes known to the controller, with their ips, tags and last time seen.
+
+Nodes that have not been seen for longer than the --stale-after of the controller
+are only shown with --stale. Nodes not seen for longer than --expire-after are
+forgotten by the controller.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := dial(conf)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			resp, err := mpb.NewControllerClient(conn).ListNodes(context.Background(), &mpb.ListNodesRequest{
+				Tags:         nf.Tags,
+				IncludeStale: nf.Stale,
+			})
+			if err != nil {
+				return eclient.NiceError(err, "could not list nodes - %w", err)
+			}
+			return PrintNodes(os.Stdout, resp.Nodes, time.Now())
+		},
+	}
+	c.Flags().StringArrayVar(&nf.Tags, "tag", []string{}, "only show the nodes with this tag - can be repeated, to show the nodes with all the tags")
+	c.Flags().BoolVar(&nf.Stale, "stale", false, "also show the nodes that have not been seen recently")
+	return c
+}
+
+// PrintNodes writes a table with the nodes, showing how long ago they were seen relative to now.
+func PrintNodes(out io.Writer, nodes []*mpb.Node, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tLAST SEEN\tIPS\tTAGS")
+	for _, node := range nodes {
+		status := "disconnected"
+		switch {
+		case node.Stale:
+			status = "stale"
+		case node.Connected:
+			status = "connected"
+		}
+		seen := now.Sub(node.LastSeen.AsTime()).Truncate(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s ago\t%s\t%s\n", node.Name, status, seen, strings.Join(node.Ips, ","), strings.Join(node.Tags, ","))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	eclient "github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/machinist/config"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// RunFlags are the options of `machinist run`.
+type RunFlags struct {
+	Node    string
+	Tag     string
+	Timeout time.Duration
+	Env     []string
+	Workdir string
+}
+
+func NewRunCommand(conf *config.Common) *cobra.Command {
+	rf := &RunFlags{}
+	c := &cobra.Command{
+		Use:   "run [--node=NAME|--tag=TAG] [OPTIONS] -- COMMAND [ARGS...]",
+		Short: "Runs a command on one or more nodes, and shows its output",
+		Long: `Runs a command on one or more nodes, and shows its output.
+
+The nodes must be polling the controller with --enable-run, and you must be
+allowed to run the command on all the nodes by the --run-acl of the controller.
+
+When running on a tag, each line of output is prefixed with the name of the node.
+The exit status is the one of the command if run on a single node, 1 if the
+command failed on any of the nodes otherwise.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (rf.Node == "") == (rf.Tag == "") {
+				return kflags.NewUsageErrorf("exactly one of --node or --tag must be specified")
+			}
+			conn, err := dial(conf)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			req := &mpb.RunRequest{
+				Node:      rf.Node,
+				Tag:       rf.Tag,
+				Argv:      args,
+				Env:       rf.Env,
+				Workdir:   rf.Workdir,
+				TimeoutMs: rf.Timeout.Milliseconds(),
+			}
+			exits, err := Run(context.Background(), mpb.NewControllerClient(conn), req, os.Stdout, os.Stderr)
+			if err != nil {
+				return eclient.NiceError(err, "could not run command - %w", err)
+			}
+			return ExitStatus(exits, os.Stderr)
+		},
+	}
+	c.Flags().StringVar(&rf.Node, "node", "", "name of the node to run the command on")
+	c.Flags().StringVar(&rf.Tag, "tag", "", "run the command on all the connected nodes with this tag")
+	c.Flags().DurationVar(&rf.Timeout, "timeout", 0, "kill the command if still running after this long, defaults to the maximum allowed by the controller")
+	c.Flags().StringArrayVar(&rf.Env, "env", []string{}, "environment variable to set for the command, as KEY=VALUE - can be repeated")
+	c.Flags().StringVar(&rf.Workdir, "workdir", "", "directory to run the command in")
+	return c
+}
+
+// dial connects to the controller, authenticating with the credentials of `enkit login`.
+func dial(conf *config.Common) (*grpc.ClientConn, error) {
+	_, cookie, err := conf.Root.IdentityCookie()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Dial(net.JoinHostPort(conf.ControlPlaneHost, strconv.Itoa(conf.ControlPlanePort)), grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(eclient.SetCookieUnaryInterceptor(cookie)),
+		grpc.WithStreamInterceptor(eclient.SetCookieStreamInterceptor(cookie)))
+}
+
+// Run runs a command on the nodes, and copies their output to stdout and stderr.
+//
+// If the command is run on a tag, the lines of output are prefixed with the name of the node.
+// Returns the exit status of the command on each node.
+func Run(ctx context.Context, client mpb.ControllerClient, req *mpb.RunRequest, stdout, stderr io.Writer) (map[string]*mpb.CommandExit, error) {
+	stream, err := client.Run(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	results, err := receive(stream, req.Tag != "", stdout, stderr)
+	return exitStatuses(results), err
+}
+
+// receive copies the output of the nodes to stdout and stderr, until the controller closes the stream.
+//
+// If prefix is true, the lines of output are prefixed with the name of the node.
+// Returns the last response received from each node, carrying the exit status.
+func receive(stream grpc.ServerStreamingClient[mpb.RunResponse], prefix bool, stdout, stderr io.Writer) (map[string]*mpb.RunResponse, error) {
+	outputs := map[string][2]*prefixWriter{}
+	results := map[string]*mpb.RunResponse{}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+
+		output, found := outputs[resp.Node]
+		if !found {
+			p := ""
+			if prefix {
+				p = resp.Node + ": "
+			}
+			output = [2]*prefixWriter{{out: stdout, prefix: p}, {out: stderr, prefix: p}}
+			outputs[resp.Node] = output
+		}
+
+		switch r := resp.Output.(type) {
+		case *mpb.RunResponse_Stdout:
+			output[0].Write(r.Stdout)
+		case *mpb.RunResponse_Stderr:
+			output[1].Write(r.Stderr)
+		case *mpb.RunResponse_Exit:
+			output[0].Flush()
+			output[1].Flush()
+			results[resp.Node] = resp
+		}
+	}
+}
+
+// exitStatuses returns the exit status of each node, from the responses returned by receive.
+func exitStatuses(results map[string]*mpb.RunResponse) map[string]*mpb.CommandExit {
+	exits := map[string]*mpb.CommandExit{}
+	for node, resp := range results {
+		exits[node] = resp.GetExit()
+	}
+	return exits
+}
+
+// ExitStatus summarizes the exit status of the nodes, as returned by Run.
+//
+// Returns nil if the command succeeded on all nodes, an error with the exit status
+// of the command if it was run on a single node, or with status 1 otherwise.
+func ExitStatus(exits map[string]*mpb.CommandExit, stderr io.Writer) error {
+	var failed []string
+	for node, exit := range exits {
+		if exit.Status != 0 {
+			failed = append(failed, node)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+
+	for _, node := range failed {
+		exit := exits[node]
+		message := fmt.Sprintf("exit status %d", exit.Status)
+		if exit.Error != "" {
+			message += " - " + exit.Error
+		}
+		fmt.Fprintf(stderr, "%s: %s\n", node, message)
+	}
+	if len(exits) == 1 {
+		return kflags.NewStatusErrorf(int(exits[failed[0]].Status), "command failed on %s", failed[0])
+	}
+	return kflags.NewStatusErrorf(1, "command failed on %d of %d nodes: %s", len(failed), len(exits), strings.Join(failed, ", "))
+}
+
+// prefixWriter prepends a prefix to each line written.
+type prefixWriter struct {
+	out     io.Writer
+	prefix  string
+	partial []byte
+}
+
+func (pw *prefixWriter) Write(data []byte) (int, error) {
+	if pw.prefix == "" {
+		return pw.out.Write(data)
+	}
+
+	pw.partial = append(pw.partial, data...)
+	for {
+		end := bytes.IndexByte(pw.partial, '\n')
+		if end < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(pw.out, "%s%s", pw.prefix, pw.partial[:end+1]); err != nil {
+			return 0, err
+		}
+		pw.partial = pw.partial[end+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes the last line of output, if it was not terminated by a newline.
+func (pw *prefixWriter) Flush() error {
+	if len(pw.partial) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(pw.out, "%s%s\n", pw.prefix, pw.partial)
+	pw.partial = nil
+	return err
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	eclient "github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/machinist/config"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+
+	"github.com/spf13/cobra"
+)
+
+// TokenFlags are the options of `machinist token create`.
+type TokenFlags struct {
+	Names []string
+	Tags  []string
+	Uses  int32
+	TTL   time.Duration
+}
+
+func NewTokenCommand(conf *config.Common) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "token",
+		Short: "Manages the tokens nodes can enroll with",
+	}
+	c.AddCommand(NewTokenCreateCommand(conf))
+	return c
+}
+
+func NewTokenCreateCommand(conf *config.Common) *cobra.Command {
+	tf := &TokenFlags{}
+	c := &cobra.Command{
+		Use:   "create [--name=PATTERN...] [--tag=PATTERN...] [--uses=N] [--ttl=DURATION]",
+		Short: "Creates a token nodes can enroll with, and prints it",
+		Long: `Creates a token nodes can enroll with, and prints it.
+
+Nodes enroll by polling the controller with --enrollment-token, and are issued
+a credential they must present from then on. Names and tags are patterns, where
+* matches any sequence of characters: the token only allows nodes with a name
+matching any of the --name, and all tags matching any of the --tag. Nodes
+already enrolled can only enroll again with a token listing their exact name.
+
+You must be allowed to enroll nodes by the --run-acl of the controller.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := dial(conf)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			resp, err := mpb.NewControllerClient(conn).CreateToken(context.Background(), &mpb.CreateTokenRequest{
+				Names: tf.Names,
+				Tags:  tf.Tags,
+				Uses:  tf.Uses,
+				TtlMs: tf.TTL.Milliseconds(),
+			})
+			if err != nil {
+				return eclient.NiceError(err, "could not create token - %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "token valid until %s\n", resp.Expires.AsTime().Local().Format(time.RFC3339))
+			fmt.Println(resp.Token)
+			return nil
+		},
+	}
+	c.Flags().StringArrayVar(&tf.Names, "name", []string{}, "name the nodes enrolling with the token can have - can be repeated, any name if not specified")
+	c.Flags().StringArrayVar(&tf.Tags, "tag", []string{}, "tag the nodes enrolling with the token can have - can be repeated, any tag if not specified")
+	c.Flags().Int32Var(&tf.Uses, "uses", 1, "how many nodes can enroll with the token")
+	c.Flags().DurationVar(&tf.TTL, "ttl", 0, "how long the token is valid for, defaults to the maximum allowed by the controller")
+	return c
+}
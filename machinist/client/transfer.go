@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ccontavalli/enkit/astore/client/astore"
+	eclient "github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
+	"github.com/ccontavalli/enkit/machinist/config"
+	"github.com/ccontavalli/enkit/machinist/polling"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+	"github.com/ccontavalli/enkit/machinist/transfer"
+
+	"github.com/spf13/cobra"
+)
+
+// PushFlags are the options of `machinist push`.
+type PushFlags struct {
+	Node    string
+	Tag     string
+	Timeout time.Duration
+	Mode    string
+
+	Astore string
+	Arch   []string
+	Store  *eclient.ServerFlags
+}
+
+func NewPushCommand(conf *config.Common) *cobra.Command {
+	pf := &PushFlags{
+		Store: eclient.DefaultServerFlags("store", "Artifacts store metadata server", ""),
+	}
+	c := &cobra.Command{
+		Use:   "push [--node=NAME|--tag=TAG] [OPTIONS] LOCAL-FILE REMOTE-PATH | --astore=ARTIFACT REMOTE-PATH",
+		Short: "Copies a file to one or more nodes",
+		Long: `Copies a file to one or more nodes.
+
+The file is first uploaded to the controller, and then downloaded by each node.
+Alternatively, with --astore, the nodes download an artifact straight from astore.
+
+Interrupted transfers are resumed by running the same command again. Files are
+replaced atomically on the nodes, once their checksum has been verified.
+
+The nodes must be polling the controller with --enable-run, and you must be
+allowed to push the file on all the nodes by the --run-acl of the controller.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (pf.Node == "") == (pf.Tag == "") {
+				return kflags.NewUsageErrorf("exactly one of --node or --tag must be specified")
+			}
+			if (pf.Astore == "") != (len(args) == 2) {
+				return kflags.NewUsageErrorf("either a local file or --astore must be specified, and the path on the nodes")
+			}
+			mode, err := strconv.ParseUint(pf.Mode, 8, 32)
+			if err != nil {
+				return kflags.NewUsageErrorf("invalid --mode %q - must be octal, as in 0755", pf.Mode)
+			}
+
+			conn, err := dial(conf)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			client := mpb.NewControllerClient(conn)
+
+			req := &mpb.PushRequest{
+				Node:      pf.Node,
+				Tag:       pf.Tag,
+				Path:      args[len(args)-1],
+				Mode:      uint32(mode),
+				TimeoutMs: pf.Timeout.Milliseconds(),
+			}
+			if pf.Astore != "" {
+				if err := resolveArtifact(conf, pf, req); err != nil {
+					return err
+				}
+			} else {
+				key, err := transfer.Verify(args[0], "")
+				if err != nil {
+					return err
+				}
+				if _, err := transfer.UploadFile(context.Background(), client, key, args[0]); err != nil {
+					return eclient.NiceError(err, "could not upload %s - %w", args[0], err)
+				}
+				req.Key = key
+			}
+
+			exits, err := Push(context.Background(), client, req, os.Stderr)
+			if err != nil {
+				return eclient.NiceError(err, "could not push file - %w", err)
+			}
+			return ExitStatus(exits, os.Stderr)
+		},
+	}
+	c.Flags().StringVar(&pf.Node, "node", "", "name of the node to copy the file to")
+	c.Flags().StringVar(&pf.Tag, "tag", "", "copy the file to all the connected nodes with this tag")
+	c.Flags().DurationVar(&pf.Timeout, "timeout", 0, "give up if the file was not copied after this long, defaults to the maximum allowed by the controller")
+	c.Flags().StringVar(&pf.Mode, "mode", "0644", "permissions of the file on the nodes, in octal")
+	c.Flags().StringVar(&pf.Astore, "astore", "", "path or uid of an astore artifact to copy to the nodes, instead of a local file")
+	c.Flags().StringSliceVar(&pf.Arch, "arch", []string{}, "architecture of the astore artifact to copy")
+	pf.Store.Register(&kcobra.FlagSet{FlagSet: c.Flags()}, "")
+	return c
+}
+
+// resolveArtifact fills the request with the URL, size and checksum of the astore artifact.
+func resolveArtifact(conf *config.Common, pf *PushFlags, req *mpb.PushRequest) error {
+	_, cookie, err := conf.Root.IdentityCookie()
+	if err != nil {
+		return err
+	}
+	conn, err := pf.Store.Connect(eclient.WithCookie(cookie))
+	if err != nil {
+		return err
+	}
+	resp, _, _, err := astore.New(conn).GetRetrieveResponse(pf.Astore, pf.Arch, astore.IdAuto, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Url == "" || len(resp.Artifact.GetMD5()) == 0 {
+		return fmt.Errorf("artifact %s has no url or checksum", pf.Astore)
+	}
+	req.Url = resp.Url
+	req.Size = resp.Artifact.Size
+	req.Checksum = "md5:" + hex.EncodeToString(resp.Artifact.MD5)
+	return nil
+}
+
+// Push copies a file to the nodes, and returns the outcome on each node.
+//
+// Errors reported by the controller while copying are written to stderr.
+func Push(ctx context.Context, client mpb.ControllerClient, req *mpb.PushRequest, stderr io.Writer) (map[string]*mpb.CommandExit, error) {
+	stream, err := client.Push(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	results, err := receive(stream, false, stderr, stderr)
+	return exitStatuses(results), err
+}
+
+// PullFlags are the options of `machinist pull`.
+type PullFlags struct {
+	Node    string
+	Tag     string
+	Timeout time.Duration
+}
+
+func NewPullCommand(conf *config.Common) *cobra.Command {
+	pf := &PullFlags{}
+	c := &cobra.Command{
+		Use:   "pull [--node=NAME|--tag=TAG] [OPTIONS] REMOTE-PATH LOCAL-DIRECTORY",
+		Short: "Copies a file from one or more nodes",
+		Long: `Copies a file from one or more nodes.
+
+The file of each node is stored in LOCAL-DIRECTORY/<node>/, with the same name
+it has on the nodes. The path of each file copied is shown on the output.
+
+The nodes must be polling the controller with --enable-run, and you must be
+allowed to pull the file from all the nodes by the --run-acl of the controller.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (pf.Node == "") == (pf.Tag == "") {
+				return kflags.NewUsageErrorf("exactly one of --node or --tag must be specified")
+			}
+			conn, err := dial(conf)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			req := &mpb.PullRequest{
+				Node:      pf.Node,
+				Tag:       pf.Tag,
+				Path:      args[0],
+				TimeoutMs: pf.Timeout.Milliseconds(),
+			}
+			exits, err := Pull(context.Background(), mpb.NewControllerClient(conn), req, args[1], os.Stdout, os.Stderr)
+			if err != nil {
+				return eclient.NiceError(err, "could not pull file - %w", err)
+			}
+			return ExitStatus(exits, os.Stderr)
+		},
+	}
+	c.Flags().StringVar(&pf.Node, "node", "", "name of the node to copy the file from")
+	c.Flags().StringVar(&pf.Tag, "tag", "", "copy the file from all the connected nodes with this tag")
+	c.Flags().DurationVar(&pf.Timeout, "timeout", 0, "give up if the file was not copied after this long, defaults to the maximum allowed by the controller")
+	return c
+}
+
+// Pull copies a file from the nodes into dir/<node>/, and returns the outcome on each node.
+//
+// The paths of the files copied are written to stdout, errors reported by the controller to stderr.
+func Pull(ctx context.Context, client mpb.ControllerClient, req *mpb.PullRequest, dir string, stdout, stderr io.Writer) (map[string]*mpb.CommandExit, error) {
+	stream, err := client.Pull(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	results, err := receive(stream, false, stderr, stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	exits := exitStatuses(results)
+	for node, resp := range results {
+		if resp.GetExit().GetStatus() != 0 || resp.Key == "" {
+			continue
+		}
+		path := filepath.Join(dir, node, filepath.Base(req.Path))
+		if err := transfer.DownloadFile(ctx, client, resp.Key, path, 0, ""); err != nil {
+			exits[node] = &mpb.CommandExit{Status: polling.ExitError, Error: fmt.Sprintf("could not download %s - %v", path, err)}
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: %s\n", node, path)
+	}
+	return exits, nil
+}
@@ -2,6 +2,7 @@ package machinist
 
 import (
 	"github.com/ccontavalli/enkit/lib/client"
+	mclient "github.com/ccontavalli/enkit/machinist/client"
 	"github.com/ccontavalli/enkit/machinist/config"
 	"github.com/ccontavalli/enkit/machinist/machine"
 	"github.com/ccontavalli/enkit/machinist/mserver"
@@ -21,5 +22,6 @@ func NewRootCommand(bf *client.BaseFlags) *cobra.Command {
 	c.PersistentFlags().BoolVar(&conf.EnableMetrics, "metrics-enable", true, "")
 	c.AddCommand(machine.NewNodeCommand(conf))
 	c.AddCommand(mserver.NewCommand(conf.Root))
+	mclient.AddCommands(c, conf)
 	return c
 }
@@ -12,6 +12,14 @@ type Node struct {
 
 	RequireRoot bool
 
+	// Run the commands requested by the controller, see `machinist run`.
+	EnableRun bool
+
+	// Token to enroll with, see `machinist token create`, and file where
+	// to keep the credential issued by the controller at enrollment.
+	EnrollmentToken string
+	CredentialFile  string
+
 	// BUG(INFRA-2550): Machinist can unpack files/scripts/config onto the host
 	// machine, but this is better managed out-of-band by another tool, such as
 	// Ansible or Puppet. If this bool is set, perform the legacy unpacking
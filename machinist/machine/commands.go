@@ -2,6 +2,7 @@ package machine
 
 import (
 	"fmt"
+	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/machinist/config"
 	"github.com/spf13/cobra"
 	"os"
@@ -66,6 +67,11 @@ func NewPollCommand(conf *config.Node) *cobra.Command {
 	c := &cobra.Command{
 		Use: "poll [SUBCOMMANDS] [OPTIONS]",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			// Tokens have a limited number of uses and expire: without a credential file, the node
+			// may not be able to enroll again once restarted.
+			if conf.EnrollmentToken != "" && conf.CredentialFile == "" {
+				return kflags.NewUsageErrorf("--credential-file must be specified with --enrollment-token, to keep the credential issued at enrollment")
+			}
 			m, err := New(WithConfig(conf))
 			if err != nil {
 				return err
@@ -77,6 +83,9 @@ func NewPollCommand(conf *config.Node) *cobra.Command {
 		},
 	}
 	c.PersistentFlags().StringArrayVar(&conf.IpAddresses, "ips", []string{}, "the list of ip addresses bound to this machine")
+	c.PersistentFlags().BoolVar(&conf.EnableRun, "enable-run", false, "run the commands requested by the controller with 'machinist run', as the user machinist runs as")
+	c.PersistentFlags().StringVar(&conf.EnrollmentToken, "enrollment-token", "", "token to enroll with, as created with 'machinist token create' - only used if the node has no credential yet, requires --credential-file")
+	c.PersistentFlags().StringVar(&conf.CredentialFile, "credential-file", "", "file where to keep the credential issued by the controller when enrolling - required with --enrollment-token")
 	return c
 }
 
@@ -64,6 +64,29 @@ func WithTags(tags []string) NodeModifier {
 	}
 }
 
+func WithEnableRun(enable bool) NodeModifier {
+	return func(node *Machine) error {
+		node.EnableRun = enable
+		return nil
+	}
+}
+
+// WithEnrollmentToken sets the token to enroll with, as created with `machinist token create`.
+func WithEnrollmentToken(token string) NodeModifier {
+	return func(node *Machine) error {
+		node.EnrollmentToken = token
+		return nil
+	}
+}
+
+// WithCredentialFile sets the file where to keep the credential issued by the controller at enrollment.
+func WithCredentialFile(path string) NodeModifier {
+	return func(node *Machine) error {
+		node.CredentialFile = path
+		return nil
+	}
+}
+
 func WithDialFunc(f func() (*grpc.ClientConn, error)) NodeModifier {
 	return func(node *Machine) error {
 		node.DialFunc = f
@@ -0,0 +1,222 @@
+package mserver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/config/marshal"
+	"github.com/ccontavalli/enkit/lib/oauth"
+	"github.com/ccontavalli/enkit/lib/oauth/ogrpc"
+	"github.com/ccontavalli/enkit/machinist/state"
+)
+
+// Authenticator returns the identity of the user performing a request, as in user@domain.
+//
+// It must return a grpc status error if the request is not authenticated.
+type Authenticator func(ctx context.Context) (string, error)
+
+// OAuthAuthenticator authenticates requests by using the credentials cookie set by `enkit login`.
+func OAuthAuthenticator(extractor *oauth.Extractor) Authenticator {
+	return func(ctx context.Context) (string, error) {
+		creds, err := ogrpc.GetCredentials(extractor, ctx)
+		if err != nil {
+			return "", err
+		}
+		return creds.Identity.GlobalName(), nil
+	}
+}
+
+// Operations that can be allowed by a RunRule.
+const (
+	// Run commands with `machinist run`.
+	OpRun = "run"
+	// Copy files to the nodes with `machinist push`.
+	OpPush = "push"
+	// Copy files from the nodes with `machinist pull`.
+	OpPull = "pull"
+	// Create enrollment tokens with `machinist token create`.
+	OpEnroll = "enroll"
+)
+
+// RunRule allows a set of identities to run a set of commands on a set of nodes.
+//
+// All the fields except Operations are lists of patterns, where * matches any
+// sequence of characters.
+type RunRule struct {
+	// Operations allowed, any of OpRun, OpPush, OpPull or OpEnroll. Only OpRun if empty.
+	Operations []string `json:"operations,omitempty"`
+	// Identities allowed, as in "*@enfabrica.net" or "carlo@github.com".
+	Identities []string `json:"identities"`
+	// Names of the nodes the commands can be run on.
+	Nodes []string `json:"nodes,omitempty"`
+	// Tags of the nodes the commands can be run on.
+	// If both Nodes and Tags are empty, commands can run on any node.
+	Tags []string `json:"tags,omitempty"`
+	// Commands allowed, matched against the arguments joined by spaces, as
+	// in "uptime" or "systemctl status *". Any command is allowed if empty.
+	Commands []string `json:"commands,omitempty"`
+	// Environment variables the commands can be run with, matched against
+	// each NAME=value, as in "LANG=*". No variable is allowed if empty.
+	Env []string `json:"env,omitempty"`
+	// Directories the commands can be run in, as in "/tmp/*". Commands can
+	// only run in the default directory of the node if empty.
+	Workdirs []string `json:"workdirs,omitempty"`
+	// Paths on the nodes files can be pushed to or pulled from, as in "/tmp/*".
+	// Any path is allowed if empty.
+	Files []string `json:"files,omitempty"`
+}
+
+// allows returns true if the rule allows the identity to perform the operation on the machine.
+func (rule *RunRule) allows(identity, operation string, machine *state.Machine) bool {
+	if len(rule.Operations) == 0 {
+		if operation != OpRun {
+			return false
+		}
+	} else if !matchAny(rule.Operations, operation) {
+		return false
+	}
+	if !matchAny(rule.Identities, identity) {
+		return false
+	}
+	if len(rule.Nodes) == 0 && len(rule.Tags) == 0 {
+		return true
+	}
+	allowed := matchAny(rule.Nodes, machine.Name)
+	for _, tag := range machine.Tags {
+		allowed = allowed || matchAny(rule.Tags, tag)
+	}
+	return allowed
+}
+
+// RunACL determines who can run what with `machinist run`.
+//
+// A command is allowed if at least one rule matches, it is denied otherwise.
+// The ACL is loaded from a yaml, json, toml, ... file like:
+//
+//	rules:
+//	  - identities: ["*@enfabrica.net"]
+//	    tags: ["builder"]
+//	    commands: ["uptime", "systemctl status *"]
+//	  - identities: ["*@enfabrica.net"]
+//	    tags: ["builder"]
+//	    commands: ["make *"]
+//	    env: ["LANG=*", "MAKEFLAGS=*"]
+//	    workdirs: ["/home/build/*"]
+//	  - identities: ["*@enfabrica.net"]
+//	    operations: ["pull"]
+//	    files: ["/var/log/*"]
+//	  - identities: ["admin@enfabrica.net"]
+//	    operations: ["run", "push", "pull", "enroll"]
+type RunACL struct {
+	Rules []RunRule `json:"rules"`
+}
+
+// LoadRunACL reads the ACL from a file, in any format supported by marshal.
+func LoadRunACL(path string) (*RunACL, error) {
+	acl := &RunACL{}
+	if err := marshal.UnmarshalFile(path, acl); err != nil {
+		return nil, fmt.Errorf("could not load run acl %s - %w", path, err)
+	}
+	for ix, rule := range acl.Rules {
+		if len(rule.Identities) == 0 {
+			return nil, fmt.Errorf("invalid run acl %s - rule #%d has no identities", path, ix)
+		}
+		for _, op := range rule.Operations {
+			if op != OpRun && op != OpPush && op != OpPull && op != OpEnroll {
+				return nil, fmt.Errorf("invalid run acl %s - rule #%d has unknown operation %q", path, ix, op)
+			}
+		}
+	}
+	return acl, nil
+}
+
+// Allowed returns true if the identity is allowed to run the command on the machine,
+// with the environment variables env, as NAME=value, in the workdir.
+//
+// Commands with environment variables or a workdir are only allowed by rules
+// explicitly allowing them, as they can change what the command does.
+func (acl *RunACL) Allowed(identity string, machine *state.Machine, argv, env []string, workdir string) bool {
+	command := strings.Join(argv, " ")
+	for _, rule := range acl.Rules {
+		if !rule.allows(identity, OpRun, machine) {
+			continue
+		}
+		if len(rule.Commands) > 0 && !matchAny(rule.Commands, command) {
+			continue
+		}
+		if !matchAll(rule.Env, env) {
+			continue
+		}
+		if workdir != "" && !matchAny(rule.Workdirs, workdir) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// AllowedFile returns true if the identity is allowed to push or pull the file on the machine.
+//
+// path must be absolute and clean, as . or .. components would bypass the patterns.
+func (acl *RunACL) AllowedFile(identity, operation string, machine *state.Machine, path string) bool {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return false
+	}
+	for _, rule := range acl.Rules {
+		if !rule.allows(identity, operation, machine) {
+			continue
+		}
+		if len(rule.Files) > 0 && !matchAny(rule.Files, path) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// AllowedEnroll returns true if the identity is allowed to create enrollment tokens for
+// nodes with the names and tags, as patterns.
+//
+// Rules restricted to some nodes only allow tokens restricted to names matching them,
+// rules restricted to some tags only allow tokens restricted to tags matching them.
+// A rule restricted to both requires both: a token with no name restriction could
+// otherwise enroll any node, and one with no tag restriction could claim any tag.
+func (acl *RunACL) AllowedEnroll(identity string, names, tags []string) bool {
+	for _, rule := range acl.Rules {
+		if !matchAny(rule.Operations, OpEnroll) || !matchAny(rule.Identities, identity) {
+			continue
+		}
+		if len(rule.Nodes) > 0 && (len(names) == 0 || !matchAll(rule.Nodes, names)) {
+			continue
+		}
+		if len(rule.Tags) > 0 && (len(tags) == 0 || !matchAll(rule.Tags, tags)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchAll returns true if all the values match any of the patterns.
+func matchAll(patterns []string, values []string) bool {
+	for _, value := range values {
+		if !matchAny(patterns, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny returns true if the value matches any of the patterns.
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if matched, _ := regexp.MatchString(expr, value); matched {
+			return true
+		}
+	}
+	return false
+}
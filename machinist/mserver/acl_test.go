@@ -0,0 +1,144 @@
+package mserver_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ccontavalli/enkit/machinist/mserver"
+	"github.com/ccontavalli/enkit/machinist/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+rules:
+  - identities: ["*@enfabrica.net"]
+    tags: ["builder"]
+    commands: ["uptime", "systemctl status *"]
+  - identities: ["*@enfabrica.net"]
+    tags: ["builder"]
+    commands: ["make *"]
+    env: ["LANG=*"]
+    workdirs: ["/home/build/*"]
+  - identities: ["admin@enfabrica.net"]
+    nodes: ["db*"]
+`), 0o644))
+
+	acl, err := mserver.LoadRunACL(path)
+	assert.NoError(t, err)
+
+	builder := &state.Machine{Name: "build01", Tags: []string{"big", "builder"}}
+	db := &state.Machine{Name: "db01"}
+	tests := []struct {
+		identity string
+		machine  *state.Machine
+		argv     []string
+		env      []string
+		workdir  string
+		allowed  bool
+	}{
+		{"carlo@enfabrica.net", builder, []string{"uptime"}, nil, "", true},
+		{"carlo@enfabrica.net", builder, []string{"systemctl", "status", "sshd"}, nil, "", true},
+		{"carlo@enfabrica.net", builder, []string{"systemctl", "stop", "sshd"}, nil, "", false},
+		{"carlo@enfabrica.net", builder, []string{"uptime", "-p"}, nil, "", false},
+		{"carlo@enfabrica.net", db, []string{"uptime"}, nil, "", false},
+		{"carlo@github.com", builder, []string{"uptime"}, nil, "", false},
+		{"admin@enfabrica.net", db, []string{"rm", "-rf", "/tmp/cache"}, nil, "", true},
+		{"admin@enfabrica.net", builder, []string{"rm", "-rf", "/tmp/cache"}, nil, "", false},
+		{"xadmin@enfabrica.net", db, []string{"rm", "-rf", "/tmp/cache"}, nil, "", false},
+		{"carlo@enfabrica.net", builder, []string{"uptime"}, []string{"LD_PRELOAD=/tmp/evil.so"}, "", false},
+		{"carlo@enfabrica.net", builder, []string{"uptime"}, nil, "/tmp", false},
+		{"carlo@enfabrica.net", builder, []string{"make", "all"}, []string{"LANG=C"}, "/home/build/src", true},
+		{"carlo@enfabrica.net", builder, []string{"make", "all"}, []string{"LANG=C", "LD_PRELOAD=/tmp/evil.so"}, "", false},
+		{"carlo@enfabrica.net", builder, []string{"make", "all"}, nil, "/tmp", false},
+		{"admin@enfabrica.net", db, []string{"uptime"}, []string{"LD_PRELOAD=/tmp/evil.so"}, "", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, acl.Allowed(test.identity, test.machine, test.argv, test.env, test.workdir),
+			"%s %s %v %v %s", test.identity, test.machine.Name, test.argv, test.env, test.workdir)
+	}
+
+	assert.False(t, acl.AllowedFile("admin@enfabrica.net", mserver.OpPush, db, "/etc/passwd"))
+
+	assert.NoError(t, os.WriteFile(path, []byte(`
+rules:
+  - identities: ["*@enfabrica.net"]
+    operations: ["pull"]
+    files: ["/var/log/*"]
+  - identities: ["admin@enfabrica.net"]
+    operations: ["run", "push", "pull"]
+`), 0o644))
+	acl, err = mserver.LoadRunACL(path)
+	assert.NoError(t, err)
+	assert.True(t, acl.AllowedFile("carlo@enfabrica.net", mserver.OpPull, db, "/var/log/syslog"))
+	assert.False(t, acl.AllowedFile("carlo@enfabrica.net", mserver.OpPull, db, "/etc/shadow"))
+	assert.False(t, acl.AllowedFile("carlo@enfabrica.net", mserver.OpPull, db, "/var/log/../../etc/shadow"))
+	assert.False(t, acl.AllowedFile("carlo@enfabrica.net", mserver.OpPull, db, "/var/log/./syslog"))
+	assert.False(t, acl.AllowedFile("carlo@enfabrica.net", mserver.OpPull, db, "var/log/syslog"))
+	assert.False(t, acl.AllowedFile("carlo@enfabrica.net", mserver.OpPush, db, "/var/log/syslog"))
+	assert.False(t, acl.Allowed("carlo@enfabrica.net", db, []string{"uptime"}, nil, ""))
+	assert.True(t, acl.AllowedFile("admin@enfabrica.net", mserver.OpPush, db, "/etc/passwd"))
+	assert.True(t, acl.Allowed("admin@enfabrica.net", db, []string{"uptime"}, nil, ""))
+
+	assert.NoError(t, os.WriteFile(path, []byte(`rules: [{identities: ["*"], operations: ["delete"]}]`), 0o644))
+	_, err = mserver.LoadRunACL(path)
+	assert.ErrorContains(t, err, "unknown operation")
+
+	assert.NoError(t, os.WriteFile(path, []byte(`rules: [{nodes: ["db01"]}]`), 0o644))
+	_, err = mserver.LoadRunACL(path)
+	assert.ErrorContains(t, err, "no identities")
+}
+
+func TestEnrollACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+rules:
+  - identities: ["*@enfabrica.net"]
+    operations: ["enroll"]
+    nodes: ["build*"]
+    tags: ["builder"]
+  - identities: ["admin@enfabrica.net"]
+    operations: ["enroll"]
+  - identities: ["*@github.com"]
+`), 0o644))
+
+	acl, err := mserver.LoadRunACL(path)
+	assert.NoError(t, err)
+
+	assert.True(t, acl.AllowedEnroll("admin@enfabrica.net", nil, nil))
+	assert.True(t, acl.AllowedEnroll("carlo@enfabrica.net", []string{"build01", "build*"}, []string{"builder"}))
+	assert.False(t, acl.AllowedEnroll("carlo@enfabrica.net", nil, nil))
+	// Both the names and the tags are required, or the token would be unrestricted on the other.
+	assert.False(t, acl.AllowedEnroll("carlo@enfabrica.net", []string{"build01"}, nil))
+	assert.False(t, acl.AllowedEnroll("carlo@enfabrica.net", nil, []string{"builder"}))
+	assert.False(t, acl.AllowedEnroll("carlo@enfabrica.net", []string{"build01"}, []string{"db"}))
+	assert.False(t, acl.AllowedEnroll("carlo@enfabrica.net", []string{"build01", "db01"}, []string{"builder"}))
+	assert.False(t, acl.AllowedEnroll("carlo@enfabrica.net", []string{"build01"}, []string{"builder", "db"}))
+	assert.False(t, acl.AllowedEnroll("carlo@github.com", nil, nil))
+}
+
+func TestEnrollACLSingleConstraint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+rules:
+  - identities: ["ci@enfabrica.net"]
+    operations: ["enroll"]
+    nodes: ["ci-*"]
+  - identities: ["ops@enfabrica.net"]
+    operations: ["enroll"]
+    tags: ["gpu"]
+`), 0o644))
+
+	acl, err := mserver.LoadRunACL(path)
+	assert.NoError(t, err)
+
+	// Constraints the rule does not set are free.
+	assert.True(t, acl.AllowedEnroll("ci@enfabrica.net", []string{"ci-01"}, nil))
+	assert.True(t, acl.AllowedEnroll("ci@enfabrica.net", []string{"ci-01"}, []string{"anything"}))
+	assert.False(t, acl.AllowedEnroll("ci@enfabrica.net", nil, []string{"anything"}))
+	assert.True(t, acl.AllowedEnroll("ops@enfabrica.net", nil, []string{"gpu"}))
+	assert.True(t, acl.AllowedEnroll("ops@enfabrica.net", []string{"any01"}, []string{"gpu"}))
+	assert.False(t, acl.AllowedEnroll("ops@enfabrica.net", []string{"any01"}, nil))
+}
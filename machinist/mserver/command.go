@@ -2,7 +2,9 @@ package mserver
 
 import (
 	"github.com/ccontavalli/enkit/lib/client"
+	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
 	"github.com/ccontavalli/enkit/lib/knetwork/kdns"
+	"github.com/ccontavalli/enkit/lib/oauth"
 	"github.com/ccontavalli/enkit/machinist/config"
 	"github.com/spf13/cobra"
 	"net"
@@ -16,15 +18,43 @@ type controlPlaneFlags struct {
 	BindNet   string
 	StateFile string
 	bf        *client.BaseFlags
+
+	DnsTTL             uint32
+	DnsNameserver      string
+	DnsForwarders      []string
+	DnsTransferAllowed []string
+	DnsForwardAllowed  []string
+	DnsUpdateKeys      []string
+
+	RunACL         string
+	RunMaxTimeout  string
+	StoreDir       string
+	StoreRetention string
+
+	StaleAfter  string
+	ExpireAfter string
+
+	RequireEnrollment bool
+	TokenMaxTTL       string
+	Extractor         *oauth.ExtractorFlags
 }
 
 func NewCommand(bf *client.BaseFlags) *cobra.Command {
 	cpf := &controlPlaneFlags{
-		bf: bf,
+		bf:        bf,
+		Extractor: oauth.DefaultExtractorFlags(),
 	}
 	c := &cobra.Command{
 		Use: "controlplane",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			var updateKeys []kdns.UpdateKey
+			for _, value := range cpf.DnsUpdateKeys {
+				key, err := kdns.ParseUpdateKey(value)
+				if err != nil {
+					return err
+				}
+				updateKeys = append(updateKeys, key)
+			}
 			dnsListener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(cpf.DnsPort)))
 			if err != nil {
 				return err
@@ -34,14 +64,38 @@ func NewCommand(bf *client.BaseFlags) *cobra.Command {
 				return err
 			}
 
-			mController, err := NewController(
+			runMods := []ControllerModifier{
+				WithRunACL(cpf.RunACL),
+				WithRunMaxTimeout(cpf.RunMaxTimeout),
+				WithStoreDir(cpf.StoreDir),
+				WithStoreRetention(cpf.StoreRetention),
+				WithStaleAfter(cpf.StaleAfter),
+				WithExpireAfter(cpf.ExpireAfter),
+				WithRequireEnrollment(cpf.RequireEnrollment),
+				WithTokenMaxTTL(cpf.TokenMaxTTL),
+			}
+			if len(cpf.Extractor.SymmetricKey) > 0 {
+				extractor, err := oauth.NewExtractor(oauth.WithExtractorFlags(cpf.Extractor))
+				if err != nil {
+					return err
+				}
+				runMods = append(runMods, WithAuthenticator(OAuthAuthenticator(extractor)))
+			}
+
+			mController, err := NewController(append(runMods,
 				WithStateFile(cpf.StateFile),
 				WithKDnsFlags(
 					kdns.WithTCPListener(dnsListener),
 					kdns.WithPort(cpf.DnsPort),
 					kdns.WithDomains(cpf.Domains),
+					kdns.WithTTL(cpf.DnsTTL),
+					kdns.WithNameserver(cpf.DnsNameserver),
+					kdns.WithForwarders(cpf.DnsForwarders),
+					kdns.WithForwardAllowed(cpf.DnsForwardAllowed),
+					kdns.WithTransferAllowed(cpf.DnsTransferAllowed),
+					kdns.WithUpdateKeys(updateKeys...),
 				),
-			)
+			)...)
 			if err != nil {
 				return err
 			}
@@ -65,5 +119,20 @@ func NewCommand(bf *client.BaseFlags) *cobra.Command {
 	c.PersistentFlags().StringSliceVar(&cpf.Domains, "domains", []string{}, "domains that the master ControlPlane will be serving")
 	c.PersistentFlags().StringVar(&cpf.BindNet, "bind-net", "127.0.0.1", "the address to bind the grpc listener to")
 	c.PersistentFlags().StringVar(&cpf.StateFile, "state", "", "file to write and load state to")
+	c.PersistentFlags().Uint32Var(&cpf.DnsTTL, "dns-ttl", kdns.DefaultTTL, "TTL in seconds of the dns records generated for the nodes")
+	c.PersistentFlags().StringVar(&cpf.DnsNameserver, "dns-nameserver", "", "name of the nameserver advertised in the SOA and NS records of the domains, defaults to ns.<domain>")
+	c.PersistentFlags().StringSliceVar(&cpf.DnsForwarders, "dns-forward", []string{}, "upstream resolvers to forward queries outside of --domains to, as host or host:port")
+	c.PersistentFlags().StringSliceVar(&cpf.DnsForwardAllowed, "dns-allow-forward", kdns.DefaultForwardAllowed, "networks, in CIDR notation, allowed to have their queries forwarded to --dns-forward - queries from other networks are refused")
+	c.PersistentFlags().StringArrayVar(&cpf.DnsUpdateKeys, "dns-update-key", []string{}, "TSIG key allowed to change records with DNS UPDATE (nsupdate), as [algorithm:]name:base64-secret[:names[:types]] - can be repeated")
+	c.PersistentFlags().StringSliceVar(&cpf.DnsTransferAllowed, "dns-allow-transfer", []string{}, "networks, in CIDR notation, allowed to request a zone transfer (AXFR) of --domains")
+	c.PersistentFlags().StringVar(&cpf.StaleAfter, "stale-after", "1m", "nodes not seen for this long are removed from the _all dns records and the metrics targets - 0 to never consider nodes stale")
+	c.PersistentFlags().StringVar(&cpf.ExpireAfter, "expire-after", "24h", "nodes not seen for this long are forgotten, and removed from dns - 0 to never forget nodes")
+	c.PersistentFlags().BoolVar(&cpf.RequireEnrollment, "require-enrollment", false, "only allow nodes to register after enrolling with a token created with 'machinist token create' - nodes that enrolled always need to present their credential")
+	c.PersistentFlags().StringVar(&cpf.TokenMaxTTL, "token-max-ttl", "24h", "maximum time an enrollment token created with 'machinist token create' is valid for")
+	c.PersistentFlags().StringVar(&cpf.RunACL, "run-acl", "", "file with the rules determining who can run commands and copy files on which nodes, with 'machinist run', 'push' and 'pull', and create enrollment tokens - remote execution and enrollment tokens are disabled if not specified")
+	c.PersistentFlags().StringVar(&cpf.RunMaxTimeout, "run-max-timeout", "1h", "maximum time a command started with 'machinist run' can run for")
+	c.PersistentFlags().StringVar(&cpf.StoreDir, "store-dir", "", "directory where to keep the files copied with 'machinist push' and 'machinist pull' - file transfers are disabled if not specified")
+	c.PersistentFlags().StringVar(&cpf.StoreRetention, "store-retention", "24h", "files in --store-dir not written for this long are deleted, pulled files must be retrieved before then - 0 to keep files forever")
+	cpf.Extractor.Register(&kcobra.FlagSet{FlagSet: c.PersistentFlags()}, "")
 	return c
 }
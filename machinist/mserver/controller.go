@@ -4,14 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
+	"sync"
 	"time"
-	
+
 	"github.com/ccontavalli/enkit/lib/knetwork/kdns"
 	"github.com/ccontavalli/enkit/lib/logger"
 	mpb "github.com/ccontavalli/enkit/machinist/rpc"
 	"github.com/ccontavalli/enkit/machinist/state"
+	"github.com/ccontavalli/enkit/machinist/transfer"
 
 	"github.com/miekg/dns"
 	"google.golang.org/grpc/codes"
@@ -31,11 +34,45 @@ type Controller struct {
 
 	dnsServer *kdns.DnsServer
 	domains   []string
+
+	// Who can run commands on the nodes, remote execution is disabled if either is nil.
+	authenticate  Authenticator
+	runACL        *RunACL
+	runMaxTimeout time.Duration
+
+	// Nodes not seen for staleAfter are removed from the _all records and metrics
+	// targets, nodes not seen for expireAfter are forgotten. Never if 0.
+	staleAfter  time.Duration
+	expireAfter time.Duration
+
+	// Require nodes to enroll with a token before they can register, see CreateToken.
+	requireEnrollment bool
+	// Maximum time an enrollment token can be valid for.
+	tokenMaxTTL time.Duration
+
+	// Files pushed to and pulled from the nodes, file transfers are disabled if nil.
+	store transfer.Store
+	// Files not written for storeRetention are deleted from the store. Never if 0.
+	storeRetention time.Duration
+
+	// Protects sessions, commands and rng.
+	sessionsLock sync.Mutex
+	// Poll streams of the connected nodes, by node name.
+	sessions map[string]*pollSession
+	// Commands dispatched to nodes, by command id.
+	commands map[string]*command
+	rng      *rand.Rand
 }
 
 // Init is designed to run after all components have been started up before running itself as a server
 func (en *Controller) Init() {
-	for _, m := range en.State.Machines {
+	// Nodes loaded from the state file may have never been seen, consider them just seen.
+	for _, m := range en.Nodes() {
+		if m.LastSeen.IsZero() {
+			state.TouchMachine(en.State, m.Name, time.Now())
+		}
+	}
+	for _, m := range en.Nodes() {
 		en.addNodeToDns(m.Name, m.Ips, m.Tags)
 	}
 }
@@ -48,14 +85,6 @@ func (en *Controller) Nodes() []*state.Machine {
 	return nodes
 }
 
-func (en *Controller) Download(*mpb.DownloadRequest, mpb.Controller_DownloadServer) error {
-	return nil
-}
-
-func (en *Controller) Upload(mpb.Controller_UploadServer) error {
-	return nil
-}
-
 func (en *Controller) HandlePing(stream mpb.Controller_PollServer, ping *mpb.ClientPing) error {
 	return stream.Send(
 		&mpb.PollResponse{
@@ -78,25 +107,56 @@ func (en *Controller) HandleRegister(stream mpb.Controller_PollServer, ping *mpb
 	if len(parsedIps) == 0 {
 		return errors.New("no valid ip sent")
 	}
+	now := time.Now()
 	newMachine := &state.Machine{
-		Name: ping.Name,
-		Ips:  parsedIps,
-		Tags: ping.Tag,
+		Name:       ping.Name,
+		Ips:        parsedIps,
+		Tags:       ping.Tag,
+		Registered: now,
+		LastSeen:   now,
+	}
+	existing := state.GetMachine(en.State, ping.Name)
+	enrolled, err := en.authorizeRegister(ping, existing)
+	if err != nil {
+		en.Log.Warnf("node %s not allowed to register - %v", ping.Name, err)
+		return err
+	}
+	if err := en.checkReplace(existing, newMachine, enrolled, now); err != nil {
+		en.Log.Warnf("node %s not allowed to register - %v", ping.Name, err)
+		return err
+	}
+	newMachine.Credential = enrolled.hash
+	newMachine.AllowedTags = enrolled.allowedTags
+	if existing != nil && !existing.Registered.IsZero() {
+		newMachine.Registered = existing.Registered
 	}
 	if err := state.AddMachine(en.State, newMachine); err != nil {
-		return status.Errorf(codes.AlreadyExists, err.Error())
+		return status.Errorf(codes.AlreadyExists, "%v", err)
+	}
+	if existing == nil || !sameMachine(existing, newMachine) {
+		en.Log.Infof("node %s registered with ips %v tags %v", newMachine.Name, newMachine.Ips, newMachine.Tags)
+		en.addNodeToDns(ping.Name, newMachine.Ips, newMachine.Tags)
 	}
-	en.addNodeToDns(ping.Name, newMachine.Ips, newMachine.Tags)
 	return stream.Send(
 		&mpb.PollResponse{
 			Resp: &mpb.PollResponse_Result{
-				Result: &mpb.ActionResult{},
+				Result: &mpb.ActionResult{Credential: enrolled.credential},
 			},
 		})
 
 }
 
 func (en *Controller) Poll(stream mpb.Controller_PollServer) error {
+	session := &pollSession{Controller_PollServer: stream}
+	defer en.closeSession(session)
+
+	// Name of the node, once registered.
+	name := ""
+	defer func() {
+		if name != "" {
+			state.TouchMachine(en.State, name, time.Now())
+		}
+	}()
 	for {
 		in, err := stream.Recv()
 		if err != nil {
@@ -105,57 +165,72 @@ func (en *Controller) Poll(stream mpb.Controller_PollServer) error {
 
 		switch r := in.Req.(type) {
 		case *mpb.PollRequest_Ping:
-			en.HandlePing(stream, r.Ping)
+			if name != "" {
+				state.TouchMachine(en.State, name, time.Now())
+			}
+			en.HandlePing(session, r.Ping)
 
 		case *mpb.PollRequest_Register:
-			if err = en.HandleRegister(stream, r.Register); err != nil {
+			if err = en.HandleRegister(session, r.Register); err != nil {
 				return err
 			}
+			en.addSession(r.Register.Name, session)
+			name = r.Register.Name
+
+		case *mpb.PollRequest_Result:
+			en.HandleResult(session, r.Result)
 		}
 	}
 }
 
+// addNodeToDns creates or replaces the records of a node, one A or AAAA record per ip, and a TXT record per tag.
+//
+// Records are created with a TTL of 0, so the dns server assigns them the configured TTL.
 func (en *Controller) addNodeToDns(name string, ips []net.IP, tags []string) {
 	for _, d := range en.dnsServer.Domains {
 		dnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", name, d))
-		var recordTags []dns.RR
+		records := map[uint16][]dns.RR{}
 		for _, t := range tags {
-			entry, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, "TXT", t))
+			entry, err := dns.NewRR(fmt.Sprintf("%s 0 %s %s", dnsName, "TXT", t))
 			if err != nil {
 				continue
 			}
-			recordTags = append(recordTags, entry)
+			records[dns.TypeTXT] = append(records[dns.TypeTXT], entry)
 		}
 		for _, i := range ips {
-			var recordType string
+			recordType := "AAAA"
 			if i.To4() != nil {
 				recordType = "A"
 			}
-			if i.To16() != nil && recordType == "" {
-				recordType = "AAAA"
-			}
-			if recordType != "" {
-				entry, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, recordType, i.String()))
-				if err != nil {
-					continue
-				}
-				en.Log.Infof("Adding %s to the dns ControlPlane %s", dnsName, entry)
-				en.dnsServer.SetEntry(dnsName, []dns.RR{entry})
-				en.dnsServer.SetEntry(dnsName, recordTags)
+			entry, err := dns.NewRR(fmt.Sprintf("%s 0 %s %s", dnsName, recordType, i.String()))
+			if err != nil {
+				continue
 			}
+			records[entry.Header().Rrtype] = append(records[entry.Header().Rrtype], entry)
+		}
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT} {
+			en.dnsServer.ReplaceEntry(dnsName, t, records[t])
 		}
 	}
 }
 
-// ServeAllAndInfoRecords will continuously poll Nodes() and create multiple _all.<domain> records containing the ip addresses
-// of all machines attached.
+// removeNodeFromDns deletes the records created by addNodeToDns.
+func (en *Controller) removeNodeFromDns(name string) {
+	en.addNodeToDns(name, nil, nil)
+}
+
+// ServeAllAndInfoRecords will continuously poll LiveNodes() and create multiple _all.<domain> records containing the ip addresses
+// of all machines attached and not stale. Expired machines are removed at the same time.
 // It also serves the current state of the dns server via the _info record.
 // TODO(adam): be able to pass in a wrapped ticker for testing intervals
 func (en *Controller) ServeAllAndInfoRecords(killChannel chan struct{}, killChannelAck chan struct{}) {
 	for {
 		select {
 		case <-time.After(en.allRecordsRefreshRate):
-			ns := en.Nodes()
+			en.ExpireNodes(time.Now())
+			en.ExpireFiles(time.Now())
+			state.ExpireTokens(en.State, time.Now())
+			ns := en.LiveNodes(time.Now())
 			for _, d := range en.dnsServer.Domains {
 				dnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", "_all", d))
 				infoDnsName := dns.CanonicalName(fmt.Sprintf("%s.%s", "_info", d))
@@ -163,20 +238,23 @@ func (en *Controller) ServeAllAndInfoRecords(killChannel chan struct{}, killChan
 				var infoDnsRecords []dns.RR
 				for _, v := range ns {
 					for _, i := range v.Ips {
-						rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", dnsName, "A", i.String()))
+						rr, err := dns.NewRR(fmt.Sprintf("%s 0 %s %s", dnsName, "A", i.String()))
 						if err != nil {
 							en.Log.Errorf("err: %v", err)
+							continue
 						}
-						infoRR, err := dns.NewRR(fmt.Sprintf("%s %s { name: %s, ip: %s }", infoDnsName, "TXT", v.Name, i.String()))
+						infoRR, err := dns.NewRR(fmt.Sprintf("%s 0 %s { name: %s, ip: %s }", infoDnsName, "TXT", v.Name, i.String()))
 						if err != nil {
 							en.Log.Errorf("err: %v", err)
+							continue
 						}
 						allDnsRecords = append(allDnsRecords, rr)
 						infoDnsRecords = append(infoDnsRecords, infoRR)
 					}
 				}
-				en.dnsServer.SetEntry(dnsName, allDnsRecords)
-				en.dnsServer.SetEntry(infoDnsName, infoDnsRecords)
+				// Only replace the records managed here, leaving any other record type added to the names.
+				en.dnsServer.ReplaceEntry(dnsName, dns.TypeA, allDnsRecords)
+				en.dnsServer.ReplaceEntry(infoDnsName, dns.TypeTXT, infoDnsRecords)
 			}
 		case <-killChannel:
 			killChannelAck <- struct{}{}
@@ -190,7 +268,7 @@ func (en *Controller) ServeAllAndInfoRecords(killChannel chan struct{}, killChan
 // https://prometheus.io/docs/prometheus/latest/configuration/configuration/#http_sd_config.
 // Set a "hostname" label on all metrics from this host.
 func scrapeConfigForHost(hostname string, addrs []string) map[string]interface{} {
-	return map[string]interface{} {
+	return map[string]interface{}{
 		"targets": addrs,
 		"labels": map[string]string{
 			"hostname": hostname,
@@ -202,7 +280,7 @@ func scrapeConfigForHost(hostname string, addrs []string) map[string]interface{}
 // https://prometheus.io/docs/prometheus/latest/configuration/configuration/#http_sd_config.
 func (en *Controller) MetricsTargets(w http.ResponseWriter, r *http.Request) {
 	scrapeConfig := []map[string]interface{}{}
-	for _, node := range en.Nodes() {
+	for _, node := range en.LiveNodes(time.Now()) {
 		var ips []string
 		for _, ip := range node.Ips {
 			ips = append(ips, ip.String())
@@ -0,0 +1,156 @@
+package mserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+	"github.com/ccontavalli/enkit/machinist/state"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newSecret returns a random string to use as enrollment token or node credential, and its hash.
+//
+// Only the hash is kept by the controller.
+func newSecret() (string, string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(data)
+	return secret, hashSecret(secret), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken returns a new enrollment token, valid for the names and tags requested.
+//
+// The caller must be allowed to enroll nodes with the names and tags by the run acl.
+func (en *Controller) CreateToken(ctx context.Context, req *mpb.CreateTokenRequest) (*mpb.CreateTokenResponse, error) {
+	if en.authenticate == nil || en.runACL == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "enrollment tokens are not enabled on this controller")
+	}
+	identity, err := en.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Uses < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid number of uses %d", req.Uses)
+	}
+	if !en.runACL.AllowedEnroll(identity, req.Names, req.Tags) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed to enroll nodes with names %v tags %v", identity, req.Names, req.Tags)
+	}
+
+	token, hash, err := newSecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not generate token - %v", err)
+	}
+	uses := int(req.Uses)
+	if uses == 0 {
+		uses = 1
+	}
+	ttl := en.tokenMaxTTL
+	if requested := time.Duration(req.TtlMs) * time.Millisecond; requested > 0 && requested < ttl {
+		ttl = requested
+	}
+	expires := time.Now().Add(ttl)
+	state.AddToken(en.State, &state.EnrollmentToken{
+		Hash:    hash,
+		Creator: identity,
+		Names:   req.Names,
+		Tags:    req.Tags,
+		Uses:    uses,
+		Expires: expires,
+	})
+
+	en.Log.Infof("%s created an enrollment token for %d nodes with names %v tags %v, expiring %s", identity, uses, req.Names, req.Tags, expires.Format(time.RFC3339))
+	return &mpb.CreateTokenResponse{Token: token, Expires: timestamppb.New(expires)}, nil
+}
+
+// enrollment is the outcome of authorizeRegister.
+type enrollment struct {
+	// Credential issued to the node, if it just enrolled.
+	credential string
+	// Hash of the credential and tags allowed, to store with the node.
+	hash        string
+	allowedTags []string
+}
+
+// checkTags returns an error if any of the tags does not match the patterns, unless there are no patterns.
+func checkTags(patterns, tags []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	for _, tag := range tags {
+		if !matchAny(patterns, tag) {
+			return status.Errorf(codes.PermissionDenied, "tag %q is not allowed, allowed tags are %s", tag, strings.Join(patterns, ", "))
+		}
+	}
+	return nil
+}
+
+// authorizeRegister verifies the node is allowed to register with the name and tags requested.
+//
+// Nodes presenting a valid enrollment token are issued a new credential. Once a node has
+// a credential, it must present it every time it registers, until the node expires, or
+// enroll again with a token listing its exact name.
+// Nodes can register without token or credential only if enrollment is not required.
+func (en *Controller) authorizeRegister(req *mpb.ClientRegister, existing *state.Machine) (*enrollment, error) {
+	if req.Credential != "" {
+		if existing == nil || existing.Credential == "" ||
+			subtle.ConstantTimeCompare([]byte(hashSecret(req.Credential)), []byte(existing.Credential)) != 1 {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid credential for node %s, the node needs to enroll again", req.Name)
+		}
+		if err := checkTags(existing.AllowedTags, req.Tag); err != nil {
+			return nil, err
+		}
+		return &enrollment{hash: existing.Credential, allowedTags: existing.AllowedTags}, nil
+	}
+
+	if req.Token != "" {
+		token, err := state.UseToken(en.State, hashSecret(req.Token), time.Now(), func(token *state.EnrollmentToken) error {
+			if len(token.Names) > 0 && !matchAny(token.Names, req.Name) {
+				return status.Errorf(codes.PermissionDenied, "enrollment token does not allow the name %s", req.Name)
+			}
+			// Enrolling again issues a new credential, taking over the name and its
+			// DNS records: only allowed with a token created for that very node.
+			if existing != nil && existing.Credential != "" && !slices.Contains(token.Names, req.Name) {
+				return status.Errorf(codes.PermissionDenied, "node %s is already enrolled, only a token created with --name=%s can enroll it again", req.Name, req.Name)
+			}
+			return checkTags(token.Tags, req.Tag)
+		})
+		if err != nil {
+			if _, ok := status.FromError(err); !ok {
+				err = status.Errorf(codes.Unauthenticated, "%v", err)
+			}
+			return nil, err
+		}
+		credential, hash, err := newSecret()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not generate credential - %v", err)
+		}
+		en.Log.Infof("node %s enrolled with a token created by %s, %d uses left", req.Name, token.Creator, token.Uses)
+		return &enrollment{credential: credential, hash: hash, allowedTags: token.Tags}, nil
+	}
+
+	if existing != nil && existing.Credential != "" {
+		return nil, status.Errorf(codes.Unauthenticated, "node %s is enrolled, and must present its credential", req.Name)
+	}
+	if en.requireEnrollment {
+		return nil, status.Errorf(codes.Unauthenticated, "node %s must enroll with a token, as created with 'machinist token create'", req.Name)
+	}
+	return &enrollment{}, nil
+}
@@ -3,8 +3,11 @@ package mserver
 import (
 	"github.com/ccontavalli/enkit/lib/knetwork/kdns"
 	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/ccontavalli/enkit/lib/srand"
 	"github.com/ccontavalli/enkit/machinist/state"
+	"github.com/ccontavalli/enkit/machinist/transfer"
 	"log"
+	"math/rand"
 	"time"
 )
 
@@ -13,7 +16,15 @@ func NewController(mods ...ControllerModifier) (*Controller, error) {
 		State:                 &state.MachineController{},
 		stateWriteTTL:         time.Second * 30,
 		allRecordsRefreshRate: time.Second * 5,
+		runMaxTimeout:         time.Hour,
+		staleAfter:            time.Minute,
+		expireAfter:           24 * time.Hour,
+		tokenMaxTTL:           24 * time.Hour,
+		storeRetention:        24 * time.Hour,
 		Log:                   &logger.DefaultLogger{Printer: log.Printf},
+		sessions:              map[string]*pollSession{},
+		commands:              map[string]*command{},
+		rng:                   rand.New(srand.Source),
 	}
 	for _, m := range mods {
 		if err := m(en); err != nil {
@@ -72,3 +83,127 @@ func WithAllRecordsRefreshRate(duration string) ControllerModifier {
 		return nil
 	}
 }
+
+// WithStaleAfter sets how long a node can go without being seen before it is considered stale.
+//
+// Stale nodes are removed from the _all dns records and the metrics targets. 0 to disable.
+func WithStaleAfter(duration string) ControllerModifier {
+	return func(controller *Controller) error {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		controller.staleAfter = d
+		return nil
+	}
+}
+
+// WithExpireAfter sets how long a node can go without being seen before it is forgotten. 0 to disable.
+func WithExpireAfter(duration string) ControllerModifier {
+	return func(controller *Controller) error {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		controller.expireAfter = d
+		return nil
+	}
+}
+
+// WithAuthenticator configures how to determine the identity of users running commands.
+func WithAuthenticator(auth Authenticator) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.authenticate = auth
+		return nil
+	}
+}
+
+// WithRunACL loads the rules determining who can run commands on the nodes.
+//
+// Without rules, or if path is empty, remote execution is disabled.
+func WithRunACL(path string) ControllerModifier {
+	return func(controller *Controller) error {
+		if path == "" {
+			return nil
+		}
+		acl, err := LoadRunACL(path)
+		if err != nil {
+			return err
+		}
+		controller.runACL = acl
+		return nil
+	}
+}
+
+// WithRunMaxTimeout sets the maximum time a command run on the nodes can take.
+func WithRunMaxTimeout(duration string) ControllerModifier {
+	return func(controller *Controller) error {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		controller.runMaxTimeout = d
+		return nil
+	}
+}
+
+// WithRequireEnrollment requires nodes to enroll with a token before they can register.
+//
+// Nodes that enrolled must always present their credential, regardless of this option.
+func WithRequireEnrollment(require bool) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.requireEnrollment = require
+		return nil
+	}
+}
+
+// WithTokenMaxTTL sets the maximum time an enrollment token can be valid for.
+func WithTokenMaxTTL(duration string) ControllerModifier {
+	return func(controller *Controller) error {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		controller.tokenMaxTTL = d
+		return nil
+	}
+}
+
+// WithStore configures where to keep the files pushed to and pulled from the nodes.
+func WithStore(store transfer.Store) ControllerModifier {
+	return func(controller *Controller) error {
+		controller.store = store
+		return nil
+	}
+}
+
+// WithStoreDir keeps the files pushed to and pulled from the nodes in a local directory.
+//
+// If dir is empty, file transfers are disabled.
+func WithStoreDir(dir string) ControllerModifier {
+	return func(controller *Controller) error {
+		if dir == "" {
+			return nil
+		}
+		store, err := transfer.NewDirStore(dir)
+		if err != nil {
+			return err
+		}
+		controller.store = store
+		return nil
+	}
+}
+
+// WithStoreRetention sets how long the files pushed to and pulled from the nodes are kept in the store.
+//
+// Files are deleted once not written for this long, unless a transfer is in progress. 0 to keep them forever.
+func WithStoreRetention(duration string) ControllerModifier {
+	return func(controller *Controller) error {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		controller.storeRetention = d
+		return nil
+	}
+}
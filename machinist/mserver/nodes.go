@@ -0,0 +1,163 @@
+package mserver
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+	"github.com/ccontavalli/enkit/machinist/state"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sameMachine returns true if the machines have the same ips and tags.
+func sameMachine(a, b *state.Machine) bool {
+	if len(a.Ips) != len(b.Ips) || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range a.Ips {
+		if !a.Ips[i].Equal(b.Ips[i]) {
+			return false
+		}
+	}
+	for i := range a.Tags {
+		if a.Tags[i] != b.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameIps returns true if the machines have the same ips, in any order.
+func sameIps(a, b *state.Machine) bool {
+	if len(a.Ips) != len(b.Ips) {
+		return false
+	}
+	for _, ip := range a.Ips {
+		found := false
+		for _, other := range b.Ips {
+			found = found || ip.Equal(other)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkReplace returns an error unless node can take the place of the existing node with the same name.
+//
+// A node still live can only be replaced by a node proving to be the same: presenting its
+// credential, enrolling again with a token or, if it never enrolled and enrollment is not
+// required, registering with the same ips. Otherwise, commands and transfers for the name
+// would be sent to whoever registered last.
+func (en *Controller) checkReplace(existing, node *state.Machine, enrolled *enrollment, now time.Time) error {
+	if existing == nil || en.isStale(existing, now) {
+		return nil
+	}
+	// authorizeRegister verified the credential or the token presented.
+	if enrolled.hash != "" {
+		return nil
+	}
+	if !en.requireEnrollment && existing.Credential == "" && sameIps(existing, node) {
+		return nil
+	}
+	return status.Errorf(codes.AlreadyExists, "node %s is already registered with ips %v, and was seen %s ago", existing.Name, existing.Ips, now.Sub(existing.LastSeen).Round(time.Second))
+}
+
+// isStale returns true if the node has not been seen for longer than the stale threshold.
+//
+// Nodes with a Poll stream open are never stale, no matter how often they send requests.
+func (en *Controller) isStale(node *state.Machine, now time.Time) bool {
+	return en.staleAfter > 0 && now.Sub(node.LastSeen) > en.staleAfter && !en.connected(node.Name)
+}
+
+// LiveNodes returns the nodes that are not stale, those seen within the stale threshold.
+func (en *Controller) LiveNodes(now time.Time) []*state.Machine {
+	var live []*state.Machine
+	for _, node := range en.Nodes() {
+		if !en.isStale(node, now) {
+			live = append(live, node)
+		}
+	}
+	return live
+}
+
+// ExpireNodes forgets the nodes not seen for longer than the expire threshold, removing their dns records.
+//
+// Nodes with a Poll stream open are considered just seen.
+func (en *Controller) ExpireNodes(now time.Time) {
+	if en.expireAfter <= 0 {
+		return
+	}
+	for _, node := range en.Nodes() {
+		if en.connected(node.Name) {
+			state.TouchMachine(en.State, node.Name, now)
+		}
+	}
+	for _, node := range state.ExpireMachines(en.State, now.Add(-en.expireAfter)) {
+		en.Log.Infof("node %s expired, last seen %s", node.Name, node.LastSeen.Format(time.RFC3339))
+		en.removeNodeFromDns(node.Name)
+	}
+}
+
+// connected returns true if the node has a Poll stream open.
+func (en *Controller) connected(name string) bool {
+	en.sessionsLock.Lock()
+	defer en.sessionsLock.Unlock()
+	return en.sessions[name] != nil
+}
+
+// hasTags returns true if the node has all the tags.
+func hasTags(node *state.Machine, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range node.Tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ListNodes returns the nodes with the tags requested, sorted by name.
+//
+// If an authenticator is configured, the caller must be authenticated.
+func (en *Controller) ListNodes(ctx context.Context, req *mpb.ListNodesRequest) (*mpb.ListNodesResponse, error) {
+	if en.authenticate != nil {
+		if _, err := en.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	resp := &mpb.ListNodesResponse{}
+	for _, node := range en.Nodes() {
+		stale := en.isStale(node, now)
+		if (stale && !req.IncludeStale) || !hasTags(node, req.Tags) {
+			continue
+		}
+		var ips []string
+		for _, ip := range node.Ips {
+			ips = append(ips, ip.String())
+		}
+		resp.Nodes = append(resp.Nodes, &mpb.Node{
+			Name:       node.Name,
+			Ips:        ips,
+			Tags:       node.Tags,
+			Registered: timestamppb.New(node.Registered),
+			LastSeen:   timestamppb.New(node.LastSeen),
+			Stale:      stale,
+			Connected:  en.connected(node.Name),
+		})
+	}
+	sort.Slice(resp.Nodes, func(i, j int) bool {
+		return resp.Nodes[i].Name < resp.Nodes[j].Name
+	})
+	return resp, nil
+}
@@ -0,0 +1,329 @@
+package mserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccontavalli/enkit/machinist/polling"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+	"github.com/ccontavalli/enkit/machinist/state"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// kRunGrace is how long to wait for a node to report the exit status of a command
+// past its timeout, before considering the node lost.
+const kRunGrace = 30 * time.Second
+
+// pollSession serializes the messages sent over a Poll stream.
+//
+// Responses to the node are sent by the Poll handler, while actions are sent
+// by the Run handlers, concurrently.
+type pollSession struct {
+	mpb.Controller_PollServer
+	lock sync.Mutex
+}
+
+func (ps *pollSession) Send(resp *mpb.PollResponse) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.Controller_PollServer.Send(resp)
+}
+
+// command is a command or transfer dispatched to a node, waiting for results.
+type command struct {
+	id      string
+	node    string
+	session *pollSession
+
+	// For transfers, key of the file the node is allowed to download or, if upload is set, upload.
+	key    string
+	upload bool
+
+	// Channel of the Run handler, where the results are forwarded.
+	results chan<- *mpb.RunResponse
+	// Closed when the Run handler returns, and results are no longer accepted.
+	done <-chan struct{}
+}
+
+func (c *command) deliver(resp *mpb.RunResponse) {
+	select {
+	case c.results <- resp:
+	case <-c.done:
+	}
+}
+
+func exitResponse(node string, exit *mpb.CommandExit) *mpb.RunResponse {
+	return &mpb.RunResponse{Node: node, Output: &mpb.RunResponse_Exit{Exit: exit}}
+}
+
+// addSession records the Poll stream used by a node, so commands can be dispatched to it.
+func (en *Controller) addSession(node string, session *pollSession) {
+	en.sessionsLock.Lock()
+	defer en.sessionsLock.Unlock()
+	en.sessions[node] = session
+}
+
+// closeSession forgets a Poll stream, failing all the commands dispatched over it.
+func (en *Controller) closeSession(session *pollSession) {
+	en.sessionsLock.Lock()
+	for node, existing := range en.sessions {
+		if existing == session {
+			delete(en.sessions, node)
+		}
+	}
+	var lost []*command
+	for id, cmd := range en.commands {
+		if cmd.session == session {
+			lost = append(lost, cmd)
+			delete(en.commands, id)
+		}
+	}
+	en.sessionsLock.Unlock()
+
+	for _, cmd := range lost {
+		cmd.deliver(exitResponse(cmd.node, &mpb.CommandExit{Status: polling.ExitError, Error: "lost connection to node"}))
+	}
+}
+
+// startCommand dispatches a command to a node.
+//
+// action returns the message to send to the node. It is invoked before the command is
+// registered, and can set its key to authorize a transfer.
+func (en *Controller) startCommand(node string, action func(cmd *command) *mpb.PollResponse, results chan<- *mpb.RunResponse, done <-chan struct{}) (*command, error) {
+	en.sessionsLock.Lock()
+	session := en.sessions[node]
+	if session == nil {
+		en.sessionsLock.Unlock()
+		return nil, fmt.Errorf("node is not connected")
+	}
+	cmd := &command{
+		id:      fmt.Sprintf("%s-%016x", node, en.rng.Uint64()),
+		node:    node,
+		session: session,
+		results: results,
+		done:    done,
+	}
+	resp := action(cmd)
+	en.commands[cmd.id] = cmd
+	en.sessionsLock.Unlock()
+
+	if err := session.Send(resp); err != nil {
+		en.removeCommand(cmd.id)
+		return nil, fmt.Errorf("could not send command to node - %w", err)
+	}
+	return cmd, nil
+}
+
+func (en *Controller) removeCommand(id string) *command {
+	en.sessionsLock.Lock()
+	defer en.sessionsLock.Unlock()
+	cmd := en.commands[id]
+	delete(en.commands, id)
+	return cmd
+}
+
+// stopCommand forgets a command, asking the node to stop it if it is still running.
+func (en *Controller) stopCommand(cmd *command) {
+	if en.removeCommand(cmd.id) == nil {
+		return
+	}
+	if err := cmd.session.Send(&mpb.PollResponse{Resp: &mpb.PollResponse_Cancel{Cancel: &mpb.ActionCancel{Id: cmd.id}}}); err != nil {
+		en.Log.Warnf("could not cancel command %s on %s - %v", cmd.id, cmd.node, err)
+	}
+}
+
+// HandleResult forwards the output of a command sent by a node to the user that requested it.
+//
+// Results are only accepted from the session the command was sent to: a node cannot
+// report output or exit status for commands running on other nodes.
+func (en *Controller) HandleResult(stream mpb.Controller_PollServer, result *mpb.ClientResult) {
+	en.sessionsLock.Lock()
+	cmd := en.commands[result.Id]
+	if cmd != nil && cmd.session != stream {
+		en.Log.Warnf("dropping result for command %s on %s - sent by a different node", result.Id, cmd.node)
+		cmd = nil
+	}
+	if cmd != nil && result.GetExit() != nil {
+		delete(en.commands, result.Id)
+	}
+	en.sessionsLock.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	resp := &mpb.RunResponse{Node: cmd.node}
+	switch r := result.Result.(type) {
+	case *mpb.ClientResult_Stdout:
+		resp.Output = &mpb.RunResponse_Stdout{Stdout: r.Stdout}
+	case *mpb.ClientResult_Stderr:
+		resp.Output = &mpb.RunResponse_Stderr{Stderr: r.Stderr}
+	case *mpb.ClientResult_Exit:
+		resp.Output = &mpb.RunResponse_Exit{Exit: r.Exit}
+		if cmd.upload && r.Exit.Status == 0 {
+			resp.Key = cmd.key
+		}
+	default:
+		return
+	}
+	cmd.deliver(resp)
+}
+
+// targets returns the connected and disconnected nodes with the name or tag.
+func (en *Controller) targets(name, tag string) []*state.Machine {
+	var nodes []*state.Machine
+	for _, node := range en.Nodes() {
+		if name != "" && node.Name == name {
+			nodes = append(nodes, node)
+			continue
+		}
+		for _, t := range node.Tags {
+			if tag != "" && t == tag {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	return nodes
+}
+
+// selectNodes authenticates the caller, and returns the nodes with the name or tag.
+//
+// allowed is invoked for each node, and returns a description of the operation if the
+// caller is not allowed to perform it on the node, or the empty string otherwise.
+func (en *Controller) selectNodes(ctx context.Context, name, tag string, allowed func(identity string, node *state.Machine) string) (string, []*state.Machine, error) {
+	if en.authenticate == nil || en.runACL == nil {
+		return "", nil, status.Errorf(codes.FailedPrecondition, "remote execution is not enabled on this controller")
+	}
+	identity, err := en.authenticate(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if (name == "") == (tag == "") {
+		return "", nil, status.Errorf(codes.InvalidArgument, "exactly one of node or tag must be specified")
+	}
+
+	nodes := en.targets(name, tag)
+	if len(nodes) == 0 {
+		return "", nil, status.Errorf(codes.NotFound, "no node matches node %q tag %q", name, tag)
+	}
+	for _, node := range nodes {
+		if denied := allowed(identity, node); denied != "" {
+			return "", nil, status.Errorf(codes.PermissionDenied, "%s is not allowed to %s on %s", identity, denied, node.Name)
+		}
+	}
+	return identity, nodes, nil
+}
+
+// timeout returns the timeout to use for an operation, given the one requested by the user.
+func (en *Controller) timeout(requestedMs int64) time.Duration {
+	timeout := en.runMaxTimeout
+	if requested := time.Duration(requestedMs) * time.Millisecond; requested > 0 && requested < timeout {
+		timeout = requested
+	}
+	return timeout
+}
+
+// names returns the names of the nodes, for logging.
+func names(nodes []*state.Machine) string {
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// dispatch starts a command on each node, and streams back the results until all nodes report an exit status.
+//
+// Nodes that are not connected are reported with a polling.ExitError status, nodes that do not
+// report an exit status within the timeout with a polling.ExitTimeout status.
+func (en *Controller) dispatch(stream grpc.ServerStreamingServer[mpb.RunResponse], nodes []*state.Machine, timeout time.Duration, action func(cmd *command) *mpb.PollResponse) error {
+	ctx, cancel := context.WithTimeout(stream.Context(), timeout+kRunGrace)
+	defer cancel()
+
+	results := make(chan *mpb.RunResponse, 64)
+	done := make(chan struct{})
+	defer close(done)
+
+	running := map[string]*command{}
+	for _, node := range nodes {
+		cmd, err := en.startCommand(node.Name, action, results, done)
+		if err != nil {
+			if err := stream.Send(exitResponse(node.Name, &mpb.CommandExit{Status: polling.ExitError, Error: err.Error()})); err != nil {
+				return err
+			}
+			continue
+		}
+		defer en.stopCommand(cmd)
+		running[node.Name] = cmd
+	}
+
+	for len(running) > 0 {
+		select {
+		case resp := <-results:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			if resp.GetExit() != nil {
+				delete(running, resp.Node)
+			}
+
+		case <-ctx.Done():
+			if err := stream.Context().Err(); err != nil {
+				return status.FromContextError(err).Err()
+			}
+			for node := range running {
+				exit := &mpb.CommandExit{Status: polling.ExitTimeout, Timeout: true, Error: "node did not report the exit status in time"}
+				if err := stream.Send(exitResponse(node, exit)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Run runs a command on the nodes selected by the request, streaming back output and exit status.
+//
+// The caller must be allowed to run the command on all the nodes by the run acl. Nodes
+// that are not connected are reported with a polling.ExitError status.
+func (en *Controller) Run(req *mpb.RunRequest, stream mpb.Controller_RunServer) error {
+	if len(req.Argv) == 0 {
+		return status.Errorf(codes.InvalidArgument, "no command to run")
+	}
+	line := strings.Join(req.Argv, " ")
+	identity, nodes, err := en.selectNodes(stream.Context(), req.Node, req.Tag, func(identity string, node *state.Machine) string {
+		if !en.runACL.Allowed(identity, node, req.Argv, req.Env, req.Workdir) {
+			op := fmt.Sprintf("run %q", line)
+			if len(req.Env) > 0 {
+				op += fmt.Sprintf(" with env %q", req.Env)
+			}
+			if req.Workdir != "" {
+				op += fmt.Sprintf(" in %s", req.Workdir)
+			}
+			return op
+		}
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+
+	timeout := en.timeout(req.TimeoutMs)
+	en.Log.Infof("%s is running %q on %s, timeout %s", identity, line, names(nodes), timeout)
+	return en.dispatch(stream, nodes, timeout, func(cmd *command) *mpb.PollResponse {
+		return &mpb.PollResponse{Resp: &mpb.PollResponse_Start{Start: &mpb.ActionSession{
+			Id:        cmd.id,
+			Argv:      req.Argv,
+			Env:       req.Env,
+			Workdir:   req.Workdir,
+			TimeoutMs: timeout.Milliseconds(),
+		}}}
+	})
+}
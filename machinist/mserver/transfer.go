@@ -0,0 +1,350 @@
+package mserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+	"github.com/ccontavalli/enkit/machinist/state"
+	"github.com/ccontavalli/enkit/machinist/transfer"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ways a file in the store can be accessed, as checked by authorizeKey.
+const (
+	accessStat = iota
+	accessUpload
+	accessDownload
+)
+
+// pullPrefix returns the prefix of the keys of the files pulled by a user.
+func pullPrefix(identity string) string {
+	return "pull/" + identity + "/"
+}
+
+// storeError converts an error returned by the store into a grpc status.
+func storeError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return status.Errorf(codes.NotFound, "%v", err)
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
+
+// pendingTransfer returns true if a node is expected to access the file with key, as requested by a Push or Pull.
+func (en *Controller) pendingTransfer(key string, access int) bool {
+	en.sessionsLock.Lock()
+	defer en.sessionsLock.Unlock()
+	for _, cmd := range en.commands {
+		if cmd.key != key {
+			continue
+		}
+		if access == accessStat || (access == accessUpload) == cmd.upload {
+			return true
+		}
+	}
+	return false
+}
+
+// transfersPending returns true if any node is expected to access a file in the store.
+func (en *Controller) transfersPending() bool {
+	en.sessionsLock.Lock()
+	defer en.sessionsLock.Unlock()
+	for _, cmd := range en.commands {
+		if cmd.key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireFiles deletes the files in the store not written for longer than the retention.
+//
+// Files pulled from the nodes are never read again by the controller, and files
+// uploaded to be pushed can be reused by checksum only until then. Nothing is deleted
+// while a transfer is in progress, as the nodes may be reading or writing the files.
+func (en *Controller) ExpireFiles(now time.Time) {
+	expirer, ok := en.store.(transfer.Expirer)
+	if !ok || en.storeRetention <= 0 || en.transfersPending() {
+		return
+	}
+	expired, err := expirer.Expire(now.Add(-en.storeRetention))
+	if err != nil {
+		en.Log.Warnf("could not expire files in the store - %v", err)
+	}
+	if expired > 0 {
+		en.Log.Infof("deleted %d files not written for %s from the store", expired, en.storeRetention)
+	}
+}
+
+// authorizeKey checks that the caller can access the file with key in the store.
+//
+// Nodes can only access the files of the transfers dispatched to them. Users can upload
+// and download files by checksum, as in sha256:<hex>, and download the files they pulled.
+func (en *Controller) authorizeKey(ctx context.Context, key string, access int) error {
+	if en.store == nil {
+		return status.Errorf(codes.FailedPrecondition, "file transfers are not enabled on this controller")
+	}
+	if key == "" {
+		return status.Errorf(codes.InvalidArgument, "no key specified")
+	}
+	if en.pendingTransfer(key, access) {
+		return nil
+	}
+	if en.authenticate == nil {
+		return status.Errorf(codes.PermissionDenied, "no transfer in progress for %s", key)
+	}
+	identity, err := en.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	return authorizeUserKey(identity, key, access)
+}
+
+// authorizeUserKey checks that the user with identity can access the file with key in the store.
+func authorizeUserKey(identity, key string, access int) error {
+	if _, err := transfer.ParseChecksum(key); err == nil {
+		return nil
+	}
+	if access != accessUpload && strings.HasPrefix(key, pullPrefix(identity)) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "%s is not allowed to access %s", identity, key)
+}
+
+// checkPath returns an error unless path is absolute and clean.
+//
+// Paths with . or .. components, or repeated separators, would bypass the patterns in the run acl.
+func checkPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return status.Errorf(codes.InvalidArgument, "path %q must be absolute", path)
+	}
+	if filepath.Clean(path) != path {
+		return status.Errorf(codes.InvalidArgument, "path %q must be clean - use %q", path, filepath.Clean(path))
+	}
+	return nil
+}
+
+// Stat returns the state of a file in the store, to resume or skip an upload.
+func (en *Controller) Stat(ctx context.Context, req *mpb.StatRequest) (*mpb.StatResponse, error) {
+	if err := en.authorizeKey(ctx, req.Key, accessStat); err != nil {
+		return nil, err
+	}
+	info, err := en.store.Stat(req.Key)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return &mpb.StatResponse{Size: info.Size, Complete: info.Complete, Checksum: info.Checksum}, nil
+}
+
+// Upload stores a file sent by a node or a user.
+//
+// If the stream is interrupted, the data received is kept, and the upload can be resumed
+// by sending the remaining data with an offset. The file is verified against the checksum
+// once the stream is closed.
+func (en *Controller) Upload(stream mpb.Controller_UploadServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if err := en.authorizeKey(stream.Context(), req.Key, accessUpload); err != nil {
+		return err
+	}
+	if req.Checksum != "" {
+		if _, err := transfer.ParseChecksum(req.Checksum); err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if _, err := transfer.ParseChecksum(req.Key); err == nil && !strings.EqualFold(req.Key, req.Checksum) {
+		return status.Errorf(codes.InvalidArgument, "files uploaded by checksum must have checksum %s, got %q", req.Key, req.Checksum)
+	}
+	// Don't touch files already uploaded, they may be in the process of being downloaded.
+	if info, err := en.store.Stat(req.Key); err == nil && info.Complete && req.Checksum != "" && strings.EqualFold(info.Checksum, req.Checksum) {
+		return stream.SendAndClose(&mpb.UploadResponse{Size: info.Size, Checksum: info.Checksum})
+	}
+
+	key, total, checksum := req.Key, req.Total, req.Checksum
+	w, err := en.store.Append(key, req.Offset)
+	if err != nil {
+		return status.Errorf(codes.OutOfRange, "%v", err)
+	}
+	for {
+		if _, err := w.Write(req.Data); err != nil {
+			w.Close()
+			return storeError(err)
+		}
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The data received so far is kept, so the upload can be resumed.
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return storeError(err)
+	}
+
+	if total > 0 {
+		info, err := en.store.Stat(key)
+		if err != nil {
+			return storeError(err)
+		}
+		if info.Size != total {
+			en.store.Delete(key)
+			return status.Errorf(codes.DataLoss, "upload of %s corrupted - got %d bytes, expected %d", key, info.Size, total)
+		}
+	}
+	info, err := en.store.Commit(key, checksum)
+	if err != nil {
+		return status.Errorf(codes.DataLoss, "%v", err)
+	}
+	return stream.SendAndClose(&mpb.UploadResponse{Size: info.Size, Checksum: info.Checksum})
+}
+
+// Download sends a file from the store, starting at the requested offset.
+//
+// The first response carries the size and checksum of the complete file.
+func (en *Controller) Download(req *mpb.DownloadRequest, stream mpb.Controller_DownloadServer) error {
+	if err := en.authorizeKey(stream.Context(), req.Key, accessDownload); err != nil {
+		return err
+	}
+	info, err := en.store.Stat(req.Key)
+	if err != nil {
+		return storeError(err)
+	}
+	if !info.Complete {
+		return status.Errorf(codes.FailedPrecondition, "file %s is still being uploaded", req.Key)
+	}
+	if req.Offset < 0 || req.Offset > info.Size {
+		return status.Errorf(codes.OutOfRange, "invalid offset %d for %s - file is %d bytes", req.Offset, req.Key, info.Size)
+	}
+	r, err := en.store.Open(req.Key, req.Offset)
+	if err != nil {
+		return storeError(err)
+	}
+	defer r.Close()
+
+	resp := &mpb.DownloadResponse{Total: info.Size, Checksum: info.Checksum}
+	buffer := make([]byte, transfer.ChunkSize)
+	for first := true; ; first = false {
+		size, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return storeError(err)
+		}
+		if size > 0 || first {
+			resp.Data = buffer[:size]
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &mpb.DownloadResponse{}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// Push copies a file to the nodes selected by the request, streaming back the outcome for each node.
+//
+// The file is either uploaded to the store first, or downloaded by the nodes from an URL.
+// The caller must be allowed to push the file to all the nodes by the run acl.
+func (en *Controller) Push(req *mpb.PushRequest, stream mpb.Controller_PushServer) error {
+	if err := checkPath(req.Path); err != nil {
+		return err
+	}
+	if (req.Key == "") == (req.Url == "") {
+		return status.Errorf(codes.InvalidArgument, "exactly one of key or url must be specified")
+	}
+	if req.Url != "" {
+		if _, err := transfer.ParseChecksum(req.Checksum); err != nil {
+			return status.Errorf(codes.InvalidArgument, "a checksum is required to push an url - %v", err)
+		}
+	}
+
+	identity, nodes, err := en.selectNodes(stream.Context(), req.Node, req.Tag, func(identity string, node *state.Machine) string {
+		if !en.runACL.AllowedFile(identity, OpPush, node, req.Path) {
+			return "push " + req.Path
+		}
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+
+	size, checksum, source := req.Size, req.Checksum, req.Url
+	if req.Key != "" {
+		if en.store == nil {
+			return status.Errorf(codes.FailedPrecondition, "file transfers are not enabled on this controller")
+		}
+		// The nodes will download the file: the caller must be allowed to download it.
+		if err := authorizeUserKey(identity, req.Key, accessDownload); err != nil {
+			return err
+		}
+		info, err := en.store.Stat(req.Key)
+		if err != nil || !info.Complete {
+			return status.Errorf(codes.FailedPrecondition, "file %s was not uploaded", req.Key)
+		}
+		size, checksum, source = info.Size, info.Checksum, req.Key
+	}
+
+	timeout := en.timeout(req.TimeoutMs)
+	en.Log.Infof("%s is pushing %s to %s on %s, timeout %s", identity, source, req.Path, names(nodes), timeout)
+	return en.dispatch(stream, nodes, timeout, func(cmd *command) *mpb.PollResponse {
+		cmd.key = req.Key
+		return &mpb.PollResponse{Resp: &mpb.PollResponse_Download{Download: &mpb.ActionDownload{
+			Id:       cmd.id,
+			Key:      req.Key,
+			Url:      req.Url,
+			Size:     size,
+			Checksum: checksum,
+			Path:     req.Path,
+			Mode:     req.Mode,
+		}}}
+	})
+}
+
+// Pull copies a file from the nodes selected by the request to the store.
+//
+// The exit status for each node carries the key of the file in the store, which the
+// caller can then retrieve with Download. The caller must be allowed to pull the file
+// from all the nodes by the run acl.
+func (en *Controller) Pull(req *mpb.PullRequest, stream mpb.Controller_PullServer) error {
+	if en.store == nil {
+		return status.Errorf(codes.FailedPrecondition, "file transfers are not enabled on this controller")
+	}
+	if err := checkPath(req.Path); err != nil {
+		return err
+	}
+
+	identity, nodes, err := en.selectNodes(stream.Context(), req.Node, req.Tag, func(identity string, node *state.Machine) string {
+		if !en.runACL.AllowedFile(identity, OpPull, node, req.Path) {
+			return "pull " + req.Path
+		}
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+
+	timeout := en.timeout(req.TimeoutMs)
+	en.Log.Infof("%s is pulling %s from %s, timeout %s", identity, req.Path, names(nodes), timeout)
+	return en.dispatch(stream, nodes, timeout, func(cmd *command) *mpb.PollResponse {
+		cmd.key = fmt.Sprintf("%s%s", pullPrefix(identity), cmd.id)
+		cmd.upload = true
+		return &mpb.PollResponse{Resp: &mpb.PollResponse_Upload{Upload: &mpb.ActionUpload{
+			Id:   cmd.id,
+			Path: req.Path,
+			Key:  cmd.key,
+		}}}
+	})
+}
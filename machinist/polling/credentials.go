@@ -0,0 +1,61 @@
+package polling
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+)
+
+// Credentials are presented by the node to the controller every time it registers.
+//
+// A node enrolls by presenting a token, as created with `machinist token create`, and
+// is issued a credential by the controller, to be presented from then on.
+type Credentials struct {
+	lock       sync.Mutex
+	token      string
+	credential string
+	// File where the credential is saved, not saved if empty.
+	path string
+}
+
+// LoadCredentials returns the credential saved in the file at path, if any, or the token otherwise.
+func LoadCredentials(token, path string) (*Credentials, error) {
+	creds := &Credentials{token: token, path: path}
+	if path == "" {
+		return creds, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	creds.credential = strings.TrimSpace(string(data))
+	return creds, nil
+}
+
+// Fill sets the credential in the register request or, if the node has not enrolled yet, the token.
+func (c *Credentials) Fill(req *mpb.ClientRegister) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	req.Token = ""
+	req.Credential = c.credential
+	if c.credential == "" {
+		req.Token = c.token
+	}
+}
+
+// Update records the credential issued by the controller, saving it to the file, if any.
+func (c *Credentials) Update(credential string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.credential = credential
+	if c.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, []byte(credential+"\n"), 0o600)
+}
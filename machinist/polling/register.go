@@ -11,37 +11,46 @@ import (
 )
 
 // SendRegisterRequests is a blocking function that will send re-register requests every 5 seconds.
+//
+// The stream used to register is also used by the controller to request actions, see Session.
+// Each request carries the enrollment token or, once enrolled, the credential of the node.
 func SendRegisterRequests(ctx context.Context, client mpb.ControllerClient, conf *config.Node) error {
-	pollStream, err := client.Poll(ctx)
+	creds, err := LoadCredentials(conf.EnrollmentToken, conf.CredentialFile)
 	if err != nil {
 		return err
 	}
-	l := conf.Common.Root.Log
-	registerRequest := &mpb.PollRequest{
-		Req: &mpb.PollRequest_Register{
-			Register: &mpb.ClientRegister{
-				Name: conf.Name,
-				Tag:  conf.Tags,
-				Ips:  conf.IpAddresses,
-			},
-		},
+	session, err := NewSession(ctx, client, conf, creds)
+	if err != nil {
+		return err
 	}
+	l := conf.Common.Root.Log
 	for {
-		if err := pollStream.Send(registerRequest); err != nil {
-			_, err := pollStream.Recv()
+		register := &mpb.ClientRegister{
+			Name: conf.Name,
+			Tag:  conf.Tags,
+			Ips:  conf.IpAddresses,
+		}
+		creds.Fill(register)
+		registerRequest := &mpb.PollRequest{
+			Req: &mpb.PollRequest_Register{
+				Register: register,
+			},
+		}
+		if err := session.Send(registerRequest); err != nil {
+			err := session.Close()
 			s, ok := status.FromError(err)
 			if ok {
 				l.Errorf("unable to send register request: %+v", s.Message())
 			} else {
 				l.Errorf("unable to send request, unknown err: %w", err)
 			}
-			p, err := client.Poll(ctx)
+			p, err := NewSession(ctx, client, conf, creds)
 			if err != nil {
 				l.Errorf("error %w reconnecting, trying again", err)
 				registerFailCounter.Inc()
 			} else {
 				l.Infof("Successfully reconnected")
-				pollStream = p
+				session = p
 			}
 		}
 		_ = <-time.After(5 * time.Second)
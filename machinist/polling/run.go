@@ -0,0 +1,138 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+)
+
+const (
+	// ExitTimeout is the status of a command killed because it timed out. Same as timeout(1).
+	ExitTimeout = 124
+	// ExitError is the status of a command that could not be run. Same as ssh.
+	ExitError = 255
+)
+
+// kMaxChunk is the maximum size of the output sent in a single ClientResult.
+const kMaxChunk = 32 * 1024
+
+// kWaitDelay is how long to wait for the output of a command to be closed once
+// it terminated, before giving up. Commands leaving children running in background
+// may keep the output open indefinitely.
+const kWaitDelay = 5 * time.Second
+
+// RunCommand runs the command requested by the controller, and returns its exit status.
+//
+// The command inherits the environment of the node, with the variables requested added.
+func RunCommand(ctx context.Context, action *mpb.ActionSession, stdout, stderr io.Writer) *mpb.CommandExit {
+	if len(action.Argv) == 0 {
+		return &mpb.CommandExit{Status: ExitError, Error: "no command to run"}
+	}
+	if action.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(action.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, action.Argv[0], action.Argv[1:]...)
+	cmd.Env = append(os.Environ(), action.Env...)
+	cmd.Dir = action.Workdir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = kWaitDelay
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &mpb.CommandExit{Status: ExitTimeout, Timeout: true, Error: fmt.Sprintf("timed out after %s", time.Duration(action.TimeoutMs)*time.Millisecond)}
+	}
+	if err == nil {
+		return &mpb.CommandExit{}
+	}
+
+	var eerr *exec.ExitError
+	if !errors.As(err, &eerr) {
+		return &mpb.CommandExit{Status: ExitError, Error: err.Error()}
+	}
+	if status, ok := eerr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &mpb.CommandExit{Status: 128 + int32(status.Signal())}
+	}
+	return &mpb.CommandExit{Status: int32(eerr.ExitCode())}
+}
+
+// outputWriter relays the output of a command to the controller.
+type outputWriter struct {
+	session *Session
+	id      string
+	stderr  bool
+}
+
+func (ow *outputWriter) Write(data []byte) (int, error) {
+	for written := 0; written < len(data); {
+		chunk := data[written:min(written+kMaxChunk, len(data))]
+		result := &mpb.ClientResult{Id: ow.id, Result: &mpb.ClientResult_Stdout{Stdout: chunk}}
+		if ow.stderr {
+			result.Result = &mpb.ClientResult_Stderr{Stderr: chunk}
+		}
+		if err := ow.session.Send(&mpb.PollRequest{Req: &mpb.PollRequest_Result{Result: result}}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return len(data), nil
+}
+
+func (s *Session) sendExit(id string, exit *mpb.CommandExit) {
+	result := &mpb.ClientResult{Id: id, Result: &mpb.ClientResult_Exit{Exit: exit}}
+	if err := s.Send(&mpb.PollRequest{Req: &mpb.PollRequest_Result{Result: result}}); err != nil {
+		s.log.Warnf("could not send exit status of command %s - %v", id, err)
+	}
+}
+
+// start runs a command in background, relaying its output to the controller.
+func (s *Session) start(ctx context.Context, action *mpb.ActionSession) {
+	if !s.enableRun {
+		s.log.Warnf("refusing to run %q - remote execution is disabled on this node", strings.Join(action.Argv, " "))
+		s.sendExit(action.Id, &mpb.CommandExit{Status: ExitError, Error: "remote execution is disabled on this node, run machinist with --enable-run"})
+		return
+	}
+
+	s.log.Infof("running %q as requested by the controller, id %s", strings.Join(action.Argv, " "), action.Id)
+	s.spawn(ctx, action.Id, func(ctx context.Context) *mpb.CommandExit {
+		return RunCommand(ctx, action,
+			&outputWriter{session: s, id: action.Id},
+			&outputWriter{session: s, id: action.Id, stderr: true})
+	})
+}
+
+// spawn invokes run in background, and sends the exit status it returns to the controller.
+//
+// The context passed to run is canceled if the controller cancels the command.
+func (s *Session) spawn(ctx context.Context, id string, run func(ctx context.Context) *mpb.CommandExit) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.commandsLock.Lock()
+	s.commands[id] = cancel
+	s.commandsLock.Unlock()
+
+	go func() {
+		defer s.stop(id)
+		s.sendExit(id, run(ctx))
+	}()
+}
+
+// stop kills a command started with start, if still running.
+func (s *Session) stop(id string) {
+	s.commandsLock.Lock()
+	defer s.commandsLock.Unlock()
+	if cancel := s.commands[id]; cancel != nil {
+		cancel()
+		delete(s.commands, id)
+	}
+}
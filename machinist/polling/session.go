@@ -0,0 +1,105 @@
+package polling
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ccontavalli/enkit/lib/logger"
+	"github.com/ccontavalli/enkit/machinist/config"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+)
+
+// Session is a Poll stream to the controller, processing the actions it requests.
+//
+// Commands started by the session are stopped when the session is closed.
+type Session struct {
+	log         logger.Logger
+	enableRun   bool
+	credentials *Credentials
+
+	client mpb.ControllerClient
+	stream mpb.Controller_PollClient
+	cancel context.CancelFunc
+	done   chan struct{}
+	// Error returned by Recv, valid once done is closed.
+	err error
+
+	// Serializes Send, invoked by the register loop and by the commands running.
+	sendLock sync.Mutex
+
+	commandsLock sync.Mutex
+	commands     map[string]context.CancelFunc
+}
+
+// NewSession opens a Poll stream to the controller, and starts processing the actions received.
+//
+// Credentials issued by the controller are recorded in creds.
+func NewSession(ctx context.Context, client mpb.ControllerClient, conf *config.Node, creds *Credentials) (*Session, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := client.Poll(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s := &Session{
+		log:         conf.Common.Root.Log,
+		enableRun:   conf.EnableRun,
+		credentials: creds,
+		client:      client,
+		stream:      stream,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		commands:    map[string]context.CancelFunc{},
+	}
+	go s.receive(ctx)
+	return s, nil
+}
+
+// Send sends a request to the controller.
+func (s *Session) Send(req *mpb.PollRequest) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.stream.Send(req)
+}
+
+// Close terminates the session, returns the error that caused the stream to fail, if any.
+func (s *Session) Close() error {
+	s.cancel()
+	<-s.done
+	return s.err
+}
+
+func (s *Session) receive(ctx context.Context) {
+	defer close(s.done)
+	defer s.cancel()
+
+	for {
+		resp, err := s.stream.Recv()
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		switch r := resp.Resp.(type) {
+		case *mpb.PollResponse_Result:
+			if r.Result.Status != 0 {
+				s.log.Errorf("controller returned error %d - %s", r.Result.Status, r.Result.Description)
+			}
+			if r.Result.Credential != "" {
+				s.log.Infof("enrolled, the controller issued a credential to this node")
+				if err := s.credentials.Update(r.Result.Credential); err != nil {
+					s.log.Errorf("could not save the credential issued by the controller - %v", err)
+				}
+			}
+		case *mpb.PollResponse_Start:
+			s.start(ctx, r.Start)
+		case *mpb.PollResponse_Upload:
+			s.upload(ctx, r.Upload)
+		case *mpb.PollResponse_Download:
+			s.download(ctx, r.Download)
+		case *mpb.PollResponse_Cancel:
+			s.stop(r.Cancel.Id)
+		}
+	}
+}
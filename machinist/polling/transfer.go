@@ -0,0 +1,52 @@
+package polling
+
+import (
+	"context"
+	"os"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+	"github.com/ccontavalli/enkit/machinist/transfer"
+)
+
+// transferExit returns the exit status reporting the outcome of a transfer.
+func transferExit(err error) *mpb.CommandExit {
+	if err != nil {
+		return &mpb.CommandExit{Status: ExitError, Error: err.Error()}
+	}
+	return &mpb.CommandExit{}
+}
+
+// upload sends a file to the controller in background, as requested by `machinist pull`.
+func (s *Session) upload(ctx context.Context, action *mpb.ActionUpload) {
+	if !s.enableRun {
+		s.log.Warnf("refusing to upload %s - remote execution is disabled on this node", action.Path)
+		s.sendExit(action.Id, &mpb.CommandExit{Status: ExitError, Error: "remote execution is disabled on this node, run machinist with --enable-run"})
+		return
+	}
+
+	s.log.Infof("uploading %s as requested by the controller, id %s", action.Path, action.Id)
+	s.spawn(ctx, action.Id, func(ctx context.Context) *mpb.CommandExit {
+		_, err := transfer.UploadFile(ctx, s.client, action.Key, action.Path)
+		return transferExit(err)
+	})
+}
+
+// download retrieves a file in background, as requested by `machinist push`.
+//
+// The file is downloaded either from the controller, or from the URL in the action.
+func (s *Session) download(ctx context.Context, action *mpb.ActionDownload) {
+	if !s.enableRun {
+		s.log.Warnf("refusing to download %s - remote execution is disabled on this node", action.Path)
+		s.sendExit(action.Id, &mpb.CommandExit{Status: ExitError, Error: "remote execution is disabled on this node, run machinist with --enable-run"})
+		return
+	}
+
+	s.log.Infof("downloading %s as requested by the controller, id %s", action.Path, action.Id)
+	s.spawn(ctx, action.Id, func(ctx context.Context) *mpb.CommandExit {
+		mode := os.FileMode(action.Mode)
+		if action.Url != "" {
+			return transferExit(transfer.DownloadURL(ctx, action.Url, action.Path, mode, action.Size, action.Checksum))
+		}
+		return transferExit(transfer.DownloadFile(ctx, s.client, action.Key, action.Path, mode, action.Checksum))
+	})
+}
@@ -1,21 +1,50 @@
 package state
 
 import (
+	"errors"
 	"github.com/ccontavalli/enkit/lib/config/marshal"
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 type Machine struct {
 	Name string   `json:"name"`
 	Ips  []net.IP `json:"ips"`
 	Tags []string `json:"tags"`
+
+	// When the machine first registered, and when it was last heard from.
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+
+	// Hash of the credential issued to the machine when it enrolled, empty if it
+	// registered without enrolling. Once set, the machine must present the credential.
+	Credential string `json:"credential,omitempty"`
+	// Tags the machine can have, as allowed by the token it enrolled with. Any tag if empty.
+	AllowedTags []string `json:"allowed_tags,omitempty"`
+}
+
+// EnrollmentToken allows machines to enroll, see `machinist token create`.
+type EnrollmentToken struct {
+	// Hash of the token, the token itself is only returned to who created it.
+	Hash string `json:"hash"`
+	// Who created the token.
+	Creator string `json:"creator,omitempty"`
+
+	// Names and tags of the machines that can enroll with the token, as patterns. Any if empty.
+	Names []string `json:"names,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
+	// How many more machines can enroll with the token, and until when.
+	Uses    int       `json:"uses"`
+	Expires time.Time `json:"expires"`
 }
 
 type MachineController struct {
 	sync.RWMutex
 	Machines []*Machine
+	Tokens   []*EnrollmentToken `json:",omitempty"`
 }
 
 // AddMachine adds a machine to the parsed in state. If a machine exists with the same name, it returns an error.
@@ -35,6 +64,41 @@ func AddMachine(mc *MachineController, m *Machine) error {
 	return nil
 }
 
+// TouchMachine records that the machine with the name was seen at the time.
+//
+// Machines are never modified in place, so the pointers returned by GetMachine can be
+// safely read without holding the lock. Returns false if no machine exists with the name.
+func TouchMachine(mc *MachineController, name string, seen time.Time) bool {
+	mc.Lock()
+	defer mc.Unlock()
+	for i, mm := range mc.Machines {
+		if mm.Name == name {
+			updated := *mm
+			updated.LastSeen = seen
+			mc.Machines[i] = &updated
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireMachines removes the machines last seen before the time, and returns them.
+func ExpireMachines(mc *MachineController, before time.Time) []*Machine {
+	mc.Lock()
+	defer mc.Unlock()
+	var expired []*Machine
+	kept := []*Machine{}
+	for _, mm := range mc.Machines {
+		if mm.LastSeen.Before(before) {
+			expired = append(expired, mm)
+			continue
+		}
+		kept = append(kept, mm)
+	}
+	mc.Machines = kept
+	return expired
+}
+
 // GetMachine fetches a machine from the state. If no machine exists with the name, it returns nil.
 func GetMachine(mc *MachineController, name string) *Machine {
 	mc.RLock()
@@ -47,6 +111,55 @@ func GetMachine(mc *MachineController, name string) *Machine {
 	return nil
 }
 
+// AddToken adds an enrollment token to the state.
+func AddToken(mc *MachineController, token *EnrollmentToken) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Tokens = append(mc.Tokens, token)
+}
+
+// UseToken consumes one use of the enrollment token with the hash, if valid at the time.
+//
+// check is invoked with the lock held to verify the token can be used, and must not modify it.
+// Tokens expired or without uses left are removed. Returns the token used, or an error if there
+// is no valid token with the hash, or check returned an error.
+func UseToken(mc *MachineController, hash string, now time.Time, check func(token *EnrollmentToken) error) (*EnrollmentToken, error) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Tokens = validTokens(mc.Tokens, now)
+	for i, token := range mc.Tokens {
+		if token.Hash != hash {
+			continue
+		}
+		if err := check(token); err != nil {
+			return nil, err
+		}
+		used := *token
+		used.Uses--
+		mc.Tokens[i] = &used
+		mc.Tokens = validTokens(mc.Tokens, now)
+		return &used, nil
+	}
+	return nil, errors.New("invalid or expired enrollment token")
+}
+
+// ExpireTokens removes the enrollment tokens expired at the time, or without uses left.
+func ExpireTokens(mc *MachineController, now time.Time) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.Tokens = validTokens(mc.Tokens, now)
+}
+
+func validTokens(tokens []*EnrollmentToken, now time.Time) []*EnrollmentToken {
+	var valid []*EnrollmentToken
+	for _, token := range tokens {
+		if token.Uses > 0 && now.Before(token.Expires) {
+			valid = append(valid, token)
+		}
+	}
+	return valid
+}
+
 // ReadInController will attempt to read in the filepath provided and deserialize it into the machine controller.
 // Fails if the file exists and cannot deserialize. If the file does not exist, it will create tje file and return a fresh state.
 func ReadInController(filepath string) (*MachineController, error) {
@@ -1,6 +1,7 @@
 package state_test
 
 import (
+	"errors"
 	"github.com/ccontavalli/enkit/lib/srand"
 	"github.com/ccontavalli/enkit/machinist/state"
 	"github.com/stretchr/testify/assert"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestReadInController(t *testing.T) {
@@ -56,3 +58,47 @@ func TestReadInController(t *testing.T) {
 		assert.NotNil(t, err)
 	})
 }
+
+func TestExpireMachines(t *testing.T) {
+	now := time.Now()
+	m := &state.MachineController{}
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "old", LastSeen: now.Add(-time.Hour)}))
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "new", LastSeen: now}))
+	assert.Nil(t, state.AddMachine(m, &state.Machine{Name: "touched", LastSeen: now.Add(-time.Hour)}))
+
+	previous := state.GetMachine(m, "touched")
+	assert.True(t, state.TouchMachine(m, "touched", now))
+	assert.False(t, state.TouchMachine(m, "missing", now))
+	assert.Equal(t, now, state.GetMachine(m, "touched").LastSeen)
+	assert.Equal(t, now.Add(-time.Hour), previous.LastSeen)
+
+	expired := state.ExpireMachines(m, now.Add(-time.Minute))
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "old", expired[0].Name)
+	assert.Nil(t, state.GetMachine(m, "old"))
+	assert.Equal(t, 2, len(m.Machines))
+}
+
+func TestUseToken(t *testing.T) {
+	now := time.Now()
+	m := &state.MachineController{}
+	state.AddToken(m, &state.EnrollmentToken{Hash: "twice", Uses: 2, Expires: now.Add(time.Hour)})
+	state.AddToken(m, &state.EnrollmentToken{Hash: "expired", Uses: 1, Expires: now.Add(-time.Second)})
+	accept := func(token *state.EnrollmentToken) error { return nil }
+
+	_, err := state.UseToken(m, "twice", now, func(token *state.EnrollmentToken) error { return errors.New("denied") })
+	assert.ErrorContains(t, err, "denied")
+
+	used, err := state.UseToken(m, "twice", now, accept)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, used.Uses)
+	used, err = state.UseToken(m, "twice", now, accept)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, used.Uses)
+	_, err = state.UseToken(m, "twice", now, accept)
+	assert.Error(t, err)
+
+	_, err = state.UseToken(m, "expired", now, accept)
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(m.Tokens))
+}
@@ -1,22 +1,30 @@
 package e2e_test
 
 import (
+	"bytes"
 	"context"
 	"github.com/ccontavalli/enkit/lib/knetwork"
 	"github.com/ccontavalli/enkit/lib/knetwork/kdns"
 	"github.com/ccontavalli/enkit/lib/srand"
+	mclient "github.com/ccontavalli/enkit/machinist/client"
 	"github.com/ccontavalli/enkit/machinist/config"
 	"github.com/ccontavalli/enkit/machinist/machine"
 	"github.com/ccontavalli/enkit/machinist/mserver"
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
 	"github.com/ccontavalli/enkit/machinist/state"
+	"github.com/ccontavalli/enkit/machinist/transfer"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 	"math/rand"
 	"net"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -154,6 +162,549 @@ func TestJoinServerAndPoll(t *testing.T) {
 	assert.Nil(t, mainServer.Stop())
 }
 
+func TestRun(t *testing.T) {
+	dnsLis, _ := registerPort(t)
+	dnsAddr, err := dnsLis.Address()
+	assert.Nil(t, err)
+	lis := bufconn.Listen(2048 * 2048)
+
+	aclFile := filepath.Join(t.TempDir(), "acl.yaml")
+	assert.NoError(t, os.WriteFile(aclFile, []byte(`
+rules:
+  - identities: ["*@enfabrica.net"]
+    tags: ["big"]
+    commands: ["echo *", "sh -c *", "sleep *"]
+`), 0o644))
+
+	s, _, err := createNewControlPlane(t, []mserver.ControllerModifier{
+		mserver.WithKDnsFlags(
+			kdns.WithTCPListener(dnsLis),
+			kdns.WithHost(dnsAddr.IP.String()),
+			kdns.WithPort(dnsAddr.Port),
+			kdns.WithDomains([]string{"enkit."}),
+		),
+		mserver.WithAuthenticator(func(ctx context.Context) (string, error) {
+			return "carlo@enfabrica.net", nil
+		}),
+		mserver.WithRunACL(aclFile),
+	}, []mserver.Modifier{
+		mserver.WithMachinistFlags(
+			config.WithListener(lis),
+			config.WithInsecure(),
+		),
+	})
+	assert.Nil(t, err)
+	go func() {
+		assert.Nil(t, s.Run())
+	}()
+	defer s.Stop()
+
+	customConnect := func() (*grpc.ClientConn, error) {
+		return grpc.DialContext(context.TODO(), "bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return lis.Dial()
+			}), grpc.WithInsecure())
+	}
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("test01"),
+		machine.WithIps([]string{"10.0.0.4"}),
+		machine.WithTags([]string{"big"}),
+		machine.WithEnableRun(true),
+		machine.WithMachinistFlags(config.WithEnableMetrics(false)),
+	})
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("test02"),
+		machine.WithIps([]string{"10.0.0.1"}),
+		machine.WithTags([]string{"big"}),
+		machine.WithMachinistFlags(config.WithEnableMetrics(false)),
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := customConnect()
+	assert.NoError(t, err)
+	client := mpb.NewControllerClient(conn)
+
+	var stdout, stderr bytes.Buffer
+	exits, err := mclient.Run(context.Background(), client, &mpb.RunRequest{
+		Node: "test01",
+		Argv: []string{"sh", "-c", "echo out; echo err >&2; exit 3"},
+	}, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+	assert.Equal(t, 1, len(exits))
+	assert.Equal(t, int32(3), exits["test01"].Status)
+	assert.Error(t, mclient.ExitStatus(exits, &stderr))
+
+	// test02 does not allow remote execution.
+	stdout.Reset()
+	exits, err = mclient.Run(context.Background(), client, &mpb.RunRequest{
+		Tag:  "big",
+		Argv: []string{"echo", "hello"},
+	}, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, "test01: hello\n", stdout.String())
+	assert.Equal(t, int32(0), exits["test01"].Status)
+	assert.Equal(t, int32(255), exits["test02"].Status)
+	assert.Contains(t, exits["test02"].Error, "disabled")
+
+	start := time.Now()
+	exits, err = mclient.Run(context.Background(), client, &mpb.RunRequest{
+		Node:      "test01",
+		Argv:      []string{"sleep", "10"},
+		TimeoutMs: 100,
+	}, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.True(t, exits["test01"].Timeout)
+	assert.Equal(t, int32(124), exits["test01"].Status)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	_, err = mclient.Run(context.Background(), client, &mpb.RunRequest{
+		Node: "test01",
+		Argv: []string{"rm", "-rf", "/"},
+	}, &stdout, &stderr)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = mclient.Run(context.Background(), client, &mpb.RunRequest{
+		Node: "test03",
+		Argv: []string{"echo", "hello"},
+	}, &stdout, &stderr)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestTransfer(t *testing.T) {
+	dnsLis, _ := registerPort(t)
+	dnsAddr, err := dnsLis.Address()
+	assert.Nil(t, err)
+	lis := bufconn.Listen(2048 * 2048)
+
+	dir := t.TempDir()
+	aclFile := filepath.Join(dir, "acl.yaml")
+	assert.NoError(t, os.WriteFile(aclFile, []byte(`
+rules:
+  - identities: ["*@enfabrica.net"]
+    operations: ["push", "pull"]
+    files: ["`+dir+`/files/*"]
+`), 0o644))
+
+	s, mController, err := createNewControlPlane(t, []mserver.ControllerModifier{
+		mserver.WithKDnsFlags(
+			kdns.WithTCPListener(dnsLis),
+			kdns.WithHost(dnsAddr.IP.String()),
+			kdns.WithPort(dnsAddr.Port),
+			kdns.WithDomains([]string{"enkit."}),
+		),
+		mserver.WithAuthenticator(func(ctx context.Context) (string, error) {
+			return "carlo@enfabrica.net", nil
+		}),
+		mserver.WithRunACL(aclFile),
+		mserver.WithStoreDir(filepath.Join(dir, "store")),
+	}, []mserver.Modifier{
+		mserver.WithMachinistFlags(
+			config.WithListener(lis),
+			config.WithInsecure(),
+		),
+	})
+	assert.Nil(t, err)
+	go func() {
+		assert.Nil(t, s.Run())
+	}()
+	defer s.Stop()
+
+	customConnect := func() (*grpc.ClientConn, error) {
+		return grpc.DialContext(context.TODO(), "bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return lis.Dial()
+			}), grpc.WithInsecure())
+	}
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("test01"),
+		machine.WithIps([]string{"10.0.0.4"}),
+		machine.WithTags([]string{"big"}),
+		machine.WithEnableRun(true),
+		machine.WithMachinistFlags(config.WithEnableMetrics(false)),
+	})
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("test02"),
+		machine.WithIps([]string{"10.0.0.1"}),
+		machine.WithTags([]string{"big"}),
+		machine.WithMachinistFlags(config.WithEnableMetrics(false)),
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := customConnect()
+	assert.NoError(t, err)
+	client := mpb.NewControllerClient(conn)
+
+	// Upload half of the file, and check the upload is resumed from there.
+	data := bytes.Repeat([]byte("0123456789abcdef"), transfer.ChunkSize/8)
+	local := filepath.Join(dir, "local.bin")
+	assert.NoError(t, os.WriteFile(local, data, 0o644))
+	key, err := transfer.Verify(local, "")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	upload, err := client.Upload(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, upload.Send(&mpb.UploadRequest{Key: key, Total: int64(len(data)), Checksum: key, Data: data[:len(data)/2]}))
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	stat, err := client.Stat(context.Background(), &mpb.StatRequest{Key: key})
+	assert.NoError(t, err)
+	assert.False(t, stat.Complete)
+	assert.Equal(t, int64(len(data)/2), stat.Size)
+
+	uploaded, err := transfer.UploadFile(context.Background(), client, key, local)
+	assert.NoError(t, err)
+	assert.Equal(t, key, uploaded.Checksum)
+	assert.Equal(t, int64(len(data)), uploaded.Size)
+
+	remote := filepath.Join(dir, "files", "remote.bin")
+	var stderr bytes.Buffer
+	exits, err := mclient.Push(context.Background(), client, &mpb.PushRequest{
+		Node: "test01",
+		Key:  key,
+		Path: remote,
+		Mode: 0o755,
+	}, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), exits["test01"].Status, "%s", exits["test01"].Error)
+	pushed, err := os.ReadFile(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, data, pushed)
+	st, err := os.Stat(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), st.Mode().Perm())
+
+	// test02 does not allow remote execution.
+	var stdout bytes.Buffer
+	pulled := filepath.Join(dir, "pulled")
+	exits, err = mclient.Pull(context.Background(), client, &mpb.PullRequest{
+		Tag:  "big",
+		Path: remote,
+	}, pulled, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), exits["test01"].Status, "%s", exits["test01"].Error)
+	assert.Equal(t, int32(255), exits["test02"].Status)
+	assert.Contains(t, exits["test02"].Error, "disabled")
+	pulledData, err := os.ReadFile(filepath.Join(pulled, "test01", "remote.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, pulledData)
+
+	exits, err = mclient.Pull(context.Background(), client, &mpb.PullRequest{
+		Node: "test01",
+		Path: filepath.Join(dir, "files", "missing.bin"),
+	}, pulled, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(255), exits["test01"].Status)
+
+	_, err = mclient.Push(context.Background(), client, &mpb.PushRequest{
+		Node: "test01",
+		Key:  key,
+		Path: filepath.Join(dir, "other.bin"),
+	}, &stderr)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = mclient.Push(context.Background(), client, &mpb.PushRequest{
+		Node: "test01",
+		Key:  "sha256:" + strings.Repeat("0", 64),
+		Path: remote,
+	}, &stderr)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Keys not uploaded by checksum can only be accessed by nodes, while transferring them.
+	_, err = client.Stat(context.Background(), &mpb.StatRequest{Key: "pull/someone@enfabrica.net/test01-0"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Files not written for the retention, a day by default, are deleted from the store.
+	mController.ExpireFiles(time.Now().Add(time.Hour))
+	_, err = client.Stat(context.Background(), &mpb.StatRequest{Key: key})
+	assert.NoError(t, err)
+	mController.ExpireFiles(time.Now().Add(25 * time.Hour))
+	_, err = client.Stat(context.Background(), &mpb.StatRequest{Key: key})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeLiveness(t *testing.T) {
+	dnsLis, customResolver := registerPort(t)
+	dnsAddr, err := dnsLis.Address()
+	assert.Nil(t, err)
+	lis := bufconn.Listen(2048 * 2048)
+
+	s, mController, err := createNewControlPlane(t, []mserver.ControllerModifier{
+		mserver.WithAllRecordsRefreshRate("50ms"),
+		mserver.WithStaleAfter("300ms"),
+		mserver.WithExpireAfter("1s"),
+		mserver.WithKDnsFlags(
+			kdns.WithTCPListener(dnsLis),
+			kdns.WithHost(dnsAddr.IP.String()),
+			kdns.WithPort(dnsAddr.Port),
+			kdns.WithDomains([]string{"enkit."}),
+		),
+	}, []mserver.Modifier{
+		mserver.WithMachinistFlags(
+			config.WithListener(lis),
+			config.WithInsecure(),
+		),
+	})
+	assert.Nil(t, err)
+	go func() {
+		assert.Nil(t, s.Run())
+	}()
+	defer s.Stop()
+
+	customConnect := func() (*grpc.ClientConn, error) {
+		return grpc.DialContext(context.TODO(), "bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return lis.Dial()
+			}), grpc.WithInsecure())
+	}
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("test01"),
+		machine.WithIps([]string{"10.0.0.4"}),
+		machine.WithTags([]string{"big"}),
+		machine.WithMachinistFlags(config.WithEnableMetrics(false)),
+	})
+
+	conn, err := customConnect()
+	assert.NoError(t, err)
+	client := mpb.NewControllerClient(conn)
+
+	register := func(name, ip string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		poll, err := client.Poll(ctx)
+		assert.NoError(t, err)
+		assert.NoError(t, poll.Send(&mpb.PollRequest{Req: &mpb.PollRequest_Register{Register: &mpb.ClientRegister{
+			Name: name,
+			Tag:  []string{"big", "small"},
+			Ips:  []string{ip},
+		}}}))
+		_, err = poll.Recv()
+		return err
+	}
+
+	// A live node cannot be replaced by a node with a different ip.
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, codes.AlreadyExists, status.Code(register("test01", "10.0.0.9")))
+	res, err := customResolver.LookupHost(context.TODO(), "test01.enkit")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.4"}, res)
+
+	// test02 registers once, changes ip once stale, and then disappears.
+	assert.NoError(t, register("test02", "10.0.0.1"))
+	assert.NoError(t, register("test02", "10.0.0.1"))
+	assert.Equal(t, codes.AlreadyExists, status.Code(register("test02", "10.0.0.2")))
+	time.Sleep(400 * time.Millisecond)
+	assert.NoError(t, register("test02", "10.0.0.2"))
+	time.Sleep(200 * time.Millisecond)
+
+	res, err = customResolver.LookupHost(context.TODO(), "test02.enkit")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, res)
+	res, err = customResolver.LookupHost(context.TODO(), "_all.enkit")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.4", "10.0.0.2"}, res)
+
+	nodes, err := client.ListNodes(context.Background(), &mpb.ListNodesRequest{Tags: []string{"big"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodes.Nodes))
+	assert.Equal(t, "test01", nodes.Nodes[0].Name)
+	assert.True(t, nodes.Nodes[0].Connected)
+	assert.Equal(t, "test02", nodes.Nodes[1].Name)
+	assert.Equal(t, []string{"10.0.0.2"}, nodes.Nodes[1].Ips)
+	assert.False(t, nodes.Nodes[1].Connected)
+	assert.False(t, nodes.Nodes[1].Stale)
+	assert.True(t, nodes.Nodes[1].Registered.AsTime().Before(nodes.Nodes[1].LastSeen.AsTime()))
+
+	nodes, err = client.ListNodes(context.Background(), &mpb.ListNodesRequest{Tags: []string{"big", "small"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodes.Nodes))
+
+	// test02 becomes stale, and is removed from _all and the metrics targets, but not from its own records.
+	time.Sleep(400 * time.Millisecond)
+	nodes, err = client.ListNodes(context.Background(), &mpb.ListNodesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodes.Nodes))
+	nodes, err = client.ListNodes(context.Background(), &mpb.ListNodesRequest{IncludeStale: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodes.Nodes))
+	assert.True(t, nodes.Nodes[1].Stale)
+
+	res, err = customResolver.LookupHost(context.TODO(), "_all.enkit")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.4"}, res)
+	res, err = customResolver.LookupHost(context.TODO(), "test02.enkit")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, res)
+
+	recorder := httptest.NewRecorder()
+	mController.MetricsTargets(recorder, httptest.NewRequest("GET", "/metrics_targets", nil))
+	assert.NotContains(t, recorder.Body.String(), "test02")
+	assert.Contains(t, recorder.Body.String(), "test01")
+
+	// test02 expires, and is forgotten.
+	time.Sleep(time.Second)
+	nodes, err = client.ListNodes(context.Background(), &mpb.ListNodesRequest{IncludeStale: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodes.Nodes))
+	assert.Equal(t, "test01", nodes.Nodes[0].Name)
+	_, err = customResolver.LookupHost(context.TODO(), "test02.enkit")
+	assert.Error(t, err)
+}
+
+func TestEnrollment(t *testing.T) {
+	dnsLis, customResolver := registerPort(t)
+	dnsAddr, err := dnsLis.Address()
+	assert.Nil(t, err)
+	lis := bufconn.Listen(2048 * 2048)
+
+	dir := t.TempDir()
+	aclFile := filepath.Join(dir, "acl.yaml")
+	assert.NoError(t, os.WriteFile(aclFile, []byte(`
+rules:
+  - identities: ["*@enfabrica.net"]
+    operations: ["enroll"]
+    nodes: ["build*"]
+  - identities: ["carlo@enfabrica.net"]
+    operations: ["enroll"]
+    tags: ["big"]
+`), 0o644))
+
+	s, _, err := createNewControlPlane(t, []mserver.ControllerModifier{
+		mserver.WithAllRecordsRefreshRate("50ms"),
+		mserver.WithKDnsFlags(
+			kdns.WithTCPListener(dnsLis),
+			kdns.WithHost(dnsAddr.IP.String()),
+			kdns.WithPort(dnsAddr.Port),
+			kdns.WithDomains([]string{"enkit."}),
+		),
+		mserver.WithAuthenticator(func(ctx context.Context) (string, error) {
+			return "carlo@enfabrica.net", nil
+		}),
+		mserver.WithRunACL(aclFile),
+		mserver.WithRequireEnrollment(true),
+	}, []mserver.Modifier{
+		mserver.WithMachinistFlags(
+			config.WithListener(lis),
+			config.WithInsecure(),
+		),
+	})
+	assert.Nil(t, err)
+	go func() {
+		assert.Nil(t, s.Run())
+	}()
+	defer s.Stop()
+
+	customConnect := func() (*grpc.ClientConn, error) {
+		return grpc.DialContext(context.TODO(), "bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return lis.Dial()
+			}), grpc.WithInsecure())
+	}
+	conn, err := customConnect()
+	assert.NoError(t, err)
+	client := mpb.NewControllerClient(conn)
+
+	_, err = client.CreateToken(context.Background(), &mpb.CreateTokenRequest{Names: []string{"db01"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	token, err := client.CreateToken(context.Background(), &mpb.CreateTokenRequest{Names: []string{"build*"}, Tags: []string{"big"}})
+	assert.NoError(t, err)
+
+	register := func(req *mpb.ClientRegister) (*mpb.ActionResult, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		poll, err := client.Poll(ctx)
+		assert.NoError(t, err)
+		req.Ips = []string{"10.0.0.1"}
+		assert.NoError(t, poll.Send(&mpb.PollRequest{Req: &mpb.PollRequest_Register{Register: req}}))
+		resp, err := poll.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return resp.GetResult(), nil
+	}
+
+	// Without a token, or with a token not allowing the name or tags, nodes cannot register.
+	_, err = register(&mpb.ClientRegister{Name: "build01"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = register(&mpb.ClientRegister{Name: "db01", Token: token.Token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"small"}, Token: token.Token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	result, err := register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Token: token.Token})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, result.Credential)
+
+	// The token was single use, and the node must now present its credential.
+	_, err = register(&mpb.ClientRegister{Name: "build02", Token: token.Token})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Credential: "invalid"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big", "small"}, Credential: result.Credential})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	issued := result.Credential
+	result, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Credential: issued})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Credential)
+
+	// Tokens not listing the exact name can't take over an enrolled node, and its DNS records.
+	token, err = client.CreateToken(context.Background(), &mpb.CreateTokenRequest{Tags: []string{"big"}})
+	assert.NoError(t, err)
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Token: token.Token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	token, err = client.CreateToken(context.Background(), &mpb.CreateTokenRequest{Names: []string{"build*"}, Tags: []string{"big"}})
+	assert.NoError(t, err)
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Token: token.Token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	// The refused attempts did not use the token, which still enrolls new nodes.
+	_, err = register(&mpb.ClientRegister{Name: "build02", Tag: []string{"big"}, Token: token.Token})
+	assert.NoError(t, err)
+
+	// A token created for the node enrolls it again, with a new credential.
+	token, err = client.CreateToken(context.Background(), &mpb.CreateTokenRequest{Names: []string{"build01"}, Tags: []string{"big"}})
+	assert.NoError(t, err)
+	enrolled, err := register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Token: token.Token})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, enrolled.Credential)
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Credential: issued})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = register(&mpb.ClientRegister{Name: "build01", Tag: []string{"big"}, Credential: enrolled.Credential})
+	assert.NoError(t, err)
+
+	// A node enrolls with its token, and saves the credential issued for the next time.
+	token, err = client.CreateToken(context.Background(), &mpb.CreateTokenRequest{Names: []string{"build*"}})
+	assert.NoError(t, err)
+	credentialFile := filepath.Join(dir, "credential")
+	go joinNodeToMaster(t, []machine.NodeModifier{
+		machine.WithDialFunc(customConnect),
+		machine.WithName("build03"),
+		machine.WithIps([]string{"10.0.0.3"}),
+		machine.WithEnrollmentToken(token.Token),
+		machine.WithCredentialFile(credentialFile),
+		machine.WithMachinistFlags(config.WithEnableMetrics(false)),
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	credential, err := os.ReadFile(credentialFile)
+	assert.NoError(t, err)
+	_, err = register(&mpb.ClientRegister{Name: "build03", Credential: strings.TrimSpace(string(credential))})
+	assert.NoError(t, err)
+	res, err := customResolver.LookupHost(context.TODO(), "build03.enkit")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, res)
+}
+
 func joinNodeToMaster(t *testing.T, opts []machine.NodeModifier) *machine.Machine {
 	n, err := machine.New(opts...)
 	assert.NoError(t, err)
@@ -0,0 +1,90 @@
+// Package transfer implements the copy of files between users, the machinist controller and the nodes.
+//
+// Files are uploaded to and downloaded from the controller in chunks, over the Upload and
+// Download rpcs. Partial transfers can be resumed, and files are verified with a checksum
+// once complete.
+package transfer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultAlgorithm is the algorithm used to compute checksums when none is requested.
+const DefaultAlgorithm = "sha256"
+
+// NewHash returns the hash to compute a checksum with the algorithm, sha256 or md5.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q - must be sha256 or md5", algorithm)
+}
+
+// ParseChecksum validates a checksum, and returns its algorithm.
+func ParseChecksum(checksum string) (string, error) {
+	algorithm, sum, found := strings.Cut(checksum, ":")
+	if !found {
+		return "", fmt.Errorf("invalid checksum %q - must be formatted as algorithm:hex", checksum)
+	}
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != h.Size() {
+		return "", fmt.Errorf("invalid checksum %q - not a valid %s", checksum, algorithm)
+	}
+	return algorithm, nil
+}
+
+// Format returns the checksum computed by the hash.
+func Format(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// FileChecksum computes the checksum of a file with the algorithm.
+func FileChecksum(path, algorithm string) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return Format(algorithm, h), nil
+}
+
+// Verify computes the checksum of a file, and compares it with the expected one.
+//
+// If expected is empty, the checksum is computed with DefaultAlgorithm and returned.
+func Verify(path, expected string) (string, error) {
+	algorithm := DefaultAlgorithm
+	if expected != "" {
+		var err error
+		if algorithm, err = ParseChecksum(expected); err != nil {
+			return "", err
+		}
+	}
+	checksum, err := FileChecksum(path, algorithm)
+	if err != nil {
+		return "", err
+	}
+	if expected != "" && !strings.EqualFold(checksum, expected) {
+		return "", fmt.Errorf("checksum mismatch - expected %s, got %s", expected, checksum)
+	}
+	return checksum, nil
+}
@@ -0,0 +1,237 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mpb "github.com/ccontavalli/enkit/machinist/rpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ChunkSize is the maximum size of the data sent in each UploadRequest and DownloadResponse.
+const ChunkSize = 1024 * 1024
+
+// DefaultMode is the permissions of downloaded files, if none was specified.
+const DefaultMode = 0o644
+
+// UploadFile uploads the file at path as key, resuming a previous partial upload of the same key.
+//
+// If a file with the same checksum was already uploaded as key, the upload is skipped.
+func UploadFile(ctx context.Context, client mpb.ControllerClient, key, path string) (*mpb.UploadResponse, error) {
+	checksum, err := Verify(path, "")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(0)
+	stat, err := client.Stat(ctx, &mpb.StatRequest{Key: key})
+	switch {
+	case err == nil && stat.Complete && stat.Checksum == checksum:
+		return &mpb.UploadResponse{Size: stat.Size, Checksum: stat.Checksum}, nil
+	case err == nil && !stat.Complete && stat.Size <= st.Size():
+		offset = stat.Size
+	case err != nil && status.Code(err) != codes.NotFound:
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &mpb.UploadRequest{Key: key, Total: st.Size(), Offset: offset, Checksum: checksum}
+	buffer := make([]byte, ChunkSize)
+	for first := true; ; first = false {
+		size, err := io.ReadFull(f, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		// The first request is sent even if there is no data, as it carries the key.
+		if size > 0 || first {
+			req.Data = buffer[:size]
+			if err := stream.Send(req); err != nil {
+				// Send returns io.EOF if the server closed the stream, the outcome is returned by CloseAndRecv.
+				return stream.CloseAndRecv()
+			}
+			req = &mpb.UploadRequest{}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// partialPath returns the path of the file used to store a partial download of path.
+//
+// The file is in the same directory as path, so it can be atomically renamed once complete.
+func partialPath(path string) string {
+	dir, base := filepath.Split(path)
+	return filepath.Join(dir, "."+base+".partial")
+}
+
+// openPartial opens the partial download of path for writing, returning the offset to resume from.
+func openPartial(path string) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(partialPath(path), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+// finishPartial verifies the partial download of path, and renames it to path.
+//
+// If the download is incomplete, the partial file is kept to resume the download later.
+// If it is corrupted, the partial file is removed, and the download will start from scratch.
+func finishPartial(path string, mode os.FileMode, size int64, checksum string) error {
+	partial := partialPath(path)
+	st, err := os.Stat(partial)
+	if err != nil {
+		return err
+	}
+	if size > 0 && st.Size() < size {
+		return fmt.Errorf("download of %s interrupted - got %d bytes out of %d", path, st.Size(), size)
+	}
+	if size > 0 && st.Size() > size {
+		os.Remove(partial)
+		return fmt.Errorf("download of %s corrupted - got %d bytes, expected %d", path, st.Size(), size)
+	}
+	if _, err := Verify(partial, checksum); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("download of %s corrupted - %w", path, err)
+	}
+
+	if mode == 0 {
+		mode = DefaultMode
+	}
+	if err := os.Chmod(partial, mode); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// DownloadFile downloads key from the controller into path, resuming a previous partial download.
+//
+// The file is downloaded next to path, and atomically renamed once complete and its checksum
+// verified. If checksum is empty, the checksum returned by the controller is used.
+func DownloadFile(ctx context.Context, client mpb.ControllerClient, key, path string, mode os.FileMode, checksum string) error {
+	f, offset, err := openPartial(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stream, err := client.Download(ctx, &mpb.DownloadRequest{Key: key, Offset: offset})
+	if err != nil {
+		return err
+	}
+	resp, err := stream.Recv()
+	if status.Code(err) == codes.OutOfRange {
+		// The partial file is larger than the file on the server, it must be from a different file.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if stream, err = client.Download(ctx, &mpb.DownloadRequest{Key: key}); err != nil {
+			return err
+		}
+		resp, err = stream.Recv()
+	}
+	if err != nil {
+		return err
+	}
+
+	total := resp.Total
+	if checksum == "" {
+		checksum = resp.Checksum
+	} else if resp.Checksum != "" && !strings.EqualFold(checksum, resp.Checksum) {
+		return fmt.Errorf("file %s on the controller has checksum %s, expected %s", key, resp.Checksum, checksum)
+	}
+	for {
+		if _, err := f.Write(resp.Data); err != nil {
+			return err
+		}
+		resp, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return finishPartial(path, mode, total, checksum)
+}
+
+// DownloadURL downloads url into path, resuming a previous partial download if the server supports ranges.
+//
+// Like DownloadFile, the file is atomically renamed once complete and its size and checksum verified.
+func DownloadURL(ctx context.Context, url, path string, mode os.FileMode, size int64, checksum string) error {
+	f, offset, err := openPartial(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Range not supported, start from scratch.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete, or corrupted. Let the checks below decide.
+		resp.Body = http.NoBody
+	default:
+		return fmt.Errorf("download of %s failed with status %s", url, resp.Status)
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return finishPartial(path, mode, size, checksum)
+}
@@ -0,0 +1,55 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/machinist/transfer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadURL(t *testing.T) {
+	data := []byte(strings.Repeat("machinist", 1000))
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bin", "tool")
+	sum := md5.Sum(data)
+	checksum := "md5:" + hex.EncodeToString(sum[:])
+
+	// Simulate an interrupted download, which is resumed.
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "bin", ".tool.partial"), data[:1000], 0o600))
+	assert.NoError(t, transfer.DownloadURL(context.Background(), server.URL, path, 0o755, int64(len(data)), checksum))
+	assert.Equal(t, []string{"bytes=1000-"}, ranges)
+
+	downloaded, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+	st, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), st.Mode().Perm())
+	_, err = os.Stat(filepath.Join(dir, "bin", ".tool.partial"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A corrupted partial download is discarded, so the next attempt starts from scratch.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "bin", ".tool.partial"), []byte("corrupted"), 0o600))
+	err = transfer.DownloadURL(context.Background(), server.URL, path, 0, int64(len(data)), checksum)
+	assert.ErrorContains(t, err, "checksum mismatch")
+	assert.NoError(t, transfer.DownloadURL(context.Background(), server.URL, path, 0, int64(len(data)), checksum))
+	assert.Equal(t, []string{"bytes=1000-", "bytes=9-", ""}, ranges)
+}
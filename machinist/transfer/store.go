@@ -0,0 +1,220 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/multierror"
+)
+
+// Info describes a file in a Store.
+type Info struct {
+	// Bytes stored so far.
+	Size int64
+	// True once the file was committed, in which case Checksum is set.
+	Complete bool
+	Checksum string
+}
+
+// Store keeps the files transferred through the controller.
+//
+// Files are first written in a partial state with Append, possibly over multiple
+// attempts, and then marked complete with Commit. Only complete files can be read.
+type Store interface {
+	// Stat returns the state of the file, an error wrapping os.ErrNotExist if the file is unknown.
+	Stat(key string) (*Info, error)
+	// Append returns a writer to add data to the partial file, starting at offset.
+	//
+	// offset must not be larger than the size of the partial file, any data past offset is discarded.
+	// If the file is complete, it is turned back into a partial file.
+	Append(key string, offset int64) (io.WriteCloser, error)
+	// Commit verifies the checksum of the partial file, and marks it complete.
+	//
+	// If checksum is empty, the checksum is computed with DefaultAlgorithm.
+	// The partial file is removed if the checksum does not match.
+	Commit(key string, checksum string) (*Info, error)
+	// Open returns a reader for a complete file, starting at offset.
+	Open(key string, offset int64) (io.ReadCloser, error)
+	// Delete removes the file, complete or partial.
+	Delete(key string) error
+}
+
+// Expirer is implemented by the stores able to delete the files no longer in use.
+type Expirer interface {
+	// Expire deletes the files, complete or partial, last written before the time.
+	//
+	// Returns the number of files deleted.
+	Expire(before time.Time) (int, error)
+}
+
+// DirStore is a Store keeping the files in a local directory.
+type DirStore struct {
+	Dir string
+}
+
+// NewDirStore returns a DirStore storing files in dir, creating it if necessary.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create store directory - %w", err)
+	}
+	return &DirStore{Dir: dir}, nil
+}
+
+// path returns the base path of the files used to store key.
+//
+// Keys are arbitrary strings, hashed to obtain a valid file name.
+func (ds *DirStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(ds.Dir, hex.EncodeToString(sum[:]))
+}
+
+func (ds *DirStore) Stat(key string) (*Info, error) {
+	base := ds.path(key)
+	if checksum, err := os.ReadFile(base + ".checksum"); err == nil {
+		st, err := os.Stat(base)
+		if err != nil {
+			return nil, err
+		}
+		return &Info{Size: st.Size(), Complete: true, Checksum: strings.TrimSpace(string(checksum))}, nil
+	}
+
+	st, err := os.Stat(base + ".partial")
+	if err != nil {
+		return nil, fmt.Errorf("file %s - %w", key, err)
+	}
+	return &Info{Size: st.Size()}, nil
+}
+
+func (ds *DirStore) Append(key string, offset int64) (io.WriteCloser, error) {
+	base := ds.path(key)
+	if _, err := os.Stat(base + ".checksum"); err == nil {
+		if err := os.Rename(base, base+".partial"); err != nil {
+			return nil, err
+		}
+		os.Remove(base + ".checksum")
+	}
+
+	f, err := os.OpenFile(base+".partial", os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset > st.Size() {
+		f.Close()
+		return nil, fmt.Errorf("invalid offset %d for %s - only %d bytes stored", offset, key, st.Size())
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (ds *DirStore) Commit(key string, checksum string) (*Info, error) {
+	base := ds.path(key)
+	computed, err := Verify(base+".partial", checksum)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			os.Remove(base + ".partial")
+		}
+		return nil, fmt.Errorf("file %s - %w", key, err)
+	}
+	if err := os.Rename(base+".partial", base); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".checksum", []byte(computed), 0o600); err != nil {
+		return nil, err
+	}
+	return ds.Stat(key)
+}
+
+func (ds *DirStore) Open(key string, offset int64) (io.ReadCloser, error) {
+	info, err := ds.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Complete {
+		return nil, fmt.Errorf("file %s is still being uploaded - %w", key, os.ErrNotExist)
+	}
+	if offset > info.Size {
+		return nil, fmt.Errorf("invalid offset %d for %s - file is %d bytes", offset, key, info.Size)
+	}
+
+	f, err := os.Open(ds.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (ds *DirStore) Delete(key string) error {
+	base := ds.path(key)
+	var errs []error
+	for _, path := range []string{base, base + ".checksum", base + ".partial"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return multierror.New(errs)
+}
+
+func (ds *DirStore) Expire(before time.Time) (int, error) {
+	entries, err := os.ReadDir(ds.Dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// A file is stored in up to three entries with the same base name, see path:
+	// it is in use if any of them was written recently.
+	var errs []error
+	written := map[string]time.Time{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if info.IsDir() {
+			continue
+		}
+		base := strings.SplitN(entry.Name(), ".", 2)[0]
+		if info.ModTime().After(written[base]) {
+			written[base] = info.ModTime()
+		}
+	}
+
+	expired := 0
+	for base, last := range written {
+		if !last.Before(before) {
+			continue
+		}
+		for _, path := range []string{base, base + ".checksum", base + ".partial"} {
+			if err := os.Remove(filepath.Join(ds.Dir, path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+		expired++
+	}
+	return expired, multierror.New(errs)
+}
@@ -0,0 +1,128 @@
+package transfer_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ccontavalli/enkit/machinist/transfer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirStore(t *testing.T) {
+	store, err := transfer.NewDirStore(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = store.Stat("logs/test01")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	w, err := store.Append("logs/test01", 0)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello, "))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	info, err := store.Stat("logs/test01")
+	assert.NoError(t, err)
+	assert.Equal(t, &transfer.Info{Size: 7}, info)
+	_, err = store.Open("logs/test01", 0)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Resuming past the end of the data stored is not allowed.
+	_, err = store.Append("logs/test01", 10)
+	assert.ErrorContains(t, err, "invalid offset")
+
+	// Resuming before the end discards the data past offset.
+	w, err = store.Append("logs/test01", 5)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(", world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	_, err = store.Commit("logs/test01", "md5:00000000000000000000000000000000")
+	assert.ErrorContains(t, err, "checksum mismatch")
+	_, err = store.Stat("logs/test01")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	w, err = store.Append("logs/test01", 0)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello, world"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	info, err = store.Commit("logs/test01", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &transfer.Info{
+		Size:     12,
+		Complete: true,
+		Checksum: "sha256:09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b",
+	}, info)
+
+	r, err := store.Open("logs/test01", 7)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "world", string(data))
+
+	assert.NoError(t, store.Delete("logs/test01"))
+	_, err = store.Stat("logs/test01")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.NoError(t, store.Delete("logs/test01"))
+}
+
+func TestDirStoreExpire(t *testing.T) {
+	store, err := transfer.NewDirStore(t.TempDir())
+	assert.NoError(t, err)
+
+	write := func(key string, commit bool) {
+		w, err := store.Append(key, 0)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte("content of " + key))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		if commit {
+			_, err = store.Commit(key, "")
+			assert.NoError(t, err)
+		}
+	}
+	write("pull/old", true)
+	write("pull/partial", false)
+
+	old := time.Now().Add(-2 * time.Hour)
+	entries, err := os.ReadDir(store.Dir)
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		assert.NoError(t, os.Chtimes(filepath.Join(store.Dir, entry.Name()), old, old))
+	}
+	write("pull/new", true)
+
+	expired, err := store.Expire(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, expired)
+	for _, key := range []string{"pull/old", "pull/partial"} {
+		_, err = store.Stat(key)
+		assert.True(t, errors.Is(err, os.ErrNotExist), key)
+	}
+	info, err := store.Stat("pull/new")
+	assert.NoError(t, err)
+	assert.True(t, info.Complete)
+	entries, err = os.ReadDir(store.Dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestParseChecksum(t *testing.T) {
+	algorithm, err := transfer.ParseChecksum("md5:5eb63bbbe01eeed093cb22bb8f5acdc3")
+	assert.NoError(t, err)
+	assert.Equal(t, "md5", algorithm)
+
+	_, err = transfer.ParseChecksum("5eb63bbbe01eeed093cb22bb8f5acdc3")
+	assert.ErrorContains(t, err, "algorithm:hex")
+	_, err = transfer.ParseChecksum("sha256:5eb63bbbe01eeed093cb22bb8f5acdc3")
+	assert.ErrorContains(t, err, "not a valid sha256")
+	_, err = transfer.ParseChecksum("crc32:5eb63bbb")
+	assert.ErrorContains(t, err, "unsupported")
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
-	"net/http/httptrace"
 	"regexp"
 	"strings"
 
@@ -15,6 +13,7 @@ import (
 
 	"github.com/ccontavalli/enkit/lib/client"
 	"github.com/ccontavalli/enkit/lib/config/marshal"
+	"github.com/ccontavalli/enkit/lib/kemail"
 	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -53,6 +52,16 @@ var (
 		Name: "probe_gauge",
 		Help: "Time to complete the last probe, broken down by operation type.",
 	}, []string{"target", "type"})
+
+	probeHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_healthy",
+		Help: "1 if the last probe succeeded, 0 otherwise.",
+	}, []string{"target"})
+
+	certExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_cert_expiry_seconds",
+		Help: "Seconds left before the first certificate presented by the target expires, negative if already expired.",
+	}, []string{"target"})
 )
 
 var removeIPsAndDomains = regexp.MustCompile(`[a-zA-Z0-9_-]+(\.[a-zA-Z0-9_-]+)+[.]?(:[0-9]+)?`)
@@ -61,156 +70,150 @@ func FormatError(err error) string {
 	return removeIPsAndDomains.ReplaceAllString(err.Error(), "${ip:port}")
 }
 
-func trace(transport *http.Transport, name, site string) {
-	exportedCount.WithLabelValues(name, "attempted").Add(1)
+// Probe is the configuration of a probe, as read from the config file.
+type Probe struct {
+	// One of http (default), tcp, tls, dns, icmp.
+	Type string
 
-	req, err := http.NewRequest("GET", site, nil)
-	if err != nil {
-		errorCount.WithLabelValues(name, FormatError(err)).Add(1)
-		exportedCount.WithLabelValues(name, "internal-error").Add(1)
-		return
-	}
+	Name string
+	// What to probe: a URL for http probes, a host:port for tcp and tls probes,
+	// the name to resolve for dns probes, a host or IP for icmp probes.
+	Address string
 
-	var RunStart, DNSStart, ConnectStart, WriteStart, ReadStart time.Time
-	var RunDuration, DNSDuration, ConnectDuration, WriteDuration, FirstReadDuration, FullReadDuration time.Duration
-	var bodyBytes []byte
-
-	RunStart = time.Now()
-	defer func() {
-		now := time.Now()
-		RunDuration = now.Sub(RunStart)
-		metrics := []struct {
-			name  string
-			start time.Time
-			value time.Duration
-		}{
-			{"run", RunStart, RunDuration},
-			{"dns", DNSStart, DNSDuration},
-			{"connect", ConnectStart, ConnectDuration},
-			{"write", WriteStart, WriteDuration},
-			{"firstread", ReadStart, FirstReadDuration},
-			{"fullread", ReadStart, FullReadDuration},
-		}
+	// How often to run the probe, 10s by default.
+	Interval time.Duration
+	// How long to wait for the probe to complete, defaults to the Interval.
+	Timeout time.Duration
+
+	// http probes: method to use, GET by default, status codes considered
+	// healthy, any < 400 by default, and a regular expression the body must match.
+	Method       string
+	ExpectStatus []int
+	ExpectBody   string
+
+	// http and tls probes: skip verification of the certificate.
+	Insecure bool
+	// tls probes: name to use for SNI and verification, the host in Address by default,
+	// and how long before the certificate expires the probe should start failing.
+	ServerName string
+	MinExpiry  time.Duration
+
+	// dns probes: server to query, the system resolver by default, type of record
+	// to look up, A by default, and values that must be present in the answer.
+	Server     string
+	RecordType string
+	Expect     []string
+}
 
-		for _, metric := range metrics {
-			if metric.start.IsZero() {
-				log.Printf("skipping metric %s - still zero - %#v", metric.name, metric)
-				continue
-			}
-			// This code is run as part of a defer, when an error may have happened.
-			// Blame the time we spent until the error happened on any timer that was started
-			// before the error happened.
-			difference := metric.value
-			if difference == 0 {
-				difference = now.Sub(metric.start)
-			}
+type Config struct {
+	Notify NotifyConfig
+	Probe  []Probe
+}
 
-			exportedSummary.WithLabelValues(name, metric.name).Observe(difference.Seconds())
-			exportedGauge.WithLabelValues(name, metric.name).Set(difference.Seconds())
-			exportedTotal.WithLabelValues(name, fmt.Sprintf("%s", metric.name)).Add(difference.Seconds())
-		}
+// Monitor runs a probe periodically, exports its metrics, and notifies state changes.
+type Monitor struct {
+	Probe     Probe
+	Prober    Prober
+	Tracker   *Tracker
+	Notifiers []Notifier
+}
 
-		log.Printf("%s - %d bytes - run:%s, dns:%s, connect:%s, write:%s, firstread:%s, fullread:%s",
-			site, len(bodyBytes), RunDuration, DNSDuration, ConnectDuration, WriteDuration, FirstReadDuration, FullReadDuration)
-
-	}()
-
-	trace := &httptrace.ClientTrace{
-		DNSStart: func(dnsInfo httptrace.DNSStartInfo) {
-			DNSStart = time.Now()
-		},
-		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
-			DNSDuration = time.Since(DNSStart)
-		},
-
-		ConnectStart: func(network, addr string) {
-			ConnectStart = time.Now()
-		},
-		ConnectDone: func(network, addr string, err error) {
-			ConnectDuration = time.Since(ConnectStart)
-			WriteStart = time.Now()
-		},
-
-		WroteHeaders: func() {
-			WriteDuration = time.Since(WriteStart)
-			ReadStart = time.Now()
-		},
-		GotFirstResponseByte: func() {
-			FirstReadDuration = time.Since(ReadStart)
-		},
+func NewMonitor(p Probe, notify *NotifyConfig, notifiers []Notifier) (*Monitor, error) {
+	if p.Interval <= 0 {
+		p.Interval = 10 * time.Second
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = p.Interval
+	}
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		p.Name = p.Address
+	}
+	if p.Address == "" {
+		return nil, fmt.Errorf("probe %s - an Address must be specified", p.Name)
 	}
 
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
-	resp, err := transport.RoundTrip(req)
+	prober, err := NewProber(&p)
 	if err != nil {
-		errorCount.WithLabelValues(name, FormatError(err)).Add(1)
-		exportedCount.WithLabelValues(name, "request-error").Add(1)
-		return
+		return nil, err
 	}
-	exportedCount.WithLabelValues(name, fmt.Sprintf("status-%d", resp.StatusCode)).Add(1)
+	return &Monitor{Probe: p, Prober: prober, Tracker: NewTracker(notify.Threshold), Notifiers: notifiers}, nil
+}
+
+// RunOnce runs the probe once, and records the results.
+func (m *Monitor) RunOnce() error {
+	name := m.Probe.Name
+	exportedCount.WithLabelValues(name, "attempted").Add(1)
+
+	timer := &Timer{}
+	timer.Start("run")
+	ctx, cancel := context.WithTimeout(context.Background(), m.Probe.Timeout)
+	defer cancel()
+	status, err := m.Prober.Probe(ctx, timer)
+	timer.Stop("run")
 
-	defer resp.Body.Close()
-	bodyBytes, err = ioutil.ReadAll(resp.Body)
+	exportedCount.WithLabelValues(name, status).Add(1)
 	if err != nil {
 		errorCount.WithLabelValues(name, FormatError(err)).Add(1)
-		exportedCount.WithLabelValues(name, "read-error").Add(1)
-		return
 	}
-	FullReadDuration = time.Since(ReadStart)
-}
 
-func probe(p Probe) {
-	if p.Interval <= 0 {
-		p.Interval = 10 * time.Second
+	var timings []string
+	for _, metric := range timer.Durations(time.Now()) {
+		exportedSummary.WithLabelValues(name, metric.name).Observe(metric.duration.Seconds())
+		exportedGauge.WithLabelValues(name, metric.name).Set(metric.duration.Seconds())
+		exportedTotal.WithLabelValues(name, metric.name).Add(metric.duration.Seconds())
+		timings = append(timings, fmt.Sprintf("%s:%s", metric.name, metric.duration))
 	}
-	p.Name = strings.TrimSpace(p.Name)
-	if p.Name == "" {
-		p.Name = p.Address
+
+	result := status
+	if err != nil {
+		result = fmt.Sprintf("%s (%s)", status, err)
 	}
+	log.Printf("%s - %s - %s", name, result, strings.Join(timings, ", "))
 
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   p.Interval,
-			KeepAlive: p.Interval,
-			DualStack: true,
-		}).DialContext,
-		ForceAttemptHTTP2:     false,
-		DisableKeepAlives:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	healthy := 0.
+	if err == nil {
+		healthy = 1
 	}
+	probeHealthy.WithLabelValues(name).Set(healthy)
+
+	from, since, changed := m.Tracker.Update(err == nil, time.Now())
+	if changed {
+		transition := &Transition{
+			Probe:   name,
+			Type:    m.Probe.Type,
+			Address: m.Probe.Address,
+			From:    from,
+			To:      m.Tracker.state,
+			Since:   since,
+		}
+		if err != nil {
+			transition.Error = err.Error()
+		}
+		transition.Text = transition.Summary()
+		log.Printf("%s - %s", name, transition.Text)
+		go Dispatch(m.Notifiers, transition)
+	}
+	return err
+}
 
+// Run runs the probe forever, at the configured interval.
+func (m *Monitor) Run() {
 	for {
 		started := time.Now()
-		trace(transport, p.Name, p.Address)
+		m.RunOnce()
 
 		elapsed := time.Now().Sub(started)
-		difference := p.Interval - elapsed
+		difference := m.Probe.Interval - elapsed
 		if difference > 0 {
 			time.Sleep(difference)
 		} else {
 			difference = -1 * difference
-			accumulatedDelay.WithLabelValues(p.Name).Add(difference.Seconds())
+			accumulatedDelay.WithLabelValues(m.Probe.Name).Add(difference.Seconds())
 		}
 	}
 }
 
-type Probe struct {
-	Type string
-
-	Name    string
-	Address string
-
-	Interval time.Duration
-}
-
-type Config struct {
-	Probe []Probe
-}
-
 func main() {
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -222,7 +225,12 @@ func main() {
 		SilenceErrors: true,
 		Example: `  $ monitor -p 8080 ./probes.toml
 	To start a monitoring daemon running the probes defined in probes.cfg,
-	providing a UI on port 8080.`,
+	providing a UI on port 8080.
+
+  $ monitor --notify-smtp-host smtp.example.com --notify-smtp-user monitor \
+      --notify-smtp-password-file /etc/monitor/smtp ./probes.toml
+	Same as above, sending an email to the addresses in the Notify
+	section of probes.toml when a probe starts failing, or recovers.`,
 	}
 
 	base := client.DefaultBaseFlags(root.Name(), "enkit")
@@ -230,9 +238,15 @@ func main() {
 	port := 7777
 	root.Flags().IntVarP(&port, "port", "p", port, "Port number on which the probing daemon will be listening for connections.")
 
+	smtp := kemail.DefaultDialerFlags()
+	smtp.Register(&kcobra.FlagSet{FlagSet: root.Flags()}, "notify-")
+
 	root.RunE = func(cmd *cobra.Command, args []string) error {
-		base.Log.Warnf("Listening on port %d", port)
+		dialer := func() (kemail.Dialer, error) {
+			return kemail.NewDialer(kemail.FromDialerFlags(smtp))
+		}
 
+		var monitors []*Monitor
 		for _, arg := range args {
 			var config Config
 			err := marshal.UnmarshalFile(arg, &config)
@@ -240,11 +254,24 @@ func main() {
 				return err
 			}
 
+			notifiers, err := NewNotifiers(&config.Notify, dialer)
+			if err != nil {
+				return fmt.Errorf("%s: %w", arg, err)
+			}
 			for _, p := range config.Probe {
-				go probe(p)
+				monitor, err := NewMonitor(p, &config.Notify, notifiers)
+				if err != nil {
+					return fmt.Errorf("%s: %w", arg, err)
+				}
+				monitors = append(monitors, monitor)
 			}
 		}
 
+		for _, monitor := range monitors {
+			go monitor.Run()
+		}
+
+		base.Log.Warnf("Listening on port %d", port)
 		return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 	}
 
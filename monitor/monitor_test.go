@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runProbe(t *testing.T, p Probe) (string, error) {
+	prober, err := NewProber(&p)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return prober.Probe(ctx, &Timer{})
+}
+
+func TestHTTPProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "all systems nominal")
+	}))
+	defer server.Close()
+
+	status, err := runProbe(t, Probe{Address: server.URL, ExpectBody: "nominal$"})
+	assert.NoError(t, err)
+	assert.Equal(t, "status-200", status)
+
+	status, err = runProbe(t, Probe{Address: server.URL, ExpectBody: "degraded"})
+	assert.ErrorContains(t, err, "does not match")
+	assert.Equal(t, "status-200", status)
+
+	status, err = runProbe(t, Probe{Address: server.URL + "/missing"})
+	assert.ErrorContains(t, err, "unexpected status")
+	assert.Equal(t, "status-404", status)
+
+	_, err = runProbe(t, Probe{Address: server.URL + "/missing", ExpectStatus: []int{404}})
+	assert.NoError(t, err)
+
+	_, err = NewProber(&Probe{Address: server.URL, ExpectBody: "("})
+	assert.Error(t, err)
+}
+
+func TestTCPAndTLSProbe(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	_, err := runProbe(t, Probe{Type: "tcp", Address: address})
+	assert.NoError(t, err)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+	status, err := runProbe(t, Probe{Type: "tcp", Address: closed.Addr().String()})
+	assert.Error(t, err)
+	assert.Equal(t, "connect-error", status)
+
+	// The test server certificate is self signed.
+	status, err = runProbe(t, Probe{Type: "tls", Address: address})
+	assert.Error(t, err)
+	assert.Equal(t, "handshake-error", status)
+
+	_, err = runProbe(t, Probe{Type: "tls", Address: address, Insecure: true})
+	assert.NoError(t, err)
+
+	left := time.Until(server.Certificate().NotAfter)
+	status, err = runProbe(t, Probe{Type: "tls", Address: address, Insecure: true, MinExpiry: left + 24*time.Hour})
+	assert.ErrorContains(t, err, "expires in")
+	assert.Equal(t, "expiring", status)
+}
+
+func TestDNSProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		if req.Question[0].Name == "www.example.com." && req.Question[0].Qtype == dns.TypeA {
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+		} else {
+			reply.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(reply)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	_, err = runProbe(t, Probe{Type: "dns", Address: "www.example.com", Server: conn.LocalAddr().String(), Expect: []string{"192.0.2.1"}})
+	assert.NoError(t, err)
+
+	status, err := runProbe(t, Probe{Type: "dns", Address: "www.example.com", Server: conn.LocalAddr().String(), Expect: []string{"192.0.2.2"}})
+	assert.ErrorContains(t, err, "missing 192.0.2.2")
+	assert.Equal(t, "unexpected-answer", status)
+
+	status, err = runProbe(t, Probe{Type: "dns", Address: "missing.example.com", Server: conn.LocalAddr().String()})
+	assert.Error(t, err)
+	assert.Equal(t, "resolve-error", status)
+
+	_, err = NewProber(&Probe{Type: "dns", Address: "www.example.com", RecordType: "SRV"})
+	assert.Error(t, err)
+	_, err = NewProber(&Probe{Type: "carrier-pigeon"})
+	assert.Error(t, err)
+}
+
+func TestTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewTracker(2)
+
+	// Healthy from the start: not notified.
+	_, _, changed := tracker.Update(true, now)
+	assert.False(t, changed)
+	assert.Equal(t, StateHealthy, tracker.state)
+
+	// A single failure is not enough.
+	_, _, changed = tracker.Update(false, now.Add(time.Second))
+	assert.False(t, changed)
+	_, _, changed = tracker.Update(true, now.Add(2*time.Second))
+	assert.False(t, changed)
+
+	_, _, changed = tracker.Update(false, now.Add(3*time.Second))
+	assert.False(t, changed)
+	from, since, changed := tracker.Update(false, now.Add(4*time.Second))
+	assert.True(t, changed)
+	assert.Equal(t, StateHealthy, from)
+	assert.Equal(t, now.Add(3*time.Second), since)
+	assert.Equal(t, StateFailing, tracker.state)
+
+	_, _, changed = tracker.Update(true, now.Add(5*time.Second))
+	assert.False(t, changed)
+	from, _, changed = tracker.Update(true, now.Add(6*time.Second))
+	assert.True(t, changed)
+	assert.Equal(t, StateFailing, from)
+}
+
+func TestMonitorNotify(t *testing.T) {
+	var lock sync.Mutex
+	var received []Transition
+	done := make(chan struct{}, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var transition Transition
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&transition))
+		lock.Lock()
+		received = append(received, transition)
+		lock.Unlock()
+		done <- struct{}{}
+	}))
+	defer webhook.Close()
+
+	healthy := true
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	config := &NotifyConfig{Webhook: []string{webhook.URL}, Threshold: 1}
+	notifiers, err := NewNotifiers(config, nil)
+	require.NoError(t, err)
+	monitor, err := NewMonitor(Probe{Name: "target", Address: target.URL}, config, notifiers)
+	require.NoError(t, err)
+
+	assert.NoError(t, monitor.RunOnce())
+	healthy = false
+	assert.Error(t, monitor.RunOnce())
+	<-done
+	healthy = true
+	assert.NoError(t, monitor.RunOnce())
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, received, 2)
+	assert.Equal(t, StateFailing, received[0].To)
+	assert.Contains(t, received[0].Error, "500")
+	assert.Contains(t, received[0].Text, "probe target is FAILING")
+	assert.Equal(t, StateHealthy, received[1].To)
+
+	_, err = NewNotifiers(&NotifyConfig{Email: []string{"oncall@example.com"}}, nil)
+	assert.ErrorContains(t, err, "From")
+}
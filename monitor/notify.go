@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/kemail"
+	"gopkg.in/gomail.v2"
+)
+
+// State is the health of a probe, as seen by the notifiers.
+type State string
+
+const (
+	StateUnknown State = "unknown"
+	StateHealthy State = "healthy"
+	StateFailing State = "failing"
+)
+
+// NotifyConfig configures the notifications sent when probes change state.
+type NotifyConfig struct {
+	// URLs to POST a json description of the transition to.
+	//
+	// The json includes a "text" field, so slack, mattermost or google
+	// chat incoming webhooks can be used directly.
+	Webhook []string
+	// Email addresses to notify. Requires configuring an smtp server with the --notify-smtp-* flags.
+	Email []string
+	// Sender of the emails.
+	From string
+
+	// Number of consecutive failures before a probe is considered failing,
+	// and of consecutive successes before it is considered healthy again.
+	Threshold int
+}
+
+// Transition describes a probe changing state.
+type Transition struct {
+	Probe   string    `json:"probe"`
+	Type    string    `json:"type"`
+	Address string    `json:"address"`
+	From    State     `json:"from"`
+	To      State     `json:"to"`
+	Since   time.Time `json:"since"`
+	Error   string    `json:"error,omitempty"`
+	Text    string    `json:"text"`
+}
+
+func (t *Transition) Summary() string {
+	switch t.To {
+	case StateFailing:
+		return fmt.Sprintf("probe %s is FAILING since %s - %s", t.Probe, t.Since.Format(time.RFC3339), t.Error)
+	case StateHealthy:
+		return fmt.Sprintf("probe %s is HEALTHY again since %s", t.Probe, t.Since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("probe %s is %s", t.Probe, t.To)
+}
+
+// Tracker follows the state of a probe, debouncing transitions.
+type Tracker struct {
+	threshold int
+
+	state   State
+	pending State
+	count   int
+	since   time.Time
+}
+
+func NewTracker(threshold int) *Tracker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &Tracker{threshold: threshold, state: StateUnknown}
+}
+
+// Update records the result of a probe.
+//
+// Returns the previous state, the time the new state was first observed,
+// and true if the probe changed state and should be notified. A probe that
+// is healthy from the start is not notified.
+func (t *Tracker) Update(healthy bool, now time.Time) (State, time.Time, bool) {
+	result := StateFailing
+	if healthy {
+		result = StateHealthy
+	}
+
+	// The first healthy result just establishes the initial state.
+	if result == t.state || (t.state == StateUnknown && healthy) {
+		t.state, t.pending, t.count = result, "", 0
+		return t.state, time.Time{}, false
+	}
+	if result != t.pending {
+		t.pending, t.count, t.since = result, 0, now
+	}
+	t.count++
+	if t.count < t.threshold {
+		return t.state, time.Time{}, false
+	}
+
+	from := t.state
+	t.state, t.pending, t.count = result, "", 0
+	return from, t.since, true
+}
+
+// Notifier delivers a notification of a probe changing state.
+type Notifier interface {
+	Notify(t *Transition) error
+}
+
+// WebhookNotifier posts transitions as json.
+type WebhookNotifier struct {
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+}
+
+func (wn *WebhookNotifier) Notify(t *Transition) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wn.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", wn.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %s returned %s - %s", wn.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// EmailNotifier sends transitions by email.
+type EmailNotifier struct {
+	Dialer kemail.Dialer
+	From   string
+	To     []string
+}
+
+func (en *EmailNotifier) Notify(t *Transition) error {
+	message := gomail.NewMessage()
+	message.SetHeader("From", en.From)
+	message.SetHeader("To", en.To...)
+	message.SetHeader("Subject", "[monitor] "+t.Summary())
+	message.SetBody("text/plain", fmt.Sprintf(
+		"Probe: %s\nType: %s\nAddress: %s\nState: %s -> %s\nSince: %s\nError: %s\n",
+		t.Probe, t.Type, t.Address, t.From, t.To, t.Since.Format(time.RFC3339), t.Error))
+
+	return kemail.SendMessages(en.Dialer, []*gomail.Message{message}, func(*gomail.Message) string {
+		return strings.Join(en.To, ", ")
+	}, kemail.WithMaxAttempts(3), kemail.WithShuffle(false))
+}
+
+// NewNotifiers creates the notifiers configured.
+//
+// dialer is only required if email notifications are configured.
+func NewNotifiers(config *NotifyConfig, dialer func() (kemail.Dialer, error)) ([]Notifier, error) {
+	var notifiers []Notifier
+	for _, url := range config.Webhook {
+		notifiers = append(notifiers, &WebhookNotifier{URL: url, Client: http.DefaultClient, Timeout: 30 * time.Second})
+	}
+	if len(config.Email) > 0 {
+		if config.From == "" {
+			return nil, fmt.Errorf("email notifications require a From address in the Notify section")
+		}
+		d, err := dialer()
+		if err != nil {
+			return nil, fmt.Errorf("email notifications require an smtp server, see --notify-smtp-host - %w", err)
+		}
+		notifiers = append(notifiers, &EmailNotifier{Dialer: d, From: config.From, To: config.Email})
+	}
+	return notifiers, nil
+}
+
+// Dispatch delivers a transition to all notifiers, in parallel.
+//
+// Returns once all notifiers completed. Errors are logged.
+func Dispatch(notifiers []Notifier, t *Transition) {
+	var wg sync.WaitGroup
+	for _, notifier := range notifiers {
+		wg.Add(1)
+		go func(notifier Notifier) {
+			defer wg.Done()
+			if err := notifier.Notify(t); err != nil {
+				log.Printf("%s - notification failed - %s", t.Probe, err)
+			}
+		}(notifier)
+	}
+	wg.Wait()
+}
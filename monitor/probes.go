@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccontavalli/enkit/lib/icmp"
+)
+
+// Prober runs a single type of probe against a target.
+type Prober interface {
+	// Probe runs the probe once, recording the duration of each phase in timer.
+	//
+	// Returns the status of the probe, used as a label in the probe_count metric,
+	// and a non nil error if the probe failed.
+	Probe(ctx context.Context, timer *Timer) (string, error)
+}
+
+// Timer records the duration of the phases of a probe.
+//
+// Probes may be interrupted by errors or timeouts at any time: phases
+// that were started and not stopped are accounted until the end of the probe.
+type Timer struct {
+	lock   sync.Mutex
+	phases []phase
+}
+
+type phase struct {
+	name     string
+	start    time.Time
+	duration time.Duration
+}
+
+// Start starts timing the named phase.
+func (t *Timer) Start(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.phases = append(t.phases, phase{name: name, start: time.Now()})
+}
+
+// Stop stops timing the last phase started with the specified name.
+func (t *Timer) Stop(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := len(t.phases) - 1; i >= 0; i-- {
+		if t.phases[i].name == name {
+			if t.phases[i].duration == 0 {
+				t.phases[i].duration = time.Since(t.phases[i].start)
+			}
+			return
+		}
+	}
+}
+
+// Durations returns the duration of each phase, as of now.
+func (t *Timer) Durations(now time.Time) []phase {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	result := make([]phase, 0, len(t.phases))
+	for _, p := range t.phases {
+		// Blame the time spent until the error happened on any timer that was started
+		// before the error happened.
+		if p.duration == 0 {
+			p.duration = now.Sub(p.start)
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// NewProber returns the Prober for the type of probe configured.
+func NewProber(p *Probe) (Prober, error) {
+	switch strings.ToLower(p.Type) {
+	case "", "http":
+		return NewHTTPProber(p)
+	case "tcp":
+		return &TCPProber{Address: p.Address}, nil
+	case "tls":
+		return NewTLSProber(p)
+	case "dns":
+		return NewDNSProber(p)
+	case "icmp":
+		return &ICMPProber{Address: p.Address}, nil
+	}
+	return nil, fmt.Errorf("unknown probe type %q - must be one of http, tcp, tls, dns, icmp", p.Type)
+}
+
+// HTTPProber fetches a URL, and optionally checks the status and content of the reply.
+type HTTPProber struct {
+	Method  string
+	Address string
+
+	// Status codes considered healthy. If empty, any status < 400.
+	ExpectStatus []int
+	// If not nil, the body must match this regular expression.
+	ExpectBody *regexp.Regexp
+
+	transport *http.Transport
+}
+
+func NewHTTPProber(p *Probe) (*HTTPProber, error) {
+	prober := &HTTPProber{
+		Method:       strings.ToUpper(p.Method),
+		Address:      p.Address,
+		ExpectStatus: p.ExpectStatus,
+		transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   p.Timeout,
+				KeepAlive: p.Interval,
+			}).DialContext,
+			ForceAttemptHTTP2:     false,
+			DisableKeepAlives:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   p.Timeout,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: p.Insecure},
+		},
+	}
+	if prober.Method == "" {
+		prober.Method = "GET"
+	}
+	if p.ExpectBody != "" {
+		re, err := regexp.Compile(p.ExpectBody)
+		if err != nil {
+			return nil, fmt.Errorf("probe %s - invalid ExpectBody - %w", p.Name, err)
+		}
+		prober.ExpectBody = re
+	}
+	return prober, nil
+}
+
+func (hp *HTTPProber) healthyStatus(status int) bool {
+	if len(hp.ExpectStatus) == 0 {
+		return status < 400
+	}
+	for _, expected := range hp.ExpectStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func (hp *HTTPProber) Probe(ctx context.Context, timer *Timer) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, hp.Method, hp.Address, nil)
+	if err != nil {
+		return "internal-error", err
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(dnsInfo httptrace.DNSStartInfo) {
+			timer.Start("dns")
+		},
+		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
+			timer.Stop("dns")
+		},
+
+		ConnectStart: func(network, addr string) {
+			timer.Start("connect")
+		},
+		ConnectDone: func(network, addr string, err error) {
+			timer.Stop("connect")
+			timer.Start("write")
+		},
+
+		WroteHeaders: func() {
+			timer.Stop("write")
+			timer.Start("firstread")
+			timer.Start("fullread")
+		},
+		GotFirstResponseByte: func() {
+			timer.Stop("firstread")
+		},
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := hp.transport.RoundTrip(req)
+	if err != nil {
+		return "request-error", err
+	}
+	defer resp.Body.Close()
+
+	status := fmt.Sprintf("status-%d", resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "read-error", err
+	}
+	timer.Stop("fullread")
+
+	if !hp.healthyStatus(resp.StatusCode) {
+		return status, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if hp.ExpectBody != nil && !hp.ExpectBody.Match(body) {
+		return status, fmt.Errorf("body of %d bytes does not match %s", len(body), hp.ExpectBody)
+	}
+	return status, nil
+}
+
+// TCPProber checks that a TCP connection can be established.
+type TCPProber struct {
+	Address string
+}
+
+func (tp *TCPProber) Probe(ctx context.Context, timer *Timer) (string, error) {
+	timer.Start("connect")
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", tp.Address)
+	if err != nil {
+		return "connect-error", err
+	}
+	timer.Stop("connect")
+	conn.Close()
+	return "success", nil
+}
+
+// TLSProber completes a TLS handshake, and reports the expiry of the certificates.
+type TLSProber struct {
+	Name       string
+	Address    string
+	ServerName string
+	Insecure   bool
+	// If the certificate expires in less than MinExpiry, the probe fails.
+	MinExpiry time.Duration
+
+	now func() time.Time
+}
+
+func NewTLSProber(p *Probe) (*TLSProber, error) {
+	serverName := p.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(p.Address)
+		if err != nil {
+			return nil, fmt.Errorf("probe %s - tls probes require an address in the host:port format - %w", p.Name, err)
+		}
+		serverName = host
+	}
+	return &TLSProber{
+		Name:       p.Name,
+		Address:    p.Address,
+		ServerName: serverName,
+		Insecure:   p.Insecure,
+		MinExpiry:  p.MinExpiry,
+		now:        time.Now,
+	}, nil
+}
+
+func (tp *TLSProber) Probe(ctx context.Context, timer *Timer) (string, error) {
+	timer.Start("connect")
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", tp.Address)
+	if err != nil {
+		return "connect-error", err
+	}
+	timer.Stop("connect")
+	defer conn.Close()
+
+	timer.Start("handshake")
+	client := tls.Client(conn, &tls.Config{ServerName: tp.ServerName, InsecureSkipVerify: tp.Insecure})
+	if err := client.HandshakeContext(ctx); err != nil {
+		return "handshake-error", err
+	}
+	timer.Stop("handshake")
+
+	certs := client.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "handshake-error", fmt.Errorf("no certificate presented")
+	}
+	// The connection breaks as soon as any certificate in the chain expires.
+	first := certs[0]
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(first.NotAfter) {
+			first = cert
+		}
+	}
+	left := first.NotAfter.Sub(tp.now())
+	certExpiry.WithLabelValues(tp.Name).Set(left.Seconds())
+
+	if left < tp.MinExpiry {
+		return "expiring", fmt.Errorf("certificate %q expires in %s, on %s", first.Subject.CommonName, left.Round(time.Minute), first.NotAfter.Format(time.RFC3339))
+	}
+	return "success", nil
+}
+
+// DNSProber resolves a name, optionally against a specific server.
+type DNSProber struct {
+	Query      string
+	RecordType string
+	// Values that must be present in the answer. If empty, any non empty answer is fine.
+	Expect []string
+
+	resolver *net.Resolver
+}
+
+func NewDNSProber(p *Probe) (*DNSProber, error) {
+	prober := &DNSProber{
+		Query:      p.Address,
+		RecordType: strings.ToUpper(p.RecordType),
+		Expect:     p.Expect,
+		resolver:   net.DefaultResolver,
+	}
+	if prober.RecordType == "" {
+		prober.RecordType = "A"
+	}
+	switch prober.RecordType {
+	case "A", "AAAA", "CNAME", "MX", "NS", "TXT":
+	default:
+		return nil, fmt.Errorf("probe %s - unsupported RecordType %q - must be one of A, AAAA, CNAME, MX, NS, TXT", p.Name, p.RecordType)
+	}
+
+	if p.Server != "" {
+		server := p.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		prober.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server)
+			},
+		}
+	}
+	return prober, nil
+}
+
+func (dp *DNSProber) lookup(ctx context.Context) ([]string, error) {
+	var result []string
+	switch dp.RecordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if dp.RecordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := dp.resolver.LookupIP(ctx, network, dp.Query)
+		for _, ip := range ips {
+			result = append(result, ip.String())
+		}
+		return result, err
+	case "CNAME":
+		cname, err := dp.resolver.LookupCNAME(ctx, dp.Query)
+		if cname != "" {
+			result = append(result, cname)
+		}
+		return result, err
+	case "MX":
+		mxs, err := dp.resolver.LookupMX(ctx, dp.Query)
+		for _, mx := range mxs {
+			result = append(result, mx.Host)
+		}
+		return result, err
+	case "NS":
+		nss, err := dp.resolver.LookupNS(ctx, dp.Query)
+		for _, ns := range nss {
+			result = append(result, ns.Host)
+		}
+		return result, err
+	case "TXT":
+		return dp.resolver.LookupTXT(ctx, dp.Query)
+	}
+	return nil, fmt.Errorf("unsupported record type %s", dp.RecordType)
+}
+
+func (dp *DNSProber) Probe(ctx context.Context, timer *Timer) (string, error) {
+	timer.Start("resolve")
+	answers, err := dp.lookup(ctx)
+	if err != nil {
+		return "resolve-error", err
+	}
+	timer.Stop("resolve")
+
+	if len(answers) == 0 {
+		return "empty", fmt.Errorf("no %s record for %s", dp.RecordType, dp.Query)
+	}
+	for _, expected := range dp.Expect {
+		found := false
+		for _, answer := range answers {
+			if strings.EqualFold(strings.TrimSuffix(answer, "."), strings.TrimSuffix(expected, ".")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "unexpected-answer", fmt.Errorf("%s %s resolved to %s, missing %s", dp.Query, dp.RecordType, strings.Join(answers, ", "), expected)
+		}
+	}
+	return "success", nil
+}
+
+var (
+	pingerOnce sync.Once
+	pinger     *icmp.PingHandler
+	pingerErr  error
+)
+
+// sharedPinger returns the PingHandler shared by all the icmp probes.
+//
+// Sending icmp packets requires privileges (CAP_NET_RAW on linux), so the
+// sockets are only opened if there's at least one icmp probe configured.
+func sharedPinger() (*icmp.PingHandler, error) {
+	pingerOnce.Do(func() {
+		var options []icmp.DispatcherOption
+		var errs []string
+		for _, bindto := range []string{"0.0.0.0", "::"} {
+			socket, err := icmp.NewSocket(bindto)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			options = append(options, icmp.AddSocket(socket))
+		}
+		if len(options) == 0 {
+			pingerErr = fmt.Errorf("could not open icmp sockets - %s", strings.Join(errs, ", "))
+			return
+		}
+
+		dispatcher, err := icmp.NewDispatcher(options...)
+		if err != nil {
+			pingerErr = err
+			return
+		}
+		pinger, pingerErr = icmp.NewPingHandler(dispatcher)
+		if pingerErr != nil {
+			return
+		}
+		go dispatcher.Run()
+		go pinger.Run()
+	})
+	return pinger, pingerErr
+}
+
+// ICMPProber sends an echo request, and waits for the reply.
+type ICMPProber struct {
+	Address string
+}
+
+func (ip *ICMPProber) Probe(ctx context.Context, timer *Timer) (string, error) {
+	pinger, err := sharedPinger()
+	if err != nil {
+		return "internal-error", err
+	}
+
+	timer.Start("dns")
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, ip.Address)
+	if err != nil {
+		return "resolve-error", err
+	}
+	timer.Stop("dns")
+
+	timeout := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	type reply struct {
+		ok  bool
+		err error
+	}
+	replied := make(chan reply, 1)
+	timer.Start("rtt")
+	go func() {
+		_, message, err := pinger.SendAndWait([]byte("enkit-monitor"), &addrs[0], timeout)
+		replied <- reply{ok: message != nil, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "timeout", ctx.Err()
+	case r := <-replied:
+		if r.err != nil {
+			return "send-error", r.err
+		}
+		if !r.ok {
+			return "timeout", fmt.Errorf("no reply from %s within %s", addrs[0].String(), timeout)
+		}
+	}
+	timer.Stop("rtt")
+	return "success", nil
+}
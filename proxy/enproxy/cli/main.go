@@ -28,36 +28,12 @@ func currentConfigOrRejectLegacy(binding config.Binding, normalizer *enproxy.Con
 		return current, warnings, nil
 	}
 
-	var legacy legacyConfig
-	if legacyErr := binding.Unmarshal(&legacy); legacyErr == nil && legacy.looksLegacy() {
+	if version, detectErr := enproxy.DetectConfigVersion(binding.Unmarshal); detectErr == nil && version < enproxy.ConfigVersion {
 		return enproxy.Config{}, nil, rejectLegacyConfig()
 	}
 	return enproxy.Config{}, nil, err
 }
 
-func loadLegacyConfig(binding config.Binding, relayHost string) (legacyConfig, error) {
-	var legacy legacyConfig
-	if err := binding.Unmarshal(&legacy); err == nil && legacy.looksLegacy() {
-		upgraded, err := legacy.upgrade(relayHost)
-		if err != nil {
-			return legacyConfig{}, err
-		}
-		if _, _, err := (&upgraded).Parse(); err != nil {
-			return legacyConfig{}, err
-		}
-		return legacy, nil
-	}
-
-	if _, _, err := enproxy.ParseConfigBinding(binding, relayHost); err == nil {
-		return legacyConfig{}, kflags.NewUsageErrorf("selected config is already in the current enproxy format")
-	}
-
-	if err := binding.Unmarshal(&legacy); err != nil {
-		return legacyConfig{}, err
-	}
-	return legacyConfig{}, kflags.NewUsageErrorf("selected config is not in the legacy enproxy format")
-}
-
 func printWarnings(out io.Writer, warnings enproxy.Warnings) {
 	for _, warning := range warnings {
 		_, _ = fmt.Fprintln(out, warning)
@@ -179,14 +155,14 @@ func NewConfigUpdateCommand(rng *rand.Rand, flags *enproxy.Flags) *cobra.Command
 			defer workspace.Close()
 			defer store.Close()
 
-			relayHost := strings.TrimSpace(flags.Nassh.RelayHost)
-			legacy, err := loadLegacyConfig(binding, relayHost)
+			schema := enproxy.NewConfigSchema(strings.TrimSpace(flags.Nassh.RelayHost))
+			var upgraded enproxy.Config
+			from, err := schema.Load(binding.Unmarshal, &upgraded)
 			if err != nil {
 				return err
 			}
-			upgraded, err := legacy.upgrade(relayHost)
-			if err != nil {
-				return err
+			if from == schema.Version() {
+				return kflags.NewUsageErrorf("selected config is already in the current enproxy format")
 			}
 			if err := binding.Marshal(upgraded); err != nil {
 				return fmt.Errorf("failed to update config: %w", err)
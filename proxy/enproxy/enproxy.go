@@ -669,6 +669,9 @@ func WithOauthRedirector(rflags *oauth.RedirectorFlags) Modifier {
 		if err := WithAuthenticator(redirector.Authenticate)(op); err != nil {
 			return err
 		}
+		// Credentials supplied in the Authorization header are removed by the
+		// redirector itself, the cookie is removed by the proxy: neither reaches
+		// the backend.
 		return WithProxyMods(
 			httpp.WithStripCookie([]string{redirector.CredentialsCookieName()}),
 		)(op)
@@ -0,0 +1,120 @@
+package enproxy
+
+import (
+	"strings"
+
+	"github.com/ccontavalli/enkit/lib/config/typed"
+	"github.com/ccontavalli/enkit/lib/kflags"
+	"github.com/ccontavalli/enkit/lib/khttp"
+	"github.com/ccontavalli/enkit/proxy/httpp"
+)
+
+const (
+	// ConfigVersionLegacy is the pre-module config format, mapping urls
+	// directly to proxy backends.
+	ConfigVersionLegacy = 1
+	// ConfigVersion is the version of the current Config format.
+	ConfigVersion = 2
+)
+
+// configV1 is the pre-module enproxy config format.
+type configV1 struct {
+	Mapping []httpp.Mapping
+	Domains []string
+	Tunnels []string
+}
+
+func (cfg configV1) looksLegacy() bool {
+	for _, mapping := range cfg.Mapping {
+		if strings.TrimSpace(mapping.To) != "" || mapping.Transform != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectConfigVersion returns the version of the Config document read.
+//
+// Config does not store a version: legacy documents are recognized by
+// their mappings having a proxy backend rather than a target.
+func DetectConfigVersion(read typed.Reader) (int, error) {
+	var legacy configV1
+	if err := read(&legacy); err == nil && legacy.looksLegacy() {
+		return ConfigVersionLegacy, nil
+	}
+	return ConfigVersion, nil
+}
+
+// NewConfigSchema returns the schema of Config documents.
+//
+// relayHost is the NASSH relay host used to upgrade legacy documents with
+// tunnels, as those relied on the --host-port flag to serve the relay.
+func NewConfigSchema(relayHost string) *typed.Schema[Config] {
+	schema := typed.NewSchema[Config](ConfigVersion).Detect(DetectConfigVersion)
+	return typed.Upgrade(schema, ConfigVersionLegacy, func(legacy configV1) (Config, error) {
+		upgraded, err := legacy.upgrade(relayHost)
+		if err != nil {
+			return Config{}, err
+		}
+		if _, _, err := upgraded.Parse(); err != nil {
+			return Config{}, err
+		}
+		return upgraded, nil
+	})
+}
+
+func init() {
+	typed.Register("enproxy.Config", NewConfigSchema(""))
+}
+
+func (cfg configV1) upgrade(relayHost string) (Config, error) {
+	upgraded := Config{
+		Mapping: make([]Mapping, 0, len(cfg.Mapping)+1),
+		Domains: append([]string(nil), cfg.Domains...),
+		Tunnels: append([]string(nil), cfg.Tunnels...),
+	}
+
+	for _, mapping := range cfg.Mapping {
+		upgraded.Mapping = append(upgraded.Mapping, Mapping{
+			Name:   mapping.Name,
+			From:   mapping.From,
+			Auth:   mapping.Auth,
+			Target: Target{Proxy: &ProxyTarget{To: mapping.To, Transform: mapping.Transform}},
+		})
+	}
+
+	if len(cfg.Tunnels) > 0 {
+		mapping, err := legacyNasshMapping(relayHost)
+		if err != nil {
+			return Config{}, err
+		}
+		upgraded.Mapping = append(upgraded.Mapping, mapping)
+	}
+
+	return upgraded, nil
+}
+
+func legacyNasshMapping(relayHost string) (Mapping, error) {
+	relayHost = strings.TrimSpace(relayHost)
+	if relayHost == "" {
+		return Mapping{}, kflags.NewUsageErrorf("legacy config contains tunnels; upgrade it with `enproxyctl --host-port=<relay host> config update`")
+	}
+
+	routeHost := strings.TrimSpace(khttp.LooselyGetHost(relayHost))
+	if routeHost == "" {
+		return Mapping{}, kflags.NewUsageErrorf("legacy NASSH relay host %q does not contain a routable host", relayHost)
+	}
+
+	target := &NasshTarget{}
+	if routeHost != relayHost {
+		target.RelayHost = relayHost
+	}
+	return Mapping{
+		Name: "nassh",
+		From: httpp.HostPath{
+			Host: routeHost,
+			Path: "/",
+		},
+		Target: Target{Nassh: target},
+	}, nil
+}
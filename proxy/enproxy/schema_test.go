@@ -1,15 +1,17 @@
-package main
+package enproxy
 
 import (
 	"testing"
 
+	"github.com/ccontavalli/enkit/lib/config/marshal"
+	"github.com/ccontavalli/enkit/lib/config/typed"
 	"github.com/ccontavalli/enkit/proxy/httpp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestLegacyConfigUpgrade(t *testing.T) {
-	legacy := legacyConfig{
+func TestConfigV1Upgrade(t *testing.T) {
+	legacy := configV1{
 		Mapping: []httpp.Mapping{{
 			Name: "api",
 			From: httpp.HostPath{Host: "example.com", Path: "/api/"},
@@ -49,8 +51,8 @@ func TestLegacyConfigUpgrade(t *testing.T) {
 	}
 }
 
-func TestLegacyConfigUpgradeOmitsRedundantRelayHost(t *testing.T) {
-	legacy := legacyConfig{
+func TestConfigV1UpgradeOmitsRedundantRelayHost(t *testing.T) {
+	legacy := configV1{
 		Mapping: []httpp.Mapping{{
 			From: httpp.HostPath{Host: "example.com", Path: "/"},
 			To:   "https://backend.example.com",
@@ -69,8 +71,8 @@ func TestLegacyConfigUpgradeOmitsRedundantRelayHost(t *testing.T) {
 	}
 }
 
-func TestLegacyConfigUpgradeRequiresRelayHostForTunnels(t *testing.T) {
-	legacy := legacyConfig{
+func TestConfigV1UpgradeRequiresRelayHostForTunnels(t *testing.T) {
+	legacy := configV1{
 		Mapping: []httpp.Mapping{{
 			From: httpp.HostPath{Host: "example.com", Path: "/"},
 			To:   "https://backend.example.com",
@@ -82,8 +84,44 @@ func TestLegacyConfigUpgradeRequiresRelayHostForTunnels(t *testing.T) {
 	assert.ErrorContains(t, err, "--host-port")
 }
 
-func TestLegacyConfigLooksLegacy(t *testing.T) {
-	assert.False(t, (legacyConfig{}).looksLegacy())
-	assert.False(t, legacyConfig{Mapping: []httpp.Mapping{{From: httpp.HostPath{Host: "example.com", Path: "/"}}}}.looksLegacy())
-	assert.True(t, legacyConfig{Mapping: []httpp.Mapping{{To: "https://backend.example.com"}}}.looksLegacy())
+func TestConfigV1LooksLegacy(t *testing.T) {
+	assert.False(t, (configV1{}).looksLegacy())
+	assert.False(t, configV1{Mapping: []httpp.Mapping{{From: httpp.HostPath{Host: "example.com", Path: "/"}}}}.looksLegacy())
+	assert.True(t, configV1{Mapping: []httpp.Mapping{{To: "https://backend.example.com"}}}.looksLegacy())
+}
+
+func TestConfigSchemaUpgradesLegacyDocuments(t *testing.T) {
+	legacy := configV1{
+		Mapping: []httpp.Mapping{{
+			From: httpp.HostPath{Host: "example.com", Path: "/"},
+			To:   "https://backend.example.com",
+		}},
+	}
+	read := func(value interface{}) error {
+		data, err := marshal.Json.Marshal(legacy)
+		if err != nil {
+			return err
+		}
+		return marshal.Json.Unmarshal(data, value)
+	}
+
+	version, err := DetectConfigVersion(read)
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigVersionLegacy, version)
+
+	var upgraded Config
+	from, err := NewConfigSchema("").Load(read, &upgraded)
+	require.NoError(t, err)
+	assert.Equal(t, ConfigVersionLegacy, from)
+	if assert.Len(t, upgraded.Mapping, 1) && assert.NotNil(t, upgraded.Mapping[0].Target.Proxy) {
+		assert.Equal(t, "https://backend.example.com", upgraded.Mapping[0].Target.Proxy.To)
+	}
+
+	// Documents in the current format are left alone.
+	legacy = configV1{}
+	version, err = DetectConfigVersion(read)
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigVersion, version)
+
+	assert.NotNil(t, typed.Lookup("enproxy.Config"))
 }
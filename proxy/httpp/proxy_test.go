@@ -0,0 +1,77 @@
+package httpp
+
+import (
+	"github.com/ccontavalli/enkit/lib/oauth"
+	"github.com/ccontavalli/enkit/lib/srand"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatedProxyStripsCredentials(t *testing.T) {
+	var forwarded http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	authURL, err := url.Parse("https://auth.example.com/")
+	assert.NoError(t, err)
+	redirector, err := oauth.NewRedirector(
+		oauth.WithRng(rand.New(srand.Source)),
+		oauth.WithSigningExtractorFlags(oauth.DefaultSigningExtractorFlags()),
+		oauth.WithAuthURL(authURL),
+	)
+	assert.NoError(t, err)
+	token, err := redirector.EncodeCredentials(oauth.CredentialsCookie{
+		Identity: oauth.Identity{Id: "id", Username: "user", Organization: "example.com"},
+		Token:    oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)},
+	})
+	assert.NoError(t, err)
+
+	p, err := NewBuilder(WithAuthenticator(redirector.Authenticate), WithStripCookie([]string{redirector.CredentialsCookieName()}))
+	assert.NoError(t, err)
+	handler, err := p.CreateHandler(Mapping{From: HostPath{Path: "/"}, To: backend.URL})
+	assert.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(mod func(r *http.Request)) int {
+		forwarded = nil
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/path", nil)
+		assert.NoError(t, err)
+		req.Header.Set("User-Agent", "git/2.43.0")
+		mod(req)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Tokens in the Authorization header or in the cookie are not forwarded.
+	assert.Equal(t, http.StatusOK, get(func(r *http.Request) { r.SetBasicAuth("git", token) }))
+	assert.NotNil(t, forwarded)
+	assert.Empty(t, forwarded.Get("Authorization"))
+
+	assert.Equal(t, http.StatusOK, get(func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }))
+	assert.NotNil(t, forwarded)
+	assert.Empty(t, forwarded.Get("Authorization"))
+
+	assert.Equal(t, http.StatusOK, get(func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: redirector.CredentialsCookieName(), Value: token})
+		r.AddCookie(&http.Cookie{Name: "other", Value: "kept"})
+	}))
+	assert.NotNil(t, forwarded)
+	assert.Equal(t, "other=kept", forwarded.Get("Cookie"))
+
+	// Without a token, the request does not reach the backend.
+	assert.Equal(t, http.StatusUnauthorized, get(func(r *http.Request) { r.SetBasicAuth("user", "backend-password") }))
+	assert.Nil(t, forwarded)
+}
@@ -2,25 +2,28 @@ package main
 
 import (
 	"context"
-	"os"
+	"encoding/json"
 	"fmt"
+	"github.com/ccontavalli/enkit/lib/forge"
 	"github.com/ccontavalli/enkit/lib/github"
 	"github.com/ccontavalli/enkit/lib/kflags"
 	"github.com/ccontavalli/enkit/lib/kflags/kcobra"
 	"github.com/josephburnett/jd/lib"
 	"github.com/spf13/cobra"
+	"os"
+	"time"
 )
 
 func PostCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "post --github-... --pr=PR# --template='...' --diff-...",
-		Short: "Posts data to a new or existing stable comment",
+		Use:           "post --github-... --pr=PR# --template='...' --diff-...",
+		Short:         "Posts data to a new or existing stable comment",
 		SilenceUsage:  true,
 		SilenceErrors: true,
 
-		Args:  cobra.NoArgs,
+		Args: cobra.NoArgs,
 
-		Long: `"staco post" adds or updates a stable comment on github.
+		Long: `"staco post" adds or updates a stable comment on a PR.
 
 To use 'staco post' you must supply --github-owner, --github-repo and
 --pr to select the github repository and PR to work on.
@@ -31,6 +34,14 @@ https://github.com/cli/cli you can configure the token with:
 
   export GH_TOKEN=$(gh auth status -t 2>&1 |sed -ne 's/.*Token: //p')
 
+Repositories hosted on gitlab or gitea are supported as well, by
+passing --forge=gitlab or --forge=gitea. Use --gitlab-project, or
+--gitea-url, --gitea-owner and --gitea-repo to select the repository,
+and --gitlab-token or --gitea-token (or a GITLAB_TOKEN or GITEA_TOKEN
+environment variable) to authenticate. --pr is then the number of the
+merge request, as shown in the URL. When running in gitlab CI,
+--gitlab-url and --gitlab-project default to the current project.
+
 To describe the stable comment to add or update, you should specify
 the options --template, --json, and one of the --diff-* options.
 
@@ -84,11 +95,18 @@ an empty/skeleton --json, and always update the content via
     The first time this command is run, "Runs" will be initialized to an
     empty array, and immediately gain the {"Test":123} first value. If this
     command is re-run multiple times (on an actual PR), the "Runs"
-    array will keep growing with more and more {"Test":123} objects.`,
+    array will keep growing with more and more {"Test":123} objects.
+
+  $ staco post --forge gitlab --gitlab-project group/project --pr 12 \
+       --json '{"Runs":[]}' --template '{{. |printf "%#v"}}' \
+       --diff-patch '[{"op":"add", "path":"/Runs/-", "value":{"Test": 123}}]'
+
+    Same as above, on merge request !12 of the gitlab project
+    https://gitlab.com/group/project.`,
 	}
 
-	gh := github.DefaultRepoClientFlags()
-	gh.Register(&kcobra.FlagSet{cmd.Flags()}, "")
+	ff := github.DefaultForgeFlags()
+	ff.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
 
 	tf := github.DefaultStableCommentTransformerFlags()
 	tf.Register(&kcobra.FlagSet{cmd.Flags()}, "")
@@ -112,9 +130,9 @@ an empty/skeleton --json, and always update the content via
 			return err
 		}
 
-		var repo *github.RepoClient
+		var repo forge.Forge
 		if pr != 0 {
-			repo, err = github.NewRepoClient(github.RepoClientFromFlags(context.Background(), gh))
+			repo, err = github.NewForgeFromFlags(context.Background(), ff)
 			if err != nil {
 				return err
 			}
@@ -144,6 +162,147 @@ an empty/skeleton --json, and always update the content via
 	return cmd
 }
 
+func CheckCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           "check --github-... --sha=SHA --name=NAME --template='...' --diff-... --annotate=FILE",
+		Short:         "Creates or updates a check run, with a stable summary and annotations",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+
+		Args: cobra.NoArgs,
+
+		Long: `"staco check" creates or updates a github check run.
+
+Check runs are shown in the checks tab of a PR, with a status and a
+conclusion, and can annotate specific lines of files, which are then
+shown inline in the diff view.
+
+"staco check" works like "staco post": the summary of the check run is
+rendered from a --template and --json, stored in the check itself, so
+subsequent invocations can update the json with one of the --diff-*
+options. See "staco post --help" for details.
+
+Check runs are identified by --name and the --sha of the commit. If a
+check with the same name already exists on the commit, it is updated.
+
+Annotations are parsed from the build or test output supplied with
+--annotate, in the common "file:line[:column]: message" format printed
+by compilers, linters, bazel and go test. Use --strip-prefix to make
+absolute paths relative to the repository, and --go-module to locate
+files referenced in go test output. Annotations are appended to those
+already posted in the check.
+
+Github only allows github apps to create check runs: the --github-token
+(or GH_TOKEN) must be an installation token, like the GITHUB_TOKEN of a
+github action, rather than a personal access token.`,
+		Example: `
+  $ staco check --github-owner octo-test --github-repo octo-repo \
+       --sha $(git rev-parse HEAD) --name build --status in_progress \
+       --json '{"Steps":[]}' --template '{{range .Steps}}* {{.}}{{"\n"}}{{end}}'
+
+    Creates (or updates) the "build" check run for the current commit,
+    marking it as in progress.
+
+  $ bazel build //... 2>&1 | tee build.log
+  $ staco check --github-owner octo-test --github-repo octo-repo \
+       --sha $(git rev-parse HEAD) --name build --conclusion failure \
+       --diff-patch '[{"op":"add", "path":"/Steps/-", "value":"build failed"}]' \
+       --annotate build.log --strip-prefix $(pwd)
+
+    Completes the same check run as failed, appending a line to the
+    summary, and annotating the files with the errors in build.log.`,
+	}
+
+	gh := github.DefaultRepoClientFlags()
+	gh.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
+
+	tf := github.DefaultStableCommentTransformerFlags()
+	tf.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
+
+	scf := github.DefaultStableCommentFlags()
+	scf.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
+
+	crf := github.DefaultCheckRunFlags()
+	crf.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
+
+	apf := github.DefaultAnnotationParserFlags()
+	apf.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
+
+	var annotate []string
+	cmd.Flags().StringArrayVar(&annotate, "annotate", nil, "File with build or test output to parse for annotations, - for stdin (repeatable)")
+	var dryrun bool
+	cmd.Flags().BoolVarP(&dryrun, "dry-run", "n", false, "Don't change the check run, show what you would do")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		transformer, err := github.NewTransformerFromFlags(tf)
+		if err != nil {
+			return err
+		}
+
+		run, err := github.CheckRunFromFlags(crf, time.Now())
+		if err != nil {
+			return err
+		}
+
+		parser := github.NewAnnotationParser(github.AnnotationParserFromFlags(apf))
+		for _, file := range annotate {
+			if err := parseAnnotations(parser, file); err != nil {
+				return err
+			}
+		}
+		run.Output.Annotations = parser.Annotations()
+
+		sc, err := github.NewStableCheck(crf.Name, crf.SHA, github.StableCommentFromFlags(scf))
+		if err != nil {
+			return err
+		}
+
+		var repo *github.RepoClient
+		if crf.SHA != "" {
+			repo, err = github.NewRepoClient(github.RepoClientFromFlags(context.Background(), gh))
+			if err != nil {
+				return err
+			}
+
+			if err := sc.UpdateFromCheck(repo); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "WARNING: no SHA specified, --dryrun is assumed - just showing result on STDOUT\n")
+			dryrun = true
+		}
+
+		prepared, err := sc.PrepareCheckRun(transformer, run)
+		if err != nil {
+			return err
+		}
+		if !dryrun && repo != nil {
+			return sc.PostCheckRun(repo, prepared)
+		}
+
+		result, err := json.MarshalIndent(prepared, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("On SHA %s - would %s - content:\n===========\n%s\n==========\n", crf.SHA, sc.PostAction(), result)
+		return nil
+	}
+
+	return cmd
+}
+
+func parseAnnotations(parser *github.AnnotationParser, file string) error {
+	if file == "-" {
+		return parser.Parse(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parser.Parse(f)
+}
+
 func DiffCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "diff --input '{...}' --output '{...}'",
@@ -246,6 +405,9 @@ func ShowCommand() *cobra.Command {
 
 		Long: `"staco show" parses and shows the staco metadata in a PR.
 
+Just like "staco post", it works with github, gitlab or gitea
+repositories, see --forge.
+
 The command will scan all the comments of a PR, look for the staco
 comment with the specified --marker, and output the metdata
 stored in the comment itself: the json, and template used.
@@ -257,8 +419,8 @@ to edit the json with more familiar commands, to then
 pipe it back to the post command.`,
 	}
 
-	gh := github.DefaultRepoClientFlags()
-	gh.Register(&kcobra.FlagSet{cmd.Flags()}, "")
+	ff := github.DefaultForgeFlags()
+	ff.Register(&kcobra.FlagSet{FlagSet: cmd.Flags()}, "")
 
 	var pr int
 	cmd.Flags().IntVar(&pr, "pr", 0, "PR Number to update")
@@ -274,7 +436,7 @@ pipe it back to the post command.`,
 		if pr == 0 {
 			return kflags.NewUsageErrorf("A PR number MUST be specified with --pr")
 		}
-		repo, err := github.NewRepoClient(github.RepoClientFromFlags(context.Background(), gh))
+		repo, err := github.NewForgeFromFlags(context.Background(), ff)
 		if err != nil {
 			return err
 		}
@@ -323,13 +485,14 @@ pipe it back to the post command.`,
 func main() {
 	root := &cobra.Command{
 		Use:   "staco",
-		Short: "Tool to create and handle stable comments on github",
+		Short: "Tool to create and handle stable comments on github, gitlab or gitea",
 
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
 
 	root.AddCommand(PostCommand())
+	root.AddCommand(CheckCommand())
 	root.AddCommand(ShowCommand())
 	root.AddCommand(DiffCommand())
 